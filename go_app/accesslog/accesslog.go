@@ -0,0 +1,225 @@
+// Package accesslog writes one line per HTTP request, apart from the application log,
+// in the Common or Combined Log Format that log tooling has read for decades, or as
+// JSON for log pipelines. What goes into an entry is decided by the caller; MaskIP and
+// StripQuery help keep personal data out.
+package accesslog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Line formats
+const (
+	FORMAT_COMMON   = "common"   // NCSA Common Log Format
+	FORMAT_COMBINED = "combined" // Common plus the referer and user agent
+	FORMAT_JSON     = "json"
+)
+
+// Timestamp layout of the Common Log Format
+const CLF_TIME_LAYOUT = "02/Jan/2006:15:04:05 -0700"
+
+// One request
+type Entry struct {
+	Time      time.Time     `json:"time"`
+	ClientIP  string        `json:"clientIp"`
+	User      string        `json:"user,omitempty"`
+	Method    string        `json:"method"`
+	Path      string        `json:"path"` // with the query when it is logged
+	Protocol  string        `json:"protocol"`
+	Status    int           `json:"status"`
+	Bytes     int64         `json:"bytes"`
+	Duration  time.Duration `json:"-"`
+	Referer   string        `json:"referer,omitempty"`
+	UserAgent string        `json:"userAgent,omitempty"`
+	TraceID   string        `json:"traceId,omitempty"`
+}
+
+// Writes entries as lines in one format. Safe for concurrent use.
+type Logger struct {
+	format string
+	mutex  sync.Mutex
+	out    io.Writer
+}
+
+func New(format string, out io.Writer) (*Logger, error) {
+	switch format {
+	case FORMAT_COMMON, FORMAT_COMBINED, FORMAT_JSON:
+	default:
+		return nil, fmt.Errorf("access log format must be %s, %s or %s, got %q", FORMAT_COMMON, FORMAT_COMBINED, FORMAT_JSON, format)
+	}
+	return &Logger{format: format, out: out}, nil
+}
+
+// Writes entry as one line. Each line is a single Write, so writers that frame
+// messages, like syslog, get one entry per message.
+func (l *Logger) Log(entry Entry) error {
+	line := Format(l.format, entry)
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	_, err := l.out.Write(line)
+	return err
+}
+
+// Closes the destination when it can be closed
+func (l *Logger) Close() error {
+	if closer, ok := l.out.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// The line of entry in format, ending in a newline
+func Format(format string, entry Entry) []byte {
+	if format == FORMAT_JSON {
+		line, _ := json.Marshal(struct {
+			Entry
+			DurationMs float64 `json:"durationMs"`
+		}{entry, float64(entry.Duration.Microseconds()) / 1000})
+		return append(line, '\n')
+	}
+
+	var b strings.Builder
+	b.WriteString(field(entry.ClientIP))
+	b.WriteString(" - ")
+	b.WriteString(field(entry.User))
+	b.WriteString(" [")
+	b.WriteString(entry.Time.Format(CLF_TIME_LAYOUT))
+	b.WriteString("] ")
+	b.WriteString(quote(entry.Method + " " + entry.Path + " " + entry.Protocol))
+	b.WriteString(" ")
+	b.WriteString(strconv.Itoa(entry.Status))
+	b.WriteString(" ")
+	if entry.Bytes > 0 {
+		b.WriteString(strconv.FormatInt(entry.Bytes, 10))
+	} else {
+		b.WriteString("-")
+	}
+	if format == FORMAT_COMBINED {
+		b.WriteString(" ")
+		b.WriteString(quote(entry.Referer))
+		b.WriteString(" ")
+		b.WriteString(quote(entry.UserAgent))
+	}
+	b.WriteString("\n")
+	return []byte(b.String())
+}
+
+// An unquoted CLF field: "-" when empty, without spaces or control characters
+func field(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// A quoted CLF field, escaped so a client can't forge a line or end the field early
+func quote(value string) string {
+	if value == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < ' ' || r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, r)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// How client IPs are written
+const (
+	IP_MASKED = "masked" // the network only: IPv4 /24, IPv6 /48
+	IP_FULL   = "full"
+	IP_NONE   = "none"
+)
+
+// Reduces ip as mode says. Unless mode is IP_FULL, values that aren't IPs are
+// dropped.
+func MaskIP(ip, mode string) string {
+	switch mode {
+	case IP_FULL:
+		return ip
+	case IP_NONE:
+		return ""
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// A URL without its query and fragment, which often carry tokens, emails and search
+// terms. Referers are reduced to their origin and path the same way.
+func StripQuery(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		if path, _, ok := strings.Cut(raw, "?"); ok {
+			return path
+		}
+		return raw
+	}
+	parsed.RawQuery, parsed.Fragment, parsed.RawFragment, parsed.User = "", "", "", nil
+	return parsed.String()
+}
+
+// Where entries are written: "stdout", "stderr", "syslog" for the local syslog daemon,
+// "syslog://host:514" or "syslog+tcp://host:514" for a remote one, or a file path,
+// optionally as "file:///var/log/app/access.log". Files are rotated as rotation says.
+func Open(destination string, rotation Rotation) (io.Writer, error) {
+	switch {
+	case destination == "" || destination == "stdout":
+		return nopCloser{os.Stdout}, nil
+	case destination == "stderr":
+		return nopCloser{os.Stderr}, nil
+	case destination == "syslog" || strings.HasPrefix(destination, "syslog://") || strings.HasPrefix(destination, "syslog+tcp://"):
+		network, address := "", ""
+		if destination != "syslog" {
+			target, err := url.Parse(destination)
+			if err != nil || target.Host == "" {
+				return nil, fmt.Errorf("access log destination %q: invalid syslog address", destination)
+			}
+			network, address = "udp", target.Host
+			if target.Scheme == "syslog+tcp" {
+				network = "tcp"
+			}
+		}
+		return openSyslog(network, address)
+	}
+	path := strings.TrimPrefix(destination, "file://")
+	if path == "" {
+		return nil, errors.New("access log destination has no file path")
+	}
+	return OpenFile(path, rotation)
+}
+
+// Keeps the process's stdout and stderr open when the logger is closed
+type nopCloser struct {
+	io.Writer
+}
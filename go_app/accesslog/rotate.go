@@ -0,0 +1,106 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// When a log file is rotated: once it would grow past MaxBytes it is renamed to
+// path.1, path.1 to path.2 and so on, keeping MaxBackups of them
+type Rotation struct {
+	MaxBytes   int64 // 0 never rotates
+	MaxBackups int
+}
+
+// A log file rotated by size. Safe for concurrent use.
+type File struct {
+	path     string
+	rotation Rotation
+
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Opens path for appending, creating it and its directory as needed
+func OpenFile(path string, rotation Rotation) (*File, error) {
+	f := &File{path: path, rotation: rotation}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+// Appends p, rotating first when p would take the file past MaxBytes. A line is
+// never split across files.
+func (f *File) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+	if f.rotation.MaxBytes > 0 && f.size > 0 && f.size+int64(len(p)) > f.rotation.MaxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate %s: %w", f.path, err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// The caller holds the mutex
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+	if f.rotation.MaxBackups > 0 {
+		os.Remove(backupPath(f.path, f.rotation.MaxBackups))
+		for i := f.rotation.MaxBackups - 1; i >= 1; i-- {
+			if err := os.Rename(backupPath(f.path, i), backupPath(f.path, i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(f.path, backupPath(f.path, 1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func backupPath(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+func (f *File) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+
+package accesslog
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// Sends each entry as a syslog message from the "access" tag at LOG_INFO of the
+// LOG_LOCAL0 facility. network and address are empty for the local daemon.
+func openSyslog(network, address string) (io.Writer, error) {
+	return syslog.Dial(network, address, syslog.LOG_INFO|syslog.LOG_LOCAL0, "access")
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+
+package accesslog
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(network, address string) (io.Writer, error) {
+	return nil, errors.New("syslog is not available on this platform")
+}
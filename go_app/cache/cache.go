@@ -0,0 +1,296 @@
+// Package cache is an in-memory key-value cache split into shards, each with its own
+// lock, so concurrent requests for different keys rarely contend. Entries expire after
+// a TTL, and each shard evicts its least recently used entries beyond the size limits.
+// GetOrLoad collapses concurrent loads of a missing key into one call.
+//
+// The server keeps its metadata, response cache and rate limit buckets in caches.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// Per-cache counters and gauges, published on /debug/vars
+var cacheMetrics = expvar.NewMap("caches")
+
+// Shards when Options.Shards is not set
+const DEFAULT_SHARDS = 16
+
+type Options[V any] struct {
+	// Names the cache in the metrics; unnamed caches are not published
+	Name string
+	// Rounded up to a power of two, DEFAULT_SHARDS when less than 1
+	Shards int
+	// Lifetime of entries stored without one; 0 keeps them until evicted
+	TTL time.Duration
+	// Most entries kept, spread evenly over the shards; 0 is unlimited
+	MaxEntries int
+	// Most total Cost kept, spread evenly over the shards; 0 is unlimited
+	MaxCost int64
+	// Cost of a value, e.g. its size in bytes; every value costs 1 when nil
+	Cost func(V) int64
+	// Defaults to time.Now
+	Now func() time.Time
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	cost    int64
+	expires time.Time // zero when the entry doesn't expire
+}
+
+// A load in progress that concurrent callers wait for
+type load[V any] struct {
+	done  chan struct{}
+	value V
+	ttl   time.Duration
+	err   error
+}
+
+type shard[K comparable, V any] struct {
+	mutex   sync.Mutex
+	entries map[K]*list.Element // of *entry[K, V]
+	order   *list.List          // most recently used first
+	cost    int64
+	loads   map[K]*load[V]
+}
+
+// A sharded LRU cache, safe for concurrent use
+type Cache[K comparable, V any] struct {
+	options    Options[V]
+	seed       maphash.Seed
+	shards     []*shard[K, V]
+	maxEntries int   // per shard
+	maxCost    int64 // per shard
+	metrics    *expvar.Map
+}
+
+func New[K comparable, V any](options Options[V]) *Cache[K, V] {
+	count := 1
+	for count < options.Shards || options.Shards < 1 && count < DEFAULT_SHARDS {
+		count <<= 1
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	c := &Cache[K, V]{
+		options: options,
+		seed:    maphash.MakeSeed(),
+		shards:  make([]*shard[K, V], count),
+		metrics: new(expvar.Map),
+	}
+	if options.MaxEntries > 0 {
+		c.maxEntries = (options.MaxEntries + count - 1) / count
+	}
+	if options.MaxCost > 0 {
+		c.maxCost = (options.MaxCost + int64(count) - 1) / int64(count)
+	}
+	for i := range c.shards {
+		c.shards[i] = &shard[K, V]{entries: make(map[K]*list.Element), order: list.New(), loads: make(map[K]*load[V])}
+	}
+	c.metrics.Set("entries", expvar.Func(func() interface{} { return c.Len() }))
+	if options.Name != "" {
+		cacheMetrics.Set(options.Name, c.metrics)
+	}
+	return c
+}
+
+func (c *Cache[K, V]) shard(key K) *shard[K, V] {
+	return c.shards[maphash.Comparable(c.seed, key)&uint64(len(c.shards)-1)]
+}
+
+// Returns the value of key unless it is missing or expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return c.get(s, key)
+}
+
+// The caller holds the shard's lock
+func (c *Cache[K, V]) get(s *shard[K, V], key K) (V, bool) {
+	var zero V
+	element, ok := s.entries[key]
+	if !ok {
+		c.metrics.Add("misses", 1)
+		return zero, false
+	}
+	e := element.Value.(*entry[K, V])
+	if !e.expires.IsZero() && !c.options.Now().Before(e.expires) {
+		c.remove(s, element)
+		c.metrics.Add("expirations", 1)
+		c.metrics.Add("misses", 1)
+		return zero, false
+	}
+	s.order.MoveToFront(element)
+	c.metrics.Add("hits", 1)
+	return e.value, true
+}
+
+// Stores value under key for the default TTL
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.SetWithTTL(key, value, c.options.TTL)
+}
+
+// Stores value under key for ttl; 0 keeps it until evicted
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	c.set(s, key, value, ttl)
+}
+
+// The caller holds the shard's lock
+func (c *Cache[K, V]) set(s *shard[K, V], key K, value V, ttl time.Duration) {
+	e := &entry[K, V]{key: key, value: value, cost: 1}
+	if c.options.Cost != nil {
+		e.cost = c.options.Cost(value)
+	}
+	if ttl > 0 {
+		e.expires = c.options.Now().Add(ttl)
+	}
+	if element, ok := s.entries[key]; ok {
+		c.remove(s, element)
+	}
+	s.entries[key] = s.order.PushFront(e)
+	s.cost += e.cost
+	// The new entry stays even when it alone exceeds the cost limit, so a large value
+	// is still cached rather than silently dropped
+	for s.order.Len() > 1 && (c.maxEntries > 0 && s.order.Len() > c.maxEntries || c.maxCost > 0 && s.cost > c.maxCost) {
+		c.remove(s, s.order.Back())
+		c.metrics.Add("evictions", 1)
+	}
+}
+
+func (c *Cache[K, V]) remove(s *shard[K, V], element *list.Element) {
+	e := s.order.Remove(element).(*entry[K, V])
+	delete(s.entries, e.key)
+	s.cost -= e.cost
+}
+
+// Returns the value of key, loading and storing it with the default TTL when it is
+// missing. Concurrent callers for the same key wait for a single load and share its
+// result; errors are returned to all of them and not cached. A caller whose ctx ends
+// stops waiting, the load carries on for the others.
+func (c *Cache[K, V]) GetOrLoad(ctx context.Context, key K, loader func(ctx context.Context) (V, error)) (V, error) {
+	return c.GetOrLoadWithTTL(ctx, key, func(ctx context.Context) (V, time.Duration, error) {
+		value, err := loader(ctx)
+		return value, c.options.TTL, err
+	})
+}
+
+// GetOrLoad for values whose lifetime is only known once they are loaded, e.g. one
+// read from the value itself. The loader returns the TTL to store the value for.
+func (c *Cache[K, V]) GetOrLoadWithTTL(ctx context.Context, key K, loader func(ctx context.Context) (V, time.Duration, error)) (V, error) {
+	s := c.shard(key)
+	s.mutex.Lock()
+	for {
+		if value, ok := c.get(s, key); ok {
+			s.mutex.Unlock()
+			return value, nil
+		}
+		l, ok := s.loads[key]
+		if !ok {
+			break
+		}
+		s.mutex.Unlock()
+		c.metrics.Add("shared_loads", 1)
+		select {
+		case <-l.done:
+		case <-ctx.Done():
+			var zero V
+			return zero, ctx.Err()
+		}
+		// A load abandoned by its caller, e.g. on a client disconnect, is retried by
+		// the callers still waiting
+		if !isContextError(l.err) || ctx.Err() != nil {
+			return l.value, l.err
+		}
+		s.mutex.Lock()
+	}
+	l := &load[V]{done: make(chan struct{})}
+	s.loads[key] = l
+	s.mutex.Unlock()
+
+	c.metrics.Add("loads", 1)
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			l.err = fmt.Errorf("cache load panicked: %v", recovered)
+			c.finishLoad(s, key, l)
+			panic(recovered)
+		}
+		c.finishLoad(s, key, l)
+	}()
+	l.value, l.ttl, l.err = loader(ctx)
+	return l.value, l.err
+}
+
+func isContextError(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func (c *Cache[K, V]) finishLoad(s *shard[K, V], key K, l *load[V]) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.loads, key)
+	if l.err == nil {
+		c.set(s, key, l.value, l.ttl)
+	} else {
+		c.metrics.Add("load_errors", 1)
+	}
+	close(l.done)
+}
+
+func (c *Cache[K, V]) Delete(key K) {
+	s := c.shard(key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if element, ok := s.entries[key]; ok {
+		c.remove(s, element)
+	}
+}
+
+// Removes the entries match returns true for, e.g. every key with a prefix
+func (c *Cache[K, V]) DeleteFunc(match func(key K, value V) bool) {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		for element := s.order.Front(); element != nil; {
+			next := element.Next()
+			if e := element.Value.(*entry[K, V]); match(e.key, e.value) {
+				c.remove(s, element)
+			}
+			element = next
+		}
+		s.mutex.Unlock()
+	}
+}
+
+// Removes every entry
+func (c *Cache[K, V]) Clear() {
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		s.entries = make(map[K]*list.Element)
+		s.order.Init()
+		s.cost = 0
+		s.mutex.Unlock()
+	}
+}
+
+// Entries stored, expired ones included until they are looked up or evicted
+func (c *Cache[K, V]) Len() int {
+	total := 0
+	for _, s := range c.shards {
+		s.mutex.Lock()
+		total += s.order.Len()
+		s.mutex.Unlock()
+	}
+	return total
+}
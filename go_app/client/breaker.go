@@ -0,0 +1,98 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Consecutive failures that open a host's circuit
+const DEFAULT_BREAKER_THRESHOLD = 5
+
+// How long an open circuit fails calls before letting one through to probe the host
+const DEFAULT_BREAKER_COOLDOWN = 30 * time.Second
+
+// Returned, wrapped with the host, by calls made while the host's circuit is open
+var ErrCircuitOpen = errors.New("client: circuit open")
+
+// Circuit breakers by host, shared by every Client using them. After Threshold
+// consecutive failures a host's circuit opens and calls fail with ErrCircuitOpen
+// without being sent. Once Cooldown has passed, one call is let through: its success
+// closes the circuit, its failure opens it for another Cooldown.
+//
+// Failures are network errors and 5xx answers other than a 503 with Retry-After, which
+// is the service saying when to come back rather than being down.
+type Breakers struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mutex sync.Mutex
+	hosts map[string]*breaker
+}
+
+// The breakers of clients built by New
+var DefaultBreakers = NewBreakers(DEFAULT_BREAKER_THRESHOLD, DEFAULT_BREAKER_COOLDOWN)
+
+func NewBreakers(threshold int, cooldown time.Duration) *Breakers {
+	return &Breakers{Threshold: threshold, Cooldown: cooldown, hosts: map[string]*breaker{}}
+}
+
+type breaker struct {
+	failures  int
+	openUntil time.Time // zero while closed
+	probing   bool      // a call is testing the host after the cooldown
+}
+
+// Lets a call to host through, or fails while its circuit is open or already probed
+func (b *Breakers) allow(host string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state := b.hosts[host]
+	if state == nil || state.openUntil.IsZero() {
+		return nil
+	}
+	if time.Now().Before(state.openUntil) || state.probing {
+		return fmt.Errorf("%w: %s", ErrCircuitOpen, host)
+	}
+	state.probing = true
+	return nil
+}
+
+// Records the outcome of a call allowed to host: the response, or err when none came.
+// ctx is the call's, to tell a caller giving up from a host timing out.
+func (b *Breakers) record(ctx context.Context, host string, resp *http.Response, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	state := b.hosts[host]
+	if state == nil {
+		state = &breaker{}
+		b.hosts[host] = state
+	}
+	// The caller gave up, which says nothing about the host
+	if err != nil && ctx.Err() != nil {
+		state.probing = false
+		return
+	}
+	if !failed(resp, err) {
+		*state = breaker{}
+		return
+	}
+	state.failures++
+	if state.probing || state.failures >= b.Threshold {
+		state.openUntil = time.Now().Add(b.Cooldown)
+		state.probing = false
+	}
+}
+
+func failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	if resp.StatusCode == http.StatusServiceUnavailable && resp.Header.Get("Retry-After") != "" {
+		return false
+	}
+	return resp.StatusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,132 @@
+package client
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/cache"
+)
+
+// Body bytes kept by the cache of New
+const DEFAULT_CACHE_SIZE = 8 << 20
+
+// GET answers kept as the service's Cache-Control, ETag and Last-Modified allow. A
+// fresh answer is reused without a request; a stale one with a validator is revalidated
+// with If-None-Match or If-Modified-Since, and a 304 reuses its body. Entries belong to
+// the identity of the Client using the cache, so Login and SetToken clear it.
+type ResponseCache struct {
+	entries *cache.Cache[string, *cachedResponse]
+}
+
+// A cache holding up to maxBytes of bodies, evicting the least recently used ones
+func NewResponseCache(maxBytes int64) *ResponseCache {
+	return &ResponseCache{entries: cache.New[string](cache.Options[*cachedResponse]{
+		MaxCost: maxBytes,
+		Cost:    func(response *cachedResponse) int64 { return int64(len(response.body)) },
+	})}
+}
+
+// Drops every entry
+func (c *ResponseCache) Clear() {
+	c.entries.Clear()
+}
+
+func (c *ResponseCache) get(url string) *cachedResponse {
+	response, _ := c.entries.Get(url)
+	return response
+}
+
+// Keeps the answer to url if its headers allow, dropping an older entry otherwise
+func (c *ResponseCache) store(url string, header http.Header, body []byte) {
+	response, ok := newCachedResponse(header, body)
+	if !ok {
+		c.entries.Delete(url)
+		return
+	}
+	c.entries.Set(url, response)
+}
+
+// An answer kept by ResponseCache. Never changed once stored, as concurrent calls share it.
+type cachedResponse struct {
+	body         []byte
+	etag         string
+	lastModified string
+	freshUntil   time.Time // zero when every use must be revalidated
+}
+
+// Reports whether the answer may be used without asking the service
+func (r *cachedResponse) fresh() bool {
+	return time.Now().Before(r.freshUntil)
+}
+
+// Makes req conditional on the answer still being current
+func (r *cachedResponse) setValidators(req *http.Request) {
+	if r.etag != "" {
+		req.Header.Set("If-None-Match", r.etag)
+	}
+	if r.lastModified != "" {
+		req.Header.Set("If-Modified-Since", r.lastModified)
+	}
+}
+
+// The entry for an answer with header, false when it must not or can't usefully be
+// kept: no-store, Vary: *, or neither a max-age nor a validator
+func newCachedResponse(header http.Header, body []byte) (*cachedResponse, bool) {
+	control := parseCacheControl(header.Get("Cache-Control"))
+	if control.noStore || header.Get("Vary") == "*" {
+		return nil, false
+	}
+	response := &cachedResponse{
+		body:         body,
+		etag:         header.Get("ETag"),
+		lastModified: header.Get("Last-Modified"),
+	}
+	if !control.noCache && control.maxAge > 0 {
+		// Age is how long the answer already spent in caches on the way
+		age, _ := strconv.Atoi(header.Get("Age"))
+		response.freshUntil = time.Now().Add(control.maxAge - time.Duration(age)*time.Second)
+	}
+	if response.freshUntil.IsZero() && response.etag == "" && response.lastModified == "" {
+		return nil, false
+	}
+	return response, true
+}
+
+// The headers of a 304 answering cached's revalidation, with the validators it left out
+func mergeHeader(cached *cachedResponse, header http.Header) http.Header {
+	merged := header.Clone()
+	if merged.Get("ETag") == "" && cached.etag != "" {
+		merged.Set("ETag", cached.etag)
+	}
+	if merged.Get("Last-Modified") == "" && cached.lastModified != "" {
+		merged.Set("Last-Modified", cached.lastModified)
+	}
+	return merged
+}
+
+// The Cache-Control directives the cache acts on
+type cacheControl struct {
+	noStore bool
+	noCache bool
+	maxAge  time.Duration
+}
+
+func parseCacheControl(header string) cacheControl {
+	var control cacheControl
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store":
+			control.noStore = true
+		case "no-cache":
+			control.noCache = true
+		case "max-age":
+			if seconds, err := strconv.Atoi(strings.Trim(value, `"`)); err == nil && seconds > 0 {
+				control.maxAge = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return control
+}
@@ -0,0 +1,412 @@
+// Package client calls this service from other Go services: typed methods for its
+// endpoints, retries with backoff, circuit breaking per host, caching of GET answers,
+// and tokens that are refreshed before they expire.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of the default HTTP client, per attempt
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// Attempts after the first one for a retryable failure
+const DEFAULT_MAX_RETRIES = 3
+
+// First backoff delay; each retry doubles it, with jitter
+const RETRY_BASE_DELAY = 200 * time.Millisecond
+
+// Longest wait between attempts. A Retry-After beyond it is not waited out.
+const RETRY_MAX_DELAY = 5 * time.Second
+
+// Tokens are refreshed this long before their exp
+const REFRESH_MARGIN = 30 * time.Second
+
+// Largest response body read
+const MAX_RESPONSE_SIZE = 1 << 20
+
+// A response other than 2xx. Message is the service's "error" field, in the client's
+// Accept-Language if it sends one; Code is the same in every language.
+type Error struct {
+	StatusCode int
+	Code       string // e.g. "invalid_credentials"
+	Message    string
+	Retryable  bool          // the service says the same request may succeed later
+	RetryAfter time.Duration // zero without a Retry-After header
+	Body       []byte
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("%d %s", e.StatusCode, e.Message)
+}
+
+// Reports whether err is an *Error with the given status
+func IsStatus(err error, status int) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
+
+// One entry of a /status answer: this service, or a downstream folded into it
+type StatusEntry struct {
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version,omitempty"`
+	Build       string `json:"build,omitempty"`
+	SHA         string `json:"sha,omitempty"`
+	ConfigState string `json:"configState,omitempty"`
+	Error       string `json:"error,omitempty"`
+
+	// Set on downstream entries
+	Name    string `json:"name,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Latency string `json:"latency,omitempty"`
+}
+
+// A /status answer, keyed by application name
+type Status map[string][]StatusEntry
+
+// Calls one instance of the service. Safe for concurrent use once configured.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	MaxRetries int
+	Cache      *ResponseCache // nil sends every GET
+	Breakers   *Breakers      // nil never fails fast
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time // zero when the token carries no exp
+}
+
+// Builds a client for the service at baseURL, e.g. "http://auth.internal:3000"
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: DEFAULT_TIMEOUT},
+		MaxRetries: DEFAULT_MAX_RETRIES,
+		Cache:      NewResponseCache(DEFAULT_CACHE_SIZE),
+		Breakers:   DefaultBreakers,
+	}
+}
+
+// The current token, empty before Login or SetToken
+func (c *Client) Token() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.token
+}
+
+// Uses a token obtained elsewhere, e.g. passed in by a caller
+func (c *Client) SetToken(token string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setToken(token)
+	c.clearCache()
+}
+
+// Forgets the answers cached for the previous identity
+func (c *Client) clearCache() {
+	if c.Cache != nil {
+		c.Cache.Clear()
+	}
+}
+
+func (c *Client) setToken(token string) {
+	c.token = token
+	c.expires = tokenExpiry(token)
+}
+
+// Exchanges credentials for a token, which later calls use. otp is the TOTP or recovery
+// code for users with two-factor authentication, empty otherwise.
+func (c *Client) Login(ctx context.Context, username, password, otp string) (string, error) {
+	request := map[string]string{"username": username, "password": password}
+	if otp != "" {
+		request["otp"] = otp
+	}
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/login", "", request, &response); err != nil {
+		return "", err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setToken(response.Token)
+	c.clearCache()
+	return response.Token, nil
+}
+
+// Exchanges the current token, expired or not, for a new one
+func (c *Client) Refresh(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.refresh(ctx, c.token)
+}
+
+// Refreshes stale unless another caller already replaced it. Called with the mutex held,
+// so concurrent callers wait for one refresh instead of each sending their own.
+func (c *Client) refresh(ctx context.Context, stale string) (string, error) {
+	if c.token != stale {
+		return c.token, nil
+	}
+	if stale == "" {
+		return "", errors.New("client: no token to refresh, call Login first")
+	}
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/refresh", stale, nil, &response); err != nil {
+		return "", err
+	}
+	c.setToken(response.Token)
+	return response.Token, nil
+}
+
+// Fetches the service's /status. While the service is degraded it answers 503; the
+// status is then returned along with the *Error.
+func (c *Client) Status(ctx context.Context) (Status, error) {
+	var status Status
+	err := c.authorized(ctx, http.MethodGet, "/status", nil, &status)
+	var apiErr *Error
+	if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusServiceUnavailable {
+		if json.Unmarshal(apiErr.Body, &status) != nil {
+			return nil, err
+		}
+		return status, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Sends a request with the current token, refreshing it when it is about to expire or
+// refused. The service accepts most tokens only once and answers 403 on reuse, so the
+// refresh after a refusal is the common case.
+func (c *Client) authorized(ctx context.Context, method, path string, body, out any) error {
+	c.mutex.Lock()
+	token := c.token
+	if token != "" && !c.expires.IsZero() && time.Until(c.expires) < REFRESH_MARGIN {
+		var err error
+		if token, err = c.refresh(ctx, token); err != nil {
+			c.mutex.Unlock()
+			return fmt.Errorf("client: refresh token: %w", err)
+		}
+	}
+	c.mutex.Unlock()
+
+	err := c.do(ctx, method, path, token, body, out)
+	if token == "" || !(IsStatus(err, http.StatusUnauthorized) || IsStatus(err, http.StatusForbidden)) {
+		return err
+	}
+	c.mutex.Lock()
+	token, refreshErr := c.refresh(ctx, token)
+	c.mutex.Unlock()
+	if refreshErr != nil {
+		return err
+	}
+	return c.do(ctx, method, path, token, body, out)
+}
+
+// Sends one request, retrying what is safe to retry, and decodes a 2xx JSON answer into out
+func (c *Client) do(ctx context.Context, method, path, token string, body, out any) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, path, token, payload, out)
+		if err == nil {
+			return nil
+		}
+		delay, retry := c.retryDelay(ctx, method, err, attempt)
+		if !retry {
+			return err
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path, token string, payload []byte, out any) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	var cached *cachedResponse
+	if method == http.MethodGet && c.Cache != nil {
+		if cached = c.Cache.get(req.URL.String()); cached != nil {
+			if cached.fresh() {
+				return decode(method, path, cached.body, out)
+			}
+			cached.setValidators(req)
+		}
+	}
+
+	if c.Breakers != nil {
+		if err := c.Breakers.allow(req.URL.Host); err != nil {
+			return err
+		}
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if c.Breakers != nil {
+		c.Breakers.record(ctx, req.URL.Host, resp, err)
+	}
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MAX_RESPONSE_SIZE))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		// The 304 carries the current freshness; the body is the one kept
+		c.Cache.store(req.URL.String(), mergeHeader(cached, resp.Header), cached.body)
+		return decode(method, path, cached.body, out)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		apiErr := &Error{StatusCode: resp.StatusCode, Body: data}
+		var message struct {
+			Error     string `json:"error"`
+			Code      string `json:"code"`
+			Retryable bool   `json:"retryable"`
+		}
+		if json.Unmarshal(data, &message) == nil {
+			apiErr.Message, apiErr.Code, apiErr.Retryable = message.Error, message.Code, message.Retryable
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return apiErr
+	}
+	if method == http.MethodGet && c.Cache != nil {
+		c.Cache.store(req.URL.String(), resp.Header, data)
+	}
+	return decode(method, path, data, out)
+}
+
+// Decodes a 2xx JSON answer into out
+func decode(method, path string, data []byte, out any) error {
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("client: decode %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// Reports whether repeating a request with method leaves the service as one request
+// would, so a failure whose outcome is unknown can be retried
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// Whether and how long to wait before the next attempt. Throttling and unavailability are
+// retried for any method, since the service did not act on the request. Gateway errors and
+// network failures, timeouts of an attempt included, are retried only for idempotent
+// methods, where repeating is harmless. Nothing is retried once ctx is done or the
+// host's circuit is open.
+func (c *Client) retryDelay(ctx context.Context, method string, err error, attempt int) (time.Duration, bool) {
+	if attempt >= c.MaxRetries || ctx.Err() != nil || errors.Is(err, ErrCircuitOpen) {
+		return 0, false
+	}
+
+	var apiErr *Error
+	switch {
+	case errors.As(err, &apiErr):
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		case http.StatusBadGateway, http.StatusGatewayTimeout:
+			if !idempotent(method) {
+				return 0, false
+			}
+		default:
+			return 0, false
+		}
+		if apiErr.RetryAfter > RETRY_MAX_DELAY {
+			return 0, false
+		}
+		if apiErr.RetryAfter > 0 {
+			return apiErr.RetryAfter, true
+		}
+	case !idempotent(method):
+		return 0, false
+	}
+	return backoff(attempt), true
+}
+
+// Exponential backoff with full jitter, capped at RETRY_MAX_DELAY
+func backoff(attempt int) time.Duration {
+	limit := RETRY_BASE_DELAY << attempt
+	if limit <= 0 || limit > RETRY_MAX_DELAY {
+		limit = RETRY_MAX_DELAY
+	}
+	return time.Duration(rand.Int64N(int64(limit))) + time.Millisecond
+}
+
+// The exp claim of a JWT, read without verifying it; the service does that
+func tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
@@ -0,0 +1,348 @@
+// Command scaffold performs operator tasks against a running service.
+//
+//	scaffold keys rotate [-url http://localhost:3000] [-admin-token TOKEN]
+//	scaffold encrypt [-key KEY | -kms-key KEY] [-type str] VALUE
+//	scaffold doctor [CONFIG FLAGS]
+//	scaffold errors export
+//	scaffold config schema
+//	scaffold config validate [-format FORMAT] [-env PROFILE] FILE
+//	scaffold self-update [-url URL] [-public-key KEY] [-check] [-force]
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/configcrypt"
+	"go_app/configformat"
+	"go_app/selfupdate"
+	"go_app/server"
+)
+
+const USAGE = `Usage:
+  scaffold keys rotate [-url URL] [-admin-token TOKEN]
+      Rotate the token signing key of a running service.
+  scaffold encrypt [-key KEY | -kms-key KEY] [-type str|int|float|bool] VALUE
+      Print VALUE as an ENC[...] value for metadata.json.
+  scaffold encrypt -new-key
+      Print a new random metadata key.
+  scaffold doctor [CONFIG FLAGS]
+      Check the service config and its dependencies as the service would see them.
+      Takes the service's flags, config file and APP_* environment variables.
+  scaffold errors export
+      Print the catalog of error codes as JSON: status, message key, retryability
+      and the message in every shipped language.
+  scaffold config schema
+      Print the JSON Schema of the metadata document.
+  scaffold config validate [-format FORMAT] [-env PROFILE] FILE
+      Check a metadata document against the schema, with the overlay of PROFILE
+      merged in as the service would. Fails when it has problems.
+  scaffold self-update [-url URL] [-public-key KEY] [-check] [-force]
+      Replace this binary with the latest release, after verifying the signature
+      of its checksums and the checksum of the download. -check only reports
+      whether there is a newer release.
+`
+
+// Environment variable holding the admin token, as read by the service itself
+const ADMIN_TOKEN_ENV = "APP_ADMIN_TOKEN"
+
+// Environment variables holding the release manifest URL and the release signing key
+// for self-update
+const (
+	UPDATE_URL_ENV        = "SCAFFOLD_UPDATE_URL"
+	UPDATE_PUBLIC_KEY_ENV = "SCAFFOLD_UPDATE_PUBLIC_KEY"
+)
+
+// Defaults for self-update, set at link time by teams distributing their own builds, e.g.
+// -ldflags "-X main.UpdateURL=https://releases.example.com/scaffold/latest.json -X main.UpdatePublicKey=BASE64"
+var (
+	UpdateURL       string
+	UpdatePublicKey string
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "scaffold:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	switch {
+	case len(args) >= 2 && args[0] == "keys" && args[1] == "rotate":
+		return rotateKeys(args[2:], stdout)
+	case len(args) >= 1 && args[0] == "encrypt":
+		return encrypt(args[1:], stdout)
+	case len(args) >= 1 && args[0] == "doctor":
+		return doctor(args[1:], stdout)
+	case len(args) >= 2 && args[0] == "errors" && args[1] == "export":
+		return exportErrors(args[2:], stdout)
+	case len(args) >= 2 && args[0] == "config" && args[1] == "schema":
+		return printSchema(args[2:], stdout)
+	case len(args) >= 2 && args[0] == "config" && args[1] == "validate":
+		return validateConfig(args[2:], stdout)
+	case len(args) >= 1 && args[0] == "self-update":
+		return selfUpdate(args[1:], stdout)
+	default:
+		fmt.Fprint(os.Stderr, USAGE)
+		return errors.New("unknown command")
+	}
+}
+
+// Admin token from APP_ADMIN_TOKEN, falling back to the legacy ADMIN_TOKEN
+func defaultAdminToken() string {
+	if token := os.Getenv(ADMIN_TOKEN_ENV); token != "" {
+		return token
+	}
+	return os.Getenv("ADMIN_TOKEN")
+}
+
+func rotateKeys(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	url := fs.String("url", "http://localhost:3000", "base URL of the service")
+	adminToken := fs.String("admin-token", defaultAdminToken(), "admin token (default from "+ADMIN_TOKEN_ENV+")")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *adminToken == "" {
+		return errors.New("an admin token is required")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*url, "/")+"/admin/keys/rotate", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Admin-Token", *adminToken)
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Kid       string   `json:"kid"`
+		Algorithm string   `json:"algorithm"`
+		ValidKids []string `json:"validKids"`
+		Error     string   `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("%s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, result.Error)
+	}
+
+	fmt.Fprintf(stdout, "Rotated to %s key %s\n", result.Algorithm, result.Kid)
+	fmt.Fprintf(stdout, "Keys valid for verification: %s\n", strings.Join(result.ValidKids, ", "))
+	return nil
+}
+
+func encrypt(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	key := fs.String("key", os.Getenv("APP_METADATA_KEY"), "base64 metadata key or @file (default from APP_METADATA_KEY)")
+	kmsKey := fs.String("kms-key", os.Getenv("APP_METADATA_KMS_KEY"), "KMS-encrypted metadata key or @file (default from APP_METADATA_KMS_KEY)")
+	valueType := fs.String("type", configcrypt.TYPE_STRING, "type of VALUE: str, int, float or bool")
+	newKey := fs.Bool("new-key", false, "print a new random metadata key instead")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *newKey {
+		generated, err := configcrypt.GenerateKey()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(generated))
+		return nil
+	}
+	if fs.NArg() != 1 {
+		return errors.New("exactly one VALUE is required")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cipher, err := configcrypt.LoadCipher(ctx, *key, *kmsKey)
+	if err != nil {
+		return err
+	}
+	if cipher == nil {
+		return errors.New("a key is required, see -key and -kms-key")
+	}
+
+	var value interface{}
+	text := fs.Arg(0)
+	switch *valueType {
+	case configcrypt.TYPE_STRING:
+		value = text
+	case configcrypt.TYPE_INT:
+		value, err = strconv.ParseInt(text, 10, 64)
+	case configcrypt.TYPE_FLOAT:
+		value, err = strconv.ParseFloat(text, 64)
+	case configcrypt.TYPE_BOOL:
+		value, err = strconv.ParseBool(text)
+	default:
+		err = fmt.Errorf("unknown type %q", *valueType)
+	}
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := cipher.Encrypt(value)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, encrypted)
+	return nil
+}
+
+func doctor(args []string, stdout io.Writer) error {
+	config, err := server.LoadConfig(args)
+	if err != nil {
+		return err
+	}
+	if !server.WriteCheckReport(stdout, server.Check(context.Background(), config)) {
+		return errors.New("some checks failed")
+	}
+	return nil
+}
+
+func exportErrors(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("errors export", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(server.ErrorCatalog())
+}
+
+func printSchema(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("config schema", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(server.MetadataSchema())
+}
+
+func validateConfig(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("config validate", flag.ContinueOnError)
+	format := fs.String("format", configformat.AUTO, "format of the document: auto (by extension, else JSON), "+strings.Join(configformat.Names(), ", "))
+	profile := fs.String("env", "", "profile whose overlay, e.g. metadata.staging.json, is merged in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("config validate takes one file")
+	}
+	path := fs.Arg(0)
+	metadata, err := server.LoadMetadataFile(path, *format, *profile)
+	if err != nil {
+		return err
+	}
+	problems := server.ValidateMetadata(metadata)
+	for _, problem := range problems {
+		fmt.Fprintf(stdout, "%s: %s\n", path, problem)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s has %d problems", path, len(problems))
+	}
+	fmt.Fprintf(stdout, "%s: ok\n", path)
+	return nil
+}
+
+// Value of the environment variable, falling back to the link-time default
+func envOr(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Version of this binary: the link-time server.BuildVersion, else the module version
+func currentVersion() string {
+	if server.BuildVersion != "" {
+		return server.BuildVersion
+	}
+	if build, ok := debug.ReadBuildInfo(); ok && build.Main.Version != "(devel)" {
+		return strings.TrimPrefix(build.Main.Version, "v")
+	}
+	return ""
+}
+
+func selfUpdate(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	url := fs.String("url", envOr(UPDATE_URL_ENV, UpdateURL), "URL of the release manifest (default from "+UPDATE_URL_ENV+")")
+	publicKey := fs.String("public-key", envOr(UPDATE_PUBLIC_KEY_ENV, UpdatePublicKey), "Ed25519 key releases are signed with, base64 or PEM, or @file (default from "+UPDATE_PUBLIC_KEY_ENV+")")
+	check := fs.Bool("check", false, "only report whether a newer release exists")
+	force := fs.Bool("force", false, "install the latest release even if it isn't newer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *url == "" {
+		return errors.New("a release URL is required, see -url")
+	}
+
+	// Even -check needs the key: the version is only trusted once the manifest's
+	// signature checks out
+	text := *publicKey
+	if path, ok := strings.CutPrefix(text, "@"); ok {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		text = string(content)
+	}
+	if text == "" {
+		return errors.New("a public key is required to verify releases, see -public-key")
+	}
+	key, err := selfupdate.ParsePublicKey(text)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selfupdate.FETCH_TIMEOUT)
+	defer cancel()
+	current := currentVersion()
+	updater := selfupdate.New(selfupdate.Options{URL: *url, PublicKey: key, Current: current, Force: *force})
+	release, err := updater.Latest(ctx)
+	if err != nil {
+		return err
+	}
+	newer := selfupdate.Newer(release.Version, current)
+	if current == "" {
+		current = "unknown"
+	}
+	if !newer && !*force {
+		fmt.Fprintf(stdout, "Up to date: %s, latest release %s\n", current, release.Version)
+		return nil
+	}
+	if *check {
+		fmt.Fprintf(stdout, "Release %s is available, running %s\n", release.Version, current)
+		return nil
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if err := updater.Install(ctx, release, executable); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Updated %s from %s to %s\n", executable, current, release.Version)
+	return nil
+}
@@ -0,0 +1,203 @@
+// Package configcrypt encrypts individual configuration values so secrets can be kept
+// next to plain settings. Values use a sops-style envelope:
+//
+//	ENC[AES256_GCM,data:<base64>,iv:<base64>,tag:<base64>,type:str]
+//
+// All values in a document share one 256-bit data key, given directly or encrypted
+// with AWS KMS.
+package configcrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	PREFIX   = "ENC[AES256_GCM,"
+	KEY_SIZE = 32
+)
+
+// Value types recorded in the envelope so numbers and booleans survive encryption
+const (
+	TYPE_STRING = "str"
+	TYPE_INT    = "int"
+	TYPE_FLOAT  = "float"
+	TYPE_BOOL   = "bool"
+)
+
+var ErrNoKey = errors.New("configuration has encrypted values but no decryption key is configured")
+
+// Encrypts and decrypts values with a data key
+type Cipher struct {
+	key []byte
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KEY_SIZE {
+		return nil, fmt.Errorf("data key must be %d bytes, got %d", KEY_SIZE, len(key))
+	}
+	return &Cipher{key: key}, nil
+}
+
+// Random data key for new documents
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KEY_SIZE)
+	_, err := rand.Read(key)
+	return key, err
+}
+
+// Data key from its base64 encoding; values starting with "@" name a file holding it
+func ParseKey(value string) ([]byte, error) {
+	if strings.HasPrefix(value, "@") {
+		content, err := os.ReadFile(value[1:])
+		if err != nil {
+			return nil, err
+		}
+		value = string(content)
+	}
+	return base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+}
+
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, PREFIX) && strings.HasSuffix(value, "]")
+}
+
+// Encrypts a string, integer, float or boolean into an ENC[...] envelope
+func (c *Cipher) Encrypt(value interface{}) (string, error) {
+	var plaintext, valueType string
+	switch v := value.(type) {
+	case string:
+		plaintext, valueType = v, TYPE_STRING
+	case int:
+		plaintext, valueType = strconv.Itoa(v), TYPE_INT
+	case int64:
+		plaintext, valueType = strconv.FormatInt(v, 10), TYPE_INT
+	case float64:
+		plaintext, valueType = strconv.FormatFloat(v, 'g', -1, 64), TYPE_FLOAT
+	case bool:
+		plaintext, valueType = strconv.FormatBool(v), TYPE_BOOL
+	default:
+		return "", fmt.Errorf("cannot encrypt %T", value)
+	}
+
+	gcm, err := c.gcm(12)
+	if err != nil {
+		return "", err
+	}
+	iv := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(iv); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nil, iv, []byte(plaintext), nil)
+	data, tag := sealed[:len(sealed)-gcm.Overhead()], sealed[len(sealed)-gcm.Overhead():]
+
+	encode := base64.StdEncoding.EncodeToString
+	return fmt.Sprintf("%sdata:%s,iv:%s,tag:%s,type:%s]", PREFIX, encode(data), encode(iv), encode(tag), valueType), nil
+}
+
+// Decrypts an ENC[...] envelope into a value of its recorded type
+func (c *Cipher) Decrypt(envelope string) (interface{}, error) {
+	if !IsEncrypted(envelope) {
+		return nil, errors.New("not an encrypted value")
+	}
+	fields := map[string]string{}
+	for _, field := range strings.Split(strings.TrimSuffix(strings.TrimPrefix(envelope, PREFIX), "]"), ",") {
+		name, value, _ := strings.Cut(field, ":")
+		fields[name] = value
+	}
+
+	var parts [3][]byte
+	for i, name := range []string{"data", "iv", "tag"} {
+		decoded, err := base64.StdEncoding.DecodeString(fields[name])
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s: %w", name, err)
+		}
+		parts[i] = decoded
+	}
+	data, iv, tag := parts[0], parts[1], parts[2]
+	if len(iv) == 0 {
+		return nil, errors.New("missing iv")
+	}
+
+	gcm, err := c.gcm(len(iv))
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), nil)
+	if err != nil {
+		return nil, errors.New("decryption failed, wrong key or tampered value")
+	}
+
+	switch text := string(plaintext); fields["type"] {
+	case TYPE_STRING, "":
+		return text, nil
+	case TYPE_INT:
+		return strconv.ParseInt(text, 10, 64)
+	case TYPE_FLOAT:
+		return strconv.ParseFloat(text, 64)
+	case TYPE_BOOL:
+		return strconv.ParseBool(text)
+	default:
+		return nil, fmt.Errorf("unknown value type %q", fields["type"])
+	}
+}
+
+// Accepts the IV sizes of other sops-style tools as well as the standard 12 bytes
+func (c *Cipher) gcm(nonceSize int) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithNonceSize(block, nonceSize)
+}
+
+// Replaces every encrypted string in a decoded JSON document with its plaintext value.
+// c may be nil, in which case documents with encrypted values fail with ErrNoKey.
+func DecryptTree(c *Cipher, document interface{}) (interface{}, error) {
+	return decryptTree(c, document, "")
+}
+
+func decryptTree(c *Cipher, node interface{}, path string) (interface{}, error) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for name, child := range v {
+			decrypted, err := decryptTree(c, child, path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			v[name] = decrypted
+		}
+	case []interface{}:
+		for i, child := range v {
+			decrypted, err := decryptTree(c, child, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = decrypted
+		}
+	case string:
+		if !IsEncrypted(v) {
+			return v, nil
+		}
+		if c == nil {
+			return nil, ErrNoKey
+		}
+		value, err := c.Decrypt(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", strings.TrimPrefix(path, "."), err)
+		}
+		// Keep numbers as float64 like encoding/json does
+		if n, ok := value.(int64); ok {
+			return float64(n), nil
+		}
+		return value, nil
+	}
+	return node, nil
+}
@@ -0,0 +1,120 @@
+// Package configformat decodes the metadata document from the formats teams keep it
+// in: JSON, YAML, TOML and HCL. Whatever the format, the result has the shape
+// encoding/json gives: objects are map[string]interface{}, arrays []interface{} and
+// numbers float64, so code reading the metadata never sees the difference.
+package configformat
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Names of the built-in formats, also accepted by ByName
+const (
+	JSON = "json"
+	YAML = "yaml"
+	TOML = "toml"
+	HCL  = "hcl"
+)
+
+// Picks the format from the document's name
+const AUTO = "auto"
+
+// Turns a document into its top-level object
+type Decoder func(content []byte) (map[string]interface{}, error)
+
+var (
+	mutex      sync.RWMutex
+	decoders   = map[string]Decoder{}
+	extensions = map[string]string{}
+)
+
+func init() {
+	Register(JSON, decodeJSON, ".json")
+	Register(YAML, Normalize(decodeYAML), ".yaml", ".yml")
+	Register(TOML, Normalize(decodeTOML), ".toml")
+	Register(HCL, Normalize(decodeHCL), ".hcl")
+}
+
+// Adds or replaces the format name, detected by the given file extensions. Decoders
+// that produce other Go types than encoding/json should be wrapped with Normalize.
+func Register(name string, decoder Decoder, exts ...string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	decoders[name] = decoder
+	for _, ext := range exts {
+		extensions[strings.ToLower(ext)] = name
+	}
+}
+
+// Names of the registered formats, sorted
+func Names() []string {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	names := make([]string, 0, len(decoders))
+	for name := range decoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The decoder for format, or with AUTO the one whose extension documentName has. Names
+// without a known extension, e.g. a Consul key, are read as JSON.
+func ByName(format, documentName string) (Decoder, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if format == "" || format == AUTO {
+		// Query strings of URL sources don't belong to the extension
+		name, _, _ := strings.Cut(documentName, "?")
+		format = JSON
+		if detected, ok := extensions[strings.ToLower(path.Ext(name))]; ok {
+			format = detected
+		}
+	}
+	decoder, ok := decoders[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown metadata format %q", format)
+	}
+	return decoder, nil
+}
+
+// Wraps decoder so its result is converted to encoding/json types, e.g. YAML integers
+// become float64 and timestamps strings
+func Normalize(decoder Decoder) Decoder {
+	return func(content []byte) (map[string]interface{}, error) {
+		document, err := decoder(content)
+		if err != nil {
+			return nil, err
+		}
+		encoded, err := json.Marshal(document)
+		if err != nil {
+			return nil, err
+		}
+		return decodeJSON(encoded)
+	}
+}
+
+func decodeJSON(content []byte) (map[string]interface{}, error) {
+	var document map[string]interface{}
+	if err := json.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+func decodeYAML(content []byte) (map[string]interface{}, error) {
+	var document map[string]interface{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
@@ -0,0 +1,310 @@
+package configformat
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Parses the static subset of HCL 2 native syntax: attributes and blocks with literal
+// values. Block labels become nested objects, e.g. service "api" { ... } reads as
+// {"service": {"api": {...}}}, and a block repeated under the same labels becomes a
+// list. Variables, function calls and template interpolation have nothing to refer to
+// in metadata and are rejected.
+func decodeHCL(content []byte) (map[string]interface{}, error) {
+	p := &hclParser{scanner: newScanner(HCL, content)}
+	body, err := p.body()
+	if err != nil {
+		return nil, err
+	}
+	if !p.eof() {
+		return nil, p.errorf("unexpected %s", p.describe())
+	}
+	return body, nil
+}
+
+type hclParser struct {
+	*scanner
+}
+
+// Skips spaces and comments, with newlines too if lines is set
+func (p *hclParser) skip(lines bool) {
+	for {
+		p.skipSpaces()
+		switch {
+		case p.hasPrefix("#") || p.hasPrefix("//"):
+			p.take(func(c byte) bool { return c != '\n' })
+		case p.hasPrefix("/*"):
+			end := strings.Index(p.src[p.pos+2:], "*/")
+			if end < 0 {
+				p.advance(len(p.src) - p.pos)
+				return
+			}
+			p.advance(end + 4)
+		case lines && p.peek() == '\n':
+			p.advance(1)
+		default:
+			return
+		}
+	}
+}
+
+// Reads attributes and blocks up to a closing brace or the end
+func (p *hclParser) body() (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	for {
+		p.skip(true)
+		if p.eof() || p.peek() == '}' {
+			return body, nil
+		}
+		name := p.identifier()
+		if name == "" {
+			return nil, p.errorf("expected an attribute or block, found %s", p.describe())
+		}
+		p.skip(false)
+		if p.accept("=") {
+			if _, exists := body[name]; exists {
+				return nil, p.errorf("duplicate attribute %q", name)
+			}
+			p.skip(false)
+			value, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			body[name] = value
+		} else if err := p.block(body, name); err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if !p.eof() && p.peek() != '}' && !p.accept("\n") {
+			return nil, p.errorf("expected end of line, found %s", p.describe())
+		}
+	}
+}
+
+// Reads the labels and body of a block of the given type into parent
+func (p *hclParser) block(parent map[string]interface{}, kind string) error {
+	keys := []string{kind}
+	for p.peek() != '{' {
+		var label string
+		var err error
+		if p.peek() == '"' {
+			label, err = p.quoted()
+		} else if label = p.identifier(); label == "" {
+			err = p.errorf("expected \"=\" or a block, found %s", p.describe())
+		}
+		if err != nil {
+			return err
+		}
+		keys = append(keys, label)
+		p.skip(false)
+	}
+	p.advance(1)
+	body, err := p.body()
+	if err != nil {
+		return err
+	}
+	if err := p.expect("}"); err != nil {
+		return err
+	}
+
+	target := parent
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := target[key].(map[string]interface{})
+		if !ok {
+			if _, exists := target[key]; exists {
+				return p.errorf("block %q conflicts with an attribute", key)
+			}
+			next = map[string]interface{}{}
+			target[key] = next
+		}
+		target = next
+	}
+	last := keys[len(keys)-1]
+	switch existing := target[last].(type) {
+	case nil:
+		target[last] = body
+	case map[string]interface{}:
+		target[last] = []interface{}{existing, body}
+	case []interface{}:
+		target[last] = append(existing, body)
+	}
+	return nil
+}
+
+func (p *hclParser) identifier() string {
+	if c := p.peek(); c >= '0' && c <= '9' || c == '-' {
+		return ""
+	}
+	return p.take(isBareKeyByte)
+}
+
+func (p *hclParser) expression() (interface{}, error) {
+	switch c := p.peek(); {
+	case c == '"':
+		return p.quoted()
+	case p.hasPrefix("<<"):
+		return p.heredoc()
+	case c == '[':
+		return p.tuple()
+	case c == '{':
+		return p.object()
+	case c == '-' || c >= '0' && c <= '9':
+		return p.number()
+	}
+	switch name := p.identifier(); name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "":
+		return nil, p.errorf("expected a value, found %s", p.describe())
+	default:
+		return nil, p.errorf("unsupported expression %q: only literal values are allowed", name)
+	}
+}
+
+// Reads a quoted template, which must not interpolate
+func (p *hclParser) quoted() (string, error) {
+	p.advance(1)
+	var b strings.Builder
+	for {
+		switch {
+		case p.eof() || p.peek() == '\n':
+			return "", p.errorf("unterminated string")
+		case p.accept(`"`):
+			return b.String(), nil
+		case p.accept("$${"):
+			b.WriteString("${")
+		case p.accept("%%{"):
+			b.WriteString("%{")
+		case p.hasPrefix("${") || p.hasPrefix("%{"):
+			return "", p.errorf("template interpolation is not supported")
+		case p.accept(`\`):
+			escaped, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(escaped)
+		default:
+			b.WriteByte(p.peek())
+			p.advance(1)
+		}
+	}
+}
+
+// Reads <<MARKER or the indented <<-MARKER form up to the line holding only MARKER
+func (p *hclParser) heredoc() (string, error) {
+	p.advance(2)
+	indented := p.accept("-")
+	marker := p.identifier()
+	if marker == "" {
+		return "", p.errorf("expected a heredoc marker, found %s", p.describe())
+	}
+	p.skipSpaces()
+	if err := p.expect("\n"); err != nil {
+		return "", err
+	}
+	var lines []string
+	for {
+		if p.eof() {
+			return "", p.errorf("heredoc %s is not terminated", marker)
+		}
+		line := p.take(func(c byte) bool { return c != '\n' })
+		if strings.TrimSpace(line) == marker {
+			break
+		}
+		if strings.Contains(strings.ReplaceAll(line, "$${", ""), "${") {
+			return "", p.errorf("template interpolation is not supported")
+		}
+		lines = append(lines, strings.ReplaceAll(line, "$${", "${"))
+		p.advance(1)
+	}
+	if indented {
+		// Strips the indentation all lines share
+		indent := -1
+		for _, line := range lines {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if n := len(line) - len(strings.TrimLeft(line, " \t")); indent < 0 || n < indent {
+				indent = n
+			}
+		}
+		for i, line := range lines {
+			lines[i] = line[min(max(indent, 0), len(line)):]
+		}
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+func (p *hclParser) tuple() ([]interface{}, error) {
+	p.advance(1)
+	values := []interface{}{}
+	for {
+		p.skip(true)
+		if p.accept("]") {
+			return values, nil
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skip(true)
+		if !p.accept(",") {
+			return values, p.expect("]")
+		}
+	}
+}
+
+// Reads { key = value, ... } where entries are separated by commas or newlines and
+// keys may be quoted
+func (p *hclParser) object() (map[string]interface{}, error) {
+	p.advance(1)
+	object := map[string]interface{}{}
+	for {
+		p.skip(true)
+		if p.accept("}") {
+			return object, nil
+		}
+		var key string
+		var err error
+		if p.peek() == '"' {
+			key, err = p.quoted()
+		} else if key = p.identifier(); key == "" {
+			err = p.errorf("expected an object key, found %s", p.describe())
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		if !p.accept("=") && !p.accept(":") {
+			return nil, p.errorf("expected \"=\" after %q, found %s", key, p.describe())
+		}
+		p.skip(false)
+		if object[key], err = p.expression(); err != nil {
+			return nil, err
+		}
+		p.skip(false)
+		p.accept(",")
+	}
+}
+
+func (p *hclParser) number() (interface{}, error) {
+	token := p.take(func(c byte) bool {
+		return c >= '0' && c <= '9' || c == '.' || c == 'e' || c == 'E' || c == '+' || c == '-'
+	})
+	if value, err := strconv.ParseInt(token, 10, 64); err == nil {
+		return value, nil
+	}
+	value, err := strconv.ParseFloat(token, 64)
+	if err != nil {
+		return nil, p.errorf("invalid number %q", token)
+	}
+	return value, nil
+}
@@ -0,0 +1,130 @@
+package configformat
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Position in a document shared by the TOML and HCL parsers
+type scanner struct {
+	format string
+	src    string
+	pos    int
+	line   int
+}
+
+func newScanner(format string, content []byte) *scanner {
+	return &scanner{format: format, src: string(content), line: 1}
+}
+
+func (s *scanner) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%s: line %d: %s", s.format, s.line, fmt.Sprintf(format, args...))
+}
+
+func (s *scanner) eof() bool {
+	return s.pos >= len(s.src)
+}
+
+// The next byte, 0 at the end
+func (s *scanner) peek() byte {
+	if s.eof() {
+		return 0
+	}
+	return s.src[s.pos]
+}
+
+func (s *scanner) hasPrefix(prefix string) bool {
+	return strings.HasPrefix(s.src[s.pos:], prefix)
+}
+
+func (s *scanner) advance(n int) {
+	s.line += strings.Count(s.src[s.pos:s.pos+n], "\n")
+	s.pos += n
+}
+
+// Consumes prefix if the input continues with it
+func (s *scanner) accept(prefix string) bool {
+	if !s.hasPrefix(prefix) {
+		return false
+	}
+	s.advance(len(prefix))
+	return true
+}
+
+func (s *scanner) expect(prefix string) error {
+	if !s.accept(prefix) {
+		return s.errorf("expected %q, found %s", prefix, s.describe())
+	}
+	return nil
+}
+
+// The upcoming input for error messages
+func (s *scanner) describe() string {
+	if s.eof() {
+		return "end of document"
+	}
+	r, _ := utf8.DecodeRuneInString(s.src[s.pos:])
+	if r == '\n' {
+		return "end of line"
+	}
+	return strconv.QuoteRune(r)
+}
+
+// Skips spaces and tabs, but not line breaks
+func (s *scanner) skipSpaces() {
+	for s.peek() == ' ' || s.peek() == '\t' || s.peek() == '\r' {
+		s.pos++
+	}
+}
+
+// Consumes bytes while match holds and returns them
+func (s *scanner) take(match func(c byte) bool) string {
+	start := s.pos
+	for !s.eof() && match(s.peek()) {
+		s.pos++
+	}
+	return s.src[start:s.pos]
+}
+
+// Reads the escape after a backslash in a double-quoted string, common to TOML and HCL
+func (s *scanner) escape() (string, error) {
+	c := s.peek()
+	s.pos++
+	switch c {
+	case 'b':
+		return "\b", nil
+	case 't':
+		return "\t", nil
+	case 'n':
+		return "\n", nil
+	case 'f':
+		return "\f", nil
+	case 'r':
+		return "\r", nil
+	case 'e':
+		return "\x1b", nil
+	case '"', '\\':
+		return string(c), nil
+	case 'u', 'U':
+		digits := 4
+		if c == 'U' {
+			digits = 8
+		}
+		if s.pos+digits > len(s.src) {
+			return "", s.errorf("truncated \\%c escape", c)
+		}
+		code, err := strconv.ParseUint(s.src[s.pos:s.pos+digits], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(code)) {
+			return "", s.errorf("invalid \\%c escape", c)
+		}
+		s.pos += digits
+		return string(rune(code)), nil
+	}
+	return "", s.errorf("invalid escape \\%c", c)
+}
+
+func isBareKeyByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
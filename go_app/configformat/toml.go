@@ -0,0 +1,387 @@
+package configformat
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Parses TOML 1.0. Dates and times have no JSON counterpart and are kept as the
+// strings they were written as.
+func decodeTOML(content []byte) (map[string]interface{}, error) {
+	p := &tomlParser{scanner: newScanner(TOML, content), root: map[string]interface{}{}}
+	p.current = p.root
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return p.root, nil
+		}
+		var err error
+		if p.peek() == '[' {
+			err = p.header()
+		} else {
+			err = p.keyValue(p.current)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+type tomlParser struct {
+	*scanner
+	root    map[string]interface{}
+	current map[string]interface{} // table that key/value pairs go to
+}
+
+// Skips whitespace, line breaks and comments
+func (p *tomlParser) skipBlank() {
+	for {
+		p.skipSpaces()
+		switch {
+		case p.peek() == '#':
+			p.take(func(c byte) bool { return c != '\n' })
+		case p.peek() == '\n':
+			p.advance(1)
+		default:
+			return
+		}
+	}
+}
+
+// Allows only a comment before the next line
+func (p *tomlParser) endOfLine() error {
+	p.skipSpaces()
+	if p.peek() == '#' {
+		p.take(func(c byte) bool { return c != '\n' })
+	}
+	if !p.eof() && !p.accept("\n") {
+		return p.errorf("expected end of line, found %s", p.describe())
+	}
+	return nil
+}
+
+// Reads [table] or [[array.of.tables]] and makes it the current table
+func (p *tomlParser) header() error {
+	array := p.accept("[[")
+	if !array {
+		p.advance(1)
+	}
+	p.skipSpaces()
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if array {
+		err = p.expect("]]")
+	} else {
+		err = p.expect("]")
+	}
+	if err != nil {
+		return err
+	}
+
+	table := p.root
+	for _, key := range keys[:len(keys)-1] {
+		if table, err = p.descend(table, key); err != nil {
+			return err
+		}
+	}
+	last := keys[len(keys)-1]
+	if !array {
+		p.current, err = p.descend(table, last)
+		return err
+	}
+	existing, ok := table[last]
+	list, isList := existing.([]interface{})
+	if ok && !isList {
+		return p.errorf("%q is not an array of tables", last)
+	}
+	entry := map[string]interface{}{}
+	table[last] = append(list, entry)
+	p.current = entry
+	return nil
+}
+
+// The table under key in table, created if missing. An array of tables stands for its
+// last entry, as in TOML headers and dotted keys.
+func (p *tomlParser) descend(table map[string]interface{}, key string) (map[string]interface{}, error) {
+	switch next := table[key].(type) {
+	case nil:
+		created := map[string]interface{}{}
+		table[key] = created
+		return created, nil
+	case map[string]interface{}:
+		return next, nil
+	case []interface{}:
+		if len(next) > 0 {
+			if last, ok := next[len(next)-1].(map[string]interface{}); ok {
+				return last, nil
+			}
+		}
+	}
+	return nil, p.errorf("%q is already a value, not a table", key)
+}
+
+// Reads key = value into table
+func (p *tomlParser) keyValue(table map[string]interface{}) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpaces()
+	if err := p.expect("="); err != nil {
+		return err
+	}
+	p.skipSpaces()
+	value, err := p.value()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys[:len(keys)-1] {
+		if table, err = p.descend(table, key); err != nil {
+			return err
+		}
+	}
+	last := keys[len(keys)-1]
+	if _, exists := table[last]; exists {
+		return p.errorf("duplicate key %q", last)
+	}
+	table[last] = value
+	return nil
+}
+
+// Reads a possibly dotted key of bare and quoted parts
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		var part string
+		var err error
+		switch p.peek() {
+		case '"':
+			part, err = p.basicString()
+		case '\'':
+			part, err = p.literalString()
+		default:
+			if part = p.take(isBareKeyByte); part == "" {
+				return nil, p.errorf("expected a key, found %s", p.describe())
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, part)
+		p.skipSpaces()
+		if !p.accept(".") {
+			return keys, nil
+		}
+		p.skipSpaces()
+	}
+}
+
+func (p *tomlParser) value() (interface{}, error) {
+	switch {
+	case p.hasPrefix(`"""`):
+		return p.multilineBasicString()
+	case p.hasPrefix("'''"):
+		return p.multilineLiteralString()
+	case p.peek() == '"':
+		return p.basicString()
+	case p.peek() == '\'':
+		return p.literalString()
+	case p.peek() == '[':
+		return p.array()
+	case p.peek() == '{':
+		return p.inlineTable()
+	case p.accept("true"):
+		return true, nil
+	case p.accept("false"):
+		return false, nil
+	}
+	return p.scalar()
+}
+
+func (p *tomlParser) basicString() (string, error) {
+	p.advance(1)
+	var b strings.Builder
+	for {
+		switch c := p.peek(); c {
+		case 0, '\n':
+			return "", p.errorf("unterminated string")
+		case '"':
+			p.advance(1)
+			return b.String(), nil
+		case '\\':
+			p.advance(1)
+			escaped, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(escaped)
+		default:
+			b.WriteByte(c)
+			p.advance(1)
+		}
+	}
+}
+
+func (p *tomlParser) literalString() (string, error) {
+	p.advance(1)
+	text := p.take(func(c byte) bool { return c != '\'' && c != '\n' })
+	if !p.accept("'") {
+		return "", p.errorf("unterminated string")
+	}
+	return text, nil
+}
+
+func (p *tomlParser) multilineBasicString() (string, error) {
+	p.advance(3)
+	p.accept("\r")
+	p.accept("\n") // a line break right after the quotes is trimmed
+	var b strings.Builder
+	for {
+		switch {
+		case p.eof():
+			return "", p.errorf("unterminated string")
+		case p.hasPrefix(`"""`) && !p.hasPrefix(`""""`):
+			p.advance(3)
+			return b.String(), nil
+		case p.peek() == '\\':
+			p.advance(1)
+			// A backslash at the end of a line joins it with the next non-blank text
+			rest := p.src[p.pos:]
+			if trimmed := strings.TrimLeft(rest, " \t\r"); strings.HasPrefix(trimmed, "\n") {
+				p.advance(len(rest) - len(strings.TrimLeft(rest, " \t\r\n")))
+				continue
+			}
+			escaped, err := p.escape()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(escaped)
+		default:
+			b.WriteByte(p.peek())
+			p.advance(1)
+		}
+	}
+}
+
+func (p *tomlParser) multilineLiteralString() (string, error) {
+	p.advance(3)
+	p.accept("\r")
+	p.accept("\n")
+	end := strings.Index(p.src[p.pos:], "'''")
+	if end < 0 {
+		return "", p.errorf("unterminated string")
+	}
+	// Up to two quotes may end the content right before the closing ones
+	for extra := 0; extra < 2 && p.pos+end+3 < len(p.src) && p.src[p.pos+end+3] == '\''; extra++ {
+		end++
+	}
+	text := p.src[p.pos : p.pos+end]
+	p.advance(end + 3)
+	return text, nil
+}
+
+func (p *tomlParser) array() ([]interface{}, error) {
+	p.advance(1)
+	values := []interface{}{}
+	for {
+		p.skipBlank()
+		if p.accept("]") {
+			return values, nil
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		p.skipBlank()
+		if !p.accept(",") {
+			p.skipBlank()
+			return values, p.expect("]")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() (map[string]interface{}, error) {
+	p.advance(1)
+	table := map[string]interface{}{}
+	p.skipSpaces()
+	if p.accept("}") {
+		return table, nil
+	}
+	for {
+		p.skipSpaces()
+		if err := p.keyValue(table); err != nil {
+			return nil, err
+		}
+		p.skipSpaces()
+		if !p.accept(",") {
+			return table, p.expect("}")
+		}
+	}
+}
+
+// Reads a number, date or time
+func (p *tomlParser) scalar() (interface{}, error) {
+	token := p.take(func(c byte) bool {
+		return isBareKeyByte(c) || c == '+' || c == '.' || c == ':'
+	})
+	// A date and a time may be separated by a space instead of T
+	if isDate(token) && p.peek() == ' ' && p.pos+1 < len(p.src) && p.src[p.pos+1] >= '0' && p.src[p.pos+1] <= '9' {
+		p.pos++
+		token += " " + p.take(func(c byte) bool { return isBareKeyByte(c) || c == '+' || c == '.' || c == ':' })
+	}
+	if token == "" {
+		return nil, p.errorf("expected a value, found %s", p.describe())
+	}
+	if isDate(token) || len(token) >= 5 && token[2] == ':' {
+		return token, nil
+	}
+
+	unsigned := strings.TrimLeft(token, "+-")
+	switch unsigned {
+	case "inf":
+		if token[0] == '-' {
+			return math.Inf(-1), nil
+		}
+		return math.Inf(1), nil
+	case "nan":
+		return math.NaN(), nil
+	}
+	if strings.HasPrefix(unsigned, "0x") || strings.HasPrefix(unsigned, "0o") || strings.HasPrefix(unsigned, "0b") {
+		if unsigned != token {
+			return nil, p.errorf("invalid number %q", token)
+		}
+		value, err := strconv.ParseInt(token, 0, 64)
+		if err != nil {
+			return nil, p.errorf("invalid number %q", token)
+		}
+		return value, nil
+	}
+	if strings.Contains(token, "__") || strings.HasPrefix(unsigned, "_") || strings.HasSuffix(token, "_") {
+		return nil, p.errorf("invalid number %q", token)
+	}
+	digits := strings.ReplaceAll(token, "_", "")
+	if value, err := strconv.ParseInt(digits, 10, 64); err == nil {
+		if len(strings.TrimLeft(digits, "+-")) > 1 && strings.TrimLeft(digits, "+-")[0] == '0' {
+			return nil, p.errorf("leading zeros in %q", token)
+		}
+		return value, nil
+	}
+	value, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		return nil, p.errorf("invalid value %q", token)
+	}
+	return value, nil
+}
+
+// Reports whether token starts with a full date, e.g. 1979-05-27
+func isDate(token string) bool {
+	return len(token) >= 10 && token[4] == '-' && token[7] == '-'
+}
@@ -0,0 +1,135 @@
+// Package configsource fetches the service metadata document from a local file or a
+// remote backend: Consul KV, etcd, S3 or a plain HTTP config service.
+package configsource
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Upper bound on the size of a fetched document
+const MAX_DOCUMENT_SIZE = 1 << 20
+
+// Wait between attempts after a watch fails
+const WATCH_RETRY_INTERVAL = 5 * time.Second
+
+// Where the metadata document comes from
+type Source interface {
+	Load(ctx context.Context) ([]byte, error)
+	String() string
+}
+
+// Implemented by sources that can push change notifications. Watch blocks until ctx
+// is done, calling changed whenever the document may have changed.
+type Watcher interface {
+	Watch(ctx context.Context, changed func())
+}
+
+// Builds a source from a spec:
+//
+//	./metadata.json or file:///etc/app/metadata.json
+//	consul://127.0.0.1:8500/path/to/key
+//	etcd://127.0.0.1:2379/path/to/key
+//	s3://bucket/path/to/metadata.json
+//	http://config-service/metadata.json (or https://)
+func New(spec string) (Source, error) {
+	if !strings.Contains(spec, "://") {
+		return NewFile(spec), nil
+	}
+
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("config source %q: %w", spec, err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+
+	switch u.Scheme {
+	case "file":
+		return NewFile(u.Path), nil
+	case "consul":
+		return NewConsulKV("http://"+u.Host, key), nil
+	case "etcd":
+		return NewEtcd("http://"+u.Host, u.Path), nil
+	case "s3":
+		return NewS3(u.Host, key), nil
+	case "http", "https":
+		return NewHTTP(spec), nil
+	default:
+		return nil, fmt.Errorf("unknown config source scheme %q", u.Scheme)
+	}
+}
+
+// Reads the document from the local filesystem
+type File struct {
+	Path string
+}
+
+func NewFile(path string) *File {
+	return &File{Path: path}
+}
+
+func (f *File) Load(ctx context.Context) ([]byte, error) {
+	return os.ReadFile(f.Path)
+}
+
+func (f *File) String() string {
+	return f.Path
+}
+
+// Fetches the document with a GET from any HTTP config service
+type HTTP struct {
+	URL        string
+	HTTPClient *http.Client
+}
+
+func NewHTTP(url string) *HTTP {
+	return &HTTP{URL: url, HTTPClient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (h *HTTP) Load(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetch(h.HTTPClient, req)
+}
+
+func (h *HTTP) String() string {
+	return h.URL
+}
+
+// Sends req and returns the body of a 2xx response
+func fetch(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_DOCUMENT_SIZE))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Redacted(), resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// Sleeps for WATCH_RETRY_INTERVAL, returning false if ctx ends first
+func waitRetry(ctx context.Context) bool {
+	timer := time.NewTimer(WATCH_RETRY_INTERVAL)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
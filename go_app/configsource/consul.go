@@ -0,0 +1,84 @@
+package configsource
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// How long a Consul blocking query waits for a change before returning
+const CONSUL_WATCH_WAIT = 5 * time.Minute
+
+// Reads the document from a Consul KV key and watches it with blocking queries
+type ConsulKV struct {
+	Addr       string
+	Key        string
+	HTTPClient *http.Client
+
+	// Without a timeout, for blocking queries
+	WatchClient *http.Client
+}
+
+func NewConsulKV(addr, key string) *ConsulKV {
+	return &ConsulKV{
+		Addr:        strings.TrimRight(addr, "/"),
+		Key:         key,
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+		WatchClient: &http.Client{},
+	}
+}
+
+func (c *ConsulKV) keyURL() string {
+	return c.Addr + "/v1/kv/" + (&url.URL{Path: c.Key}).EscapedPath()
+}
+
+func (c *ConsulKV) Load(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.keyURL()+"?raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetch(c.HTTPClient, req)
+}
+
+func (c *ConsulKV) String() string {
+	return "consul " + c.Addr + " key " + c.Key
+}
+
+// Long-polls the key and calls changed whenever its modify index moves
+func (c *ConsulKV) Watch(ctx context.Context, changed func()) {
+	index := ""
+	for ctx.Err() == nil {
+		next, err := c.waitIndex(ctx, index)
+		if err != nil {
+			if !waitRetry(ctx) {
+				return
+			}
+			continue
+		}
+		if index != "" && next != index {
+			changed()
+		}
+		index = next
+	}
+}
+
+// Runs one blocking query and returns the resulting X-Consul-Index
+func (c *ConsulKV) waitIndex(ctx context.Context, index string) (string, error) {
+	query := url.Values{"wait": {CONSUL_WATCH_WAIT.String()}}
+	if index != "" {
+		query.Set("index", index)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.keyURL()+"?"+query.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := c.WatchClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	// A missing key answers 404 but still carries an index to block on
+	return resp.Header.Get("X-Consul-Index"), nil
+}
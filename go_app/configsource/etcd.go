@@ -0,0 +1,122 @@
+package configsource
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reads the document from an etcd key through the v3 JSON gateway and watches it
+type Etcd struct {
+	Addr       string
+	Key        string
+	HTTPClient *http.Client
+
+	// Without a timeout, for the streaming watch
+	WatchClient *http.Client
+}
+
+func NewEtcd(addr, key string) *Etcd {
+	return &Etcd{
+		Addr:        strings.TrimRight(addr, "/"),
+		Key:         key,
+		HTTPClient:  &http.Client{Timeout: 10 * time.Second},
+		WatchClient: &http.Client{},
+	}
+}
+
+func (e *Etcd) post(ctx context.Context, path string, body interface{}) (*http.Request, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Addr+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+func (e *Etcd) Load(ctx context.Context) ([]byte, error) {
+	req, err := e.post(ctx, "/v3/kv/range", map[string]string{
+		"key": base64.StdEncoding.EncodeToString([]byte(e.Key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	body, err := fetch(e.HTTPClient, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("decode etcd range response: %w", err)
+	}
+	if len(result.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd key %s not found", e.Key)
+	}
+	return base64.StdEncoding.DecodeString(result.Kvs[0].Value)
+}
+
+func (e *Etcd) String() string {
+	return "etcd " + e.Addr + " key " + e.Key
+}
+
+// Streams watch events for the key, reconnecting after failures
+func (e *Etcd) Watch(ctx context.Context, changed func()) {
+	for ctx.Err() == nil {
+		e.watchOnce(ctx, changed)
+		if !waitRetry(ctx) {
+			return
+		}
+	}
+}
+
+func (e *Etcd) watchOnce(ctx context.Context, changed func()) error {
+	req, err := e.post(ctx, "/v3/watch", map[string]interface{}{
+		"create_request": map[string]string{
+			"key": base64.StdEncoding.EncodeToString([]byte(e.Key)),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := e.WatchClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("etcd watch: %s", resp.Status)
+	}
+
+	// The gateway streams one JSON object per watch response
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var message struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&message); err != nil {
+			return err
+		}
+		if len(message.Result.Events) > 0 {
+			changed()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package configsource
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"go_app/sigv4"
+)
+
+// Reads the document from an S3 object. Requests are signed with credentials from the
+// default chain (sigv4.DefaultCredentials), or sent anonymously when there are none.
+// AWS_ENDPOINT_URL_S3 (or AWS_ENDPOINT_URL) points it at S3-compatible storage.
+type S3 struct {
+	Bucket     string
+	Key        string
+	Region     string
+	Endpoint   string
+	HTTPClient *http.Client
+}
+
+func NewS3(bucket, key string) *S3 {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return &S3{
+		Bucket:     bucket,
+		Key:        key,
+		Region:     sigv4.RegionFromEnv(),
+		Endpoint:   strings.TrimRight(endpoint, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Virtual-hosted style on AWS, path style on a custom endpoint
+func (s *S3) objectURL() string {
+	path := (&url.URL{Path: "/" + s.Key}).EscapedPath()
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + s.Bucket + path
+	}
+	return "https://" + s.Bucket + ".s3." + s.Region + ".amazonaws.com" + path
+}
+
+func (s *S3) Load(ctx context.Context) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.objectURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := sigv4.DefaultCredentials(ctx)
+	switch {
+	case err == nil:
+		sigv4.Sign(req, creds, s.Region, "s3", sigv4.EMPTY_PAYLOAD, time.Now())
+	case !errors.Is(err, sigv4.ErrNoCredentials):
+		return nil, err
+	}
+	return fetch(s.HTTPClient, req)
+}
+
+func (s *S3) String() string {
+	return "s3://" + s.Bucket + "/" + s.Key
+}
@@ -0,0 +1,135 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Registers services with the local Consul agent over its HTTP API
+type Consul struct {
+	Addr       string
+	HTTPClient *http.Client
+}
+
+func NewConsul(addr string) *Consul {
+	return &Consul{
+		Addr:       strings.TrimRight(addr, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Consul services have no scheme, so it is kept in their metadata
+const CONSUL_SCHEME_META = "scheme"
+
+type consulCheck struct {
+	HTTP                           string `json:"HTTP"`
+	Interval                       string `json:"Interval"`
+	Timeout                        string `json:"Timeout"`
+	DeregisterCriticalServiceAfter string `json:"DeregisterCriticalServiceAfter"`
+}
+
+type consulService struct {
+	ID      string            `json:"ID"`
+	Name    string            `json:"Name"`
+	Address string            `json:"Address"`
+	Port    int               `json:"Port"`
+	Meta    map[string]string `json:"Meta,omitempty"`
+	Check   *consulCheck      `json:"Check,omitempty"`
+}
+
+func (c *Consul) Register(ctx context.Context, instance Instance) error {
+	service := consulService{
+		ID:      instance.ID,
+		Name:    instance.Name,
+		Address: instance.Address,
+		Port:    instance.Port,
+		Meta:    instance.Meta,
+	}
+	if instance.Scheme != "" {
+		service.Meta = maps.Clone(instance.Meta)
+		if service.Meta == nil {
+			service.Meta = map[string]string{}
+		}
+		service.Meta[CONSUL_SCHEME_META] = instance.Scheme
+	}
+	if instance.HealthCheckURL != "" {
+		service.Check = &consulCheck{
+			HTTP:                           instance.HealthCheckURL,
+			Interval:                       "10s",
+			Timeout:                        "2s",
+			DeregisterCriticalServiceAfter: "1m",
+		}
+	}
+	return c.do(ctx, http.MethodPut, "/v1/agent/service/register", service, nil)
+}
+
+func (c *Consul) Deregister(ctx context.Context, instance Instance) error {
+	return c.do(ctx, http.MethodPut, "/v1/agent/service/deregister/"+url.PathEscape(instance.ID), nil, nil)
+}
+
+func (c *Consul) Instances(ctx context.Context, name string) ([]Instance, error) {
+	var entries []struct {
+		Node struct {
+			Address string `json:"Address"`
+		} `json:"Node"`
+		Service consulService `json:"Service"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/health/service/"+url.PathEscape(name)+"?passing=true", nil, &entries); err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(entries))
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		instances = append(instances, Instance{
+			ID:      entry.Service.ID,
+			Name:    entry.Service.Name,
+			Address: address,
+			Port:    entry.Service.Port,
+			Meta:    entry.Service.Meta,
+			Scheme:  entry.Service.Meta[CONSUL_SCHEME_META],
+		})
+	}
+	return instances, nil
+}
+
+func (c *Consul) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.Addr+path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("consul %s %s: %w", method, path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("consul %s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(message))
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
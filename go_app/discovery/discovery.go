@@ -0,0 +1,116 @@
+// Package discovery registers this service with Consul or etcd and finds sibling services.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a discovered instance list is reused before asking the registry again
+const DISCOVERY_CACHE_TTL = 10 * time.Second
+
+// A running copy of a service
+type Instance struct {
+	ID      string            `json:"id"`
+	Name    string            `json:"name"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	// "http" or "https"; http when empty
+	Scheme string `json:"scheme,omitempty"`
+
+	// URL the registry should probe; backends without health checks ignore it
+	HealthCheckURL string `json:"healthCheckUrl,omitempty"`
+}
+
+// Base URL of the instance
+func (i Instance) URL() string {
+	scheme := i.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(i.Address, strconv.Itoa(i.Port))
+}
+
+// A service registry backend
+type Registry interface {
+	Register(ctx context.Context, instance Instance) error
+	Deregister(ctx context.Context, instance Instance) error
+	// Returns the healthy instances of a service
+	Instances(ctx context.Context, name string) ([]Instance, error)
+}
+
+var ErrNoInstances = errors.New("no healthy instances")
+
+// Creates the registry for backend ("consul" or "etcd") at addr
+func NewRegistry(backend, addr string) (Registry, error) {
+	switch backend {
+	case "consul":
+		return NewConsul(addr), nil
+	case "etcd":
+		return NewEtcd(addr), nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %q", backend)
+	}
+}
+
+type serviceInstances struct {
+	instances []Instance
+	fetched   time.Time
+	next      atomic.Uint64
+}
+
+// Client-side load balancer over a Registry, rotating through healthy instances
+type Client struct {
+	Registry Registry
+
+	mutex    sync.Mutex
+	services map[string]*serviceInstances
+}
+
+func NewClient(registry Registry) *Client {
+	return &Client{Registry: registry, services: make(map[string]*serviceInstances)}
+}
+
+// Picks the next instance of serviceName in round-robin order
+func (c *Client) Discover(ctx context.Context, serviceName string) (Instance, error) {
+	service, err := c.lookup(ctx, serviceName)
+	if err != nil {
+		return Instance{}, err
+	}
+	n := service.next.Add(1) - 1
+	return service.instances[n%uint64(len(service.instances))], nil
+}
+
+func (c *Client) lookup(ctx context.Context, serviceName string) (*serviceInstances, error) {
+	c.mutex.Lock()
+	cached, ok := c.services[serviceName]
+	c.mutex.Unlock()
+	if ok && time.Since(cached.fetched) < DISCOVERY_CACHE_TTL {
+		return cached, nil
+	}
+
+	instances, err := c.Registry.Instances(ctx, serviceName)
+	if err != nil {
+		// Keep calling the last known instances while the registry is unreachable
+		if ok {
+			return cached, nil
+		}
+		return nil, err
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("%s: %w", serviceName, ErrNoInstances)
+	}
+
+	service := &serviceInstances{instances: instances, fetched: time.Now()}
+	c.mutex.Lock()
+	c.services[serviceName] = service
+	c.mutex.Unlock()
+	return service, nil
+}
@@ -0,0 +1,252 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Key prefix under which instances are stored: /services/<name>/<id>
+const ETCD_PREFIX = "/services/"
+
+// Lease TTL; an instance disappears this long after its process stops renewing it
+const ETCD_LEASE_TTL = 30 * time.Second
+
+// Registers services in etcd through its v3 JSON gateway, kept alive by a lease
+type Etcd struct {
+	Addr       string
+	HTTPClient *http.Client
+	// Defaults to log.Default()
+	Logger *log.Logger
+
+	mutex  sync.Mutex
+	leases map[string]*etcdLease
+}
+
+type etcdLease struct {
+	id     string // replaced when the instance is registered again, guarded by Etcd.mutex
+	cancel context.CancelFunc
+}
+
+func NewEtcd(addr string) *Etcd {
+	return &Etcd{
+		Addr:       strings.TrimRight(addr, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+		Logger:     log.Default(),
+		leases:     make(map[string]*etcdLease),
+	}
+}
+
+func etcdKey(name, id string) string {
+	return ETCD_PREFIX + name + "/" + id
+}
+
+func b64(value string) string {
+	return base64.StdEncoding.EncodeToString([]byte(value))
+}
+
+func (e *Etcd) Register(ctx context.Context, instance Instance) error {
+	leaseID, err := e.put(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	keepAliveCtx, cancel := context.WithCancel(context.Background())
+	lease := &etcdLease{id: leaseID, cancel: cancel}
+	e.mutex.Lock()
+	e.leases[instance.ID] = lease
+	e.mutex.Unlock()
+
+	go e.keepAlive(keepAliveCtx, instance, lease)
+	return nil
+}
+
+// Stores instance under a new lease, returning the lease's ID
+func (e *Etcd) put(ctx context.Context, instance Instance) (string, error) {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.do(ctx, "/v3/lease/grant", map[string]interface{}{"TTL": int(ETCD_LEASE_TTL.Seconds())}, &grant); err != nil {
+		return "", err
+	}
+
+	value, err := json.Marshal(instance)
+	if err != nil {
+		return "", err
+	}
+	put := map[string]interface{}{
+		"key":   b64(etcdKey(instance.Name, instance.ID)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": grant.ID,
+	}
+	if err := e.do(ctx, "/v3/kv/put", put, nil); err != nil {
+		return "", err
+	}
+	return grant.ID, nil
+}
+
+// Renews the lease at a third of its TTL until the context is canceled. Once the lease
+// is gone, because etcd says so or it went unrenewed for a whole TTL while etcd was
+// unreachable, the instance's key went with it, so it is registered again under a new
+// lease.
+func (e *Etcd) keepAlive(ctx context.Context, instance Instance, lease *etcdLease) {
+	ticker := time.NewTicker(ETCD_LEASE_TTL / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		e.mutex.Lock()
+		leaseID := lease.id
+		e.mutex.Unlock()
+		alive, err := e.renew(ctx, leaseID)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && alive {
+			renewed = time.Now()
+			continue
+		}
+		if err != nil {
+			e.Logger.Println("etcd lease keepalive failed:", err)
+			if time.Since(renewed) < ETCD_LEASE_TTL {
+				continue
+			}
+		}
+
+		newID, err := e.put(ctx, instance)
+		if err != nil {
+			if ctx.Err() == nil {
+				e.Logger.Printf("etcd lease of %s expired, registering again failed: %v", instance.ID, err)
+			}
+			continue
+		}
+		e.mutex.Lock()
+		if ctx.Err() != nil {
+			// Deregistered meanwhile, and it revoked the old lease
+			e.mutex.Unlock()
+			e.do(context.Background(), "/v3/lease/revoke", map[string]string{"ID": newID}, nil)
+			return
+		}
+		lease.id = newID
+		e.mutex.Unlock()
+		renewed = time.Now()
+		e.Logger.Printf("etcd lease of %s expired, registered it again", instance.ID)
+	}
+}
+
+// Renews a lease, returning whether it still exists
+func (e *Etcd) renew(ctx context.Context, leaseID string) (bool, error) {
+	// The gateway streams keepalive responses; the first is the one for this request.
+	// etcd answers an expired lease with a TTL of 0, or with "lease not found".
+	var response struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	err := e.do(ctx, "/v3/lease/keepalive", map[string]string{"ID": leaseID}, &response)
+	if err != nil && strings.Contains(err.Error(), "lease not found") {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if strings.Contains(response.Error.Message, "lease not found") {
+		return false, nil
+	}
+	if response.Error.Message != "" {
+		return false, fmt.Errorf("etcd /v3/lease/keepalive: %s", response.Error.Message)
+	}
+	ttl, _ := strconv.Atoi(response.Result.TTL)
+	return ttl > 0, nil
+}
+
+func (e *Etcd) Deregister(ctx context.Context, instance Instance) error {
+	e.mutex.Lock()
+	lease, ok := e.leases[instance.ID]
+	delete(e.leases, instance.ID)
+	if !ok {
+		e.mutex.Unlock()
+		return nil
+	}
+	// Canceled under the mutex, so keepAlive can't swap in a new lease after this
+	lease.cancel()
+	leaseID := lease.id
+	e.mutex.Unlock()
+
+	// Revoking the lease deletes the instance key with it
+	return e.do(ctx, "/v3/lease/revoke", map[string]string{"ID": leaseID}, nil)
+}
+
+func (e *Etcd) Instances(ctx context.Context, name string) ([]Instance, error) {
+	prefix := ETCD_PREFIX + name + "/"
+	// The range end is the prefix with its last byte incremented
+	rangeEnd := prefix[:len(prefix)-1] + string(prefix[len(prefix)-1]+1)
+
+	var result struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	query := map[string]string{"key": b64(prefix), "range_end": b64(rangeEnd)}
+	if err := e.do(ctx, "/v3/kv/range", query, &result); err != nil {
+		return nil, err
+	}
+
+	instances := make([]Instance, 0, len(result.Kvs))
+	for _, kv := range result.Kvs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			continue
+		}
+		var instance Instance
+		if err := json.Unmarshal(value, &instance); err == nil {
+			instances = append(instances, instance)
+		}
+	}
+	return instances, nil
+}
+
+func (e *Etcd) do(ctx context.Context, path string, body, result interface{}) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.Addr+path, bytes.NewReader(encoded))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("etcd %s: %w", path, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("etcd %s: %s: %s", path, resp.Status, bytes.TrimSpace(message))
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Package eventbus is an in-process publish/subscribe bus. Publishers never block:
+// each subscriber owns a bounded queue drained by its own goroutine, and events that
+// do not fit are dropped and counted.
+package eventbus
+
+import (
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// Published and dropped events per topic, published on /debug/vars
+var eventMetrics = expvar.NewMap("events")
+
+// Queue size used when a subscriber asks for 0
+const DEFAULT_QUEUE_SIZE = 64
+
+// Subscribing to this topic name receives events of every topic
+const ALL_TOPICS = "*"
+
+// A published event with its untyped payload
+type Event struct {
+	Topic   string
+	Time    time.Time
+	Payload interface{}
+}
+
+// Names a topic and the payload type carried on it
+type Topic[T any] struct {
+	Name string
+}
+
+func NewTopic[T any](name string) Topic[T] {
+	return Topic[T]{Name: name}
+}
+
+type subscription struct {
+	topic   string
+	queue   chan Event
+	handler func(Event)
+	done    chan struct{}
+}
+
+// Routes events from publishers to subscribers
+type Bus struct {
+	Logger *log.Logger
+
+	mutex  sync.RWMutex
+	nextID int
+	subs   map[int]*subscription
+}
+
+func New(logger *log.Logger) *Bus {
+	return &Bus{Logger: logger, subs: make(map[int]*subscription)}
+}
+
+// Delivers an event to every subscriber of its topic and of ALL_TOPICS
+func (b *Bus) Publish(topic string, payload interface{}) {
+	event := Event{Topic: topic, Time: time.Now(), Payload: payload}
+	eventMetrics.Add(topic+".published", 1)
+
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	for _, sub := range b.subs {
+		if sub.topic != topic && sub.topic != ALL_TOPICS {
+			continue
+		}
+		select {
+		case sub.queue <- event:
+		default:
+			eventMetrics.Add(topic+".dropped", 1)
+		}
+	}
+}
+
+// Calls handler for each event on topic from a dedicated goroutine, queueing up to
+// queueSize events. The returned function unsubscribes and waits for the goroutine.
+func (b *Bus) Subscribe(topic string, queueSize int, handler func(Event)) func() {
+	if queueSize <= 0 {
+		queueSize = DEFAULT_QUEUE_SIZE
+	}
+	sub := &subscription{
+		topic:   topic,
+		queue:   make(chan Event, queueSize),
+		handler: handler,
+		done:    make(chan struct{}),
+	}
+
+	b.mutex.Lock()
+	id := b.nextID
+	b.nextID++
+	b.subs[id] = sub
+	b.mutex.Unlock()
+
+	go b.run(sub)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			b.mutex.Lock()
+			delete(b.subs, id)
+			b.mutex.Unlock()
+			close(sub.queue)
+			<-sub.done
+		})
+	}
+}
+
+func (b *Bus) run(sub *subscription) {
+	defer close(sub.done)
+	for event := range sub.queue {
+		b.dispatch(sub, event)
+	}
+}
+
+// Runs the handler, keeping a panicking subscriber from taking the process down
+func (b *Bus) dispatch(sub *subscription, event Event) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			b.Logger.Printf("Event subscriber for %s panicked: %v", event.Topic, recovered)
+		}
+	}()
+	sub.handler(event)
+}
+
+// Publishes a typed payload on topic
+func Publish[T any](b *Bus, topic Topic[T], payload T) {
+	b.Publish(topic.Name, payload)
+}
+
+// Subscribes a handler that receives topic's payloads with their static type
+func Subscribe[T any](b *Bus, topic Topic[T], queueSize int, handler func(T)) func() {
+	return b.Subscribe(topic.Name, queueSize, func(event Event) {
+		if payload, ok := event.Payload.(T); ok {
+			handler(payload)
+		}
+	})
+}
@@ -0,0 +1,423 @@
+// Package graphql serves a small, hand-written GraphQL schema without code generation.
+// It executes queries and mutations with aliases, arguments, variables, fragments and
+// the @include/@skip directives. Subscriptions and schema introspection are not
+// supported; the schema is documented next to the code that builds it.
+package graphql
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+)
+
+// Largest request body accepted by Handler
+const MAX_REQUEST_SIZE = 1 << 20
+
+// Deepest selection nesting executed, so one query cannot walk the graph indefinitely
+const MAX_DEPTH = 10
+
+// The root types. Mutation may be nil.
+type Schema struct {
+	Query    *Object
+	Mutation *Object
+}
+
+// An object type and its fields
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Resolves a field of an object. source is the value of the enclosing object, nil for
+// root fields.
+type ResolveFunc func(ctx context.Context, source any, args Args) (any, error)
+
+type Field struct {
+	// Type of the resolved value when it is an object, or a slice of them; nil for
+	// scalars and lists of scalars, which are encoded as JSON
+	Type    *Object
+	Resolve ResolveFunc
+}
+
+// A field that reads a property of its source, which must be a T
+func Property[T any](get func(source T) any) *Field {
+	return &Field{Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+		return get(source.(T)), nil
+	}}
+}
+
+// Field arguments with variables substituted. Numbers are int64 when integral and
+// float64 otherwise, whether written in the query or passed as variables.
+type Args map[string]any
+
+// The named argument if it is a string
+func (a Args) String(name string) (string, bool) {
+	s, ok := a[name].(string)
+	return s, ok
+}
+
+// A request as sent by GraphQL clients
+type Request struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName,omitempty"`
+	Variables     map[string]any `json:"variables,omitempty"`
+}
+
+type Response struct {
+	Data   any      `json:"data"` // omitted when the request failed before execution
+	Errors []*Error `json:"errors,omitempty"`
+
+	executed bool
+}
+
+// Omits data for requests that never executed, as the spec requires
+func (r Response) MarshalJSON() ([]byte, error) {
+	if !r.executed {
+		return json.Marshal(struct {
+			Errors []*Error `json:"errors"`
+		}{r.Errors})
+	}
+	type plain Response
+	return json.Marshal(plain(r))
+}
+
+type Error struct {
+	Message   string     `json:"message"`
+	Locations []Location `json:"locations,omitempty"`
+	Path      []any      `json:"path,omitempty"`
+}
+
+func (e *Error) Error() string { return e.Message }
+
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Parses, validates and executes request against schema. Resolver errors leave their
+// field null and are reported with its path; the rest of the data is still returned.
+func Execute(ctx context.Context, schema *Schema, request Request) Response {
+	doc, err := parse(request.Query)
+	if err != nil {
+		var syntaxErr *SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return Response{Errors: []*Error{{Message: syntaxErr.Message, Locations: []Location{{syntaxErr.Line, syntaxErr.Col}}}}}
+		}
+		return failed(err.Error())
+	}
+
+	op, err := doc.operation(request.OperationName)
+	if err != nil {
+		return failed(err.Error())
+	}
+	root := schema.Query
+	if op.kind == "mutation" {
+		if root = schema.Mutation; root == nil {
+			return failed("mutations are not supported")
+		}
+	}
+	variables, err := coerceVariables(op, request.Variables)
+	if err != nil {
+		return failed(err.Error())
+	}
+
+	e := &executor{doc: doc, variables: variables}
+	if errs := e.validate(root, op.selections, nil, 1); len(errs) > 0 {
+		return Response{Errors: errs}
+	}
+	data := e.executeSelections(ctx, root, nil, op.selections, nil)
+	return Response{Data: data, Errors: e.errors, executed: true}
+}
+
+func failed(message string) Response {
+	return Response{Errors: []*Error{{Message: message}}}
+}
+
+func (d *document) operation(name string) (*operation, error) {
+	if name == "" {
+		if len(d.operations) > 1 {
+			return nil, errors.New("operationName is required for documents with several operations")
+		}
+		return d.operations[0], nil
+	}
+	for _, op := range d.operations {
+		if op.name == name {
+			return op, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", name)
+}
+
+// Applies defaults and checks that non-null variables are provided
+func coerceVariables(op *operation, provided map[string]any) (map[string]any, error) {
+	variables := map[string]any{}
+	for _, definition := range op.variables {
+		v, ok := provided[definition.name]
+		if !ok && definition.defaultValue != nil {
+			v, ok = definition.defaultValue, true
+		}
+		if definition.nonNull && (!ok || v == nil) {
+			return nil, fmt.Errorf("variable $%s is required", definition.name)
+		}
+		if ok {
+			variables[definition.name] = v
+		}
+	}
+	return variables, nil
+}
+
+type executor struct {
+	doc       *document
+	variables map[string]any
+	errors    []*Error
+}
+
+// The fields of selections that apply to object, grouped by response key in order.
+// Fragments are flattened and @include/@skip applied.
+func (e *executor) collectFields(object *Object, selections []selection, visited map[string]bool) (keys []string, groups map[string][]*field) {
+	groups = map[string][]*field{}
+	var collect func(selections []selection)
+	collect = func(selections []selection) {
+		for _, sel := range selections {
+			switch sel := sel.(type) {
+			case *field:
+				if !e.included(sel.directives) {
+					continue
+				}
+				if _, seen := groups[sel.key()]; !seen {
+					keys = append(keys, sel.key())
+				}
+				groups[sel.key()] = append(groups[sel.key()], sel)
+			case *fragmentSpread:
+				fragment := e.doc.fragments[sel.name]
+				if fragment == nil || visited[sel.name] || !e.included(sel.directives) || fragment.typeName != object.Name {
+					continue
+				}
+				visited[sel.name] = true
+				collect(fragment.selections)
+				delete(visited, sel.name)
+			case *inlineFragment:
+				if !e.included(sel.directives) || sel.typeName != "" && sel.typeName != object.Name {
+					continue
+				}
+				collect(sel.selections)
+			}
+		}
+	}
+	collect(selections)
+	return keys, groups
+}
+
+func (e *executor) included(directives []directive) bool {
+	for _, d := range directives {
+		condition, _ := e.resolveValue(d.arguments["if"]).(bool)
+		if d.name == "skip" && condition || d.name == "include" && !condition {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks fields against the schema before anything runs
+func (e *executor) validate(object *Object, selections []selection, path []any, depth int) []*Error {
+	if depth > MAX_DEPTH {
+		return []*Error{{Message: fmt.Sprintf("query is nested deeper than %d levels", MAX_DEPTH), Path: path}}
+	}
+	var errs []*Error
+	for _, sel := range selections {
+		if spread, ok := sel.(*fragmentSpread); ok && e.doc.fragments[spread.name] == nil {
+			errs = append(errs, &Error{Message: fmt.Sprintf("unknown fragment %q", spread.name)})
+		}
+	}
+	keys, groups := e.collectFields(object, selections, map[string]bool{})
+	for _, key := range keys {
+		for _, f := range groups[key] {
+			location := []Location{{f.line, f.col}}
+			if f.name == "__typename" {
+				continue
+			}
+			definition := object.Fields[f.name]
+			if definition == nil {
+				errs = append(errs, &Error{Message: fmt.Sprintf("unknown field %q on %s", f.name, object.Name), Locations: location})
+				continue
+			}
+			switch {
+			case definition.Type == nil && f.selections != nil:
+				errs = append(errs, &Error{Message: fmt.Sprintf("field %q is a scalar and takes no selection", f.name), Locations: location})
+			case definition.Type != nil && f.selections == nil:
+				errs = append(errs, &Error{Message: fmt.Sprintf("field %q needs a selection of %s fields", f.name, definition.Type.Name), Locations: location})
+			case definition.Type != nil:
+				errs = append(errs, e.validate(definition.Type, f.selections, append(path, key), depth+1)...)
+			}
+		}
+	}
+	return errs
+}
+
+func (e *executor) executeSelections(ctx context.Context, object *Object, source any, selections []selection, path []any) orderedMap {
+	keys, groups := e.collectFields(object, selections, map[string]bool{})
+	result := make(orderedMap, 0, len(keys))
+	for _, key := range keys {
+		fields := groups[key]
+		f := fields[0]
+		if f.name == "__typename" {
+			result = append(result, entry{key, object.Name})
+			continue
+		}
+		var merged []selection
+		for _, same := range fields {
+			merged = append(merged, same.selections...)
+		}
+
+		fieldPath := append(append([]any(nil), path...), key)
+		definition := object.Fields[f.name]
+		value, err := resolve(ctx, definition, source, e.arguments(f.arguments))
+		if err != nil {
+			e.errors = append(e.errors, &Error{Message: err.Error(), Locations: []Location{{f.line, f.col}}, Path: fieldPath})
+			result = append(result, entry{key, nil})
+			continue
+		}
+		result = append(result, entry{key, e.complete(ctx, definition.Type, value, merged, fieldPath)})
+	}
+	return result
+}
+
+// Runs the resolver of definition, turning a panic into an error of the field so one
+// broken resolver cannot fail the whole request, or the server
+func resolve(ctx context.Context, definition *Field, source any, args Args) (value any, err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			value, err = nil, fmt.Errorf("internal error: %v", recovered)
+		}
+	}()
+	return definition.Resolve(ctx, source, args)
+}
+
+// Applies the sub-selection to an object value, or to each element of a list of them
+func (e *executor) complete(ctx context.Context, object *Object, value any, selections []selection, path []any) any {
+	if object == nil || value == nil {
+		return value
+	}
+	v := reflect.ValueOf(value)
+	if v.Kind() == reflect.Pointer && v.IsNil() {
+		return nil
+	}
+	if v.Kind() == reflect.Slice {
+		items := make([]any, v.Len())
+		for i := range items {
+			items[i] = e.complete(ctx, object, v.Index(i).Interface(), selections, append(path, i))
+		}
+		return items
+	}
+	return e.executeSelections(ctx, object, value, selections, path)
+}
+
+func (e *executor) arguments(arguments map[string]value) Args {
+	args := Args{}
+	for name, v := range arguments {
+		args[name] = e.resolveValue(v)
+	}
+	return args
+}
+
+// Replaces variables in v, recursively, and unwraps enum values to strings
+func (e *executor) resolveValue(v value) any {
+	switch v := v.(type) {
+	case variable:
+		return e.variables[string(v)]
+	case enumValue:
+		return string(v)
+	case []value:
+		list := make([]any, len(v))
+		for i, item := range v {
+			list[i] = e.resolveValue(item)
+		}
+		return list
+	case map[string]value:
+		object := map[string]any{}
+		for name, item := range v {
+			object[name] = e.resolveValue(item)
+		}
+		return object
+	}
+	return v
+}
+
+// A JSON object that keeps the order of the selection
+type orderedMap []entry
+
+type entry struct {
+	key   string
+	value any
+}
+
+func (m orderedMap) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, item := range m {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(item.key)
+		value, err := json.Marshal(item.value)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// Serves schema over HTTP POST with a JSON body, per the GraphQL over HTTP convention.
+// Executed requests answer 200 even when fields failed; a body that is not a request
+// answers 400.
+func Handler(schema *Schema) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request Request
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_REQUEST_SIZE))
+		decoder.UseNumber()
+		status := http.StatusOK
+		var response Response
+		if err := decoder.Decode(&request); err != nil || request.Query == "" {
+			status, response = http.StatusBadRequest, failed("body must be a JSON object with a query")
+		} else {
+			request.Variables = plainNumbers(request.Variables).(map[string]any)
+			response = Execute(r.Context(), schema, request)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+// Turns json.Numbers back into float64, keeping integers that fit exactly as int64 so
+// resolvers see the same types as for literals
+func plainNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = plainNumbers(v[i])
+		}
+	case map[string]any:
+		if v == nil {
+			return map[string]any{}
+		}
+		for key := range v {
+			v[key] = plainNumbers(v[key])
+		}
+	}
+	return v
+}
@@ -0,0 +1,118 @@
+package graphql
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+type file struct {
+	Name string
+	Size int64
+}
+
+var testSchema = func() *Schema {
+	fileType := &Object{Name: "File", Fields: map[string]*Field{
+		"name": Property(func(f file) any { return f.Name }),
+		"size": Property(func(f file) any { return f.Size }),
+	}}
+	return &Schema{Query: &Object{Name: "Query", Fields: map[string]*Field{
+		"files": {Type: fileType, Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+			return []file{{"a.txt", 1}, {"b.txt", 2}}, nil
+		}},
+		"file": {Type: fileType, Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+			name, _ := args.String("name")
+			return file{Name: name}, nil
+		}},
+		"failing": {Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+			return nil, errors.New("not allowed")
+		}},
+		// Hands its fields a value they do not expect, so Property panics
+		"broken": {Type: fileType, Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+			return "not a file", nil
+		}},
+		"panicking": {Resolve: func(ctx context.Context, source any, args Args) (any, error) {
+			panic("resolver bug")
+		}},
+	}}}
+}()
+
+func TestExecute(t *testing.T) {
+	tests := []struct {
+		name      string
+		request   Request
+		want      string
+		wantError string
+	}{
+		{
+			name:    "aliases and fragments",
+			request: Request{Query: `{ files { ...F } one: file(name: "c.txt") { name } } fragment F on File { name size }`},
+			want:    `{"data":{"files":[{"name":"a.txt","size":1},{"name":"b.txt","size":2}],"one":{"name":"c.txt"}}}`,
+		},
+		{
+			name:    "variables and directives",
+			request: Request{Query: `query($n: String!, $all: Boolean = false) { file(name: $n) { name size @include(if: $all) } }`, Variables: map[string]any{"n": "d.txt"}},
+			want:    `{"data":{"file":{"name":"d.txt"}}}`,
+		},
+		{
+			name:      "resolver error",
+			request:   Request{Query: `{ failing file(name: "e") { name } }`},
+			want:      `{"data":{"failing":null,"file":{"name":"e"}},"errors":[{"message":"not allowed","locations":[{"line":1,"column":3}],"path":["failing"]}]}`,
+			wantError: "not allowed",
+		},
+		{
+			name:      "panicking resolver",
+			request:   Request{Query: `{ panicking }`},
+			want:      `{"data":{"panicking":null},"errors":[{"message":"internal error: resolver bug","locations":[{"line":1,"column":3}],"path":["panicking"]}]}`,
+			wantError: "internal error: resolver bug",
+		},
+		{
+			name:      "panicking property",
+			request:   Request{Query: `{ broken { name } }`},
+			wantError: "internal error: interface conversion: interface {} is string, not graphql.file",
+		},
+		{
+			name:      "syntax error",
+			request:   Request{Query: `{ files { name }`},
+			want:      `{"errors":[{"message":"unterminated selection set","locations":[{"line":1,"column":17}]}]}`,
+			wantError: "unterminated selection set",
+		},
+		{
+			name:      "unknown field",
+			request:   Request{Query: `{ missing }`},
+			wantError: `unknown field "missing" on Query`,
+		},
+		{
+			name:      "missing variable",
+			request:   Request{Query: `query($n: String!) { file(name: $n) { name } }`},
+			wantError: "variable $n is required",
+		},
+		{
+			name:      "mutations unsupported",
+			request:   Request{Query: `mutation { files { name } }`},
+			wantError: "mutations are not supported",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := Execute(context.Background(), testSchema, test.request)
+			if test.wantError == "" && len(response.Errors) > 0 {
+				t.Errorf("unexpected errors: %v", response.Errors[0])
+			}
+			if test.wantError != "" && (len(response.Errors) == 0 || response.Errors[0].Message != test.wantError) {
+				t.Errorf("errors = %v, want %q", response.Errors, test.wantError)
+			}
+			if test.want == "" {
+				return
+			}
+			encoded, err := json.Marshal(response)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(encoded) != test.want {
+				t.Errorf("response = %s, want %s", encoded, test.want)
+			}
+		})
+	}
+}
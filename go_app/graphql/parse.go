@@ -0,0 +1,506 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A parsed request document: operations and the fragments they spread
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind       string // "query" or "mutation"
+	name       string
+	variables  []variableDefinition
+	selections []selection
+}
+
+type variableDefinition struct {
+	name         string
+	nonNull      bool
+	defaultValue value // nil without a default
+}
+
+type fragment struct {
+	typeName   string
+	selections []selection
+}
+
+// A field, a fragment spread or an inline fragment
+type selection interface{}
+
+type field struct {
+	alias      string
+	name       string
+	arguments  map[string]value
+	directives []directive
+	selections []selection
+	line, col  int
+}
+
+// The response key of f: its alias, or its name
+func (f *field) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type fragmentSpread struct {
+	name       string
+	directives []directive
+}
+
+type inlineFragment struct {
+	typeName   string // empty to apply to any type
+	directives []directive
+	selections []selection
+}
+
+type directive struct {
+	name      string
+	arguments map[string]value
+}
+
+// An input value as written in the document
+type value interface{}
+
+type variable string
+
+type enumValue string
+
+// A syntax error with its position in the document
+type SyntaxError struct {
+	Message   string
+	Line, Col int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("syntax error at %d:%d: %s", e.Line, e.Col, e.Message)
+}
+
+const (
+	tokenEOF = iota
+	tokenPunctuator
+	tokenName
+	tokenInt
+	tokenFloat
+	tokenString
+)
+
+type token struct {
+	kind      int
+	text      string
+	line, col int
+}
+
+// Deepest nesting of selection sets, lists and objects parsed. The recursive descent
+// would otherwise let a body of nothing but brackets grow the stack without limit.
+const MAX_PARSE_DEPTH = 64
+
+type parser struct {
+	source    string
+	offset    int
+	line, col int
+	token     token
+	depth     int
+}
+
+// The parser reports errors by panicking with a *SyntaxError from fail, which saves
+// checking an error after every token. Every panic stops here: a SyntaxError is
+// returned as it is, and anything else, which would be a bug in the parser, becomes an
+// error rather than taking the request down.
+func parse(source string) (doc *document, err error) {
+	p := &parser{source: source, line: 1, col: 1}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			if syntaxErr, ok := recovered.(*SyntaxError); ok {
+				err = syntaxErr
+				return
+			}
+			doc, err = nil, fmt.Errorf("parse failed: %v", recovered)
+		}
+	}()
+	p.next()
+	return p.parseDocument(), nil
+}
+
+func (p *parser) fail(format string, args ...any) {
+	panic(&SyntaxError{Message: fmt.Sprintf(format, args...), Line: p.token.line, Col: p.token.col})
+}
+
+// Enters a nested construct; call the returned function to leave it
+func (p *parser) nest() func() {
+	if p.depth++; p.depth > MAX_PARSE_DEPTH {
+		p.fail("nested deeper than %d levels", MAX_PARSE_DEPTH)
+	}
+	return func() { p.depth-- }
+}
+
+// Reads the next token, skipping whitespace, commas and comments
+func (p *parser) next() {
+	for p.offset < len(p.source) {
+		c := p.source[p.offset]
+		if c == '#' {
+			for p.offset < len(p.source) && p.source[p.offset] != '\n' {
+				p.advance(1)
+			}
+		} else if c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',' {
+			p.advance(1)
+		} else {
+			break
+		}
+	}
+	p.token = token{line: p.line, col: p.col}
+	if p.offset >= len(p.source) {
+		p.token.kind = tokenEOF
+		return
+	}
+
+	start := p.offset
+	c := p.source[p.offset]
+	switch {
+	case strings.HasPrefix(p.source[p.offset:], "..."):
+		p.advance(3)
+		p.token.kind = tokenPunctuator
+	case strings.ContainsRune("!$()[]{}:=@|&", rune(c)):
+		p.advance(1)
+		p.token.kind = tokenPunctuator
+	case c == '_' || isLetter(c):
+		for p.offset < len(p.source) && (p.source[p.offset] == '_' || isLetter(p.source[p.offset]) || isDigit(p.source[p.offset])) {
+			p.advance(1)
+		}
+		p.token.kind = tokenName
+	case c == '-' || isDigit(c):
+		p.token.kind = p.readNumber()
+	case c == '"':
+		p.token.kind = tokenString
+		p.token.text = p.readString()
+		return
+	default:
+		p.fail("unexpected character %q", c)
+	}
+	p.token.text = p.source[start:p.offset]
+}
+
+func (p *parser) advance(n int) {
+	for i := 0; i < n; i++ {
+		if p.source[p.offset] == '\n' {
+			p.line++
+			p.col = 1
+		} else {
+			p.col++
+		}
+		p.offset++
+	}
+}
+
+func (p *parser) readNumber() int {
+	kind := tokenInt
+	if p.source[p.offset] == '-' {
+		p.advance(1)
+	}
+	digits := func() {
+		start := p.offset
+		for p.offset < len(p.source) && isDigit(p.source[p.offset]) {
+			p.advance(1)
+		}
+		if p.offset == start {
+			p.fail("malformed number")
+		}
+	}
+	digits()
+	if p.offset < len(p.source) && p.source[p.offset] == '.' {
+		kind = tokenFloat
+		p.advance(1)
+		digits()
+	}
+	if p.offset < len(p.source) && (p.source[p.offset] == 'e' || p.source[p.offset] == 'E') {
+		kind = tokenFloat
+		p.advance(1)
+		if p.offset < len(p.source) && (p.source[p.offset] == '+' || p.source[p.offset] == '-') {
+			p.advance(1)
+		}
+		digits()
+	}
+	return kind
+}
+
+// Reads a quoted string with its escapes; block strings are not supported
+func (p *parser) readString() string {
+	if strings.HasPrefix(p.source[p.offset:], `"""`) {
+		p.fail("block strings are not supported")
+	}
+	p.advance(1)
+	var text strings.Builder
+	for {
+		if p.offset >= len(p.source) || p.source[p.offset] == '\n' {
+			p.fail("unterminated string")
+		}
+		c := p.source[p.offset]
+		switch {
+		case c == '"':
+			p.advance(1)
+			return text.String()
+		case c == '\\':
+			if p.offset+1 >= len(p.source) {
+				p.fail("unterminated string")
+			}
+			escape := p.source[p.offset+1]
+			if escape == 'u' {
+				if p.offset+6 > len(p.source) {
+					p.fail("malformed unicode escape")
+				}
+				code, err := strconv.ParseUint(p.source[p.offset+2:p.offset+6], 16, 32)
+				if err != nil {
+					p.fail("malformed unicode escape")
+				}
+				text.WriteRune(rune(code))
+				p.advance(6)
+				continue
+			}
+			replacement, ok := map[byte]string{'"': `"`, '\\': `\`, '/': "/", 'b': "\b", 'f': "\f", 'n': "\n", 'r': "\r", 't': "\t"}[escape]
+			if !ok {
+				p.fail("unknown escape \\%c", escape)
+			}
+			text.WriteString(replacement)
+			p.advance(2)
+		default:
+			r, size := utf8.DecodeRuneInString(p.source[p.offset:])
+			text.WriteRune(r)
+			p.advance(size)
+		}
+	}
+}
+
+func isLetter(c byte) bool { return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func (p *parser) peek(punctuator string) bool {
+	return p.token.kind == tokenPunctuator && p.token.text == punctuator
+}
+
+func (p *parser) skip(punctuator string) bool {
+	if p.peek(punctuator) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(punctuator string) {
+	if !p.skip(punctuator) {
+		p.fail("expected %q, found %q", punctuator, p.token.text)
+	}
+}
+
+func (p *parser) name() string {
+	if p.token.kind != tokenName {
+		p.fail("expected a name, found %q", p.token.text)
+	}
+	name := p.token.text
+	p.next()
+	return name
+}
+
+func (p *parser) keyword(word string) bool {
+	if p.token.kind == tokenName && p.token.text == word {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) parseDocument() *document {
+	doc := &document{fragments: map[string]*fragment{}}
+	for p.token.kind != tokenEOF {
+		switch {
+		case p.peek("{"):
+			doc.operations = append(doc.operations, &operation{kind: "query", selections: p.parseSelectionSet()})
+		case p.keyword("fragment"):
+			name := p.name()
+			if !p.keyword("on") {
+				p.fail("expected \"on\"")
+			}
+			if _, exists := doc.fragments[name]; exists {
+				p.fail("duplicate fragment %q", name)
+			}
+			typeName := p.name()
+			p.parseDirectives()
+			doc.fragments[name] = &fragment{typeName: typeName, selections: p.parseSelectionSet()}
+		case p.token.kind == tokenName && (p.token.text == "query" || p.token.text == "mutation"):
+			op := &operation{kind: p.name()}
+			if p.token.kind == tokenName {
+				op.name = p.name()
+			}
+			if p.skip("(") {
+				for !p.skip(")") {
+					op.variables = append(op.variables, p.parseVariableDefinition())
+				}
+			}
+			p.parseDirectives()
+			op.selections = p.parseSelectionSet()
+			doc.operations = append(doc.operations, op)
+		default:
+			p.fail("expected an operation or fragment, found %q", p.token.text)
+		}
+	}
+	if len(doc.operations) == 0 {
+		p.fail("no operations")
+	}
+	return doc
+}
+
+func (p *parser) parseVariableDefinition() variableDefinition {
+	p.expect("$")
+	definition := variableDefinition{name: p.name()}
+	p.expect(":")
+	definition.nonNull = p.parseType()
+	if p.skip("=") {
+		definition.defaultValue = p.parseValue(true)
+	}
+	p.parseDirectives()
+	return definition
+}
+
+// Skips a type reference, reporting whether it is non-null. Variables are passed to
+// resolvers as sent, so the type itself is not kept.
+func (p *parser) parseType() bool {
+	defer p.nest()()
+	if p.skip("[") {
+		p.parseType()
+		p.expect("]")
+	} else {
+		p.name()
+	}
+	return p.skip("!")
+}
+
+func (p *parser) parseSelectionSet() []selection {
+	defer p.nest()()
+	p.expect("{")
+	if p.peek("}") {
+		p.fail("empty selection set")
+	}
+	var selections []selection
+	for !p.skip("}") {
+		if p.token.kind == tokenEOF {
+			p.fail("unterminated selection set")
+		}
+		selections = append(selections, p.parseSelection())
+	}
+	return selections
+}
+
+func (p *parser) parseSelection() selection {
+	if p.skip("...") {
+		if p.token.kind == tokenName && p.token.text != "on" {
+			return &fragmentSpread{name: p.name(), directives: p.parseDirectives()}
+		}
+		inline := &inlineFragment{}
+		if p.keyword("on") {
+			inline.typeName = p.name()
+		}
+		inline.directives = p.parseDirectives()
+		inline.selections = p.parseSelectionSet()
+		return inline
+	}
+
+	// The position is read before name() moves past it
+	f := &field{line: p.token.line, col: p.token.col}
+	f.name = p.name()
+	if p.skip(":") {
+		f.alias, f.name = f.name, p.name()
+	}
+	f.arguments = p.parseArguments()
+	f.directives = p.parseDirectives()
+	if p.peek("{") {
+		f.selections = p.parseSelectionSet()
+	}
+	return f
+}
+
+func (p *parser) parseArguments() map[string]value {
+	if !p.skip("(") {
+		return nil
+	}
+	arguments := map[string]value{}
+	for !p.skip(")") {
+		name := p.name()
+		p.expect(":")
+		arguments[name] = p.parseValue(false)
+	}
+	return arguments
+}
+
+func (p *parser) parseDirectives() []directive {
+	var directives []directive
+	for p.skip("@") {
+		directives = append(directives, directive{name: p.name(), arguments: p.parseArguments()})
+	}
+	return directives
+}
+
+// Parses an input value; constant values, like variable defaults, cannot use variables
+func (p *parser) parseValue(constant bool) value {
+	defer p.nest()()
+	switch {
+	case p.peek("$"):
+		if constant {
+			p.fail("variables are not allowed here")
+		}
+		p.next()
+		return variable(p.name())
+	case p.skip("["):
+		list := []value{}
+		for !p.skip("]") {
+			list = append(list, p.parseValue(constant))
+		}
+		return list
+	case p.skip("{"):
+		object := map[string]value{}
+		for !p.skip("}") {
+			name := p.name()
+			p.expect(":")
+			object[name] = p.parseValue(constant)
+		}
+		return object
+	}
+
+	current := p.token
+	switch current.kind {
+	case tokenInt:
+		n, err := strconv.ParseInt(current.text, 10, 64)
+		if err != nil {
+			p.fail("integer out of range")
+		}
+		p.next()
+		return n
+	case tokenFloat:
+		p.next()
+		f, _ := strconv.ParseFloat(current.text, 64)
+		return f
+	case tokenString:
+		p.next()
+		return current.text
+	case tokenName:
+		p.next()
+		switch current.text {
+		case "true":
+			return true
+		case "false":
+			return false
+		case "null":
+			return nil
+		}
+		return enumValue(current.text)
+	}
+	p.fail("expected a value, found %q", current.text)
+	return nil
+}
@@ -0,0 +1,154 @@
+package graphql
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	doc, err := parse(`
+		# comments, commas and whitespace are ignored
+		query Files($limit: Int = 10, $owner: String!, $tags: [String!]) @cached {
+			recent: files(limit: $limit, owner: $owner, order: NEWEST, tags: $tags) {
+				id, name
+				...Meta @include(if: true)
+				... on File { size }
+				... @skip(if: false) { type }
+			}
+		}
+		fragment Meta on File { created updated }
+		mutation { delete(id: "a\"bé\n", force: true, retries: -3, ratio: 1.5e2, parent: null, filter: {kinds: [1, 2]}) }
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.operations) != 2 || len(doc.fragments) != 1 {
+		t.Fatalf("got %d operations and %d fragments, want 2 and 1", len(doc.operations), len(doc.fragments))
+	}
+
+	query := doc.operations[0]
+	if query.kind != "query" || query.name != "Files" {
+		t.Errorf("operation = %s %s, want query Files", query.kind, query.name)
+	}
+	wantVariables := []variableDefinition{
+		{name: "limit", defaultValue: int64(10)},
+		{name: "owner", nonNull: true},
+		{name: "tags"},
+	}
+	if !reflect.DeepEqual(query.variables, wantVariables) {
+		t.Errorf("variables = %+v, want %+v", query.variables, wantVariables)
+	}
+
+	files := query.selections[0].(*field)
+	if files.alias != "recent" || files.name != "files" || files.key() != "recent" {
+		t.Errorf("field = %s: %s, want recent: files", files.alias, files.name)
+	}
+	wantArguments := map[string]value{"limit": variable("limit"), "owner": variable("owner"), "order": enumValue("NEWEST"), "tags": variable("tags")}
+	if !reflect.DeepEqual(files.arguments, wantArguments) {
+		t.Errorf("arguments = %#v, want %#v", files.arguments, wantArguments)
+	}
+	if files.line != 4 || files.col != 4 {
+		t.Errorf("field at %d:%d, want 4:4", files.line, files.col)
+	}
+	if len(files.selections) != 5 {
+		t.Fatalf("got %d selections, want 5", len(files.selections))
+	}
+	spread := files.selections[2].(*fragmentSpread)
+	if spread.name != "Meta" || spread.directives[0].name != "include" || spread.directives[0].arguments["if"] != true {
+		t.Errorf("spread = %+v", spread)
+	}
+	if inline := files.selections[3].(*inlineFragment); inline.typeName != "File" {
+		t.Errorf("inline fragment on %q, want File", inline.typeName)
+	}
+	if inline := files.selections[4].(*inlineFragment); inline.typeName != "" || inline.directives[0].name != "skip" {
+		t.Errorf("inline fragment = %+v, want an untyped one with @skip", inline)
+	}
+	if meta := doc.fragments["Meta"]; meta.typeName != "File" || len(meta.selections) != 2 {
+		t.Errorf("fragment = %+v", meta)
+	}
+
+	mutation := doc.operations[1]
+	wantValues := map[string]value{
+		"id":      "a\"bé\n",
+		"force":   true,
+		"retries": int64(-3),
+		"ratio":   150.0,
+		"parent":  nil,
+		"filter":  map[string]value{"kinds": []value{int64(1), int64(2)}},
+	}
+	if got := mutation.selections[0].(*field).arguments; mutation.kind != "mutation" || !reflect.DeepEqual(got, wantValues) {
+		t.Errorf("mutation arguments = %#v, want %#v", got, wantValues)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		message   string
+		line, col int
+	}{
+		{"empty document", "", "no operations", 1, 1},
+		{"empty selection set", "{ }", "empty selection set", 1, 3},
+		{"unterminated selection set", "{ a", "unterminated selection set", 1, 4},
+		{"missing argument value", "{ a(b: ) }", `expected a value, found ")"`, 1, 8},
+		{"missing colon", "{ a(b 1) }", `expected ":", found "1"`, 1, 7},
+		{"unexpected character", "{ a; }", `unexpected character ';'`, 1, 4},
+		{"error position across lines", "{\n  a\n  b(\n}", `expected a name, found "}"`, 4, 1},
+		{"unknown definition", "subscription { a }", `expected an operation or fragment, found "subscription"`, 1, 1},
+		{"fragment without type", "fragment F { a } { a }", `expected "on"`, 1, 12},
+		{"duplicate fragment", "fragment F on T { a } fragment F on T { b } { a }", `duplicate fragment "F"`, 1, 37},
+		{"variable in a default", "query($a: Int = $b) { a }", "variables are not allowed here", 1, 17},
+		{"unterminated string", `{ a(b: "c) }`, "unterminated string", 1, 8},
+		{"newline in a string", "{ a(b: \"c\n\") }", "unterminated string", 1, 8},
+		{"unknown escape", `{ a(b: "\x") }`, `unknown escape \x`, 1, 8},
+		{"short unicode escape", `{ a(b: "\u12") }`, "malformed unicode escape", 1, 8},
+		{"bad unicode escape", `{ a(b: "\uZZZZ") }`, "malformed unicode escape", 1, 8},
+		{"block string", `{ a(b: """c""") }`, "block strings are not supported", 1, 8},
+		{"malformed number", "{ a(b: -) }", "malformed number", 1, 8},
+		{"malformed exponent", "{ a(b: 1e) }", "malformed number", 1, 8},
+		{"integer out of range", "{ a(b: 9223372036854775808) }", "integer out of range", 1, 8},
+		{"selections nested too deeply", "{" + strings.Repeat(" a {", MAX_PARSE_DEPTH) + " b" + strings.Repeat(" }", MAX_PARSE_DEPTH+1), "nested deeper than 64 levels", 1, 257},
+		{"values nested too deeply", "{ a(b: " + strings.Repeat("[", 100) + strings.Repeat("]", 100) + ") }", "nested deeper than 64 levels", 1, 71},
+		{"types nested too deeply", "query($a: " + strings.Repeat("[", 100) + "Int" + strings.Repeat("]", 100) + ") { a }", "nested deeper than 64 levels", 1, 75},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			doc, err := parse(test.source)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("parse() = %v, %v, want a syntax error", doc, err)
+			}
+			if syntaxErr.Message != test.message || syntaxErr.Line != test.line || syntaxErr.Col != test.col {
+				t.Errorf("error = %q at %d:%d, want %q at %d:%d", syntaxErr.Message, syntaxErr.Line, syntaxErr.Col, test.message, test.line, test.col)
+			}
+		})
+	}
+}
+
+// Whatever the input, parse returns a document or a SyntaxError. Any other error is a
+// panic of the parser that parse recovered from, and so a bug.
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"{ a }",
+		`query Q($v: [Int!] = [1]) { a: b(c: $v, d: "eA", f: {g: 1.5e3}) @include(if: true) { ...F ... on T { h } } }`,
+		"fragment F on T { a } mutation { b }",
+		`{ a(b: "\`,
+		"{ a(b: -",
+		"[[[[",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, source string) {
+		doc, err := parse(source)
+		var syntaxErr *SyntaxError
+		if err != nil && !errors.As(err, &syntaxErr) {
+			t.Fatalf("parse(%q) failed: %v", source, err)
+		}
+		if (doc == nil) == (err == nil) {
+			t.Fatalf("parse(%q) = %v, %v, want either a document or an error", source, doc, err)
+		}
+	})
+}
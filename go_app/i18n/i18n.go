@@ -0,0 +1,162 @@
+// Package i18n picks the language of content for a client from its Accept-Language
+// preferences and the locales the content exists in, and looks up translated messages.
+package i18n
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Locale used when none of the client's preferences is available
+const DEFAULT_LOCALE = "en"
+
+// Lowercases tag and uses "-" as separator, so "pt_BR" and "pt-br" are the same locale
+func Canonical(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+// The language tags of an Accept-Language header, most preferred first. Tags with q=0,
+// malformed entries and the "*" wildcard are left out.
+func ParseAcceptLanguage(header string) []string {
+	type preference struct {
+		tag     string
+		quality float64
+	}
+	var preferences []preference
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = Canonical(tag)
+		if tag == "" || tag == "*" || !validTag(tag) {
+			continue
+		}
+		quality := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(value, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+			quality = q
+		}
+		if quality > 0 {
+			preferences = append(preferences, preference{tag, quality})
+		}
+	}
+	sort.SliceStable(preferences, func(i, j int) bool { return preferences[i].quality > preferences[j].quality })
+
+	tags := make([]string, len(preferences))
+	for i, p := range preferences {
+		tags[i] = p.tag
+	}
+	return tags
+}
+
+// Letters, digits and "-" only, which also keeps tags safe to use in file paths
+func validTag(tag string) bool {
+	for _, c := range tag {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// The locales to try for preferred, in order: each tag followed by its more general
+// parents ("de-ch" then "de"), then fallback. Duplicates are dropped.
+func Chain(preferred []string, fallback string) []string {
+	var chain []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			chain = append(chain, tag)
+		}
+	}
+	for _, tag := range preferred {
+		tag = Canonical(tag)
+		for {
+			add(tag)
+			i := strings.LastIndex(tag, "-")
+			if i < 0 {
+				break
+			}
+			tag = tag[:i]
+		}
+	}
+	add(Canonical(fallback))
+	return chain
+}
+
+// The first locale of Chain(preferred, fallback) for which available reports true, or
+// "" when there is none
+func Negotiate(preferred []string, fallback string, available func(locale string) bool) string {
+	for _, locale := range Chain(preferred, fallback) {
+		if available(locale) {
+			return locale
+		}
+	}
+	return ""
+}
+
+// Messages by key in several locales, read from <locale>.json files that each hold an
+// object of key to message
+type Catalog struct {
+	Fallback string // locale tried after the client's preferences
+
+	messages map[string]map[string]string // locale, key, message
+}
+
+// Reads every <locale>.json file in the root of fsys
+func LoadCatalog(fsys fs.FS, fallback string) (*Catalog, error) {
+	catalog := &Catalog{Fallback: Canonical(fallback), messages: make(map[string]map[string]string)}
+	files, err := fs.Glob(fsys, "*.json")
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(content, &messages); err != nil {
+			return nil, fmt.Errorf("catalog %s: %w", file, err)
+		}
+		catalog.messages[Canonical(strings.TrimSuffix(file, ".json"))] = messages
+	}
+	if catalog.messages[catalog.Fallback] == nil {
+		return nil, fmt.Errorf("catalog has no %s.json for the fallback locale", catalog.Fallback)
+	}
+	return catalog, nil
+}
+
+// The catalog's locales, sorted
+func (c *Catalog) Locales() []string {
+	locales := make([]string, 0, len(c.messages))
+	for locale := range c.messages {
+		locales = append(locales, locale)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// The messages of locale, nil if the catalog lacks it. Do not modify the map.
+func (c *Catalog) Messages(locale string) map[string]string {
+	return c.messages[Canonical(locale)]
+}
+
+// The message for key in the first locale of Chain(preferred, c.Fallback) that has
+// it, and that locale. Keys missing from one locale fall back like missing locales.
+func (c *Catalog) Lookup(key string, preferred []string) (message, locale string, ok bool) {
+	locale = Negotiate(preferred, c.Fallback, func(locale string) bool {
+		_, ok := c.messages[locale][key]
+		return ok
+	})
+	if locale == "" {
+		return "", "", false
+	}
+	return c.messages[locale][key], locale, true
+}
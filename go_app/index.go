@@ -1,255 +1,224 @@
 package main
 
 import (
-	"crypto/rand"
-	"encoding/hex"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"strings"
-	"sync"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/golang-jwt/jwt/v4"
-)
-
-// Constants
-const CACHE_DURATION_MS = 5 * 60 * 1000 // 5 minutes
-const TOKEN_EXPIRATION_TIME = time.Hour // 1-hour token expiration
-
-// Function to generate a random secret key
-func generateSecretKey() string {
-	secret := make([]byte, 64)
-	_, err := rand.Read(secret)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return hex.EncodeToString(secret)
-}
-
-// Holds configuration information with metadata, SHA value, and last updated timestamp.
-type ConfigCache struct {
-	Metadata    map[string]interface{}
-	SHA         string
-	LastUpdated int64
-	Mutex       sync.Mutex
-}
+	"github.com/quic-go/quic-go/http3"
 
-var configCache = ConfigCache{
-	Metadata:    nil,
-	SHA:         "",
-	LastUpdated: 0,
-}
+	"go_app/lifecycle"
+	"go_app/server"
+)
 
-// Token blacklist to store used tokens
-var tokenBlacklist = struct {
-	Set   map[string]struct{}
-	Mutex sync.Mutex
-}{
-	Set: make(map[string]struct{}),
-}
+// How long in-flight requests get to finish after SIGINT or SIGTERM, per listener
+const SHUTDOWN_TIMEOUT = 15 * time.Second
 
-// Cached token and secret key
-var cachedToken string
-var cachedSecretKey = generateSecretKey()
+// Embedded web assets, set by web_embed.go when built with the embedweb tag
+var webFS fs.FS
 
-func getGitSha() (string, error) {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
-	output, err := cmd.Output()
+func main() {
+	config, err := server.LoadConfig(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintf(os.Stderr, "\nConfig keys (flag, environment variable, default):\n%s\n", server.ConfigUsage())
+		os.Exit(0)
+	}
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
-	return strings.TrimSpace(string(output)), nil
-}
-
-func handleErrorResponse(w http.ResponseWriter, statusCode int, message string) {
-	log.Println(message)
-	w.WriteHeader(statusCode)
-	json.NewEncoder(w).Encode(map[string]string{"error": message})
-}
+	config.WebFS = webFS
 
-func loadConfiguration() (ConfigCache, error) {
-	currentTimestamp := time.Now().UnixNano() / int64(time.Millisecond)
-
-	configCache.Mutex.Lock()
-	defer configCache.Mutex.Unlock()
-
-	if configCache.Metadata != nil && (currentTimestamp-configCache.LastUpdated) < CACHE_DURATION_MS {
-		return configCache, nil
+	if config.CheckOnly {
+		if !server.WriteCheckReport(os.Stdout, server.Check(context.Background(), config)) {
+			os.Exit(1)
+		}
+		return
 	}
 
-	metadataContent, err := ioutil.ReadFile("./metadata.json")
+	app, err := server.New(config)
 	if err != nil {
-		log.Println("Configuration loading failed:", err)
-		return ConfigCache{}, errors.New("failed to load configuration")
+		log.Fatal(err)
 	}
-
-	var metadata map[string]interface{}
-	if err := json.Unmarshal(metadataContent, &metadata); err != nil {
-		log.Println("Configuration loading failed:", err)
-		return ConfigCache{}, errors.New("failed to parse configuration")
+	log.Printf("Starting %s", app.BuildInfo(context.Background()))
+	if config.Dev {
+		log.Printf("Development profile: %s database at %s", config.Database.Driver, config.Database.URL)
 	}
 
-	sha, err := getGitSha()
+	listener, err := newListener(config.ListenAddr, config.Port)
 	if err != nil {
-		log.Println("Configuration loading failed:", err)
-		return ConfigCache{}, errors.New("failed to get git SHA")
-	}
-
-	configCache.Metadata = metadata
-	configCache.SHA = sha
-	configCache.LastUpdated = currentTimestamp
-
-	return configCache, nil
-}
-
-func authenticateToken(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		token := strings.TrimPrefix(authHeader, "Bearer ")
-
-		if token == "" {
-			handleErrorResponse(w, http.StatusUnauthorized, "Unauthorized: Missing token")
-			return
-		}
-
-		tokenBlacklist.Mutex.Lock()
-		_, exists := tokenBlacklist.Set[token]
-		tokenBlacklist.Mutex.Unlock()
-
-		if exists {
-			handleErrorResponse(w, http.StatusForbidden, "Forbidden: Token has already been used")
-			return
-		}
-
-		claims := jwt.MapClaims{}
-		parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cachedSecretKey), nil
-		})
-
-		if err != nil || !parsedToken.Valid {
-			if errors.Is(err, jwt.ErrTokenExpired) {
-				handleErrorResponse(w, http.StatusUnauthorized, "Unauthorized: Token expired")
-			} else {
-				handleErrorResponse(w, http.StatusForbidden, "Forbidden: Invalid token")
-			}
-			return
-		}
-
-		if r.URL.Path != "/protected" {
-			tokenBlacklist.Mutex.Lock()
-			tokenBlacklist.Set[token] = struct{}{}
-			tokenBlacklist.Mutex.Unlock()
-		}
-
-		next(w, r)
+		log.Fatal(err)
 	}
-}
+	listener = app.LimitConnections(listener)
 
-func generateToken(payload map[string]interface{}) (string, error) {
-	cachedSecretKey = generateSecretKey() // Generate a new secret key
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims(payload))
-	signedToken, err := token.SignedString([]byte(cachedSecretKey))
+	tlsConfig, err := app.TLSConfig()
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
-	cachedToken = signedToken
-	return cachedToken, nil
-}
-
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	user := map[string]interface{}{"id": 1, "username": "exampleuser"}
-	token, err := generateToken(user)
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	sides, err := newSideServers(config, app)
 	if err != nil {
-		handleErrorResponse(w, http.StatusInternalServerError, "Failed to generate token")
-		return
+		log.Fatal(err)
 	}
-	json.NewEncoder(w).Encode(map[string]string{"token": token})
-}
-
-func refreshHandler(w http.ResponseWriter, r *http.Request) {
-	authHeader := r.Header.Get("Authorization")
-	token := strings.TrimPrefix(authHeader, "Bearer ")
-
-	if token == "" {
-		handleErrorResponse(w, http.StatusUnauthorized, "Unauthorized: Missing token")
-		return
+	var quicConn net.PacketConn
+	if config.HTTP3.Enabled {
+		if quicConn, err = net.ListenPacket("udp", config.HTTP3Addr()); err != nil {
+			log.Fatal(fmt.Errorf("http3: %w", err))
+		}
 	}
 
-	claims := jwt.MapClaims{}
-	parsedToken, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(cachedSecretKey), nil
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Admin and metrics come before the App's own subsystems, so they stay up until
+	// everything else has drained and the shutdown can be watched on
+	// /admin/shutdown-status. The public server comes after them, and the registry is
+	// left first so no new traffic is routed here while draining.
+	serveErrors := make(chan error, len(sides)+2)
+	for i := len(sides) - 1; i >= 0; i-- {
+		app.Lifecycle.Prepend(serveHook(sides[i].name, sides[i].server, sides[i].listener, serveErrors))
+	}
+	app.Lifecycle.Append(lifecycle.Background("config reload", func(ctx context.Context) { reloadOnHangup(ctx, app) }))
+	app.Lifecycle.Append(serveHook("public", app.NewServer(app.Handler()), listener, serveErrors))
+	if quicConn != nil {
+		app.Lifecycle.Append(serveHTTP3Hook(app, app.NewHTTP3Server(app.Handler(), tlsConfig), quicConn, serveErrors))
+	}
+	var deregister func(context.Context) error
+	app.Lifecycle.Append(lifecycle.Hook{
+		Name: "service registration",
+		Start: func(ctx context.Context) (err error) {
+			deregister, err = app.RegisterService(ctx, listener.Addr())
+			return err
+		},
+		Stop: func(ctx context.Context) error { return deregister(ctx) },
 	})
 
-	if err != nil || !parsedToken.Valid || claims["id"] == nil {
-		handleErrorResponse(w, http.StatusBadRequest, "Token is still valid, no need for refresh")
-		return
+	if err := app.Lifecycle.Start(ctx); err != nil {
+		log.Fatal(err)
 	}
-
-	newToken, err := generateToken(claims)
-	if err != nil {
-		handleErrorResponse(w, http.StatusInternalServerError, "Failed to refresh token")
-		return
+	var serveErr error
+	select {
+	case <-ctx.Done():
+	case serveErr = <-serveErrors:
+		log.Println("Server failed:", serveErr)
+	}
+	log.Println("Shutting down")
+	if err := app.Lifecycle.Stop(context.Background()); err != nil || serveErr != nil {
+		os.Exit(1)
 	}
-
-	json.NewEncoder(w).Encode(map[string]string{"token": newToken})
-}
-
-func protectedHandler(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "Access granted to protected resource",
-	})
-}
-
-func rootHandler(w http.ResponseWriter, r *http.Request) {
-	json.NewEncoder(w).Encode(map[string]string{"message": "Hello World"})
 }
 
-func statusHandler(w http.ResponseWriter, r *http.Request) {
-	config, err := loadConfiguration()
-	if err != nil {
-		handleErrorResponse(w, http.StatusInternalServerError, "Internal Server Error")
-		return
+// Serves on listener from start until stop, which waits up to SHUTDOWN_TIMEOUT for
+// requests in flight. Serve failing on its own is reported on errs.
+func serveHook(name string, server *http.Server, listener net.Listener, errs chan<- error) lifecycle.Hook {
+	return lifecycle.Hook{
+		Name: name + " server",
+		Start: func(context.Context) error {
+			log.Printf("Serving %s routes on %s", name, listener.Addr())
+			go func() {
+				if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+					errs <- fmt.Errorf("%s server: %w", name, err)
+				}
+			}()
+			return nil
+		},
+		Stop:    server.Shutdown,
+		Timeout: SHUTDOWN_TIMEOUT,
 	}
+}
 
-	buildNumber := os.Getenv("BUILD_NUMBER")
-	if buildNumber == "" {
-		buildNumber = "0"
+// serveHook for the HTTP/3 server on conn. Responses on the TCP listener advertise it
+// once it serves.
+func serveHTTP3Hook(app *server.App, h3 *http3.Server, conn net.PacketConn, errs chan<- error) lifecycle.Hook {
+	return lifecycle.Hook{
+		Name: "http3 server",
+		Start: func(context.Context) error {
+			log.Printf("Serving HTTP/3 on %s (experimental)", conn.LocalAddr())
+			go func() {
+				if err := h3.Serve(conn); !errors.Is(err, http.ErrServerClosed) {
+					errs <- fmt.Errorf("http3 server: %w", err)
+				}
+			}()
+			app.AdvertiseHTTP3(conn.LocalAddr().(*net.UDPAddr).Port)
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			drain, cancel := context.WithTimeout(ctx, SHUTDOWN_TIMEOUT)
+			defer cancel()
+			err := h3.Shutdown(drain)
+			if drain.Err() != nil {
+				// Clients that went away without closing their connections keep them
+				// open until they time out
+				err = h3.Close()
+			}
+			return errors.Join(err, conn.Close())
+		},
+		Timeout: SHUTDOWN_TIMEOUT + 5*time.Second,
 	}
+}
 
-	// Invalidate the cached token after use
-	cachedToken = ""
-
-	response := map[string][]map[string]string{
-		"my-application": {
-			{
-				"description": config.Metadata["description"].(string),
-				"version":     fmt.Sprintf("%s-%s", config.Metadata["version"].(string), buildNumber),
-				"sha":         config.SHA,
-			},
-		},
+// Re-reads the config layers on SIGHUP and applies what can change at runtime
+func reloadOnHangup(ctx context.Context, app *server.App) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+			config, err := server.LoadConfig(os.Args[1:])
+			if err == nil {
+				err = app.Reload(config)
+			}
+			if err != nil {
+				log.Println("Config reload failed:", err)
+			}
+		}
 	}
-	json.NewEncoder(w).Encode(response)
 }
 
-func main() {
-	http.HandleFunc("/login", loginHandler)
-	http.HandleFunc("/refresh", refreshHandler)
-	http.HandleFunc("/protected", authenticateToken(protectedHandler))
-	http.HandleFunc("/", rootHandler)
-	http.HandleFunc("/status", authenticateToken(statusHandler))
+// A listener next to the public one, for admin or metrics routes
+type sideServer struct {
+	name     string
+	server   *http.Server
+	listener net.Listener
+}
 
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "3000"
+// Binds the admin and metrics ports that are configured
+func newSideServers(config server.Config, app *server.App) ([]sideServer, error) {
+	candidates := []struct {
+		name    string
+		addr    string
+		handler http.Handler
+	}{
+		{"admin", net.JoinHostPort(config.AdminHost, config.AdminPort), app.AdminHandler()},
+		{"metrics", ":" + config.MetricsPort, app.MetricsHandler()},
+	}
+	var sides []sideServer
+	for _, candidate := range candidates {
+		if candidate.handler == nil {
+			continue
+		}
+		listener, err := net.Listen("tcp", candidate.addr)
+		if err != nil {
+			for _, side := range sides {
+				side.listener.Close()
+			}
+			return nil, fmt.Errorf("%s port: %w", candidate.name, err)
+		}
+		sides = append(sides, sideServer{name: candidate.name, server: app.NewServer(candidate.handler), listener: listener})
 	}
-
-	log.Printf("Server is running on port %s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	return sides, nil
 }
@@ -0,0 +1,431 @@
+// Package jwks fetches the JSON Web Key Set (RFC 7517) of a token issuer and keeps it
+// cached. Keys are looked up by kid. The set is refreshed in the background before it
+// expires, refetched when a token names a kid it doesn't have yet, and served stale for
+// a while when the issuer can't be reached, so a short outage doesn't fail every
+// request.
+package jwks
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Per-key-set counters and gauges, published on /debug/vars
+var keySetMetrics = expvar.NewMap("jwks")
+
+// How long a key set is fresh when the issuer's response doesn't say, and the bounds
+// put on what it says
+const (
+	DEFAULT_TTL = time.Hour
+	MIN_TTL     = time.Minute
+	MAX_TTL     = 24 * time.Hour
+)
+
+// Share of a key set's lifetime after which the background refresh fetches it again
+const REFRESH_AHEAD = 0.8
+
+// Wait after a failed background refresh, doubling with each failure up to
+// MAX_RETRY_INTERVAL
+const (
+	RETRY_INTERVAL     = 5 * time.Second
+	MAX_RETRY_INTERVAL = 5 * time.Minute
+)
+
+// How often a token naming an unknown kid may cause a fetch, so tokens with made-up
+// kids can't make the service hammer the issuer
+const UNKNOWN_KID_INTERVAL = 30 * time.Second
+
+// Limits of a fetch
+const (
+	FETCH_TIMEOUT     = 10 * time.Second
+	MAX_KEY_SET_BYTES = 1 << 20
+)
+
+var (
+	// No key of the set has the kid, even after refetching it
+	ErrUnknownKey = errors.New("jwks: unknown key id")
+	// The set expired longer ago than MaxStale and the issuer can't be reached
+	ErrStale = errors.New("jwks: key set is stale and the issuer is unreachable")
+	// The set has never been fetched successfully
+	ErrUnavailable = errors.New("jwks: key set is unavailable")
+)
+
+// A verification key of the set
+type Key struct {
+	ID        string
+	Algorithm string // "alg" of the JWK, empty when the issuer leaves it out
+	Public    crypto.PublicKey
+}
+
+type Options struct {
+	// The key set's URL, e.g. an OpenID provider's jwks_uri
+	URL string
+	// Names the key set in the metrics
+	Name string
+	// Defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// How long past its expiry the set is still used while the issuer can't be
+	// reached; 0 uses it until a fetch succeeds
+	MaxStale time.Duration
+	// Defaults to log.Default()
+	Logger *log.Logger
+	// Defaults to time.Now
+	Now func() time.Time
+}
+
+// A cached key set. Use Run to keep it refreshed in the background; Key fetches it on
+// first use either way.
+type Client struct {
+	options Options
+	metrics *expvar.Map
+
+	fetchMutex sync.Mutex // one fetch at a time
+
+	mutex       sync.RWMutex
+	keys        map[string]Key
+	etag        string
+	fetched     time.Time // of the set in use, or when the issuer last confirmed it
+	expires     time.Time
+	lastAttempt time.Time
+	attempts    uint64
+	failures    int // consecutive failed fetches
+}
+
+func New(options Options) *Client {
+	if options.HTTPClient == nil {
+		options.HTTPClient = http.DefaultClient
+	}
+	if options.Logger == nil {
+		options.Logger = log.Default()
+	}
+	if options.Now == nil {
+		options.Now = time.Now
+	}
+	c := &Client{options: options, metrics: new(expvar.Map)}
+	c.metrics.Set("age_seconds", expvar.Func(func() interface{} { return c.Age().Seconds() }))
+	c.metrics.Set("keys", expvar.Func(func() interface{} {
+		c.mutex.RLock()
+		defer c.mutex.RUnlock()
+		return len(c.keys)
+	}))
+	c.metrics.Set("stale", expvar.Func(func() interface{} { return c.stale() }))
+	if options.Name != "" {
+		keySetMetrics.Set(options.Name, c.metrics)
+	}
+	return c
+}
+
+// How long ago the issuer last served or confirmed the set in use, 0 before the first
+// fetch
+func (c *Client) Age() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.fetched.IsZero() {
+		return 0
+	}
+	return c.options.Now().Sub(c.fetched)
+}
+
+// Reports whether the set in use has expired, e.g. because the issuer is unreachable
+func (c *Client) stale() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return !c.fetched.IsZero() && c.options.Now().After(c.expires)
+}
+
+// The key tokens naming kid are verified with. An unknown kid refetches the set, at
+// most every UNKNOWN_KID_INTERVAL, as the issuer may have rotated its keys.
+func (c *Client) Key(ctx context.Context, kid string) (Key, error) {
+	key, found, usable := c.lookup(kid)
+	if found && usable {
+		return key, nil
+	}
+	if found {
+		// Past MaxStale: only a fresh set will do
+		if err := c.Refresh(ctx); err != nil {
+			c.metrics.Add("stale_rejections", 1)
+			return Key{}, fmt.Errorf("%w: %v", ErrStale, err)
+		}
+	} else {
+		c.metrics.Add("unknown_kids", 1)
+		if !c.mayFetchUnknown() {
+			if !c.loaded() {
+				return Key{}, ErrUnavailable
+			}
+			return Key{}, ErrUnknownKey
+		}
+		if err := c.Refresh(ctx); err != nil {
+			if !c.loaded() {
+				return Key{}, fmt.Errorf("%w: %v", ErrUnavailable, err)
+			}
+			return Key{}, err
+		}
+	}
+	if key, found, _ = c.lookup(kid); !found {
+		return Key{}, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// The key of kid, and whether the set it is in may still be used
+func (c *Client) lookup(kid string) (Key, bool, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	key, ok := c.keys[kid]
+	if !ok {
+		return Key{}, false, false
+	}
+	now := c.options.Now()
+	if now.After(c.expires) {
+		if c.options.MaxStale > 0 && now.After(c.expires.Add(c.options.MaxStale)) {
+			return key, true, false
+		}
+		c.metrics.Add("stale_uses", 1)
+	}
+	return key, true, true
+}
+
+func (c *Client) loaded() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.keys != nil
+}
+
+func (c *Client) mayFetchUnknown() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.lastAttempt.IsZero() || c.options.Now().Sub(c.lastAttempt) >= UNKNOWN_KID_INTERVAL
+}
+
+// Fetches the set now. Callers arriving while a fetch is in flight wait for it and
+// share its result rather than fetching again. A failed fetch keeps the set in use.
+func (c *Client) Refresh(ctx context.Context) error {
+	c.mutex.RLock()
+	before := c.attempts
+	c.mutex.RUnlock()
+	c.fetchMutex.Lock()
+	defer c.fetchMutex.Unlock()
+	c.mutex.RLock()
+	attempts, failures := c.attempts, c.failures
+	c.mutex.RUnlock()
+	if attempts != before {
+		if failures > 0 {
+			return errors.New("jwks: fetch failed")
+		}
+		return nil
+	}
+
+	keys, etag, ttl, err := c.fetch(ctx)
+	now := c.options.Now()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.lastAttempt = now
+	c.attempts++
+	if err != nil {
+		c.failures++
+		c.metrics.Add("refresh_failures", 1)
+		return err
+	}
+	c.failures = 0
+	c.metrics.Add("refreshes", 1)
+	if keys != nil { // nil when the set is unchanged
+		c.keys = keys
+		c.etag = etag
+	}
+	c.fetched = now
+	c.expires = now.Add(ttl)
+	return nil
+}
+
+// Fetches and parses the set, returning nil keys when the issuer answers 304 to the
+// ETag of the set in use
+func (c *Client) fetch(ctx context.Context) (map[string]Key, string, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, FETCH_TIMEOUT)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.options.URL, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	request.Header.Set("Accept", "application/jwk-set+json, application/json")
+	c.mutex.RLock()
+	if c.etag != "" && c.keys != nil {
+		request.Header.Set("If-None-Match", c.etag)
+	}
+	c.mutex.RUnlock()
+
+	response, err := c.options.HTTPClient.Do(request)
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("jwks: fetch %s: %w", c.options.URL, err)
+	}
+	defer response.Body.Close()
+	ttl := cacheLifetime(response.Header.Get("Cache-Control"))
+	if response.StatusCode == http.StatusNotModified {
+		return nil, "", ttl, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, "", 0, fmt.Errorf("jwks: fetch %s: status %d", c.options.URL, response.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, MAX_KEY_SET_BYTES+1))
+	if err != nil {
+		return nil, "", 0, fmt.Errorf("jwks: fetch %s: %w", c.options.URL, err)
+	}
+	if len(body) > MAX_KEY_SET_BYTES {
+		return nil, "", 0, fmt.Errorf("jwks: %s is larger than %d bytes", c.options.URL, MAX_KEY_SET_BYTES)
+	}
+	keys, err := Parse(body)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return keys, response.Header.Get("ETag"), ttl, nil
+}
+
+// The max-age of a Cache-Control header within MIN_TTL and MAX_TTL, DEFAULT_TTL
+// without one
+func cacheLifetime(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(name, "max-age") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.Trim(value, `"`))
+		if err != nil {
+			break
+		}
+		return min(max(time.Duration(seconds)*time.Second, MIN_TTL), MAX_TTL)
+	}
+	return DEFAULT_TTL
+}
+
+// Keeps the set fresh until ctx ends: fetches it, then again once REFRESH_AHEAD of its
+// lifetime has passed. Failures are retried with a growing wait while the set in use
+// keeps serving.
+func (c *Client) Run(ctx context.Context) {
+	for {
+		timer := time.NewTimer(c.nextRefresh())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+			c.options.Logger.Printf("Key set %s refresh failed, using the previous keys: %v", c.options.URL, err)
+		}
+	}
+}
+
+// Wait until the background refresh should next fetch the set
+func (c *Client) nextRefresh() time.Duration {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if c.failures > 0 {
+		wait := RETRY_INTERVAL << min(c.failures-1, 16)
+		return min(wait, MAX_RETRY_INTERVAL)
+	}
+	if c.fetched.IsZero() {
+		return 0
+	}
+	refreshAt := c.fetched.Add(time.Duration(float64(c.expires.Sub(c.fetched)) * REFRESH_AHEAD))
+	return max(refreshAt.Sub(c.options.Now()), 0)
+}
+
+// A JSON Web Key of a key set, the members this package reads
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// Reads the RSA and EC signature keys of a key set document by kid. Keys for
+// encryption, of other types, or without a kid are skipped.
+func Parse(document []byte) (map[string]Key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(document, &set); err != nil {
+		return nil, fmt.Errorf("jwks: %w", err)
+	}
+	keys := make(map[string]Key, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kid == "" || (key.Use != "" && key.Use != "sig") {
+			continue
+		}
+		var public crypto.PublicKey
+		var err error
+		switch key.Kty {
+		case "RSA":
+			public, err = rsaKey(key)
+		case "EC":
+			public, err = ecKey(key)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("jwks: key %s: %w", key.Kid, err)
+		}
+		keys[key.Kid] = Key{ID: key.Kid, Algorithm: key.Alg, Public: public}
+	}
+	return keys, nil
+}
+
+func rsaKey(key jwk) (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(key.N)
+	if err != nil {
+		return nil, errors.New("invalid n")
+	}
+	e, err := base64.RawURLEncoding.DecodeString(key.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, errors.New("invalid e")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+func ecKey(key jwk) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch key.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", key.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(key.X)
+	if err != nil {
+		return nil, errors.New("invalid x")
+	}
+	y, err := base64.RawURLEncoding.DecodeString(key.Y)
+	if err != nil {
+		return nil, errors.New("invalid y")
+	}
+	public := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	// Rejects points off the curve, which ECDH() checks
+	if _, err := public.ECDH(); err != nil {
+		return nil, errors.New("point is not on the curve")
+	}
+	return public, nil
+}
@@ -0,0 +1,192 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER tag classes and the constructed bit, as used by LDAP's ASN.1 encoding
+const (
+	classUniversal   = 0x00
+	classApplication = 0x40
+	classContext     = 0x80
+	constructed      = 0x20
+)
+
+// Universal tags
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x10 | constructed
+	tagSet         = 0x11 | constructed
+)
+
+// Largest message read from a server, which keeps a broken or hostile one from making
+// the client allocate without bound
+const MAX_MESSAGE_SIZE = 16 << 20
+
+// Deepest nesting of constructed elements decoded. LDAP messages nest a few levels;
+// without a limit a hostile server could make the decoder recurse until the stack runs
+// out, which crashes the process rather than failing the request.
+const MAX_DEPTH = 32
+
+// One decoded element: its tag byte and content, with children parsed for constructed
+// elements
+type packet struct {
+	tag      byte
+	value    []byte
+	children []packet
+}
+
+// Encodes an element of tag with content
+func encode(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		out = append(out, byte(n))
+	case n < 0x100:
+		out = append(out, 0x81, byte(n))
+	case n < 0x10000:
+		out = append(out, 0x82, byte(n>>8), byte(n))
+	default:
+		out = append(out, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(out, content...)
+}
+
+func encodeSequence(tag byte, elements ...[]byte) []byte {
+	var content []byte
+	for _, element := range elements {
+		content = append(content, element...)
+	}
+	return encode(tag, content)
+}
+
+func encodeString(tag byte, value string) []byte {
+	return encode(tag, []byte(value))
+}
+
+func encodeInteger(tag byte, value int64) []byte {
+	// Minimal two's complement, big-endian
+	var content []byte
+	for {
+		content = append([]byte{byte(value)}, content...)
+		if value >= -0x80 && value < 0x80 {
+			break
+		}
+		value >>= 8
+	}
+	return encode(tag, content)
+}
+
+func encodeBoolean(value bool) []byte {
+	if value {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0x00})
+}
+
+// Reads one element from r
+func readPacket(r *bufio.Reader) (packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return packet{}, unexpectedEOF(err)
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 4 {
+			return packet{}, errors.New("ldap: unsupported BER length")
+		}
+		length = 0
+		for range octets {
+			b, err := r.ReadByte()
+			if err != nil {
+				return packet{}, unexpectedEOF(err)
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > MAX_MESSAGE_SIZE {
+		return packet{}, fmt.Errorf("ldap: message of %d bytes exceeds the limit", length)
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return packet{}, unexpectedEOF(err)
+	}
+	return parsePacket(tag, content, 1)
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Parses content of tag, descending into constructed elements; depth is that of the
+// element itself, 1 for a message
+func parsePacket(tag byte, content []byte, depth int) (packet, error) {
+	p := packet{tag: tag, value: content}
+	if tag&constructed == 0 {
+		return p, nil
+	}
+	if depth >= MAX_DEPTH {
+		return packet{}, errors.New("ldap: BER elements nested too deeply")
+	}
+	for len(content) > 0 {
+		if len(content) < 2 {
+			return packet{}, errors.New("ldap: truncated BER element")
+		}
+		childTag, length, header := content[0], int(content[1]), 2
+		if length&0x80 != 0 {
+			octets := length & 0x7f
+			if octets == 0 || octets > 4 || len(content) < 2+octets {
+				return packet{}, errors.New("ldap: invalid BER length")
+			}
+			length = 0
+			for _, b := range content[2 : 2+octets] {
+				length = length<<8 | int(b)
+			}
+			header += octets
+		}
+		if length < 0 || len(content) < header+length {
+			return packet{}, errors.New("ldap: truncated BER element")
+		}
+		child, err := parsePacket(childTag, content[header:header+length], depth+1)
+		if err != nil {
+			return packet{}, err
+		}
+		p.children = append(p.children, child)
+		content = content[header+length:]
+	}
+	return p, nil
+}
+
+// The value of an INTEGER or ENUMERATED element. One that is empty or does not fit an
+// int64 is an error rather than a value that wrapped around.
+func (p packet) integer() (int64, error) {
+	if len(p.value) == 0 || len(p.value) > 8 {
+		return 0, errors.New("ldap: invalid BER integer")
+	}
+	var value int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			value = -1
+		}
+		value = value<<8 | int64(b)
+	}
+	return value, nil
+}
+
+func (p packet) string() string {
+	return string(p.value)
+}
@@ -0,0 +1,231 @@
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decode(data []byte) (packet, error) {
+	return readPacket(bufio.NewReader(bytes.NewReader(data)))
+}
+
+// Encodes p back, children included, with minimal lengths
+func reencode(p packet) []byte {
+	if p.tag&constructed == 0 {
+		return encode(p.tag, p.value)
+	}
+	var children [][]byte
+	for _, child := range p.children {
+		children = append(children, reencode(child))
+	}
+	return encodeSequence(p.tag, children...)
+}
+
+func TestLengths(t *testing.T) {
+	tests := []struct {
+		size   int
+		header []byte
+	}{
+		{0, []byte{tagOctetString, 0x00}},
+		{0x7f, []byte{tagOctetString, 0x7f}},
+		{0x80, []byte{tagOctetString, 0x81, 0x80}},
+		{0xff, []byte{tagOctetString, 0x81, 0xff}},
+		{0x100, []byte{tagOctetString, 0x82, 0x01, 0x00}},
+		{0xffff, []byte{tagOctetString, 0x82, 0xff, 0xff}},
+		{0x10000, []byte{tagOctetString, 0x84, 0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		content := bytes.Repeat([]byte{'x'}, test.size)
+		encoded := encode(tagOctetString, content)
+		if !bytes.HasPrefix(encoded, test.header) || len(encoded) != len(test.header)+test.size {
+			t.Errorf("encode(%d bytes) header = % x, want % x", test.size, encoded[:min(len(encoded), 6)], test.header)
+		}
+		decoded, err := decode(encoded)
+		if err != nil {
+			t.Errorf("decode(%d bytes): %v", test.size, err)
+			continue
+		}
+		if decoded.tag != tagOctetString || !bytes.Equal(decoded.value, content) {
+			t.Errorf("decode(%d bytes) = tag 0x%02x with %d bytes", test.size, decoded.tag, len(decoded.value))
+		}
+	}
+}
+
+func TestIntegers(t *testing.T) {
+	tests := []struct {
+		value   int64
+		content []byte
+	}{
+		{0, []byte{0x00}},
+		{1, []byte{0x01}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{256, []byte{0x01, 0x00}},
+		{-1, []byte{0xff}},
+		{-128, []byte{0x80}},
+		{-129, []byte{0xff, 0x7f}},
+		{math.MaxInt32, []byte{0x7f, 0xff, 0xff, 0xff}},
+		{math.MaxInt64, []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{math.MinInt64, []byte{0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		encoded := encodeInteger(tagInteger, test.value)
+		if want := append([]byte{tagInteger, byte(len(test.content))}, test.content...); !bytes.Equal(encoded, want) {
+			t.Errorf("encodeInteger(%d) = % x, want % x", test.value, encoded, want)
+		}
+		decoded, err := decode(encoded)
+		if err != nil {
+			t.Fatalf("decode(% x): %v", encoded, err)
+		}
+		if value, err := decoded.integer(); value != test.value || err != nil {
+			t.Errorf("integer() of % x = %d, %v, want %d", encoded, value, err, test.value)
+		}
+	}
+
+	for _, content := range [][]byte{{}, bytes.Repeat([]byte{0x01}, 9)} {
+		if value, err := (packet{tag: tagInteger, value: content}).integer(); err == nil {
+			t.Errorf("integer() of % x = %d, want an error", content, value)
+		}
+	}
+}
+
+func TestBooleans(t *testing.T) {
+	if got := encodeBoolean(true); !bytes.Equal(got, []byte{tagBoolean, 0x01, 0xff}) {
+		t.Errorf("encodeBoolean(true) = % x", got)
+	}
+	if got := encodeBoolean(false); !bytes.Equal(got, []byte{tagBoolean, 0x01, 0x00}) {
+		t.Errorf("encodeBoolean(false) = % x", got)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	// A search entry with two attributes, as a server would send it
+	message := encodeSequence(tagSequence,
+		encodeInteger(tagInteger, 7),
+		encodeSequence(opSearchEntry,
+			encodeString(tagOctetString, "uid=alice,ou=people,dc=example,dc=com"),
+			encodeSequence(tagSequence,
+				encodeSequence(tagSequence,
+					encodeString(tagOctetString, "cn"),
+					encodeSequence(tagSet, encodeString(tagOctetString, "Alice")),
+				),
+				encodeSequence(tagSequence,
+					encodeString(tagOctetString, "memberOf"),
+					encodeSequence(tagSet,
+						encodeString(tagOctetString, "cn=admins"),
+						encodeString(tagOctetString, strings.Repeat("g", 300)),
+					),
+				),
+			),
+		),
+	)
+	// Two messages back to back are read one at a time
+	reader := bufio.NewReader(bytes.NewReader(append(message, message...)))
+	for range 2 {
+		decoded, err := readPacket(reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decoded.tag != tagSequence || len(decoded.children) != 2 {
+			t.Fatalf("message = tag 0x%02x with %d children", decoded.tag, len(decoded.children))
+		}
+		if id, err := decoded.children[0].integer(); id != 7 || err != nil {
+			t.Errorf("message ID = %d, %v, want 7", id, err)
+		}
+		entry, err := parseEntry(decoded.children[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := Entry{
+			DN: "uid=alice,ou=people,dc=example,dc=com",
+			Attributes: map[string][]string{
+				"cn":       {"Alice"},
+				"memberOf": {"cn=admins", strings.Repeat("g", 300)},
+			},
+		}
+		if !reflect.DeepEqual(entry, want) {
+			t.Errorf("entry = %+v, want %+v", entry, want)
+		}
+		if encoded := reencode(decoded); !bytes.Equal(encoded, message) {
+			t.Errorf("re-encoded message differs:\n% x\n% x", encoded, message)
+		}
+	}
+	if _, err := readPacket(reader); err != io.EOF {
+		t.Errorf("read past the last message: %v, want io.EOF", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	nested := func(depth int) []byte {
+		element := encode(tagOctetString, nil)
+		for range depth - 1 {
+			element = encodeSequence(tagSequence, element)
+		}
+		return element
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"missing length", []byte{tagSequence}, "unexpected EOF"},
+		{"indefinite length", []byte{tagSequence, 0x80, 0x00, 0x00}, "unsupported BER length"},
+		{"length of five octets", []byte{tagOctetString, 0x85, 0, 0, 0, 0, 1}, "unsupported BER length"},
+		{"truncated length octets", []byte{tagOctetString, 0x82, 0x01}, "unexpected EOF"},
+		{"oversized message", []byte{tagOctetString, 0x84, 0x01, 0x00, 0x00, 0x01}, "exceeds the limit"},
+		{"length beyond int32", []byte{tagOctetString, 0x84, 0xff, 0xff, 0xff, 0xff}, "exceeds the limit"},
+		{"truncated content", []byte{tagOctetString, 0x05, 'a', 'b'}, "unexpected EOF"},
+		{"child missing its length", []byte{tagSequence, 0x01, tagInteger}, "truncated BER element"},
+		{"child longer than its parent", []byte{tagSequence, 0x03, tagOctetString, 0x05, 'a'}, "truncated BER element"},
+		{"child with indefinite length", []byte{tagSequence, 0x02, tagSequence, 0x80}, "invalid BER length"},
+		{"child length octets missing", []byte{tagSequence, 0x02, tagOctetString, 0x82}, "invalid BER length"},
+		{"child length of five octets", []byte{tagSequence, 0x07, tagOctetString, 0x85, 0, 0, 0, 0, 0}, "invalid BER length"},
+		{"grandchild truncated", []byte{tagSequence, 0x04, tagSequence, 0x02, tagInteger, 0x05}, "truncated BER element"},
+		{"nested too deeply", nested(MAX_DEPTH + 1), "nested too deeply"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := decode(test.data)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("decode(% x) = %+v, %v, want %q", test.data, decoded, err, test.err)
+			}
+		})
+	}
+
+	if _, err := decode(nested(MAX_DEPTH)); err != nil {
+		t.Errorf("decode(%d levels): %v", MAX_DEPTH, err)
+	}
+	if _, err := decode(nil); !errors.Is(err, io.EOF) {
+		t.Errorf("decode(nothing) = %v, want io.EOF", err)
+	}
+}
+
+// Whatever a server sends, the decoder returns an error or a packet that re-encodes to
+// something it decodes the same way; it never panics
+func FuzzReadPacket(f *testing.F) {
+	f.Add(encodeSequence(tagSequence, encodeInteger(tagInteger, 1), encodeSequence(opSearchDone, encode(tagEnumerated, []byte{0}), encodeString(tagOctetString, ""), encodeString(tagOctetString, ""))))
+	f.Add(encodeSequence(tagSequence, encodeSequence(tagSet, encodeBoolean(true)), encodeInteger(tagInteger, -300)))
+	f.Add([]byte{tagSequence, 0x84, 0x00, 0x00, 0x00, 0x02, tagInteger, 0x00})
+	f.Add([]byte{tagSequence, 0x04, tagSequence, 0x82, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded, err := decode(data)
+		if err != nil {
+			return
+		}
+		decoded.integer()
+		again, err := decode(reencode(decoded))
+		if err != nil {
+			t.Fatalf("re-encoded packet does not decode: %v", err)
+		}
+		if !reflect.DeepEqual(reencode(again), reencode(decoded)) {
+			t.Fatalf("packet changed through re-encoding")
+		}
+	})
+}
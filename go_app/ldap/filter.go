@@ -0,0 +1,182 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Filter choices of RFC 4511, section 4.5.1
+const (
+	filterAnd            = classContext | constructed | 0
+	filterOr             = classContext | constructed | 1
+	filterNot            = classContext | constructed | 2
+	filterEquality       = classContext | constructed | 3
+	filterSubstrings     = classContext | constructed | 4
+	filterGreaterOrEqual = classContext | constructed | 5
+	filterLessOrEqual    = classContext | constructed | 6
+	filterPresent        = classContext | 7
+	filterApproximate    = classContext | constructed | 8
+)
+
+// Parts of a substrings filter
+const (
+	substringInitial = classContext | 0
+	substringAny     = classContext | 1
+	substringFinal   = classContext | 2
+)
+
+// Escapes value for use in a filter, as RFC 4515 requires for *, (, ), \ and NUL, so a
+// username can't change the meaning of the filter it is put in
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// Encodes a filter in the string form of RFC 4515, e.g.
+// (&(objectClass=person)(|(uid=jdoe)(mail=jdoe@*))). Extensible matches are not
+// supported.
+func compileFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if filter != "" && filter[0] != '(' {
+		filter = "(" + filter + ")" // the outer parentheses are commonly left out
+	}
+	encoded, rest, err := parseFilter(filter)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: filter %q: %w", filter, err)
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("ldap: filter %q: unexpected %q", filter, rest)
+	}
+	return encoded, nil
+}
+
+// Parses one parenthesized filter at the start of s, returning what follows it
+func parseFilter(s string) ([]byte, string, error) {
+	if s == "" || s[0] != '(' {
+		return nil, "", fmt.Errorf("expected (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, "", fmt.Errorf("unexpected end")
+	}
+	switch s[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		s = s[1:]
+		var parts [][]byte
+		for s != "" && s[0] == '(' {
+			part, rest, err := parseFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			parts, s = append(parts, part), rest
+		}
+		if s == "" || s[0] != ')' {
+			return nil, "", fmt.Errorf("expected )")
+		}
+		return encodeSequence(tag, parts...), s[1:], nil
+	case '!':
+		part, rest, err := parseFilter(s[1:])
+		if err != nil {
+			return nil, "", err
+		}
+		if rest == "" || rest[0] != ')' {
+			return nil, "", fmt.Errorf("expected )")
+		}
+		return encode(filterNot, part), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("expected )")
+	}
+	encoded, err := parseItem(s[:end])
+	return encoded, s[end+1:], err
+}
+
+// Parses a simple item such as uid=jdoe, cn=J*, mail=* or age>=21
+func parseItem(item string) ([]byte, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq < 1 {
+		return nil, fmt.Errorf("invalid item %q", item)
+	}
+	attribute, value, tag := item[:eq], item[eq+1:], byte(filterEquality)
+	switch attribute[len(attribute)-1] {
+	case '>':
+		attribute, tag = attribute[:len(attribute)-1], filterGreaterOrEqual
+	case '<':
+		attribute, tag = attribute[:len(attribute)-1], filterLessOrEqual
+	case '~':
+		attribute, tag = attribute[:len(attribute)-1], filterApproximate
+	case ':':
+		return nil, fmt.Errorf("extensible match %q is not supported", item)
+	}
+	if attribute == "" || strings.ContainsAny(attribute, "()*\\ ") {
+		return nil, fmt.Errorf("invalid attribute in %q", item)
+	}
+	if tag == filterEquality && value == "*" {
+		return encodeString(filterPresent, attribute), nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		pieces := strings.Split(value, "*")
+		var parts [][]byte
+		for i, piece := range pieces {
+			if piece == "" {
+				continue
+			}
+			unescaped, err := unescapeValue(piece)
+			if err != nil {
+				return nil, err
+			}
+			partTag := byte(substringAny)
+			switch i {
+			case 0:
+				partTag = substringInitial
+			case len(pieces) - 1:
+				partTag = substringFinal
+			}
+			parts = append(parts, encodeString(partTag, unescaped))
+		}
+		return encodeSequence(filterSubstrings, encodeString(tagOctetString, attribute), encodeSequence(tagSequence, parts...)), nil
+	}
+	unescaped, err := unescapeValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return encodeSequence(tag, encodeString(tagOctetString, attribute), encodeString(tagOctetString, unescaped)), nil
+}
+
+// Resolves the \XX escapes of a filter value
+func unescapeValue(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("truncated escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,419 @@
+// Package ldap is a minimal LDAPv3 client covering what authenticating against a
+// directory such as OpenLDAP or Active Directory takes: simple binds, searches and
+// StartTLS, over ldap:// or ldaps:// URLs. A connection runs one operation at a time;
+// share them through a Pool.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timeout of an operation when Options.Timeout is not set
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// Protocol operations of RFC 4511, section 4.2 onwards
+const (
+	opBindRequest      = classApplication | constructed | 0
+	opBindResponse     = classApplication | constructed | 1
+	opUnbindRequest    = classApplication | 2
+	opSearchRequest    = classApplication | constructed | 3
+	opSearchEntry      = classApplication | constructed | 4
+	opSearchDone       = classApplication | constructed | 5
+	opSearchReference  = classApplication | constructed | 19
+	opExtendedRequest  = classApplication | constructed | 23
+	opExtendedResponse = classApplication | constructed | 24
+)
+
+// OID of the StartTLS extended operation
+const startTLSOID = "1.3.6.1.4.1.1466.20037"
+
+// Search scopes
+const (
+	SCOPE_BASE    = 0 // the base entry only
+	SCOPE_ONE     = 1 // its immediate children
+	SCOPE_SUBTREE = 2 // the base entry and everything below it
+)
+
+// Result codes callers commonly tell apart
+const (
+	RESULT_SUCCESS              = 0
+	RESULT_SIZE_LIMIT_EXCEEDED  = 4
+	RESULT_INVALID_CREDENTIALS  = 49
+	RESULT_UNAVAILABLE          = 52
+	RESULT_UNWILLING_TO_PERFORM = 53
+)
+
+// A result other than success
+type Error struct {
+	Code    int
+	Message string // the server's diagnostic message, may be empty
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// Reports whether err is an LDAP result with code
+func IsResult(err error, code int) bool {
+	var ldapErr *Error
+	return errors.As(err, &ldapErr) && ldapErr.Code == code
+}
+
+// Returned by Bind for a DN with an empty password, which servers treat as an
+// unauthenticated bind that succeeds without checking anything (RFC 4513, 5.1.2)
+var ErrEmptyPassword = errors.New("ldap: empty password")
+
+type Options struct {
+	Timeout time.Duration // per operation, including dialing; DEFAULT_TIMEOUT when 0
+	// For ldaps:// and StartTLS. The server name defaults to the URL's host.
+	TLS      *tls.Config
+	StartTLS bool // upgrade an ldap:// connection before anything else is sent
+}
+
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	timeout   time.Duration
+	messageID int64
+	closed    bool
+}
+
+// Connects to an ldap:// or ldaps:// URL; the port defaults to 389 and 636
+func Dial(ctx context.Context, rawURL string, options Options) (*Conn, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = DEFAULT_TIMEOUT
+	}
+	host, port := parsed.Hostname(), parsed.Port()
+	secure := false
+	switch parsed.Scheme {
+	case "ldap":
+		if port == "" {
+			port = "389"
+		}
+	case "ldaps":
+		secure = true
+		if port == "" {
+			port = "636"
+		}
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme in %q", rawURL)
+	}
+	if secure && options.StartTLS {
+		return nil, errors.New("ldap: StartTLS over ldaps://")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	c := &Conn{conn: conn, reader: bufio.NewReader(conn), timeout: options.Timeout}
+	if secure || options.StartTLS {
+		if options.StartTLS {
+			if err := c.startTLS(); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		config := &tls.Config{}
+		if options.TLS != nil {
+			config = options.TLS.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+		c.conn, c.reader = tlsConn, bufio.NewReader(tlsConn)
+	}
+	return c, nil
+}
+
+func (c *Conn) startTLS() error {
+	response, err := c.roundTrip(encodeSequence(opExtendedRequest, encodeString(classContext|0, startTLSOID)), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	return resultError(response)
+}
+
+// Authenticates the connection as dn. Later operations run with its permissions until
+// the next Bind. An empty dn and password bind anonymously.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" && dn != "" {
+		return ErrEmptyPassword
+	}
+	request := encodeSequence(opBindRequest,
+		encodeInteger(tagInteger, 3),
+		encodeString(tagOctetString, dn),
+		encodeString(classContext|0, password),
+	)
+	response, err := c.roundTrip(request, opBindResponse)
+	if err != nil {
+		return err
+	}
+	return resultError(response)
+}
+
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int    // SCOPE_*
+	Filter     string // RFC 4515, e.g. (&(objectClass=person)(uid=jdoe)); use EscapeFilter on values
+	Attributes []string
+	SizeLimit  int // most entries returned, 0 for the server's limit
+}
+
+// An entry found by a search
+type Entry struct {
+	DN         string
+	Attributes map[string][]string // by attribute name as the server returned it
+}
+
+// Values of the attribute name, matched case-insensitively like LDAP does
+func (e Entry) Get(name string) []string {
+	if values, ok := e.Attributes[name]; ok {
+		return values
+	}
+	for attribute, values := range e.Attributes {
+		if strings.EqualFold(attribute, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Runs a search and returns the entries found. Referrals are not followed. A search
+// stopped by the size limit returns the entries so far with an Error of
+// RESULT_SIZE_LIMIT_EXCEEDED.
+func (c *Conn) Search(request SearchRequest) ([]Entry, error) {
+	filter, err := compileFilter(request.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attributes := make([][]byte, len(request.Attributes))
+	for i, attribute := range request.Attributes {
+		attributes[i] = encodeString(tagOctetString, attribute)
+	}
+	id, err := c.send(encodeSequence(opSearchRequest,
+		encodeString(tagOctetString, request.BaseDN),
+		encodeInteger(tagEnumerated, int64(request.Scope)),
+		encodeInteger(tagEnumerated, 0), // never dereference aliases
+		encodeInteger(tagInteger, int64(request.SizeLimit)),
+		encodeInteger(tagInteger, int64(c.timeout/time.Second)),
+		encodeBoolean(false),
+		filter,
+		encodeSequence(tagSequence, attributes...),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case opSearchEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case opSearchReference:
+		case opSearchDone:
+			return entries, resultError(op)
+		default:
+			c.Close()
+			return nil, fmt.Errorf("ldap: unexpected operation 0x%02x in search results", op.tag)
+		}
+	}
+}
+
+func parseEntry(op packet) (Entry, error) {
+	if len(op.children) < 2 {
+		return Entry{}, errors.New("ldap: malformed search entry")
+	}
+	entry := Entry{DN: op.children[0].string(), Attributes: make(map[string][]string)}
+	for _, attribute := range op.children[1].children {
+		if len(attribute.children) < 2 {
+			return Entry{}, errors.New("ldap: malformed attribute")
+		}
+		name := attribute.children[0].string()
+		for _, value := range attribute.children[1].children {
+			entry.Attributes[name] = append(entry.Attributes[name], value.string())
+		}
+	}
+	return entry, nil
+}
+
+// Sends an unbind request and closes the connection
+func (c *Conn) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	c.send(encode(opUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+// Whether the connection broke or was closed; a pool drops such connections
+func (c *Conn) Closed() bool {
+	return c.closed
+}
+
+func (c *Conn) roundTrip(request []byte, responseTag byte) (packet, error) {
+	id, err := c.send(request)
+	if err != nil {
+		return packet{}, err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return packet{}, err
+	}
+	if op.tag != responseTag {
+		c.Close()
+		return packet{}, fmt.Errorf("ldap: unexpected operation 0x%02x", op.tag)
+	}
+	return op, nil
+}
+
+// Wraps op in an LDAPMessage with the next message ID and writes it
+func (c *Conn) send(op []byte) (int64, error) {
+	if c.closed && op[0] != opUnbindRequest {
+		return 0, errors.New("ldap: connection closed")
+	}
+	c.messageID++
+	message := encodeSequence(tagSequence, encodeInteger(tagInteger, c.messageID), op)
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(message); err != nil {
+		c.closed = true
+		c.conn.Close()
+		return 0, fmt.Errorf("ldap: %w", err)
+	}
+	return c.messageID, nil
+}
+
+// Reads the next operation for message id. Any failure closes the connection, since
+// the stream can no longer be trusted to be in step.
+func (c *Conn) receive(id int64) (packet, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	for {
+		message, err := readPacket(c.reader)
+		if err != nil {
+			c.closed = true
+			c.conn.Close()
+			return packet{}, fmt.Errorf("ldap: %w", err)
+		}
+		if message.tag != tagSequence || len(message.children) < 2 {
+			c.Close()
+			return packet{}, errors.New("ldap: malformed message")
+		}
+		messageID, err := message.children[0].integer()
+		if err != nil {
+			c.Close()
+			return packet{}, err
+		}
+		switch messageID {
+		case id:
+			return message.children[1], nil
+		case 0:
+			// An unsolicited notification, e.g. the server disconnecting
+			c.closed = true
+			c.conn.Close()
+			if op := message.children[1]; op.tag == opExtendedResponse {
+				if err := resultError(op); err != nil {
+					return packet{}, err
+				}
+			}
+			return packet{}, errors.New("ldap: server ended the connection")
+		}
+	}
+}
+
+// The error of an LDAPResult, nil on success
+func resultError(op packet) error {
+	if len(op.children) < 3 {
+		return errors.New("ldap: malformed result")
+	}
+	code, err := op.children[0].integer()
+	if err != nil {
+		return err
+	}
+	if code == RESULT_SUCCESS {
+		return nil
+	}
+	return &Error{Code: int(code), Message: op.children[2].string()}
+}
+
+// Connections to one server, reused across operations. Get dials when none is idle;
+// Put keeps at most Size idle connections and closes the rest.
+type Pool struct {
+	URL     string
+	Options Options
+	Size    int
+
+	mutex sync.Mutex
+	idle  []*Conn
+}
+
+func (p *Pool) Get(ctx context.Context) (*Conn, error) {
+	p.mutex.Lock()
+	if n := len(p.idle); n > 0 {
+		c := p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mutex.Unlock()
+		return c, nil
+	}
+	p.mutex.Unlock()
+	return Dial(ctx, p.URL, p.Options)
+}
+
+// Returns c for reuse; broken connections are dropped
+func (p *Pool) Put(c *Conn) {
+	if c.Closed() {
+		return
+	}
+	p.mutex.Lock()
+	if len(p.idle) < p.Size {
+		p.idle = append(p.idle, c)
+		c = nil
+	}
+	p.mutex.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Closes the idle connections
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mutex.Unlock()
+	for _, c := range idle {
+		c.Close()
+	}
+}
@@ -0,0 +1,283 @@
+// Package lifecycle starts and stops a service's subsystems in a fixed order. Hooks
+// start in the order they were appended and stop in reverse, so something appended
+// after the database starts once the database is up and stops before it goes away.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Time a hook gets to start or stop when its Timeout is zero
+const DEFAULT_TIMEOUT = 15 * time.Second
+
+// A subsystem's start and stop steps. Either may be nil.
+type Hook struct {
+	Name    string
+	Start   func(ctx context.Context) error
+	Stop    func(ctx context.Context) error
+	Timeout time.Duration // per step, DEFAULT_TIMEOUT when zero
+}
+
+// Where a hook is, see Manager.Status
+const (
+	STATE_PENDING   = "pending" // not started yet
+	STATE_STARTING  = "starting"
+	STATE_RUNNING   = "running"
+	STATE_STOPPING  = "stopping"
+	STATE_STOPPED   = "stopped"   // drained, or nothing to stop
+	STATE_FAILED    = "failed"    // its start or stop step returned an error
+	STATE_TIMED_OUT = "timed_out" // its step was abandoned when the time was up
+	STATE_SKIPPED   = "skipped"   // not stopped, the stop budget was spent
+)
+
+// Returned, naming the hook, for hooks left unstopped because StopBudget ran out
+var ErrStopBudget = errors.New("stop budget spent")
+
+// A hook's progress
+type HookStatus struct {
+	Name    string
+	State   string
+	Timeout time.Duration // of its steps, after Manager.Timeouts
+	Since   time.Time     // when State was entered
+	Took    time.Duration // its last step
+	Error   string        // of its last step
+}
+
+// The hooks' progress, e.g. for reporting which subsystems have drained
+type Status struct {
+	Stopping bool
+	Stopped  time.Time // when Stop began
+	Deadline time.Time // when StopBudget runs out; zero without one
+	Hooks    []HookStatus
+}
+
+// Runs hooks in order. Append them before Start; the manager is not safe for
+// concurrent modification. Status may be read at any time, including while stopping.
+type Manager struct {
+	Logger *log.Logger
+
+	// Longest Stop may take overall, e.g. a little under a pod's termination grace
+	// period. Each stop step gets the lesser of its timeout and what is left, and hooks
+	// still waiting when it is spent are skipped. 0 is no limit.
+	StopBudget time.Duration
+	// Step timeouts by hook name, overriding Hook.Timeout
+	Timeouts map[string]time.Duration
+
+	hooks   []Hook
+	started int // hooks whose Start succeeded, a prefix of hooks
+	mutex   sync.Mutex
+
+	statusMutex sync.Mutex // guards status
+	status      Status
+}
+
+func New(logger *log.Logger) *Manager {
+	if logger == nil {
+		logger = log.Default()
+	}
+	return &Manager{Logger: logger}
+}
+
+// Adds a hook after those already appended
+func (m *Manager) Append(hook Hook) {
+	m.hooks = append(m.hooks, hook)
+	m.statusMutex.Lock()
+	m.status.Hooks = append(m.status.Hooks, HookStatus{Name: hook.Name, State: STATE_PENDING})
+	m.statusMutex.Unlock()
+}
+
+// Adds a hook before all others, so it starts first and stops last. For what has to
+// outlive the rest, like a listener reporting on the shutdown.
+func (m *Manager) Prepend(hook Hook) {
+	m.hooks = append([]Hook{hook}, m.hooks...)
+	m.statusMutex.Lock()
+	m.status.Hooks = append([]HookStatus{{Name: hook.Name, State: STATE_PENDING}}, m.status.Hooks...)
+	m.statusMutex.Unlock()
+}
+
+// Names of the hooks in start order
+func (m *Manager) Names() []string {
+	names := make([]string, len(m.hooks))
+	for i, hook := range m.hooks {
+		names[i] = hook.Name
+	}
+	return names
+}
+
+// A copy of the hooks' progress, in start order
+func (m *Manager) Status() Status {
+	m.statusMutex.Lock()
+	defer m.statusMutex.Unlock()
+	status := m.status
+	status.Hooks = make([]HookStatus, len(m.status.Hooks))
+	for i, hook := range m.status.Hooks {
+		hook.Timeout = m.timeout(m.hooks[i])
+		status.Hooks[i] = hook
+	}
+	return status
+}
+
+// Moves hook i to state; err and took describe the step that led there, if any
+func (m *Manager) setState(i int, state string, took time.Duration, err error) {
+	m.statusMutex.Lock()
+	defer m.statusMutex.Unlock()
+	hook := &m.status.Hooks[i]
+	hook.State, hook.Since, hook.Took, hook.Error = state, time.Now(), took, ""
+	if err != nil {
+		hook.Error = err.Error()
+	}
+}
+
+// The state a step that returned err leaves its hook in
+func outcome(done string, err error) string {
+	switch {
+	case err == nil:
+		return done
+	case errors.Is(err, context.DeadlineExceeded):
+		return STATE_TIMED_OUT
+	default:
+		return STATE_FAILED
+	}
+}
+
+// Starts the hooks in order. When one fails, those already started are stopped again
+// and the error names the failing hook, joined with any errors from stopping.
+func (m *Manager) Start(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for m.started < len(m.hooks) {
+		hook := m.hooks[m.started]
+		if hook.Start != nil {
+			m.setState(m.started, STATE_STARTING, 0, nil)
+			start := time.Now()
+			if err := runStep(ctx, m.timeout(hook), hook.Start); err != nil {
+				m.setState(m.started, outcome(STATE_FAILED, err), time.Since(start), err)
+				startErr := fmt.Errorf("start %s: %w", hook.Name, err)
+				return errors.Join(startErr, m.stop(context.WithoutCancel(ctx)))
+			}
+		}
+		m.setState(m.started, STATE_RUNNING, 0, nil)
+		m.started++
+	}
+	return nil
+}
+
+// Stops the started hooks in reverse order. A failing hook doesn't keep the rest from
+// stopping; the errors are joined, each naming its hook. Stopping twice is harmless.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.stop(ctx)
+}
+
+func (m *Manager) stop(ctx context.Context) error {
+	var deadline time.Time
+	if m.StopBudget > 0 {
+		deadline = time.Now().Add(m.StopBudget)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	m.statusMutex.Lock()
+	if !m.status.Stopping {
+		m.status.Stopping, m.status.Stopped, m.status.Deadline = true, time.Now(), deadline
+	}
+	m.statusMutex.Unlock()
+
+	var errs []error
+	for ; m.started > 0; m.started-- {
+		i := m.started - 1
+		hook := m.hooks[i]
+		if hook.Stop == nil {
+			m.setState(i, STATE_STOPPED, 0, nil)
+			continue
+		}
+		if ctx.Err() != nil {
+			m.setState(i, STATE_SKIPPED, 0, ErrStopBudget)
+			m.Logger.Printf("Not stopping %s: %v", hook.Name, ErrStopBudget)
+			errs = append(errs, fmt.Errorf("stop %s: %w", hook.Name, ErrStopBudget))
+			continue
+		}
+		m.setState(i, STATE_STOPPING, 0, nil)
+		start := time.Now()
+		err := runStep(ctx, m.timeout(hook), hook.Stop)
+		m.setState(i, outcome(STATE_STOPPED, err), time.Since(start), err)
+		if err != nil {
+			m.Logger.Printf("Stopping %s failed: %v", hook.Name, err)
+			errs = append(errs, fmt.Errorf("stop %s: %w", hook.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The step timeout of hook: Timeouts, else its own, else DEFAULT_TIMEOUT
+func (m *Manager) timeout(hook Hook) time.Duration {
+	if timeout, ok := m.Timeouts[hook.Name]; ok && timeout > 0 {
+		return timeout
+	}
+	if hook.Timeout > 0 {
+		return hook.Timeout
+	}
+	return DEFAULT_TIMEOUT
+}
+
+// Runs step within timeout, or ctx's deadline when sooner. A step that ignores its
+// context is abandoned when the time is up, so one stuck subsystem can't hold up the
+// others.
+func runStep(ctx context.Context, timeout time.Duration, step func(context.Context) error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				done <- fmt.Errorf("panic: %v", recovered)
+			}
+		}()
+		done <- step(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("gave up after %s: %w", timeout.Round(time.Millisecond), ctx.Err())
+	}
+}
+
+// A hook for a loop that runs until its context ends, like a watcher or a consumer.
+// Start launches run; Stop cancels its context and waits for it to return.
+func Background(name string, run func(ctx context.Context)) Hook {
+	var cancel context.CancelFunc
+	done := make(chan struct{})
+	return Hook{
+		Name: name,
+		Start: func(ctx context.Context) error {
+			var runCtx context.Context
+			// The loop outlives Start's deadline
+			runCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+			go func() {
+				defer close(done)
+				run(runCtx)
+			}()
+			return nil
+		},
+		Stop: func(ctx context.Context) error {
+			cancel()
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// First file descriptor passed by systemd socket activation (SD_LISTEN_FDS_START)
+const SYSTEMD_LISTEN_FDS_START = 3
+
+// Creates the server listener from the listen-addr setting, systemd socket activation, or port.
+//
+// listenAddr accepts "unix:///path/to.sock", "systemd", or a TCP address such as
+// "127.0.0.1:8080". When it is empty but systemd passed sockets for this process,
+// the first one is used. Otherwise the server listens on TCP port port.
+func newListener(listenAddr, port string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(listenAddr, "unix://"):
+		return listenUnix(strings.TrimPrefix(listenAddr, "unix://"))
+	case listenAddr == "systemd":
+		return listenSystemd()
+	case listenAddr != "":
+		return net.Listen("tcp", listenAddr)
+	}
+
+	if os.Getenv("LISTEN_FDS") != "" {
+		return listenSystemd()
+	}
+	return net.Listen("tcp", ":"+port)
+}
+
+func listenUnix(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("unix socket path is empty")
+	}
+	// A socket file left behind by a previous run would make the bind fail
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// Inherits the first socket passed via the systemd LISTEN_FDS protocol
+func listenSystemd() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("LISTEN_PID does not match this process")
+	}
+
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, errors.New("no sockets passed via LISTEN_FDS")
+	}
+
+	// Keep child processes (e.g. git) from inheriting the activation variables
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	file := os.NewFile(uintptr(SYSTEMD_LISTEN_FDS_START), "systemd-listener")
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("inherit systemd socket: %w", err)
+	}
+	return listener, nil
+}
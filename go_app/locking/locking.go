@@ -0,0 +1,156 @@
+// Package locking provides named locks shared by the replicas of a service, so a
+// scheduled job runs on one of them at a time. Locks expire after a TTL, so a replica
+// that dies holding one doesn't block the others for long. Every lease carries a
+// fencing token, larger for each later holder of the same name: storage that records
+// the token it last saw can refuse writes from a holder whose lease has already run out.
+package locking
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Per-lock counters, published on /debug/vars
+var (
+	lockMetrics  = expvar.NewMap("locks")
+	metricsMutex sync.Mutex
+)
+
+// How often Lock retries a held lock, first and at most
+const (
+	RETRY_INTERVAL     = 50 * time.Millisecond
+	MAX_RETRY_INTERVAL = time.Second
+)
+
+// Returned by Acquire and TryLock when someone else holds the lock
+var ErrLocked = errors.New("lock is held elsewhere")
+
+// A backend keeping locks, e.g. Redis or Postgres
+type Locker interface {
+	// Takes name for ttl without waiting, or fails with ErrLocked
+	Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error)
+}
+
+// A held lock
+type Lease struct {
+	Name    string
+	Token   int64     // fencing token, increasing with every acquisition of Name
+	Expires time.Time // when the lock frees itself unless released before
+
+	once    sync.Once
+	release func(ctx context.Context) error
+	err     error
+}
+
+// Gives the lock up. Only the first call releases; later ones return its result.
+func (l *Lease) Release(ctx context.Context) error {
+	l.once.Do(func() {
+		l.err = l.release(ctx)
+		metricsFor(l.Name).Add("released", 1)
+	})
+	return l.err
+}
+
+func newLease(name string, token int64, ttl time.Duration, release func(ctx context.Context) error) *Lease {
+	return &Lease{Name: name, Token: token, Expires: time.Now().Add(ttl), release: release}
+}
+
+// Takes name from locker if it is free, counting the outcome
+func TryLock(ctx context.Context, locker Locker, name string, ttl time.Duration) (*Lease, error) {
+	metrics := metricsFor(name)
+	lease, err := locker.Acquire(ctx, name, ttl)
+	switch {
+	case err == nil:
+		metrics.Add("acquired", 1)
+	case errors.Is(err, ErrLocked):
+		metrics.Add("contended", 1)
+	default:
+		metrics.Add("errors", 1)
+	}
+	return lease, err
+}
+
+// Takes name from locker, waiting while someone else holds it until ctx is done. The
+// time spent waiting is added up in the lock's wait_ms.
+func Lock(ctx context.Context, locker Locker, name string, ttl time.Duration) (*Lease, error) {
+	start := time.Now()
+	defer func() { metricsFor(name).Add("wait_ms", time.Since(start).Milliseconds()) }()
+	interval := RETRY_INTERVAL
+	for {
+		lease, err := TryLock(ctx, locker, name, ttl)
+		if !errors.Is(err, ErrLocked) {
+			return lease, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+		interval = min(interval*2, MAX_RETRY_INTERVAL)
+	}
+}
+
+func metricsFor(name string) *expvar.Map {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	if metrics, ok := lockMetrics.Get(name).(*expvar.Map); ok {
+		return metrics
+	}
+	metrics := new(expvar.Map)
+	lockMetrics.Set(name, metrics)
+	return metrics
+}
+
+// Random value telling holders apart
+func newOwner() (string, error) {
+	owner := make([]byte, 16)
+	if _, err := rand.Read(owner); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(owner), nil
+}
+
+// Locks within one process, for single replicas and development
+type Memory struct {
+	mutex  sync.Mutex
+	held   map[string]memoryHold
+	fences map[string]int64
+}
+
+type memoryHold struct {
+	owner   string
+	expires time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{held: map[string]memoryHold{}, fences: map[string]int64{}}
+}
+
+func (m *Memory) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	now := time.Now()
+	if hold, ok := m.held[name]; ok && now.Before(hold.expires) {
+		return nil, ErrLocked
+	}
+	m.held[name] = memoryHold{owner: owner, expires: now.Add(ttl)}
+	m.fences[name]++
+	return newLease(name, m.fences[name], ttl, func(ctx context.Context) error {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		// Expired and taken by someone else in the meantime
+		if m.held[name].owner == owner {
+			delete(m.held, name)
+		}
+		return nil
+	}), nil
+}
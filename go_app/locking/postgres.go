@@ -0,0 +1,95 @@
+package locking
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"time"
+)
+
+// Time allowed for unlocking a lease whose own context is gone
+const POSTGRES_RELEASE_TIMEOUT = 5 * time.Second
+
+const postgresFencesSchema = `CREATE TABLE IF NOT EXISTS lock_fences (
+	name TEXT PRIMARY KEY,
+	token BIGINT NOT NULL
+)`
+
+// Locks as Postgres session-level advisory locks. Each lease holds a connection of the
+// pool until released, as the lock belongs to the session; if the replica dies, the
+// server ends the session and frees the lock without waiting for the TTL. Fencing
+// tokens are counted in the lock_fences table.
+type Postgres struct {
+	db *sql.DB
+}
+
+// Creates the lock_fences table if needed. db must use a Postgres driver, such as pgx.
+func NewPostgres(ctx context.Context, db *sql.DB) (*Postgres, error) {
+	if _, err := db.ExecContext(ctx, postgresFencesSchema); err != nil {
+		return nil, fmt.Errorf("create lock_fences: %w", err)
+	}
+	return &Postgres{db: db}, nil
+}
+
+// Advisory locks are named by a 64-bit key
+func advisoryKey(name string) int64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(name))
+	return int64(hash.Sum64())
+}
+
+func (p *Postgres) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	conn, err := p.db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", name, err)
+	}
+	key := advisoryKey(name)
+	var locked bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, key).Scan(&locked); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("lock %s: %w", name, err)
+	}
+	if !locked {
+		conn.Close()
+		return nil, ErrLocked
+	}
+
+	unlock := func(ctx context.Context) error {
+		defer conn.Close()
+		_, err := conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, key)
+		return err
+	}
+	var token int64
+	err = conn.QueryRowContext(ctx, `INSERT INTO lock_fences (name, token) VALUES ($1, 1)
+		ON CONFLICT (name) DO UPDATE SET token = lock_fences.token + 1 RETURNING token`, name).Scan(&token)
+	if err != nil {
+		unlock(context.Background())
+		return nil, fmt.Errorf("lock %s: fencing token: %w", name, err)
+	}
+
+	// Advisory locks don't expire; the TTL is kept by unlocking when it runs out, so
+	// the lease ends at the same time on every backend
+	released := make(chan struct{})
+	lease := newLease(name, token, ttl, func(ctx context.Context) error {
+		close(released)
+		if ctx.Err() != nil {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(context.WithoutCancel(ctx), POSTGRES_RELEASE_TIMEOUT)
+			defer cancel()
+		}
+		return unlock(ctx)
+	})
+	go func() {
+		timer := time.NewTimer(ttl)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+			ctx, cancel := context.WithTimeout(context.Background(), POSTGRES_RELEASE_TIMEOUT)
+			defer cancel()
+			lease.Release(ctx)
+		case <-released:
+		}
+	}()
+	return lease, nil
+}
@@ -0,0 +1,79 @@
+package locking
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go_app/redis"
+)
+
+// Prefixes of the keys a lock lives in: the holder's owner value with a PX expiry, and
+// the fencing counter, which never expires
+const (
+	REDIS_LOCK_PREFIX  = "lock:"
+	REDIS_FENCE_PREFIX = "lock-fence:"
+)
+
+// Takes the lock and bumps its fencing counter in one step, so a token is only used up
+// by an acquisition that succeeded. Answers the token, or 0 when the lock is held.
+const redisAcquireScript = `if redis.call('set', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+	return redis.call('incr', KEYS[2])
+end
+return 0`
+
+// Deletes the lock only while it is still ours; once it expired, someone else's may be
+// in its place
+const redisReleaseScript = `if redis.call('get', KEYS[1]) == ARGV[1] then
+	return redis.call('del', KEYS[1])
+end
+return 0`
+
+// Locks in Redis as keys set with SET NX PX. A single Redis server is assumed; with a
+// replica failover a lock may be granted twice, which fencing tokens then catch.
+type Redis struct {
+	client *redis.Client
+}
+
+// Connects to a redis:// or rediss:// (TLS) URL with an optional password and database
+// number, e.g. redis://:secret@localhost:6379/2
+func NewRedis(rawURL string, timeout time.Duration) (*Redis, error) {
+	client, err := redis.New(rawURL, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &Redis{client: client}, nil
+}
+
+func (r *Redis) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	owner, err := newOwner()
+	if err != nil {
+		return nil, err
+	}
+	key := REDIS_LOCK_PREFIX + name
+	reply, err := r.client.Do(ctx, "EVAL", redisAcquireScript, "2", key, REDIS_FENCE_PREFIX+name, owner, strconv.FormatInt(max(ttl.Milliseconds(), 1), 10))
+	if err != nil {
+		return nil, fmt.Errorf("lock %s: %w", name, err)
+	}
+	token, ok := reply.(int64)
+	if !ok {
+		return nil, fmt.Errorf("lock %s: unexpected reply %v", name, reply)
+	}
+	if token == 0 {
+		return nil, ErrLocked
+	}
+	return newLease(name, token, ttl, func(ctx context.Context) error {
+		_, err := r.client.Do(ctx, "EVAL", redisReleaseScript, "1", key, owner)
+		return err
+	}), nil
+}
+
+// Pings the server, e.g. for a startup check
+func (r *Redis) Ping(ctx context.Context) error {
+	return r.client.Ping(ctx)
+}
+
+func (r *Redis) Close() error {
+	return r.client.Close()
+}
@@ -0,0 +1,246 @@
+package messaging
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Per group/topic counters and lag, published on /debug/vars
+var consumerMetrics = expvar.NewMap("consumer")
+
+// Defaults of the Consumer settings
+const (
+	DEFAULT_BATCH_SIZE    = 100
+	DEFAULT_POLL_INTERVAL = time.Second
+	DEFAULT_MAX_ATTEMPTS  = 5
+	DEFAULT_RETRY_DELAY   = time.Second // doubled per attempt
+	DEFAULT_DRAIN_TIMEOUT = 15 * time.Second
+)
+
+// Longest wait between two attempts at one message
+const MAX_RETRY_DELAY = time.Minute
+
+// Wrapped by handler errors that retrying cannot fix, like a malformed payload. The
+// message is dead-lettered without further attempts.
+var ErrPermanent = errors.New("permanent failure")
+
+// Processes one message. Returning nil acknowledges it; an error has it retried.
+type Handler func(ctx context.Context, message Message) error
+
+// Delivers messages of the registered topics to their handlers at least once, in
+// topic order per batch. After a crash, messages since the last commit are delivered
+// again, so handlers must tolerate duplicates.
+type Consumer struct {
+	Log    Log
+	Group  string // consumer group; offsets are kept per group and topic
+	Logger *log.Logger
+
+	BatchSize    int           // messages read per poll
+	PollInterval time.Duration // wait after finding a topic empty
+	MaxAttempts  int           // attempts before a message is dead-lettered
+	RetryDelay   time.Duration // wait before the second attempt
+	DrainTimeout time.Duration // time handlers in flight get after Run's context ends
+
+	registrations []registration
+}
+
+type registration struct {
+	topic       string
+	concurrency int
+	handler     Handler
+}
+
+func NewConsumer(log Log, group string, logger *log.Logger) *Consumer {
+	return &Consumer{
+		Log:          log,
+		Group:        group,
+		Logger:       logger,
+		BatchSize:    DEFAULT_BATCH_SIZE,
+		PollInterval: DEFAULT_POLL_INTERVAL,
+		MaxAttempts:  DEFAULT_MAX_ATTEMPTS,
+		RetryDelay:   DEFAULT_RETRY_DELAY,
+		DrainTimeout: DEFAULT_DRAIN_TIMEOUT,
+	}
+}
+
+// Registers handler for topic, running up to concurrency messages at once (1 when
+// less). Messages are then handled out of order within a batch. Register before Run;
+// not safe for concurrent modification.
+func (c *Consumer) Handle(topic string, concurrency int, handler Handler) {
+	c.registrations = append(c.registrations, registration{topic: topic, concurrency: max(concurrency, 1), handler: handler})
+}
+
+// Consumes every registered topic until ctx ends. Then no new messages start, handlers
+// in flight get up to DrainTimeout to finish, and what completed is committed before
+// Run returns.
+func (c *Consumer) Run(ctx context.Context) {
+	if len(c.registrations) == 0 {
+		return
+	}
+	handlerCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		timer := time.AfterFunc(c.DrainTimeout, cancel)
+		<-handlerCtx.Done()
+		timer.Stop()
+	})
+	defer stop()
+
+	var wg sync.WaitGroup
+	for _, reg := range c.registrations {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.consume(ctx, handlerCtx, reg)
+		}()
+	}
+	wg.Wait()
+}
+
+func (c *Consumer) metric(topic, name string) string {
+	return c.Group + "/" + topic + "." + name
+}
+
+// Polls one topic. ctx stops polling; handlerCtx bounds handlers and commits.
+func (c *Consumer) consume(ctx, handlerCtx context.Context, reg registration) {
+	var offset int64
+	for {
+		var err error
+		if offset, err = c.Log.Committed(ctx, c.Group, reg.topic); err == nil {
+			break
+		}
+		c.Logger.Printf("Consumer %s: reading the offset of %s failed: %v", c.Group, reg.topic, err)
+		if !sleep(ctx, c.PollInterval) {
+			return
+		}
+	}
+
+	for ctx.Err() == nil {
+		batch, err := c.Log.Read(ctx, reg.topic, offset, c.BatchSize)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.Logger.Printf("Consumer %s: reading %s failed: %v", c.Group, reg.topic, err)
+			}
+			sleep(ctx, c.PollInterval)
+			continue
+		}
+		c.recordLag(ctx, reg.topic, offset)
+		if len(batch) == 0 {
+			sleep(ctx, c.PollInterval)
+			continue
+		}
+
+		completed := c.processBatch(ctx, handlerCtx, reg, batch)
+		if completed == 0 {
+			continue
+		}
+		next := batch[completed-1].Offset
+		if err := c.Log.Commit(handlerCtx, c.Group, reg.topic, next); err != nil {
+			// The batch is redelivered after a restart; keep going from memory meanwhile
+			c.Logger.Printf("Consumer %s: committing %s at %d failed: %v", c.Group, reg.topic, next, err)
+		}
+		offset = next
+		c.recordLag(ctx, reg.topic, offset)
+	}
+}
+
+func (c *Consumer) recordLag(ctx context.Context, topic string, offset int64) {
+	head, err := c.Log.Head(ctx, topic)
+	if err != nil {
+		return
+	}
+	lag := new(expvar.Int)
+	lag.Set(head - offset)
+	consumerMetrics.Set(c.metric(topic, "lag"), lag)
+}
+
+// Handles batch with up to reg.concurrency messages at once and returns how many
+// leading messages are done, which is what may be committed
+func (c *Consumer) processBatch(ctx, handlerCtx context.Context, reg registration, batch []Message) int {
+	done := make([]bool, len(batch))
+	slots := make(chan struct{}, reg.concurrency)
+	var wg sync.WaitGroup
+dispatch:
+	for i, message := range batch {
+		select {
+		case <-ctx.Done():
+			break dispatch
+		case slots <- struct{}{}:
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			done[i] = c.deliver(ctx, handlerCtx, reg, message)
+		}()
+	}
+	wg.Wait()
+
+	completed := 0
+	for completed < len(done) && done[completed] {
+		completed++
+	}
+	return completed
+}
+
+// Runs the handler until it succeeds or the message is dead-lettered. Returns false
+// when draining cut it short, leaving the message for redelivery.
+func (c *Consumer) deliver(ctx, handlerCtx context.Context, reg registration, message Message) bool {
+	delay := c.RetryDelay
+	for attempt := 1; ; attempt++ {
+		message.Attempt = attempt
+		err := callHandler(handlerCtx, reg.handler, message)
+		if err == nil {
+			consumerMetrics.Add(c.metric(reg.topic, "processed"), 1)
+			return true
+		}
+		if handlerCtx.Err() != nil {
+			return false
+		}
+		consumerMetrics.Add(c.metric(reg.topic, "failed"), 1)
+
+		if errors.Is(err, ErrPermanent) || attempt >= c.MaxAttempts {
+			if _, dlqErr := c.Log.Append(handlerCtx, DeadLetterTopic(reg.topic), message.Payload); dlqErr != nil {
+				c.Logger.Printf("Consumer %s: dead-lettering %s/%d failed: %v", c.Group, reg.topic, message.Offset, dlqErr)
+				return false
+			}
+			consumerMetrics.Add(c.metric(reg.topic, "dead_lettered"), 1)
+			c.Logger.Printf("Consumer %s: message %s/%d dead-lettered after %d attempts: %v", c.Group, reg.topic, message.Offset, attempt, err)
+			return true
+		}
+
+		// While draining, leave the message to the next run instead of waiting to retry
+		if !sleep(ctx, delay) {
+			return false
+		}
+		consumerMetrics.Add(c.metric(reg.topic, "retried"), 1)
+		delay = min(delay*2, MAX_RETRY_DELAY)
+	}
+}
+
+// Calls handler, turning a panic into an error so one bad message cannot stop the consumer
+func callHandler(ctx context.Context, handler Handler, message Message) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("handler panicked: %v", recovered)
+		}
+	}()
+	return handler(ctx, message)
+}
+
+// Waits for d, returning false if ctx ends first
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -0,0 +1,116 @@
+// Package messaging moves messages between services through a durable, ordered log and
+// delivers them to handlers at least once. Unlike eventbus, nothing is dropped: a
+// message counts as consumed only once its handler succeeded or it was dead-lettered.
+package messaging
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Suffix of the topic that receives messages whose handler kept failing
+const DEAD_LETTER_SUFFIX = ".dead-letter"
+
+// A message read from the log
+type Message struct {
+	Topic   string
+	Offset  int64 // position in the topic, increasing from 1
+	Payload []byte
+	Time    time.Time // when it was appended
+
+	// Delivery attempt in this process, from 1. A message redelivered after a restart
+	// starts again at 1.
+	Attempt int
+}
+
+// Decodes a JSON payload into v
+func (m Message) Decode(v any) error {
+	return json.Unmarshal(m.Payload, v)
+}
+
+// Ordered per-topic message storage with committed offsets per consumer group
+type Log interface {
+	// Appends payload to topic and returns its offset
+	Append(ctx context.Context, topic string, payload []byte) (int64, error)
+	// Up to limit messages of topic after the given offset, oldest first
+	Read(ctx context.Context, topic string, after int64, limit int) ([]Message, error)
+	// Offset of the newest message of topic, 0 when it is empty
+	Head(ctx context.Context, topic string) (int64, error)
+	// Offset up to which group has consumed topic, 0 before its first commit
+	Committed(ctx context.Context, group, topic string) (int64, error)
+	Commit(ctx context.Context, group, topic string, offset int64) error
+}
+
+// Appends payload to topic as JSON
+func Publish(ctx context.Context, log Log, topic string, payload any) (int64, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	return log.Append(ctx, topic, data)
+}
+
+// The topic receiving topic's dead letters
+func DeadLetterTopic(topic string) string {
+	return topic + DEAD_LETTER_SUFFIX
+}
+
+// In-memory Log for development and single-instance use. Messages and offsets are
+// lost on restart.
+type MemoryLog struct {
+	mutex   sync.Mutex
+	topics  map[string][]Message
+	offsets map[[2]string]int64
+}
+
+func NewMemoryLog() *MemoryLog {
+	return &MemoryLog{topics: make(map[string][]Message), offsets: make(map[[2]string]int64)}
+}
+
+func (l *MemoryLog) Append(ctx context.Context, topic string, payload []byte) (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	offset := int64(len(l.topics[topic]) + 1)
+	l.topics[topic] = append(l.topics[topic], Message{
+		Topic:   topic,
+		Offset:  offset,
+		Payload: append([]byte(nil), payload...),
+		Time:    time.Now(),
+	})
+	return offset, nil
+}
+
+func (l *MemoryLog) Read(ctx context.Context, topic string, after int64, limit int) ([]Message, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	messages := l.topics[topic]
+	if after >= int64(len(messages)) {
+		return nil, nil
+	}
+	messages = messages[max(after, 0):]
+	if len(messages) > limit {
+		messages = messages[:limit]
+	}
+	return append([]Message(nil), messages...), nil
+}
+
+func (l *MemoryLog) Head(ctx context.Context, topic string) (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return int64(len(l.topics[topic])), nil
+}
+
+func (l *MemoryLog) Committed(ctx context.Context, group, topic string) (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.offsets[[2]string{group, topic}], nil
+}
+
+func (l *MemoryLog) Commit(ctx context.Context, group, topic string, offset int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.offsets[[2]string{group, topic}] = offset
+	return nil
+}
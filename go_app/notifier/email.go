@@ -0,0 +1,147 @@
+package notifier
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"go_app/i18n"
+)
+
+// Email templates shipped with the binary, as templates/<locale>/<name>.<part>
+//
+//go:embed templates
+var defaultTemplates embed.FS
+
+// Template used for events whose kind has no template of its own
+const DEFAULT_EMAIL_TEMPLATE = "event"
+
+// File suffixes of the parts of an email template. The subject and HTML body are
+// required; without a text part the email is sent as HTML only.
+const (
+	SUBJECT_SUFFIX = ".subject.txt"
+	TEXT_SUFFIX    = ".txt"
+	HTML_SUFFIX    = ".html"
+)
+
+// Returned by Render when name has no template in any locale of the chain
+var ErrNoTemplate = errors.New("no email template")
+
+// A rendered email
+type Email struct {
+	Locale  string
+	Subject string
+	Text    string // empty when the template has no text part
+	HTML    string
+}
+
+// Localized email templates: html/template for HTML bodies, text/template for subjects
+// and plain text bodies
+type Templates struct {
+	Locale string // used when none of the recipient's locales has the template
+
+	subjects map[string]*template.Template // keyed by "<locale>/<name>"
+	texts    map[string]*template.Template
+	htmls    map[string]*htmltemplate.Template
+}
+
+// Parses the embedded templates, then the files in dir, which replace embedded files
+// of the same locale and name and may add locales and names. An empty dir uses the
+// embedded templates alone, an empty locale i18n.DEFAULT_LOCALE.
+func LoadTemplates(dir, locale string) (*Templates, error) {
+	if locale == "" {
+		locale = i18n.DEFAULT_LOCALE
+	}
+	t := &Templates{
+		Locale:   i18n.Canonical(locale),
+		subjects: make(map[string]*template.Template),
+		texts:    make(map[string]*template.Template),
+		htmls:    make(map[string]*htmltemplate.Template),
+	}
+	embedded, _ := fs.Sub(defaultTemplates, "templates")
+	if err := t.load(embedded); err != nil {
+		return nil, err
+	}
+	if dir != "" {
+		if err := t.load(os.DirFS(dir)); err != nil {
+			return nil, fmt.Errorf("email templates %s: %w", dir, err)
+		}
+	}
+	for key := range t.htmls {
+		if t.subjects[key] == nil {
+			return nil, fmt.Errorf("email template %s has no %s", key, SUBJECT_SUFFIX)
+		}
+	}
+	return t, nil
+}
+
+// Parses the <locale>/<name>.<part> files of fsys; other files are ignored
+func (t *Templates) load(fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		locale, base := path.Split(file)
+		locale = i18n.Canonical(strings.TrimSuffix(locale, "/"))
+		if locale == "" || strings.Contains(locale, "/") {
+			return nil
+		}
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case strings.HasSuffix(base, SUBJECT_SUFFIX):
+			key := locale + "/" + strings.TrimSuffix(base, SUBJECT_SUFFIX)
+			t.subjects[key], err = template.New(file).Funcs(templateFuncs).Parse(string(content))
+		case strings.HasSuffix(base, TEXT_SUFFIX):
+			key := locale + "/" + strings.TrimSuffix(base, TEXT_SUFFIX)
+			t.texts[key], err = template.New(file).Funcs(templateFuncs).Parse(string(content))
+		case strings.HasSuffix(base, HTML_SUFFIX):
+			key := locale + "/" + strings.TrimSuffix(base, HTML_SUFFIX)
+			t.htmls[key], err = htmltemplate.New(file).Funcs(htmltemplate.FuncMap(templateFuncs)).Parse(string(content))
+		}
+		return err
+	})
+}
+
+// Renders template name with data in the first locale of the recipient's preferences,
+// most preferred first, that has it. Regional locales fall back to their language
+// ("de-ch" to "de"), and then to t.Locale.
+func (t *Templates) Render(name string, locales []string, data any) (Email, error) {
+	locale := i18n.Negotiate(locales, t.Locale, func(locale string) bool {
+		return t.htmls[locale+"/"+name] != nil
+	})
+	if locale == "" {
+		return Email{}, fmt.Errorf("%w %q", ErrNoTemplate, name)
+	}
+	key := locale + "/" + name
+
+	email := Email{Locale: locale}
+	var buf bytes.Buffer
+	if err := t.subjects[key].Execute(&buf, data); err != nil {
+		return Email{}, err
+	}
+	email.Subject = strings.TrimSpace(buf.String())
+	if text := t.texts[key]; text != nil {
+		buf.Reset()
+		if err := text.Execute(&buf, data); err != nil {
+			return Email{}, err
+		}
+		email.Text = buf.String()
+	}
+	buf.Reset()
+	if err := t.htmls[key].Execute(&buf, data); err != nil {
+		return Email{}, err
+	}
+	email.HTML = buf.String()
+	return email, nil
+}
@@ -0,0 +1,134 @@
+// Package notifier delivers security event notifications by email and webhook, with
+// per-event rate limiting so an incident produces a handful of messages, not a flood.
+package notifier
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event kinds that can be enabled as triggers
+const (
+	EVENT_AUTH_FAILURES  = "auth_failures"  // a login key was locked out after repeated failures
+	EVENT_KEY_ROTATION   = "key_rotation"   // the token signing key changed
+	EVENT_READINESS_FLAP = "readiness_flap" // a readiness check changed state repeatedly
+	EVENT_PANIC          = "panic"          // a handler panicked
+	EVENT_SLO_BURN       = "slo_burn"       // a route spends its error budget too fast
+)
+
+// Pending notifications beyond this are dropped
+const QUEUE_SIZE = 100
+
+// Timeout for delivering one notification to one backend
+const DELIVERY_TIMEOUT = 10 * time.Second
+
+// Something worth telling a human about
+type Event struct {
+	Kind    string
+	Message string
+	Time    time.Time
+	Fields  map[string]string
+
+	// Events of the same kind dropped by the rate limit since the last delivery
+	Suppressed int
+}
+
+// Delivers a rendered event somewhere
+type Backend interface {
+	Send(ctx context.Context, event Event) error
+	String() string
+}
+
+// Fans enabled events out to backends in the background. The zero value and nil
+// notifiers are valid and drop everything.
+type Notifier struct {
+	Backends []Backend
+	Triggers map[string]bool
+	Interval time.Duration // minimum time between deliveries of the same kind
+	Logger   *log.Logger
+
+	mutex      sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+	queue      chan Event
+	startOnce  sync.Once
+}
+
+// Builds a notifier for triggers, a comma separated list of event kinds
+func New(triggers string, interval time.Duration, logger *log.Logger, backends ...Backend) *Notifier {
+	enabled := map[string]bool{}
+	for _, kind := range strings.Split(triggers, ",") {
+		if kind = strings.TrimSpace(kind); kind != "" {
+			enabled[kind] = true
+		}
+	}
+	return &Notifier{
+		Backends:   backends,
+		Triggers:   enabled,
+		Interval:   interval,
+		Logger:     logger,
+		last:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		queue:      make(chan Event, QUEUE_SIZE),
+	}
+}
+
+// Enabled event kinds, sorted
+func (n *Notifier) EnabledTriggers() []string {
+	if n == nil {
+		return nil
+	}
+	var kinds []string
+	for kind, enabled := range n.Triggers {
+		if enabled {
+			kinds = append(kinds, kind)
+		}
+	}
+	sort.Strings(kinds)
+	return kinds
+}
+
+// Queues event for delivery without blocking. Disabled kinds, events inside the rate
+// limit interval, and events arriving while the queue is full are dropped.
+func (n *Notifier) Notify(event Event) {
+	if n == nil || len(n.Backends) == 0 || !n.Triggers[event.Kind] {
+		return
+	}
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	n.mutex.Lock()
+	if last, ok := n.last[event.Kind]; ok && event.Time.Sub(last) < n.Interval {
+		n.suppressed[event.Kind]++
+		n.mutex.Unlock()
+		return
+	}
+	n.last[event.Kind] = event.Time
+	event.Suppressed = n.suppressed[event.Kind]
+	n.suppressed[event.Kind] = 0
+	n.mutex.Unlock()
+
+	n.startOnce.Do(func() { go n.deliver() })
+	select {
+	case n.queue <- event:
+	default:
+		n.Logger.Printf("Notification queue full, dropping %s event", event.Kind)
+	}
+}
+
+func (n *Notifier) deliver() {
+	for event := range n.queue {
+		for _, backend := range n.Backends {
+			ctx, cancel := context.WithTimeout(context.Background(), DELIVERY_TIMEOUT)
+			if err := backend.Send(ctx, event); err != nil {
+				n.Logger.Printf("Notification via %s failed: %v", backend, err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Sends events as email through an SMTP relay
+type SMTP struct {
+	Addr     string // host:port
+	From     string
+	To       []string
+	Username string // PLAIN auth is used when set
+	Password string
+
+	// Event emails are rendered from the template named after the event kind, or
+	// DEFAULT_EMAIL_TEMPLATE, in the first of Locales that has it
+	Templates *Templates
+	Locales   []string
+
+	// Custom plain text body replacing Templates when set, with Subject as its subject
+	Subject *template.Template
+	Body    *template.Template
+}
+
+// Builds an SMTP backend sending to the comma separated recipients in to. A non-empty
+// bodyTemplate replaces templates with a plain text body; nil templates use the
+// embedded ones.
+func NewSMTP(addr, from, to, username, password, bodyTemplate string, templates *Templates, locales []string) (*SMTP, error) {
+	var recipients []string
+	for _, address := range strings.Split(to, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			recipients = append(recipients, address)
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, errors.New("smtp: no recipients")
+	}
+	s := &SMTP{
+		Addr:      addr,
+		From:      from,
+		To:        recipients,
+		Username:  username,
+		Password:  password,
+		Templates: templates,
+		Locales:   locales,
+	}
+
+	if bodyTemplate != "" {
+		var err error
+		if s.Subject, err = ParseTemplate("subject", DEFAULT_SUBJECT_TEMPLATE); err != nil {
+			return nil, err
+		}
+		if s.Body, err = ParseTemplate("body", bodyTemplate); err != nil {
+			return nil, fmt.Errorf("email template: %w", err)
+		}
+	} else if s.Templates == nil {
+		var err error
+		if s.Templates, err = LoadTemplates("", ""); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *SMTP) Send(ctx context.Context, event Event) error {
+	email, err := s.render(event)
+	if err != nil {
+		return err
+	}
+	return s.SendEmail(ctx, s.To, event.Time, email)
+}
+
+func (s *SMTP) render(event Event) (Email, error) {
+	if s.Body != nil {
+		subject, err := render(s.Subject, event)
+		if err != nil {
+			return Email{}, err
+		}
+		body, err := render(s.Body, event)
+		return Email{Subject: subject, Text: body}, err
+	}
+	email, err := s.Templates.Render(event.Kind, s.Locales, event)
+	if errors.Is(err, ErrNoTemplate) {
+		email, err = s.Templates.Render(DEFAULT_EMAIL_TEMPLATE, s.Locales, event)
+	}
+	return email, err
+}
+
+// Sends email to the given recipients, as multipart/alternative when it has both a
+// text and an HTML body. Usable for transactional emails rendered with Templates.
+func (s *SMTP) SendEmail(ctx context.Context, to []string, date time.Time, email Email) error {
+	message, err := buildMessage(s.From, to, date, email)
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+
+	// net/smtp has no context support, so bound the whole exchange with a goroutine
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.Addr, auth, s.From, to, message)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Formats email as an RFC 5322 message with quoted-printable UTF-8 bodies, which also
+// turns line breaks into CRLF
+func buildMessage(from string, to []string, date time.Time, email Email) ([]byte, error) {
+	var buf bytes.Buffer
+	header := func(name, value string) {
+		buf.WriteString(name + ": " + value + "\r\n")
+	}
+	header("From", from)
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.ReplaceAll(email.Subject, "\n", " ")))
+	header("Date", date.Format(time.RFC1123Z))
+	header("MIME-Version", "1.0")
+	if email.Locale != "" {
+		header("Content-Language", email.Locale)
+	}
+
+	var parts []textproto.MIMEHeader
+	var bodies []string
+	if email.Text != "" || email.HTML == "" {
+		parts = append(parts, textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+		bodies = append(bodies, email.Text)
+	}
+	if email.HTML != "" {
+		parts = append(parts, textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}})
+		bodies = append(bodies, email.HTML)
+	}
+	for _, part := range parts {
+		part.Set("Content-Transfer-Encoding", "quoted-printable")
+	}
+
+	if len(parts) == 1 {
+		header("Content-Type", parts[0].Get("Content-Type"))
+		header("Content-Transfer-Encoding", parts[0].Get("Content-Transfer-Encoding"))
+		buf.WriteString("\r\n")
+		if err := writeQuotedPrintable(&buf, bodies[0]); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	writer := multipart.NewWriter(&buf)
+	header("Content-Type", "multipart/alternative; boundary="+writer.Boundary())
+	buf.WriteString("\r\n")
+	for i, part := range parts {
+		w, err := writer.CreatePart(part)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(w, bodies[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeQuotedPrintable(w io.Writer, body string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(body)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+func (s *SMTP) String() string {
+	return "smtp " + s.Addr
+}
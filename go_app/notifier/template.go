@@ -0,0 +1,41 @@
+package notifier
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"text/template"
+)
+
+// Subject of emails with a custom plain text body
+const DEFAULT_SUBJECT_TEMPLATE = `[{{.Kind}}] {{.Message}}`
+
+// Default webhook payload, a JSON object with the event's fields
+const DEFAULT_WEBHOOK_TEMPLATE = `{"kind":{{json .Kind}},"message":{{json .Message}},"time":{{json .Time}},"fields":{{json .Fields}},"suppressed":{{.Suppressed}}}`
+
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+// Parses a payload template. Values starting with "@" name a file to read it from.
+func ParseTemplate(name, text string) (*template.Template, error) {
+	if len(text) > 0 && text[0] == '@' {
+		content, err := os.ReadFile(text[1:])
+		if err != nil {
+			return nil, err
+		}
+		text = string(content)
+	}
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+func render(tmpl *template.Template, event Event) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
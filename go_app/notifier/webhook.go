@@ -0,0 +1,62 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// Posts the rendered payload to an HTTP endpoint, e.g. a chat or incident tool webhook
+type Webhook struct {
+	URL         string
+	ContentType string
+	Template    *template.Template
+	HTTPClient  *http.Client
+}
+
+// Builds a webhook backend; an empty payloadTemplate sends DEFAULT_WEBHOOK_TEMPLATE as JSON
+func NewWebhook(url, payloadTemplate string) (*Webhook, error) {
+	if payloadTemplate == "" {
+		payloadTemplate = DEFAULT_WEBHOOK_TEMPLATE
+	}
+	tmpl, err := ParseTemplate("webhook", payloadTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("webhook template: %w", err)
+	}
+	return &Webhook{
+		URL:         url,
+		ContentType: "application/json",
+		Template:    tmpl,
+		HTTPClient:  &http.Client{Timeout: DELIVERY_TIMEOUT},
+	}, nil
+}
+
+func (w *Webhook) Send(ctx context.Context, event Event) error {
+	payload, err := render(w.Template, event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, strings.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.ContentType)
+
+	resp, err := w.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *Webhook) String() string {
+	return "webhook " + w.URL
+}
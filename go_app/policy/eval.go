@@ -0,0 +1,612 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// Variables visible to an expression, innermost first
+type scope struct {
+	name   string
+	value  interface{}
+	vars   map[string]interface{}
+	parent *scope
+}
+
+func (s *scope) lookup(name string) (interface{}, bool) {
+	for ; s != nil; s = s.parent {
+		if s.vars == nil && s.name == name {
+			return s.value, true
+		}
+		if value, ok := s.vars[name]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+type node interface {
+	eval(s *scope) (interface{}, error)
+}
+
+type literal struct{ value interface{} }
+
+func (n literal) eval(*scope) (interface{}, error) { return n.value, nil }
+
+type variable string
+
+func (n variable) eval(s *scope) (interface{}, error) {
+	if value, ok := s.lookup(string(n)); ok {
+		return value, nil
+	}
+	return nil, fmt.Errorf("undeclared reference to %q", string(n))
+}
+
+type selectField struct {
+	target node
+	field  string
+}
+
+func (n *selectField) eval(s *scope) (interface{}, error) {
+	target, err := n.target.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	object, ok := target.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot select %q from %s", n.field, typeName(target))
+	}
+	value, ok := object[n.field]
+	if !ok {
+		return nil, fmt.Errorf("no such key: %s", n.field)
+	}
+	return value, nil
+}
+
+type indexOp struct {
+	target, index node
+}
+
+func (n *indexOp) eval(s *scope) (interface{}, error) {
+	target, err := n.target.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	index, err := n.index.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch target := target.(type) {
+	case map[string]interface{}:
+		key, ok := index.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys are strings, not %s", typeName(index))
+		}
+		value, ok := target[key]
+		if !ok {
+			return nil, fmt.Errorf("no such key: %s", key)
+		}
+		return value, nil
+	case []interface{}:
+		i, ok := toInt(index)
+		if !ok || i < 0 || i >= int64(len(target)) {
+			return nil, fmt.Errorf("index %v out of range", index)
+		}
+		return target[i], nil
+	}
+	return nil, fmt.Errorf("cannot index %s", typeName(target))
+}
+
+type unaryOp struct {
+	operator string
+	operand  node
+}
+
+func (n *unaryOp) eval(s *scope) (interface{}, error) {
+	value, err := n.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch value := value.(type) {
+	case bool:
+		if n.operator == "!" {
+			return !value, nil
+		}
+	case int64:
+		if n.operator == "-" {
+			if value == math.MinInt64 {
+				return nil, errIntOverflow
+			}
+			return -value, nil
+		}
+	case float64:
+		if n.operator == "-" {
+			return -value, nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s%s", n.operator, typeName(value))
+}
+
+// && and || with CEL's error absorption: false && error is false and true || error is
+// true, whichever side the error is on
+type logical struct {
+	or          bool
+	left, right node
+}
+
+func (n *logical) eval(s *scope) (interface{}, error) {
+	left, leftErr := n.boolean(n.left, s)
+	if leftErr == nil && left == n.or {
+		return left, nil
+	}
+	right, rightErr := n.boolean(n.right, s)
+	if rightErr == nil && right == n.or {
+		return right, nil
+	}
+	if leftErr != nil {
+		return nil, leftErr
+	}
+	return right, rightErr
+}
+
+func (n *logical) boolean(operand node, s *scope) (bool, error) {
+	value, err := operand.eval(s)
+	if err != nil {
+		return false, err
+	}
+	b, ok := value.(bool)
+	if !ok {
+		return false, fmt.Errorf("no such overload: %s with %s", map[bool]string{true: "||", false: "&&"}[n.or], typeName(value))
+	}
+	return b, nil
+}
+
+type conditional struct {
+	condition, then, otherwise node
+}
+
+func (n *conditional) eval(s *scope) (interface{}, error) {
+	condition, err := n.condition.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := condition.(bool)
+	if !ok {
+		return nil, fmt.Errorf("condition is %s, not bool", typeName(condition))
+	}
+	if b {
+		return n.then.eval(s)
+	}
+	return n.otherwise.eval(s)
+}
+
+type listLiteral struct{ items []node }
+
+func (n *listLiteral) eval(s *scope) (interface{}, error) {
+	list := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		value, err := item.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		list[i] = value
+	}
+	return list, nil
+}
+
+type mapLiteral struct{ keys, values []node }
+
+func (n *mapLiteral) eval(s *scope) (interface{}, error) {
+	m := make(map[string]interface{}, len(n.keys))
+	for i := range n.keys {
+		key, err := n.keys[i].eval(s)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("map keys are strings, not %s", typeName(key))
+		}
+		if m[name], err = n.values[i].eval(s); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+type binaryOp struct {
+	operator    string
+	left, right node
+}
+
+func (n *binaryOp) eval(s *scope) (interface{}, error) {
+	left, err := n.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	right, err := n.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch n.operator {
+	case "==":
+		return equal(left, right), nil
+	case "!=":
+		return !equal(left, right), nil
+	case "in":
+		switch container := right.(type) {
+		case []interface{}:
+			for _, item := range container {
+				if equal(left, item) {
+					return true, nil
+				}
+			}
+			return false, nil
+		case map[string]interface{}:
+			key, ok := left.(string)
+			_, found := container[key]
+			return ok && found, nil
+		}
+		return nil, fmt.Errorf("no such overload: %s in %s", typeName(left), typeName(right))
+	case "<", "<=", ">", ">=":
+		order, ok := compare(left, right)
+		if !ok {
+			return nil, fmt.Errorf("no such overload: %s %s %s", typeName(left), n.operator, typeName(right))
+		}
+		switch n.operator {
+		case "<":
+			return order < 0, nil
+		case "<=":
+			return order <= 0, nil
+		case ">":
+			return order > 0, nil
+		}
+		return order >= 0, nil
+	}
+	return arithmeticOp(n.operator, left, right)
+}
+
+func arithmeticOp(operator string, left, right interface{}) (interface{}, error) {
+	if l, ok := left.(string); ok && operator == "+" {
+		if r, ok := right.(string); ok {
+			return l + r, nil
+		}
+	}
+	if l, ok := left.([]interface{}); ok && operator == "+" {
+		if r, ok := right.([]interface{}); ok {
+			return append(append([]interface{}{}, l...), r...), nil
+		}
+	}
+	l, lInt := left.(int64)
+	r, rInt := right.(int64)
+	if lInt && rInt {
+		return intOp(operator, l, r)
+	}
+	lf, lNum := toFloat(left)
+	rf, rNum := toFloat(right)
+	if lNum && rNum {
+		switch operator {
+		case "+":
+			return lf + rf, nil
+		case "-":
+			return lf - rf, nil
+		case "*":
+			return lf * rf, nil
+		case "/":
+			return lf / rf, nil
+		case "%":
+			return math.Mod(lf, rf), nil
+		}
+	}
+	return nil, fmt.Errorf("no such overload: %s %s %s", typeName(left), operator, typeName(right))
+}
+
+// Ints do not wrap around: like CEL, an operation whose result does not fit is an error
+var errIntOverflow = errors.New("integer overflow")
+
+func intOp(operator string, l, r int64) (interface{}, error) {
+	switch operator {
+	case "+":
+		if r > 0 && l > math.MaxInt64-r || r < 0 && l < math.MinInt64-r {
+			return nil, errIntOverflow
+		}
+		return l + r, nil
+	case "-":
+		if r < 0 && l > math.MaxInt64+r || r > 0 && l < math.MinInt64+r {
+			return nil, errIntOverflow
+		}
+		return l - r, nil
+	case "*":
+		product := l * r
+		if l != 0 && (product/l != r || l == -1 && r == math.MinInt64 || r == -1 && l == math.MinInt64) {
+			return nil, errIntOverflow
+		}
+		return product, nil
+	case "/", "%":
+		if r == 0 {
+			return nil, fmt.Errorf("division by zero")
+		}
+		if l == math.MinInt64 && r == -1 {
+			if operator == "%" {
+				return int64(0), nil
+			}
+			return nil, errIntOverflow
+		}
+		if operator == "/" {
+			return l / r, nil
+		}
+		return l % r, nil
+	}
+	return nil, fmt.Errorf("no such overload: int %s int", operator)
+}
+
+// A function or method call. Macros (has, exists, all) get their arguments unevaluated.
+type call struct {
+	name   string
+	target node // receiver of a method call, nil for functions
+	args   []node
+}
+
+// Arity of the functions, with the receiver counted for methods
+var functions = map[string]int{
+	"size": 1, "int": 1, "double": 1, "string": 1, "has": 1,
+	"startsWith": 2, "endsWith": 2, "contains": 2, "matches": 2, "lowerAscii": 1, "upperAscii": 1,
+	"exists": 3, "all": 3,
+}
+
+func newCall(name token, target node, args []node) (node, error) {
+	arity, ok := functions[name.text]
+	if !ok {
+		return nil, &SyntaxError{Message: fmt.Sprintf("unknown function %q", name.text), Offset: name.offset}
+	}
+	given := len(args)
+	if target != nil {
+		given++
+	}
+	if given != arity {
+		return nil, &SyntaxError{Message: fmt.Sprintf("%s takes %d arguments", name.text, arity), Offset: name.offset}
+	}
+	switch name.text {
+	case "has":
+		if _, ok := args[0].(*selectField); !ok || target != nil {
+			return nil, &SyntaxError{Message: "has() takes a field selection, e.g. has(claims.tenant)", Offset: name.offset}
+		}
+	case "exists", "all":
+		if _, ok := args[0].(variable); !ok || target == nil {
+			return nil, &SyntaxError{Message: name.text + "() is called on a list with a variable name, e.g. roles." + name.text + "(r, r == \"admin\")", Offset: name.offset}
+		}
+	}
+	// Receiver-style and function-style calls are the same, e.g. size(x) and x.size()
+	if target != nil {
+		args = append([]node{target}, args...)
+	}
+	return &call{name: name.text, args: args}, nil
+}
+
+func (n *call) eval(s *scope) (interface{}, error) {
+	switch n.name {
+	case "has":
+		field := n.args[0].(*selectField)
+		target, err := field.target.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		object, ok := target.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("has() on %s", typeName(target))
+		}
+		_, found := object[field.field]
+		return found, nil
+	case "exists", "all":
+		return n.quantify(s)
+	}
+
+	args := make([]interface{}, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	switch n.name {
+	case "size":
+		switch value := args[0].(type) {
+		case string:
+			return int64(utf8.RuneCountInString(value)), nil
+		case []interface{}:
+			return int64(len(value)), nil
+		case map[string]interface{}:
+			return int64(len(value)), nil
+		}
+	case "int":
+		if i, ok := toInt(args[0]); ok {
+			return i, nil
+		}
+		// Doubles are truncated; those beyond the int range have no int value
+		if f, ok := args[0].(float64); ok {
+			if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+				return nil, errIntOverflow
+			}
+			return int64(f), nil
+		}
+	case "double":
+		if f, ok := toFloat(args[0]); ok {
+			return f, nil
+		}
+	case "string":
+		switch value := args[0].(type) {
+		case string:
+			return value, nil
+		case int64, float64, bool:
+			return fmt.Sprint(value), nil
+		}
+	case "lowerAscii", "upperAscii":
+		if value, ok := args[0].(string); ok {
+			if n.name == "lowerAscii" {
+				return strings.ToLower(value), nil
+			}
+			return strings.ToUpper(value), nil
+		}
+	default:
+		text, ok := args[0].(string)
+		arg, argOK := args[1].(string)
+		if !ok || !argOK {
+			break
+		}
+		switch n.name {
+		case "startsWith":
+			return strings.HasPrefix(text, arg), nil
+		case "endsWith":
+			return strings.HasSuffix(text, arg), nil
+		case "contains":
+			return strings.Contains(text, arg), nil
+		case "matches":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			return re.MatchString(text), nil
+		}
+	}
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = typeName(arg)
+	}
+	return nil, fmt.Errorf("no such overload: %s(%s)", n.name, strings.Join(types, ", "))
+}
+
+// list.exists(x, predicate) and list.all(x, predicate), also over map keys
+func (n *call) quantify(s *scope) (interface{}, error) {
+	target, err := n.args[0].eval(s)
+	if err != nil {
+		return nil, err
+	}
+	var items []interface{}
+	switch target := target.(type) {
+	case []interface{}:
+		items = target
+	case map[string]interface{}:
+		for key := range target {
+			items = append(items, key)
+		}
+	default:
+		return nil, fmt.Errorf("no such overload: %s.%s", typeName(target), n.name)
+	}
+	name := string(n.args[1].(variable))
+	wanted := n.name == "exists"
+	for _, item := range items {
+		value, err := n.args[2].eval(&scope{name: name, value: item, parent: s})
+		if err != nil {
+			return nil, err
+		}
+		b, ok := value.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s() predicate is %s, not bool", n.name, typeName(value))
+		}
+		if b == wanted {
+			return wanted, nil
+		}
+	}
+	return !wanted, nil
+}
+
+func equal(left, right interface{}) bool {
+	if l, ok := toFloat(left); ok {
+		r, ok := toFloat(right)
+		return ok && l == r
+	}
+	switch l := left.(type) {
+	case []interface{}:
+		r, ok := right.([]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for i := range l {
+			if !equal(l[i], r[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		r, ok := right.(map[string]interface{})
+		if !ok || len(l) != len(r) {
+			return false
+		}
+		for key, value := range l {
+			if other, found := r[key]; !found || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	}
+	return left == right
+}
+
+// -1, 0 or 1 for numbers and strings
+func compare(left, right interface{}) (int, bool) {
+	if l, ok := toFloat(left); ok {
+		r, ok := toFloat(right)
+		switch {
+		case !ok:
+			return 0, false
+		case l < r:
+			return -1, true
+		case l > r:
+			return 1, true
+		}
+		return 0, true
+	}
+	l, lOK := left.(string)
+	r, rOK := right.(string)
+	if !lOK || !rOK {
+		return 0, false
+	}
+	return strings.Compare(l, r), true
+}
+
+func toInt(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return value, true
+	case float64:
+		if value == math.Trunc(value) && value >= math.MinInt64 && value < math.MaxInt64 {
+			return int64(value), true
+		}
+	}
+	return 0, false
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return float64(value), true
+	case float64:
+		return value, true
+	}
+	return 0, false
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "bool"
+	case int64:
+		return "int"
+	case float64:
+		return "double"
+	case string:
+		return "string"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "map"
+	}
+	return fmt.Sprintf("%T", value)
+}
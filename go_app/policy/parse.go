@@ -0,0 +1,407 @@
+package policy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// A syntax error with its offset in the expression
+type SyntaxError struct {
+	Message string
+	Offset  int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("policy: %s at offset %d", e.Message, e.Offset)
+}
+
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenInt
+	tokenFloat
+	tokenString
+	tokenPunct
+)
+
+type token struct {
+	kind   int
+	text   string // identifier, punctuator or the decoded string
+	offset int
+}
+
+// Multi-character punctuators, longest first
+var punctuators = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "+", "-", "*", "/", "%", "?", ":", ".", ",", "(", ")", "[", "]", "{", "}"}
+
+func tokenize(source string) ([]token, error) {
+	var tokens []token
+	for pos := 0; pos < len(source); {
+		c := source[pos]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			pos++
+		case c == '/' && strings.HasPrefix(source[pos:], "//"):
+			for pos < len(source) && source[pos] != '\n' {
+				pos++
+			}
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := pos
+			for pos < len(source) && (isIdentByte(source[pos])) {
+				pos++
+			}
+			tokens = append(tokens, token{tokenIdent, source[start:pos], start})
+		case c >= '0' && c <= '9':
+			start, kind := pos, tokenInt
+			for pos < len(source) && (isIdentByte(source[pos]) || source[pos] == '.' && kind == tokenInt && pos+1 < len(source) && source[pos+1] >= '0' && source[pos+1] <= '9') {
+				hex := pos > start+1 && (source[start+1] == 'x' || source[start+1] == 'X')
+				if source[pos] == '.' || !hex && (source[pos] == 'e' || source[pos] == 'E') {
+					kind = tokenFloat
+				}
+				pos++
+			}
+			tokens = append(tokens, token{kind, source[start:pos], start})
+		case c == '"' || c == '\'':
+			text, end, err := readString(source, pos)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{tokenString, text, pos})
+			pos = end
+		default:
+			matched := ""
+			for _, punctuator := range punctuators {
+				if strings.HasPrefix(source[pos:], punctuator) {
+					matched = punctuator
+					break
+				}
+			}
+			if matched == "" {
+				r, _ := utf8.DecodeRuneInString(source[pos:])
+				return nil, &SyntaxError{Message: fmt.Sprintf("unexpected character %q", r), Offset: pos}
+			}
+			tokens = append(tokens, token{tokenPunct, matched, pos})
+			pos += len(matched)
+		}
+	}
+	return append(tokens, token{tokenEOF, "", len(source)}), nil
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Reads the quoted string starting at start and returns it with the offset after it
+func readString(source string, start int) (string, int, error) {
+	quote := source[start]
+	var b strings.Builder
+	for pos := start + 1; pos < len(source); {
+		c := source[pos]
+		switch {
+		case c == quote:
+			return b.String(), pos + 1, nil
+		case c == '\n':
+			return "", 0, &SyntaxError{Message: "unterminated string", Offset: start}
+		case c == '\\' && pos+1 < len(source):
+			switch escaped := source[pos+1]; escaped {
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			case 'r':
+				b.WriteByte('\r')
+			case '\\', '"', '\'':
+				b.WriteByte(escaped)
+			default:
+				return "", 0, &SyntaxError{Message: fmt.Sprintf("invalid escape \\%c", escaped), Offset: pos}
+			}
+			pos += 2
+		default:
+			b.WriteByte(c)
+			pos++
+		}
+	}
+	return "", 0, &SyntaxError{Message: "unterminated string", Offset: start}
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// Consumes the punctuator or keyword text if it comes next
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokenPunct || t.kind == tokenIdent) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected("expected " + strconv.Quote(text))
+	}
+	return nil
+}
+
+func (p *parser) unexpected(message string) error {
+	t := p.peek()
+	found := strconv.Quote(t.text)
+	if t.kind == tokenEOF {
+		found = "end of expression"
+	}
+	return &SyntaxError{Message: message + ", found " + found, Offset: t.offset}
+}
+
+// expr := or ("?" expr ":" expr)?
+func (p *parser) expression() (node, error) {
+	condition, err := p.or()
+	if err != nil || !p.accept("?") {
+		return condition, err
+	}
+	then, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	otherwise, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	return &conditional{condition, then, otherwise}, nil
+}
+
+func (p *parser) or() (node, error) {
+	left, err := p.and()
+	for err == nil && p.accept("||") {
+		var right node
+		if right, err = p.and(); err == nil {
+			left = &logical{or: true, left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) and() (node, error) {
+	left, err := p.relation()
+	for err == nil && p.accept("&&") {
+		var right node
+		if right, err = p.relation(); err == nil {
+			left = &logical{left: left, right: right}
+		}
+	}
+	return left, err
+}
+
+// relation := sum (("==" | "!=" | "<" | "<=" | ">" | ">=" | "in") sum)*, left associative
+func (p *parser) relation() (node, error) {
+	left, err := p.binary(1)
+	for err == nil {
+		operator := ""
+		for _, candidate := range []string{"==", "!=", "<=", ">=", "<", ">", "in"} {
+			if p.accept(candidate) {
+				operator = candidate
+				break
+			}
+		}
+		if operator == "" {
+			break
+		}
+		var right node
+		if right, err = p.binary(1); err == nil {
+			left = &binaryOp{operator, left, right}
+		}
+	}
+	return left, err
+}
+
+// Arithmetic operators by precedence level, lowest first
+var arithmetic = [][]string{1: {"+", "-"}, 2: {"*", "/", "%"}}
+
+func (p *parser) binary(level int) (node, error) {
+	if level == len(arithmetic) {
+		return p.unary()
+	}
+	left, err := p.binary(level + 1)
+	for err == nil {
+		operator := ""
+		for _, candidate := range arithmetic[level] {
+			if p.peek().kind == tokenPunct && p.peek().text == candidate {
+				operator = candidate
+			}
+		}
+		if operator == "" {
+			break
+		}
+		p.next()
+		var right node
+		if right, err = p.binary(level + 1); err == nil {
+			left = &binaryOp{operator, left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *parser) unary() (node, error) {
+	for _, operator := range []string{"!", "-"} {
+		if p.accept(operator) {
+			operand, err := p.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &unaryOp{operator, operand}, nil
+		}
+	}
+	return p.member()
+}
+
+// member := primary ("." ident ("(" args ")")? | "[" expr "]")*
+func (p *parser) member() (node, error) {
+	target, err := p.primary()
+	for err == nil {
+		switch {
+		case p.accept("."):
+			name := p.next()
+			if name.kind != tokenIdent {
+				return nil, &SyntaxError{Message: "expected a field name after \".\"", Offset: name.offset}
+			}
+			if p.accept("(") {
+				var args []node
+				if args, err = p.arguments(")"); err == nil {
+					target, err = newCall(name, target, args)
+				}
+			} else {
+				target = &selectField{target, name.text}
+			}
+		case p.accept("["):
+			var index node
+			if index, err = p.expression(); err == nil {
+				if err = p.expect("]"); err == nil {
+					target = &indexOp{target, index}
+				}
+			}
+		default:
+			return target, nil
+		}
+	}
+	return nil, err
+}
+
+// Comma separated expressions up to the closing punctuator
+func (p *parser) arguments(closing string) ([]node, error) {
+	var args []node
+	for !p.accept(closing) {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			// A trailing comma is allowed in lists
+			if p.accept(closing) {
+				break
+			}
+		}
+		arg, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+func (p *parser) primary() (node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenInt:
+		value, err := strconv.ParseInt(t.text, 0, 64)
+		if err != nil {
+			return nil, &SyntaxError{Message: "invalid number " + t.text, Offset: t.offset}
+		}
+		return literal{value}, nil
+	case tokenFloat:
+		value, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, &SyntaxError{Message: "invalid number " + t.text, Offset: t.offset}
+		}
+		return literal{value}, nil
+	case tokenString:
+		return literal{t.text}, nil
+	case tokenIdent:
+		switch t.text {
+		case "true", "false":
+			return literal{t.text == "true"}, nil
+		case "null":
+			return literal{nil}, nil
+		}
+		if p.accept("(") {
+			args, err := p.arguments(")")
+			if err != nil {
+				return nil, err
+			}
+			return newCall(t, nil, args)
+		}
+		return variable(t.text), nil
+	case tokenPunct:
+		switch t.text {
+		case "(":
+			inner, err := p.expression()
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case "[":
+			items, err := p.arguments("]")
+			return &listLiteral{items}, err
+		case "{":
+			return p.mapLiteral()
+		}
+	}
+	// Step back so the error names the token; next does not move past the end
+	if t.kind != tokenEOF {
+		p.pos--
+	}
+	return nil, p.unexpected("expected a value")
+}
+
+func (p *parser) mapLiteral() (node, error) {
+	m := &mapLiteral{}
+	for !p.accept("}") {
+		if len(m.keys) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+			if p.accept("}") {
+				break
+			}
+		}
+		key, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		value, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		m.keys, m.values = append(m.keys, key), append(m.values, value)
+	}
+	return m, nil
+}
@@ -0,0 +1,67 @@
+// Package policy evaluates authorization rules written in a subset of CEL, the Common
+// Expression Language, e.g.
+//
+//	"admin" in user.roles || (user.tenant == "acme" && time.hour >= 8 && time.hour < 18)
+//
+// Supported are literals (int, double, string, bool, null, lists and maps), field
+// selection and indexing, the arithmetic, comparison, logical and conditional
+// operators, "in", and the functions size, has, int, double, string, startsWith,
+// endsWith, contains, matches, lowerAscii, upperAscii and the exists and all macros.
+// Timestamps, durations and protobuf messages are not. Expressions run against
+// variables of JSON-like values: maps with string keys, []interface{}, string, bool,
+// int64 or float64 and nil.
+package policy
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A compiled expression
+type Program struct {
+	source string
+	root   node
+}
+
+func Compile(source string) (*Program, error) {
+	tokens, err := tokenize(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	root, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenEOF {
+		return nil, p.unexpected("expected end of expression")
+	}
+	return &Program{source: source, root: root}, nil
+}
+
+func (p *Program) String() string {
+	return p.source
+}
+
+// Evaluates the expression. A reference to a missing variable or key is an error
+// unless && or || decide the result without it.
+func (p *Program) Eval(vars map[string]interface{}) (interface{}, error) {
+	value, err := p.root.eval(&scope{vars: vars})
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	return value, nil
+}
+
+// Evaluates an expression that must produce a bool
+func (p *Program) Allow(vars map[string]interface{}) (bool, error) {
+	value, err := p.Eval(vars)
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := value.(bool)
+	if !ok {
+		return false, errors.New("policy: expression is " + typeName(value) + ", not bool")
+	}
+	return allowed, nil
+}
@@ -0,0 +1,264 @@
+package policy
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testVars = map[string]interface{}{
+	"user": map[string]interface{}{
+		"name":   "Alice",
+		"roles":  []interface{}{"reader", "admin"},
+		"tenant": "acme",
+		"age":    int64(42),
+		"quota":  1.5,
+		"labels": map[string]interface{}{"team": "core"},
+	},
+	"time":  map[string]interface{}{"hour": int64(9)},
+	"empty": []interface{}{},
+}
+
+func TestEval(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		want       interface{}
+	}{
+		// Precedence, loosest to tightest: ?:, ||, &&, relations, + -, * / %, unary
+		{"multiplication before addition", "1 + 2 * 3", int64(7)},
+		{"parentheses", "(1 + 2) * 3", int64(9)},
+		{"left associative subtraction", "10 - 4 - 3", int64(3)},
+		{"left associative division", "100 / 10 / 5", int64(2)},
+		{"modulo with multiplication", "7 % 4 * 2", int64(6)},
+		{"unary minus before multiplication", "-2 * 3", int64(-6)},
+		{"double negation", "!!true", true},
+		{"not before and", "!false && false", false},
+		{"and before or", "true || false && false", true},
+		{"and before or, reordered", "false && true || true", true},
+		{"relation before and", "1 < 2 && 2 < 3", true},
+		{"arithmetic before relation", "1 + 1 == 2", true},
+		{"relations chain left to right", "1 < 2 == true", true},
+		{"conditional loosest", "true ? 1 : 2 + 10", int64(1)},
+		{"conditional after or", "false || true ? 'yes' : 'no'", "yes"},
+		{"nested conditional", "false ? 1 : true ? 2 : 3", int64(2)},
+		{"selection before unary", "-user.age", int64(-42)},
+		{"in before and", "'admin' in user.roles && user.tenant == 'acme'", true},
+
+		// Types
+		{"int division truncates", "7 / 2", int64(3)},
+		{"double division", "7.0 / 2", 3.5},
+		{"int and double mix", "1 + 0.5", 1.5},
+		{"hex int", "0x1F", int64(31)},
+		{"exponent", "1e3", 1000.0},
+		{"int equals double", "1 == 1.0", true},
+		{"string concatenation", "'a' + \"b\"", "ab"},
+		{"string escapes", `'it\'s\n' == "it's\n"`, true},
+		{"string ordering", "'apple' < 'banana'", true},
+		{"list concatenation", "[1] + [2, 3]", []interface{}{int64(1), int64(2), int64(3)}},
+		{"list equality", "[1, [2]] == [1, [2.0]]", true},
+		{"map literal", "{'a': 1, 'b': [true]}", map[string]interface{}{"a": int64(1), "b": []interface{}{true}}},
+		{"map equality ignores order", "{'a': 1, 'b': 2} == {'b': 2, 'a': 1}", true},
+		{"null", "null == null", true},
+		{"different types are unequal", "'1' == 1", false},
+		{"bool is not int", "true != 1", true},
+		{"trailing comma", "[1, 2,].size()", int64(2)},
+
+		// Selection, indexing and membership
+		{"nested selection", "user.labels.team", "core"},
+		{"map index", "user['tenant']", "acme"},
+		{"list index", "user.roles[1]", "admin"},
+		{"integral double index", "user.roles[1.0]", "admin"},
+		{"in list", "'reader' in user.roles", true},
+		{"not in list", "'owner' in user.roles", false},
+		{"in map checks keys", "'team' in user.labels", true},
+		{"int in list of doubles", "2 in [1.0, 2.0]", true},
+
+		// Functions and macros
+		{"size of string counts runes", "size('héllo')", int64(5)},
+		{"size method", "user.roles.size()", int64(2)},
+		{"size of map", "size(user.labels)", int64(1)},
+		{"has present", "has(user.tenant)", true},
+		{"has absent", "has(user.missing)", false},
+		{"int of double truncates", "int(-2.7)", int64(-2)},
+		{"int of int", "int(3)", int64(3)},
+		{"double of int", "double(3)", 3.0},
+		{"string of int", "string(42)", "42"},
+		{"string of bool", "string(true)", "true"},
+		{"startsWith", "user.name.startsWith('Al')", true},
+		{"endsWith", "endsWith(user.name, 'ce')", true},
+		{"contains", "user.name.contains('lic')", true},
+		{"matches", "user.name.matches('^A[a-z]+$')", true},
+		{"lowerAscii", "user.name.lowerAscii()", "alice"},
+		{"upperAscii", "user.tenant.upperAscii()", "ACME"},
+		{"exists", "user.roles.exists(r, r == 'admin')", true},
+		{"exists on empty list", "empty.exists(x, x == 1)", false},
+		{"all", "[1, 2, 3].all(x, x > 0)", true},
+		{"all fails", "[1, -2, 3].all(x, x > 0)", false},
+		{"all on empty list", "empty.all(x, false)", true},
+		{"exists over map keys", "user.labels.exists(k, k == 'team')", true},
+		{"macro variable shadows", "[1].exists(user, user == 1)", true},
+		{"macro sees outer variables", "[9].exists(h, h == time.hour)", true},
+
+		// CEL error absorption: && and || ignore an error the other side decides
+		{"false and error", "false && user.missing", false},
+		{"error and false", "user.missing && false", false},
+		{"true or error", "true || undefined", true},
+		{"error or true", "undefined || true", true},
+		{"type error absorbed", "1 || true", true},
+		{"untaken branch not evaluated", "true ? 1 : undefined", int64(1)},
+
+		// Comments
+		{"comment", "1 + // one more\n1", int64(2)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := Compile(test.expression)
+			if err != nil {
+				t.Fatalf("Compile(%q): %v", test.expression, err)
+			}
+			got, err := program.Eval(testVars)
+			if err != nil {
+				t.Fatalf("Eval(%q): %v", test.expression, err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("Eval(%q) = %#v, want %#v", test.expression, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		err        string
+	}{
+		{"undeclared variable", "missing", `undeclared reference to "missing"`},
+		{"missing key", "user.missing", "no such key: missing"},
+		{"missing index key", "user['missing']", "no such key: missing"},
+		{"select on scalar", "user.age.value", `cannot select "value" from int`},
+		{"index out of range", "user.roles[2]", "index 2 out of range"},
+		{"negative index", "user.roles[-1]", "index -1 out of range"},
+		{"fractional index", "user.roles[0.5]", "index 0.5 out of range"},
+		{"non-string map key", "user.labels[1]", "map keys are strings, not int"},
+		{"index on scalar", "true[0]", "cannot index bool"},
+		{"int division by zero", "1 / 0", "division by zero"},
+		{"int modulo by zero", "1 % 0", "division by zero"},
+		{"addition overflow", "9223372036854775807 + 1", "integer overflow"},
+		{"subtraction overflow", "-9223372036854775807 - 2", "integer overflow"},
+		{"multiplication overflow", "4611686018427387904 * 2", "integer overflow"},
+		{"negation overflow", "-(-9223372036854775807 - 1)", "integer overflow"},
+		{"division overflow", "(-9223372036854775807 - 1) / -1", "integer overflow"},
+		{"int of huge double", "int(1e19)", "integer overflow"},
+		{"infinite index", "user.roles[1.0 / 0.0]", "index +Inf out of range"},
+		{"string plus int", "'a' + 1", "no such overload: string + int"},
+		{"bool arithmetic", "true * 2", "no such overload: bool * int"},
+		{"negated string", "-'a'", "no such overload: -string"},
+		{"not of int", "!1", "no such overload: !int"},
+		{"compare string and int", "'a' < 1", "no such overload: string < int"},
+		{"compare bools", "true < false", "no such overload: bool < bool"},
+		{"in scalar", "1 in 2", "no such overload: int in int"},
+		{"and with non-bool", "true && 1", "no such overload: && with int"},
+		{"both sides fail", "undefined || user.missing", `undeclared reference to "undefined"`},
+		{"condition not bool", "1 ? 2 : 3", "condition is int, not bool"},
+		{"size of int", "size(1)", "no such overload: size(int)"},
+		{"startsWith on int", "startsWith(1, 'a')", "no such overload: startsWith(int, string)"},
+		{"invalid regexp", "'a'.matches('[')", "missing closing ]"},
+		{"has on scalar", "has(user.age.value)", "has() on int"},
+		{"exists on scalar", "user.age.exists(x, true)", "no such overload: int.exists"},
+		{"predicate not bool", "[1].all(x, x)", "all() predicate is int, not bool"},
+		{"map key not string", "{1: 2}", "map keys are strings, not int"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := Compile(test.expression)
+			if err != nil {
+				t.Fatalf("Compile(%q): %v", test.expression, err)
+			}
+			got, err := program.Eval(testVars)
+			if err == nil {
+				t.Fatalf("Eval(%q) = %#v, want an error", test.expression, got)
+			}
+			if !strings.HasPrefix(err.Error(), "policy: ") || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Eval(%q) error = %q, want %q", test.expression, err, test.err)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+		message    string
+		offset     int
+	}{
+		{"empty", "", "expected a value, found end of expression", 0},
+		{"only whitespace", "   ", "expected a value, found end of expression", 3},
+		{"missing operand", "1 +", "expected a value, found end of expression", 3},
+		{"missing operand mid expression", "1 + * 2", `expected a value, found "*"`, 4},
+		{"trailing tokens", "1 2", `expected end of expression, found "2"`, 2},
+		{"unclosed parenthesis", "(1 + 2", `expected ")", found end of expression`, 6},
+		{"unclosed index", "user.roles[0", `expected "]", found end of expression`, 12},
+		{"conditional without else", "true ? 1", `expected ":", found end of expression`, 8},
+		{"missing list comma", "[1 2]", `expected ",", found "2"`, 3},
+		{"missing map colon", "{'a' 1}", `expected ":", found "1"`, 5},
+		{"field name after dot", "user.1", `expected a field name after "."`, 5},
+		{"unexpected character", "1 # 2", "unexpected character '#'", 2},
+		{"non-ASCII character", "1 ≠ 2", "unexpected character '≠'", 2},
+		{"unterminated string", "'abc", "unterminated string", 0},
+		{"newline in string", "'a\nb'", "unterminated string", 0},
+		{"invalid escape", `'\q'`, `invalid escape \q`, 1},
+		{"int out of range", "9223372036854775808", "invalid number 9223372036854775808", 0},
+		{"malformed number", "1abc", "invalid number 1abc", 0},
+		{"unknown function", "now()", `unknown function "now"`, 0},
+		{"wrong arity", "size(1, 2)", "size takes 1 arguments", 0},
+		{"wrong method arity", "'a'.startsWith()", "startsWith takes 2 arguments", 4},
+		{"has without selection", "has(user)", "has() takes a field selection", 0},
+		{"exists without variable", "user.roles.exists('r', true)", "exists() is called on a list with a variable name", 11},
+		{"all as a function", "all(x, true)", "all takes 3 arguments", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			program, err := Compile(test.expression)
+			var syntaxErr *SyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Fatalf("Compile(%q) = %v, %v, want a syntax error", test.expression, program, err)
+			}
+			if !strings.HasPrefix(syntaxErr.Message, test.message) || syntaxErr.Offset != test.offset {
+				t.Errorf("Compile(%q) error = %q at %d, want %q at %d", test.expression, syntaxErr.Message, syntaxErr.Offset, test.message, test.offset)
+			}
+		})
+	}
+}
+
+func TestAllow(t *testing.T) {
+	program, err := Compile(`"admin" in user.roles || (user.tenant == "acme" && time.hour >= 8 && time.hour < 18)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if allowed, err := program.Allow(testVars); !allowed || err != nil {
+		t.Errorf("Allow() = %v, %v, want true", allowed, err)
+	}
+
+	outsider := map[string]interface{}{
+		"user": map[string]interface{}{"roles": []interface{}{}, "tenant": "other"},
+		"time": map[string]interface{}{"hour": int64(22)},
+	}
+	if allowed, err := program.Allow(outsider); allowed || err != nil {
+		t.Errorf("Allow() = %v, %v, want false", allowed, err)
+	}
+
+	// Not a bool, or no value at all, is never an allow
+	for _, expression := range []string{"1", "user.missing"} {
+		program, err := Compile(expression)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allowed, err := program.Allow(testVars); allowed || err == nil {
+			t.Errorf("Allow(%q) = %v, %v, want false with an error", expression, allowed, err)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+// Package redis is a small client of the Redis protocol (RESP2), enough for the
+// scaffolding's own uses of Redis: distributed locks and server-side sessions.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An error reply of the server, e.g. "NOSCRIPT ..." or "WRONGPASS ..."
+type Error string
+
+func (e Error) Error() string { return "redis: " + string(e) }
+
+// A RESP2 client on one connection, which is redialed after errors. Commands are
+// serialized, which suits light traffic such as locks and sessions.
+type Client struct {
+	address  string
+	tls      *tls.Config
+	username string
+	password string
+	database int
+	timeout  time.Duration
+
+	mutex  sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// A client of a redis:// or rediss:// (TLS) URL with an optional password and database
+// number, e.g. redis://:secret@localhost:6379/2. It connects on the first command;
+// timeout bounds each command.
+func New(rawURL string, timeout time.Duration) (*Client, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("redis url: %w", err)
+	}
+	client := &Client{address: parsed.Host, timeout: timeout}
+	switch parsed.Scheme {
+	case "redis":
+	case "rediss":
+		client.tls = &tls.Config{ServerName: parsed.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("redis url: unsupported scheme %q", parsed.Scheme)
+	}
+	if parsed.Port() == "" {
+		client.address = net.JoinHostPort(parsed.Hostname(), "6379")
+	}
+	if parsed.User != nil {
+		client.username = parsed.User.Username()
+		client.password, _ = parsed.User.Password()
+	}
+	if database := strings.Trim(parsed.Path, "/"); database != "" {
+		if client.database, err = strconv.Atoi(database); err != nil {
+			return nil, fmt.Errorf("redis url: database %q is not a number", database)
+		}
+	}
+	return client, nil
+}
+
+// Sends one command and reads its reply: a string, int64, []interface{}, nil or an
+// Error. Error replies are also returned as the error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		if err := c.dial(ctx); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := c.roundTrip(ctx, args)
+	var serverError Error
+	if err != nil && !errors.As(err, &serverError) {
+		// The connection is in an unknown state, with a reply possibly still on the way
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *Client) dial(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: c.timeout}
+	var conn net.Conn
+	var err error
+	if c.tls != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: c.tls}).DialContext(ctx, "tcp", c.address)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.address)
+	}
+	if err != nil {
+		return fmt.Errorf("redis: %w", err)
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+
+	var setup [][]string
+	switch {
+	case c.username != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.database != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.database)})
+	}
+	for _, command := range setup {
+		if _, err := c.roundTrip(ctx, command); err != nil {
+			conn.Close()
+			c.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) roundTrip(ctx context.Context, args []string) (interface{}, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok || c.timeout > 0 && time.Until(deadline) > c.timeout {
+		deadline = time.Now().Add(c.timeout)
+	}
+	c.conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	return readReply(c.reader)
+}
+
+func readReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed integer %q", body)
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("redis: %w", err)
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		elements := make([]interface{}, n)
+		for i := range elements {
+			// Errors inside an array, as from EXEC, are values rather than failures
+			element, err := readReply(r)
+			var serverError Error
+			if errors.As(err, &serverError) {
+				element, err = serverError, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = element
+		}
+		return elements, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
+
+// Pings the server, e.g. for a startup check
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.Do(ctx, "PING")
+	return err
+}
+
+func (c *Client) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
@@ -0,0 +1,343 @@
+// Package selfupdate replaces a running binary with the latest release from an
+// internal release endpoint. The endpoint serves a manifest naming the version, and the
+// binary and checksum of each platform, next to an Ed25519 signature of the manifest.
+// The signature is checked against a public key the caller trusts before anything in
+// the manifest is used, the download against its checksum, and only then is the binary
+// swapped in with a rename, so a failed or tampered update leaves the old binary in
+// place. As the version is signed too, an endpoint can't pass an older release off as
+// a newer one.
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Platform of the running binary, as manifests key their binaries
+const PLATFORM = runtime.GOOS + "/" + runtime.GOARCH
+
+// Limits of a fetch
+const (
+	FETCH_TIMEOUT      = 5 * time.Minute
+	MAX_MANIFEST_BYTES = 1 << 20
+	MAX_BINARY_BYTES   = 512 << 20
+)
+
+var (
+	// The manifest has no binary for the platform
+	ErrNoBinary = errors.New("selfupdate: no binary for this platform")
+	// The manifest isn't signed by the trusted key
+	ErrSignature = errors.New("selfupdate: manifest signature is invalid")
+	// The download doesn't match its signed checksum
+	ErrChecksum = errors.New("selfupdate: checksum mismatch")
+	// The release isn't newer than the running version
+	ErrNotNewer = errors.New("selfupdate: release is not newer than the running version")
+)
+
+// The manifest served at the release URL. Its Ed25519 signature, in base64, is served
+// at the same URL with ".sig" appended. Relative URLs are resolved against the
+// manifest's.
+//
+//	{
+//	  "version": "1.5.0",
+//	  "binaries": {
+//	    "linux/amd64": {"url": "scaffold-linux-amd64", "sha256": "9f86d0…"},
+//	    "darwin/arm64": {"url": "scaffold-darwin-arm64", "sha256": "60303a…"}
+//	  }
+//	}
+type Release struct {
+	Version  string            `json:"version"`
+	Binaries map[string]Binary `json:"binaries"` // by PLATFORM
+
+	// Set by Latest once the signature checked out
+	verified bool
+}
+
+type Binary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"` // hex
+}
+
+type Options struct {
+	// URL of the release manifest
+	URL string
+	// Key the manifest must be signed with, see ParsePublicKey
+	PublicKey ed25519.PublicKey
+	// Version of the running binary. Install refuses a release that isn't newer, see
+	// Newer. Empty when unknown, which any release is newer than.
+	Current string
+	// Install a release even if it isn't newer than Current
+	Force bool
+	// Defaults to a client with FETCH_TIMEOUT
+	HTTPClient *http.Client
+}
+
+type Updater struct {
+	options Options
+}
+
+func New(options Options) *Updater {
+	if options.HTTPClient == nil {
+		options.HTTPClient = &http.Client{Timeout: FETCH_TIMEOUT}
+	}
+	return &Updater{options: options}
+}
+
+// Reads an Ed25519 public key: 32 bytes in base64, or a PEM "PUBLIC KEY" block as
+// openssl writes it
+func ParsePublicKey(text string) (ed25519.PublicKey, error) {
+	text = strings.TrimSpace(text)
+	if block, _ := pem.Decode([]byte(text)); block != nil {
+		parsed, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("selfupdate: public key: %w", err)
+		}
+		key, ok := parsed.(ed25519.PublicKey)
+		if !ok {
+			return nil, errors.New("selfupdate: public key is not an Ed25519 key")
+		}
+		return key, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(text)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("selfupdate: public key must be %d bytes in base64 or PEM", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Fetches the manifest of the latest release and checks its signature. Nothing in a
+// manifest that isn't signed by the trusted key is returned, the version included.
+func (u *Updater) Latest(ctx context.Context) (*Release, error) {
+	if len(u.options.PublicKey) != ed25519.PublicKeySize {
+		return nil, errors.New("selfupdate: a public key is required")
+	}
+	body, err := u.get(ctx, u.options.URL, MAX_MANIFEST_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := u.get(ctx, signatureURL(u.options.URL), MAX_MANIFEST_BYTES)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil || !ed25519.Verify(u.options.PublicKey, body, decoded) {
+		return nil, ErrSignature
+	}
+
+	release := &Release{}
+	if err := json.Unmarshal(body, release); err != nil {
+		return nil, fmt.Errorf("selfupdate: manifest %s: %w", u.options.URL, err)
+	}
+	if release.Version == "" || len(release.Binaries) == 0 {
+		return nil, fmt.Errorf("selfupdate: manifest %s needs a version and binaries", u.options.URL)
+	}
+	release.verified = true
+	return release, nil
+}
+
+// Downloads the release's binary for PLATFORM, verifies it and replaces executable
+// with it. The release must come from Latest, and be newer than Options.Current unless
+// Options.Force is set. Nothing is replaced unless the binary matches its checksum.
+func (u *Updater) Install(ctx context.Context, release *Release, executable string) error {
+	if !release.verified {
+		return errors.New("selfupdate: release was not verified by Latest")
+	}
+	if !u.options.Force && !Newer(release.Version, u.options.Current) {
+		return fmt.Errorf("%w: %s, running %s", ErrNotNewer, release.Version, u.options.Current)
+	}
+	binary, ok := release.Binaries[PLATFORM]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoBinary, PLATFORM)
+	}
+	want, err := hex.DecodeString(binary.SHA256)
+	if err != nil || len(want) != sha256.Size {
+		return fmt.Errorf("selfupdate: malformed checksum for %s", PLATFORM)
+	}
+
+	target, err := filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return err
+	}
+	temp, err := u.download(ctx, binary.URL, filepath.Dir(target), want)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(temp, info.Mode().Perm()); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	if err := replace(target, temp); err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return nil
+}
+
+// Writes the binary at address to a temporary file next to the one it replaces, so
+// the final rename stays on one filesystem, and checks it against want
+func (u *Updater) download(ctx context.Context, address, dir string, want []byte) (string, error) {
+	response, err := u.open(ctx, address)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	temp, err := os.CreateTemp(dir, ".selfupdate-*")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(temp, hash), io.LimitReader(response.Body, MAX_BINARY_BYTES+1))
+	if err == nil && written > MAX_BINARY_BYTES {
+		err = fmt.Errorf("selfupdate: %s is larger than %d bytes", address, MAX_BINARY_BYTES)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && !bytes.Equal(hash.Sum(nil), want) {
+		err = ErrChecksum
+	}
+	if err != nil {
+		os.Remove(temp.Name())
+		return "", err
+	}
+	return temp.Name(), nil
+}
+
+// Moves temp over target. Windows won't rename over a running binary, but it lets one
+// be moved aside, so there the old one is kept as target.old.
+func replace(target, temp string) error {
+	if runtime.GOOS != "windows" {
+		return os.Rename(temp, target)
+	}
+	old := target + ".old"
+	os.Remove(old)
+	if err := os.Rename(target, old); err != nil {
+		return err
+	}
+	if err := os.Rename(temp, target); err != nil {
+		os.Rename(old, target)
+		return err
+	}
+	return nil
+}
+
+// Where the signature of the manifest at address is served: the same URL with ".sig"
+// appended to its path
+func signatureURL(address string) string {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return address + ".sig"
+	}
+	parsed.Path += ".sig"
+	parsed.RawPath = ""
+	return parsed.String()
+}
+
+func (u *Updater) resolve(reference string) (string, error) {
+	base, err := url.Parse(u.options.URL)
+	if err != nil {
+		return "", fmt.Errorf("selfupdate: release URL: %w", err)
+	}
+	ref, err := url.Parse(reference)
+	if err != nil {
+		return "", fmt.Errorf("selfupdate: %q: %w", reference, err)
+	}
+	return base.ResolveReference(ref).String(), nil
+}
+
+func (u *Updater) open(ctx context.Context, reference string) (*http.Response, error) {
+	address, err := u.resolve(reference)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := u.options.HTTPClient.Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("selfupdate: fetch %s: %w", address, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("selfupdate: fetch %s: status %d", address, response.StatusCode)
+	}
+	return response, nil
+}
+
+func (u *Updater) get(ctx context.Context, reference string, limit int64) ([]byte, error) {
+	response, err := u.open(ctx, reference)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("selfupdate: fetch %s: %w", reference, err)
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("selfupdate: %s is larger than %d bytes", reference, limit)
+	}
+	return body, nil
+}
+
+// Whether version is newer than current, comparing dot-separated numbers as
+// semantic versions do and ignoring a leading "v" and any pre-release suffix. An
+// unknown current version is older than any release.
+func Newer(version, current string) bool {
+	if current == "" {
+		return true
+	}
+	a, b := versionParts(version), versionParts(current)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		var x, y int
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(version, "v")
+	version, _, _ = strings.Cut(version, "-")
+	version, _, _ = strings.Cut(version, "+")
+	parts := []int{}
+	for _, part := range strings.Split(version, ".") {
+		n, _ := strconv.Atoi(part)
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -0,0 +1,232 @@
+package selfupdate
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	newBinary = []byte("#!/bin/sh\necho new\n")
+	oldBinary = []byte("#!/bin/sh\necho old\n")
+)
+
+// A release endpoint serving files by path
+func serve(t *testing.T, files map[string][]byte) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func manifest(t *testing.T, version string, binaries map[string]Binary) []byte {
+	t.Helper()
+	encoded, err := json.Marshal(map[string]any{"version": version, "binaries": binaries})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+func sign(key ed25519.PrivateKey, content []byte) []byte {
+	return []byte(base64.StdEncoding.EncodeToString(ed25519.Sign(key, content)) + "\n")
+}
+
+func sum(content []byte) string {
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:])
+}
+
+func TestUpdate(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := manifest(t, "1.5.0", map[string]Binary{PLATFORM: {URL: "scaffold", SHA256: sum(newBinary)}})
+	otherPlatform := manifest(t, "1.5.0", map[string]Binary{"plan9/mips": {URL: "scaffold", SHA256: sum(newBinary)}})
+
+	tests := []struct {
+		name       string
+		manifest   []byte
+		signature  []byte
+		binary     []byte
+		current    string
+		force      bool
+		wantLatest error
+		wantErr    error
+	}{
+		{
+			name:      "newer release",
+			manifest:  release,
+			signature: sign(private, release),
+			binary:    newBinary,
+			current:   "1.4.2",
+		},
+		{
+			name:      "unknown running version",
+			manifest:  release,
+			signature: sign(private, release),
+			binary:    newBinary,
+		},
+		{
+			name:       "signed by another key",
+			manifest:   release,
+			signature:  sign(otherKey, release),
+			wantLatest: ErrSignature,
+		},
+		{
+			name:       "malformed signature",
+			manifest:   release,
+			signature:  []byte("not base64"),
+			wantLatest: ErrSignature,
+		},
+		{
+			name:       "version changed after signing",
+			manifest:   bytes.Replace(release, []byte("1.5.0"), []byte("9.0.0"), 1),
+			signature:  sign(private, release),
+			wantLatest: ErrSignature,
+		},
+		{
+			name:      "checksum mismatch",
+			manifest:  release,
+			signature: sign(private, release),
+			binary:    []byte("#!/bin/sh\necho tampered\n"),
+			wantErr:   ErrChecksum,
+		},
+		{
+			name:      "no binary for the platform",
+			manifest:  otherPlatform,
+			signature: sign(private, otherPlatform),
+			binary:    newBinary,
+			wantErr:   ErrNoBinary,
+		},
+		{
+			// An older release, signed when it shipped, served as the latest
+			name:      "downgrade",
+			manifest:  release,
+			signature: sign(private, release),
+			binary:    newBinary,
+			current:   "1.6.0",
+			wantErr:   ErrNotNewer,
+		},
+		{
+			name:      "same version",
+			manifest:  release,
+			signature: sign(private, release),
+			binary:    newBinary,
+			current:   "v1.5.0",
+			wantErr:   ErrNotNewer,
+		},
+		{
+			name:      "forced downgrade",
+			manifest:  release,
+			signature: sign(private, release),
+			binary:    newBinary,
+			current:   "1.6.0",
+			force:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := serve(t, map[string][]byte{
+				"/releases/latest.json":     test.manifest,
+				"/releases/latest.json.sig": test.signature,
+				"/releases/scaffold":        test.binary,
+			})
+			executable := filepath.Join(t.TempDir(), "scaffold")
+			if err := os.WriteFile(executable, oldBinary, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			updater := New(Options{URL: base + "/releases/latest.json", PublicKey: public, Current: test.current, Force: test.force})
+
+			latest, err := updater.Latest(context.Background())
+			if !errors.Is(err, test.wantLatest) {
+				t.Fatalf("Latest() = %v, want %v", err, test.wantLatest)
+			}
+			if err != nil {
+				return
+			}
+			if latest.Version != "1.5.0" {
+				t.Errorf("version = %q, want 1.5.0", latest.Version)
+			}
+
+			err = updater.Install(context.Background(), latest, executable)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("Install() = %v, want %v", err, test.wantErr)
+			}
+			want := newBinary
+			if test.wantErr != nil {
+				want = oldBinary
+			}
+			installed, err := os.ReadFile(executable)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(installed, want) {
+				t.Errorf("executable = %q, want %q", installed, want)
+			}
+			if info, err := os.Stat(executable); err != nil || info.Mode().Perm() != 0o755 {
+				t.Errorf("executable mode = %v, %v, want 0755", info.Mode(), err)
+			}
+			// No temporary file is left behind
+			if entries, _ := os.ReadDir(filepath.Dir(executable)); len(entries) != 1 {
+				t.Errorf("directory holds %d files, want 1", len(entries))
+			}
+		})
+	}
+}
+
+func TestInstallNeedsAVerifiedRelease(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := New(Options{URL: "http://releases.invalid/latest.json", PublicKey: public})
+	release := &Release{Version: "99.0.0", Binaries: map[string]Binary{PLATFORM: {URL: "scaffold", SHA256: sum(newBinary)}}}
+	if err := updater.Install(context.Background(), release, os.Args[0]); err == nil || !strings.Contains(err.Error(), "not verified") {
+		t.Errorf("Install() of a hand-made release = %v, want an error", err)
+	}
+}
+
+func TestNewer(t *testing.T) {
+	tests := []struct {
+		version, current string
+		want             bool
+	}{
+		{"1.5.0", "1.4.9", true},
+		{"1.10.0", "1.9.0", true},
+		{"v2.0.0", "1.99.99", true},
+		{"1.5", "1.5.0", false},
+		{"1.5.0", "1.5.0", false},
+		{"1.5.0-rc1", "1.5.0", false},
+		{"1.4.0", "1.5.0", false},
+		{"0.0.1", "", true},
+	}
+	for _, test := range tests {
+		if got := Newer(test.version, test.current); got != test.want {
+			t.Errorf("Newer(%q, %q) = %v, want %v", test.version, test.current, got, test.want)
+		}
+	}
+}
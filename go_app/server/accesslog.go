@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go_app/accesslog"
+	"go_app/telemetry"
+)
+
+// access-log value that turns the access log off
+const ACCESS_LOG_OFF = "off"
+
+// Entries written and writes that failed, published on /debug/vars
+var accessLogMetrics = expvar.NewMap("access_log")
+
+// One line per request, apart from the application log. The defaults keep personal
+// data out: client IPs are masked to their network, query strings and the referer's
+// query are left out, and users are named by ID rather than username.
+type AccessLogConfig struct {
+	Format      string // off, common, combined or json
+	Destination string // stdout, stderr, syslog, syslog://host:port or a file path
+	MaxSizeMB   int    // a log file is rotated once it would grow past this; 0 never
+	MaxBackups  int    // rotated files kept
+	ClientIP    string // masked, full or none
+	Query       bool   // include query strings
+}
+
+func (c AccessLogConfig) validate() error {
+	switch c.Format {
+	case ACCESS_LOG_OFF, "", accesslog.FORMAT_COMMON, accesslog.FORMAT_COMBINED, accesslog.FORMAT_JSON:
+	default:
+		return fmt.Errorf("access-log must be %s, %s, %s or %s, got %q", ACCESS_LOG_OFF, accesslog.FORMAT_COMMON, accesslog.FORMAT_COMBINED, accesslog.FORMAT_JSON, c.Format)
+	}
+	switch c.ClientIP {
+	case accesslog.IP_MASKED, accesslog.IP_FULL, accesslog.IP_NONE:
+	default:
+		return fmt.Errorf("access-log-ip must be %s, %s or %s, got %q", accesslog.IP_MASKED, accesslog.IP_FULL, accesslog.IP_NONE, c.ClientIP)
+	}
+	return nil
+}
+
+// The access log of config, nil when it is off
+func newAccessLog(config AccessLogConfig) (*accesslog.Logger, error) {
+	if config.Format == ACCESS_LOG_OFF || config.Format == "" {
+		return nil, nil
+	}
+	out, err := accesslog.Open(config.Destination, accesslog.Rotation{MaxBytes: int64(config.MaxSizeMB) << 20, MaxBackups: config.MaxBackups})
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return accesslog.New(config.Format, out)
+}
+
+// Counts the bytes of a response for the access log
+type accessWriter struct {
+	statusWriter
+	bytes int64
+}
+
+func (w *accessWriter) Write(p []byte) (int, error) {
+	n, err := w.statusWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Writes an access log entry once each request is answered, refused ones included.
+// The user comes from the auth strategy that accepted the request, see authSucceeded.
+func (a *App) logAccess(next http.Handler) http.Handler {
+	if a.accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		state := &hookState{}
+		recorder := &accessWriter{statusWriter: statusWriter{ResponseWriter: w}}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), hookStateKey{}, state)))
+		a.writeAccessEntry(r, recorder, state, start)
+	})
+}
+
+func (a *App) writeAccessEntry(r *http.Request, recorder *accessWriter, state *hookState, start time.Time) {
+	config := a.Config.AccessLog
+	ip := clientIP(r)
+	if addr, ok := a.Network.ClientAddr(r); ok {
+		ip = addr.String()
+	}
+	path := r.URL.Path
+	if config.Query && r.URL.RawQuery != "" {
+		path += "?" + r.URL.RawQuery
+	}
+	status := recorder.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	entry := accesslog.Entry{
+		Time:      start,
+		ClientIP:  accesslog.MaskIP(ip, config.ClientIP),
+		Method:    r.Method,
+		Path:      path,
+		Protocol:  r.Proto,
+		Status:    status,
+		Bytes:     recorder.bytes,
+		Duration:  time.Since(start),
+		UserAgent: r.UserAgent(),
+	}
+	if referer := r.Referer(); referer != "" {
+		entry.Referer = referer
+		if !config.Query {
+			entry.Referer = accesslog.StripQuery(referer)
+		}
+	}
+	if user := state.user.Load(); user != nil {
+		entry.User = user.ID
+	}
+	if span, ok := telemetry.SpanFromContext(r.Context()); ok {
+		entry.TraceID = span.TraceID
+	}
+	if err := a.accessLog.Log(entry); err != nil {
+		accessLogMetrics.Add("failures", 1)
+		return
+	}
+	accessLogMetrics.Add("entries", 1)
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"go_app/eventbus"
+)
+
+// Guards operator endpoints with the static admin token (APP_ADMIN_TOKEN); admin routes are disabled when it is unset
+func (a *App) requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		adminToken := a.Config.AdminToken
+		if adminToken == "" {
+			a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found")
+			return
+		}
+
+		provided := r.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(adminToken)) != 1 {
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Invalid admin token")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+type unlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+func (r unlockRequest) Validate() error {
+	if r.Username == "" && r.IP == "" {
+		return errors.New("username or ip is required")
+	}
+	return nil
+}
+
+type unlockResponse struct {
+	Unlocked map[string]bool `json:"unlocked"`
+}
+
+func (a *App) unlock(ctx context.Context, request unlockRequest) (unlockResponse, error) {
+	unlocked := map[string]bool{}
+	if request.Username != "" {
+		unlocked["username"] = a.LoginGuard.Unlock(usernameKey(request.Username))
+	}
+	if request.IP != "" {
+		unlocked["ip"] = a.LoginGuard.Unlock(ipKey(request.IP))
+	}
+
+	a.Logger.Printf("audit: event=login_unlock username=%q ip=%q by=%s", request.Username, request.IP, clientIPFromContext(ctx))
+	loginMetrics.Add("unlocks", 1)
+	return unlockResponse{Unlocked: unlocked}, nil
+}
+
+// Dumps the effective config with secrets redacted
+func (a *App) configHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, r, http.StatusOK, a.Config.Redacted())
+}
+
+// Switches to a fresh signing key; previous keys keep verifying per token-previous-keys
+func (a *App) rotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := a.keys(r.Context()).Rotate()
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Failed to rotate keys")
+		return
+	}
+
+	a.Logger.Printf("audit: event=key_rotation kid=%s by=%s", key.ID, clientIP(r))
+	eventbus.Publish(a.Events, TopicKeyRotated, KeyRotatedEvent{KeyID: key.ID, Time: a.clock(r.Context()).Now()})
+
+	var kids []string
+	for _, verification := range a.keys(r.Context()).VerificationKeys() {
+		kids = append(kids, verification.ID)
+	}
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"kid":       key.ID,
+		"algorithm": key.Method.Alg(),
+		"validKids": kids,
+	})
+}
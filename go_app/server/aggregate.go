@@ -0,0 +1,138 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/telemetry"
+)
+
+// A downstream service whose /status is folded into ours
+type downstream struct {
+	Name string
+	URL  string // empty when the name is resolved through service discovery
+}
+
+// Parses "name=url" pairs separated by commas. An entry without "=" is either a URL
+// (named after its host) or a service name resolved through discovery.
+func parseDownstreams(value string) []downstream {
+	var services []downstream
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, url, ok := strings.Cut(entry, "=")
+		if !ok {
+			name, url = entry, ""
+			if strings.Contains(entry, "://") {
+				url = entry
+				name = strings.SplitN(strings.SplitN(entry, "://", 2)[1], "/", 2)[0]
+			}
+		}
+		services = append(services, downstream{Name: name, URL: strings.TrimRight(url, "/")})
+	}
+	return services
+}
+
+// Calls every configured downstream /status concurrently and returns one entry per
+// service instance, in config order. Failing services are reported, not fatal; why
+// they failed is only logged, as it names internal hosts and ports.
+func (a *App) downstreamStatuses(ctx context.Context) []map[string]string {
+	services := parseDownstreams(a.Config.DownstreamServices)
+	results := make([][]map[string]string, len(services))
+
+	var wg sync.WaitGroup
+	for i, service := range services {
+		wg.Add(1)
+		go func(i int, service downstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, a.Config.DownstreamTimeout)
+			defer cancel()
+
+			start := time.Now()
+			entries, err := a.fetchDownstreamStatus(ctx, service)
+			if err != nil {
+				a.Logger.Printf("Downstream status of %s failed: %v", service.Name, err)
+				results[i] = []map[string]string{{"name": service.Name, "status": "unavailable"}}
+				return
+			}
+			latency := time.Since(start).Round(time.Millisecond).String()
+			for _, entry := range entries {
+				entry["name"] = service.Name
+				entry["status"] = "ok"
+				entry["latency"] = latency
+			}
+			results[i] = entries
+		}(i, service)
+	}
+	wg.Wait()
+
+	var statuses []map[string]string
+	for _, entries := range results {
+		statuses = append(statuses, entries...)
+	}
+	return statuses
+}
+
+// Base URL of a downstream, resolved through service discovery when none is configured
+func (a *App) downstreamURL(ctx context.Context, service downstream) (string, error) {
+	if service.URL != "" {
+		return service.URL, nil
+	}
+	if a.Discovery == nil {
+		return "", errors.New("no URL and service discovery is disabled")
+	}
+	instance, err := a.Discovery.Discover(ctx, service.Name)
+	if err != nil {
+		return "", err
+	}
+	return instance.URL(), nil
+}
+
+// Fetches the /status of service with downstream-authorization, if set. The caller's
+// token is not passed on: it was issued for this service and must not leak to others.
+func (a *App) fetchDownstreamStatus(ctx context.Context, service downstream) ([]map[string]string, error) {
+	base, err := a.downstreamURL(ctx, service)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/status", nil)
+	if err != nil {
+		return nil, err
+	}
+	if authorization := a.Config.DownstreamAuthorization; authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	if span, ok := telemetry.SpanFromContext(ctx); ok {
+		req.Header.Set("traceparent", span.Traceparent())
+	}
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+		return nil, fmt.Errorf("status endpoint answered %s", resp.Status)
+	}
+
+	// Downstreams answer in our own format: {"<service>": [{"version": ...}, ...]}
+	var body map[string][]map[string]string
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decode status: %w", err)
+	}
+	var entries []map[string]string
+	for _, list := range body {
+		entries = append(entries, list...)
+	}
+	return entries, nil
+}
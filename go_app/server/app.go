@@ -0,0 +1,469 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go_app/accesslog"
+	"go_app/cache"
+	"go_app/configcrypt"
+	"go_app/configformat"
+	"go_app/configsource"
+	"go_app/discovery"
+	"go_app/eventbus"
+	"go_app/jwks"
+	"go_app/lifecycle"
+	"go_app/locking"
+	"go_app/messaging"
+	"go_app/notifier"
+	"go_app/session"
+	"go_app/storage/blob"
+	"go_app/telemetry"
+	"go_app/workerpool"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Holds every dependency of the service so handlers need no package-level state
+type App struct {
+	Config         Config
+	Logger         *log.Logger    // plain lines, including audit lines, which are never filtered
+	Log            *slog.Logger   // leveled, structured logging to the same writer
+	LogLevel       *slog.LevelVar // App.Log's level; see SetLogLevel
+	Clock          Clock
+	Version        VersionSource // commit SHA for /status, see Config.VersionSource
+	Keys           KeyProvider
+	Stores         Stores
+	LoginGuard     *LoginGuard
+	LoadShedder    *LoadShedder
+	RateLimiter    *RateLimiter
+	Discovery      *discovery.Client
+	Notifier       *notifier.Notifier      // nil when no notification backend is configured
+	mailer         *notifier.SMTP          // sends verification emails; nil without an SMTP relay
+	oidcKeys       *jwks.Client            // keys of the oidc-issuer; nil without one
+	accessLog      *accesslog.Logger       // nil while access-log is off
+	http3AltSvc    atomic.Pointer[string]  // Alt-Svc of the HTTP/3 listener, see AdvertiseHTTP3
+	Metrics        *telemetry.OTLPExporter // nil unless the otlp metrics backend is selected
+	Events         *eventbus.Bus
+	Consumer       *messaging.Consumer // handlers of Stores.Messages topics, run by Run
+	HTTPClient     *http.Client        // for calls to other services
+	ResponseCache  *ResponseCache
+	Workers        *workerpool.Pool   // for CPU-bound or blocking work, see Config.Workers
+	Locks          locking.Locker     // named locks shared by the replicas, see Config.Locks
+	Lifecycle      *lifecycle.Manager // starts and stops the subsystems in order, see registerLifecycle
+	AuthStrategies map[string]AuthStrategy
+	Hooks          Hooks          // request lifecycle callbacks
+	Network        *NetworkPolicy // trusted proxies and client allow/deny lists
+	DB             *sql.DB        // nil unless a database is configured
+	Database       *Database      // DB with its read replicas; nil unless a database is configured
+	Blobs          blob.Store     // uploaded file contents; nil disables /files
+	FileScanner    FileScanner
+	Router         *Router
+	AdminRouter    *Router // admin and debug routes when admin-port is set, else nil
+	MetricsRouter  *Router // /metrics when metrics-port is set, else nil
+
+	// Where /status metadata is read from; NewApp uses Config.MetadataPath
+	MetadataSource configsource.Source
+	// Decrypts ENC[...] metadata values; nil when no key is configured
+	MetadataCipher *configcrypt.Cipher
+
+	configMutex    sync.Mutex
+	replayMutex    sync.Mutex // makes the single-use check and record one step
+	configCache    *cache.Cache[string, ConfigCache]
+	configState    string                 // CONFIG_STATE_OK or CONFIG_STATE_DEGRADED after the first load
+	configSnapshot map[string]interface{} // last loaded metadata, kept for diffing when the cache is dropped
+	configChanges  []ConfigChange         // oldest first, at most config-change-history
+	tenantConfigs  *cache.Cache[string, *tenantOverlay]
+	deployment     *cache.Cache[string, DeploymentInfo] // see Deployment
+	twoFactorMutex sync.Mutex                           // serializes code checks so a code or recovery code is accepted once
+
+	routeMutex   sync.Mutex // guards routeGroups and swapping the routers
+	staticRoutes []builtRoute
+	routeGroups  map[string]*routeGroup
+
+	webhooks map[string]Webhook // by provider, see RegisterWebhook
+
+	policies       []PolicyRule   // loaded from policy-file by New
+	policyLocation *time.Location // zone of the policy time variables
+
+	csrfKey     []byte         // see csrf-secret
+	cookieCodec *session.Codec // see session-cookie-keys
+	tokenParser *jwt.Parser
+	tokenCache  *cache.Cache[string, *verifiedToken]
+
+	slos sync.Map // route pattern -> *sloTracker, see trackSLO
+
+	routeSettings       atomic.Pointer[map[string]RouteSettings] // from the metadata, see RouteSettings
+	routeSettingsReload atomic.Bool                              // a background reload is running
+	routeSettingsRetry  atomic.Int64                             // unix nanoseconds before which no reload starts
+	slowStackAt         atomic.Int64                             // unix nanoseconds of the last slow request stack sample
+	routeSettingsDelay  time.Duration                            // backoff after failed reloads, owned by the reload
+
+	logLevelMutex    sync.Mutex
+	logLevelRevert   *time.Timer // pending revert of a temporary level
+	logLevelRevertAt time.Time
+	logLevelBase     slog.Level // level restored by the revert
+}
+
+// Builds an App from explicitly provided dependencies, for manual or generated DI wiring
+func NewApp(config Config, logger *log.Logger, clock Clock, keys KeyProvider, stores Stores) *App {
+	if stores.Sessions == nil {
+		stores.Sessions = NewMemorySessionStore()
+	}
+	if stores.TwoFactor == nil {
+		stores.TwoFactor = NewMemoryTwoFactorStore()
+	}
+	if stores.Files == nil {
+		stores.Files = NewMemoryFileStore()
+	}
+	if stores.Cutoffs == nil {
+		stores.Cutoffs = NewMemoryCutoffStore()
+	}
+	if stores.Usage == nil {
+		stores.Usage = NewMemoryUsageStore()
+	}
+	if stores.Messages == nil {
+		stores.Messages = messaging.NewMemoryLog()
+	}
+	if stores.Subscriptions == nil {
+		stores.Subscriptions = NewMemorySubscriptionStore()
+	}
+	if stores.Items == nil {
+		stores.Items = NewMemoryItemStore()
+	}
+	if stores.History == nil {
+		stores.History = NewMemoryHistoryStore()
+	}
+	if stores.TenantConfigs == nil {
+		stores.TenantConfigs = NewMemoryTenantConfigStore()
+	}
+	network, err := NewNetworkPolicy(config.Network)
+	if err != nil {
+		logger.Println("Ignoring invalid network entries:", err)
+	}
+	version, err := NewVersionSource(config.VersionSource, config.VersionFile)
+	if err != nil {
+		logger.Println("Ignoring version source:", err)
+		version, _ = NewVersionSource(VERSION_SOURCE_AUTO, config.VersionFile)
+	}
+	logLevel := new(slog.LevelVar)
+	if level, err := parseLogLevel(config.LogLevel); err == nil {
+		logLevel.Set(level)
+	} else if config.LogLevel != "" {
+		logger.Println("Ignoring log level:", err)
+	}
+	a := &App{
+		Config:         config,
+		Logger:         logger,
+		Log:            slog.New(slog.NewTextHandler(logger.Writer(), &slog.HandlerOptions{Level: logLevel})),
+		LogLevel:       logLevel,
+		Clock:          clock,
+		Version:        version,
+		Keys:           keys,
+		Stores:         stores,
+		LoginGuard:     NewLoginGuard(config.Login, logger, clock),
+		LoadShedder:    NewLoadShedder(config.LoadShed),
+		RateLimiter:    NewRateLimiter(clock),
+		configCache:    cache.New[string, ConfigCache](cache.Options[ConfigCache]{Name: "metadata", Shards: 1, TTL: CACHE_DURATION_MS * time.Millisecond, Now: clock.Now}),
+		deployment:     cache.New[string, DeploymentInfo](cache.Options[DeploymentInfo]{Name: "deployment", Shards: 1, Now: clock.Now}),
+		tenantConfigs:  cache.New[string, *tenantOverlay](cache.Options[*tenantOverlay]{Name: "tenant_config", MaxEntries: MAX_CACHED_TENANTS, Now: clock.Now}),
+		tokenParser:    jwt.NewParser(jwt.WithoutClaimsValidation()),
+		tokenCache:     newTokenCache(clock),
+		Router:         NewRouter(),
+		Events:         eventbus.New(logger),
+		Consumer:       messaging.NewConsumer(stores.Messages, config.Discovery.ServiceName, logger),
+		HTTPClient:     &http.Client{Timeout: 30 * time.Second, Transport: budgetTransport{http.DefaultTransport}},
+		ResponseCache:  NewResponseCache(clock),
+		Workers:        workerpool.New("default", config.Workers.Size, config.Workers.QueueSize, logger),
+		Locks:          locking.NewMemory(),
+		Lifecycle:      lifecycle.New(logger),
+		AuthStrategies: make(map[string]AuthStrategy),
+		Network:        network,
+		routeGroups:    make(map[string]*routeGroup),
+		webhooks:       make(map[string]Webhook),
+		policyLocation: time.UTC,
+
+		MetadataSource: configsource.NewFile(config.MetadataPath),
+	}
+	// Log lines from several profiles often end up in one place
+	if config.Profile != "" {
+		a.Log = a.Log.With("profile", config.Profile)
+	}
+	if config.AdminPort != "" {
+		a.AdminRouter = NewRouter()
+	}
+	if config.MetricsPort != "" {
+		a.MetricsRouter = NewRouter()
+	}
+	a.LoginGuard.OnLockout = a.publishLockout
+	a.Lifecycle.StopBudget = config.Shutdown.GracePeriod
+	a.Lifecycle.Timeouts, _ = parseShutdownTimeouts(config.Shutdown.Timeouts)
+	a.csrfKey = []byte(config.Cookies.CSRFSecret)
+	if len(a.csrfKey) == 0 {
+		a.csrfKey = make([]byte, 32)
+		rand.Read(a.csrfKey)
+	}
+	// New refuses bad keys; here they would leave the cookie unencrypted, so say so
+	if a.cookieCodec, err = config.Cookies.codec(); err != nil {
+		logger.Println("Ignoring session-cookie-keys, session cookies are not encrypted:", err)
+	}
+	a.registerAuthStrategies()
+	// Cached responses may embed metadata, drop them when it changes
+	eventbus.Subscribe(a.Events, TopicConfigChanged, 0, func(ConfigChangedEvent) {
+		a.ResponseCache.InvalidateAll()
+	})
+	a.Events.Subscribe(eventbus.ALL_TOPICS, WEBHOOK_EVENT_QUEUE_SIZE, a.fanOutWebhooks)
+	a.subscribeHistory()
+	a.Consumer.Handle(WEBHOOK_DELIVERY_TOPIC, WEBHOOK_DELIVERY_CONCURRENCY, a.deliverWebhook)
+	a.registerLifecycle()
+	a.routes()
+	return a
+}
+
+// What New would otherwise build itself, e.g. for tests: a logger other than the
+// standard one, a controllable clock, fixed keys, or stores replacing those config
+// selects. Nil fields, and nil stores of Stores, keep New's.
+type Dependencies struct {
+	Logger *log.Logger
+	Overrides
+}
+
+// Builds an App from config: in-memory stores, or SQL ones with a database configured,
+// with any dependencies given replacing New's own, later ones winning
+func New(config Config, dependencies ...Dependencies) (*App, error) {
+	logger, clock := log.Default(), Clock(RealClock{})
+	var overrides Overrides
+	for _, given := range dependencies {
+		if given.Logger != nil {
+			logger = given.Logger
+		}
+		overrides = overrides.merge(given.Overrides)
+	}
+	if overrides.Clock != nil {
+		clock = overrides.Clock
+	}
+
+	if err := validEnvironment(config.Environment); err != nil {
+		return nil, err
+	}
+	if err := validProfile(config.Profile); err != nil {
+		return nil, err
+	}
+	if _, err := NewNetworkPolicy(config.Network); err != nil {
+		return nil, err
+	}
+	if _, err := parseLogLevel(config.LogLevel); err != nil {
+		return nil, err
+	}
+	if err := config.JSON.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Registration.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.OIDC.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.AccessLog.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.Deployment.validate(); err != nil {
+		return nil, err
+	}
+	if err := config.HTTP3.validate(config.TLS); err != nil {
+		return nil, err
+	}
+	if err := config.Shutdown.validate(); err != nil {
+		return nil, err
+	}
+	if _, err := parseMetricsBackends(config.Telemetry.Backends); err != nil {
+		return nil, err
+	}
+	if _, err := NewVersionSource(config.VersionSource, config.VersionFile); err != nil {
+		return nil, err
+	}
+	keys := overrides.Keys
+	if keys == nil {
+		ring, err := NewKeyRing(config.Tokens.Algorithm, config.Tokens.PreviousKeys)
+		if err != nil {
+			return nil, err
+		}
+		keys = ring
+	}
+	blacklist := NewBoundedBlacklist("blacklist", config.Blacklist, clock, logger)
+	revocations := NewBoundedBlacklist("revocations", config.Blacklist, clock, logger)
+	for _, store := range []*BoundedBlacklist{blacklist, revocations} {
+		if err := store.Load(); err != nil {
+			return nil, err
+		}
+	}
+	exampleUser := Account{
+		ID:       1,
+		Username: "exampleuser",
+		Password: config.ExampleUserPassword,
+	}
+	stores := Stores{
+		Blacklist:   blacklist,
+		Revocations: revocations,
+		Users:       NewMemoryUserStore(exampleUser),
+	}
+	var database *Database
+	var db *sql.DB
+	var err error
+	if config.Database.Driver != "" {
+		if database, err = openDatabases(config.Database); err != nil {
+			return nil, err
+		}
+		db = database.Primary
+		// Stores whose reads can lag behind use the replicas. Sessions, two-factor state,
+		// cutoffs and accounts decide whether to let a caller through, and messages and
+		// webhook attempts are read back by workers right after they are written, so
+		// those stay on the primary.
+		if stores.Users, err = NewSQLUserStore(db, config.Database.Driver, exampleUser); err != nil {
+			return nil, fmt.Errorf("prepare users table: %w", err)
+		}
+		if stores.Sessions, err = NewSQLSessionStore(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare sessions table: %w", err)
+		}
+		if stores.TwoFactor, err = NewSQLTwoFactorStore(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare two_factor table: %w", err)
+		}
+		if stores.Files, err = NewSQLFileStore(database, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare files table: %w", err)
+		}
+		if stores.Cutoffs, err = NewSQLCutoffStore(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare token_cutoffs table: %w", err)
+		}
+		if stores.Usage, err = NewSQLUsageStore(database, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare request_usage table: %w", err)
+		}
+		if stores.Messages, err = NewSQLMessageLog(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare messages tables: %w", err)
+		}
+		if stores.Subscriptions, err = NewSQLSubscriptionStore(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare webhook subscription tables: %w", err)
+		}
+		if stores.Items, err = NewSQLItemStore(database, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare items table: %w", err)
+		}
+		if stores.History, err = NewSQLHistoryStore(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare change_history table: %w", err)
+		}
+		if stores.TenantConfigs, err = NewSQLTenantConfigStore(db, config.Database.Driver); err != nil {
+			return nil, fmt.Errorf("prepare tenant_configs table: %w", err)
+		}
+	}
+	if config.LDAP.URL != "" {
+		if stores.Users, err = NewLDAPUserStore(config.LDAP, logger); err != nil {
+			return nil, fmt.Errorf("ldap: %w", err)
+		}
+	}
+	stores = mergeStores(stores, overrides.Stores)
+	if _, ok := stores.Users.(AccountRegistry); !ok && config.Registration.Mode != REGISTRATION_CLOSED {
+		return nil, errors.New("registration needs a user store that accepts accounts, not a directory")
+	}
+
+	locks, err := newLocker(config.Locks, config.Database.Driver, db)
+	if err != nil {
+		return nil, err
+	}
+
+	app := NewApp(config, logger, clock, keys, stores)
+	app.DB = db
+	app.Database = database
+	app.Locks = locks
+
+	if config.ConfigSource != "" {
+		if app.MetadataSource, err = configsource.New(config.ConfigSource); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := configformat.ByName(config.MetadataFormat, app.MetadataSource.String()); err != nil {
+		return nil, err
+	}
+	if err := app.loadPolicyConfig(); err != nil {
+		return nil, err
+	}
+	if _, err := config.Cookies.sameSite(); err != nil {
+		return nil, err
+	}
+	if _, err := config.Cookies.codec(); err != nil {
+		return nil, err
+	}
+
+	if config.Files.Store != "" {
+		store, err := blob.New(config.Files.Store)
+		if err != nil {
+			return nil, fmt.Errorf("files store: %w", err)
+		}
+		app.Blobs = blob.Instrument(store, "files")
+		app.FileScanner = newCommandScanner(config.Files.ScanCommand)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CONFIG_SOURCE_TIMEOUT)
+	defer cancel()
+	if app.MetadataCipher, err = configcrypt.LoadCipher(ctx, config.MetadataKey, config.MetadataKMSKey); err != nil {
+		return nil, fmt.Errorf("metadata key: %w", err)
+	}
+
+	if app.Notifier, err = newNotifier(config.Notify, app.Logger); err != nil {
+		return nil, err
+	}
+	if app.mailer, err = newMailer(config.Notify); err != nil {
+		return nil, err
+	}
+	if app.accessLog, err = newAccessLog(config.AccessLog); err != nil {
+		return nil, err
+	}
+	if app.Notifier != nil {
+		app.subscribeNotifications()
+	}
+
+	if app.Metrics, err = newMetricsExporter(config.Telemetry, config.Discovery.ServiceName, app.Logger); err != nil {
+		return nil, err
+	}
+
+	if config.Discovery.Backend != "" {
+		registry, err := discovery.NewRegistry(config.Discovery.Backend, config.Discovery.Addr)
+		if err != nil {
+			return nil, err
+		}
+		if etcd, ok := registry.(*discovery.Etcd); ok {
+			etcd.Logger = app.Logger
+		}
+		app.Discovery = discovery.NewClient(registry)
+	}
+	return app, nil
+}
+
+// Returns the root handler with edge middleware applied
+func (a *App) Handler() http.Handler {
+	return a.timeRequests(traceRequests(a.logAccess(a.filterClients(a.advertiseHTTP3(a.allowCORS(a.logRequests(stripIdentityHeaders(a.runLifecycleHooks(a.Router)))))))))
+}
+
+// Handler for the admin listener, nil unless admin-port is set. It is meant for
+// operators on a private address, so lifecycle hooks and the IP lists don't apply;
+// the admin token still does.
+func (a *App) AdminHandler() http.Handler {
+	if a.AdminRouter == nil {
+		return nil
+	}
+	return a.logAccess(a.logRequests(a.AdminRouter))
+}
+
+// Handler for the metrics listener, nil unless metrics-port is set
+func (a *App) MetricsHandler() http.Handler {
+	if a.MetricsRouter == nil {
+		return nil
+	}
+	return a.MetricsRouter
+}
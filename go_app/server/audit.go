@@ -0,0 +1,302 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/eventbus"
+)
+
+// What a ChangeEvent did to its record
+const (
+	CHANGE_CREATED = "created"
+	CHANGE_UPDATED = "updated"
+	CHANGE_DELETED = "deleted"
+)
+
+// Actor of changes made outside a request, e.g. by a scheduled job
+const SYSTEM_ACTOR = "system"
+
+// Changes kept by the in-memory history; the oldest are dropped beyond it
+const HISTORY_MEMORY_LIMIT = 10000
+
+// Changes waiting for the history subscriber before the bus drops them
+const HISTORY_QUEUE_SIZE = 1000
+
+// Who made the changes of ctx: the user ID, the method and username of principals
+// without one, e.g. "mtls:billing", or SYSTEM_ACTOR outside requests
+func Actor(ctx context.Context) string {
+	user, ok := UserFromContext(ctx)
+	switch {
+	case !ok:
+		return SYSTEM_ACTOR
+	case user.ID != "":
+		return user.ID
+	}
+	return user.AuthMethod + ":" + user.Username
+}
+
+// The audit columns of a record. Embed it in a resource and call MarkCreated and
+// MarkUpdated with the request's context; stores keep the fields in created_by, updated_by and
+// deleted_at (see ensureAuditColumns).
+type Audit struct {
+	CreatedBy string     `json:"createdBy"`
+	UpdatedBy string     `json:"updatedBy"`
+	DeletedAt *time.Time `json:"-"` // soft-deleted records are never answered
+}
+
+// Records the caller of ctx as the creator of a new record
+func (audit *Audit) MarkCreated(ctx context.Context) {
+	actor := Actor(ctx)
+	audit.CreatedBy, audit.UpdatedBy = actor, actor
+}
+
+// Records the caller of ctx as the last to change the record
+func (audit *Audit) MarkUpdated(ctx context.Context) {
+	audit.UpdatedBy = Actor(ctx)
+}
+
+// A field's value before and after a change, as encoded in responses
+type FieldChange struct {
+	Old interface{} `json:"old,omitempty"`
+	New interface{} `json:"new,omitempty"`
+}
+
+// A record created, changed or deleted, published on TopicChange
+type ChangeEvent struct {
+	Resource string                 `json:"resource"` // e.g. "item"
+	ID       string                 `json:"id"`
+	Action   string                 `json:"action"`
+	Actor    string                 `json:"actor"`
+	Changes  map[string]FieldChange `json:"changes,omitempty"` // by JSON field name
+	Time     time.Time              `json:"time"`
+}
+
+// Publishes the change of the record id from before to after on TopicChange, where the
+// history subscriber keeps it. before is nil for creations and after for deletions.
+// Fields are compared by their JSON encoding, so only what responses show is recorded.
+func (a *App) PublishChange(ctx context.Context, resource, id, action string, before, after interface{}) {
+	changes, err := diffFields(before, after)
+	if err != nil {
+		a.Log.Error("Change not recorded", "resource", resource, "id", id, "error", err)
+		return
+	}
+	eventbus.Publish(a.Events, TopicChange, ChangeEvent{
+		Resource: resource,
+		ID:       id,
+		Action:   action,
+		Actor:    Actor(ctx),
+		Changes:  changes,
+		Time:     a.clock(ctx).Now().UTC(),
+	})
+}
+
+// The JSON fields that differ between before and after, either of which may be nil
+func diffFields(before, after interface{}) (map[string]FieldChange, error) {
+	old, err := jsonFields(before)
+	if err != nil {
+		return nil, err
+	}
+	current, err := jsonFields(after)
+	if err != nil {
+		return nil, err
+	}
+	changes := map[string]FieldChange{}
+	for name, value := range current {
+		if !reflect.DeepEqual(old[name], value) {
+			changes[name] = FieldChange{Old: old[name], New: value}
+		}
+	}
+	for name, value := range old {
+		if _, ok := current[name]; !ok {
+			changes[name] = FieldChange{Old: value}
+		}
+	}
+	return changes, nil
+}
+
+func jsonFields(v interface{}) (map[string]interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]interface{}
+	return fields, json.Unmarshal(data, &fields)
+}
+
+// Keeps the changes published on TopicChange
+type HistoryStore interface {
+	Append(ctx context.Context, change ChangeEvent) error
+	// Oldest first
+	List(ctx context.Context, resource, id string) ([]ChangeEvent, error)
+}
+
+// Writes the changes published on the bus to the history store
+func (a *App) subscribeHistory() {
+	eventbus.Subscribe(a.Events, TopicChange, HISTORY_QUEUE_SIZE, func(change ChangeEvent) {
+		ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+		defer cancel()
+		if err := a.Stores.History.Append(ctx, change); err != nil {
+			a.Log.Error("Change history write failed", "resource", change.Resource, "id", change.ID, "error", err)
+		}
+	})
+}
+
+type memoryHistoryStore struct {
+	mutex   sync.Mutex
+	changes []ChangeEvent
+}
+
+func NewMemoryHistoryStore() HistoryStore {
+	return &memoryHistoryStore{}
+}
+
+func (s *memoryHistoryStore) Append(ctx context.Context, change ChangeEvent) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.changes) >= HISTORY_MEMORY_LIMIT {
+		s.changes = s.changes[1:]
+	}
+	s.changes = append(s.changes, change)
+	return nil
+}
+
+func (s *memoryHistoryStore) List(ctx context.Context, resource, id string) ([]ChangeEvent, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	changes := []ChangeEvent{}
+	for _, change := range s.changes {
+		if change.Resource == resource && change.ID == id {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// Changes in the change_history table, with the changed fields as JSON
+type sqlHistoryStore struct {
+	db     SQLDB
+	driver string
+}
+
+const historySchema = `CREATE TABLE IF NOT EXISTS change_history (
+	id TEXT PRIMARY KEY,
+	resource TEXT NOT NULL,
+	record_id TEXT NOT NULL,
+	action TEXT NOT NULL,
+	actor TEXT NOT NULL,
+	changes TEXT NOT NULL,
+	changed_at BIGINT NOT NULL
+)`
+
+// Creates the change_history table if needed
+func NewSQLHistoryStore(db SQLDB, driver string) (HistoryStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	for _, statement := range []string{
+		historySchema,
+		`CREATE INDEX IF NOT EXISTS change_history_record ON change_history (resource, record_id, changed_at)`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlHistoryStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlHistoryStore) Append(ctx context.Context, change ChangeEvent) error {
+	id, err := newRandomID()
+	if err != nil {
+		return err
+	}
+	changes, err := json.Marshal(change.Changes)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO change_history (id, resource, record_id, action, actor, changes, changed_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		id, change.Resource, change.ID, change.Action, change.Actor, string(changes), change.Time.UnixMilli())
+	return err
+}
+
+func (s *sqlHistoryStore) List(ctx context.Context, resource, id string) ([]ChangeEvent, error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.driver, `SELECT action, actor, changes, changed_at FROM change_history
+		WHERE resource = ? AND record_id = ? ORDER BY changed_at`), resource, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []ChangeEvent{}
+	for rows.Next() {
+		change := ChangeEvent{Resource: resource, ID: id}
+		var changes string
+		var changedAt int64
+		if err := rows.Scan(&change.Action, &change.Actor, &changes, &changedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &change.Changes); err != nil {
+			return nil, fmt.Errorf("change of %s %s: %w", resource, id, err)
+		}
+		change.Time = time.UnixMilli(changedAt).UTC()
+		history = append(history, change)
+	}
+	return history, rows.Err()
+}
+
+// Condition keeping soft-deleted rows out of a query
+const SQL_NOT_DELETED = "deleted_at IS NULL"
+
+// The audit columns ensureAuditColumns adds
+var auditColumns = []string{"created_by TEXT NOT NULL DEFAULT ''", "updated_by TEXT NOT NULL DEFAULT ''", "deleted_at BIGINT"}
+
+// Adds the audit columns to table unless it has them, so tables created before a
+// store took up auditing keep working. Existing rows get empty actors and aren't
+// deleted.
+func ensureAuditColumns(ctx context.Context, db SQLDB, table string) error {
+	return ensureColumns(ctx, db, table, auditColumns)
+}
+
+// Adds the columns, each a column definition, that table lacks
+func ensureColumns(ctx context.Context, db SQLDB, table string, columns []string) error {
+	rows, err := db.QueryContext(ctx, "SELECT * FROM "+table+" LIMIT 0")
+	if err != nil {
+		return err
+	}
+	existing, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	for _, column := range columns {
+		name, _, _ := strings.Cut(column, " ")
+		if slices.Contains(existing, name) {
+			continue
+		}
+		if _, err := db.ExecContext(ctx, "ALTER TABLE "+table+" ADD COLUMN "+column); err != nil {
+			return fmt.Errorf("add %s.%s: %w", table, name, err)
+		}
+	}
+	return nil
+}
+
+// Marks the rows of table matching where as deleted by the caller of ctx, leaving rows
+// already deleted alone. where uses "?" placeholders for args, like the stores' queries.
+// Reports whether any row was deleted.
+func softDelete(ctx context.Context, db SQLDB, driver, table string, now time.Time, where string, args ...interface{}) (bool, error) {
+	query := rebind(driver, "UPDATE "+table+" SET deleted_at = ?, updated_by = ? WHERE "+where+" AND "+SQL_NOT_DELETED)
+	result, err := db.ExecContext(ctx, query, append([]interface{}{now.UnixMilli(), Actor(ctx)}, args...)...)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Requests authenticated per strategy, published on /debug/vars
+var authMetrics = expvar.NewMap("auth")
+
+// Names strategies are registered under
+const (
+	STRATEGY_JWT    = "jwt"
+	STRATEGY_MTLS   = "mtls"
+	STRATEGY_APIKEY = "apikey"
+	STRATEGY_HMAC   = "hmac"
+	STRATEGY_BASIC  = "basic"
+)
+
+// Why a strategy did not authenticate a request, with the response to send
+type AuthError struct {
+	Status  int
+	Message string
+
+	// The request carries no credentials for this strategy, so the next one may try
+	NoCredentials bool
+
+	// Sent as Retry-After when set, e.g. for a throttled login
+	RetryAfter time.Duration
+}
+
+func (e *AuthError) Error() string {
+	return e.Message
+}
+
+func missingCredentials(message string) *AuthError {
+	return &AuthError{Status: http.StatusUnauthorized, Message: message, NoCredentials: true}
+}
+
+// One way of establishing who sent a request
+type AuthStrategy interface {
+	Name() string
+	// Returns the principal, or an *AuthError; NoCredentials errors let the next strategy try
+	Authenticate(r *http.Request) (*User, error)
+}
+
+// Registers strategy under its name, replacing any strategy of the same name. Call it
+// before the server starts; the registry is not safe for concurrent modification.
+func (a *App) RegisterAuthStrategy(strategy AuthStrategy) {
+	a.AuthStrategies[strategy.Name()] = strategy
+}
+
+// Strategy names from a comma separated list, e.g. "mtls,jwt"
+func parseStrategies(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Tries the named strategies in order and stores the first principal found. A strategy
+// that finds invalid credentials ends the search, so a bad token is never masked by a
+// weaker fallback.
+func (a *App) authenticateWith(names []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var missing *AuthError
+		for _, name := range names {
+			strategy, ok := a.AuthStrategies[name]
+			if !ok {
+				continue
+			}
+			user, err := strategy.Authenticate(r)
+			if err == nil {
+				user.AuthMethod = strategy.Name()
+				authMetrics.Add(strategy.Name(), 1)
+				if err := a.authSucceeded(r, user); err != nil {
+					a.rejectByHook(w, r, err)
+					return
+				}
+				next(w, r.WithContext(withUser(r.Context(), user)))
+				return
+			}
+
+			var authErr *AuthError
+			if !errors.As(err, &authErr) {
+				authErr = &AuthError{Status: http.StatusInternalServerError, Message: "Internal Server Error"}
+			}
+			if !authErr.NoCredentials {
+				authMetrics.Add(strategy.Name()+".rejected", 1)
+				a.authFailed(r, strategy.Name(), authErr)
+				if authErr.RetryAfter > 0 {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(authErr.RetryAfter.Seconds()))))
+				}
+				a.handleErrorResponse(w, r, authErr.Status, authErr.Message)
+				return
+			}
+			// Report the last strategy's challenge, usually the most general one
+			missing = authErr
+		}
+
+		if missing == nil {
+			missing = missingCredentials("Unauthorized: Authentication required")
+		}
+		a.authFailed(r, "", missing)
+		a.handleErrorResponse(w, r, missing.Status, missing.Message)
+	}
+}
+
+// Only lets requests with a valid bearer token through
+func (a *App) authenticateToken(next http.HandlerFunc) http.HandlerFunc {
+	return a.authenticateWith([]string{STRATEGY_JWT}, next)
+}
+
+// Bearer tokens issued by /login. Routes marked SingleUse accept each token once.
+type jwtStrategy struct {
+	app *App
+}
+
+func (s jwtStrategy) Name() string { return STRATEGY_JWT }
+
+func (s jwtStrategy) Authenticate(r *http.Request) (*User, error) {
+	a := s.app
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Basic ") {
+		return nil, missingCredentials("Unauthorized: Missing token")
+	}
+	token, fromCookie := a.presentedToken(r)
+
+	if token == "" {
+		return nil, missingCredentials("Unauthorized: Missing token")
+	}
+
+	verified, authErr := a.checkToken(r.Context(), token)
+	if authErr != nil {
+		return nil, authErr
+	}
+	// A browser sends the cookie along with any request, including forged ones
+	if fromCookie {
+		if err := a.checkCSRF(r, verified.claims); err != nil {
+			return nil, err
+		}
+	}
+
+	// The cached principal is shared, so every request gets its own copy; its claims
+	// are shared too and must not be modified
+	user := verified.user
+	return &user, nil
+}
+
+// Whether token is one this service would accept right now: correctly signed,
+// unexpired, and neither revoked nor cut off, with its session still active. Shared by
+// the jwt strategy and /introspect so they never disagree about a token.
+func (a *App) checkToken(ctx context.Context, token string) (*verifiedToken, *AuthError) {
+	verified, err := a.verifyToken(ctx, token)
+	if err != nil {
+		if a.stores(ctx).Revocations.Contains(token) {
+			return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Token has been revoked"}
+		}
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Token expired"}
+		}
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Invalid token"}
+	}
+	if a.revoked(ctx, token, verified) {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Token has been revoked"}
+	}
+	if active, err := a.sessionActive(ctx, verified.claims); !active {
+		if err != nil {
+			a.Logger.Println("Session lookup failed:", err)
+		}
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Session has been revoked"}
+	}
+	if revoked, err := a.cutoffPassed(ctx, verified.principals, verified.issuedAt); revoked || err != nil {
+		if err != nil {
+			a.Logger.Println("Revocation cutoff lookup failed:", err)
+		}
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Token has been revoked"}
+	}
+	return verified, nil
+}
+
+// Verified TLS client certificates
+type mtlsStrategy struct{}
+
+func (mtlsStrategy) Name() string { return STRATEGY_MTLS }
+
+func (mtlsStrategy) Authenticate(r *http.Request) (*User, error) {
+	user, ok := certificateUser(r)
+	if !ok {
+		return nil, missingCredentials("Unauthorized: Client certificate required")
+	}
+	return user, nil
+}
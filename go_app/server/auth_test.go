@@ -0,0 +1,87 @@
+package server
+
+import (
+	"crypto/rand"
+	"io"
+	"log"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// An App with in-memory stores and a token for exampleuser signed with its key
+func newAuthBenchmark(b *testing.B) (*App, func() string) {
+	b.Helper()
+	keys, err := NewRandomKeyProvider()
+	if err != nil {
+		b.Fatalf("create key provider: %v", err)
+	}
+	clock := NewMockClock(time.Now().Truncate(time.Second))
+	app := NewApp(DefaultConfig(), log.New(io.Discard, "", 0), clock, keys, Stores{
+		Blacklist:   NewMemoryBlacklist(),
+		Revocations: NewMemoryBlacklist(),
+		Users:       NewMemoryUserStore(Account{ID: 1, Username: "exampleuser", Password: "password"}),
+		TwoFactor:   NewMemoryTwoFactorStore(),
+	})
+
+	mint := func() string {
+		now := clock.Now()
+		key := keys.Current()
+		unsigned := jwt.NewWithClaims(key.Method, jwt.MapClaims{
+			"id":       1,
+			"username": "exampleuser",
+			"scope":    app.Config.Tokens.Scopes,
+			"jti":      rand.Text(),
+			"iat":      now.Unix(),
+			"exp":      now.Add(TOKEN_EXPIRATION_TIME).Unix(),
+		})
+		unsigned.Header["kid"] = key.ID
+		token, err := unsigned.SignedString(key.Private)
+		if err != nil {
+			b.Fatalf("sign token: %v", err)
+		}
+		return token
+	}
+	return app, mint
+}
+
+// Cold verifies every token from scratch, as for a client's first request; cached is
+// the same client sending its token again
+func BenchmarkAuthenticate(b *testing.B) {
+	b.Run("cold", func(b *testing.B) {
+		app, mint := newAuthBenchmark(b)
+		strategy := jwtStrategy{app: app}
+		tokens := make([]string, b.N)
+		for i := range tokens {
+			tokens[i] = mint()
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			r := httptest.NewRequest("GET", "/status", nil)
+			r.Header.Set("Authorization", "Bearer "+tokens[i])
+			if _, err := strategy.Authenticate(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		app, mint := newAuthBenchmark(b)
+		strategy := jwtStrategy{app: app}
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.Header.Set("Authorization", "Bearer "+mint())
+		if _, err := strategy.Authenticate(r); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := strategy.Authenticate(r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
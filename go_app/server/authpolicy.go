@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+)
+
+// Deployment environments. They decide how much an authentication failure reveals.
+const (
+	ENVIRONMENT_PRODUCTION  = "production"
+	ENVIRONMENT_DEVELOPMENT = "development"
+)
+
+// Public messages of the credential flows. Every failure of a flow answers with the
+// same status and message, so a response never tells whether an account exists,
+// which factor was wrong or what happened to a token.
+const (
+	MESSAGE_INVALID_CREDENTIALS = "Unauthorized: Invalid credentials"
+	MESSAGE_INVALID_TOKEN       = "Unauthorized: Invalid or expired token"
+)
+
+// Why a credential flow failed. Always logged, sent to the client only in development.
+const (
+	REASON_BAD_CREDENTIALS = "unknown user or wrong password"
+	REASON_BAD_OTP         = "wrong two-factor code"
+	REASON_TOKEN_MISSING   = "no bearer token"
+	REASON_TOKEN_REVOKED   = "token has been revoked"
+	REASON_TOKEN_INVALID   = "token signature or claims are invalid"
+	REASON_SESSION_REVOKED = "session has ended"
+)
+
+func validEnvironment(environment string) error {
+	switch environment {
+	case ENVIRONMENT_PRODUCTION, ENVIRONMENT_DEVELOPMENT:
+		return nil
+	}
+	return fmt.Errorf("unknown environment %q", environment)
+}
+
+// Reports whether failure reasons may be sent to clients
+func (a *App) detailedAuthErrors() bool {
+	return a.Config.Environment == ENVIRONMENT_DEVELOPMENT
+}
+
+// Answers a failed credential flow with its uniform message. The reason goes to the
+// log, and in development also into the response's "detail" field.
+func (a *App) authFailure(w http.ResponseWriter, r *http.Request, status int, message, reason string) {
+	a.Logger.Printf("%s (%s)", message, reason)
+	body := errorBody(w, r, status, message)
+	if a.detailedAuthErrors() {
+		body["detail"] = reason
+	}
+	a.writeJSON(w, r, status, body)
+}
+
+// Compares secrets in time independent of their content and length. Both sides are
+// hashed first because subtle.ConstantTimeCompare returns early on a length mismatch.
+func secretsEqual(given, expected string) bool {
+	givenHash, expectedHash := sha256.Sum256([]byte(given)), sha256.Sum256([]byte(expected))
+	return subtle.ConstantTimeCompare(givenHash[:], expectedHash[:]) == 1
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How far an HMAC request timestamp may be from the server clock
+const HMAC_MAX_SKEW = 5 * time.Minute
+
+// Largest body an HMAC signed request may have, it is read into memory to be hashed
+const HMAC_MAX_BODY = 10 << 20
+
+// Static API keys in the X-API-Key header; the key's name becomes the principal
+type apiKeyStrategy struct {
+	keys map[string]string // name -> key
+}
+
+func (apiKeyStrategy) Name() string { return STRATEGY_APIKEY }
+
+func (s apiKeyStrategy) Authenticate(r *http.Request) (*User, error) {
+	provided := r.Header.Get("X-API-Key")
+	if provided == "" {
+		return nil, missingCredentials("Unauthorized: Missing API key")
+	}
+	// Compare against every key so the time taken does not reveal which one matched
+	var matched string
+	for name, key := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(key)) == 1 {
+			matched = name
+		}
+	}
+	if matched == "" {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Invalid API key"}
+	}
+	return &User{ID: matched, Username: matched, Claims: map[string]interface{}{"sub": matched}}, nil
+}
+
+// Requests signed with a shared secret. Clients send X-Auth-Client, X-Auth-Timestamp
+// (Unix seconds) and X-Auth-Signature, the hex HMAC-SHA256 over
+// "METHOD\nREQUEST-URI\nTIMESTAMP\nhex(SHA-256(body))".
+type hmacStrategy struct {
+	clients map[string]string // id -> secret
+	clock   Clock
+}
+
+func (hmacStrategy) Name() string { return STRATEGY_HMAC }
+
+// The string an HMAC client signs
+func hmacStringToSign(r *http.Request, timestamp string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	return r.Method + "\n" + r.URL.RequestURI() + "\n" + timestamp + "\n" + hex.EncodeToString(bodyHash[:])
+}
+
+func (s hmacStrategy) Authenticate(r *http.Request) (*User, error) {
+	clientID := r.Header.Get("X-Auth-Client")
+	if clientID == "" {
+		return nil, missingCredentials("Unauthorized: Missing request signature")
+	}
+	rejected := &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Invalid request signature"}
+
+	secret, ok := s.clients[clientID]
+	if !ok {
+		return nil, rejected
+	}
+	timestamp := r.Header.Get("X-Auth-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, rejected
+	}
+	if skew := s.clock.Now().Sub(time.Unix(seconds, 0)); skew > HMAC_MAX_SKEW || skew < -HMAC_MAX_SKEW {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Request signature expired"}
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, HMAC_MAX_BODY+1))
+	if err != nil {
+		return nil, rejected
+	}
+	if len(body) > HMAC_MAX_BODY {
+		return nil, &AuthError{Status: http.StatusRequestEntityTooLarge, Message: "Request Entity Too Large"}
+	}
+	// The handler still needs the body
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(hmacStringToSign(r, timestamp, body)))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(r.Header.Get("X-Auth-Signature"))) {
+		return nil, rejected
+	}
+	return &User{ID: clientID, Username: clientID, Claims: map[string]interface{}{"sub": clientID}}, nil
+}
+
+// HTTP Basic auth against the user store, meant for local development only
+type basicStrategy struct {
+	app *App
+}
+
+func (basicStrategy) Name() string { return STRATEGY_BASIC }
+
+// Throttled and locked out like /login, counting against the same username and IP.
+// Basic auth has no room for a second factor, so accounts with two-factor
+// authentication must log in through /login.
+func (s basicStrategy) Authenticate(r *http.Request) (*User, error) {
+	a := s.app
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, missingCredentials("Unauthorized: Missing credentials")
+	}
+
+	keys := []string{usernameKey(username), ipKey(clientIP(r))}
+	if wait, ok := a.LoginGuard.Check(keys...); !ok {
+		loginMetrics.Add("throttled", 1)
+		return nil, &AuthError{Status: http.StatusTooManyRequests, Message: "Too Many Requests: Login temporarily locked", RetryAfter: wait}
+	}
+	defer a.LoginGuard.Release(keys...)
+
+	account, ok := a.stores(r.Context()).Users.Authenticate(username, password)
+	if !ok {
+		a.LoginGuard.RecordFailure(keys...)
+		loginMetrics.Add("failures", 1)
+		a.Logger.Printf("audit: event=basic_auth_failure username=%q ip=%s", username, clientIP(r))
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: MESSAGE_INVALID_CREDENTIALS}
+	}
+	if account.Unverified {
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Email address not verified"}
+	}
+	_, twoFactor, err := a.twoFactorEnabled(r.Context(), fmt.Sprint(account.ID))
+	if err != nil {
+		a.Logger.Println("Two-factor lookup failed:", err)
+		return nil, &AuthError{Status: http.StatusInternalServerError, Message: "Internal Server Error"}
+	}
+	if twoFactor {
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Two-factor authentication required, log in with /login"}
+	}
+	a.LoginGuard.RecordSuccess(keys...)
+	return &User{
+		ID:       fmt.Sprint(account.ID),
+		Username: account.Username,
+		Claims:   map[string]interface{}{"id": account.ID, "username": account.Username},
+	}, nil
+}
+
+// Registers the built-in strategies enabled by the config
+func (a *App) registerAuthStrategies() {
+	a.RegisterAuthStrategy(jwtStrategy{app: a})
+	a.RegisterAuthStrategy(mtlsStrategy{})
+	if a.Config.Auth.APIKeys != "" {
+		a.RegisterAuthStrategy(apiKeyStrategy{keys: parseClientCredentials(a.Config.Auth.APIKeys)})
+	}
+	if a.Config.Auth.HMACClients != "" {
+		a.RegisterAuthStrategy(hmacStrategy{clients: parseClientCredentials(a.Config.Auth.HMACClients), clock: a.Clock})
+	}
+	if a.Config.Auth.BasicDev {
+		a.Logger.Println("WARNING: HTTP Basic authentication is enabled, do not use this in production")
+		a.RegisterAuthStrategy(basicStrategy{app: a})
+	}
+	if a.Config.OIDC.Issuer != "" {
+		oidc := newOIDCStrategy(a)
+		a.oidcKeys = oidc.keys
+		a.RegisterAuthStrategy(oidc)
+	}
+}
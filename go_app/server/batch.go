@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Most entries a batch request may carry, and how many of them run at once
+const (
+	BATCH_MAX_ITEMS   = 100
+	BATCH_CONCURRENCY = 8
+)
+
+// Batch entries per outcome, published on /debug/vars
+var batchMetrics = expvar.NewMap("batch")
+
+// Body of a batch request: the entries, each shaped like the body of the single
+// operation
+type batchBody struct {
+	Items []json.RawMessage `json:"items"`
+}
+
+// Outcome of one entry. Index is its position in the request; Result is set on success
+// and Code and Error, as in error responses, on failure.
+type BatchResult[Resp any] struct {
+	Index  int    `json:"index"`
+	Status int    `json:"status"`
+	Result *Resp  `json:"result,omitempty"`
+	Code   string `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// Answer of a batch endpoint, one result per entry in request order
+type BatchResponse[Resp any] struct {
+	Results   []BatchResult[Resp] `json:"results"`
+	Succeeded int                 `json:"succeeded"`
+	Failed    int                 `json:"failed"`
+}
+
+// 200 when every entry succeeded, 207 Multi-Status when any failed
+func (b BatchResponse[Resp]) StatusCode() int {
+	if b.Failed > 0 {
+		return http.StatusMultiStatus
+	}
+	return http.StatusOK
+}
+
+// Adapts the function of a single operation to an endpoint taking up to
+// BATCH_MAX_ITEMS of them as {"items": [...]}, like Handle does for one:
+//
+//   - Each entry is decoded into its own Req and validated if Req implements Validator.
+//     A malformed or invalid entry fails alone with 400.
+//   - Valid entries run concurrently, BATCH_CONCURRENCY at a time, and don't stop on
+//     failures. Errors map to statuses as in Handle; entries not started before the
+//     request's context ends fail with 503.
+//   - The answer lists every entry's status with its result or error code.
+//
+// Only a body that is not a batch, or an empty or oversized one, fails as a whole.
+// Entries are independent, so fn must not rely on the order they run in.
+func HandleBatch[Req, Resp any](a *App, fn func(ctx context.Context, request Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body batchBody
+		if err := decodeRequest(w, r, &body); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				a.handleErrorResponse(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+				return
+			}
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: "+err.Error())
+			return
+		}
+		switch {
+		case len(body.Items) == 0:
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: items is required")
+			return
+		case len(body.Items) > BATCH_MAX_ITEMS:
+			a.handleErrorResponse(w, r, http.StatusBadRequest, fmt.Sprintf("Bad Request: at most %d items per batch", BATCH_MAX_ITEMS))
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, clientIP(r))
+		results := make([]BatchResult[Resp], len(body.Items))
+		slots := make(chan struct{}, BATCH_CONCURRENCY)
+		var wg sync.WaitGroup
+		for i, raw := range body.Items {
+			results[i].Index = i
+			var request Req
+			if err := json.Unmarshal(raw, &request); err != nil {
+				failBatchEntry(r, &results[i], http.StatusBadRequest, "Bad Request: invalid JSON body")
+				continue
+			}
+			if validator, ok := any(request).(Validator); ok {
+				if err := validator.Validate(); err != nil {
+					failBatchEntry(r, &results[i], http.StatusBadRequest, "Bad Request: "+err.Error())
+					continue
+				}
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				failBatchEntry(r, &results[i], http.StatusServiceUnavailable, "Service Unavailable")
+				continue
+			}
+			wg.Add(1)
+			result := &results[i]
+			a.Go(ctx, func(ctx context.Context) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				runBatchEntry(a, r, ctx, result, fn, request)
+			})
+		}
+		wg.Wait()
+
+		response := BatchResponse[Resp]{Results: results}
+		for _, result := range results {
+			if result.Error == "" {
+				response.Succeeded++
+			} else {
+				response.Failed++
+			}
+		}
+		batchMetrics.Add("succeeded", int64(response.Succeeded))
+		batchMetrics.Add("failed", int64(response.Failed))
+		a.writeJSON(w, r, response.StatusCode(), response)
+	}
+}
+
+// Runs fn for one entry, recording its result. The entry counts as a 500 until fn
+// returns, which is what it answers if fn panics; a.Go logs the panic.
+func runBatchEntry[Req, Resp any](a *App, r *http.Request, ctx context.Context, result *BatchResult[Resp], fn func(ctx context.Context, request Req) (Resp, error), request Req) {
+	failBatchEntry(r, result, http.StatusInternalServerError, "Internal Server Error")
+	if ctx.Err() != nil {
+		failBatchEntry(r, result, http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	response, err := fn(ctx, request)
+	if err != nil {
+		status, message := a.typedErrorStatus(r, err)
+		failBatchEntry(r, result, status, message)
+		return
+	}
+	*result = BatchResult[Resp]{Index: result.Index, Status: http.StatusOK}
+	if coder, ok := any(response).(StatusCoder); ok {
+		result.Status = coder.StatusCode()
+	}
+	if result.Status != http.StatusNoContent {
+		result.Result = &response
+	}
+}
+
+// Records a failed entry with the code and message an error response would carry
+func failBatchEntry[Resp any](r *http.Request, result *BatchResult[Resp], status int, message string) {
+	code, localized, _ := localizeError(r, status, message)
+	*result = BatchResult[Resp]{Index: result.Index, Status: status, Code: code, Error: localized, Retryable: retryableError(code, status)}
+}
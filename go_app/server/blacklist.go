@@ -0,0 +1,271 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Blacklist sizes, sweeps and evictions, published on /debug/vars
+var blacklistMetrics = expvar.NewMap("blacklist")
+
+// Size limits, retention and persistence of the token blacklists
+type BlacklistConfig struct {
+	// Above SoftLimit entries, expired entries are swept on every Add. At HardLimit the
+	// least recently used entry is evicted to make room. 0 disables a limit.
+	SoftLimit int
+	HardLimit int
+
+	// How long entries outlive their token's exp. /refresh accepts expired tokens, so a
+	// revoked token must stay listed for a while after it expires.
+	Retention time.Duration
+
+	// Snapshots are written here and reloaded on startup; persistence is off when empty
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+}
+
+type blacklistEntry struct {
+	Hash    string    `json:"hash"`
+	Expires time.Time `json:"expires"` // zero for tokens without exp
+}
+
+func (e blacklistEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+// Blacklist holding SHA-256 hashes of tokens with size limits and expiry, in LRU order
+type BoundedBlacklist struct {
+	Name   string
+	Config BlacklistConfig
+	Clock  Clock
+	Logger *log.Logger
+
+	mutex   sync.Mutex
+	order   *list.List // front is most recently used
+	entries map[string]*list.Element
+}
+
+func NewBoundedBlacklist(name string, config BlacklistConfig, clock Clock, logger *log.Logger) *BoundedBlacklist {
+	return &BoundedBlacklist{
+		Name:    name,
+		Config:  config,
+		Clock:   clock,
+		Logger:  logger,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (b *BoundedBlacklist) Contains(token string) bool {
+	return b.ContainsHash(hashToken(token))
+}
+
+// Contains for a token already hashed with hashToken, e.g. a cached verified token
+func (b *BoundedBlacklist) ContainsHash(hash string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	element, ok := b.entries[hash]
+	if !ok {
+		return false
+	}
+	if element.Value.(blacklistEntry).expired(b.Clock.Now()) {
+		b.remove(element)
+		return false
+	}
+	b.order.MoveToFront(element)
+	return true
+}
+
+func (b *BoundedBlacklist) Add(token string, expiresAt time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	entry := blacklistEntry{Hash: hashToken(token)}
+	if !expiresAt.IsZero() {
+		entry.Expires = expiresAt.Add(b.Config.Retention)
+	}
+	b.add(entry)
+}
+
+func (b *BoundedBlacklist) add(entry blacklistEntry) {
+	if element, ok := b.entries[entry.Hash]; ok {
+		element.Value = entry
+		b.order.MoveToFront(element)
+		return
+	}
+
+	if b.Config.SoftLimit > 0 && b.order.Len() >= b.Config.SoftLimit {
+		b.sweep()
+	}
+	for b.Config.HardLimit > 0 && b.order.Len() >= b.Config.HardLimit {
+		b.remove(b.order.Back())
+		blacklistMetrics.Add(b.Name+".evictions", 1)
+	}
+	b.entries[entry.Hash] = b.order.PushFront(entry)
+}
+
+// Drops expired entries
+func (b *BoundedBlacklist) sweep() {
+	now := b.Clock.Now()
+	for element := b.order.Back(); element != nil; {
+		previous := element.Prev()
+		if element.Value.(blacklistEntry).expired(now) {
+			b.remove(element)
+		}
+		element = previous
+	}
+	blacklistMetrics.Add(b.Name+".sweeps", 1)
+}
+
+func (b *BoundedBlacklist) remove(element *list.Element) {
+	b.order.Remove(element)
+	delete(b.entries, element.Value.(blacklistEntry).Hash)
+}
+
+// Number of entries, including expired ones not yet swept
+func (b *BoundedBlacklist) Len() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.order.Len()
+}
+
+func (b *BoundedBlacklist) snapshotPath() string {
+	return filepath.Join(b.Config.SnapshotDir, b.Name+".json")
+}
+
+// Writes the unexpired entries to the snapshot file, atomically replacing it
+func (b *BoundedBlacklist) Snapshot() error {
+	if b.Config.SnapshotDir == "" {
+		return nil
+	}
+
+	b.mutex.Lock()
+	b.sweep()
+	entries := make([]blacklistEntry, 0, b.order.Len())
+	// Least recently used first, so reloading restores the LRU order
+	for element := b.order.Back(); element != nil; element = element.Prev() {
+		entries = append(entries, element.Value.(blacklistEntry))
+	}
+	b.mutex.Unlock()
+	blacklistMetrics.Set(b.Name+".size", intVar(len(entries)))
+
+	content, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(b.Config.SnapshotDir, 0o700); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(b.Config.SnapshotDir, b.Name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), b.snapshotPath())
+}
+
+// Restores entries from the snapshot file; a missing file is not an error
+func (b *BoundedBlacklist) Load() error {
+	if b.Config.SnapshotDir == "" {
+		return nil
+	}
+	content, err := os.ReadFile(b.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []blacklistEntry
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("parse %s: %w", b.snapshotPath(), err)
+	}
+
+	now := b.Clock.Now()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, entry := range entries {
+		if !entry.expired(now) {
+			b.add(entry)
+		}
+	}
+	b.Logger.Printf("Loaded %d %s entries from %s", b.order.Len(), b.Name, b.snapshotPath())
+	return nil
+}
+
+func intVar(value int) *expvar.Int {
+	v := new(expvar.Int)
+	v.Set(int64(value))
+	return v
+}
+
+// Expiry of a token from its exp claim, or the zero time when it has none
+func tokenExpiry(claims jwt.MapClaims) time.Time {
+	switch exp := claims["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0)
+	case json.Number:
+		seconds, _ := exp.Int64()
+		return time.Unix(seconds, 0)
+	}
+	return time.Time{}
+}
+
+// Periodically snapshots persistent blacklists until ctx is done. Call SaveBlacklists
+// once more after shutdown so a restart does not resurrect used or revoked tokens.
+func (a *App) SnapshotBlacklists(ctx context.Context) {
+	interval := a.Config.Blacklist.SnapshotInterval
+	if a.Config.Blacklist.SnapshotDir == "" || interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.SaveBlacklists()
+		}
+	}
+}
+
+// Snapshots the blacklists that support persistence
+func (a *App) SaveBlacklists() {
+	for _, store := range []TokenBlacklist{a.Stores.Blacklist, a.Stores.Revocations} {
+		if bounded, ok := store.(*BoundedBlacklist); ok {
+			if err := bounded.Snapshot(); err != nil {
+				a.Logger.Printf("Snapshot of %s failed: %v", bounded.Name, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// Set at link time alongside BuildSHA, e.g.
+// -ldflags "-X go_app/server.BuildVersion=1.4.0 -X go_app/server.BuildDate=$(date -u +%FT%TZ)"
+var (
+	BuildVersion string
+	BuildDate    string
+)
+
+// What is running, as answered by /version and logged at startup
+type BuildInfo struct {
+	Service     string   `json:"service"`
+	Version     string   `json:"version"` // semantic version, empty when unknown
+	SHA         string   `json:"sha"`     // empty when no version source has one
+	BuildNumber string   `json:"buildNumber"`
+	BuildDate   string   `json:"buildDate"`
+	DeployTime  string   `json:"deployTime,omitempty"`
+	Region      string   `json:"region,omitempty"`
+	InstanceID  string   `json:"instanceId,omitempty"`
+	GoVersion   string   `json:"goVersion"`
+	Profile     string   `json:"profile,omitempty"` // config profile (env), when one is active
+	Features    []string `json:"features"`
+}
+
+// "my-application 1.4.0 (sha 3f2a9c1, build 42, built 2026-05-01T10:00:00Z, go1.24.0, profile staging), features: database, tls"
+func (info BuildInfo) String() string {
+	details := []string{"sha " + orUnknown(info.SHA), "build " + info.BuildNumber}
+	if info.BuildDate != "" {
+		details = append(details, "built "+info.BuildDate)
+	}
+	details = append(details, info.GoVersion)
+	if info.Profile != "" {
+		details = append(details, "profile "+info.Profile)
+	}
+	features := "none"
+	if len(info.Features) > 0 {
+		features = strings.Join(info.Features, ", ")
+	}
+	return fmt.Sprintf("%s %s (%s), features: %s", info.Service, orUnknown(info.Version), strings.Join(details, ", "), features)
+}
+
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
+
+// Describes the running build. Nothing here loads the metadata document: the version
+// comes from the build, or from the metadata only if it is already cached.
+func (a *App) BuildInfo(ctx context.Context) BuildInfo {
+	deployment := a.Deployment(ctx)
+	info := BuildInfo{
+		Service:     a.Config.Discovery.ServiceName,
+		Version:     BuildVersion,
+		BuildNumber: deployment.BuildNumber,
+		BuildDate:   BuildDate,
+		DeployTime:  deployment.DeployTime,
+		Region:      deployment.Region,
+		InstanceID:  deployment.InstanceID,
+		GoVersion:   runtime.Version(),
+		Profile:     a.Config.Profile,
+		Features:    a.features(),
+	}
+	if sha, err := a.Version.SHA(ctx); err == nil {
+		info.SHA = sha
+	}
+	if info.Version == "" {
+		if config, ok := a.configCache.Get(CONFIG_CACHE_KEY); ok {
+			info.Version, _ = config.Metadata["version"].(string)
+		}
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && build.Main.Version != "(devel)" {
+			info.Version = strings.TrimPrefix(build.Main.Version, "v")
+		}
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.time" && info.BuildDate == "" {
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// Optional subsystems this instance has turned on, sorted
+func (a *App) features() []string {
+	config := a.Config
+	enabled := map[string]bool{
+		"tls":                 config.TLS.CertFile != "",
+		"client-certificates": config.TLS.ClientCAFile != "",
+		"discovery":           config.Discovery.Backend != "",
+		"database":            config.Database.Driver != "",
+		"read-replicas":       config.Database.Driver != "" && config.Database.ReplicaURLs != "",
+		"ldap":                config.LDAP.URL != "",
+		"shared-locks":        config.Locks.Backend == LOCK_BACKEND_REDIS || config.Locks.Backend == LOCK_BACKEND_POSTGRES,
+		"uploads":             config.Files.Store != "",
+		"notifications":       config.Notify.WebhookURL != "" || config.Notify.SMTPAddr != "",
+		"graphql":             config.GraphQL,
+		"web":                 config.WebFS != nil,
+		"downstreams":         config.DownstreamServices != "",
+		"token-encryption":    config.Tokens.Encrypt,
+		"admin-port":          config.AdminPort != "",
+		"metrics-port":        config.MetricsPort != "",
+		"http3":               config.HTTP3.Enabled,
+	}
+	features := []string{}
+	for name, on := range enabled {
+		if on {
+			features = append(features, name)
+		}
+	}
+	sort.Strings(features)
+	return features
+}
+
+// GET /version: build details for fleet inventory, without a token or a metadata load
+func (a *App) versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	a.writeJSON(w, r, http.StatusOK, a.BuildInfo(r.Context()))
+}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/cache"
+)
+
+// Response cache hits, misses and shared (collapsed) requests, published on /debug/vars
+var cacheMetrics = expvar.NewMap("response_cache")
+
+// Limits of the response cache; the least recently used responses go first
+const (
+	RESPONSE_CACHE_MAX_ENTRIES = 10000
+	RESPONSE_CACHE_MAX_BYTES   = 64 << 20
+)
+
+// A captured response
+type cachedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// An in-flight request that identical concurrent requests wait for
+type inflightCall struct {
+	done     chan struct{}
+	response *cachedResponse
+}
+
+// Caches successful GET responses per route, path, query and principal, and collapses
+// concurrent identical requests into a single handler call
+type ResponseCache struct {
+	entries *cache.Cache[string, *cachedResponse]
+
+	mutex    sync.Mutex // guards inflight
+	inflight map[string]*inflightCall
+}
+
+func NewResponseCache(clock Clock) *ResponseCache {
+	return &ResponseCache{
+		entries: cache.New[string, *cachedResponse](cache.Options[*cachedResponse]{
+			Name:       "responses",
+			MaxEntries: RESPONSE_CACHE_MAX_ENTRIES,
+			MaxCost:    RESPONSE_CACHE_MAX_BYTES,
+			Cost:       func(response *cachedResponse) int64 { return int64(len(response.body)) },
+			Now:        clock.Now,
+		}),
+		inflight: make(map[string]*inflightCall),
+	}
+}
+
+// Cache key: route, then path and query, then the authenticated principal
+func responseCacheKey(route string, r *http.Request) string {
+	principal := "anonymous"
+	if user, ok := UserFromContext(r.Context()); ok {
+		principal = user.AuthMethod + ":" + user.ID
+	}
+	return route + "|" + r.URL.RequestURI() + "|" + principal
+}
+
+// Drops every entry of route
+func (c *ResponseCache) Invalidate(route string) {
+	c.entries.DeleteFunc(func(key string, _ *cachedResponse) bool {
+		return strings.HasPrefix(key, route+"|")
+	})
+}
+
+// Drops every entry
+func (c *ResponseCache) InvalidateAll() {
+	c.entries.Clear()
+}
+
+// Returns a fresh entry, or joins or starts the in-flight call for key. The leader
+// gets a nil call back and must finish it with complete.
+func (c *ResponseCache) lookup(key string) (*cachedResponse, *inflightCall, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if entry, ok := c.entries.Get(key); ok {
+		return entry, nil, false
+	}
+	if call, ok := c.inflight[key]; ok {
+		return nil, call, false
+	}
+	c.inflight[key] = &inflightCall{done: make(chan struct{})}
+	return nil, nil, true
+}
+
+func (c *ResponseCache) complete(key string, response *cachedResponse, ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	call := c.inflight[key]
+	delete(c.inflight, key)
+	if response != nil && response.status == http.StatusOK {
+		c.entries.SetWithTTL(key, response, ttl)
+	}
+	call.response = response
+	close(call.done)
+}
+
+// Buffers a response so it can be stored and replayed
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header { return r.header }
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+func writeCachedResponse(w http.ResponseWriter, response *cachedResponse, cacheStatus string) {
+	for name, values := range response.header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("X-Cache", cacheStatus)
+	w.WriteHeader(response.status)
+	w.Write(response.body)
+}
+
+// Serves GET requests on route from the cache for ttl after a successful response.
+// Requests with Overrides neither read nor fill the cache.
+func (a *App) cacheResponses(route string, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	if ttl <= 0 {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, overridden := OverridesFromContext(r.Context()); r.Method != http.MethodGet || overridden {
+			next(w, r)
+			return
+		}
+
+		key := responseCacheKey(route, r)
+		entry, call, leader := a.ResponseCache.lookup(key)
+		switch {
+		case entry != nil:
+			cacheMetrics.Add("hits", 1)
+			writeCachedResponse(w, entry, "HIT")
+			return
+		case call != nil:
+			<-call.done
+			if call.response != nil {
+				cacheMetrics.Add("shared", 1)
+				writeCachedResponse(w, call.response, "SHARED")
+				return
+			}
+			// The leader failed without a response, try on our own
+			next(w, r)
+			return
+		case leader:
+			cacheMetrics.Add("misses", 1)
+		}
+
+		var response *cachedResponse
+		defer func() { a.ResponseCache.complete(key, response, ttl) }()
+
+		recorder := &responseRecorder{header: http.Header{}}
+		next(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		response = &cachedResponse{status: recorder.status, header: recorder.header, body: recorder.body.Bytes()}
+		writeCachedResponse(w, response, "MISS")
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/telemetry"
+)
+
+// Limits of traffic shadowing. Requests with larger bodies, or arriving while the
+// shadows in flight are at the limit, are not shadowed.
+const (
+	MAX_SHADOW_BODY      = 1 << 20
+	MAX_SHADOWS_INFLIGHT = 64
+	SHADOW_TIMEOUT       = 10 * time.Second
+)
+
+// Outcomes of comparing a shadow response with the one the client got
+const (
+	SHADOW_MATCH           = "match"
+	SHADOW_STATUS_MISMATCH = "status_mismatch"
+	SHADOW_BODY_MISMATCH   = "body_mismatch"
+	SHADOW_ERROR           = "error"
+	SHADOW_SKIPPED         = "skipped"
+)
+
+// Canary routing and traffic shadowing
+type TrafficConfig struct {
+	CanaryHeader  string // "1"/"true" asks for a route's Canary, "0"/"false" for its Handler
+	CanaryPercent int    // share of requests without the header served by the Canary
+	ShadowRoutes  string // "pattern=url" pairs, e.g. "GET /status=http://status-v2:3000"
+	ShadowPercent int    // share of requests on shadowed routes that are duplicated
+	ShadowIgnore  string // JSON Pointers left out of comparisons, "*" matching any member, e.g. "/my-application/*/sha"
+}
+
+var (
+	canaryRequests = telemetry.NewCounter("http.server.canary.requests",
+		"Requests on routes with a canary, by the implementation that served them", "1")
+	shadowComparisons = telemetry.NewCounter("http.server.shadow.comparisons",
+		"Shadowed requests by how the shadow response compared to the served one", "1")
+	shadowDifferences = telemetry.NewCounter("http.server.shadow.differences",
+		"Members of JSON responses that differ between the shadow and the served one, by JSON Pointer with array indices as *", "1")
+)
+
+// Serves requests on route with canary when they ask for it with the canary header, or
+// else for canary-percent of them, and with stable otherwise. Canary responses carry
+// the header with "true".
+func (a *App) routeCanary(route string, stable, canary http.HandlerFunc) http.HandlerFunc {
+	header := a.Config.Traffic.CanaryHeader
+	return func(w http.ResponseWriter, r *http.Request) {
+		useCanary := rand.IntN(100) < a.Config.Traffic.CanaryPercent
+		if value := r.Header.Get(header); header != "" && value != "" {
+			useCanary, _ = strconv.ParseBool(value)
+		}
+		variant := "stable"
+		if useCanary {
+			variant = "canary"
+			if header != "" {
+				w.Header().Set(header, "true")
+			}
+		}
+		canaryRequests.Add(r.Context(), 1, telemetry.String("http.route", route), telemetry.String("variant", variant))
+		if useCanary {
+			canary(w, r)
+			return
+		}
+		stable(w, r)
+	}
+}
+
+// Where a shadowed route's requests are duplicated to: an in-process handler, or
+// another deployment's base URL
+type shadowTarget struct {
+	handler http.HandlerFunc
+	url     string
+}
+
+// The shadow target of route: the route table's Shadow, else a shadow-routes entry
+func (a *App) shadowTarget(route Route) (shadowTarget, bool) {
+	if route.Shadow != nil {
+		return shadowTarget{handler: route.Shadow}, true
+	}
+	for _, pair := range configList(a.Config.Traffic.ShadowRoutes) {
+		if pattern, url, ok := strings.Cut(pair, "="); ok && strings.TrimSpace(pattern) == route.Pattern() {
+			return shadowTarget{url: strings.TrimSuffix(strings.TrimSpace(url), "/")}, true
+		}
+	}
+	return shadowTarget{}, false
+}
+
+// Serves requests on route with next and, for shadow-percent of them, replays the
+// request against target once the client has its response. The shadow response is
+// discarded; only whether its status and body match is logged and counted.
+func (a *App) shadow(route string, target shadowTarget, next http.HandlerFunc) http.HandlerFunc {
+	slots := make(chan struct{}, MAX_SHADOWS_INFLIGHT)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if rand.IntN(100) >= a.Config.Traffic.ShadowPercent {
+			next(w, r)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, MAX_SHADOW_BODY+1))
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		if err != nil || len(body) > MAX_SHADOW_BODY {
+			shadowComparisons.Add(r.Context(), 1, telemetry.String("http.route", route), telemetry.String("result", SHADOW_SKIPPED))
+			next(w, r)
+			return
+		}
+
+		served := newDigestWriter(w)
+		next(served, r)
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			shadowComparisons.Add(r.Context(), 1, telemetry.String("http.route", route), telemetry.String("result", SHADOW_SKIPPED))
+			return
+		}
+		// The shadow outlives the request, but keeps its principal and trace
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), SHADOW_TIMEOUT)
+		shadowRequest := r.Clone(ctx)
+		shadowRequest.Body = io.NopCloser(bytes.NewReader(body))
+		a.Go(ctx, func(ctx context.Context) {
+			defer func() { <-slots }()
+			defer cancel()
+			shadowed, err := a.runShadow(target, shadowRequest)
+			a.compareShadow(shadowRequest, route, served, shadowed, err)
+		})
+	}
+}
+
+// Sends r to target and returns what it answered
+func (a *App) runShadow(target shadowTarget, r *http.Request) (*digestWriter, error) {
+	if target.handler != nil {
+		shadowed := newDigestWriter(discardWriter{header: http.Header{}})
+		target.handler(shadowed, r)
+		return shadowed, nil
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, target.url+r.URL.RequestURI(), r.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	if span, ok := telemetry.SpanFromContext(r.Context()); ok {
+		req.Header.Set("traceparent", span.Traceparent())
+	}
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	shadowed := newDigestWriter(discardWriter{header: resp.Header})
+	shadowed.WriteHeader(resp.StatusCode)
+	if _, err := io.Copy(shadowed, resp.Body); err != nil {
+		return nil, err
+	}
+	return shadowed, nil
+}
+
+// Compares the shadow's response with the served one. JSON bodies that differ byte for
+// byte are compared as documents, so member order and formatting don't count, nor the
+// members of shadow-ignore; the members that still differ are logged and counted.
+func (a *App) compareShadow(r *http.Request, route string, served, shadowed *digestWriter, err error) {
+	servedStatus, status := served.statusCode(), 0
+	if err == nil {
+		status = shadowed.statusCode()
+	}
+	var differences []string
+	result := SHADOW_MATCH
+	switch {
+	case err != nil:
+		result = SHADOW_ERROR
+	case status != servedStatus:
+		result = SHADOW_STATUS_MISMATCH
+	case !bytes.Equal(shadowed.digest.Sum(nil), served.digest.Sum(nil)):
+		result = SHADOW_BODY_MISMATCH
+		if found, ok := jsonDifferences(served, shadowed, a.shadowIgnored()); ok {
+			if differences = found; len(differences) == 0 {
+				result = SHADOW_MATCH
+			}
+		}
+	}
+	shadowComparisons.Add(r.Context(), 1, telemetry.String("http.route", route), telemetry.String("result", result))
+	for _, difference := range differences {
+		shadowDifferences.Add(r.Context(), 1, telemetry.String("http.route", route), telemetry.String("field", fieldPattern(difference)))
+	}
+
+	attrs := []any{"route", route, "path", r.URL.Path, "result", result, "status", servedStatus, "shadow_status", status}
+	switch {
+	case err != nil:
+		a.Log.Warn("shadow request failed", append(attrs, "error", err)...)
+	case result != SHADOW_MATCH:
+		if len(differences) > 0 {
+			attrs = append(attrs, "differences", differences)
+		}
+		a.Log.Warn("shadow response differs", attrs...)
+	default:
+		a.Log.Debug("shadow response matches", attrs...)
+	}
+}
+
+// Passes a response through while hashing its body, keeping the first MAX_SHADOW_BODY
+// bytes of it to compare as JSON
+type digestWriter struct {
+	statusWriter
+	digest    hash.Hash
+	body      bytes.Buffer
+	truncated bool
+}
+
+func newDigestWriter(w http.ResponseWriter) *digestWriter {
+	return &digestWriter{statusWriter: statusWriter{ResponseWriter: w}, digest: sha256.New()}
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	w.digest.Write(p)
+	if !w.truncated {
+		if w.body.Len()+len(p) > MAX_SHADOW_BODY {
+			w.truncated = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.statusWriter.Write(p)
+}
+
+func (w *digestWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// A response nobody reads, for in-process shadows
+type discardWriter struct {
+	header http.Header
+}
+
+func (w discardWriter) Header() http.Header         { return w.header }
+func (w discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,27 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+)
+
+// Requests whose context ended before the handler returned, per route, split into
+// "<route>.client_canceled" and "<route>.deadline_exceeded", published on /debug/vars
+var canceledMetrics = expvar.NewMap("canceled_requests")
+
+// Counts requests on route that were given up on while being handled: the client
+// disconnected, or the route's timeout passed. Handlers and the stores, sources and
+// commands they call take the request's context, so that work stops with it.
+func countCanceled(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(w, r)
+		switch err := r.Context().Err(); {
+		case errors.Is(err, context.DeadlineExceeded):
+			canceledMetrics.Add(route+".deadline_exceeded", 1)
+		case err != nil:
+			canceledMetrics.Add(route+".client_canceled", 1)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"go_app/storage/blob"
+)
+
+// Outcomes of a self-check
+const (
+	CHECK_OK   = "ok"
+	CHECK_WARN = "warn"
+	CHECK_FAIL = "fail"
+	CHECK_SKIP = "skip"
+)
+
+// Time allowed for each dependency check
+const CHECK_TIMEOUT = 5 * time.Second
+
+// One line of the diagnostic report
+type CheckResult struct {
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Detail   string        `json:"detail"`
+	Duration time.Duration `json:"duration"`
+}
+
+// Validates config, key material and every configured dependency without serving
+// requests. Used by the -check flag and `scaffold doctor`, e.g. in init containers.
+func Check(ctx context.Context, config Config) []CheckResult {
+	var results []CheckResult
+	run := func(name string, check func(ctx context.Context) (string, string)) {
+		ctx, cancel := context.WithTimeout(ctx, CHECK_TIMEOUT)
+		defer cancel()
+		start := time.Now()
+		status, detail := check(ctx)
+		results = append(results, CheckResult{Name: name, Status: status, Detail: detail, Duration: time.Since(start)})
+	}
+
+	run("config", func(context.Context) (string, string) { return checkConfig(config) })
+	run("port", func(context.Context) (string, string) { return checkPort(config) })
+	if config.AdminPort != "" {
+		run("admin port", func(context.Context) (string, string) {
+			return checkTCPAddress(net.JoinHostPort(config.AdminHost, config.AdminPort))
+		})
+	}
+	if config.MetricsPort != "" {
+		run("metrics port", func(context.Context) (string, string) { return checkTCPAddress(":" + config.MetricsPort) })
+	}
+
+	// Building the App loads signing keys, opens the database and unwraps the metadata key
+	var app *App
+	run("startup", func(context.Context) (string, string) {
+		var err error
+		if app, err = New(config); err != nil {
+			return CHECK_FAIL, err.Error()
+		}
+		return CHECK_OK, "dependencies initialized"
+	})
+	if app == nil {
+		return results
+	}
+	if app.DB != nil {
+		defer app.DB.Close()
+	}
+
+	run("signing keys", app.checkSigningKeys)
+	run("tls", app.checkTLS)
+	run("version", app.checkVersion)
+	run("metadata", app.checkMetadata)
+	run("database", app.checkDatabase)
+	run("discovery", app.checkDiscovery)
+	run("files store", app.checkBlobs)
+	for _, service := range parseDownstreams(config.DownstreamServices) {
+		run("downstream "+service.Name, func(ctx context.Context) (string, string) {
+			return app.checkDownstream(ctx, service)
+		})
+	}
+	run("notifications", app.checkNotifications)
+	return results
+}
+
+// Prints results as an aligned table and reports whether no check failed
+func WriteCheckReport(w io.Writer, results []CheckResult) bool {
+	ok := true
+	for _, result := range results {
+		if result.Status == CHECK_FAIL {
+			ok = false
+		}
+		fmt.Fprintf(w, "%-5s %-24s %s (%s)\n", result.Status, result.Name, result.Detail, result.Duration.Round(time.Millisecond))
+	}
+	return ok
+}
+
+// Flags settings that parse but would be silently ignored at runtime
+func checkConfig(config Config) (string, string) {
+	var problems []string
+	for key, value := range map[string]string{
+		"introspection-clients": config.IntrospectionClients,
+		"api-keys":              config.Auth.APIKeys,
+		"hmac-clients":          config.Auth.HMACClients,
+	} {
+		for _, pair := range configList(value) {
+			if id, secret, ok := strings.Cut(pair, ":"); !ok || id == "" || secret == "" {
+				problems = append(problems, key+": malformed entry (expected id:secret)")
+			}
+		}
+	}
+	for _, pair := range configList(config.RateLimitTiers) {
+		tier, limit, _ := strings.Cut(pair, ":")
+		if _, err := strconv.Atoi(limit); tier == "" || err != nil {
+			problems = append(problems, fmt.Sprintf("rate-limit-tiers: malformed entry %q", pair))
+		}
+	}
+	for _, pair := range configList(config.Quota.Tiers) {
+		if _, _, ok := parseTierPair(pair); !ok {
+			problems = append(problems, fmt.Sprintf("quota-tiers: malformed entry %q", pair))
+		}
+	}
+	for _, pattern := range parsePublicRoutes(config.PublicRoutes) {
+		if _, err := path.Match(strings.TrimSuffix(pattern, "/**"), "/"); err != nil {
+			problems = append(problems, fmt.Sprintf("public-routes: bad pattern %q", pattern))
+		}
+	}
+	for _, name := range parseStrategies(config.Auth.Strategies) {
+		if !knownStrategy(name) {
+			problems = append(problems, fmt.Sprintf("auth-strategies: unknown strategy %q", name))
+		}
+	}
+	if config.ExampleUserPassword == DefaultConfig().ExampleUserPassword {
+		problems = append(problems, "example-user-password: still the default")
+	}
+
+	if len(problems) > 0 {
+		return CHECK_WARN, strings.Join(problems, "; ")
+	}
+	return CHECK_OK, "valid"
+}
+
+func configList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func knownStrategy(name string) bool {
+	switch name {
+	case STRATEGY_JWT, STRATEGY_MTLS, STRATEGY_APIKEY, STRATEGY_HMAC, STRATEGY_BASIC, STRATEGY_OIDC:
+		return true
+	}
+	return false
+}
+
+// Binds the configured address briefly to make sure nothing else holds it
+func checkPort(config Config) (string, string) {
+	address := config.ListenAddr
+	switch {
+	case address == "systemd":
+		return CHECK_SKIP, "socket passed by systemd"
+	case strings.HasPrefix(address, "unix://"):
+		socket := strings.TrimPrefix(address, "unix://")
+		if conn, err := net.Dial("unix", socket); err == nil {
+			conn.Close()
+			return CHECK_FAIL, socket + " is in use"
+		}
+		return CHECK_OK, socket + " is free"
+	case address == "":
+		address = ":" + config.Port
+	}
+	return checkTCPAddress(address)
+}
+
+func checkTCPAddress(address string) (string, string) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	listener.Close()
+	return CHECK_OK, address + " is available"
+}
+
+// Signs a token with the current key and verifies it the way requests are verified
+func (a *App) checkSigningKeys(ctx context.Context) (string, string) {
+	key := a.Keys.Current()
+	claims := jwt.MapClaims{"sub": "self-check", "exp": a.Clock.Now().Add(time.Minute).Unix()}
+	if a.Config.Tokens.Audience != "" {
+		claims["aud"] = a.Config.Tokens.Audience
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.Private)
+	if err != nil {
+		return CHECK_FAIL, "signing: " + err.Error()
+	}
+	protection := key.Method.Alg()
+	if a.Config.Tokens.Encrypt {
+		if signed, err = encryptToken(key, signed); err != nil {
+			return CHECK_FAIL, "encryption: " + err.Error()
+		}
+		protection += " in " + JWE_ENCRYPTION
+	}
+	if _, err := a.parseToken(ctx, signed, false); err != nil {
+		return CHECK_FAIL, "verification: " + err.Error()
+	}
+	return CHECK_OK, fmt.Sprintf("%s key %s, %d verification keys", protection, key.ID, len(a.Keys.VerificationKeys()))
+}
+
+func (a *App) checkTLS(context.Context) (string, string) {
+	if a.Config.TLS.CertFile == "" {
+		return CHECK_SKIP, "TLS is off"
+	}
+	if _, err := a.TLSConfig(); err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	return CHECK_OK, "certificate loaded, client certificates " + a.Config.TLS.ClientAuth
+}
+
+// Loads the metadata document as /status would, including decryption, and checks it
+// against MetadataSchema
+func (a *App) checkMetadata(ctx context.Context) (string, string) {
+	config, err := a.loadConfiguration(ctx)
+	if err != nil {
+		return CHECK_FAIL, fmt.Sprintf("%s from %s", err, a.MetadataSource)
+	}
+	if problems := ValidateMetadata(config.Metadata); len(problems) > 0 {
+		return CHECK_FAIL, fmt.Sprintf("%s from %s (%d problems)", problems[0], a.MetadataSource, len(problems))
+	}
+	return CHECK_OK, fmt.Sprintf("version %s from %s", config.Metadata["version"], a.MetadataSource)
+}
+
+func (a *App) checkVersion(ctx context.Context) (string, string) {
+	sha, err := a.Version.SHA(ctx)
+	if err != nil {
+		return CHECK_FAIL, fmt.Sprintf("%s: %v", a.Version, err)
+	}
+	return CHECK_OK, fmt.Sprintf("%s from %s", sha, a.Version)
+}
+
+func (a *App) checkDatabase(ctx context.Context) (string, string) {
+	if a.DB == nil {
+		return CHECK_SKIP, "in-memory stores"
+	}
+	if err := a.DB.PingContext(ctx); err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	if a.Database != nil {
+		if a.Database.Check(ctx); len(a.Database.replicas) > 0 {
+			_, usable, replicas := a.Database.Health()
+			return CHECK_OK, fmt.Sprintf("%s reachable, %d/%d replicas usable", a.Config.Database.Driver, usable, replicas)
+		}
+	}
+	return CHECK_OK, a.Config.Database.Driver + " reachable"
+}
+
+func (a *App) checkDiscovery(ctx context.Context) (string, string) {
+	if a.Discovery == nil {
+		return CHECK_SKIP, "registration is off"
+	}
+	instances, err := a.Discovery.Registry.Instances(ctx, a.Config.Discovery.ServiceName)
+	if err != nil {
+		return CHECK_FAIL, fmt.Sprintf("%s at %s: %s", a.Config.Discovery.Backend, a.Config.Discovery.Addr, err)
+	}
+	return CHECK_OK, fmt.Sprintf("%s reachable, %d instances of %s registered", a.Config.Discovery.Backend, len(instances), a.Config.Discovery.ServiceName)
+}
+
+// Reads a key that does not exist, which needs access to the store but changes nothing
+func (a *App) checkBlobs(ctx context.Context) (string, string) {
+	if a.Blobs == nil {
+		return CHECK_SKIP, "uploads are off"
+	}
+	body, _, err := a.Blobs.Get(ctx, "doctor-probe")
+	if err == nil {
+		body.Close()
+	} else if !errors.Is(err, blob.ErrNotFound) {
+		return CHECK_FAIL, fmt.Sprintf("%s: %s", a.Blobs, err)
+	}
+	return CHECK_OK, a.Blobs.String() + " reachable"
+}
+
+// Probes the downstream's /healthz, which unlike /status needs no token
+func (a *App) checkDownstream(ctx context.Context, service downstream) (string, string) {
+	base, err := a.downstreamURL(ctx, service)
+	if err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/healthz", nil)
+	if err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return CHECK_FAIL, err.Error()
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return CHECK_FAIL, fmt.Sprintf("%s/healthz answered %s", base, resp.Status)
+	}
+	return CHECK_OK, base + " is healthy"
+}
+
+// Dials the notification backends without sending anything
+func (a *App) checkNotifications(ctx context.Context) (string, string) {
+	var targets []string
+	if a.Config.Notify.WebhookURL != "" {
+		if parsed, err := url.Parse(a.Config.Notify.WebhookURL); err == nil {
+			port := parsed.Port()
+			if port == "" {
+				port = map[string]string{"http": "80", "https": "443"}[parsed.Scheme]
+			}
+			targets = append(targets, net.JoinHostPort(parsed.Hostname(), port))
+		}
+	}
+	if a.Config.Notify.SMTPAddr != "" {
+		targets = append(targets, a.Config.Notify.SMTPAddr)
+	}
+	if len(targets) == 0 {
+		return CHECK_SKIP, "no backends configured"
+	}
+
+	var dialer net.Dialer
+	for _, target := range targets {
+		conn, err := dialer.DialContext(ctx, "tcp", target)
+		if err != nil {
+			return CHECK_FAIL, err.Error()
+		}
+		conn.Close()
+	}
+	return CHECK_OK, strings.Join(targets, ", ") + " reachable"
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A claim a route's tokens must carry, e.g. {Name: "tenant_tier", Values: []string{"gold"}}.
+// A claim holding an array satisfies it when any element matches.
+type ClaimRequirement struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values,omitempty"` // any of these; empty only requires the claim
+}
+
+// Reports whether claims satisfy the requirement. Values are compared as text, so
+// numbers and booleans are listed as "2" or "true".
+func (c ClaimRequirement) satisfiedBy(claims map[string]interface{}) bool {
+	value, ok := claims[c.Name]
+	if !ok || value == nil {
+		return false
+	}
+	if len(c.Values) == 0 {
+		return true
+	}
+	elements, isArray := value.([]interface{})
+	if !isArray {
+		elements = []interface{}{value}
+	}
+	for _, element := range elements {
+		if contains(c.Values, fmt.Sprint(element)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c ClaimRequirement) String() string {
+	if len(c.Values) == 0 {
+		return c.Name
+	}
+	return c.Name + "=" + strings.Join(c.Values, "|")
+}
+
+// Answers 403 unless the token carries every one of claims
+func (a *App) requireClaims(claims []ClaimRequirement, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Authentication required")
+			return
+		}
+		for _, claim := range claims {
+			if !claim.satisfiedBy(user.Claims) {
+				a.Log.Debug("Required claim missing", "claim", claim.String(), "user", user.ID)
+				a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Missing required claim")
+				return
+			}
+		}
+		next(w, r)
+	}
+}
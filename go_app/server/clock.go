@@ -0,0 +1,46 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// Source of the current time, replaceable in tests
+type Clock interface {
+	Now() time.Time
+}
+
+// Clock backed by the system time
+type RealClock struct{}
+
+func (RealClock) Now() time.Time { return time.Now() }
+
+// Clock that only moves when told to, so expiry can be tested without sleeping
+type MockClock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+func NewMockClock(now time.Time) *MockClock {
+	return &MockClock{now: now}
+}
+
+func (c *MockClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Moves the clock forward by d
+func (c *MockClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Jumps the clock to now
+func (c *MockClock) Set(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = now
+}
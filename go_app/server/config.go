@@ -0,0 +1,680 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"go_app/accesslog"
+	"go_app/configformat"
+	"go_app/i18n"
+	"go_app/notifier"
+	"go_app/telemetry"
+)
+
+// Prefix for environment variables that override config values
+const ENV_PREFIX = "APP_"
+
+// Config keys whose values are replaced by "REDACTED" when the config is dumped
+var secretConfigKeys = map[string]bool{
+	"admin-token":               true,
+	"example-user-password":     true,
+	"introspection-clients":     true,
+	"notify-smtp-password":      true,
+	"api-keys":                  true,
+	"database-url":              true,
+	"database-replica-urls":     true,
+	"hmac-clients":              true,
+	"metadata-key":              true,
+	"otlp-headers":              true,
+	"webhook-secrets":           true,
+	"csrf-secret":               true,
+	"session-cookie-keys":       true,
+	"ldap-bind-password":        true,
+	"lock-redis-url":            true,
+	"registration-invite-codes": true,
+	"downstream-authorization":  true,
+}
+
+// Runtime settings for the service, resolved by LoadConfig
+type Config struct {
+	Port                string
+	ListenAddr          string
+	AdminPort           string // separate listener for admin and debug routes when set
+	AdminHost           string // interface the admin listener binds to
+	MetricsPort         string // separate listener for /metrics when set
+	MetadataPath        string
+	MetadataFormat      string // json, yaml, toml, hcl or auto to detect by extension
+	ConfigSource        string
+	ConfigChangeHistory int // metadata changes kept for /admin/config/changes
+	BuildNumber         string
+	VersionSource       string // where the commit SHA comes from, see VERSION_SOURCE_*
+	VersionFile         string // read by the file version source
+	RouteGroups         string // route groups mounted at startup and on SIGHUP, comma separated
+	SingleUseRoutes     string // route patterns, e.g. "POST /files", that accept a token once
+	AdminToken          string
+	ExampleUserPassword string
+
+	// production or development; development adds failure reasons to auth errors
+	Environment string
+
+	// Config profile, e.g. dev, staging or prod (APP_ENV). The metadata file gets the
+	// overlay of the same name, metadata.<profile>.json for metadata.json.
+	Profile string
+
+	// Level of App.Log: debug, info, warn or error; changeable at runtime
+	LogLevel string
+
+	// Data key for ENC[...] values in the metadata, or the same key encrypted with KMS
+	MetadataKey    string
+	MetadataKMSKey string
+
+	// Client credentials allowed to call /introspect, as "id:secret,id2:secret2"
+	IntrospectionClients string
+
+	// Services whose /status is included in ours, as "name=url" or discovery names
+	DownstreamServices string
+	DownstreamTimeout  time.Duration
+	// Authorization header of the downstream /status calls, e.g. "Bearer <service token>";
+	// the caller's own credentials are never forwarded
+	DownstreamAuthorization string
+
+	// Glob patterns of paths served without a token on routes without an explicit Auth
+	PublicRoutes string
+
+	// Per-minute rate limits by token plan/tier, as "free:30,pro:600"
+	RateLimitTiers string
+
+	// Browser origins allowed to make cross-origin requests, "*" for any
+	CORSOrigins string
+
+	// Local development profile, see devProfile
+	Dev bool
+
+	TLS          TLSConfig
+	Discovery    DiscoveryConfig
+	Login        LoginConfig
+	LoadShed     LoadShedConfig
+	Connections  ConnectionConfig
+	Notify       NotifyConfig
+	Blacklist    BlacklistConfig
+	Tokens       TokenConfig
+	Auth         AuthConfig
+	Database     DatabaseConfig
+	Workers      WorkerConfig
+	Files        FilesConfig
+	Network      NetworkConfig
+	JSON         JSONConfig
+	Telemetry    TelemetryConfig
+	Traffic      TrafficConfig
+	Quota        QuotaConfig
+	Webhooks     WebhookConfig
+	Policy       PolicyConfig
+	Cookies      CookieConfig
+	LDAP         LDAPConfig
+	Locks        LockConfig
+	Registration RegistrationConfig
+	OIDC         OIDCConfig
+	AccessLog    AccessLogConfig
+	Deployment   DeploymentConfig
+	HTTP3        HTTP3Config
+	Shutdown     ShutdownConfig
+
+	// How long tenant overlays are cached by each replica, unless an overlay sets its own
+	TenantConfigTTL time.Duration
+
+	// Sessions unused for longer than this end; their tokens can no longer be refreshed
+	SessionIdleTimeout time.Duration
+	// Sessions older than this end however much they are used; 0 for no limit
+	SessionMaxAge time.Duration
+	// Sessions a user may have at once; logging in again ends the least recently used.
+	// 0 for no limit.
+	SessionLimit int
+	// How often ended sessions are deleted, by one replica at a time; 0 disables it
+	SessionSweepInterval time.Duration
+
+	// Requests running longer than this are logged with a stack sample; 0 disables it
+	SlowRequestThreshold time.Duration
+
+	// How often route SLO burn rates are checked for alerts; 0 disables the alerts
+	SLOEvaluationInterval time.Duration
+
+	// Goroutines started with App.Go still running this long after their request are
+	// reported as leaked; 0 disables it
+	GoroutineLeakTimeout time.Duration
+
+	// Serve POST /graphql
+	GraphQL bool
+
+	// Break the duration of each response down in a Server-Timing header
+	ServerTiming bool
+
+	// Run the self-checks, print the report and exit instead of serving
+	CheckOnly bool
+
+	// Frontend assets served at / when non-nil
+	WebFS fs.FS
+}
+
+// SQL database for persistent stores; in-memory stores are used when Driver is empty
+type DatabaseConfig struct {
+	Driver         string        // database/sql driver name, e.g. sqlite
+	URL            string        // driver specific DSN of the primary
+	ReplicaURLs    string        // DSNs of read replicas, separated by commas
+	MaxReplicaLag  time.Duration // replicas further behind serve no reads; 0 ignores lag
+	HealthInterval time.Duration // how often the primary and replicas are checked
+}
+
+// Size of the App's worker pool for expensive tasks
+type WorkerConfig struct {
+	Size      int // workers, GOMAXPROCS when 0
+	QueueSize int // tasks allowed to wait for a worker
+}
+
+// Authentication strategies
+type AuthConfig struct {
+	Strategies  string // tried in order on routes without an explicit Auth, e.g. "mtls,jwt"
+	APIKeys     string // "name:key" pairs
+	HMACClients string // "id:secret" pairs
+	BasicDev    bool
+}
+
+// Token signing keys
+type TokenConfig struct {
+	Algorithm      string // HS256 or ES256
+	PreviousKeys   int    // keys kept for verification after a rotation
+	RotatePerLogin bool   // a fresh key for every issued token, invalidating earlier ones
+	Scopes         string // space separated scopes login can grant
+	Audience       string // the "aud" claim of issued tokens, required of presented ones when set
+	Encrypt        bool   // issue signed tokens wrapped in a JWE so clients can't read the claims
+	// How long after exp a token may still be refreshed; 0 refreshes unexpired tokens only
+	RefreshGrace time.Duration
+}
+
+// Thresholds for login brute-force protection
+type LoginConfig struct {
+	MaxAttempts int
+	Lockout     time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// Values the dev profile gives keys that no config layer sets: a SQLite database in the
+// working directory, detailed errors and debug logs, any browser origin and
+// Server-Timing headers
+var devProfile = map[string]string{
+	"environment":     ENVIRONMENT_DEVELOPMENT,
+	"log-level":       "debug",
+	"database-driver": "sqlite",
+	"database-url":    "file:dev.db",
+	"cors-origins":    "*",
+	"server-timing":   "true",
+}
+
+// Compiled-in defaults, the lowest config layer
+func DefaultConfig() Config {
+	return Config{
+		Port:                "3000",
+		AdminHost:           "127.0.0.1",
+		MetadataPath:        "./metadata.json",
+		MetadataFormat:      configformat.AUTO,
+		ConfigChangeHistory: DEFAULT_CONFIG_CHANGE_HISTORY,
+		VersionSource:       VERSION_SOURCE_AUTO,
+		VersionFile:         "VERSION",
+		ExampleUserPassword: "password",
+		Environment:         ENVIRONMENT_PRODUCTION,
+		LogLevel:            "info",
+		Traffic: TrafficConfig{
+			CanaryHeader:  "X-Canary",
+			ShadowPercent: 100,
+		},
+		Telemetry: TelemetryConfig{
+			Backends:     METRICS_BACKEND_PROMETHEUS,
+			OTLPInterval: telemetry.DEFAULT_OTLP_INTERVAL,
+		},
+		JSON: JSONConfig{
+			Naming:     JSON_NAMING_CAMEL,
+			TimeFormat: JSON_TIME_RFC3339,
+		},
+		TLS: TLSConfig{
+			ClientAuth: CLIENT_AUTH_NONE,
+		},
+		Discovery: DiscoveryConfig{
+			ServiceName: "my-application",
+		},
+		Login: LoginConfig{
+			MaxAttempts: 5,
+			Lockout:     15 * time.Minute,
+			BaseDelay:   time.Second,
+			MaxDelay:    30 * time.Second,
+		},
+		LoadShed: LoadShedConfig{
+			MaxInFlight:  100,
+			MaxQueue:     50,
+			QueueTimeout: 100 * time.Millisecond,
+		},
+		Connections: ConnectionConfig{
+			MaxHeaderBytes:    64 << 10,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+		},
+		Notify: NotifyConfig{
+			Triggers:    notifier.EVENT_AUTH_FAILURES + "," + notifier.EVENT_PANIC,
+			Interval:    5 * time.Minute,
+			EmailLocale: i18n.DEFAULT_LOCALE,
+		},
+		PublicRoutes:         "/,/healthz,/metrics,/docs/**,/.well-known/**",
+		SessionIdleTimeout:   30 * 24 * time.Hour,
+		SessionSweepInterval: 10 * time.Minute,
+		Locks: LockConfig{
+			Backend: LOCK_BACKEND_MEMORY,
+		},
+		Registration: RegistrationConfig{
+			Mode:              REGISTRATION_CLOSED,
+			MinPasswordLength: 12,
+			PasswordClasses:   2,
+			VerificationTTL:   24 * time.Hour,
+		},
+		TenantConfigTTL: time.Minute,
+		Database: DatabaseConfig{
+			MaxReplicaLag:  5 * time.Second,
+			HealthInterval: 10 * time.Second,
+		},
+		Auth: AuthConfig{
+			Strategies: STRATEGY_JWT,
+		},
+		Tokens: TokenConfig{
+			Algorithm:      ALGORITHM_HS256,
+			RotatePerLogin: true,
+			Scopes:         SCOPE_STATUS_READ,
+		},
+		Blacklist: BlacklistConfig{
+			SoftLimit:        50000,
+			HardLimit:        100000,
+			Retention:        24 * time.Hour,
+			SnapshotInterval: time.Minute,
+		},
+		Files: FilesConfig{
+			MaxSize:           10 << 20,
+			AllowedExtensions: ".jpg,.jpeg,.png,.gif,.webp,.pdf,.txt,.csv",
+		},
+		Workers: WorkerConfig{
+			QueueSize: 256,
+		},
+		Webhooks: WebhookConfig{
+			Tolerance: 5 * time.Minute,
+		},
+		Policy: PolicyConfig{
+			Timezone: "UTC",
+		},
+		Cookies: CookieConfig{
+			SameSite: "lax",
+		},
+		OIDC: OIDCConfig{
+			MaxStale: 24 * time.Hour,
+		},
+		HTTP3: HTTP3Config{
+			MaxAge: 24 * time.Hour,
+		},
+		Shutdown: ShutdownConfig{
+			GracePeriod: 25 * time.Second,
+		},
+		Deployment: DeploymentConfig{
+			Metadata: DEPLOYMENT_METADATA_NONE,
+		},
+		AccessLog: AccessLogConfig{
+			Format:      ACCESS_LOG_OFF,
+			Destination: "stdout",
+			MaxSizeMB:   100,
+			MaxBackups:  5,
+			ClientIP:    accesslog.IP_MASKED,
+		},
+		LDAP: LDAPConfig{
+			UserFilter:     "(uid=%s)",
+			GroupAttribute: "memberOf",
+			PoolSize:       4,
+			Timeout:        5 * time.Second,
+		},
+		SlowRequestThreshold:  2 * time.Second,
+		SLOEvaluationInterval: time.Minute,
+		GoroutineLeakTimeout:  30 * time.Second,
+		DownstreamTimeout:     2 * time.Second,
+	}
+}
+
+// Binds every config key to a flag whose default is the current value in c.
+// The flag set doubles as the registry of keys used by the file and env layers.
+func configFlags(c *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.StringVar(&c.Port, "port", c.Port, "TCP port to listen on")
+	fs.StringVar(&c.ListenAddr, "listen-addr", c.ListenAddr, "listen address: host:port, unix:///path or systemd")
+	fs.StringVar(&c.AdminPort, "admin-port", c.AdminPort, "serve /admin and /debug on this port instead of the main one")
+	fs.StringVar(&c.AdminHost, "admin-host", c.AdminHost, "address the admin port binds to; keep it private")
+	fs.StringVar(&c.MetricsPort, "metrics-port", c.MetricsPort, "serve /metrics on this port instead of the main one")
+	fs.StringVar(&c.Telemetry.Backends, "metrics-backends", c.Telemetry.Backends, "where custom and request metrics go, separated by commas: prometheus (/metrics) and otlp")
+	fs.StringVar(&c.Telemetry.OTLPEndpoint, "otlp-endpoint", c.Telemetry.OTLPEndpoint, "OpenTelemetry collector base URL for the otlp backend, e.g. http://otel-collector:4318")
+	fs.StringVar(&c.Telemetry.OTLPHeaders, "otlp-headers", c.Telemetry.OTLPHeaders, "headers sent with OTLP exports as name=value pairs separated by commas")
+	fs.DurationVar(&c.Telemetry.OTLPInterval, "otlp-interval", c.Telemetry.OTLPInterval, "how often metrics are pushed to the OTLP endpoint")
+	fs.StringVar(&c.Traffic.CanaryHeader, "canary-header", c.Traffic.CanaryHeader, "request header choosing a route's canary (true) or stable (false) implementation; empty ignores it")
+	fs.IntVar(&c.Traffic.CanaryPercent, "canary-percent", c.Traffic.CanaryPercent, "percentage of requests without the canary header served by routes' canary implementations")
+	fs.StringVar(&c.Traffic.ShadowRoutes, "shadow-routes", c.Traffic.ShadowRoutes, "route patterns whose requests are copied to another deployment, as pattern=url pairs separated by commas, e.g. \"GET /status=http://status-v2:3000\"")
+	fs.IntVar(&c.Traffic.ShadowPercent, "shadow-percent", c.Traffic.ShadowPercent, "percentage of requests on shadowed routes that are copied")
+	fs.StringVar(&c.Traffic.ShadowIgnore, "shadow-ignore", c.Traffic.ShadowIgnore, "JSON Pointers of members left out when comparing shadow responses, separated by commas; \"*\" matches any member, e.g. \"/my-application/*/sha\"")
+	fs.StringVar(&c.MetadataPath, "metadata-path", c.MetadataPath, "path of the metadata document served by /status (.json, .yaml, .toml or .hcl)")
+	fs.StringVar(&c.MetadataFormat, "metadata-format", c.MetadataFormat, "format of the metadata document: auto (by extension, else JSON), json, yaml, toml or hcl")
+	fs.StringVar(&c.ConfigSource, "config-source", c.ConfigSource, "metadata location overriding metadata-path: file path, consul://, etcd://, s3:// or http(s):// URL")
+	fs.IntVar(&c.ConfigChangeHistory, "config-change-history", c.ConfigChangeHistory, "metadata changes listed by /admin/config/changes")
+	fs.BoolVar(&c.Dev, "dev", c.Dev, "local development profile: sqlite database in dev.db, development environment, debug logs and any CORS origin, unless set otherwise")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "browser origins allowed to call the API, separated by commas; * allows any, empty disables CORS")
+	fs.BoolVar(&c.CheckOnly, "check", c.CheckOnly, "validate config, keys and dependencies, print a report and exit non-zero on failure")
+	fs.StringVar(&c.MetadataKey, "metadata-key", c.MetadataKey, "base64 AES-256 key (or @file) decrypting ENC[...] metadata values")
+	fs.StringVar(&c.MetadataKMSKey, "metadata-kms-key", c.MetadataKMSKey, "metadata key encrypted with AWS KMS, base64 (or @file); decrypted at startup")
+	fs.StringVar(&c.Environment, "environment", c.Environment, "production or development; development explains authentication failures in responses")
+	fs.StringVar(&c.Profile, "env", c.Profile, "config profile, e.g. dev, staging or prod; merges metadata.<env>.json over the metadata file")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "minimum level of leveled log output: debug, info, warn or error; re-read on SIGHUP")
+	fs.StringVar(&c.JSON.Naming, "json-naming", c.JSON.Naming, "field naming of JSON responses: camel or snake")
+	fs.StringVar(&c.JSON.TimeFormat, "json-time-format", c.JSON.TimeFormat, "timestamps in JSON responses: rfc3339 or epoch-millis")
+	fs.StringVar(&c.BuildNumber, "build-number", c.BuildNumber, "build number appended to the version; else taken from CI variables like GITHUB_RUN_NUMBER, else 0")
+	fs.StringVar(&c.Deployment.DeployTime, "deploy-time", c.Deployment.DeployTime, "when this release was deployed, as reported by /status and /version")
+	fs.StringVar(&c.Deployment.Region, "region", c.Deployment.Region, "region the instance runs in; else taken from AWS_REGION, GOOGLE_CLOUD_REGION or FLY_REGION, else the cloud metadata endpoint")
+	fs.StringVar(&c.Deployment.InstanceID, "instance-id", c.Deployment.InstanceID, "ID of this instance; else the cloud metadata endpoint's, else FLY_ALLOC_ID, HOSTNAME or the host name")
+	fs.StringVar(&c.Deployment.Metadata, "deployment-metadata", c.Deployment.Metadata, "cloud metadata endpoint asked for the region and instance ID: none, auto, aws, gcp or azure")
+	fs.StringVar(&c.VersionSource, "version-source", c.VersionSource, "where the commit SHA comes from: auto, ldflags, env (GIT_SHA), file, buildinfo or git")
+	fs.StringVar(&c.SingleUseRoutes, "single-use-routes", c.SingleUseRoutes, "comma separated route patterns, e.g. \"POST /files\", that accept each token only once, in addition to those marked in the route table")
+	fs.StringVar(&c.RouteGroups, "route-groups", c.RouteGroups, "route groups to mount, separated by commas; re-read on SIGHUP")
+	fs.StringVar(&c.VersionFile, "version-file", c.VersionFile, "file holding the commit SHA, for the file version source")
+	fs.StringVar(&c.AdminToken, "admin-token", c.AdminToken, "token for admin endpoints; admin endpoints are disabled when empty")
+	fs.StringVar(&c.ExampleUserPassword, "example-user-password", c.ExampleUserPassword, "password of the demo exampleuser account")
+	fs.StringVar(&c.IntrospectionClients, "introspection-clients", c.IntrospectionClients, "client credentials for /introspect as id:secret pairs separated by commas")
+	fs.StringVar(&c.DownstreamServices, "downstream-services", c.DownstreamServices, "services aggregated into /status: name=url pairs or discovery service names, separated by commas")
+	fs.DurationVar(&c.DownstreamTimeout, "downstream-timeout", c.DownstreamTimeout, "timeout for each downstream /status call")
+	fs.StringVar(&c.DownstreamAuthorization, "downstream-authorization", c.DownstreamAuthorization, "Authorization header sent with downstream /status calls, e.g. a service token; none when empty")
+	fs.StringVar(&c.PublicRoutes, "public-routes", c.PublicRoutes, "paths reachable without a token, as glob patterns separated by commas; /** matches a whole subtree")
+	fs.IntVar(&c.Quota.Monthly, "quota-monthly", c.Quota.Monthly, "requests each user, API key or client may make per calendar month (UTC), 0 is unlimited")
+	fs.StringVar(&c.Quota.Tiers, "quota-tiers", c.Quota.Tiers, "monthly quotas by token plan/tier, as tier:limit pairs separated by commas; 0 is unlimited")
+	fs.StringVar(&c.Webhooks.Secrets, "webhook-secrets", c.Webhooks.Secrets, "signing secrets of the registered webhook providers, as provider:secret pairs separated by commas")
+	fs.DurationVar(&c.Webhooks.Tolerance, "webhook-tolerance", c.Webhooks.Tolerance, "how old a webhook's signed timestamp may be, 0 accepts any age")
+	fs.StringVar(&c.Policy.File, "policy-file", c.Policy.File, "authorization rules as CEL expressions per route, in JSON, YAML, TOML or HCL")
+	fs.BoolVar(&c.Policy.DryRun, "policy-dry-run", c.Policy.DryRun, "log requests the policy rules would deny instead of denying them")
+	fs.StringVar(&c.Policy.Timezone, "policy-timezone", c.Policy.Timezone, "time zone of the time variables in policy rules")
+	fs.StringVar(&c.RateLimitTiers, "rate-limit-tiers", c.RateLimitTiers, "per-minute limits on rate limited routes by token plan/tier, as tier:limit pairs separated by commas")
+	fs.StringVar(&c.TLS.CertFile, "tls-cert-file", c.TLS.CertFile, "server certificate (PEM); enables TLS when set")
+	fs.StringVar(&c.TLS.KeyFile, "tls-key-file", c.TLS.KeyFile, "server private key (PEM)")
+	fs.StringVar(&c.TLS.ClientCAFile, "tls-client-ca-file", c.TLS.ClientCAFile, "CA bundle (PEM) used to verify client certificates")
+	fs.StringVar(&c.TLS.ClientAuth, "tls-client-auth", c.TLS.ClientAuth, "client certificates: none, optional or require")
+	fs.StringVar(&c.TLS.ClientCRL, "tls-client-crl-file", c.TLS.ClientCRL, "CRL (PEM or DER) checked for revoked client certificates")
+	fs.BoolVar(&c.TLS.ClientOCSP, "tls-client-ocsp", c.TLS.ClientOCSP, "check client certificates with their OCSP responder")
+	fs.BoolVar(&c.HTTP3.Enabled, "http3", c.HTTP3.Enabled, "experimental: also serve HTTP/3 over QUIC and advertise it with Alt-Svc; needs TLS")
+	fs.StringVar(&c.HTTP3.Addr, "http3-addr", c.HTTP3.Addr, "UDP address of the HTTP/3 listener; the TCP listener's address or port when empty")
+	fs.DurationVar(&c.HTTP3.MaxAge, "http3-alt-svc-max-age", c.HTTP3.MaxAge, "how long clients may remember that HTTP/3 is available")
+	fs.DurationVar(&c.Shutdown.GracePeriod, "shutdown-grace-period", c.Shutdown.GracePeriod, "longest shutdown may take, subsystems still running then are abandoned; keep below terminationGracePeriodSeconds, 0 is no limit")
+	fs.StringVar(&c.Shutdown.Timeouts, "shutdown-timeouts", c.Shutdown.Timeouts, "per subsystem shutdown timeouts, e.g. \"message consumer=10s\"; names as in /admin/shutdown-status")
+	fs.StringVar(&c.Network.TrustedProxies, "trusted-proxies", c.Network.TrustedProxies, "CIDRs of load balancers and proxies whose X-Forwarded-For / X-Real-IP headers are trusted, separated by commas")
+	fs.StringVar(&c.Network.Allow, "ip-allow", c.Network.Allow, "CIDRs of clients allowed to connect, separated by commas; all when empty")
+	fs.StringVar(&c.Network.Deny, "ip-deny", c.Network.Deny, "CIDRs of clients refused with 403, separated by commas; applied before ip-allow")
+	fs.StringVar(&c.Discovery.Backend, "discovery-backend", c.Discovery.Backend, "service registry: consul or etcd; registration is off when empty")
+	fs.StringVar(&c.Discovery.Addr, "discovery-addr", c.Discovery.Addr, "registry URL, e.g. http://127.0.0.1:8500 (Consul) or http://127.0.0.1:2379 (etcd)")
+	fs.StringVar(&c.Discovery.ServiceName, "service-name", c.Discovery.ServiceName, "name this service registers under")
+	fs.StringVar(&c.Discovery.ServiceAddress, "service-address", c.Discovery.ServiceAddress, "address advertised to the registry, defaults to the hostname")
+	fs.IntVar(&c.Login.MaxAttempts, "login-max-attempts", c.Login.MaxAttempts, "failed logins before a lockout")
+	fs.DurationVar(&c.Login.Lockout, "login-lockout-duration", c.Login.Lockout, "how long a login lockout lasts")
+	fs.DurationVar(&c.Login.BaseDelay, "login-base-delay", c.Login.BaseDelay, "wait after the first failed login")
+	fs.DurationVar(&c.Login.MaxDelay, "login-max-delay", c.Login.MaxDelay, "upper bound of the exponential login wait")
+	fs.IntVar(&c.LoadShed.MaxInFlight, "loadshed-max-inflight", c.LoadShed.MaxInFlight, "concurrent requests per route, 0 disables load shedding")
+	fs.IntVar(&c.LoadShed.MaxQueue, "loadshed-max-queue", c.LoadShed.MaxQueue, "requests per route allowed to wait for a slot")
+	fs.DurationVar(&c.LoadShed.QueueTimeout, "loadshed-queue-timeout", c.LoadShed.QueueTimeout, "how long a queued request waits for a slot")
+	fs.IntVar(&c.Connections.MaxHeaderBytes, "max-header-bytes", c.Connections.MaxHeaderBytes, "largest request line and headers accepted, larger requests get 431")
+	fs.DurationVar(&c.Connections.ReadHeaderTimeout, "read-header-timeout", c.Connections.ReadHeaderTimeout, "how long a client has to send a request's headers before its connection is closed")
+	fs.DurationVar(&c.Connections.IdleTimeout, "idle-timeout", c.Connections.IdleTimeout, "how long a keep-alive connection may sit idle before it is closed")
+	fs.IntVar(&c.Connections.MaxPerIP, "max-conns-per-ip", c.Connections.MaxPerIP, "concurrent connections one IP may open on the public port, 0 for no limit; leave it to the proxy behind one")
+	fs.StringVar(&c.Notify.Triggers, "notify-triggers", c.Notify.Triggers, "events that send notifications: auth_failures, key_rotation, readiness_flap, panic, slo_burn")
+	fs.DurationVar(&c.Notify.Interval, "notify-interval", c.Notify.Interval, "minimum time between notifications of the same event")
+	fs.StringVar(&c.Notify.WebhookURL, "notify-webhook-url", c.Notify.WebhookURL, "URL that notifications are POSTed to")
+	fs.StringVar(&c.Notify.WebhookTemplate, "notify-webhook-template", c.Notify.WebhookTemplate, "Go template for the webhook payload, or @file")
+	fs.StringVar(&c.Notify.SMTPAddr, "notify-smtp-addr", c.Notify.SMTPAddr, "SMTP relay host:port for email notifications")
+	fs.StringVar(&c.Notify.SMTPFrom, "notify-smtp-from", c.Notify.SMTPFrom, "sender address of notification emails")
+	fs.StringVar(&c.Notify.SMTPTo, "notify-smtp-to", c.Notify.SMTPTo, "recipients of notification emails, separated by commas")
+	fs.StringVar(&c.Notify.SMTPUsername, "notify-smtp-username", c.Notify.SMTPUsername, "SMTP username")
+	fs.StringVar(&c.Notify.SMTPPassword, "notify-smtp-password", c.Notify.SMTPPassword, "SMTP password")
+	fs.StringVar(&c.Notify.EmailTemplate, "notify-email-template", c.Notify.EmailTemplate, "Go plain text template replacing the email templates, or @file")
+	fs.StringVar(&c.Notify.EmailTemplates, "notify-email-templates", c.Notify.EmailTemplates, "directory of <locale>/<name>.html, .subject.txt and .txt files overriding the embedded email templates")
+	fs.StringVar(&c.Notify.EmailLocale, "notify-email-locale", c.Notify.EmailLocale, "language of notification emails, Accept-Language syntax, e.g. de-CH,de;q=0.8")
+	fs.StringVar(&c.Database.Driver, "database-driver", c.Database.Driver, "database/sql driver for persistent stores, e.g. sqlite; in-memory stores are used when empty")
+	fs.StringVar(&c.Database.URL, "database-url", c.Database.URL, "database DSN, e.g. file:sessions.db for sqlite")
+	fs.StringVar(&c.Database.ReplicaURLs, "database-replica-urls", c.Database.ReplicaURLs, "DSNs of read replicas, separated by commas; reads that can go there do")
+	fs.DurationVar(&c.Database.MaxReplicaLag, "database-max-replica-lag", c.Database.MaxReplicaLag, "replicas further behind the primary serve no reads, 0 ignores lag")
+	fs.DurationVar(&c.Database.HealthInterval, "database-health-interval", c.Database.HealthInterval, "how often the database and its replicas are checked, 0 turns checks off")
+	fs.StringVar(&c.Files.Store, "files-store", c.Files.Store, "blob store for /files uploads: directory, file:///dir or s3://bucket/prefix; uploads are off when empty")
+	fs.Int64Var(&c.Files.MaxSize, "files-max-size", c.Files.MaxSize, "largest accepted upload in bytes")
+	fs.StringVar(&c.Files.AllowedExtensions, "files-allowed-extensions", c.Files.AllowedExtensions, "accepted upload file extensions separated by commas; empty accepts any")
+	fs.StringVar(&c.Files.ScanCommand, "files-scan-command", c.Files.ScanCommand, "command run with each upload's path before it is stored, e.g. clamdscan --no-summary; exit status 1 rejects it")
+	fs.IntVar(&c.Workers.Size, "worker-pool-size", c.Workers.Size, "workers for CPU-bound and blocking tasks; 0 uses GOMAXPROCS")
+	fs.IntVar(&c.Workers.QueueSize, "worker-queue-size", c.Workers.QueueSize, "tasks that may wait for a worker before submissions are rejected")
+	fs.DurationVar(&c.SessionIdleTimeout, "session-idle-timeout", c.SessionIdleTimeout, "how long a session may go unused before it ends")
+	fs.DurationVar(&c.SessionMaxAge, "session-max-age", c.SessionMaxAge, "how long a session may last however much it is used; 0 for no limit")
+	fs.IntVar(&c.SessionLimit, "session-limit", c.SessionLimit, "sessions a user may have at once, logging in again ends the least recently used; 0 for no limit")
+	fs.DurationVar(&c.SessionSweepInterval, "session-sweep-interval", c.SessionSweepInterval, "how often ended sessions are deleted, by one replica at a time; 0 disables it")
+	fs.StringVar(&c.Locks.Backend, "lock-backend", c.Locks.Backend, "where locks shared by replicas live: memory (this process only), redis or postgres (the database)")
+	fs.StringVar(&c.Locks.RedisURL, "lock-redis-url", c.Locks.RedisURL, "redis:// or rediss:// URL of the redis lock backend, e.g. redis://:password@redis:6379/0")
+	fs.StringVar(&c.Registration.Mode, "registration", c.Registration.Mode, "who may create an account on POST /register: closed (the route isn't served), open, or invite for holders of an invite code")
+	fs.StringVar(&c.Registration.InviteCodes, "registration-invite-codes", c.Registration.InviteCodes, "invite codes accepted by POST /register, separated by commas")
+	fs.IntVar(&c.Registration.MinPasswordLength, "password-min-length", c.Registration.MinPasswordLength, "fewest characters in a new account's password")
+	fs.IntVar(&c.Registration.PasswordClasses, "password-classes", c.Registration.PasswordClasses, "how many of lowercase letters, uppercase letters, digits and symbols a new password must mix")
+	fs.BoolVar(&c.Registration.VerifyEmail, "registration-verify-email", c.Registration.VerifyEmail, "new accounts can't log in until they open a link mailed to them through the notify SMTP relay")
+	fs.DurationVar(&c.Registration.VerificationTTL, "registration-verification-ttl", c.Registration.VerificationTTL, "how long the link of a verification email works")
+	fs.StringVar(&c.Registration.VerifyURL, "registration-verify-url", c.Registration.VerifyURL, "page verification emails link to, with ?token= appended, e.g. https://api.example.com/register/verify")
+	fs.DurationVar(&c.TenantConfigTTL, "tenant-config-ttl", c.TenantConfigTTL, "how long each replica caches a tenant's config overlay unless the overlay sets its own ttl")
+	fs.StringVar(&c.Cookies.Name, "session-cookie", c.Cookies.Name, "name of a cookie /login sets the token in for browsers, with CSRF protection; off when empty")
+	fs.StringVar(&c.Cookies.SameSite, "session-cookie-samesite", c.Cookies.SameSite, "SameSite attribute of the session cookie: lax, strict or none")
+	fs.BoolVar(&c.Cookies.Insecure, "session-cookie-insecure", c.Cookies.Insecure, "send the session cookie over plain HTTP, for local development")
+	fs.StringVar(&c.Cookies.Keys, "session-cookie-keys", c.Cookies.Keys, "base64 AES-256 keys encrypting the session cookie, newest first and separated by commas; @file reads one from a file")
+	fs.StringVar(&c.Cookies.CSRFSecret, "csrf-secret", c.Cookies.CSRFSecret, "key CSRF tokens are derived with, shared by all instances; random per process when empty")
+	fs.StringVar(&c.Cookies.CSRFExemptRoutes, "csrf-exempt-routes", c.Cookies.CSRFExemptRoutes, "route patterns accepting cookie-authenticated writes without a CSRF token, separated by commas")
+	fs.StringVar(&c.LDAP.URL, "ldap-url", c.LDAP.URL, "ldap:// or ldaps:// URL of a directory /login checks passwords against instead of the user store")
+	fs.BoolVar(&c.LDAP.StartTLS, "ldap-starttls", c.LDAP.StartTLS, "upgrade ldap:// connections with StartTLS")
+	fs.StringVar(&c.LDAP.CAFile, "ldap-ca-file", c.LDAP.CAFile, "CA bundle (PEM) verifying the directory's certificate; the system roots when empty")
+	fs.StringVar(&c.LDAP.BindDN, "ldap-bind-dn", c.LDAP.BindDN, "DN of the service account that looks users up; anonymous when empty")
+	fs.StringVar(&c.LDAP.BindPassword, "ldap-bind-password", c.LDAP.BindPassword, "password of the service account")
+	fs.StringVar(&c.LDAP.BaseDN, "ldap-base-dn", c.LDAP.BaseDN, "DN under which users are searched")
+	fs.StringVar(&c.LDAP.UserFilter, "ldap-user-filter", c.LDAP.UserFilter, "filter finding a user, %s being the username, e.g. (sAMAccountName=%s) for Active Directory")
+	fs.StringVar(&c.LDAP.IDAttribute, "ldap-id-attribute", c.LDAP.IDAttribute, "numeric attribute used as the account ID, e.g. uidNumber; a hash of the DN when empty")
+	fs.StringVar(&c.LDAP.TenantAttribute, "ldap-tenant-attribute", c.LDAP.TenantAttribute, "attribute whose value becomes the tenant claim")
+	fs.StringVar(&c.LDAP.GroupAttribute, "ldap-group-attribute", c.LDAP.GroupAttribute, "attribute listing the DNs of the user's groups")
+	fs.StringVar(&c.LDAP.GroupRoles, "ldap-group-roles", c.LDAP.GroupRoles, "roles granted per group as cn:role pairs separated by commas, e.g. admins:admin")
+	fs.IntVar(&c.LDAP.PoolSize, "ldap-pool-size", c.LDAP.PoolSize, "idle directory connections kept for reuse")
+	fs.DurationVar(&c.LDAP.Timeout, "ldap-timeout", c.LDAP.Timeout, "timeout of each directory operation")
+	fs.StringVar(&c.Auth.Strategies, "auth-strategies", c.Auth.Strategies, "authentication strategies tried in order on protected routes: jwt, mtls, apikey, hmac, basic, oidc")
+	fs.StringVar(&c.Auth.APIKeys, "api-keys", c.Auth.APIKeys, "API keys for the apikey strategy as name:key pairs separated by commas")
+	fs.StringVar(&c.Auth.HMACClients, "hmac-clients", c.Auth.HMACClients, "shared secrets for the hmac strategy as id:secret pairs separated by commas")
+	fs.StringVar(&c.OIDC.Issuer, "oidc-issuer", c.OIDC.Issuer, "issuer whose bearer tokens the oidc strategy accepts, e.g. https://accounts.example.com; off when empty")
+	fs.StringVar(&c.OIDC.JWKSURL, "oidc-jwks-url", c.OIDC.JWKSURL, "URL of the issuer's JSON Web Key Set, its jwks_uri")
+	fs.StringVar(&c.OIDC.Audience, "oidc-audience", c.OIDC.Audience, "audience issuer tokens must name in aud; any when empty")
+	fs.DurationVar(&c.OIDC.MaxStale, "oidc-max-stale", c.OIDC.MaxStale, "how long past its expiry the issuer's key set is still used while the issuer can't be reached; 0 for as long as it takes")
+	fs.StringVar(&c.AccessLog.Format, "access-log", c.AccessLog.Format, "access log line format, apart from the application log: common, combined, json or off")
+	fs.StringVar(&c.AccessLog.Destination, "access-log-destination", c.AccessLog.Destination, "where the access log goes: stdout, stderr, syslog, syslog://host:514, syslog+tcp://host:514 or a file path")
+	fs.IntVar(&c.AccessLog.MaxSizeMB, "access-log-max-size", c.AccessLog.MaxSizeMB, "megabytes an access log file grows to before it is rotated; 0 never rotates")
+	fs.IntVar(&c.AccessLog.MaxBackups, "access-log-max-backups", c.AccessLog.MaxBackups, "rotated access log files kept")
+	fs.StringVar(&c.AccessLog.ClientIP, "access-log-ip", c.AccessLog.ClientIP, "client IPs in the access log: masked to their /24 or /48 network, full or none")
+	fs.BoolVar(&c.AccessLog.Query, "access-log-query", c.AccessLog.Query, "include query strings and referer queries in the access log; they often carry tokens and personal data")
+	fs.BoolVar(&c.Auth.BasicDev, "auth-basic-dev", c.Auth.BasicDev, "enable the HTTP Basic strategy against the user store (development only)")
+	fs.StringVar(&c.Tokens.Algorithm, "token-algorithm", c.Tokens.Algorithm, "token signing algorithm: HS256 or ES256 (public keys served at /.well-known/jwks.json)")
+	fs.IntVar(&c.Tokens.PreviousKeys, "token-previous-keys", c.Tokens.PreviousKeys, "previous signing keys that stay valid for verification after a rotation")
+	fs.BoolVar(&c.Tokens.RotatePerLogin, "token-rotate-per-login", c.Tokens.RotatePerLogin, "rotate the signing key on every issued token, invalidating all earlier tokens")
+	fs.StringVar(&c.Tokens.Scopes, "token-scopes", c.Tokens.Scopes, "space separated scopes granted at login, narrowed by the client's scope parameter")
+	fs.BoolVar(&c.Tokens.Encrypt, "token-encrypt", c.Tokens.Encrypt, "encrypt issued tokens (JWE, dir/A256GCM) so clients cannot read their claims")
+	fs.DurationVar(&c.Tokens.RefreshGrace, "token-refresh-grace", c.Tokens.RefreshGrace, "how long after expiring a token can still be refreshed, 0 refreshes unexpired tokens only")
+	fs.StringVar(&c.Tokens.Audience, "token-audience", c.Tokens.Audience, "aud claim of issued tokens; when set, tokens for other audiences are rejected")
+	fs.IntVar(&c.Blacklist.SoftLimit, "blacklist-soft-limit", c.Blacklist.SoftLimit, "blacklist size above which expired entries are swept, 0 disables it")
+	fs.IntVar(&c.Blacklist.HardLimit, "blacklist-hard-limit", c.Blacklist.HardLimit, "maximum blacklist size; least recently used entries are evicted, 0 is unlimited")
+	fs.DurationVar(&c.Blacklist.Retention, "blacklist-retention", c.Blacklist.Retention, "how long blacklist entries are kept after their token expires")
+	fs.StringVar(&c.Blacklist.SnapshotDir, "blacklist-snapshot-dir", c.Blacklist.SnapshotDir, "directory for blacklist snapshots, reloaded on startup; persistence is off when empty")
+	fs.DurationVar(&c.Blacklist.SnapshotInterval, "blacklist-snapshot-interval", c.Blacklist.SnapshotInterval, "how often blacklists are snapshotted")
+	fs.BoolVar(&c.GraphQL, "graphql", c.GraphQL, "serve POST /graphql over users, status and sessions")
+	fs.BoolVar(&c.ServerTiming, "server-timing", c.ServerTiming, "send a Server-Timing header with the auth, handler, downstream and middleware durations")
+	fs.DurationVar(&c.SlowRequestThreshold, "slow-request-threshold", c.SlowRequestThreshold, "log requests slower than this, 0 disables it")
+	fs.DurationVar(&c.SLOEvaluationInterval, "slo-evaluation-interval", c.SLOEvaluationInterval, "how often route SLO burn rates are checked for alerts, 0 disables them")
+	fs.DurationVar(&c.GoroutineLeakTimeout, "goroutine-leak-timeout", c.GoroutineLeakTimeout, "log goroutines started by a request that still run this long after it ended, 0 disables it")
+	return fs
+}
+
+// Resolves the config from, in increasing precedence: compiled defaults, an optional
+// YAML or JSON file (-config or APP_CONFIG_FILE), environment variables, and flags.
+//
+// The environment variable for a key is APP_ followed by the key in upper snake case,
+// e.g. APP_LOGIN_MAX_ATTEMPTS. Only the keys that were read unprefixed before, PORT and
+// BUILD_NUMBER, still fall back to their unprefixed name.
+func LoadConfig(args []string) (Config, error) {
+	config := DefaultConfig()
+	fs := configFlags(&config)
+	configFile := fs.String("config", lookupEnv("config-file"), "YAML or JSON config file")
+
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	// Remember explicit flags so they can be re-applied on top of the other layers
+	explicit := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+	// Keys set by any layer, which the dev profile leaves alone
+	set := map[string]bool{}
+	for name := range explicit {
+		set[name] = true
+	}
+
+	if *configFile != "" {
+		values, err := readConfigFile(*configFile)
+		if err != nil {
+			return Config{}, err
+		}
+		for key, value := range values {
+			if key == "config" || fs.Lookup(key) == nil {
+				return Config{}, fmt.Errorf("%s: unknown config key %q", *configFile, key)
+			}
+			if err := fs.Set(key, value); err != nil {
+				return Config{}, fmt.Errorf("%s: %s: %w", *configFile, key, err)
+			}
+			set[key] = true
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if value := lookupEnv(f.Name); value != "" && f.Name != "config" && err == nil {
+			if setErr := fs.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("environment %s: %w", envName(f.Name), setErr)
+			}
+			set[f.Name] = true
+		}
+	})
+	if err != nil {
+		return Config{}, err
+	}
+
+	for name, value := range explicit {
+		fs.Set(name, value)
+	}
+
+	if config.Dev {
+		for name, value := range devProfile {
+			if !set[name] {
+				fs.Set(name, value)
+			}
+		}
+	}
+	return config, nil
+}
+
+// Returns the effective config as key/value pairs with secrets redacted
+func (c Config) Redacted() map[string]string {
+	dump := map[string]string{}
+	configFlags(&c).VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretConfigKeys[f.Name] && value != "" {
+			value = "REDACTED"
+		}
+		dump[f.Name] = value
+	})
+	return dump
+}
+
+// Lists the available config keys with their environment variable names and defaults
+func ConfigUsage() string {
+	c := DefaultConfig()
+	var lines []string
+	configFlags(&c).VisitAll(func(f *flag.Flag) {
+		lines = append(lines, fmt.Sprintf("  -%s (%s, default %q)\n    \t%s", f.Name, envName(f.Name), f.DefValue, f.Usage))
+	})
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func envName(key string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// Keys whose unprefixed variable is still read, as it was before config keys got the
+// APP_ prefix. Other unprefixed names such as ENVIRONMENT, REGION or DATABASE_URL are
+// often set by the platform or other tools and must not reconfigure the service.
+var legacyEnvKeys = map[string]bool{"port": true, "build-number": true}
+
+// Looks up the APP_ prefixed variable for key, falling back to the unprefixed name for
+// legacyEnvKeys
+func lookupEnv(key string) string {
+	if value := os.Getenv(envName(key)); value != "" || !legacyEnvKeys[key] {
+		return value
+	}
+	return os.Getenv(strings.TrimPrefix(envName(key), ENV_PREFIX))
+}
+
+// Reads a config file into flat key/value pairs. Nested objects are flattened by
+// joining keys with "-", and "_" is accepted in place of "-", so
+// {"login": {"max_attempts": 3}} sets login-max-attempts.
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &raw)
+	default:
+		// Keep numbers as written so integers are not turned into floats like 1e+06
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flattenConfig("", raw, values)
+	return values, nil
+}
+
+func flattenConfig(prefix string, raw map[string]interface{}, values map[string]string) {
+	for key, value := range raw {
+		key = strings.ReplaceAll(strings.ToLower(key), "_", "-")
+		if prefix != "" {
+			key = prefix + "-" + key
+		}
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenConfig(key, nested, values)
+			continue
+		}
+		values[key] = fmt.Sprintf("%v", value)
+	}
+}
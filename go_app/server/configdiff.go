@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"time"
+
+	"go_app/eventbus"
+)
+
+// Changes kept for /admin/config/changes when config-change-history is not set
+const DEFAULT_CONFIG_CHANGE_HISTORY = 20
+
+// How a refresh changed the metadata, by dotted key path, e.g. "rateLimits.pro".
+// Values are left out: decrypted ENC[...] secrets must not reach logs or admin output.
+type ConfigChange struct {
+	Source  string    `json:"source"`
+	Time    time.Time `json:"time"`
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	Changed []string  `json:"changed"`
+}
+
+// Every key the change touched, sorted
+func (c ConfigChange) Keys() []string {
+	keys := append(append(append([]string{}, c.Added...), c.Removed...), c.Changed...)
+	sort.Strings(keys)
+	return keys
+}
+
+// Compares two metadata documents leaf by leaf. Nested objects are walked; arrays and
+// scalars are compared whole.
+func diffMetadata(previous, current map[string]interface{}) ConfigChange {
+	change := ConfigChange{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	diffInto(&change, "", previous, current)
+	sort.Strings(change.Added)
+	sort.Strings(change.Removed)
+	sort.Strings(change.Changed)
+	return change
+}
+
+func diffInto(change *ConfigChange, prefix string, previous, current map[string]interface{}) {
+	for key, old := range previous {
+		path := prefix + key
+		value, ok := current[key]
+		if !ok {
+			change.Removed = append(change.Removed, path)
+			continue
+		}
+		oldObject, oldIsObject := old.(map[string]interface{})
+		object, isObject := value.(map[string]interface{})
+		switch {
+		case oldIsObject && isObject:
+			diffInto(change, path+".", oldObject, object)
+		case !reflect.DeepEqual(old, value):
+			change.Changed = append(change.Changed, path)
+		}
+	}
+	for key := range current {
+		if _, ok := previous[key]; !ok {
+			change.Added = append(change.Added, prefix+key)
+		}
+	}
+}
+
+// Compares a freshly loaded document with the one before it, then logs, publishes and
+// records what changed. The first load has nothing to compare with. The caller holds
+// configMutex.
+func (a *App) recordConfigChange(metadata map[string]interface{}) {
+	previous := a.configSnapshot
+	a.configSnapshot = metadata
+	if previous == nil {
+		return
+	}
+	change := diffMetadata(previous, metadata)
+	keys := change.Keys()
+	if len(keys) == 0 {
+		return
+	}
+	change.Source, change.Time = a.MetadataSource.String(), a.Clock.Now()
+
+	a.Logger.Printf("Configuration changed in %s: added=%v removed=%v changed=%v", change.Source, change.Added, change.Removed, change.Changed)
+	limit := a.Config.ConfigChangeHistory
+	if limit <= 0 {
+		limit = DEFAULT_CONFIG_CHANGE_HISTORY
+	}
+	a.configChanges = append(a.configChanges, change)
+	if len(a.configChanges) > limit {
+		a.configChanges = a.configChanges[len(a.configChanges)-limit:]
+	}
+	eventbus.Publish(a.Events, TopicConfigChanged, ConfigChangedEvent{Source: change.Source, Keys: keys, Time: change.Time})
+}
+
+// The recorded metadata changes, newest first
+func (a *App) ConfigChanges() []ConfigChange {
+	a.configMutex.Lock()
+	defer a.configMutex.Unlock()
+	changes := make([]ConfigChange, len(a.configChanges))
+	for i, change := range a.configChanges {
+		changes[len(changes)-1-i] = change
+	}
+	return changes
+}
+
+// GET /admin/config/changes
+func (a *App) listConfigChanges(ctx context.Context, _ struct{}) ([]ConfigChange, error) {
+	return a.ConfigChanges(), nil
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"expvar"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Connections accepted, refused and closed, published on /debug/vars
+var connectionMetrics = expvar.NewMap("connections")
+
+// Connections open on the servers built by NewServer
+var openConnections atomic.Int64
+
+func init() {
+	connectionMetrics.Set("open", expvar.Func(func() interface{} { return openConnections.Load() }))
+}
+
+// Limits on the listeners' connections, against clients that open many of them or send
+// their requests slowly to keep them busy (slowloris)
+type ConnectionConfig struct {
+	MaxHeaderBytes    int           // request line and headers; larger requests get 431
+	ReadHeaderTimeout time.Duration // to send the request line and headers
+	IdleTimeout       time.Duration // keep-alive connections idle for longer are closed
+	MaxPerIP          int           // concurrent connections from one IP; 0 for no limit
+}
+
+// An http.Server for handler with the header limits and timeouts of the connection
+// settings, counting its connections in the connections metrics. Bodies have no read
+// timeout: routes bound them with their own Timeout.
+func (a *App) NewServer(handler http.Handler) *http.Server {
+	config := a.Config.Connections
+	return &http.Server{
+		Handler:           handler,
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+		ReadHeaderTimeout: config.ReadHeaderTimeout,
+		IdleTimeout:       config.IdleTimeout,
+		ConnState:         trackConnection,
+	}
+}
+
+// The last state of each open connection
+var connectionStates sync.Map
+
+// Counts connections by the state they were closed in:
+//
+//   - closed_before_request: no byte of a request arrived, e.g. a client that connects
+//     and waits, or a failed TLS handshake;
+//   - closed_mid_request: during a request, most often one whose headers didn't arrive
+//     within the read header timeout, or a client that went away;
+//   - closed_idle: between requests, by the idle timeout or the client.
+func trackConnection(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		openConnections.Add(1)
+		connectionMetrics.Add("accepted", 1)
+	case http.StateHijacked:
+		openConnections.Add(-1)
+		connectionStates.Delete(conn)
+		return
+	case http.StateClosed:
+		openConnections.Add(-1)
+		last, _ := connectionStates.LoadAndDelete(conn)
+		switch last {
+		case http.StateNew:
+			connectionMetrics.Add("closed_before_request", 1)
+		case http.StateActive:
+			connectionMetrics.Add("closed_mid_request", 1)
+		case http.StateIdle:
+			connectionMetrics.Add("closed_idle", 1)
+		}
+		return
+	}
+	connectionStates.Store(conn, state)
+}
+
+// Wraps the public listener so each IP has at most MaxPerIP connections open; more are
+// closed as soon as they are accepted, before any TLS handshake if listener is wrapped
+// in TLS afterwards. Behind a proxy every connection comes from the proxy, so leave the
+// limit to it there. Unix sockets aren't limited.
+func (a *App) LimitConnections(listener net.Listener) net.Listener {
+	if a.Config.Connections.MaxPerIP <= 0 {
+		return listener
+	}
+	return &perIPListener{Listener: listener, max: a.Config.Connections.MaxPerIP, conns: make(map[netip.Addr]int)}
+}
+
+type perIPListener struct {
+	net.Listener
+	max int
+
+	mutex sync.Mutex
+	conns map[netip.Addr]int
+}
+
+func (l *perIPListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		address, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+		if err != nil {
+			return conn, nil
+		}
+		ip := address.Addr().Unmap()
+		l.mutex.Lock()
+		if l.conns[ip] >= l.max {
+			l.mutex.Unlock()
+			connectionMetrics.Add("rejected_per_ip", 1)
+			conn.Close()
+			continue
+		}
+		l.conns[ip]++
+		l.mutex.Unlock()
+		return &limitedConn{Conn: conn, release: func() { l.release(ip) }}, nil
+	}
+}
+
+func (l *perIPListener) release(ip netip.Addr) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// A connection counted against its IP until closed
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// Lets responses still reach the connection's own ReadFrom, e.g. sendfile on TCP
+func (c *limitedConn) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(c.Conn, r)
+}
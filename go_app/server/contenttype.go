@@ -0,0 +1,82 @@
+package server
+
+import (
+	"expvar"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Media types of Route.Consumes
+const (
+	MEDIA_TYPE_JSON      = "application/json"
+	MEDIA_TYPE_FORM      = "application/x-www-form-urlencoded"
+	MEDIA_TYPE_MULTIPART = "multipart/form-data"
+	CONSUMES_ANY         = "*/*" // the handler reads any body itself, e.g. webhooks
+)
+
+// Bodies turned away with 415, per route pattern, published on /debug/vars
+var contentTypeMetrics = expvar.NewMap("content_type_rejections")
+
+// Answers 415 to requests whose body is not of a media type the route consumes,
+// application/json unless Route.Consumes says otherwise, so a handler never decodes
+// form data or text it did not ask for. application/json also admits the +json types,
+// e.g. application/merge-patch+json. Only UTF-8 is accepted as a charset; it is
+// normalized to "utf-8" so handlers can compare the header as is. Requests without a
+// body pass whatever their Content-Type.
+func (a *App) requireContentType(pattern string, consumes []string, next http.HandlerFunc) http.HandlerFunc {
+	if len(consumes) == 0 {
+		consumes = []string{MEDIA_TYPE_JSON}
+	}
+	if contains(consumes, CONSUMES_ANY) {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+			next(w, r)
+			return
+		}
+		mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || !consumesMediaType(consumes, mediaType) {
+			a.rejectContentType(w, r, pattern, consumes, "Unsupported Media Type: Content-Type must be "+strings.Join(consumes, " or "))
+			return
+		}
+		if charset, ok := params["charset"]; ok {
+			if !strings.EqualFold(charset, "utf-8") && !strings.EqualFold(charset, "utf8") {
+				a.rejectContentType(w, r, pattern, consumes, "Unsupported Media Type: charset must be utf-8")
+				return
+			}
+			params["charset"] = "utf-8"
+		}
+		r.Header.Set("Content-Type", mime.FormatMediaType(mediaType, params))
+		next(w, r)
+	}
+}
+
+// Whether mediaType, lowercased by mime.ParseMediaType, is one of consumes
+func consumesMediaType(consumes []string, mediaType string) bool {
+	for _, accepted := range consumes {
+		switch {
+		case strings.EqualFold(accepted, mediaType):
+			return true
+		case accepted == MEDIA_TYPE_JSON && strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"):
+			return true
+		case strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, strings.ToLower(strings.TrimSuffix(accepted, "*"))):
+			return true
+		}
+	}
+	return false
+}
+
+// Answers 415, telling POST and PATCH clients what to send instead (Accept-Post of the
+// W3C LDP spec, Accept-Patch of RFC 5789)
+func (a *App) rejectContentType(w http.ResponseWriter, r *http.Request, pattern string, consumes []string, message string) {
+	switch r.Method {
+	case http.MethodPost:
+		w.Header().Set("Accept-Post", strings.Join(consumes, ", "))
+	case http.MethodPatch:
+		w.Header().Set("Accept-Patch", strings.Join(consumes, ", "))
+	}
+	contentTypeMetrics.Add(pattern, 1)
+	a.handleErrorResponse(w, r, http.StatusUnsupportedMediaType, message)
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How long browsers may cache a preflight answer
+const CORS_MAX_AGE = 10 * time.Minute
+
+// Methods allowed in cross-origin requests
+const CORS_ALLOWED_METHODS = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// Adds CORS headers for browser origins listed in cors-origins ("*" allows any) and
+// answers their preflight requests before authentication, which browsers never send
+// credentials to. Requests from other origins pass through without CORS headers.
+// Routes whose settings list corsOrigins allow those instead.
+func (a *App) allowCORS(next http.Handler) http.Handler {
+	configured := configList(a.Config.CORSOrigins)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origins := configured
+		if table := a.routeSettings.Load(); table != nil && len(*table) > 0 {
+			if settings, ok := a.routeSettingsFor(a.routePattern(r)); ok && settings.CORSOrigins != nil {
+				origins = settings.CORSOrigins
+			}
+		}
+		if len(origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !contains(origins, origin) && !contains(origins, "*") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Methods", CORS_ALLOWED_METHODS)
+		if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+			w.Header().Set("Access-Control-Allow-Headers", headers)
+		}
+		w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(CORS_MAX_AGE.Seconds())))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
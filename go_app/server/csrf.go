@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go_app/session"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// CSRF checks per outcome, published on /debug/vars
+var csrfMetrics = expvar.NewMap("csrf")
+
+// Where clients send the CSRF token: the header, or the form field for HTML forms
+const (
+	CSRF_HEADER     = "X-CSRF-Token"
+	CSRF_FORM_FIELD = "csrf_token"
+)
+
+// Browser sessions: /login also sets the token in an HttpOnly cookie, which the jwt
+// strategy accepts when no Authorization header is sent. Off unless Name is set.
+type CookieConfig struct {
+	Name     string // cookie carrying the token
+	SameSite string // lax, strict or none
+	Insecure bool   // drop the Secure attribute, for plain HTTP during development
+	Keys     string // base64 AES-256 keys encrypting the cookie, newest first; plain when empty
+
+	CSRFSecret       string // key CSRF tokens are derived with; random per process when empty
+	CSRFExemptRoutes string // route patterns that take cookie-authenticated writes without a token
+}
+
+func (c CookieConfig) sameSite() (http.SameSite, error) {
+	switch strings.ToLower(c.SameSite) {
+	case "lax", "":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		if c.Insecure {
+			return 0, fmt.Errorf("session-cookie-samesite none needs a secure cookie")
+		}
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("unknown session-cookie-samesite %q", c.SameSite)
+}
+
+// The codec encrypting the session cookie, nil without keys
+func (c CookieConfig) codec() (*session.Codec, error) {
+	keys, err := session.ParseKeys(c.Keys)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	codec, err := session.NewCodec(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("session-cookie-keys: %w", err)
+	}
+	return codec, nil
+}
+
+// The token of a request: the bearer token, or the session cookie when there is no
+// Authorization header. With session-cookie-keys, a cookie that doesn't decrypt
+// carries no token, except for a plain token set before the keys were configured,
+// which is accepted until the next refresh encrypts it.
+func (a *App) presentedToken(r *http.Request) (token string, fromCookie bool) {
+	if header := r.Header.Get("Authorization"); header != "" || a.Config.Cookies.Name == "" {
+		return strings.TrimPrefix(header, "Bearer "), false
+	}
+	cookie, err := r.Cookie(a.Config.Cookies.Name)
+	if err != nil {
+		return "", false
+	}
+	if a.cookieCodec == nil || strings.Count(cookie.Value, ".") == 2 {
+		return cookie.Value, true
+	}
+	plaintext, _, err := a.cookieCodec.Open(cookie.Name, cookie.Value)
+	if err != nil {
+		return "", false
+	}
+	return string(plaintext), true
+}
+
+// Sets the session cookie to token, encrypted with the newest session-cookie-key. It
+// outlives the token by the session idle timeout so an expired token can still be
+// refreshed through it.
+func (a *App) setSessionCookie(ctx context.Context, w http.ResponseWriter, token string) {
+	if a.cookieCodec != nil {
+		sealed, err := a.cookieCodec.Seal(a.Config.Cookies.Name, []byte(token))
+		if err != nil {
+			a.Logger.Println("Session cookie encryption failed:", err)
+			return
+		}
+		token = sealed
+	}
+	sameSite, _ := a.Config.Cookies.sameSite()
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.Config.Cookies.Name,
+		Value:    token,
+		Path:     "/",
+		Expires:  a.clock(ctx).Now().Add(a.Config.SessionIdleTimeout),
+		HttpOnly: true,
+		Secure:   !a.Config.Cookies.Insecure,
+		SameSite: sameSite,
+	})
+}
+
+func (a *App) clearSessionCookie(w http.ResponseWriter) {
+	sameSite, _ := a.Config.Cookies.sameSite()
+	http.SetCookie(w, &http.Cookie{
+		Name:     a.Config.Cookies.Name,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   !a.Config.Cookies.Insecure,
+		SameSite: sameSite,
+	})
+}
+
+// The synchronizer token of a session: an HMAC of its ID, so it needs no storage and
+// ends with the session
+func (a *App) csrfToken(sid string) string {
+	mac := hmac.New(sha256.New, a.csrfKey)
+	mac.Write([]byte("csrf:" + sid))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the CSRF token of a cookie-authenticated request. Safe methods, exempt routes
+// and requests the browser marks as same-origin pass without one; SameSite keeps the
+// cookie off most cross-site requests, but not in older browsers or from sibling
+// subdomains, which count as same-site.
+func (a *App) checkCSRF(r *http.Request, claims jwt.MapClaims) error {
+	switch {
+	case r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions:
+		return nil
+	case r.Header.Get("Sec-Fetch-Site") == "same-origin",
+		r.Pattern != "" && contains(configList(a.Config.Cookies.CSRFExemptRoutes), r.Pattern):
+		csrfMetrics.Add("exempt", 1)
+		return nil
+	}
+	presented := r.Header.Get(CSRF_HEADER)
+	if presented == "" && strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		presented = r.PostFormValue(CSRF_FORM_FIELD)
+	}
+	sid, _ := claims["sid"].(string)
+	if presented == "" || sid == "" || !hmac.Equal([]byte(presented), []byte(a.csrfToken(sid))) {
+		csrfMetrics.Add("rejected", 1)
+		a.Logger.Printf("audit: event=csrf_rejected method=%s path=%s ip=%s origin=%q", r.Method, r.URL.Path, clientIP(r), r.Header.Get("Origin"))
+		return &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Invalid CSRF token"}
+	}
+	csrfMetrics.Add("valid", 1)
+	return nil
+}
+
+// Returns the CSRF token of the caller's session, for single-page apps to send in
+// X-CSRF-Token
+func (a *App) csrfHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	sid, _ := user.Claims["sid"].(string)
+	if sid == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: Token has no session")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.writeJSON(w, r, http.StatusOK, map[string]string{"token": a.csrfToken(sid), "header": CSRF_HEADER, "field": CSRF_FORM_FIELD})
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" driver
+)
+
+// Timeout for opening and pinging the database at startup
+const DATABASE_CONNECT_TIMEOUT = 10 * time.Second
+
+// Opens and pings the configured database. The sqlite driver is built in; other
+// drivers (e.g. pgx for "pgx"/"postgres") must be linked in with a blank import.
+func openDatabase(driver, url string) (*sql.DB, error) {
+	db, err := sql.Open(driver, url)
+	if err != nil {
+		return nil, fmt.Errorf("open %s database: %w", driver, err)
+	}
+	if driver == "sqlite" {
+		// SQLite allows a single writer; serialize instead of failing with SQLITE_BUSY
+		db.SetMaxOpenConns(1)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connect to %s database: %w", driver, err)
+	}
+	return db, nil
+}
+
+// Rewrites "?" placeholders to "$1", "$2", ... for drivers that need numbered ones
+func rebind(driver, query string) string {
+	if driver != "postgres" && driver != "pgx" {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
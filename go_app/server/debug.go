@@ -0,0 +1,83 @@
+package server
+
+import (
+	"bytes"
+	"expvar"
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Slow request counts per route, published on /debug/vars
+var slowRequestMetrics = expvar.NewMap("slow_requests")
+
+// Least time between two stack samples. Each one dumps every goroutine, stopping the
+// world while it does, so when many requests turn slow at once, as under overload,
+// only the first gets a sample.
+const SLOW_REQUEST_STACK_INTERVAL = 10 * time.Second
+
+// Logs requests on route that run longer than the configured threshold, including a
+// stack sample of the handler goroutine taken when the threshold was crossed, at most
+// one per SLOW_REQUEST_STACK_INTERVAL.
+func (a *App) logSlowRequests(route string, next http.HandlerFunc) http.HandlerFunc {
+	threshold := a.Config.SlowRequestThreshold
+	if threshold <= 0 {
+		return next
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		goroutine := currentGoroutineHeader()
+
+		sample := make(chan []byte, 1)
+		timer := time.AfterFunc(threshold, func() {
+			if !a.takeStackSample() {
+				sample <- []byte("(stack not sampled: another was taken less than " + SLOW_REQUEST_STACK_INTERVAL.String() + " ago)")
+				return
+			}
+			sample <- goroutineStack(goroutine)
+		})
+
+		next(w, r)
+
+		if timer.Stop() {
+			return
+		}
+		slowRequestMetrics.Add(route, 1)
+		a.Logger.Printf("slow request: method=%s path=%s route=%s duration=%s threshold=%s\n%s",
+			r.Method, r.URL.Path, route, time.Since(start), threshold, <-sample)
+	}
+}
+
+// Reports whether a stack sample may be taken now, claiming it if so
+func (a *App) takeStackSample() bool {
+	now := time.Now().UnixNano()
+	last := a.slowStackAt.Load()
+	if last != 0 && now-last < int64(SLOW_REQUEST_STACK_INTERVAL) {
+		return false
+	}
+	return a.slowStackAt.CompareAndSwap(last, now)
+}
+
+// Returns the "goroutine N " prefix identifying the calling goroutine in stack dumps
+func currentGoroutineHeader() []byte {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	if i := bytes.IndexByte(buf, '['); i > 0 {
+		return buf[:i]
+	}
+	return buf
+}
+
+// Extracts the stack of the goroutine identified by header from a full dump
+func goroutineStack(header []byte) []byte {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+
+	for _, stack := range bytes.Split(buf, []byte("\n\n")) {
+		if bytes.HasPrefix(stack, header) {
+			return stack
+		}
+	}
+	return []byte("(stack unavailable: handler goroutine already finished)")
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go_app/telemetry"
+)
+
+// Cloud metadata endpoints deployment-metadata can query
+const (
+	DEPLOYMENT_METADATA_NONE  = "none"
+	DEPLOYMENT_METADATA_AUTO  = "auto" // all of the others at once; the first to answer, in this order, wins
+	DEPLOYMENT_METADATA_AWS   = "aws"
+	DEPLOYMENT_METADATA_GCP   = "gcp"
+	DEPLOYMENT_METADATA_AZURE = "azure"
+)
+
+// How long a cloud metadata lookup may take in all. Outside that cloud the endpoint
+// usually doesn't answer at all, so this is what auto costs there.
+const CLOUD_METADATA_TIMEOUT = 2 * time.Second
+
+// How long deployment info is reused: instances don't move, but a failed cloud
+// lookup is retried sooner
+const (
+	DEPLOYMENT_INFO_TTL       = time.Hour
+	DEPLOYMENT_INFO_RETRY_TTL = time.Minute
+)
+
+// Build number reported when no source has one
+const DEFAULT_BUILD_NUMBER = "0"
+
+// Environment variables tried, in order, when a value isn't configured: the build
+// numbers CI systems set, and the regions platforms set
+var (
+	buildNumberEnv = []string{"GITHUB_RUN_NUMBER", "CI_PIPELINE_IID", "BUILDKITE_BUILD_NUMBER", "CIRCLE_BUILD_NUM", "BUILD_ID"}
+	regionEnv      = []string{"AWS_REGION", "AWS_DEFAULT_REGION", "GOOGLE_CLOUD_REGION", "FLY_REGION"}
+	instanceEnv    = []string{"FLY_ALLOC_ID", "HOSTNAME"}
+)
+
+// Base URLs of the cloud metadata endpoints
+var cloudMetadataURLs = map[string]string{
+	DEPLOYMENT_METADATA_AWS:   "http://169.254.169.254",
+	DEPLOYMENT_METADATA_GCP:   "http://metadata.google.internal",
+	DEPLOYMENT_METADATA_AZURE: "http://169.254.169.254",
+}
+
+// Where and what this instance was deployed as. Explicit config wins over the
+// environment, the environment over the cloud metadata endpoint.
+type DeploymentConfig struct {
+	Metadata   string // cloud metadata endpoint queried, see DEPLOYMENT_METADATA_*
+	DeployTime string // e.g. set by the deploy pipeline to $(date -u +%FT%TZ)
+	Region     string
+	InstanceID string
+}
+
+func (c DeploymentConfig) validate() error {
+	switch c.Metadata {
+	case DEPLOYMENT_METADATA_NONE, "", DEPLOYMENT_METADATA_AUTO, DEPLOYMENT_METADATA_AWS, DEPLOYMENT_METADATA_GCP, DEPLOYMENT_METADATA_AZURE:
+		return nil
+	}
+	return fmt.Errorf("deployment-metadata must be none, auto, aws, gcp or azure, got %q", c.Metadata)
+}
+
+// Where the running instance is deployed, as reported by /status and /version
+type DeploymentInfo struct {
+	BuildNumber string `json:"buildNumber"`
+	DeployTime  string `json:"deployTime,omitempty"`
+	Region      string `json:"region,omitempty"`
+	InstanceID  string `json:"instanceId,omitempty"`
+	Cloud       string `json:"cloud,omitempty"` // the provider whose metadata endpoint answered
+}
+
+// Resource attributes describing the deployment, in OpenTelemetry naming
+func (info DeploymentInfo) attributes() []telemetry.Attr {
+	attrs := []telemetry.Attr{telemetry.String("service.build.number", info.BuildNumber)}
+	if info.DeployTime != "" {
+		attrs = append(attrs, telemetry.String("deployment.time", info.DeployTime))
+	}
+	if info.Region != "" {
+		attrs = append(attrs, telemetry.String("cloud.region", info.Region))
+	}
+	if info.InstanceID != "" {
+		attrs = append(attrs, telemetry.String("service.instance.id", info.InstanceID))
+	}
+	if info.Cloud != "" {
+		attrs = append(attrs, telemetry.String("cloud.provider", info.Cloud))
+	}
+	return attrs
+}
+
+// The deployment info, cached. Values missing from the config and environment are
+// asked of the cloud metadata endpoint; if that fails, what is known is returned and
+// the endpoint is asked again after DEPLOYMENT_INFO_RETRY_TTL.
+func (a *App) Deployment(ctx context.Context) DeploymentInfo {
+	info, _ := a.deployment.GetOrLoadWithTTL(ctx, "", func(ctx context.Context) (DeploymentInfo, time.Duration, error) {
+		info, err := a.resolveDeployment(ctx)
+		if err != nil {
+			a.Logger.Println("Deployment metadata lookup failed:", err)
+			return info, DEPLOYMENT_INFO_RETRY_TTL, nil
+		}
+		return info, DEPLOYMENT_INFO_TTL, nil
+	})
+	return info
+}
+
+func (a *App) resolveDeployment(ctx context.Context) (DeploymentInfo, error) {
+	config := a.Config.Deployment
+	info := DeploymentInfo{
+		BuildNumber: firstOf(a.Config.BuildNumber, firstEnv(buildNumberEnv), DEFAULT_BUILD_NUMBER),
+		DeployTime:  config.DeployTime,
+		Region:      firstOf(config.Region, firstEnv(regionEnv)),
+		InstanceID:  config.InstanceID,
+	}
+
+	var err error
+	if config.Metadata != DEPLOYMENT_METADATA_NONE && config.Metadata != "" && (info.Region == "" || info.InstanceID == "") {
+		var cloud cloudInstance
+		if cloud, err = lookupCloudMetadata(ctx, config.Metadata); err == nil {
+			info.Cloud = cloud.provider
+			info.Region = firstOf(info.Region, cloud.region)
+			info.InstanceID = firstOf(info.InstanceID, cloud.instanceID)
+		}
+	}
+	if info.InstanceID == "" {
+		info.InstanceID = firstEnv(instanceEnv)
+	}
+	if info.InstanceID == "" {
+		info.InstanceID, _ = os.Hostname()
+	}
+	return info, err
+}
+
+// Tags the app's leveled log lines and exported metrics with the deployment, once at
+// startup
+func (a *App) describeDeployment(ctx context.Context) {
+	info := a.Deployment(ctx)
+	a.Log = a.Log.With("build", info.BuildNumber, "region", info.Region, "instance", info.InstanceID)
+	if a.Metrics != nil {
+		a.Metrics.Resource = append(a.Metrics.Resource, info.attributes()...)
+	}
+	a.Logger.Printf("Deployment: build %s, region %s, instance %s", info.BuildNumber, orUnknown(info.Region), orUnknown(info.InstanceID))
+}
+
+// Adds the deployment's non-empty values to a /status entry or discovery metadata
+func addDeployment(entry map[string]string, info DeploymentInfo) {
+	entry["build"] = info.BuildNumber
+	for key, value := range map[string]string{"deployTime": info.DeployTime, "region": info.Region, "instanceId": info.InstanceID} {
+		if value != "" {
+			entry[key] = value
+		}
+	}
+}
+
+func firstOf(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func firstEnv(names []string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+type cloudInstance struct {
+	provider   string
+	region     string
+	instanceID string
+}
+
+// Metadata endpoints must be reached directly, never through a proxy
+var cloudMetadataClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+// Asks the metadata endpoint of provider, or for auto all of them at once
+func lookupCloudMetadata(ctx context.Context, provider string) (cloudInstance, error) {
+	ctx, cancel := context.WithTimeout(ctx, CLOUD_METADATA_TIMEOUT)
+	defer cancel()
+	lookups := map[string]func(context.Context, string) (cloudInstance, error){
+		DEPLOYMENT_METADATA_AWS:   awsMetadata,
+		DEPLOYMENT_METADATA_GCP:   gcpMetadata,
+		DEPLOYMENT_METADATA_AZURE: azureMetadata,
+	}
+	if provider != DEPLOYMENT_METADATA_AUTO {
+		return lookups[provider](ctx, cloudMetadataURLs[provider])
+	}
+
+	order := []string{DEPLOYMENT_METADATA_AWS, DEPLOYMENT_METADATA_GCP, DEPLOYMENT_METADATA_AZURE}
+	type result struct {
+		instance cloudInstance
+		err      error
+	}
+	results := make([]chan result, len(order))
+	for i, name := range order {
+		results[i] = make(chan result, 1)
+		go func() {
+			instance, err := lookups[name](ctx, cloudMetadataURLs[name])
+			results[i] <- result{instance, err}
+		}()
+	}
+	var errs []error
+	for i := range order {
+		r := <-results[i]
+		if r.err == nil {
+			return r.instance, nil
+		}
+		errs = append(errs, r.err)
+	}
+	return cloudInstance{}, errors.Join(errs...)
+}
+
+// EC2 instance metadata, with an IMDSv2 session token
+func awsMetadata(ctx context.Context, base string) (cloudInstance, error) {
+	token, err := metadataRequest(ctx, http.MethodPut, base+"/latest/api/token", map[string]string{"X-aws-ec2-metadata-token-ttl-seconds": "60"})
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("aws: %w", err)
+	}
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+	instanceID, err := metadataRequest(ctx, http.MethodGet, base+"/latest/meta-data/instance-id", headers)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("aws: %w", err)
+	}
+	region, err := metadataRequest(ctx, http.MethodGet, base+"/latest/meta-data/placement/region", headers)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("aws: %w", err)
+	}
+	return cloudInstance{provider: DEPLOYMENT_METADATA_AWS, region: region, instanceID: instanceID}, nil
+}
+
+// Compute Engine metadata. The region is the zone without its last part, e.g.
+// us-central1 for projects/123/zones/us-central1-a.
+func gcpMetadata(ctx context.Context, base string) (cloudInstance, error) {
+	headers := map[string]string{"Metadata-Flavor": "Google"}
+	instanceID, err := metadataRequest(ctx, http.MethodGet, base+"/computeMetadata/v1/instance/id", headers)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("gcp: %w", err)
+	}
+	zone, err := metadataRequest(ctx, http.MethodGet, base+"/computeMetadata/v1/instance/zone", headers)
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("gcp: %w", err)
+	}
+	zone = zone[strings.LastIndex(zone, "/")+1:]
+	region := zone
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		region = zone[:i]
+	}
+	return cloudInstance{provider: DEPLOYMENT_METADATA_GCP, region: region, instanceID: instanceID}, nil
+}
+
+// Azure Instance Metadata Service
+func azureMetadata(ctx context.Context, base string) (cloudInstance, error) {
+	body, err := metadataRequest(ctx, http.MethodGet, base+"/metadata/instance/compute?api-version=2021-02-01", map[string]string{"Metadata": "true"})
+	if err != nil {
+		return cloudInstance{}, fmt.Errorf("azure: %w", err)
+	}
+	var compute struct {
+		VMID     string `json:"vmId"`
+		Location string `json:"location"`
+	}
+	if err := json.Unmarshal([]byte(body), &compute); err != nil {
+		return cloudInstance{}, fmt.Errorf("azure: %w", err)
+	}
+	return cloudInstance{provider: DEPLOYMENT_METADATA_AZURE, region: compute.Location, instanceID: compute.VMID}, nil
+}
+
+func metadataRequest(ctx context.Context, method, url string, headers map[string]string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response, err := cloudMetadataClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(response.Body, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s: status %d", url, response.StatusCode)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
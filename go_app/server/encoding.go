@@ -0,0 +1,376 @@
+package server
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Field naming of JSON responses
+const (
+	JSON_NAMING_CAMEL = "camel" // configState, lastUsed
+	JSON_NAMING_SNAKE = "snake" // config_state, last_used
+)
+
+// Timestamp format of JSON responses
+const (
+	JSON_TIME_RFC3339      = "rfc3339"      // "2024-05-01T12:00:00.123Z"
+	JSON_TIME_EPOCH_MILLIS = "epoch-millis" // 1714564800123
+)
+
+// How responses are encoded. The zero value encodes like encoding/json: names as
+// declared and RFC 3339 timestamps.
+type JSONConfig struct {
+	Naming     string
+	TimeFormat string
+}
+
+func (c JSONConfig) validate() error {
+	switch c.Naming {
+	case "", JSON_NAMING_CAMEL, JSON_NAMING_SNAKE:
+	default:
+		return fmt.Errorf("unknown json-naming %q, want camel or snake", c.Naming)
+	}
+	switch c.TimeFormat {
+	case "", JSON_TIME_RFC3339, JSON_TIME_EPOCH_MILLIS:
+	default:
+		return fmt.Errorf("unknown json-time-format %q, want rfc3339 or epoch-millis", c.TimeFormat)
+	}
+	return nil
+}
+
+// Answers r with v encoded per the json-naming and json-time-format config. All JSON
+// responses go through here, so each failure is handled once: an encoding error becomes
+// a 500 while the status can still change, a response already started is left as it is
+// instead of getting a second header, and nothing is encoded for a client that is gone
+// or a route that timed out.
+func (a *App) writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	if tracked := trackedOf(w); tracked != nil && tracked.status != 0 {
+		responseMetrics.Add("after_header", 1)
+		a.Log.Warn("Response already started, dropping the rest", "path", r.URL.Path, "sent", tracked.status, "bytes", tracked.written, "status", status)
+		return
+	}
+	if err := responseAbandoned(r); err != nil {
+		responseMetrics.Add("abandoned", 1)
+		a.Log.Debug("Response not written, request is over", "path", r.URL.Path, "status", status, "error", err)
+		return
+	}
+	data, err := a.Config.JSON.Marshal(v)
+	if err != nil {
+		responseMetrics.Add("encoding_errors", 1)
+		a.Log.Error("Response encoding failed", "path", r.URL.Path, "error", err)
+		status, data = http.StatusInternalServerError, []byte(`{"error":"Internal Server Error","code":"internal_server_error","retryable":false}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		a.writeFailed(r, err)
+	}
+}
+
+// Encodes v like json.Marshal, honoring json tags, with struct field and map keys
+// renamed per Naming and time.Time values written per TimeFormat. Types with their own
+// MarshalJSON or MarshalText are encoded by encoding/json and left as they are.
+func (c JSONConfig) Marshal(v any) ([]byte, error) {
+	tree, err := c.convert(reflect.ValueOf(v))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(tree)
+}
+
+var (
+	timeType          = reflect.TypeFor[time.Time]()
+	marshalerType     = reflect.TypeFor[json.Marshaler]()
+	textMarshalerType = reflect.TypeFor[encoding.TextMarshaler]()
+)
+
+// Turns v into plain values, jsonObjects and raw JSON that json.Marshal writes as is
+func (c JSONConfig) convert(v reflect.Value) (any, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) && v.IsNil() {
+		return nil, nil
+	}
+	if v.Type() == timeType {
+		return c.formatTime(v.Interface().(time.Time)), nil
+	}
+	if v.Kind() == reflect.Pointer && v.Type().Elem() == timeType {
+		return c.convert(v.Elem())
+	}
+	if v.Type().Implements(marshalerType) || v.Type().Implements(textMarshalerType) {
+		data, err := json.Marshal(v.Interface())
+		return json.RawMessage(data), err
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		return c.convert(v.Elem())
+	case reflect.Struct:
+		var fields []jsonField
+		if err := c.appendFields(&fields, v, 0); err != nil {
+			return nil, err
+		}
+		object := make(jsonObject, 0, len(fields))
+		for _, field := range fields {
+			object = append(object, field.member)
+		}
+		return object, nil
+	case reflect.Map:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return c.convertMap(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface(), nil // base64, as encoding/json does
+		}
+		fallthrough
+	case reflect.Array:
+		items := make([]any, v.Len())
+		for i := range items {
+			item, err := c.convert(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	}
+	return v.Interface(), nil
+}
+
+type jsonField struct {
+	member jsonMember
+	depth  int // embedding depth; shallower fields hide deeper ones of the same name
+}
+
+// Adds v's fields to fields, promoting those of embedded structs like encoding/json
+func (c JSONConfig) appendFields(fields *[]jsonField, v reflect.Value, depth int) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		value := v.Field(i)
+
+		if field.Anonymous && name == "" {
+			embedded := value
+			if embedded.Kind() == reflect.Pointer {
+				if embedded.IsNil() {
+					continue
+				}
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if err := c.appendFields(fields, embedded, depth+1); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !field.IsExported() {
+			continue
+		}
+		optionList := strings.Split(options, ",")
+		if slices.Contains(optionList, "omitempty") && isEmptyValue(value) ||
+			slices.Contains(optionList, "omitzero") && value.IsZero() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		converted, err := c.convert(value)
+		if err != nil {
+			return err
+		}
+
+		member := jsonField{member: jsonMember{Key: c.key(name), Value: converted}, depth: depth}
+		index := slices.IndexFunc(*fields, func(existing jsonField) bool { return existing.member.Key == member.member.Key })
+		switch {
+		case index < 0:
+			*fields = append(*fields, member)
+		case member.depth < (*fields)[index].depth:
+			(*fields)[index] = member
+		}
+	}
+	return nil
+}
+
+// Map entries sorted by key, as encoding/json writes them
+func (c JSONConfig) convertMap(v reflect.Value) (jsonObject, error) {
+	object := make(jsonObject, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKey(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		value, err := c.convert(iter.Value())
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, jsonMember{Key: key, Value: value})
+	}
+	sort.Slice(object, func(i, j int) bool { return object[i].Key < object[j].Key })
+	for i := range object {
+		object[i].Key = c.key(object[i].Key)
+	}
+	return object, nil
+}
+
+func mapKey(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if marshaler, ok := key.Interface().(encoding.TextMarshaler); ok {
+		text, err := marshaler.MarshalText()
+		return string(text), err
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", key.Type())
+}
+
+// Same rules as encoding/json's omitempty
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64,
+		reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+func (c JSONConfig) formatTime(t time.Time) any {
+	if c.TimeFormat == JSON_TIME_EPOCH_MILLIS {
+		return t.UnixMilli()
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// Renames key per Naming. Keys that are not identifiers, like "my-application" or
+// config keys, are data rather than field names and stay as they are.
+func (c JSONConfig) key(key string) string {
+	if !isIdentifier(key) {
+		return key
+	}
+	switch c.Naming {
+	case JSON_NAMING_CAMEL:
+		return camelCase(key)
+	case JSON_NAMING_SNAKE:
+		return snakeCase(key)
+	}
+	return key
+}
+
+func isIdentifier(key string) bool {
+	for i, r := range key {
+		if !(r < unicode.MaxASCII && (unicode.IsLetter(r) || r == '_' || i > 0 && unicode.IsDigit(r))) {
+			return false
+		}
+	}
+	return key != ""
+}
+
+// Splits an identifier into lower-cased words: "cacheTTL", "cache_ttl" and "CacheTTL"
+// all give [cache ttl], and "sha256" stays one word
+func identifierWords(key string) []string {
+	var words []string
+	runes := []rune(key)
+	start := 0
+	for i := 1; i <= len(runes); i++ {
+		boundary := i == len(runes) || runes[i] == '_'
+		if !boundary && unicode.IsUpper(runes[i]) {
+			// lower to upper (cacheTtl), or the last capital of an acronym (TTLValue)
+			boundary = !unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])
+		}
+		if boundary {
+			if word := strings.Trim(string(runes[start:i]), "_"); word != "" {
+				words = append(words, strings.ToLower(word))
+			}
+			start = i
+		}
+	}
+	return words
+}
+
+func snakeCase(key string) string {
+	return strings.Join(identifierWords(key), "_")
+}
+
+// Keys without underscores only get a lowered leading capital, so "cacheTTL" and
+// "userID" keep their acronyms while "UserID" becomes "userID"
+func camelCase(key string) string {
+	if !strings.Contains(key, "_") {
+		runes := []rune(key)
+		upper := 0
+		for upper < len(runes) && unicode.IsUpper(runes[upper]) {
+			upper++
+		}
+		if upper > 1 && upper < len(runes) && unicode.IsLower(runes[upper]) {
+			upper-- // URLPath: the P starts the next word
+		}
+		return strings.ToLower(string(runes[:upper])) + string(runes[upper:])
+	}
+	words := identifierWords(key)
+	for i := 1; i < len(words); i++ {
+		words[i] = strings.ToUpper(words[i][:1]) + words[i][1:]
+	}
+	return strings.Join(words, "")
+}
+
+// A JSON object that keeps its member order
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	Key   string
+	Value any
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, member := range o {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, err := json.Marshal(member.Key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(member.Value)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
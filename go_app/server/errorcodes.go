@@ -0,0 +1,93 @@
+package server
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"go_app/i18n"
+)
+
+// The status and retryability of each error code; its messages are in
+// locales/<locale>.json
+//
+//go:embed errorcodes.json
+var errorCodesFile []byte
+
+// What clients may rely on about an error code, as exported by scaffold errors export
+type ErrorCode struct {
+	Code       string            `json:"code"`
+	Status     int               `json:"status"`
+	MessageKey string            `json:"messageKey"` // in locales/<locale>.json
+	Retryable  bool              `json:"retryable"`  // the same request may succeed later
+	Messages   map[string]string `json:"messages"`   // by locale
+}
+
+type errorDefinition struct {
+	Status    int  `json:"status"`
+	Retryable bool `json:"retryable"`
+}
+
+var errorDefinitions = loadErrorDefinitions()
+
+// Every code must have both a definition and an English message, so the catalog
+// handed to clients is complete
+func loadErrorDefinitions() map[string]errorDefinition {
+	var definitions map[string]errorDefinition
+	if err := json.Unmarshal(errorCodesFile, &definitions); err != nil {
+		panic(err) // the embedded catalog is broken, a build problem
+	}
+	english := errorCatalog.Messages(i18n.DEFAULT_LOCALE)
+	for code, definition := range definitions {
+		if _, ok := english[code]; !ok {
+			panic(fmt.Sprintf("error code %s has no message in %s.json", code, i18n.DEFAULT_LOCALE))
+		}
+		if http.StatusText(definition.Status) == "" {
+			panic(fmt.Sprintf("error code %s has unknown status %d", code, definition.Status))
+		}
+	}
+	for code := range english {
+		if _, ok := definitions[code]; !ok {
+			panic(fmt.Sprintf("error code %s is missing from errorcodes.json", code))
+		}
+	}
+	return definitions
+}
+
+// Reports whether clients may retry an error with code. Codes outside the catalog
+// are the status's own (see statusCode), retryable when the status says so.
+func retryableError(code string, status int) bool {
+	if definition, ok := errorDefinitions[code]; ok {
+		return definition.Retryable
+	}
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Every error code with its status, retryability and messages in each shipped
+// language, sorted by code
+func ErrorCatalog() []ErrorCode {
+	codes := make([]ErrorCode, 0, len(errorDefinitions))
+	for code, definition := range errorDefinitions {
+		messages := map[string]string{}
+		for _, locale := range errorCatalog.Locales() {
+			if message, ok := errorCatalog.Messages(locale)[code]; ok {
+				messages[locale] = message
+			}
+		}
+		codes = append(codes, ErrorCode{
+			Code:       code,
+			Status:     definition.Status,
+			MessageKey: code,
+			Retryable:  definition.Retryable,
+			Messages:   messages,
+		})
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes
+}
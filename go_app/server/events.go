@@ -0,0 +1,87 @@
+package server
+
+import (
+	"time"
+
+	"go_app/eventbus"
+)
+
+// Topics published on App.Events
+var (
+	TopicLogin          = eventbus.NewTopic[LoginEvent]("auth.login")
+	TopicLockout        = eventbus.NewTopic[LockoutEvent]("auth.lockout")
+	TopicLogout         = eventbus.NewTopic[LogoutEvent]("auth.logout")
+	TopicKeyRotated     = eventbus.NewTopic[KeyRotatedEvent]("auth.key_rotated")
+	TopicConfigChanged  = eventbus.NewTopic[ConfigChangedEvent]("config.changed")
+	TopicPanic          = eventbus.NewTopic[PanicEvent]("http.panic")
+	TopicReadiness      = eventbus.NewTopic[ReadinessEvent]("health.readiness")
+	TopicChange         = eventbus.NewTopic[ChangeEvent]("data.changed")
+	TopicUserRegistered = eventbus.NewTopic[UserRegisteredEvent]("auth.user_registered")
+	TopicSLOBurn        = eventbus.NewTopic[SLOBurnEvent]("slo.burn")
+)
+
+// A login attempt that reached the credential check
+type LoginEvent struct {
+	Username string
+	IP       string
+	Success  bool
+	Time     time.Time
+}
+
+// A username or IP locked out after repeated failed logins
+type LockoutEvent struct {
+	Key      string
+	Failures int
+	Until    time.Time
+}
+
+// A token revoked through /logout
+type LogoutEvent struct {
+	UserID string
+	IP     string
+	Time   time.Time
+}
+
+// The token signing key changed
+type KeyRotatedEvent struct {
+	KeyID string
+	Time  time.Time
+}
+
+// A metadata refresh changed these dotted key paths, e.g. "rateLimits.pro"
+type ConfigChangedEvent struct {
+	Source string
+	Keys   []string
+	Time   time.Time
+}
+
+// A handler panicked
+type PanicEvent struct {
+	Route string
+	Path  string
+	Value string
+	Time  time.Time
+}
+
+// A route's SLO burn rate alert started or stopped firing, see evaluateSLOs
+type SLOBurnEvent struct {
+	Route     string
+	Alert     string        // SLOAlert.Name
+	Window    time.Duration // the alert's long window
+	BurnRate  float64       // over Window
+	Objective float64
+	Firing    bool
+	Time      time.Time
+}
+
+// Readiness changed because the metadata became unavailable or recovered
+type ReadinessEvent struct {
+	Ready  bool
+	Reason string
+	Time   time.Time
+}
+
+// LoginGuard hook publishing lockouts
+func (a *App) publishLockout(key string, failures int, until time.Time) {
+	eventbus.Publish(a.Events, TopicLockout, LockoutEvent{Key: key, Failures: failures, Until: until})
+}
@@ -0,0 +1,434 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/subprocess"
+)
+
+// Room for multipart headers and boundaries on top of files-max-size
+const MULTIPART_OVERHEAD = 1 << 20
+
+// Longest a scan command may take before the upload fails
+const FILE_SCAN_TIMEOUT = 2 * time.Minute
+
+// Upload settings; /files answers 404 when Store is empty
+type FilesConfig struct {
+	Store             string // blob store: directory, file:///dir or s3://bucket/prefix
+	MaxSize           int64  // bytes per file
+	AllowedExtensions string // e.g. ".png,.pdf"; empty allows any
+	ScanCommand       string // run with the upload's path before it is stored
+}
+
+// An uploaded file; the content lives in the blob store under ID
+type File struct {
+	ID          string    `json:"id"`
+	OwnerID     string    `json:"-"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	SHA256      string    `json:"sha256"`
+	Created     time.Time `json:"created"`
+}
+
+// Persists file records
+type FileStore interface {
+	Create(ctx context.Context, file File) error
+	Get(ctx context.Context, id string) (File, bool, error)
+	List(ctx context.Context, ownerID string) ([]File, error)
+	Delete(ctx context.Context, id string) error
+}
+
+// Inspects an upload before it is stored, e.g. with a virus scanner. Returning
+// ErrInfected rejects the upload; other errors fail it.
+type FileScanner interface {
+	Scan(ctx context.Context, path string) error
+}
+
+var ErrInfected = errors.New("file failed the security scan")
+
+// Runs a command such as "clamdscan --no-summary" with the file path appended. Exit
+// status 1 means infected, as with ClamAV; any other failure is an error.
+type commandScanner struct {
+	args []string
+}
+
+func newCommandScanner(command string) FileScanner {
+	if command == "" {
+		return nil
+	}
+	return &commandScanner{args: strings.Fields(command)}
+}
+
+func (s *commandScanner) Scan(ctx context.Context, path string) error {
+	output, err := subprocess.Default.Run(ctx, subprocess.Command{
+		Name:    s.args[0],
+		Args:    append(s.args[1:len(s.args):len(s.args)], path),
+		Timeout: FILE_SCAN_TIMEOUT,
+	})
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return fmt.Errorf("%w: %s", ErrInfected, strings.TrimSpace(string(output)))
+	}
+	if err != nil {
+		return fmt.Errorf("scan command: %w", err)
+	}
+	return nil
+}
+
+type memoryFileStore struct {
+	mutex sync.Mutex
+	files map[string]File
+}
+
+func NewMemoryFileStore() FileStore {
+	return &memoryFileStore{files: make(map[string]File)}
+}
+
+func (s *memoryFileStore) Create(ctx context.Context, file File) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.files[file.ID] = file
+	return nil
+}
+
+func (s *memoryFileStore) Get(ctx context.Context, id string) (File, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	file, ok := s.files[id]
+	return file, ok, nil
+}
+
+func (s *memoryFileStore) List(ctx context.Context, ownerID string) ([]File, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var files []File
+	for _, file := range s.files {
+		if file.OwnerID == ownerID {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Created.After(files[j].Created) })
+	return files, nil
+}
+
+func (s *memoryFileStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.files, id)
+	return nil
+}
+
+// File records in a SQL database
+type sqlFileStore struct {
+	db     SQLDB
+	driver string
+}
+
+const filesSchema = `CREATE TABLE IF NOT EXISTS files (
+	id TEXT PRIMARY KEY,
+	owner_id TEXT NOT NULL,
+	name TEXT NOT NULL,
+	size BIGINT NOT NULL,
+	content_type TEXT NOT NULL,
+	sha256 TEXT NOT NULL,
+	created_at BIGINT NOT NULL
+)`
+
+// Creates the files table if needed
+func NewSQLFileStore(db SQLDB, driver string) (FileStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	for _, statement := range []string{
+		filesSchema,
+		`CREATE INDEX IF NOT EXISTS files_owner_id ON files (owner_id)`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlFileStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlFileStore) Create(ctx context.Context, file File) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO files (id, owner_id, name, size, content_type, sha256, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		file.ID, file.OwnerID, file.Name, file.Size, file.ContentType, file.SHA256, file.Created.Unix())
+	return err
+}
+
+func scanFile(row interface{ Scan(...interface{}) error }) (File, error) {
+	var file File
+	var created int64
+	err := row.Scan(&file.ID, &file.OwnerID, &file.Name, &file.Size, &file.ContentType, &file.SHA256, &created)
+	file.Created = time.Unix(created, 0)
+	return file, err
+}
+
+func (s *sqlFileStore) Get(ctx context.Context, id string) (File, bool, error) {
+	row := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT id, owner_id, name, size, content_type, sha256, created_at FROM files WHERE id = ?`), id)
+	file, err := scanFile(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return File{}, false, nil
+	}
+	if err != nil {
+		return File{}, false, err
+	}
+	return file, true, nil
+}
+
+func (s *sqlFileStore) List(ctx context.Context, ownerID string) ([]File, error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.driver, `SELECT id, owner_id, name, size, content_type, sha256, created_at FROM files WHERE owner_id = ? ORDER BY created_at DESC`), ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []File
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+func (s *sqlFileStore) Delete(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `DELETE FROM files WHERE id = ?`), id)
+	return err
+}
+
+func (a *App) extensionAllowed(name string) bool {
+	if a.Config.Files.AllowedExtensions == "" {
+		return true
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, allowed := range strings.Split(a.Config.Files.AllowedExtensions, ",") {
+		if ext != "" && ext == strings.ToLower(strings.TrimSpace(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// The caller's file with the ID in the path; other users' files count as missing
+func (a *App) ownedFile(w http.ResponseWriter, r *http.Request) (File, bool) {
+	user, _ := UserFromContext(r.Context())
+	file, exists, err := a.stores(r.Context()).Files.Get(r.Context(), r.PathValue("id"))
+	if err != nil {
+		a.Logger.Println("File lookup failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return File{}, false
+	}
+	if !exists || file.OwnerID != user.ID {
+		a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found: File does not exist")
+		return File{}, false
+	}
+	return file, true
+}
+
+// Streams the "file" part of a multipart body to a temporary file while hashing it,
+// scans it, then moves it to the blob store
+func (a *App) uploadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Blobs == nil {
+		a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found: File storage is not configured")
+		return
+	}
+	user, _ := UserFromContext(r.Context())
+	maxSize := a.Config.Files.MaxSize
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+MULTIPART_OVERHEAD)
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: multipart/form-data body required")
+		return
+	}
+	var part io.Reader
+	var name string
+	for {
+		next, err := reader.NextPart()
+		if err != nil {
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: file field is required")
+			return
+		}
+		if next.FormName() == "file" && next.FileName() != "" {
+			part, name = next, filepath.Base(next.FileName())
+			break
+		}
+	}
+	if !a.extensionAllowed(name) {
+		a.handleErrorResponse(w, r, http.StatusUnsupportedMediaType, "Unsupported Media Type: File type not allowed")
+		return
+	}
+
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		a.Logger.Println("Upload failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(part, maxSize+1))
+	var tooLarge *http.MaxBytesError
+	if size > maxSize || errors.As(err, &tooLarge) {
+		a.handleErrorResponse(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request Entity Too Large: Files are limited to %d bytes", maxSize))
+		return
+	}
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: Upload interrupted")
+		return
+	}
+
+	// The content decides the type, not the client's claim
+	head := make([]byte, 512)
+	n, _ := tmp.ReadAt(head, 0)
+	contentType := http.DetectContentType(head[:n])
+
+	if a.FileScanner != nil {
+		err := a.Workers.Do(r.Context(), func(ctx context.Context) error {
+			return a.FileScanner.Scan(ctx, tmp.Name())
+		})
+		if errors.Is(err, ErrInfected) {
+			a.Logger.Printf("audit: event=upload_rejected user=%s name=%q ip=%s reason=%q", user.ID, name, clientIP(r), err)
+			a.handleErrorResponse(w, r, http.StatusUnprocessableEntity, "Unprocessable Entity: File failed the security scan")
+			return
+		}
+		if a.handleWorkerError(w, r, err) {
+			return
+		}
+	}
+
+	id, err := newRandomID()
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	file := File{
+		ID:          id,
+		OwnerID:     user.ID,
+		Name:        name,
+		Size:        size,
+		ContentType: contentType,
+		SHA256:      hex.EncodeToString(hash.Sum(nil)),
+		Created:     a.clock(r.Context()).Now(),
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err == nil {
+		err = a.Blobs.Put(r.Context(), id, tmp, size, contentType)
+	}
+	if err == nil {
+		err = a.stores(r.Context()).Files.Create(r.Context(), file)
+	}
+	if err != nil {
+		a.Logger.Println("Upload failed:", err)
+		a.Blobs.Delete(context.WithoutCancel(r.Context()), id)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	a.Logger.Printf("audit: event=file_uploaded file=%s user=%s size=%d ip=%s", id, user.ID, size, clientIP(r))
+	w.Header().Set("Location", "/files/"+id)
+	a.writeJSON(w, r, http.StatusCreated, file)
+}
+
+// Lists the caller's files, newest first
+func (a *App) listFilesHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	files, err := a.stores(r.Context()).Files.List(r.Context(), user.ID)
+	if err != nil {
+		a.Logger.Println("File listing failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// NDJSON with Accept: application/x-ndjson, {"files": [...]} otherwise
+	stream := NewJSONStream(w, r, StreamOptions{Envelope: "files", Encoding: a.Config.JSON})
+	for _, file := range files {
+		// Unbuffered and without a Timeout, so the request context is what ends a listing
+		if r.Context().Err() != nil {
+			return
+		}
+		if err := stream.Write(file); err != nil {
+			return
+		}
+	}
+	stream.Close()
+}
+
+// Streams one of the caller's files as an attachment
+func (a *App) downloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Blobs == nil {
+		a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found: File storage is not configured")
+		return
+	}
+	file, ok := a.ownedFile(w, r)
+	if !ok {
+		return
+	}
+	etag := `"` + file.SHA256 + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, _, err := a.Blobs.Get(r.Context(), file.ID)
+	if err != nil {
+		a.Logger.Println("File download failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", file.ContentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": file.Name}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag)
+	if _, err := io.Copy(w, body); err != nil {
+		a.Logger.Println("File download interrupted:", err)
+	}
+}
+
+// Removes one of the caller's files
+func (a *App) deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	if a.Blobs == nil {
+		a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found: File storage is not configured")
+		return
+	}
+	user, _ := UserFromContext(r.Context())
+	file, ok := a.ownedFile(w, r)
+	if !ok {
+		return
+	}
+	if err := a.Blobs.Delete(r.Context(), file.ID); err != nil {
+		a.Logger.Println("File deletion failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if err := a.stores(r.Context()).Files.Delete(r.Context(), file.ID); err != nil {
+		a.Logger.Println("File deletion failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	a.Logger.Printf("audit: event=file_deleted file=%s user=%s ip=%s", file.ID, user.ID, clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
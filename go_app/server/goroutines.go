@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"go_app/eventbus"
+)
+
+// Goroutines started with App.Go per route, published on /debug/vars, e.g.
+// request_goroutines{key="POST /orders",field="running"} 2
+var goroutineMetrics = expvar.NewMap("request_goroutines")
+
+var goroutineMetricsMutex sync.Mutex
+
+// Route that goroutines started outside a request are counted under
+const GOROUTINE_ROUTE_NONE = "none"
+
+// The goroutines a request started with App.Go
+type goroutineGroup struct {
+	route string
+	path  string
+
+	mutex   sync.Mutex
+	started int
+	running map[int][]byte // stack header of each running goroutine, by start order
+	leaked  map[int]bool
+}
+
+type goroutineGroupKey struct{}
+
+// The counters of route, created on first use
+func routeGoroutineMetrics(route string) *expvar.Map {
+	if metrics, ok := goroutineMetrics.Get(route).(*expvar.Map); ok {
+		return metrics
+	}
+	goroutineMetricsMutex.Lock()
+	defer goroutineMetricsMutex.Unlock()
+	if metrics, ok := goroutineMetrics.Get(route).(*expvar.Map); ok {
+		return metrics
+	}
+	metrics := new(expvar.Map).Init()
+	for _, field := range []string{"started", "running", "panics", "leaked"} {
+		metrics.Add(field, 0)
+	}
+	goroutineMetrics.Set(route, metrics)
+	return metrics
+}
+
+// Gives requests on route a group for App.Go. Goroutines of the group still running
+// goroutine-leak-timeout after the handler returned are logged with their stack and
+// counted as leaked, once each.
+func (a *App) trackGoroutines(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		group := &goroutineGroup{route: route, path: r.URL.Path, running: map[int][]byte{}, leaked: map[int]bool{}}
+		next(w, r.WithContext(context.WithValue(r.Context(), goroutineGroupKey{}, group)))
+
+		group.mutex.Lock()
+		started := group.started
+		group.mutex.Unlock()
+		if timeout := a.Config.GoroutineLeakTimeout; started > 0 && timeout > 0 {
+			time.AfterFunc(timeout, func() { a.reportLeaks(group, timeout) })
+		}
+	}
+}
+
+func (a *App) reportLeaks(group *goroutineGroup, timeout time.Duration) {
+	group.mutex.Lock()
+	var headers [][]byte
+	for id, header := range group.running {
+		if header != nil && !group.leaked[id] {
+			group.leaked[id] = true
+			headers = append(headers, header)
+		}
+	}
+	group.mutex.Unlock()
+
+	for _, header := range headers {
+		routeGoroutineMetrics(group.route).Add("leaked", 1)
+		a.Logger.Printf("goroutine leak: route=%s path=%s still running %s after the request ended\n%s",
+			group.route, group.path, timeout, goroutineStack(header))
+	}
+}
+
+// Runs fn in a goroutine tied to the request in ctx. fn gets ctx, which ends with the
+// request unless the caller detached it with context.WithoutCancel. The goroutine is
+// counted on the request's route, and a panic is logged and published on TopicPanic
+// instead of crashing the process. Handlers should start background work this way
+// rather than with a bare go statement, so work that never finishes shows up on
+// /debug/goroutines and in the log.
+func (a *App) Go(ctx context.Context, fn func(ctx context.Context)) {
+	group, _ := ctx.Value(goroutineGroupKey{}).(*goroutineGroup)
+	route, path := GOROUTINE_ROUTE_NONE, ""
+	id := 0
+	if group != nil {
+		route, path = group.route, group.path
+		group.mutex.Lock()
+		group.started++
+		id = group.started
+		// Reserved now, so a leak check racing the start still sees the goroutine
+		group.running[id] = nil
+		group.mutex.Unlock()
+	}
+	metrics := routeGoroutineMetrics(route)
+	metrics.Add("started", 1)
+	metrics.Add("running", 1)
+
+	go func() {
+		if group != nil {
+			header := currentGoroutineHeader()
+			group.mutex.Lock()
+			if _, ok := group.running[id]; ok {
+				group.running[id] = header
+			}
+			group.mutex.Unlock()
+		}
+		defer func() {
+			metrics.Add("running", -1)
+			if group != nil {
+				group.mutex.Lock()
+				delete(group.running, id)
+				group.mutex.Unlock()
+			}
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			metrics.Add("panics", 1)
+			a.Logger.Printf("Panic in goroutine of %s: %v\n%s", route, recovered, debug.Stack())
+			eventbus.Publish(a.Events, TopicPanic, PanicEvent{
+				Route: route,
+				Path:  path,
+				Value: fmt.Sprint(recovered),
+				Time:  a.Clock.Now(),
+			})
+		}()
+		fn(ctx)
+	}()
+}
+
+type goroutineCounts struct {
+	Started int64 `json:"started"`
+	Running int64 `json:"running"`
+	Panics  int64 `json:"panics"`
+	Leaked  int64 `json:"leaked"`
+}
+
+type goroutinesResponse struct {
+	Total  int                        `json:"total"` // every goroutine of the process
+	Routes map[string]goroutineCounts `json:"routes"`
+}
+
+// Goroutine counts of the process and per route, for spotting handlers that leak
+// background work
+func (a *App) listGoroutines(ctx context.Context, _ struct{}) (goroutinesResponse, error) {
+	response := goroutinesResponse{Total: runtime.NumGoroutine(), Routes: map[string]goroutineCounts{}}
+	goroutineMetrics.Do(func(kv expvar.KeyValue) {
+		metrics, ok := kv.Value.(*expvar.Map)
+		if !ok {
+			return
+		}
+		value := func(field string) int64 {
+			if counter, ok := metrics.Get(field).(*expvar.Int); ok {
+				return counter.Value()
+			}
+			return 0
+		}
+		response.Routes[kv.Key] = goroutineCounts{
+			Started: value("started"),
+			Running: value("running"),
+			Panics:  value("panics"),
+			Leaked:  value("leaked"),
+		}
+	})
+	return response, nil
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go_app/graphql"
+)
+
+// Returned by resolvers when the request carries no user, or one without the scopes
+// the field's REST route requires
+var (
+	errGraphQLUnauthorized = errors.New("Unauthorized: Missing token")
+	errGraphQLScope        = errors.New("Forbidden: Insufficient scope")
+)
+
+// The request's user, if it was granted scopes. Each resolver asks for the scopes of
+// the REST route serving the same data, so /graphql is no way around them.
+func graphQLUser(ctx context.Context, scopes ...string) (*User, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return nil, errGraphQLUnauthorized
+	}
+	if !user.HasScopes(scopes...) {
+		return nil, errGraphQLScope
+	}
+	return user, nil
+}
+
+// Schema of /graphql:
+//
+//	type Query {
+//	  me: User
+//	  status: Status
+//	  sessions: [Session]
+//	}
+//	type Mutation {
+//	  revokeSession(id: ID!): Boolean
+//	}
+//	type User { id: ID, username: String, authMethod: String, roles: [String] }
+//	type Status { description: String, version: String, sha: String, configState: String, error: String }
+//	type Session { id: ID, userAgent: String, ip: String, created: Time, lastUsed: Time, current: Boolean }
+//
+// Time follows json-time-format.
+func (a *App) graphQLSchema() *graphql.Schema {
+	user := &graphql.Object{Name: "User", Fields: map[string]*graphql.Field{
+		"id":         graphql.Property(func(u *User) any { return u.ID }),
+		"username":   graphql.Property(func(u *User) any { return u.Username }),
+		"authMethod": graphql.Property(func(u *User) any { return u.AuthMethod }),
+		"roles": graphql.Property(func(u *User) any {
+			roles, _ := u.Claims["roles"].([]interface{})
+			return roles
+		}),
+	}}
+	status := &graphql.Object{Name: "Status", Fields: map[string]*graphql.Field{
+		"description": graphql.Property(func(s map[string]string) any { return s["description"] }),
+		"version":     graphql.Property(func(s map[string]string) any { return s["version"] }),
+		"sha":         graphql.Property(func(s map[string]string) any { return s["sha"] }),
+		"configState": graphql.Property(func(s map[string]string) any { return s["configState"] }),
+		"error":       graphql.Property(func(s map[string]string) any { return s["error"] }),
+	}}
+	session := &graphql.Object{Name: "Session", Fields: map[string]*graphql.Field{
+		"id":        graphql.Property(func(s sessionView) any { return s.ID }),
+		"userAgent": graphql.Property(func(s sessionView) any { return s.UserAgent }),
+		"ip":        graphql.Property(func(s sessionView) any { return s.IP }),
+		"created":   graphql.Property(func(s sessionView) any { return a.Config.JSON.formatTime(s.Created) }),
+		"lastUsed":  graphql.Property(func(s sessionView) any { return a.Config.JSON.formatTime(s.LastUsed) }),
+		"current":   graphql.Property(func(s sessionView) any { return s.Current }),
+	}}
+
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"me": {Type: user, Resolve: func(ctx context.Context, _ any, _ graphql.Args) (any, error) {
+			return graphQLUser(ctx)
+		}},
+		"status": {Type: status, Resolve: func(ctx context.Context, _ any, _ graphql.Args) (any, error) {
+			if _, err := graphQLUser(ctx, SCOPE_STATUS_READ); err != nil {
+				return nil, err
+			}
+			return a.statusEntry(ctx), nil
+		}},
+		"sessions": {Type: session, Resolve: func(ctx context.Context, _ any, _ graphql.Args) (any, error) {
+			if _, err := graphQLUser(ctx); err != nil {
+				return nil, err
+			}
+			list, err := a.listSessions(ctx, struct{}{})
+			if err != nil {
+				return nil, a.graphQLError(err)
+			}
+			return list.Sessions, nil
+		}},
+	}}
+	mutation := &graphql.Object{Name: "Mutation", Fields: map[string]*graphql.Field{
+		"revokeSession": {Resolve: func(ctx context.Context, _ any, args graphql.Args) (any, error) {
+			if _, err := graphQLUser(ctx); err != nil {
+				return nil, err
+			}
+			id, ok := args.String("id")
+			if !ok || id == "" {
+				return nil, errors.New("Bad Request: id is required")
+			}
+			if _, err := a.deleteSession(ctx, sessionRequest{ID: id}); err != nil {
+				return nil, a.graphQLError(err)
+			}
+			return true, nil
+		}},
+	}}
+	return &graphql.Schema{Query: query, Mutation: mutation}
+}
+
+// This service's /status entry, without downstreams
+func (a *App) statusEntry(ctx context.Context) map[string]string {
+	deployment := a.Deployment(ctx)
+	config, err := a.loadConfiguration(ctx)
+	if err != nil {
+		entry := map[string]string{"configState": CONFIG_STATE_DEGRADED, "error": err.Error()}
+		if sha, err := a.Version.SHA(ctx); err == nil {
+			entry["sha"] = sha
+		}
+		addDeployment(entry, deployment)
+		return entry
+	}
+	description, _ := config.Metadata["description"].(string)
+	version, _ := config.Metadata["version"].(string)
+	entry := map[string]string{
+		"description": description,
+		"version":     fmt.Sprintf("%s-%s", version, deployment.BuildNumber),
+		"sha":         config.SHA,
+		"configState": CONFIG_STATE_OK,
+	}
+	addDeployment(entry, deployment)
+	return entry
+}
+
+// Passes a RejectError's message to the client and hides anything else, like Handle does
+func (a *App) graphQLError(err error) error {
+	var rejected *RejectError
+	if errors.As(err, &rejected) {
+		return errors.New(rejected.Message)
+	}
+	a.Log.Error("GraphQL resolver failed", "error", err)
+	return errors.New("Internal Server Error")
+}
+
+// Serves the schema with the client IP in the context for audit lines. The response
+// keeps the field names of the query, so json-naming does not apply.
+func (a *App) graphqlHandler() http.HandlerFunc {
+	serve := graphql.Handler(a.graphQLSchema())
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, clientIP(r))
+		serve(w, r.WithContext(ctx))
+	}
+}
@@ -0,0 +1,480 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"go_app/configcrypt"
+	"go_app/configformat"
+	"go_app/configsource"
+	"go_app/eventbus"
+)
+
+// Constants
+const CACHE_DURATION_MS = 5 * 60 * 1000 // 5 minutes
+const TOKEN_EXPIRATION_TIME = time.Hour // 1-hour token expiration
+const CONFIG_SOURCE_TIMEOUT = 5 * time.Second
+const CONFIG_RETRY_AFTER = 30 * time.Second // suggested wait while the metadata is unavailable
+const CONFIG_CACHE_KEY = "metadata"         // the metadata's key in App.configCache
+const GIT_SHA_TIMEOUT = 2 * time.Second
+
+// Whether /status could load the metadata
+const (
+	CONFIG_STATE_OK       = "ok"
+	CONFIG_STATE_DEGRADED = "degraded"
+)
+
+// Holds configuration information with metadata, SHA value, and last updated timestamp.
+type ConfigCache struct {
+	Metadata    map[string]interface{}
+	SHA         string
+	LastUpdated int64
+}
+
+func (a *App) handleErrorResponse(w http.ResponseWriter, r *http.Request, statusCode int, message string) {
+	if statusCode >= http.StatusInternalServerError {
+		a.Log.Error(message, "status", statusCode)
+	} else {
+		a.Log.Info(message, "status", statusCode)
+	}
+	a.writeJSON(w, r, statusCode, errorBody(w, r, statusCode, message))
+}
+
+// Returns the cached metadata, loading it when stale. Concurrent requests share one
+// load. ctx is usually the request's, so a client that disconnects or times out stops
+// the load; that says nothing about the metadata source, so it neither degrades
+// readiness nor reaches the cache, and requests still waiting load it themselves.
+func (a *App) loadConfiguration(ctx context.Context) (ConfigCache, error) {
+	return a.configCache.GetOrLoad(ctx, CONFIG_CACHE_KEY, func(ctx context.Context) (ConfigCache, error) {
+		config, err := a.fetchConfiguration(ctx)
+		if err != nil && ctx.Err() != nil {
+			return ConfigCache{}, ctx.Err()
+		}
+
+		a.configMutex.Lock()
+		defer a.configMutex.Unlock()
+		if err != nil {
+			a.setConfigState(CONFIG_STATE_DEGRADED, err)
+			return ConfigCache{}, err
+		}
+		config.LastUpdated = a.Clock.Now().UnixMilli()
+		a.setConfigState(CONFIG_STATE_OK, nil)
+		if a.routeSettings.Load() == nil || !reflect.DeepEqual(a.configSnapshot["routes"], config.Metadata["routes"]) {
+			a.applyRouteSettings(config.Metadata["routes"])
+		}
+		a.recordConfigChange(config.Metadata)
+		return config, nil
+	})
+}
+
+func (a *App) fetchConfiguration(ctx context.Context) (ConfigCache, error) {
+	ctx, cancel := context.WithTimeout(ctx, CONFIG_SOURCE_TIMEOUT)
+	defer cancel()
+	metadataContent, err := a.MetadataSource.Load(ctx)
+	if err != nil {
+		a.Logger.Println("Configuration loading failed:", err)
+		return ConfigCache{}, errors.New("failed to load configuration")
+	}
+
+	decode, err := configformat.ByName(a.Config.MetadataFormat, a.MetadataSource.String())
+	if err != nil {
+		a.Logger.Println("Configuration loading failed:", err)
+		return ConfigCache{}, errors.New("failed to parse configuration")
+	}
+	metadata, err := decode(metadataContent)
+	if err != nil {
+		a.Logger.Println("Configuration loading failed:", err)
+		return ConfigCache{}, errors.New("failed to parse configuration")
+	}
+	if err := a.applyProfileOverlay(metadata, decode); err != nil {
+		a.Logger.Printf("Configuration loading failed: profile %s: %v", a.Config.Profile, err)
+		return ConfigCache{}, errors.New("failed to parse configuration")
+	}
+	if _, err := configcrypt.DecryptTree(a.MetadataCipher, metadata); err != nil {
+		a.Logger.Println("Configuration loading failed:", err)
+		return ConfigCache{}, errors.New("failed to decrypt configuration")
+	}
+	for _, field := range []string{"description", "version"} {
+		if _, ok := metadata[field].(string); !ok {
+			a.Logger.Printf("Configuration loading failed: %q is missing or not a string", field)
+			return ConfigCache{}, errors.New("invalid configuration")
+		}
+	}
+
+	sha, err := a.Version.SHA(ctx)
+	if err != nil {
+		a.Logger.Printf("Configuration loading failed: version source %s: %v", a.Version, err)
+		return ConfigCache{}, errors.New("failed to get commit SHA")
+	}
+	return ConfigCache{Metadata: metadata, SHA: sha}, nil
+}
+
+// Records the outcome of a metadata load and publishes readiness changes. The caller
+// holds configMutex.
+func (a *App) setConfigState(state string, err error) {
+	previous := a.configState
+	a.configState = state
+	if previous == "" || previous == state {
+		return
+	}
+
+	event := ReadinessEvent{Ready: state == CONFIG_STATE_OK, Time: a.Clock.Now()}
+	if err != nil {
+		event.Reason = err.Error()
+	}
+	a.Logger.Printf("Configuration state changed from %s to %s", previous, state)
+	eventbus.Publish(a.Events, TopicReadiness, event)
+}
+
+// Reloads the metadata whenever the source reports a change, for sources that support
+// watching, so ConfigChanged goes out right away rather than on the next request.
+// Blocks until ctx is done; returns immediately otherwise.
+func (a *App) WatchConfiguration(ctx context.Context) {
+	watcher, ok := a.MetadataSource.(configsource.Watcher)
+	if !ok {
+		return
+	}
+	watcher.Watch(ctx, func() {
+		a.Logger.Println("Configuration source reported a change:", a.MetadataSource)
+		a.configCache.Delete(CONFIG_CACHE_KEY)
+		if _, err := a.loadConfiguration(ctx); err != nil {
+			a.Logger.Println("Configuration reload failed:", err)
+		}
+	})
+}
+
+// Decrypts encrypted tokens, verifies the signature and checks the time-based claims
+// against the App clock. Expired tokens still return their claims alongside
+// jwt.ErrTokenExpired unless allowExpired is set.
+func (a *App) parseToken(ctx context.Context, token string, allowExpired bool) (jwt.MapClaims, error) {
+	claims, _, err := a.parseTokenKey(ctx, token, allowExpired)
+	return claims, err
+}
+
+// parseToken, also returning the key that verified the token
+func (a *App) parseTokenKey(ctx context.Context, token string, allowExpired bool) (jwt.MapClaims, SigningKey, error) {
+	token, err := a.decryptToken(ctx, token)
+	if err != nil {
+		return nil, SigningKey{}, err
+	}
+	claims := jwt.MapClaims{}
+	var key SigningKey
+	_, err = a.tokenParser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if key, err = a.signingKeyOf(ctx, token); err != nil {
+			return nil, err
+		}
+		return key.Public, nil
+	})
+	if err != nil {
+		return nil, SigningKey{}, err
+	}
+	claims, err = a.validateClaims(ctx, claims, allowExpired)
+	return claims, key, err
+}
+
+// Checks the time claims and audience of claims, which were verified
+func (a *App) validateClaims(ctx context.Context, claims jwt.MapClaims, allowExpired bool) (jwt.MapClaims, error) {
+	now := a.clock(ctx).Now().Unix()
+	if !claims.VerifyNotBefore(now, false) || !claims.VerifyIssuedAt(now, false) {
+		return nil, jwt.ErrTokenNotValidYet
+	}
+	if audience := a.Config.Tokens.Audience; audience != "" && !claims.VerifyAudience(audience, true) {
+		return nil, fmt.Errorf("token is not meant for audience %q", audience)
+	}
+	if !allowExpired && !claims.VerifyExpiresAt(now, false) {
+		return claims, jwt.ErrTokenExpired
+	}
+	return claims, nil
+}
+
+// Picks the key named by the token's kid (the current key for tokens without one) and
+// refuses tokens whose alg does not match it
+func (a *App) signingKeyOf(ctx context.Context, token *jwt.Token) (SigningKey, error) {
+	key := a.keys(ctx).Current()
+	if kid, ok := token.Header["kid"].(string); ok {
+		if key, ok = a.keys(ctx).Lookup(kid); !ok {
+			return SigningKey{}, fmt.Errorf("unknown key %q", kid)
+		}
+	}
+	if token.Method.Alg() != key.Method.Alg() {
+		return SigningKey{}, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+	}
+	return key, nil
+}
+
+func (a *App) generateToken(ctx context.Context, payload map[string]interface{}) (string, error) {
+	key := a.keys(ctx).Current()
+	if a.Config.Tokens.RotatePerLogin {
+		var err error
+		if key, err = a.keys(ctx).Rotate(); err != nil { // Generate a new secret key
+			return "", err
+		}
+		eventbus.Publish(a.Events, TopicKeyRotated, KeyRotatedEvent{KeyID: key.ID, Time: a.clock(ctx).Now()})
+	}
+
+	now := a.clock(ctx).Now()
+	claims := jwt.MapClaims{}
+	for name, value := range payload {
+		claims[name] = value
+	}
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(TOKEN_EXPIRATION_TIME).Unix()
+	if a.Config.Tokens.Audience != "" {
+		claims["aud"] = a.Config.Tokens.Audience
+	}
+	// Tokens are used once, so a refresh within the same second must not re-sign identical claims
+	jti, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+	claims["jti"] = jti
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.Private)
+	if err != nil || !a.Config.Tokens.Encrypt {
+		return signed, err
+	}
+	return encryptToken(key, signed)
+}
+
+func (a *App) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var credentials struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+		OTP      string `json:"otp"`   // TOTP or recovery code, for users with two-factor authentication
+		Scope    string `json:"scope"` // space separated subset of token-scopes, all of them when empty
+	}
+	if err := json.NewDecoder(r.Body).Decode(&credentials); err != nil || credentials.Username == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: username and password are required")
+		return
+	}
+
+	keys := []string{usernameKey(credentials.Username), ipKey(clientIP(r))}
+	if wait, ok := a.LoginGuard.Check(keys...); !ok {
+		loginMetrics.Add("throttled", 1)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		a.handleErrorResponse(w, r, http.StatusTooManyRequests, "Too Many Requests: Login temporarily locked")
+		return
+	}
+	defer a.LoginGuard.Release(keys...)
+
+	account, ok := a.stores(r.Context()).Users.Authenticate(credentials.Username, credentials.Password)
+	if !ok {
+		a.LoginGuard.RecordFailure(keys...)
+		loginMetrics.Add("failures", 1)
+		a.Logger.Printf("audit: event=login_failure username=%q ip=%s", credentials.Username, clientIP(r))
+		eventbus.Publish(a.Events, TopicLogin, LoginEvent{Username: credentials.Username, IP: clientIP(r), Time: a.clock(r.Context()).Now()})
+		a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_CREDENTIALS, REASON_BAD_CREDENTIALS)
+		return
+	}
+	// Only the account's owner knows the password, so this tells nobody else it exists
+	if account.Unverified {
+		loginMetrics.Add("unverified", 1)
+		a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Email address not verified")
+		return
+	}
+
+	methods := []string{AMR_PASSWORD}
+	_, twoFactor, err := a.twoFactorEnabled(r.Context(), fmt.Sprint(account.ID))
+	if err != nil {
+		a.Logger.Println("Two-factor lookup failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	if twoFactor {
+		if credentials.OTP == "" {
+			a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Two-factor code required")
+			return
+		}
+		if ok, err := a.verifySecondFactor(r.Context(), fmt.Sprint(account.ID), credentials.OTP); !ok {
+			if err != nil {
+				a.Logger.Println("Two-factor verification failed:", err)
+			}
+			a.LoginGuard.RecordFailure(keys...)
+			loginMetrics.Add("failures", 1)
+			a.Logger.Printf("audit: event=2fa_failure username=%q ip=%s", credentials.Username, clientIP(r))
+			a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_CREDENTIALS, REASON_BAD_OTP)
+			return
+		}
+		methods = append(methods, AMR_OTP)
+	}
+	a.LoginGuard.RecordSuccess(keys...)
+	eventbus.Publish(a.Events, TopicLogin, LoginEvent{Username: credentials.Username, IP: clientIP(r), Success: true, Time: a.clock(r.Context()).Now()})
+
+	sessionID, err := a.startSession(r, fmt.Sprint(account.ID))
+	if err != nil {
+		a.Logger.Println("Session creation failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+
+	scope := strings.Join(a.grantScopes(credentials.Scope, parseScopes(a.Config.Tokens.Scopes)), " ")
+	user := map[string]interface{}{"id": account.ID, "username": account.Username, "sid": sessionID, "amr": methods, SCOPE_CLAIM: scope}
+	if account.Tenant != "" {
+		user[TENANT_CLAIM] = account.Tenant
+	}
+	if len(account.Roles) > 0 {
+		user["roles"] = account.Roles
+	}
+	token, err := a.generateToken(r.Context(), user)
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Failed to generate token")
+		return
+	}
+	response := map[string]string{"token": token, "scope": scope}
+	if a.Config.Cookies.Name != "" {
+		a.setSessionCookie(r.Context(), w, token)
+		response["csrfToken"] = a.csrfToken(sessionID)
+	}
+	a.writeJSON(w, r, http.StatusOK, response)
+}
+
+func (a *App) refreshHandler(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie := a.presentedToken(r)
+
+	if token == "" {
+		a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_TOKEN, REASON_TOKEN_MISSING)
+		return
+	}
+
+	if a.stores(r.Context()).Revocations.Contains(token) {
+		a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_TOKEN, REASON_TOKEN_REVOKED)
+		return
+	}
+
+	// Expired tokens may be refreshed within token-refresh-grace of their exp
+	claims, err := a.parseToken(r.Context(), token, true)
+	if err != nil || claims["id"] == nil || !a.refreshable(r.Context(), claims) {
+		a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_TOKEN, REASON_TOKEN_INVALID)
+		return
+	}
+
+	if active, err := a.sessionActive(r.Context(), claims); !active {
+		if err != nil {
+			a.Logger.Println("Session lookup failed:", err)
+		}
+		a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_TOKEN, REASON_SESSION_REVOKED)
+		return
+	}
+	if revoked, err := a.issuedBeforeCutoff(r.Context(), claims); revoked || err != nil {
+		if err != nil {
+			a.Logger.Println("Revocation cutoff lookup failed:", err)
+		}
+		a.authFailure(w, r, http.StatusUnauthorized, MESSAGE_INVALID_TOKEN, REASON_TOKEN_REVOKED)
+		return
+	}
+	if fromCookie {
+		if err := a.checkCSRF(r, claims); err != nil {
+			a.handleErrorResponse(w, r, http.StatusForbidden, err.Error())
+			return
+		}
+	}
+	if sid, ok := claims["sid"].(string); ok {
+		if err := a.stores(r.Context()).Sessions.Touch(r.Context(), sid, clientIP(r), r.UserAgent(), a.clock(r.Context()).Now()); err != nil {
+			a.Logger.Println("Session update failed:", err)
+		}
+	}
+
+	// A refreshed token can narrow its scopes but never widen them. Tokens from before
+	// scopes existed hold whatever login grants today.
+	var body struct {
+		Scope string `json:"scope"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: scope must be a string")
+		return
+	}
+	held := claimScopes(claims)
+	if _, ok := claims[SCOPE_CLAIM]; !ok {
+		held = parseScopes(a.Config.Tokens.Scopes)
+	}
+	scope := strings.Join(a.grantScopes(body.Scope, held), " ")
+	claims[SCOPE_CLAIM] = scope
+	// The second factor was proven at login, not now; a refreshed token must step up again
+	delete(claims, "amr")
+
+	newToken, err := a.generateToken(r.Context(), claims)
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Failed to refresh token")
+		return
+	}
+	if fromCookie {
+		a.setSessionCookie(r.Context(), w, newToken)
+	}
+
+	a.writeJSON(w, r, http.StatusOK, map[string]string{"token": newToken, "scope": scope})
+}
+
+// Whether claims, verified but possibly expired, are within token-refresh-grace of their exp
+func (a *App) refreshable(ctx context.Context, claims jwt.MapClaims) bool {
+	grace := int64(a.Config.Tokens.RefreshGrace / time.Second)
+	return claims.VerifyExpiresAt(a.clock(ctx).Now().Unix()-grace, false)
+}
+
+func (a *App) protectedHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"message": "Access granted to protected resource",
+		"user":    user.Username,
+	})
+}
+
+func (a *App) rootHandler(w http.ResponseWriter, r *http.Request) {
+	a.writeJSON(w, r, http.StatusOK, map[string]string{"message": "Hello World"})
+}
+
+func (a *App) statusHandler(w http.ResponseWriter, r *http.Request) {
+	config, err := a.loadConfiguration(r.Context())
+	if err != nil {
+		a.degradedStatusHandler(w, r, err)
+		return
+	}
+
+	deployment := a.Deployment(r.Context())
+	entry := map[string]string{
+		"description": config.Metadata["description"].(string),
+		"version":     fmt.Sprintf("%s-%s", config.Metadata["version"].(string), deployment.BuildNumber),
+		"sha":         config.SHA,
+		"configState": CONFIG_STATE_OK,
+	}
+	addDeployment(entry, deployment)
+	response := map[string][]map[string]string{"my-application": {entry}}
+	if a.Config.DownstreamServices != "" {
+		response["my-application"] = append(response["my-application"], a.downstreamStatuses(r.Context())...)
+	}
+	a.writeJSON(w, r, http.StatusOK, response)
+}
+
+// Answers /status with what is known without the metadata, so callers can tell a
+// configuration problem from an outage
+func (a *App) degradedStatusHandler(w http.ResponseWriter, r *http.Request, loadErr error) {
+	deployment := a.Deployment(r.Context())
+	entry := map[string]string{
+		"build":       deployment.BuildNumber,
+		"configState": CONFIG_STATE_DEGRADED,
+		"error":       loadErr.Error(),
+	}
+	addDeployment(entry, deployment)
+	if sha, err := a.Version.SHA(r.Context()); err == nil {
+		entry["sha"] = sha
+	}
+	response := map[string][]map[string]string{"my-application": {entry}}
+	if a.Config.DownstreamServices != "" {
+		response["my-application"] = append(response["my-application"], a.downstreamStatuses(r.Context())...)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(CONFIG_RETRY_AFTER.Seconds())))
+	a.writeJSON(w, r, http.StatusServiceUnavailable, response)
+}
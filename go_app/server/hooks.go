@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Refuses a request with Status and Message, e.g. 429 when a quota is used up. Returned
+// by OnRequestStart and OnAuthSuccess hooks and by Handle functions; from a hook, any
+// other error answers 500.
+type RejectError struct {
+	Status  int
+	Message string
+}
+
+func (e *RejectError) Error() string {
+	return e.Message
+}
+
+// What OnResponse hooks learn about a finished request
+type ResponseInfo struct {
+	Status   int
+	Duration time.Duration
+	User     *User // nil unless a strategy authenticated the request
+}
+
+// Callbacks teams extending the scaffold attach to the request lifecycle, for quota
+// checks, analytics and the like, without changing the middleware stack. Register them
+// before the server starts; the registry is not safe for concurrent modification.
+// Hooks run in registration order.
+type Hooks struct {
+	requestStart []func(r *http.Request) error
+	authSuccess  []func(r *http.Request, user *User) error
+	authFailure  []func(r *http.Request, strategy string, err *AuthError)
+	response     []func(r *http.Request, info ResponseInfo)
+	shutdown     []func(ctx context.Context)
+}
+
+// Runs before routing, after the client IP is resolved. An error refuses the request.
+func (h *Hooks) OnRequestStart(fn func(r *http.Request) error) {
+	h.requestStart = append(h.requestStart, fn)
+}
+
+// Runs when an auth strategy accepts a request, before role and two-factor checks. An
+// error refuses the request.
+func (h *Hooks) OnAuthSuccess(fn func(r *http.Request, user *User) error) {
+	h.authSuccess = append(h.authSuccess, fn)
+}
+
+// Runs when a request is refused for missing or invalid credentials. strategy is the
+// strategy that refused it, or empty when none of the route's strategies found any.
+func (h *Hooks) OnAuthFailure(fn func(r *http.Request, strategy string, err *AuthError)) {
+	h.authFailure = append(h.authFailure, fn)
+}
+
+// Runs after the response has been written, including refused and unrouted requests
+func (h *Hooks) OnResponse(fn func(r *http.Request, info ResponseInfo)) {
+	h.response = append(h.response, fn)
+}
+
+// Runs during graceful shutdown once the server has stopped accepting requests
+func (h *Hooks) OnShutdown(fn func(ctx context.Context)) {
+	h.shutdown = append(h.shutdown, fn)
+}
+
+// Carries the authenticated user from the auth middleware out to OnResponse hooks. The
+// pointer is atomic because timed out handlers keep running next to the middleware.
+type hookState struct {
+	user atomic.Pointer[User]
+}
+
+type hookStateKey struct{}
+
+// Answers a hook's error: its RejectError, or 500
+func (a *App) rejectByHook(w http.ResponseWriter, r *http.Request, err error) {
+	var rejected *RejectError
+	if errors.As(err, &rejected) {
+		a.handleErrorResponse(w, r, rejected.Status, rejected.Message)
+		return
+	}
+	a.Log.Error("Hook failed", "error", err)
+	a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+}
+
+// Edge middleware running the OnRequestStart and OnResponse hooks. Without any it
+// adds nothing to the request path.
+func (a *App) runLifecycleHooks(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.Hooks.requestStart) == 0 && len(a.Hooks.response) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		// logAccess may have installed one already
+		state, ok := r.Context().Value(hookStateKey{}).(*hookState)
+		if !ok {
+			state = &hookState{}
+			r = r.WithContext(context.WithValue(r.Context(), hookStateKey{}, state))
+		}
+		recorder := &statusWriter{ResponseWriter: w}
+		defer func() {
+			info := ResponseInfo{Status: recorder.status, Duration: time.Since(start), User: state.user.Load()}
+			for _, hook := range a.Hooks.response {
+				hook(r, info)
+			}
+		}()
+
+		for _, hook := range a.Hooks.requestStart {
+			if err := hook(r); err != nil {
+				a.rejectByHook(recorder, r, err)
+				return
+			}
+		}
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// Runs the OnAuthSuccess hooks and remembers the user for OnResponse
+func (a *App) authSucceeded(r *http.Request, user *User) error {
+	if state, ok := r.Context().Value(hookStateKey{}).(*hookState); ok {
+		state.user.Store(user)
+	}
+	for _, hook := range a.Hooks.authSuccess {
+		if err := hook(r, user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) authFailed(r *http.Request, strategy string, err *AuthError) {
+	for _, hook := range a.Hooks.authFailure {
+		hook(r, strategy, err)
+	}
+}
+
+// Runs the OnShutdown hooks; index.go calls it after the server has drained
+func (a *App) RunShutdownHooks(ctx context.Context) {
+	for _, hook := range a.Hooks.shutdown {
+		hook(ctx)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// HTTP/3 over QUIC next to the TCP listener, for clients on lossy or changing
+// networks, like phones. Experimental: off unless http3 is set.
+type HTTP3Config struct {
+	Enabled bool
+	Addr    string        // UDP address; the TCP listener's port on all interfaces when empty
+	MaxAge  time.Duration // how long clients may remember the Alt-Svc advertisement
+}
+
+func (c HTTP3Config) validate(tls TLSConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if tls.CertFile == "" {
+		return errors.New("http3 needs tls-cert-file: QUIC is always encrypted")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("http3-alt-svc-max-age must not be negative, got %s", c.MaxAge)
+	}
+	return nil
+}
+
+// An HTTP/3 server for handler with the TLS settings of the TCP listener, mTLS
+// included, and its idle timeout. 0-RTT stays off: early data can be replayed, and
+// routes don't tell whether they are safe to replay.
+func (a *App) NewHTTP3Server(handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	return &http3.Server{
+		Handler:        detectEmptyBodies(handler),
+		TLSConfig:      tlsConfig,
+		MaxHeaderBytes: a.Config.Connections.MaxHeaderBytes,
+		IdleTimeout:    a.Config.Connections.IdleTimeout,
+		QUICConfig:     &quic.Config{Allow0RTT: false, MaxIdleTimeout: a.Config.Connections.IdleTimeout},
+	}
+}
+
+// HTTP/3 requests without Content-Length have a length of -1 even when the stream ends
+// right after the headers, as it does for a GET. Such requests get the NoBody an
+// HTTP/1 server gives them, so checks for requests without a body apply the same way.
+func detectEmptyBodies(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength < 0 && r.Body != nil && r.Body != http.NoBody {
+			buffered := bufio.NewReaderSize(r.Body, 1)
+			if _, err := buffered.Peek(1); err == io.EOF {
+				r.Body, r.ContentLength = http.NoBody, 0
+			} else {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{buffered, r.Body}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Makes responses on the TCP listener tell clients that HTTP/3 is served on UDP port
+func (a *App) AdvertiseHTTP3(port int) {
+	value := fmt.Sprintf(`h3=":%d"; ma=%d`, port, int(a.Config.HTTP3.MaxAge.Seconds()))
+	a.http3AltSvc.Store(&value)
+}
+
+// Adds the Alt-Svc header once AdvertiseHTTP3 was called, to responses of requests
+// that didn't already come over HTTP/3
+func (a *App) advertiseHTTP3(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if value := a.http3AltSvc.Load(); value != nil && r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", *value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UDP address of the HTTP/3 listener: http3-addr, else the TCP address of listen-addr,
+// else port
+func (c Config) HTTP3Addr() string {
+	if c.HTTP3.Addr != "" {
+		return c.HTTP3.Addr
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err == nil && !strings.Contains(c.ListenAddr, "://") {
+		return c.ListenAddr
+	}
+	return ":" + c.Port
+}
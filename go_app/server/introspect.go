@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// Parses "id:secret,id2:secret2" into a map of client credentials
+func parseClientCredentials(value string) map[string]string {
+	clients := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		id, secret, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if ok && id != "" && secret != "" {
+			clients[id] = secret
+		}
+	}
+	return clients
+}
+
+// Checks HTTP Basic client credentials against the configured introspection clients
+func (a *App) authenticateClient(r *http.Request) (string, bool) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, exists := parseClientCredentials(a.Config.IntrospectionClients)[id]
+	return id, exists && subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) == 1
+}
+
+// Token introspection endpoint (RFC 7662) for other services
+func (a *App) introspectHandler(w http.ResponseWriter, r *http.Request) {
+	clientID, ok := a.authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspect"`)
+		a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Invalid client credentials")
+		return
+	}
+
+	token := r.PostFormValue("token")
+	if token == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: token is required")
+		return
+	}
+
+	// RFC 7662 fixes the member names, so json-naming does not apply
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	// Active exactly when the jwt strategy would accept the token
+	verified, authErr := a.checkToken(r.Context(), token)
+	if authErr != nil {
+		a.Logger.Printf("introspect: client=%s active=false", clientID)
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		return
+	}
+	claims := verified.claims
+
+	response := map[string]interface{}{
+		"active":     true,
+		"token_type": "Bearer",
+	}
+	for name, value := range claims {
+		response[name] = value
+	}
+	user := newUserFromClaims(claims)
+	if user.ID != "" {
+		response["sub"] = user.ID
+	}
+	a.Logger.Printf("introspect: client=%s active=true sub=%s", clientID, user.ID)
+	json.NewEncoder(w).Encode(response)
+}
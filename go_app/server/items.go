@@ -0,0 +1,421 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Longest item name and description accepted
+const (
+	ITEM_NAME_MAX_LENGTH        = 200
+	ITEM_DESCRIPTION_MAX_LENGTH = 4000
+)
+
+// Who a resource belongs to: a user within a tenant. Users without a tenant claim own
+// resources with an empty tenant.
+type Owner struct {
+	UserID string
+	Tenant string
+}
+
+// The owner resources created by the caller of ctx get, false when unauthenticated
+func OwnerFromContext(ctx context.Context) (Owner, bool) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.ID == "" {
+		return Owner{}, false
+	}
+	tenant, _ := user.Claims[TENANT_CLAIM].(string)
+	return Owner{UserID: user.ID, Tenant: tenant}, true
+}
+
+// Answers 404 unless the caller owns the resource named by the path value param, as
+// reported by lookup. Others' resources are reported as missing so their IDs cannot be
+// probed. Stores should still filter by owner; this check keeps handlers that forget
+// to from leaking.
+func (a *App) RequireOwner(param string, lookup func(ctx context.Context, id string) (Owner, bool, error), next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, ok := OwnerFromContext(r.Context())
+		if !ok {
+			a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Authentication required")
+			return
+		}
+		owner, exists, err := lookup(r.Context(), r.PathValue(param))
+		if err != nil {
+			a.Log.Error("Owner lookup failed", "path", r.URL.Path, "error", err)
+			a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		if !exists || owner != caller {
+			a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found: Resource does not exist")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// The example resource: a note-like record owned by the user who created it. Copy it,
+// its store and its routes as the starting point of a service's own resources.
+type Item struct {
+	ID          string    `json:"id"`
+	Owner       Owner     `json:"-"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	Audit
+}
+
+// Persists items. Every method but Owner is scoped to an owner, so one user's items
+// never come back for another, whatever the handler does. Deleted items are only
+// marked deleted, and no method but Owner returns them.
+type ItemStore interface {
+	Create(ctx context.Context, item Item) error
+	Get(ctx context.Context, owner Owner, id string) (Item, bool, error)
+	// Newest first
+	List(ctx context.Context, owner Owner) ([]Item, error)
+	// Replaces name, description, updated and updatedBy; false when owner has no such item
+	Update(ctx context.Context, owner Owner, item Item) (bool, error)
+	// Marks the item deleted at now by the caller of ctx
+	Delete(ctx context.Context, owner Owner, id string, now time.Time) (bool, error)
+	// Who owns id, deleted or not, for RequireOwner
+	Owner(ctx context.Context, id string) (Owner, bool, error)
+}
+
+type memoryItemStore struct {
+	mutex sync.Mutex
+	items map[string]Item
+}
+
+func NewMemoryItemStore() ItemStore {
+	return &memoryItemStore{items: make(map[string]Item)}
+}
+
+func (s *memoryItemStore) Create(ctx context.Context, item Item) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.items[item.ID] = item
+	return nil
+}
+
+func (s *memoryItemStore) Get(ctx context.Context, owner Owner, id string) (Item, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[id]
+	if !ok || item.Owner != owner || item.DeletedAt != nil {
+		return Item{}, false, nil
+	}
+	return item, true, nil
+}
+
+func (s *memoryItemStore) List(ctx context.Context, owner Owner) ([]Item, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	items := []Item{}
+	for _, item := range s.items {
+		if item.Owner == owner && item.DeletedAt == nil {
+			items = append(items, item)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Created.After(items[j].Created) })
+	return items, nil
+}
+
+func (s *memoryItemStore) Update(ctx context.Context, owner Owner, item Item) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stored, ok := s.items[item.ID]
+	if !ok || stored.Owner != owner || stored.DeletedAt != nil {
+		return false, nil
+	}
+	stored.Name, stored.Description, stored.Updated, stored.UpdatedBy = item.Name, item.Description, item.Updated, item.UpdatedBy
+	s.items[item.ID] = stored
+	return true, nil
+}
+
+func (s *memoryItemStore) Delete(ctx context.Context, owner Owner, id string, now time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[id]
+	if !ok || item.Owner != owner || item.DeletedAt != nil {
+		return false, nil
+	}
+	item.DeletedAt = &now
+	item.MarkUpdated(ctx)
+	s.items[id] = item
+	return true, nil
+}
+
+func (s *memoryItemStore) Owner(ctx context.Context, id string) (Owner, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	item, ok := s.items[id]
+	return item.Owner, ok, nil
+}
+
+// Items in a SQL database. Every query but Owner has the owner in its WHERE clause.
+type sqlItemStore struct {
+	db     SQLDB
+	driver string
+}
+
+const itemsSchema = `CREATE TABLE IF NOT EXISTS items (
+	id TEXT PRIMARY KEY,
+	owner_id TEXT NOT NULL,
+	tenant TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	description TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+)`
+
+// Creates the items table if needed
+func NewSQLItemStore(db SQLDB, driver string) (ItemStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	for _, statement := range []string{
+		itemsSchema,
+		`CREATE INDEX IF NOT EXISTS items_owner ON items (tenant, owner_id, created_at)`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+	if err := ensureAuditColumns(ctx, db, "items"); err != nil {
+		return nil, err
+	}
+	return &sqlItemStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlItemStore) Create(ctx context.Context, item Item) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO items (id, owner_id, tenant, name, description, created_at, updated_at, created_by, updated_by) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		item.ID, item.Owner.UserID, item.Owner.Tenant, item.Name, item.Description, item.Created.UnixMilli(), item.Updated.UnixMilli(), item.CreatedBy, item.UpdatedBy)
+	return err
+}
+
+func scanItem(row interface{ Scan(...interface{}) error }) (Item, error) {
+	var item Item
+	var created, updated int64
+	err := row.Scan(&item.ID, &item.Owner.UserID, &item.Owner.Tenant, &item.Name, &item.Description, &created, &updated, &item.CreatedBy, &item.UpdatedBy)
+	item.Created, item.Updated = time.UnixMilli(created), time.UnixMilli(updated)
+	return item, err
+}
+
+func (s *sqlItemStore) Get(ctx context.Context, owner Owner, id string) (Item, bool, error) {
+	row := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT id, owner_id, tenant, name, description, created_at, updated_at, created_by, updated_by
+		FROM items WHERE id = ? AND owner_id = ? AND tenant = ? AND `+SQL_NOT_DELETED), id, owner.UserID, owner.Tenant)
+	item, err := scanItem(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Item{}, false, nil
+	}
+	if err != nil {
+		return Item{}, false, err
+	}
+	return item, true, nil
+}
+
+func (s *sqlItemStore) List(ctx context.Context, owner Owner) ([]Item, error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.driver, `SELECT id, owner_id, tenant, name, description, created_at, updated_at, created_by, updated_by
+		FROM items WHERE owner_id = ? AND tenant = ? AND `+SQL_NOT_DELETED+` ORDER BY created_at DESC`), owner.UserID, owner.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []Item{}
+	for rows.Next() {
+		item, err := scanItem(rows)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (s *sqlItemStore) Update(ctx context.Context, owner Owner, item Item) (bool, error) {
+	result, err := s.db.ExecContext(ctx, rebind(s.driver, `UPDATE items SET name = ?, description = ?, updated_at = ?, updated_by = ?
+		WHERE id = ? AND owner_id = ? AND tenant = ? AND `+SQL_NOT_DELETED), item.Name, item.Description, item.Updated.UnixMilli(), item.UpdatedBy, item.ID, owner.UserID, owner.Tenant)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
+
+func (s *sqlItemStore) Delete(ctx context.Context, owner Owner, id string, now time.Time) (bool, error) {
+	return softDelete(ctx, s.db, s.driver, "items", now, "id = ? AND owner_id = ? AND tenant = ?", id, owner.UserID, owner.Tenant)
+}
+
+func (s *sqlItemStore) Owner(ctx context.Context, id string) (Owner, bool, error) {
+	var owner Owner
+	err := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT owner_id, tenant FROM items WHERE id = ?`), id).Scan(&owner.UserID, &owner.Tenant)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Owner{}, false, nil
+	}
+	return owner, err == nil, err
+}
+
+type itemRequest struct {
+	ID          string `path:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func (request itemRequest) Validate() error {
+	switch {
+	case strings.TrimSpace(request.Name) == "":
+		return errors.New("name is required")
+	case len(request.Name) > ITEM_NAME_MAX_LENGTH:
+		return fmt.Errorf("name is longer than %d bytes", ITEM_NAME_MAX_LENGTH)
+	case len(request.Description) > ITEM_DESCRIPTION_MAX_LENGTH:
+		return fmt.Errorf("description is longer than %d bytes", ITEM_DESCRIPTION_MAX_LENGTH)
+	}
+	return nil
+}
+
+type itemID struct {
+	ID string `path:"id"`
+}
+
+type itemList struct {
+	Items []Item `json:"items"`
+}
+
+type itemHistory struct {
+	Changes []ChangeEvent `json:"changes"`
+}
+
+// Item answered with 201
+type createdItem struct {
+	Item
+}
+
+func (createdItem) StatusCode() int { return http.StatusCreated }
+
+var errItemNotFound = &RejectError{Status: http.StatusNotFound, Message: "Not Found: Item does not exist"}
+
+// The caller as an owner. The item routes authenticate, so this only fails for
+// principals without an ID, e.g. client certificates.
+func callerOwner(ctx context.Context) (Owner, error) {
+	owner, ok := OwnerFromContext(ctx)
+	if !ok {
+		return Owner{}, &RejectError{Status: http.StatusForbidden, Message: "Forbidden: Resources need a user"}
+	}
+	return owner, nil
+}
+
+// Who owns item id, for RequireOwner. Resolved per request, so the check reads the
+// same store as the handler when the request carries store overrides.
+func (a *App) itemOwner(ctx context.Context, id string) (Owner, bool, error) {
+	return a.stores(ctx).Items.Owner(ctx, id)
+}
+
+func (a *App) createItem(ctx context.Context, request itemRequest) (createdItem, error) {
+	owner, err := callerOwner(ctx)
+	if err != nil {
+		return createdItem{}, err
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return createdItem{}, err
+	}
+	now := a.clock(ctx).Now().UTC()
+	item := Item{ID: id, Owner: owner, Name: request.Name, Description: request.Description, Created: now, Updated: now}
+	item.MarkCreated(ctx)
+	if err := a.stores(ctx).Items.Create(ctx, item); err != nil {
+		return createdItem{}, fmt.Errorf("item creation: %w", err)
+	}
+	a.PublishChange(ctx, "item", item.ID, CHANGE_CREATED, nil, item)
+	return createdItem{item}, nil
+}
+
+func (a *App) listItems(ctx context.Context, _ struct{}) (itemList, error) {
+	owner, err := callerOwner(ctx)
+	if err != nil {
+		return itemList{}, err
+	}
+	items, err := a.stores(ctx).Items.List(ctx, owner)
+	if err != nil {
+		return itemList{}, fmt.Errorf("item listing: %w", err)
+	}
+	return itemList{Items: items}, nil
+}
+
+func (a *App) getItem(ctx context.Context, request itemID) (Item, error) {
+	owner, err := callerOwner(ctx)
+	if err != nil {
+		return Item{}, err
+	}
+	item, exists, err := a.stores(ctx).Items.Get(ctx, owner, request.ID)
+	if err != nil {
+		return Item{}, fmt.Errorf("item lookup: %w", err)
+	}
+	if !exists {
+		return Item{}, errItemNotFound
+	}
+	return item, nil
+}
+
+func (a *App) updateItem(ctx context.Context, request itemRequest) (Item, error) {
+	owner, err := callerOwner(ctx)
+	if err != nil {
+		return Item{}, err
+	}
+	before, err := a.getItem(ctx, itemID{ID: request.ID})
+	if err != nil {
+		return Item{}, err
+	}
+	item := Item{ID: request.ID, Name: request.Name, Description: request.Description, Updated: a.clock(ctx).Now().UTC()}
+	item.MarkUpdated(ctx)
+	updated, err := a.stores(ctx).Items.Update(ctx, owner, item)
+	if err != nil {
+		return Item{}, fmt.Errorf("item update: %w", err)
+	}
+	if !updated {
+		return Item{}, errItemNotFound
+	}
+	after, err := a.getItem(ctx, itemID{ID: request.ID})
+	if err != nil {
+		return Item{}, err
+	}
+	a.PublishChange(ctx, "item", item.ID, CHANGE_UPDATED, before, after)
+	return after, nil
+}
+
+func (a *App) deleteItem(ctx context.Context, request itemID) (NoContent, error) {
+	owner, err := callerOwner(ctx)
+	if err != nil {
+		return NoContent{}, err
+	}
+	before, err := a.getItem(ctx, request)
+	if err != nil {
+		return NoContent{}, err
+	}
+	deleted, err := a.stores(ctx).Items.Delete(ctx, owner, request.ID, a.clock(ctx).Now().UTC())
+	if err != nil {
+		return NoContent{}, fmt.Errorf("item deletion: %w", err)
+	}
+	if !deleted {
+		return NoContent{}, errItemNotFound
+	}
+	a.PublishChange(ctx, "item", request.ID, CHANGE_DELETED, before, nil)
+	a.Logger.Printf("audit: event=item_deleted item=%s user=%s ip=%s", request.ID, owner.UserID, clientIPFromContext(ctx))
+	return NoContent{}, nil
+}
+
+// The recorded changes of one of the caller's items, oldest first. Deleted items keep
+// theirs, as RequireOwner still finds their owner.
+func (a *App) itemHistory(ctx context.Context, request itemID) (itemHistory, error) {
+	changes, err := a.stores(ctx).History.List(ctx, "item", request.ID)
+	if err != nil {
+		return itemHistory{}, fmt.Errorf("item history: %w", err)
+	}
+	return itemHistory{Changes: changes}, nil
+}
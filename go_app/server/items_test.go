@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// The ownership check of the item routes reads the store the handlers read, so items
+// of a request's overridden store are found, and the App's aren't
+func TestItemRoutesHonorStoreOverrides(t *testing.T) {
+	keys, err := NewRandomKeyProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := NewMemoryItemStore()
+	app := NewApp(DefaultConfig(), log.New(io.Discard, "", 0), NewMockClock(time.Now()), keys, Stores{
+		Blacklist:   NewMemoryBlacklist(),
+		Revocations: NewMemoryBlacklist(),
+		Users:       NewMemoryUserStore(),
+		TwoFactor:   NewMemoryTwoFactorStore(),
+		Items:       base,
+	})
+	var getItem http.HandlerFunc
+	for _, route := range app.Routes() {
+		if route.Method == http.MethodGet && route.Path == "/items/{id}" {
+			getItem = route.Handler
+		}
+	}
+	if getItem == nil {
+		t.Fatal("no GET /items/{id} route")
+	}
+
+	owner := Owner{UserID: "1"}
+	overridden := NewMemoryItemStore()
+	overridden.Create(context.Background(), Item{ID: "canned", Owner: owner, Name: "from the override"})
+	base.Create(context.Background(), Item{ID: "real", Owner: owner, Name: "from the App"})
+
+	tests := []struct {
+		id   string
+		want int
+	}{
+		{"canned", http.StatusOK},
+		{"real", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/items/"+test.id, nil)
+		r.SetPathValue("id", test.id)
+		ctx := withUser(r.Context(), &User{ID: owner.UserID})
+		ctx = WithOverrides(ctx, Overrides{Stores: Stores{Items: overridden}})
+		w := httptest.NewRecorder()
+		getItem(w, r.WithContext(ctx))
+		if w.Code != test.want {
+			t.Errorf("GET /items/%s = %d, want %d: %s", test.id, w.Code, test.want, w.Body)
+		}
+	}
+}
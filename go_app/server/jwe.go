@@ -0,0 +1,121 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Encrypted tokens are compact JWEs (RFC 7516) wrapping the signed token: the signing
+// key's Encryption key is used directly ("dir") with AES-256-GCM
+const (
+	JWE_ALGORITHM  = "dir"
+	JWE_ENCRYPTION = "A256GCM"
+	JWE_KEY_SIZE   = 32 // bytes of SigningKey.Encryption
+)
+
+var errNoEncryptionKey = errors.New("signing key has no encryption key")
+
+type jweHeader struct {
+	Alg string `json:"alg"`
+	Enc string `json:"enc"`
+	Kid string `json:"kid"`
+	Cty string `json:"cty"` // "JWT": the plaintext is itself a token
+}
+
+func generateEncryptionKey() ([]byte, error) {
+	key := make([]byte, JWE_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Hides signed's claims from whoever holds the token. The result names key in its kid
+// header, like the token inside.
+func encryptToken(key SigningKey, signed string) (string, error) {
+	aead, err := tokenCipher(key)
+	if err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(jweHeader{Alg: JWE_ALGORITHM, Enc: JWE_ENCRYPTION, Kid: key.ID, Cty: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	protected := base64.RawURLEncoding.EncodeToString(header)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nil, nonce, []byte(signed), []byte(protected))
+	ciphertext, tag := sealed[:len(sealed)-aead.Overhead()], sealed[len(sealed)-aead.Overhead():]
+	// The encrypted key part stays empty with "dir"
+	return strings.Join([]string{
+		protected,
+		"",
+		base64.RawURLEncoding.EncodeToString(nonce),
+		base64.RawURLEncoding.EncodeToString(ciphertext),
+		base64.RawURLEncoding.EncodeToString(tag),
+	}, "."), nil
+}
+
+// Returns the signed token inside an encrypted one. Signed tokens, which have three
+// parts rather than five, are returned as they are.
+func (a *App) decryptToken(ctx context.Context, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 5 {
+		return token, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("encrypted token header: %w", err)
+	}
+	var header jweHeader
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return "", fmt.Errorf("encrypted token header: %w", err)
+	}
+	if header.Alg != JWE_ALGORITHM || header.Enc != JWE_ENCRYPTION || parts[1] != "" {
+		return "", fmt.Errorf("unsupported token encryption %s/%s", header.Alg, header.Enc)
+	}
+	key, ok := a.keys(ctx).Lookup(header.Kid)
+	if !ok {
+		return "", fmt.Errorf("unknown key %q", header.Kid)
+	}
+	aead, err := tokenCipher(key)
+	if err != nil {
+		return "", err
+	}
+
+	var decoded [3][]byte
+	for i, part := range parts[2:] {
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(part); err != nil {
+			return "", fmt.Errorf("encrypted token: %w", err)
+		}
+	}
+	nonce, ciphertext, tag := decoded[0], decoded[1], decoded[2]
+	if len(nonce) != aead.NonceSize() || len(tag) != aead.Overhead() {
+		return "", errors.New("encrypted token: malformed nonce or tag")
+	}
+	signed, err := aead.Open(nil, nonce, append(ciphertext, tag...), []byte(parts[0]))
+	if err != nil {
+		return "", fmt.Errorf("encrypted token: %w", err)
+	}
+	return string(signed), nil
+}
+
+func tokenCipher(key SigningKey) (cipher.AEAD, error) {
+	if len(key.Encryption) != JWE_KEY_SIZE {
+		return nil, fmt.Errorf("%w (key %s)", errNoEncryptionKey, key.ID)
+	}
+	block, err := aes.NewCipher(key.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
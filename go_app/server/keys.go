@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Token signing algorithms supported by KeyRing
+const (
+	ALGORITHM_HS256 = "HS256"
+	ALGORITHM_ES256 = "ES256"
+)
+
+// A token signing key, identified in token headers by its kid
+type SigningKey struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private interface{} // signs tokens
+	Public  interface{} // verifies tokens; the same secret for HMAC
+	Created time.Time
+	// AES-256 key for encrypted tokens (token-encrypt); rotates along with the signing
+	// key. Providers that leave it nil can only issue signed tokens.
+	Encryption []byte
+}
+
+// Supplies the keys used to sign and verify tokens
+type KeyProvider interface {
+	// Key that new tokens are signed with
+	Current() SigningKey
+	// Replaces the current key with a fresh one and returns it
+	Rotate() (SigningKey, error)
+	// Finds a key that tokens may still be verified against
+	Lookup(kid string) (SigningKey, bool)
+	// All keys tokens may be verified against, current first
+	VerificationKeys() []SigningKey
+}
+
+// Function to generate a random secret key
+func generateSecretKey() ([]byte, error) {
+	secret := make([]byte, 64)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(secret)), nil
+}
+
+func generateKeyID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func generateSigningKey(algorithm string) (SigningKey, error) {
+	id, err := generateKeyID()
+	if err != nil {
+		return SigningKey{}, err
+	}
+	encryption, err := generateEncryptionKey()
+	if err != nil {
+		return SigningKey{}, err
+	}
+	key := SigningKey{ID: id, Created: time.Now(), Encryption: encryption}
+
+	switch algorithm {
+	case ALGORITHM_HS256:
+		secret, err := generateSecretKey()
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodHS256, secret, secret
+	case ALGORITHM_ES256:
+		private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return SigningKey{}, err
+		}
+		key.Method, key.Private, key.Public = jwt.SigningMethodES256, private, &private.PublicKey
+	default:
+		return SigningKey{}, fmt.Errorf("unsupported token algorithm %q", algorithm)
+	}
+	return key, nil
+}
+
+// Keeps the current key plus a number of previous ones in memory, so tokens signed
+// before a rotation stay verifiable until they age out of the ring
+type KeyRing struct {
+	Algorithm    string
+	PreviousKeys int
+
+	mutex sync.RWMutex
+	keys  []SigningKey // newest first
+}
+
+func NewKeyRing(algorithm string, previousKeys int) (*KeyRing, error) {
+	ring := &KeyRing{Algorithm: algorithm, PreviousKeys: previousKeys}
+	if _, err := ring.Rotate(); err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// HS256 ring without previous keys: every rotation invalidates all earlier tokens
+func NewRandomKeyProvider() (KeyProvider, error) {
+	return NewKeyRing(ALGORITHM_HS256, 0)
+}
+
+func (r *KeyRing) Current() SigningKey {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.keys[0]
+}
+
+func (r *KeyRing) Rotate() (SigningKey, error) {
+	key, err := generateSigningKey(r.Algorithm)
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.keys = append([]SigningKey{key}, r.keys...)
+	if len(r.keys) > r.PreviousKeys+1 {
+		r.keys = r.keys[:r.PreviousKeys+1]
+	}
+	return key, nil
+}
+
+func (r *KeyRing) Lookup(kid string) (SigningKey, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, key := range r.keys {
+		if key.ID == kid {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+func (r *KeyRing) VerificationKeys() []SigningKey {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]SigningKey(nil), r.keys...)
+}
+
+// JSON Web Key (RFC 7517) for a public key; symmetric keys have none
+type JWK struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+}
+
+// Returns the public JWK for key, or false for HMAC keys which must never be published
+func publicJWK(key SigningKey) (JWK, bool) {
+	public, ok := key.Public.(*ecdsa.PublicKey)
+	if !ok {
+		return JWK{}, false
+	}
+	ecdhKey, err := public.ECDH()
+	if err != nil {
+		return JWK{}, false
+	}
+	// Uncompressed point: 0x04 || X || Y
+	point := ecdhKey.Bytes()
+	size := (len(point) - 1) / 2
+	return JWK{
+		Kty: "EC",
+		Crv: public.Curve.Params().Name,
+		X:   base64.RawURLEncoding.EncodeToString(point[1 : 1+size]),
+		Y:   base64.RawURLEncoding.EncodeToString(point[1+size:]),
+		Kid: key.ID,
+		Alg: key.Method.Alg(),
+		Use: "sig",
+	}, true
+}
+
+// Publishes the public keys tokens may be verified against (RFC 7517 key set). HS256
+// keys are secret, so the set is empty unless token-algorithm is ES256.
+func (a *App) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	keys := []JWK{}
+	for _, key := range a.keys(r.Context()).VerificationKeys() {
+		if jwk, ok := publicJWK(key); ok {
+			keys = append(keys, jwk)
+		}
+	}
+	w.Header().Set("Content-Type", "application/jwk-set+json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	// RFC 7517 fixes the member names, so json-naming does not apply
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": keys})
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/ldap"
+)
+
+// LDAP logins per outcome, published on /debug/vars
+var ldapMetrics = expvar.NewMap("ldap")
+
+// Directory the users log in against, e.g. OpenLDAP or Active Directory. Off unless URL
+// is set; it then replaces the memory and database user stores.
+type LDAPConfig struct {
+	URL          string // ldap://host or ldaps://host, optionally with a port
+	StartTLS     bool   // upgrade ldap:// connections before binding
+	CAFile       string // CA bundle (PEM) verifying the server; the system roots when empty
+	BindDN       string // service account that looks users up; anonymous when empty
+	BindPassword string
+	BaseDN       string // where users are searched, e.g. ou=people,dc=example,dc=com
+	// Finds a user; %s is the escaped username, e.g. (sAMAccountName=%s) for AD
+	UserFilter      string
+	IDAttribute     string // numeric attribute used as the account ID, e.g. uidNumber; a hash of the DN when empty
+	TenantAttribute string // attribute whose value becomes the tenant claim, optional
+	GroupAttribute  string // attribute listing the user's group DNs
+	// Roles granted per group as cn:role pairs separated by commas, e.g. "admins:admin,devs:developer";
+	// groups are matched by the value of the first RDN of their DN, case-insensitively
+	GroupRoles string
+	PoolSize   int // idle connections kept
+	Timeout    time.Duration
+}
+
+// Accounts in an LDAP directory. A login searches for the user with the service
+// account, then binds as the user's DN with the password; the server checks it, so
+// password policies and lockouts of the directory apply.
+type ldapUserStore struct {
+	config LDAPConfig
+	pool   *ldap.Pool
+	roles  map[string][]string // by lowercased group name
+	logger *log.Logger
+}
+
+func NewLDAPUserStore(config LDAPConfig, logger *log.Logger) (UserStore, error) {
+	if config.BaseDN == "" {
+		return nil, errors.New("ldap-base-dn is required")
+	}
+	if !strings.Contains(config.UserFilter, "%s") {
+		return nil, fmt.Errorf("ldap-user-filter %q has no %%s for the username", config.UserFilter)
+	}
+	options := ldap.Options{Timeout: config.Timeout, StartTLS: config.StartTLS}
+	if config.CAFile != "" {
+		bundle, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ldap-ca-file: %w", err)
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("ldap-ca-file %s: no certificates found", config.CAFile)
+		}
+		options.TLS = &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	}
+	roles := map[string][]string{}
+	for _, pair := range configList(config.GroupRoles) {
+		group, role, ok := strings.Cut(pair, ":")
+		if !ok || group == "" || role == "" {
+			return nil, fmt.Errorf("ldap-group-roles: %q is not a group:role pair", pair)
+		}
+		group = strings.ToLower(strings.TrimSpace(group))
+		roles[group] = append(roles[group], strings.TrimSpace(role))
+	}
+	store := &ldapUserStore{
+		config: config,
+		pool:   &ldap.Pool{URL: config.URL, Options: options, Size: config.PoolSize},
+		roles:  roles,
+		logger: logger,
+	}
+	// Fail at startup rather than on the first login when the URL or service account is wrong
+	conn, err := store.pool.Get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer store.pool.Put(conn)
+	if err := conn.Bind(config.BindDN, config.BindPassword); err != nil {
+		return nil, fmt.Errorf("ldap bind as %q: %w", config.BindDN, err)
+	}
+	return store, nil
+}
+
+func (s *ldapUserStore) Authenticate(username, password string) (Account, bool) {
+	if username == "" || password == "" {
+		ldapMetrics.Add("rejected", 1)
+		return Account{}, false
+	}
+	account, err := s.authenticate(username, password)
+	// A pooled connection the server has since closed fails on first use; one retry on
+	// a fresh connection covers it
+	if err != nil && !isLDAPResult(err) {
+		account, err = s.authenticate(username, password)
+	}
+	switch {
+	case err == nil:
+		ldapMetrics.Add("success", 1)
+		return account, true
+	case errors.Is(err, errLDAPUserNotFound), ldap.IsResult(err, ldap.RESULT_INVALID_CREDENTIALS):
+		ldapMetrics.Add("rejected", 1)
+	default:
+		ldapMetrics.Add("errors", 1)
+		s.logger.Printf("LDAP login of %q failed: %v", username, err)
+	}
+	return Account{}, false
+}
+
+var errLDAPUserNotFound = errors.New("no such LDAP user")
+
+func isLDAPResult(err error) bool {
+	var result *ldap.Error
+	return errors.As(err, &result) || errors.Is(err, errLDAPUserNotFound)
+}
+
+func (s *ldapUserStore) authenticate(username, password string) (Account, error) {
+	conn, err := s.pool.Get(context.Background())
+	if err != nil {
+		return Account{}, err
+	}
+	defer s.pool.Put(conn)
+	// The connection may still be bound as the previous user
+	if err := conn.Bind(s.config.BindDN, s.config.BindPassword); err != nil {
+		return Account{}, err
+	}
+	attributes := []string{s.config.GroupAttribute}
+	for _, attribute := range []string{s.config.IDAttribute, s.config.TenantAttribute} {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	entries, err := conn.Search(ldap.SearchRequest{
+		BaseDN:     s.config.BaseDN,
+		Scope:      ldap.SCOPE_SUBTREE,
+		Filter:     strings.ReplaceAll(s.config.UserFilter, "%s", ldap.EscapeFilter(username)),
+		Attributes: attributes,
+		SizeLimit:  2,
+	})
+	if ldap.IsResult(err, ldap.RESULT_SIZE_LIMIT_EXCEEDED) || err == nil && len(entries) > 1 {
+		return Account{}, fmt.Errorf("ldap-user-filter matches more than one entry for %q", username)
+	}
+	if err != nil {
+		return Account{}, err
+	}
+	if len(entries) == 0 {
+		return Account{}, errLDAPUserNotFound
+	}
+	entry := entries[0]
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return Account{}, err
+	}
+	return s.account(username, entry)
+}
+
+func (s *ldapUserStore) account(username string, entry ldap.Entry) (Account, error) {
+	account := Account{Username: username}
+	if s.config.IDAttribute != "" {
+		values := entry.Get(s.config.IDAttribute)
+		if len(values) == 0 {
+			return Account{}, fmt.Errorf("%s has no %s", entry.DN, s.config.IDAttribute)
+		}
+		id, err := strconv.Atoi(values[0])
+		if err != nil {
+			return Account{}, fmt.Errorf("%s of %s is not a number", s.config.IDAttribute, entry.DN)
+		}
+		account.ID = id
+	} else {
+		// Kept within 53 bits, as the ID travels through JSON numbers in tokens
+		hash := fnv.New64a()
+		hash.Write([]byte(strings.ToLower(entry.DN)))
+		account.ID = int(hash.Sum64() & (1<<53 - 1))
+	}
+	if s.config.TenantAttribute != "" {
+		if values := entry.Get(s.config.TenantAttribute); len(values) > 0 {
+			account.Tenant = values[0]
+		}
+	}
+	for _, group := range entry.Get(s.config.GroupAttribute) {
+		account.Roles = append(account.Roles, s.roles[strings.ToLower(groupName(group))]...)
+	}
+	return account, nil
+}
+
+// The value of the first RDN of a group DN, e.g. admins for cn=admins,ou=groups,dc=example
+func groupName(dn string) string {
+	rdn, _, _ := strings.Cut(dn, ",")
+	if _, value, ok := strings.Cut(rdn, "="); ok {
+		return strings.TrimSpace(value)
+	}
+	return strings.TrimSpace(rdn)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"go_app/lifecycle"
+	"go_app/telemetry"
+)
+
+// Registers the App's own subsystems with its lifecycle. They start in this order and
+// stop in reverse: the deployment info first, so log lines and exported metrics carry
+// it, then the metrics exporter, last down so its final export covers the shutdown,
+// and the message consumer last up and, of these, first down. Whatever is appended
+// afterwards, like the listeners in index.go, starts after all of them and stops
+// before any.
+func (a *App) registerLifecycle() {
+	a.Lifecycle.Append(lifecycle.Hook{
+		Name: "deployment info",
+		Start: func(ctx context.Context) error {
+			a.describeDeployment(ctx)
+			return nil
+		},
+	})
+
+	exporter := lifecycle.Background("metrics exporter", func(ctx context.Context) {
+		if a.Metrics != nil {
+			a.Metrics.Run(ctx, a.Config.Telemetry.OTLPInterval)
+		}
+	})
+	exporter.Timeout = telemetry.OTLP_TIMEOUT + 5*time.Second
+	a.Lifecycle.Append(exporter)
+
+	a.Lifecycle.Append(lifecycle.Hook{
+		Name: "access log",
+		Stop: func(ctx context.Context) error {
+			if a.accessLog == nil {
+				return nil
+			}
+			return a.accessLog.Close()
+		},
+	})
+
+	a.Lifecycle.Append(lifecycle.Hook{
+		Name: "database",
+		Start: func(ctx context.Context) error {
+			if a.DB == nil {
+				return nil
+			}
+			return a.DB.PingContext(ctx)
+		},
+		Stop: func(ctx context.Context) error {
+			if a.Database != nil {
+				return a.Database.Close()
+			}
+			if a.DB == nil {
+				return nil
+			}
+			return a.DB.Close()
+		},
+	})
+	a.Lifecycle.Append(lifecycle.Background("database health", func(ctx context.Context) {
+		if a.Database != nil {
+			a.Database.monitor(ctx, a.Config.Database.HealthInterval)
+		}
+	}))
+	a.Lifecycle.Append(lifecycle.Hook{
+		Name: "locks",
+		Stop: func(ctx context.Context) error {
+			if closer, ok := a.Locks.(io.Closer); ok {
+				return closer.Close()
+			}
+			return nil
+		},
+	})
+	a.Lifecycle.Append(lifecycle.Hook{
+		Name: "workers",
+		Stop: func(ctx context.Context) error {
+			a.Workers.Close()
+			return nil
+		},
+	})
+
+	// Snapshot periodically while serving, and once more after everything else stopped
+	snapshots := lifecycle.Background("blacklists", a.SnapshotBlacklists)
+	stopSnapshots := snapshots.Stop
+	snapshots.Stop = func(ctx context.Context) error {
+		err := stopSnapshots(ctx)
+		a.SaveBlacklists()
+		return err
+	}
+	a.Lifecycle.Append(snapshots)
+
+	a.Lifecycle.Append(lifecycle.Hook{
+		Name: "shutdown hooks",
+		Stop: func(ctx context.Context) error {
+			a.RunShutdownHooks(ctx)
+			return nil
+		},
+	})
+	a.Lifecycle.Append(lifecycle.Background("metadata watcher", a.WatchConfiguration))
+	a.Lifecycle.Append(lifecycle.Background("oidc keys", func(ctx context.Context) {
+		if a.oidcKeys != nil {
+			a.oidcKeys.Run(ctx)
+		}
+	}))
+	a.Lifecycle.Append(a.Every("session sweep", a.Config.SessionSweepInterval, a.sweepSessions))
+	a.Lifecycle.Append(a.watchSLOs())
+	// Failed logins are counted per replica, so every replica sweeps its own
+	a.Lifecycle.Append(lifecycle.Background("login attempts", a.LoginGuard.Run))
+
+	consumer := lifecycle.Background("message consumer", func(ctx context.Context) {
+		a.Consumer.Run(ctx)
+	})
+	// Handlers in flight get the consumer's drain time, plus a moment to commit
+	consumer.Timeout = a.Consumer.DrainTimeout + 5*time.Second
+	a.Lifecycle.Append(consumer)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go_app/workerpool"
+)
+
+// Load shedding metrics per route, published on /debug/vars
+var loadShedMetrics = expvar.NewMap("loadshed")
+
+// Limits for the per-route load shedder; MaxInFlight <= 0 disables it
+type LoadShedConfig struct {
+	MaxInFlight  int
+	MaxQueue     int
+	QueueTimeout time.Duration
+}
+
+// Caps concurrent requests per route, letting a few callers wait briefly for a slot
+type LoadShedder struct {
+	Config LoadShedConfig
+
+	mutex  sync.Mutex
+	routes map[string]*routeLimiter
+}
+
+type routeLimiter struct {
+	slots    chan struct{}
+	queued   atomic.Int64
+	inFlight *expvar.Int
+	shed     *expvar.Int
+}
+
+func NewLoadShedder(config LoadShedConfig) *LoadShedder {
+	return &LoadShedder{Config: config, routes: make(map[string]*routeLimiter)}
+}
+
+func (s *LoadShedder) limiter(route string) *routeLimiter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	limiter, ok := s.routes[route]
+	if !ok {
+		limiter = &routeLimiter{
+			slots:    make(chan struct{}, s.Config.MaxInFlight),
+			inFlight: new(expvar.Int),
+			shed:     new(expvar.Int),
+		}
+		loadShedMetrics.Set(route+".inflight", limiter.inFlight)
+		loadShedMetrics.Set(route+".shed", limiter.shed)
+		s.routes[route] = limiter
+	}
+	return limiter
+}
+
+// Waits for a free slot on route, returning false when the request should be shed
+func (s *LoadShedder) acquire(r *http.Request, limiter *routeLimiter) bool {
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	default:
+	}
+
+	if limiter.queued.Add(1) > int64(s.Config.MaxQueue) {
+		limiter.queued.Add(-1)
+		return false
+	}
+	defer limiter.queued.Add(-1)
+
+	timer := time.NewTimer(s.Config.QueueTimeout)
+	defer timer.Stop()
+
+	select {
+	case limiter.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// Wraps a route handler with the shedder, answering 503 when the route is saturated
+func (a *App) shedLoad(route string, next http.HandlerFunc) http.HandlerFunc {
+	if a.LoadShedder == nil || a.LoadShedder.Config.MaxInFlight <= 0 {
+		return next
+	}
+	limiter := a.LoadShedder.limiter(route)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !a.LoadShedder.acquire(r, limiter) {
+			limiter.shed.Add(1)
+			w.Header().Set("Retry-After", "1")
+			a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable: Server is overloaded")
+			return
+		}
+		limiter.inFlight.Add(1)
+		defer func() {
+			limiter.inFlight.Add(-1)
+			<-limiter.slots
+		}()
+
+		next(w, r)
+	}
+}
+
+// Writes the response for a failed App.Workers submission: a full queue is shed like an
+// overloaded route, other errors are reported as internal. Returns false when err is nil.
+func (a *App) handleWorkerError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, workerpool.ErrQueueFull), errors.Is(err, workerpool.ErrClosed):
+		loadShedMetrics.Add("workers", 1)
+		w.Header().Set("Retry-After", "1")
+		a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable: Server is overloaded")
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable: Request timed out")
+	default:
+		a.Logger.Println("Worker task failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"go_app/i18n"
+)
+
+// Error message catalogs, locales/<locale>.json, each mapping error codes to messages
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+// Error messages in every shipped language, and the code of each English message
+var errorCatalog, errorCodes = loadErrorCatalog()
+
+func loadErrorCatalog() (*i18n.Catalog, map[string]string) {
+	files, _ := fs.Sub(localeFiles, "locales")
+	catalog, err := i18n.LoadCatalog(files, i18n.DEFAULT_LOCALE)
+	if err != nil {
+		panic(err) // the embedded catalogs are broken, a build problem
+	}
+	codes := map[string]string{}
+	for code, message := range catalog.Messages(i18n.DEFAULT_LOCALE) {
+		codes[message] = code
+	}
+	return catalog, codes
+}
+
+// The language-independent code of an error message, and the message in the client's
+// language. Messages are written in English at the call sites and found in the catalog
+// by their text. Messages not in it, like ones with details appended, keep their
+// English text with only the "Status: " prefix translated, and take the status's code.
+func localizeError(r *http.Request, status int, message string) (code, localized, locale string) {
+	preferred := i18n.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if code, ok := errorCodes[message]; ok {
+		localized, locale, _ = errorCatalog.Lookup(code, preferred)
+		return code, localized, locale
+	}
+
+	code = statusCode(status)
+	prefix, detail, found := strings.Cut(message, ": ")
+	if prefixCode, ok := errorCodes[prefix]; found && ok {
+		translated, locale, _ := errorCatalog.Lookup(prefixCode, preferred)
+		return code, translated + ": " + detail, locale
+	}
+	return code, message, i18n.DEFAULT_LOCALE
+}
+
+// "too_many_requests" for 429
+func statusCode(status int) string {
+	text := http.StatusText(status)
+	if text == "" {
+		return "error"
+	}
+	text = strings.NewReplacer(" ", "_", "-", "_", "'", "").Replace(text)
+	return strings.ToLower(text)
+}
+
+// The JSON body of an error response, in the client's language, with its code and
+// whether it may be retried (see errorcodes.json). The client's locale changes the
+// body, so caches are told to vary on it.
+func errorBody(w http.ResponseWriter, r *http.Request, status int, message string) map[string]any {
+	code, localized, locale := localizeError(r, status, message)
+	w.Header().Set("Content-Language", locale)
+	w.Header().Add("Vary", "Accept-Language")
+	return map[string]any{"error": localized, "code": code, "retryable": retryableError(code, status)}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go_app/lifecycle"
+	"go_app/locking"
+)
+
+// Backends of lock-backend
+const (
+	LOCK_BACKEND_MEMORY   = "memory"
+	LOCK_BACKEND_REDIS    = "redis"
+	LOCK_BACKEND_POSTGRES = "postgres"
+)
+
+// Timeout of each call to the Redis lock backend
+const REDIS_LOCK_TIMEOUT = 5 * time.Second
+
+// Where the locks scheduled jobs take live. The memory backend only excludes other
+// goroutines of the process, which is enough for a single replica.
+type LockConfig struct {
+	Backend  string
+	RedisURL string // redis://[:password@]host[:port][/db], rediss:// for TLS
+}
+
+// Builds the locker of config. The postgres backend uses the configured database.
+func newLocker(config LockConfig, driver string, db *sql.DB) (locking.Locker, error) {
+	switch config.Backend {
+	case LOCK_BACKEND_MEMORY, "":
+		return locking.NewMemory(), nil
+	case LOCK_BACKEND_REDIS:
+		if config.RedisURL == "" {
+			return nil, errors.New("lock-backend redis needs lock-redis-url")
+		}
+		redis, err := locking.NewRedis(config.RedisURL, REDIS_LOCK_TIMEOUT)
+		if err != nil {
+			return nil, err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), REDIS_LOCK_TIMEOUT)
+		defer cancel()
+		if err := redis.Ping(ctx); err != nil {
+			return nil, fmt.Errorf("lock-redis-url: %w", err)
+		}
+		return redis, nil
+	case LOCK_BACKEND_POSTGRES:
+		if db == nil || driver != "postgres" && driver != "pgx" {
+			return nil, errors.New("lock-backend postgres needs database-driver postgres or pgx")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+		defer cancel()
+		return locking.NewPostgres(ctx, db)
+	}
+	return nil, fmt.Errorf("unknown lock-backend %q", config.Backend)
+}
+
+// Takes the named lock for ttl, waiting while another replica holds it until ctx is
+// done. Release the lease when done; pass its Token along to storage that checks
+// fencing tokens.
+func (a *App) Lock(ctx context.Context, name string, ttl time.Duration) (*locking.Lease, error) {
+	return locking.Lock(ctx, a.Locks, name, ttl)
+}
+
+// Runs fn if the named lock is free, holding it for at most ttl; fn's context ends
+// when the lease does. Reports false without running fn when another replica holds
+// the lock.
+func (a *App) RunExclusive(ctx context.Context, name string, ttl time.Duration, fn func(ctx context.Context, lease *locking.Lease) error) (bool, error) {
+	lease, err := locking.TryLock(ctx, a.Locks, name, ttl)
+	if errors.Is(err, locking.ErrLocked) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		if err := lease.Release(context.WithoutCancel(ctx)); err != nil {
+			a.Log.Warn("Lock release failed", "lock", name, "error", err)
+		}
+	}()
+	ctx, cancel := context.WithDeadline(ctx, lease.Expires)
+	defer cancel()
+	return true, fn(ctx, lease)
+}
+
+// A background job running fn every interval on one replica at a time. Each run keeps
+// the lock named after the job for the whole interval, so replicas whose timers are
+// out of step don't repeat it; fn's context ends with the interval.
+func (a *App) Every(name string, interval time.Duration, fn func(ctx context.Context) error) lifecycle.Hook {
+	return lifecycle.Background(name, func(ctx context.Context) {
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			// Shorter than the interval, so the next tick finds the lock free
+			lease, err := locking.TryLock(ctx, a.Locks, "job:"+name, interval*9/10)
+			if errors.Is(err, locking.ErrLocked) {
+				a.Log.Debug("Job ran on another replica", "job", name)
+				continue
+			}
+			if err != nil {
+				a.Log.Error("Job lock failed", "job", name, "error", err)
+				continue
+			}
+			runCtx, cancel := context.WithDeadline(ctx, lease.Expires)
+			if err := fn(runCtx); err != nil {
+				a.Log.Error("Job failed", "job", name, "fence", lease.Token, "error", err)
+			}
+			cancel()
+		}
+	})
+}
+
+// Deletes sessions that have been idle for longer than session-idle-timeout
+func (a *App) sweepSessions(ctx context.Context) error {
+	return a.Stores.Sessions.Prune(ctx, a.Clock.Now().Add(-a.Config.SessionIdleTimeout))
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Longest a temporary level from /admin/loglevel may last
+const MAX_LOG_LEVEL_DURATION = 24 * time.Hour
+
+// Parses debug, info, warn or error, optionally with an offset such as "debug-4"
+func parseLogLevel(value string) (slog.Level, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(value)); err != nil {
+		return 0, fmt.Errorf("invalid log level %q", value)
+	}
+	return level, nil
+}
+
+// Changes the level of App.Log. With a positive duration the previous level comes back
+// once it has passed; a later change cancels that revert. by names who made the change
+// for the audit line.
+func (a *App) SetLogLevel(level slog.Level, duration time.Duration, by string) {
+	a.logLevelMutex.Lock()
+	defer a.logLevelMutex.Unlock()
+
+	previous, base := a.LogLevel.Level(), a.LogLevel.Level()
+	if a.logLevelRevert != nil {
+		// A temporary level replacing another one still reverts to the original level
+		a.logLevelRevert.Stop()
+		a.logLevelRevert = nil
+		a.logLevelRevertAt = time.Time{}
+		base = a.logLevelBase
+	}
+	a.LogLevel.Set(level)
+
+	if duration > 0 {
+		a.logLevelBase = base
+		// The revert runs on a real timer, so it is reported in real time too; App.Clock
+		// may be a test clock that never reaches it
+		a.logLevelRevertAt = time.Now().Add(duration)
+		var timer *time.Timer
+		timer = time.AfterFunc(duration, func() {
+			a.logLevelMutex.Lock()
+			defer a.logLevelMutex.Unlock()
+			if a.logLevelRevert != timer {
+				return
+			}
+			a.LogLevel.Set(base)
+			a.logLevelRevert = nil
+			a.logLevelRevertAt = time.Time{}
+			a.Logger.Printf("audit: event=log_level level=%s previous=%s by=revert", base, level)
+		})
+		a.logLevelRevert = timer
+	}
+	a.Logger.Printf("audit: event=log_level level=%s previous=%s duration=%s by=%s", level, previous, duration, by)
+}
+
+// Applies the hot-reloadable parts of a freshly loaded config, see SIGHUP in index.go.
+// Only the log level and the mounted route groups change at runtime; everything else
+// needs a restart.
+func (a *App) Reload(config Config) error {
+	level, err := parseLogLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	a.SetLogLevel(level, 0, "sighup")
+	// Cached tokens were verified against the settings before the reload
+	a.tokenCache.Clear()
+	return a.applyRouteGroups(configList(config.RouteGroups))
+}
+
+// Reports the current level and, while a temporary level is active, when it reverts
+func (a *App) getLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	a.logLevelMutex.Lock()
+	response := map[string]interface{}{"level": a.LogLevel.Level().String()}
+	if !a.logLevelRevertAt.IsZero() {
+		response["revertTo"] = a.logLevelBase.String()
+		response["revertAt"] = a.logLevelRevertAt.UTC().Truncate(time.Second)
+	}
+	a.logLevelMutex.Unlock()
+	a.writeJSON(w, r, http.StatusOK, response)
+}
+
+// Sets the level from {"level": "debug", "duration": "15m"}; duration is optional
+func (a *App) setLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Level    string `json:"level"`
+		Duration string `json:"duration"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Level == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: level is required")
+		return
+	}
+	level, err := parseLogLevel(request.Level)
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: level must be debug, info, warn or error")
+		return
+	}
+	var duration time.Duration
+	if request.Duration != "" {
+		if duration, err = time.ParseDuration(request.Duration); err != nil || duration <= 0 || duration > MAX_LOG_LEVEL_DURATION {
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: duration must be a positive duration up to 24h")
+			return
+		}
+	}
+
+	a.SetLogLevel(level, duration, clientIP(r))
+	a.getLogLevelHandler(w, r)
+}
+
+// Records the status of a response for the debug request log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Lets http.ResponseController reach Flush and friends on the wrapped writer
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Logs every request at debug level. Costs nothing at higher levels.
+func (a *App) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.Log.Enabled(r.Context(), slog.LevelDebug) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		recorder := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		a.Log.Debug("request", "method", r.Method, "path", r.URL.Path, "status", recorder.status,
+			"duration", time.Since(start), "ip", clientIP(r))
+	})
+}
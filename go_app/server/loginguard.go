@@ -0,0 +1,230 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// Login protection metrics, published on /debug/vars
+var loginMetrics = expvar.NewMap("login")
+
+// How often keys that went quiet are dropped, see LoginGuard.Sweep
+const LOGIN_SWEEP_INTERVAL = time.Minute
+
+// Failed login state for a single username or client IP
+type loginAttempt struct {
+	Failures    int
+	LastFailure time.Time
+	NextAttempt time.Time
+	LockedUntil time.Time
+	// Attempts that passed Check and haven't been released yet
+	InFlight int
+}
+
+// Tracks failed logins and throttles callers with exponential delays and lockouts.
+//
+// A login passes Check, verifies the password and then records its outcome. As the
+// password check is slow, Check reserves the attempt so that concurrent requests
+// can't all pass it before the first failure is recorded: reserved attempts count
+// towards MaxAttempts, and once a key has failed, only one attempt at a time may be
+// in flight, so each waits out the delay of the failure before it. Every attempt that
+// passed Check must be released with Release, after its outcome is recorded if it has
+// one.
+type LoginGuard struct {
+	MaxAttempts int
+	Lockout     time.Duration
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Logger      *log.Logger
+	Clock       Clock
+
+	// Called when a key gets locked out; must not block
+	OnLockout func(key string, failures int, until time.Time)
+
+	mutex    sync.Mutex
+	attempts map[string]*loginAttempt
+}
+
+func NewLoginGuard(config LoginConfig, logger *log.Logger, clock Clock) *LoginGuard {
+	return &LoginGuard{
+		MaxAttempts: config.MaxAttempts,
+		Lockout:     config.Lockout,
+		BaseDelay:   config.BaseDelay,
+		MaxDelay:    config.MaxDelay,
+		Logger:      logger,
+		Clock:       clock,
+		attempts:    make(map[string]*loginAttempt),
+	}
+}
+
+func usernameKey(username string) string { return "user:" + username }
+func ipKey(ip string) string             { return "ip:" + ip }
+
+// Returns how long the caller must wait before another attempt is allowed for any of
+// keys. When the attempt is allowed, it is reserved on every key until Release.
+func (g *LoginGuard) Check(keys ...string) (time.Duration, bool) {
+	now := g.Clock.Now()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	var wait time.Duration
+	busy := false
+	for _, key := range keys {
+		attempt, ok := g.attempts[key]
+		if !ok {
+			continue
+		}
+		if g.expired(attempt, now) {
+			delete(g.attempts, key)
+			continue
+		}
+		for _, until := range []time.Time{attempt.LockedUntil, attempt.NextAttempt} {
+			if d := until.Sub(now); d > wait {
+				wait = d
+			}
+		}
+		if attempt.InFlight > 0 && (attempt.Failures > 0 || attempt.Failures+attempt.InFlight >= g.MaxAttempts) {
+			busy = true
+		}
+	}
+	if busy && wait <= 0 {
+		// The attempts in flight end in about as long as a password check takes
+		wait = max(g.BaseDelay, time.Second)
+	}
+	if wait > 0 {
+		return wait, false
+	}
+
+	for _, key := range keys {
+		attempt, ok := g.attempts[key]
+		if !ok {
+			attempt = &loginAttempt{}
+			g.attempts[key] = attempt
+		}
+		attempt.InFlight++
+	}
+	return 0, true
+}
+
+// Ends an attempt Check allowed. Its outcome, if any, must be recorded first.
+func (g *LoginGuard) Release(keys ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, key := range keys {
+		attempt, ok := g.attempts[key]
+		if !ok || attempt.InFlight == 0 {
+			continue
+		}
+		attempt.InFlight--
+		if attempt.InFlight == 0 && attempt.Failures == 0 {
+			delete(g.attempts, key)
+		}
+	}
+}
+
+// Failures decay once the caller has been quiet for a full lockout window
+func (g *LoginGuard) expired(attempt *loginAttempt, now time.Time) bool {
+	return attempt.InFlight == 0 && now.Sub(attempt.LastFailure) > g.Lockout && now.After(attempt.LockedUntil)
+}
+
+// Drops the keys whose failures have decayed. Check does so for the keys it is asked
+// about, but keys that are never asked about again, like made-up usernames, would
+// otherwise stay forever.
+func (g *LoginGuard) Sweep() {
+	now := g.Clock.Now()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for key, attempt := range g.attempts {
+		if g.expired(attempt, now) {
+			delete(g.attempts, key)
+		}
+	}
+	loginMetrics.Set("tracked_keys", intVar(len(g.attempts)))
+}
+
+// Sweeps every LOGIN_SWEEP_INTERVAL until ctx ends
+func (g *LoginGuard) Run(ctx context.Context) {
+	ticker := time.NewTicker(LOGIN_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.Sweep()
+		}
+	}
+}
+
+// Records a failed attempt against every key, locking keys that reach MaxAttempts
+func (g *LoginGuard) RecordFailure(keys ...string) {
+	now := g.Clock.Now()
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, key := range keys {
+		attempt, ok := g.attempts[key]
+		if !ok {
+			attempt = &loginAttempt{}
+			g.attempts[key] = attempt
+		}
+		attempt.Failures++
+		attempt.LastFailure = now
+
+		delay := g.BaseDelay << (attempt.Failures - 1)
+		if delay > g.MaxDelay || delay <= 0 {
+			delay = g.MaxDelay
+		}
+		attempt.NextAttempt = now.Add(delay)
+
+		if attempt.Failures >= g.MaxAttempts {
+			attempt.LockedUntil = now.Add(g.Lockout)
+			loginMetrics.Add("lockouts", 1)
+			g.Logger.Printf("audit: event=login_lockout key=%q failures=%d until=%s", key, attempt.Failures, attempt.LockedUntil.Format(time.RFC3339))
+			if g.OnLockout != nil {
+				g.OnLockout(key, attempt.Failures, attempt.LockedUntil)
+			}
+		}
+	}
+}
+
+// Clears the failure history for keys after a successful login
+func (g *LoginGuard) RecordSuccess(keys ...string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	for _, key := range keys {
+		g.clear(key)
+	}
+}
+
+// Removes any lockout for key, returning whether there was one
+func (g *LoginGuard) Unlock(key string) bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	return g.clear(key)
+}
+
+// Forgets key's failures, keeping the attempts in flight until they are released.
+// Returns whether there were any.
+func (g *LoginGuard) clear(key string) bool {
+	attempt, ok := g.attempts[key]
+	if !ok {
+		return false
+	}
+	if attempt.InFlight == 0 {
+		delete(g.attempts, key)
+	} else {
+		g.attempts[key] = &loginAttempt{InFlight: attempt.InFlight}
+	}
+	return attempt.Failures > 0
+}
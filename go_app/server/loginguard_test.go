@@ -0,0 +1,146 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLoginGuard(clock Clock) *LoginGuard {
+	config := LoginConfig{MaxAttempts: 3, Lockout: 15 * time.Minute, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+	return NewLoginGuard(config, log.New(io.Discard, "", 0), clock)
+}
+
+// Checks from n goroutines at once, returning how many were allowed. Allowed attempts
+// stay in flight.
+func checkConcurrently(guard *LoginGuard, n int, keys ...string) int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	allowed := 0
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := guard.Check(keys...); ok {
+				mutex.Lock()
+				allowed++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return allowed
+}
+
+func TestLoginGuardReservesAttempts(t *testing.T) {
+	clock := NewMockClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	guard := newTestLoginGuard(clock)
+	keys := []string{usernameKey("alice"), ipKey("192.0.2.1")}
+
+	// Before any failure, no more attempts than MaxAttempts may be in flight
+	if allowed := checkConcurrently(guard, 50, keys...); allowed != guard.MaxAttempts {
+		t.Fatalf("%d concurrent attempts allowed, want %d", allowed, guard.MaxAttempts)
+	}
+	if wait, ok := guard.Check(usernameKey("alice")); ok || wait < time.Second {
+		t.Errorf("Check with %d attempts in flight = %v, %v, want a refusal", guard.MaxAttempts, wait, ok)
+	}
+	// Another username from the same IP is held back too
+	if _, ok := guard.Check(usernameKey("bob"), ipKey("192.0.2.1")); ok {
+		t.Error("Check for another username from a busy IP allowed")
+	}
+	// A success frees its own attempt and clears the failures, not the others in flight
+	guard.RecordSuccess(keys...)
+	guard.Release(keys...)
+	if allowed := checkConcurrently(guard, 10, keys...); allowed != 1 {
+		t.Errorf("%d attempts allowed after one ended, want 1", allowed)
+	}
+	for range guard.MaxAttempts {
+		guard.Release(keys...)
+	}
+	if len(guard.attempts) != 0 {
+		t.Errorf("%d keys held once every attempt ended without a failure, want none", len(guard.attempts))
+	}
+
+	// After a failure, one attempt at a time, each after the failure's delay
+	guard.Check(keys...)
+	guard.RecordFailure(keys...)
+	guard.Release(keys...)
+	if wait, ok := guard.Check(keys...); ok || wait != time.Second {
+		t.Errorf("Check right after a failure = %v, %v, want a 1s wait", wait, ok)
+	}
+	clock.Advance(time.Second)
+	if allowed := checkConcurrently(guard, 50, keys...); allowed != 1 {
+		t.Fatalf("%d concurrent attempts allowed after a failure, want 1", allowed)
+	}
+	guard.RecordFailure(keys...)
+	guard.Release(keys...)
+	if wait, ok := guard.Check(keys...); ok || wait != 2*time.Second {
+		t.Errorf("Check after a second failure = %v, %v, want a 2s wait", wait, ok)
+	}
+
+	// Attempts in flight keep a key from decaying
+	clock.Advance(2 * time.Second)
+	if _, ok := guard.Check(keys...); !ok {
+		t.Fatal("Check after the delay refused")
+	}
+	clock.Advance(time.Hour)
+	guard.Sweep()
+	if _, ok := guard.attempts[usernameKey("alice")]; !ok {
+		t.Error("sweep dropped a key with an attempt in flight")
+	}
+	guard.Release(keys...)
+	guard.Sweep()
+	if len(guard.attempts) != 0 {
+		t.Errorf("%d keys held after the sweep, want none", len(guard.attempts))
+	}
+}
+
+// Parallel logins with wrong passwords all used to pass the check before the first
+// failure was recorded, each getting a guess
+func TestConcurrentLoginsAreThrottled(t *testing.T) {
+	keys, err := NewRandomKeyProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewMockClock(time.Now())
+	app := NewApp(DefaultConfig(), log.New(io.Discard, "", 0), clock, keys, Stores{
+		Blacklist:   NewMemoryBlacklist(),
+		Revocations: NewMemoryBlacklist(),
+		Users:       NewMemoryUserStore(Account{ID: 1, Username: "exampleuser", Password: "password"}),
+		TwoFactor:   NewMemoryTwoFactorStore(),
+	})
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	statuses := map[int]int{}
+	for range 30 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username":"exampleuser","password":"guess"}`))
+			app.loginHandler(w, r)
+			mutex.Lock()
+			statuses[w.Code]++
+			mutex.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if guesses := statuses[http.StatusUnauthorized]; guesses < 1 || guesses > app.LoginGuard.MaxAttempts {
+		t.Errorf("%d guesses checked, want between 1 and %d: %v", guesses, app.LoginGuard.MaxAttempts, statuses)
+	}
+	if statuses[http.StatusUnauthorized]+statuses[http.StatusTooManyRequests] != 30 {
+		t.Errorf("statuses = %v, want only 401 and 429", statuses)
+	}
+	for key, attempt := range app.LoginGuard.attempts {
+		if attempt.InFlight != 0 {
+			t.Errorf("%s has %d attempts in flight once every request ended", key, attempt.InFlight)
+		}
+	}
+}
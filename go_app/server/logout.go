@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+
+	"go_app/eventbus"
+)
+
+// Revokes the presented token so it can neither be used nor refreshed again
+func (a *App) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	token, fromCookie := a.presentedToken(r)
+	if token == "" {
+		a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Missing token")
+		return
+	}
+
+	// Expired tokens can still be logged out; they remain refreshable otherwise
+	claims, err := a.parseToken(r.Context(), token, true)
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Invalid token")
+		return
+	}
+	if fromCookie {
+		if err := a.checkCSRF(r, claims); err != nil {
+			a.handleErrorResponse(w, r, http.StatusForbidden, err.Error())
+			return
+		}
+		a.clearSessionCookie(w)
+	}
+
+	a.stores(r.Context()).Revocations.Add(token, tokenExpiry(claims))
+	if sid, ok := claims["sid"].(string); ok {
+		if err := a.stores(r.Context()).Sessions.Delete(r.Context(), sid); err != nil {
+			a.Logger.Println("Session deletion failed:", err)
+		}
+	}
+	userID := newUserFromClaims(claims).ID
+	a.Logger.Printf("audit: event=logout user=%s ip=%s", userID, clientIP(r))
+	eventbus.Publish(a.Events, TopicLogout, LogoutEvent{UserID: userID, IP: clientIP(r), Time: a.clock(r.Context()).Now()})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"go_app/messaging"
+)
+
+// Attempts at appending when concurrent publishers race for the same position
+const MESSAGE_APPEND_ATTEMPTS = 3
+
+// Message log and consumer offsets in a SQL database, shared by every instance
+type sqlMessageLog struct {
+	db     *sql.DB
+	driver string
+}
+
+const messagesSchema = `CREATE TABLE IF NOT EXISTS messages (
+	topic TEXT NOT NULL,
+	position BIGINT NOT NULL,
+	payload BLOB NOT NULL,
+	created_at BIGINT NOT NULL,
+	PRIMARY KEY (topic, position)
+)`
+
+const consumerOffsetsSchema = `CREATE TABLE IF NOT EXISTS consumer_offsets (
+	group_name TEXT NOT NULL,
+	topic TEXT NOT NULL,
+	position BIGINT NOT NULL,
+	PRIMARY KEY (group_name, topic)
+)`
+
+// Creates the messages and consumer_offsets tables if needed
+func NewSQLMessageLog(db *sql.DB, driver string) (messaging.Log, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	schema := messagesSchema
+	if driver == "postgres" || driver == "pgx" {
+		schema = strings.Replace(schema, "BLOB", "BYTEA", 1)
+	}
+	for _, statement := range []string{schema, consumerOffsetsSchema} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlMessageLog{db: db, driver: driver}, nil
+}
+
+// Takes the next position of topic in one statement; a publisher that lost the race
+// for it hits the primary key and tries again
+func (l *sqlMessageLog) Append(ctx context.Context, topic string, payload []byte) (int64, error) {
+	query := rebind(l.driver, `INSERT INTO messages (topic, position, payload, created_at)
+		SELECT ?, COALESCE(MAX(position), 0) + 1, ?, ? FROM messages WHERE topic = ?
+		RETURNING position`)
+	var err error
+	for attempt := 0; attempt < MESSAGE_APPEND_ATTEMPTS; attempt++ {
+		var position int64
+		err = l.db.QueryRowContext(ctx, query, topic, payload, time.Now().Unix(), topic).Scan(&position)
+		if err == nil {
+			return position, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return 0, err
+}
+
+func (l *sqlMessageLog) Read(ctx context.Context, topic string, after int64, limit int) ([]messaging.Message, error) {
+	rows, err := l.db.QueryContext(ctx, rebind(l.driver, `SELECT position, payload, created_at FROM messages WHERE topic = ? AND position > ? ORDER BY position LIMIT ?`), topic, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []messaging.Message
+	for rows.Next() {
+		message := messaging.Message{Topic: topic}
+		var created int64
+		if err := rows.Scan(&message.Offset, &message.Payload, &created); err != nil {
+			return nil, err
+		}
+		message.Time = time.Unix(created, 0)
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (l *sqlMessageLog) Head(ctx context.Context, topic string) (int64, error) {
+	var head int64
+	err := l.db.QueryRowContext(ctx, rebind(l.driver, `SELECT COALESCE(MAX(position), 0) FROM messages WHERE topic = ?`), topic).Scan(&head)
+	return head, err
+}
+
+func (l *sqlMessageLog) Committed(ctx context.Context, group, topic string) (int64, error) {
+	var position int64
+	err := l.db.QueryRowContext(ctx, rebind(l.driver, `SELECT position FROM consumer_offsets WHERE group_name = ? AND topic = ?`), group, topic).Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return position, err
+}
+
+func (l *sqlMessageLog) Commit(ctx context.Context, group, topic string, offset int64) error {
+	_, err := l.db.ExecContext(ctx, rebind(l.driver, `INSERT INTO consumer_offsets (group_name, topic, position) VALUES (?, ?, ?)
+		ON CONFLICT (group_name, topic) DO UPDATE SET position = excluded.position`), group, topic, offset)
+	return err
+}
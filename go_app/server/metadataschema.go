@@ -0,0 +1,266 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"go_app/configcrypt"
+	"go_app/configformat"
+)
+
+// JSON Schema dialect of MetadataSchema
+const JSON_SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+// The JSON Schema of the metadata document, for editors and for CI checks in the
+// repositories holding it. Properties the service doesn't read are allowed, and an
+// encrypted value (see scaffold encrypt) is allowed wherever a scalar is.
+func MetadataSchema() map[string]interface{} {
+	return map[string]interface{}{
+		"$schema":     JSON_SCHEMA_DIALECT,
+		"title":       "metadata",
+		"description": "Runtime configuration of the service, reloaded without a deploy",
+		"type":        "object",
+		"required":    []interface{}{"description", "version"},
+		"properties": map[string]interface{}{
+			"description": encryptable(map[string]interface{}{"type": "string", "description": "Shown by /status"}),
+			"version":     encryptable(map[string]interface{}{"type": "string", "description": "Shown by /status, followed by the build number"}),
+			"routes": map[string]interface{}{
+				"type":                 "object",
+				"description":          "Settings of routes by pattern, e.g. \"GET /status\"",
+				"additionalProperties": map[string]interface{}{"$ref": "#/$defs/routeSettings"},
+			},
+			"rateLimits": map[string]interface{}{
+				"type":                 "object",
+				"description":          "Requests per minute by the tier of the caller's token; 0 is unlimited",
+				"additionalProperties": encryptable(map[string]interface{}{"type": "integer", "minimum": 0}),
+			},
+			"featureFlags": map[string]interface{}{
+				"type":                 "object",
+				"description":          "Features by name and whether they are on; unknown features are off",
+				"additionalProperties": encryptable(map[string]interface{}{"type": "boolean"}),
+			},
+			"branding": map[string]interface{}{
+				"type":        "object",
+				"description": "Served by /branding for clients to theme themselves with, e.g. name, logoUrl and primaryColor",
+			},
+		},
+		"$defs": map[string]interface{}{
+			"encrypted": map[string]interface{}{
+				"type":    "string",
+				"pattern": "^" + regexp.QuoteMeta(configcrypt.PREFIX) + ".*\\]$",
+			},
+			"routeSettings": map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"properties": map[string]interface{}{
+					"corsOrigins": map[string]interface{}{
+						"type":  "array",
+						"items": encryptable(map[string]interface{}{"type": "string"}),
+					},
+					"rateLimit": encryptable(map[string]interface{}{"type": "integer", "minimum": 0, "description": "Requests per minute per client; 0 turns the limit off"}),
+					"auth":      encryptable(map[string]interface{}{"type": "string", "description": "An auth mode as in the route table, or strategies in order"}),
+				},
+			},
+		},
+	}
+}
+
+func encryptable(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"anyOf": []interface{}{schema, map[string]interface{}{"$ref": "#/$defs/encrypted"}}}
+}
+
+// Checks each member of a partial metadata document, such as a tenant overlay, against
+// the schema of that member. Nulls, which remove a value when merged, pass anywhere.
+func ValidateMetadataMembers(members map[string]interface{}) []SchemaError {
+	schema := MetadataSchema()
+	properties := schema["properties"].(map[string]interface{})
+	v := &schemaValidator{defs: schema["$defs"].(map[string]interface{}), overlay: true}
+	for name, value := range members {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			v.validate(property, value, pointer("", name))
+		}
+	}
+	sort.SliceStable(v.errors, func(i, j int) bool { return v.errors[i].Path < v.errors[j].Path })
+	return v.errors
+}
+
+// A place where a metadata document breaks the schema
+type SchemaError struct {
+	Path    string // JSON Pointer to the value, "" for the document
+	Message string
+}
+
+func (e SchemaError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Checks document against MetadataSchema and returns every problem found, sorted by
+// path. Only the keywords MetadataSchema uses are implemented.
+func ValidateMetadata(document map[string]interface{}) []SchemaError {
+	schema := MetadataSchema()
+	v := &schemaValidator{defs: schema["$defs"].(map[string]interface{})}
+	v.validate(schema, document, "")
+	sort.SliceStable(v.errors, func(i, j int) bool { return v.errors[i].Path < v.errors[j].Path })
+	return v.errors
+}
+
+type schemaValidator struct {
+	defs    map[string]interface{}
+	overlay bool // nulls are valid
+	errors  []SchemaError
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	v.errors = append(v.errors, SchemaError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string) {
+	if v.overlay && value == nil {
+		return
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		v.validate(v.defs[strings.TrimPrefix(ref, "#/$defs/")].(map[string]interface{}), value, path)
+		return
+	}
+	if alternatives, ok := schema["anyOf"].([]interface{}); ok {
+		// Reports the first alternative's problems, the plain value's rather than the
+		// encrypted one's
+		var first []SchemaError
+		for i, alternative := range alternatives {
+			attempt := &schemaValidator{defs: v.defs, overlay: v.overlay}
+			attempt.validate(alternative.(map[string]interface{}), value, path)
+			if len(attempt.errors) == 0 {
+				return
+			}
+			if i == 0 {
+				first = attempt.errors
+			}
+		}
+		v.errors = append(v.errors, first...)
+		return
+	}
+
+	kind, _ := schema["type"].(string)
+	switch kind {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			v.fail(path, "must be an object")
+			return
+		}
+		v.validateObject(schema, object, path)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			v.fail(path, "must be an array")
+			return
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				v.validate(items, item, fmt.Sprintf("%s/%d", path, i))
+			}
+		}
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			v.fail(path, "must be a string")
+			return
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !regexp.MustCompile(pattern).MatchString(text) {
+			v.fail(path, "must match %s", pattern)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			v.fail(path, "must be true or false")
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			v.fail(path, "must be an integer")
+			return
+		}
+		if minimum, ok := schema["minimum"].(int); ok && number < float64(minimum) {
+			v.fail(path, "must be at least %d", minimum)
+		}
+	}
+}
+
+func (v *schemaValidator) validateObject(schema, object map[string]interface{}, path string) {
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, ok := object[name.(string)]; !ok {
+				v.fail(pointer(path, name.(string)), "is required")
+			}
+		}
+	}
+	properties, _ := schema["properties"].(map[string]interface{})
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if property, ok := properties[name].(map[string]interface{}); ok {
+			v.validate(property, object[name], pointer(path, name))
+			continue
+		}
+		switch additional := schema["additionalProperties"].(type) {
+		case bool:
+			if !additional {
+				v.fail(pointer(path, name), "is not a known property")
+			}
+		case map[string]interface{}:
+			v.validate(additional, object[name], pointer(path, name))
+		}
+	}
+}
+
+// The JSON Pointer to the member name of the object at path
+func pointer(path, name string) string {
+	return path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
+
+// Reads the metadata file at path as the service would, decoded by format (see
+// configformat.ByName) and with the overlay of profile merged in when there is one.
+// Encrypted values are left as they are.
+func LoadMetadataFile(path, format, profile string) (map[string]interface{}, error) {
+	if err := validProfile(profile); err != nil {
+		return nil, err
+	}
+	decode, err := configformat.ByName(format, path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if profile == "" {
+		return metadata, nil
+	}
+	overlayPath := profilePath(path, profile)
+	content, err = os.ReadFile(overlayPath)
+	if os.IsNotExist(err) {
+		return metadata, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	overlay, err := decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", overlayPath, err)
+	}
+	mergeMetadata(metadata, overlay)
+	return metadata, nil
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go_app/telemetry"
+)
+
+// Serves the expvar metrics in the Prometheus text format. A top-level map becomes a
+// metric with a "key" label, and one more level of nesting adds a "field" label, e.g.
+// worker_pools{key="default",field="busy"} 0. Strings and arrays are left out.
+//
+// Go runtime and process metrics and build_info follow, see writeRuntimeMetrics, then
+// with the prometheus metrics backend the telemetry registry. Scrapers that
+// accept OpenMetrics get that format instead, which carries the histogram exemplars.
+func (a *App) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+	contentType, untyped := telemetry.PROMETHEUS_CONTENT_TYPE, "untyped"
+	if openMetrics {
+		contentType, untyped = telemetry.OPENMETRICS_CONTENT_TYPE, "unknown"
+	}
+	w.Header().Set("Content-Type", contentType)
+	expvar.Do(func(kv expvar.KeyValue) {
+		var value interface{}
+		if err := json.Unmarshal([]byte(kv.Value.String()), &value); err != nil {
+			return
+		}
+		name := metricName(kv.Key)
+		var samples []string
+		collectSamples(&samples, name, nil, value)
+		if len(samples) == 0 {
+			return
+		}
+		sort.Strings(samples)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, untyped)
+		io.WriteString(w, strings.Join(samples, ""))
+	})
+	a.writeRuntimeMetrics(r.Context(), w, openMetrics)
+	if backends, _ := parseMetricsBackends(a.Config.Telemetry.Backends); backends[METRICS_BACKEND_PROMETHEUS] {
+		telemetry.WritePrometheus(w, telemetry.Default.Snapshot(), openMetrics)
+	}
+	if openMetrics {
+		io.WriteString(w, "# EOF\n")
+	}
+}
+
+// Walks value, path holding the map keys leading to it
+func collectSamples(samples *[]string, name string, path []string, value interface{}) {
+	switch value := value.(type) {
+	case float64:
+		sample := name
+		switch {
+		case len(path) == 1:
+			sample += "{" + metricLabel("key", path[0]) + "}"
+		case len(path) > 1:
+			// Deeper levels extend the field label, e.g. field="BySize.Size"
+			sample += "{" + metricLabel("key", path[0]) + "," + metricLabel("field", strings.Join(path[1:], ".")) + "}"
+		}
+		*samples = append(*samples, sample+" "+strconv.FormatFloat(value, 'g', -1, 64)+"\n")
+	case bool:
+		if value {
+			collectSamples(samples, name, path, 1.0)
+		} else {
+			collectSamples(samples, name, path, 0.0)
+		}
+	case map[string]interface{}:
+		for key, nested := range value {
+			collectSamples(samples, name, append(path[:len(path):len(path)], key), nested)
+		}
+	}
+}
+
+// Replaces characters Prometheus does not allow in metric names
+func metricName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func metricLabel(name, value string) string {
+	return name + "=" + strconv.Quote(value)
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/ocsp"
+)
+
+// How client certificates are requested during the TLS handshake
+const (
+	CLIENT_AUTH_NONE     = "none"
+	CLIENT_AUTH_OPTIONAL = "optional"
+	CLIENT_AUTH_REQUIRE  = "require"
+)
+
+// Timeout for a single OCSP responder request
+const OCSP_TIMEOUT = 5 * time.Second
+
+// TLS and client certificate settings; TLS is enabled when CertFile is set
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	ClientAuth   string
+	ClientCRL    string
+	ClientOCSP   bool
+}
+
+// Cached OCSP answer for a certificate serial number
+type ocspResult struct {
+	err        error
+	nextUpdate time.Time
+}
+
+// Checks verified client certificates against a CRL and OCSP responders
+type revocationChecker struct {
+	crl        *x509.RevocationList
+	ocsp       bool
+	clock      Clock
+	httpClient *http.Client
+
+	mutex sync.Mutex
+	cache map[string]ocspResult
+}
+
+// Builds the server TLS config, or returns nil when TLS is not configured
+func (a *App) TLSConfig() (*tls.Config, error) {
+	config := a.Config.TLS
+	if config.CertFile == "" {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	switch config.ClientAuth {
+	case "", CLIENT_AUTH_NONE:
+		return tlsConfig, nil
+	case CLIENT_AUTH_OPTIONAL:
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	case CLIENT_AUTH_REQUIRE:
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth mode %q", config.ClientAuth)
+	}
+
+	caBundle, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("load client CA bundle: %w", err)
+	}
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	if !tlsConfig.ClientCAs.AppendCertsFromPEM(caBundle) {
+		return nil, errors.New("client CA bundle contains no certificates")
+	}
+
+	checker := &revocationChecker{
+		ocsp:       config.ClientOCSP,
+		clock:      a.Clock,
+		httpClient: &http.Client{Timeout: OCSP_TIMEOUT},
+		cache:      make(map[string]ocspResult),
+	}
+	if config.ClientCRL != "" {
+		if checker.crl, err = loadCRL(config.ClientCRL); err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig.VerifyConnection = checker.verifyConnection
+
+	return tlsConfig, nil
+}
+
+func loadCRL(path string) (*x509.RevocationList, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("load client CRL: %w", err)
+	}
+	if block, _ := pem.Decode(content); block != nil {
+		content = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(content)
+	if err != nil {
+		return nil, fmt.Errorf("parse client CRL: %w", err)
+	}
+	return crl, nil
+}
+
+func (c *revocationChecker) verifyConnection(state tls.ConnectionState) error {
+	if len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	chain := state.VerifiedChains[0]
+	leaf := chain[0]
+
+	if c.crl != nil {
+		for _, revoked := range c.crl.RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+				return fmt.Errorf("client certificate %s is revoked", leaf.SerialNumber)
+			}
+		}
+	}
+
+	if c.ocsp && len(chain) > 1 && len(leaf.OCSPServer) > 0 {
+		return c.checkOCSP(leaf, chain[1])
+	}
+	return nil
+}
+
+// Asks the certificate's OCSP responder for its status. Unreachable responders are
+// tolerated (soft-fail) so an OCSP outage does not lock every client out.
+func (c *revocationChecker) checkOCSP(leaf, issuer *x509.Certificate) error {
+	serial := leaf.SerialNumber.String()
+	now := c.clock.Now()
+
+	c.mutex.Lock()
+	cached, ok := c.cache[serial]
+	c.mutex.Unlock()
+	if ok && now.Before(cached.nextUpdate) {
+		return cached.err
+	}
+
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil
+	}
+	resp, err := c.httpClient.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil
+	}
+	answer, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return nil
+	}
+
+	result := ocspResult{nextUpdate: answer.NextUpdate}
+	if answer.Status == ocsp.Revoked {
+		result.err = fmt.Errorf("client certificate %s is revoked", serial)
+	}
+	if result.nextUpdate.IsZero() {
+		result.nextUpdate = now.Add(time.Hour)
+	}
+
+	c.mutex.Lock()
+	c.cache[serial] = result
+	c.mutex.Unlock()
+	return result.err
+}
+
+// Builds the request principal from a verified client certificate
+func newUserFromCertificate(cert *x509.Certificate) *User {
+	return &User{
+		ID:         cert.Subject.CommonName,
+		Username:   cert.Subject.CommonName,
+		AuthMethod: AUTH_METHOD_MTLS,
+		Claims: jwt.MapClaims{
+			"sub":     cert.Subject.CommonName,
+			"subject": cert.Subject.String(),
+			"serial":  cert.SerialNumber.String(),
+		},
+	}
+}
+
+// Returns the principal of a verified client certificate on r, if any
+func certificateUser(r *http.Request) (*User, bool) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, false
+	}
+	return newUserFromCertificate(r.TLS.VerifiedChains[0][0]), true
+}
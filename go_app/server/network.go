@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Requests refused by the allow/deny lists, published on /debug/vars
+var ipFilterMetrics = expvar.NewMap("ip_filter")
+
+// Client address filtering and the proxies trusted to report client addresses
+type NetworkConfig struct {
+	TrustedProxies string // CIDRs whose X-Forwarded-For / X-Real-IP headers are believed
+	Allow          string // CIDRs allowed to connect; everyone when empty
+	Deny           string // CIDRs refused even when allowed
+}
+
+// Parsed NetworkConfig
+type NetworkPolicy struct {
+	TrustedProxies []netip.Prefix
+	Allow          []netip.Prefix
+	Deny           []netip.Prefix
+}
+
+// Parses the CIDR lists. Invalid entries are reported and left out of the policy.
+func NewNetworkPolicy(config NetworkConfig) (*NetworkPolicy, error) {
+	var errs []error
+	parse := func(key, value string) []netip.Prefix {
+		prefixes, err := parsePrefixes(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+		}
+		return prefixes
+	}
+	policy := &NetworkPolicy{
+		TrustedProxies: parse("trusted-proxies", config.TrustedProxies),
+		Allow:          parse("ip-allow", config.Allow),
+		Deny:           parse("ip-deny", config.Deny),
+	}
+	return policy, errors.Join(errs...)
+}
+
+// Comma separated CIDRs; a bare address stands for itself
+func parsePrefixes(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	var errs []error
+	for _, item := range configList(value) {
+		if !strings.Contains(item, "/") {
+			addr, err := netip.ParseAddr(item)
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(item)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, errors.Join(errs...)
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Works out the real client: the connection's peer, unless that is a trusted proxy.
+// Then X-Forwarded-For is walked from the right, skipping further trusted proxies,
+// since only the entries appended by our own proxies can be believed. X-Real-IP is
+// used when a trusted proxy sends no X-Forwarded-For.
+func (p *NetworkPolicy) ClientAddr(r *http.Request) (netip.Addr, bool) {
+	peer, ok := remoteAddr(r)
+	if !ok || !containsAddr(p.TrustedProxies, peer) {
+		return peer, ok
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	client := peer
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(forwarded[i])
+		if hop == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			// A garbled hop ends the chain; the last good address is the best we know
+			return client, true
+		}
+		client = addr.Unmap()
+		if !containsAddr(p.TrustedProxies, client) {
+			return client, true
+		}
+	}
+	if client == peer {
+		if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return client, true
+}
+
+// Reports whether the lists let addr in
+func (p *NetworkPolicy) Allowed(addr netip.Addr) bool {
+	if containsAddr(p.Deny, addr) {
+		return false
+	}
+	return len(p.Allow) == 0 || containsAddr(p.Allow, addr)
+}
+
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+type clientIPContextKey struct{}
+
+// Resolves the client address once for every later clientIP call, so rate limits, the
+// login guard and audit logs see the real client, and refuses clients the lists block.
+// Unix socket connections have no address and pass unfiltered.
+func (a *App) filterClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := a.Network.ClientAddr(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !a.Network.Allowed(addr) {
+			ipFilterMetrics.Add("denied", 1)
+			a.Logger.Printf("audit: event=ip_denied ip=%s path=%s", addr, r.URL.Path)
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Client address not allowed")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPContextKey{}, addr.String())))
+	})
+}
+
+// The client IP resolved by filterClients, or the connection's remote address
+func clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
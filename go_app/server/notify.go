@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"go_app/eventbus"
+	"go_app/i18n"
+	"go_app/notifier"
+)
+
+// Security event notification settings; nothing is sent unless a webhook URL or an
+// SMTP relay is configured
+type NotifyConfig struct {
+	Triggers        string
+	Interval        time.Duration
+	WebhookURL      string
+	WebhookTemplate string
+	SMTPAddr        string
+	SMTPFrom        string
+	SMTPTo          string
+	SMTPUsername    string
+	SMTPPassword    string
+	EmailTemplate   string
+	EmailTemplates  string // directory overriding the embedded email templates
+	EmailLocale     string
+}
+
+// Builds the notifier and its backends, or returns nil when no backend is configured
+func newNotifier(config NotifyConfig, logger *log.Logger) (*notifier.Notifier, error) {
+	var backends []notifier.Backend
+	if config.WebhookURL != "" {
+		webhook, err := notifier.NewWebhook(config.WebhookURL, config.WebhookTemplate)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, webhook)
+	}
+	if config.SMTPAddr != "" {
+		templates, err := notifier.LoadTemplates(config.EmailTemplates, i18n.DEFAULT_LOCALE)
+		if err != nil {
+			return nil, err
+		}
+		mail, err := notifier.NewSMTP(config.SMTPAddr, config.SMTPFrom, config.SMTPTo, config.SMTPUsername, config.SMTPPassword,
+			config.EmailTemplate, templates, i18n.ParseAcceptLanguage(config.EmailLocale))
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, mail)
+	}
+	if len(backends) == 0 {
+		return nil, nil
+	}
+	return notifier.New(config.Triggers, config.Interval, logger, backends...), nil
+}
+
+// Turns a handler panic into a 500, logging the stack and publishing a PanicEvent
+func (a *App) recoverPanics(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// Deliberate aborts are how handlers drop a connection, let net/http handle them
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+
+			a.Logger.Printf("Panic serving %s: %v\n%s", route, recovered, debug.Stack())
+			eventbus.Publish(a.Events, TopicPanic, PanicEvent{
+				Route: route,
+				Path:  r.URL.Path,
+				Value: fmt.Sprint(recovered),
+				Time:  a.clock(r.Context()).Now(),
+			})
+			// A 500 can't follow a response under way; cutting the connection at least
+			// keeps the client from taking the truncated body for a complete one
+			if responseStarted(w) {
+				panic(http.ErrAbortHandler)
+			}
+			a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		}()
+		next(w, r)
+	}
+}
+
+// Forwards bus events enabled as notification triggers to the notifier
+func (a *App) subscribeNotifications() {
+	eventbus.Subscribe(a.Events, TopicLockout, 0, func(event LockoutEvent) {
+		a.Notifier.Notify(notifier.Event{
+			Kind:    notifier.EVENT_AUTH_FAILURES,
+			Message: fmt.Sprintf("Login locked out for %s after %d failed attempts", event.Key, event.Failures),
+			Time:    a.Clock.Now(),
+			Fields: map[string]string{
+				"key":      event.Key,
+				"failures": fmt.Sprint(event.Failures),
+				"until":    event.Until.Format(time.RFC3339),
+			},
+		})
+	})
+	eventbus.Subscribe(a.Events, TopicKeyRotated, 0, func(event KeyRotatedEvent) {
+		a.Notifier.Notify(notifier.Event{
+			Kind:    notifier.EVENT_KEY_ROTATION,
+			Message: "Token signing key rotated",
+			Time:    event.Time,
+		})
+	})
+	eventbus.Subscribe(a.Events, TopicReadiness, 0, func(event ReadinessEvent) {
+		message := "Service is ready again"
+		if !event.Ready {
+			message = "Service is not ready: " + event.Reason
+		}
+		a.Notifier.Notify(notifier.Event{
+			Kind:    notifier.EVENT_READINESS_FLAP,
+			Message: message,
+			Time:    event.Time,
+			Fields:  map[string]string{"ready": fmt.Sprint(event.Ready)},
+		})
+	})
+	eventbus.Subscribe(a.Events, TopicPanic, 0, func(event PanicEvent) {
+		a.Notifier.Notify(notifier.Event{
+			Kind:    notifier.EVENT_PANIC,
+			Message: fmt.Sprintf("Panic serving %s: %s", event.Route, event.Value),
+			Time:    event.Time,
+			Fields:  map[string]string{"route": event.Route, "path": event.Path},
+		})
+	})
+	eventbus.Subscribe(a.Events, TopicSLOBurn, 0, func(event SLOBurnEvent) {
+		message := fmt.Sprintf("%s is burning its error budget %.1fx too fast over %s (%s alert)", event.Route, event.BurnRate, event.Window, event.Alert)
+		if !event.Firing {
+			message = fmt.Sprintf("%s is back within its error budget (%s alert)", event.Route, event.Alert)
+		}
+		a.Notifier.Notify(notifier.Event{
+			Kind:    notifier.EVENT_SLO_BURN,
+			Message: message,
+			Time:    event.Time,
+			Fields: map[string]string{
+				"route":     event.Route,
+				"alert":     event.Alert,
+				"firing":    fmt.Sprint(event.Firing),
+				"burnRate":  strconv.FormatFloat(event.BurnRate, 'f', 2, 64),
+				"objective": fmt.Sprint(event.Objective),
+			},
+		})
+	})
+}
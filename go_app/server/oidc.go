@@ -0,0 +1,125 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"go_app/jwks"
+)
+
+// Name the oidc strategy is registered under
+const STRATEGY_OIDC = "oidc"
+
+// Signing algorithms accepted from the issuer
+var oidcAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// Bearer tokens of an external OpenID Connect provider, verified with the keys it
+// publishes
+type OIDCConfig struct {
+	Issuer   string // the "iss" of its tokens; the oidc strategy is off when empty
+	JWKSURL  string // its jwks_uri
+	Audience string // required in "aud" when set
+	MaxStale time.Duration
+}
+
+func (c OIDCConfig) validate() error {
+	if c.Issuer != "" && c.JWKSURL == "" {
+		return errors.New("oidc-issuer needs oidc-jwks-url")
+	}
+	return nil
+}
+
+type oidcStrategy struct {
+	app    *App
+	config OIDCConfig
+	keys   *jwks.Client
+	parser *jwt.Parser
+}
+
+func newOIDCStrategy(a *App) oidcStrategy {
+	return oidcStrategy{
+		app:    a,
+		config: a.Config.OIDC,
+		keys: jwks.New(jwks.Options{
+			URL:        a.Config.OIDC.JWKSURL,
+			Name:       "oidc",
+			HTTPClient: a.HTTPClient,
+			MaxStale:   a.Config.OIDC.MaxStale,
+			Logger:     a.Logger,
+			Now:        a.Clock.Now,
+		}),
+		parser: jwt.NewParser(jwt.WithoutClaimsValidation(), jwt.WithValidMethods(oidcAlgorithms)),
+	}
+}
+
+func (oidcStrategy) Name() string { return STRATEGY_OIDC }
+
+// Tokens of another issuer, including the service's own, count as missing credentials
+// so a later strategy can try them: list oidc before jwt.
+func (s oidcStrategy) Authenticate(r *http.Request) (*User, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, missingCredentials("Unauthorized: Missing token")
+	}
+	unverified := jwt.MapClaims{}
+	if _, _, err := s.parser.ParseUnverified(token, unverified); err != nil || !unverified.VerifyIssuer(s.config.Issuer, true) {
+		return nil, missingCredentials("Unauthorized: Missing token")
+	}
+
+	claims := jwt.MapClaims{}
+	_, err := s.parser.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := s.keys.Key(r.Context(), kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Algorithm != "" && key.Algorithm != token.Method.Alg() {
+			return nil, fmt.Errorf("key %s is for %s, not %s", kid, key.Algorithm, token.Method.Alg())
+		}
+		switch key.Public.(type) {
+		case *rsa.PublicKey:
+			if !strings.HasPrefix(token.Method.Alg(), "RS") && !strings.HasPrefix(token.Method.Alg(), "PS") {
+				return nil, fmt.Errorf("key %s is an RSA key", kid)
+			}
+		case *ecdsa.PublicKey:
+			if !strings.HasPrefix(token.Method.Alg(), "ES") {
+				return nil, fmt.Errorf("key %s is an EC key", kid)
+			}
+		}
+		return key.Public, nil
+	})
+	if errors.Is(err, jwks.ErrStale) || errors.Is(err, jwks.ErrUnavailable) {
+		s.app.Logger.Println("OIDC token verification failed:", err)
+		return nil, &AuthError{Status: http.StatusServiceUnavailable, Message: "Service Unavailable"}
+	}
+	if err != nil {
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Invalid token"}
+	}
+
+	now := s.app.Clock.Now().Unix()
+	if !claims.VerifyNotBefore(now, false) || !claims.VerifyIssuedAt(now, false) {
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Invalid token"}
+	}
+	if s.config.Audience != "" && !claims.VerifyAudience(s.config.Audience, true) {
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Invalid token"}
+	}
+	if !claims.VerifyExpiresAt(now, true) {
+		return nil, &AuthError{Status: http.StatusUnauthorized, Message: "Unauthorized: Token expired"}
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, &AuthError{Status: http.StatusForbidden, Message: "Forbidden: Invalid token"}
+	}
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username = subject
+	}
+	return &User{ID: subject, Username: username, Claims: claims}, nil
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Version of the OpenAPI specification /openapi.json follows
+const OPENAPI_VERSION = "3.1.0"
+
+// Security scheme names in the OpenAPI document, by auth strategy
+var openAPISchemes = map[string]string{
+	STRATEGY_JWT:    "bearerAuth",
+	STRATEGY_MTLS:   "mutualTLS",
+	STRATEGY_APIKEY: "apiKey",
+	STRATEGY_HMAC:   "requestSignature",
+	STRATEGY_BASIC:  "basicAuth",
+	STRATEGY_OIDC:   "oidcBearer",
+}
+
+// The scheme of AUTH_ADMIN routes
+const OPENAPI_ADMIN_SCHEME = "adminToken"
+
+var openAPISecuritySchemes = map[string]interface{}{
+	"bearerAuth":         map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+	"mutualTLS":          map[string]string{"type": "mutualTLS"},
+	"apiKey":             map[string]string{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+	"requestSignature":   map[string]string{"type": "apiKey", "in": "header", "name": "X-Auth-Signature", "description": "HMAC-SHA256 with X-Auth-Client and X-Auth-Timestamp"},
+	"basicAuth":          map[string]string{"type": "http", "scheme": "basic"},
+	"oidcBearer":         map[string]string{"type": "http", "scheme": "bearer", "bearerFormat": "JWT", "description": "Token of the oidc-issuer"},
+	OPENAPI_ADMIN_SCHEME: map[string]string{"type": "apiKey", "in": "header", "name": "X-Admin-Token"},
+}
+
+// Wildcards of ServeMux patterns: {id}, {path...} and {$}
+var patternWildcard = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Serves the route table as an OpenAPI document. Security requirements come from the
+// same Auth, Roles, Scopes, Claims and TwoFactor fields the middleware is built from,
+// with the auth of the "routes" metadata settings in effect, so the document can't
+// promise other checks than the ones made.
+func (a *App) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	info := a.BuildInfo(r.Context())
+	version := info.Version
+	if version == "" {
+		version = "0.0.0"
+	}
+	paths := map[string]map[string]interface{}{}
+	for _, route := range a.Routes() {
+		path, parameters := openAPIPath(route.Path)
+		method := strings.ToLower(route.Method)
+		if method == "" {
+			method = "get"
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		operation := a.openAPIOperation(route)
+		if len(parameters) > 0 {
+			operation["parameters"] = parameters
+		}
+		paths[path][method] = operation
+	}
+	document := map[string]interface{}{
+		"openapi": OPENAPI_VERSION,
+		"info":    map[string]string{"title": info.Service, "version": version},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"securitySchemes": openAPISecuritySchemes,
+			"schemas": map[string]interface{}{
+				"Error": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"error", "code"},
+					"properties": map[string]interface{}{
+						"error":     map[string]string{"type": "string"},
+						"code":      map[string]string{"type": "string"},
+						"retryable": map[string]string{"type": "boolean"},
+					},
+				},
+			},
+		},
+	}
+	// Encoded as is: json-naming must not rename OpenAPI's own keys
+	data, err := json.Marshal(document)
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	a.writeJSON(w, r, http.StatusOK, json.RawMessage(data))
+}
+
+// The OpenAPI path of a ServeMux path and its path parameters
+func openAPIPath(pattern string) (string, []map[string]interface{}) {
+	var parameters []map[string]interface{}
+	path := patternWildcard.ReplaceAllStringFunc(pattern, func(wildcard string) string {
+		name := strings.TrimSuffix(strings.Trim(wildcard, "{}"), "...")
+		if name == "$" {
+			return ""
+		}
+		parameters = append(parameters, map[string]interface{}{
+			"name": name, "in": "path", "required": true, "schema": map[string]string{"type": "string"},
+		})
+		return "{" + name + "}"
+	})
+	return path, parameters
+}
+
+func (a *App) openAPIOperation(route Route) map[string]interface{} {
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content": map[string]interface{}{
+			MEDIA_TYPE_JSON: map[string]interface{}{"schema": map[string]string{"$ref": "#/components/schemas/Error"}},
+		},
+	}
+	security := a.openAPISecurity(route)
+	operation := map[string]interface{}{
+		"operationId": route.Pattern(),
+		"security":    security,
+		"responses":   map[string]interface{}{"default": errorResponse},
+	}
+	if route.Summary != "" {
+		operation["summary"] = route.Summary
+	}
+	if route.Method == "" {
+		operation["x-any-method"] = true
+	}
+	if len(security) > 0 {
+		responses := operation["responses"].(map[string]interface{})
+		responses["401"] = map[string]string{"description": "Missing or invalid credentials"}
+		if len(route.Roles) > 0 || len(route.Scopes) > 0 || len(route.Claims) > 0 || route.TwoFactor || route.Auth == AUTH_ADMIN {
+			responses["403"] = map[string]string{"description": "Credentials lack a required role, scope, claim or second factor"}
+		}
+	}
+	if len(route.Roles) > 0 {
+		operation["x-roles"] = route.Roles
+	}
+	if len(route.Claims) > 0 {
+		operation["x-required-claims"] = route.Claims
+	}
+	if route.TwoFactor {
+		operation["x-two-factor"] = true
+	}
+	if route.SingleUse {
+		operation["x-single-use"] = true
+	}
+	if route.Listener != LISTENER_PUBLIC {
+		operation["x-listener"] = route.Listener
+	}
+	if route.SLO != nil {
+		slo := map[string]interface{}{"objective": route.SLO.Objective}
+		if route.SLO.Latency > 0 {
+			slo["latency"] = route.SLO.Latency.String()
+		}
+		operation["x-slo"] = slo
+	}
+	switch route.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		consumes := route.Consumes
+		if len(consumes) == 0 {
+			consumes = []string{MEDIA_TYPE_JSON}
+		}
+		content := map[string]interface{}{}
+		for _, mediaType := range consumes {
+			content[mediaType] = map[string]interface{}{}
+		}
+		operation["requestBody"] = map[string]interface{}{"content": content}
+	}
+	return operation
+}
+
+// The security requirements of route: alternatives, any one of which is enough. Scopes
+// are listed with every alternative, as they are checked whichever strategy
+// authenticated the caller. Empty for public routes.
+func (a *App) openAPISecurity(route Route) []map[string][]string {
+	mode := route.Auth
+	if settings, ok := a.routeSettingsFor(route.Pattern()); ok && settings.Auth != "" {
+		mode = settings.Auth
+	}
+	var strategies []string
+	switch mode {
+	case AUTH_PUBLIC:
+		return []map[string][]string{}
+	case AUTH_ADMIN:
+		return []map[string][]string{{OPENAPI_ADMIN_SCHEME: {}}}
+	case AUTH_JWT:
+		strategies = []string{STRATEGY_JWT}
+	case AUTH_MTLS:
+		strategies = []string{STRATEGY_MTLS}
+	case AUTH_CERT_OR_JWT:
+		strategies = []string{STRATEGY_MTLS, STRATEGY_JWT}
+	case AUTH_DEFAULT:
+		if matchesAnyRoute(parsePublicRoutes(a.Config.PublicRoutes), route.Path) {
+			return []map[string][]string{}
+		}
+		strategies = parseStrategies(a.Config.Auth.Strategies)
+	default:
+		strategies = parseStrategies(mode)
+	}
+	scopes := slices.Clone(route.Scopes)
+	if scopes == nil {
+		scopes = []string{}
+	}
+	requirements := []map[string][]string{}
+	for _, strategy := range strategies {
+		if scheme, ok := openAPISchemes[strategy]; ok {
+			requirements = append(requirements, map[string][]string{scheme: scopes})
+		}
+	}
+	return requirements
+}
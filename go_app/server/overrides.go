@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+)
+
+// Dependencies swapped in for a single request, e.g. by a test recording or replaying
+// a handler against a fixed clock and canned stores, or by canary middleware trying
+// a new store on a share of requests, without touching the App other requests use.
+// Nil fields, and nil stores of Stores, keep the App's.
+type Overrides struct {
+	Clock  Clock
+	Keys   KeyProvider
+	Stores Stores
+}
+
+type overridesKey struct{}
+
+// Returns ctx with overrides applied on top of any it already carries. Handlers get
+// the dependencies through App.clock, App.keys and App.stores, which honor them.
+func WithOverrides(ctx context.Context, overrides Overrides) context.Context {
+	if outer, ok := ctx.Value(overridesKey{}).(Overrides); ok {
+		overrides = outer.merge(overrides)
+	}
+	return context.WithValue(ctx, overridesKey{}, overrides)
+}
+
+// The overrides ctx carries, if any
+func OverridesFromContext(ctx context.Context) (Overrides, bool) {
+	overrides, ok := ctx.Value(overridesKey{}).(Overrides)
+	return overrides, ok
+}
+
+// o with the non-nil dependencies of inner replacing its own
+func (o Overrides) merge(inner Overrides) Overrides {
+	if inner.Clock != nil {
+		o.Clock = inner.Clock
+	}
+	if inner.Keys != nil {
+		o.Keys = inner.Keys
+	}
+	o.Stores = mergeStores(o.Stores, inner.Stores)
+	return o
+}
+
+// base with every non-nil store of top replacing its own
+func mergeStores(base, top Stores) Stores {
+	merged := reflect.ValueOf(&base).Elem()
+	overrides := reflect.ValueOf(top)
+	for i := range overrides.NumField() {
+		if field := overrides.Field(i); !field.IsNil() {
+			merged.Field(i).Set(field)
+		}
+	}
+	return base
+}
+
+// Applies the overrides choose returns for a request, e.g. canary middleware handing a
+// share of requests a new store, or a test harness wrapping App.Handler. Requests for
+// which choose reports false are served with the App's own dependencies.
+func OverrideRequests(next http.Handler, choose func(r *http.Request) (Overrides, bool)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if overrides, ok := choose(r); ok {
+			r = r.WithContext(WithOverrides(r.Context(), overrides))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The clock of the request ctx belongs to
+func (a *App) clock(ctx context.Context) Clock {
+	if overrides, ok := OverridesFromContext(ctx); ok && overrides.Clock != nil {
+		return overrides.Clock
+	}
+	return a.Clock
+}
+
+// The key provider of the request ctx belongs to
+func (a *App) keys(ctx context.Context) KeyProvider {
+	if overrides, ok := OverridesFromContext(ctx); ok && overrides.Keys != nil {
+		return overrides.Keys
+	}
+	return a.Keys
+}
+
+// The stores of the request ctx belongs to
+func (a *App) stores(ctx context.Context) Stores {
+	if overrides, ok := OverridesFromContext(ctx); ok {
+		return mergeStores(a.Stores, overrides.Stores)
+	}
+	return a.Stores
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go_app/configformat"
+	"go_app/policy"
+)
+
+// Policy decisions per rule and outcome, published on /debug/vars
+var policyMetrics = expvar.NewMap("policy_decisions")
+
+// Rule route matching every route
+const POLICY_ALL_ROUTES = "*"
+
+// Declarative access rules, checked after authentication and before the route's roles
+// and scopes
+type PolicyConfig struct {
+	File     string // rules document, JSON, YAML, TOML or HCL by extension; none when empty
+	DryRun   bool   // log denials without enforcing any rule
+	Timezone string // zone of the time variables, e.g. Europe/Berlin
+}
+
+// A rule in the policy file. Every rule matching a route must allow the request.
+type PolicyRule struct {
+	Name   string `json:"name"`
+	Route  string `json:"route"`  // route pattern as in the route table, e.g. "GET /files/{id}", or *
+	Allow  string `json:"allow"`  // CEL expression that must be true
+	DryRun bool   `json:"dryRun"` // log denials without enforcing this rule
+
+	program *policy.Program
+}
+
+// Reads and compiles the rules in path
+func loadPolicies(path string) ([]PolicyRule, error) {
+	decode, err := configformat.ByName(configformat.AUTO, path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("policy file: %w", err)
+	}
+	document, err := decode(content)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	// Through JSON, so every format fills the same struct tags
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	var file struct {
+		Rules []PolicyRule `json:"rules"`
+	}
+	if err := json.Unmarshal(encoded, &file); err != nil {
+		return nil, fmt.Errorf("policy file %s: %w", path, err)
+	}
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule%d", i+1)
+		}
+		if rule.Route == "" || rule.Allow == "" {
+			return nil, fmt.Errorf("policy %s needs a route and an allow expression", rule.Name)
+		}
+		if rule.program, err = policy.Compile(rule.Allow); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", rule.Name, err)
+		}
+	}
+	return file.Rules, nil
+}
+
+// Checks the request against the policy rules for route. A rule that doesn't
+// evaluate to true denies it, errors included, so a typo fails closed.
+func (a *App) enforcePolicy(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var vars map[string]interface{}
+		for _, rule := range a.policies {
+			if rule.Route != POLICY_ALL_ROUTES && rule.Route != route {
+				continue
+			}
+			if vars == nil {
+				vars = a.policyVariables(r, route)
+			}
+			allowed, err := rule.program.Allow(vars)
+			if allowed {
+				policyMetrics.Add(rule.Name+".allowed", 1)
+				a.Log.Debug("policy allowed", "rule", rule.Name, "route", route, "user", policyUser(r))
+				continue
+			}
+			attrs := []any{"rule", rule.Name, "route", route, "user", policyUser(r), "ip", clientIP(r)}
+			if err != nil {
+				policyMetrics.Add(rule.Name+".errors", 1)
+				attrs = append(attrs, "error", err)
+			}
+			if rule.DryRun || a.Config.Policy.DryRun {
+				policyMetrics.Add(rule.Name+".would_deny", 1)
+				a.Log.Info("policy would deny", append(attrs, "dry_run", true)...)
+				continue
+			}
+			policyMetrics.Add(rule.Name+".denied", 1)
+			a.Log.Info("policy denied", append(attrs, "dry_run", false)...)
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Denied by policy")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func policyUser(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok {
+		return user.ID
+	}
+	return ""
+}
+
+// What an expression can refer to: claims, user, request and time
+func (a *App) policyVariables(r *http.Request, route string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	account := map[string]interface{}{"authenticated": false, "roles": []interface{}{}, "scopes": []interface{}{}}
+	if user, ok := UserFromContext(r.Context()); ok {
+		for name, value := range user.Claims {
+			claims[name] = policyValue(value)
+		}
+		roles, _ := claims["roles"].([]interface{})
+		if roles == nil {
+			roles = []interface{}{}
+		}
+		scopes := []interface{}{}
+		for _, scope := range user.Scopes() {
+			scopes = append(scopes, scope)
+		}
+		tenant, _ := user.Claims[TENANT_CLAIM].(string)
+		account = map[string]interface{}{
+			"authenticated": true,
+			"id":            user.ID,
+			"username":      user.Username,
+			"method":        user.AuthMethod,
+			"roles":         roles,
+			"scopes":        scopes,
+			"tenant":        tenant,
+		}
+	}
+
+	headers := map[string]interface{}{}
+	for name, values := range r.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ", ")
+	}
+	params := map[string]interface{}{}
+	for name, values := range r.URL.Query() {
+		params[name] = values[0]
+	}
+
+	now := a.clock(r.Context()).Now().In(a.policyLocation)
+	return map[string]interface{}{
+		"claims": claims,
+		"user":   account,
+		"request": map[string]interface{}{
+			"method":  r.Method,
+			"path":    r.URL.Path,
+			"route":   route,
+			"ip":      clientIP(r),
+			"headers": headers,
+			"query":   params,
+		},
+		"time": map[string]interface{}{
+			"hour":    int64(now.Hour()),
+			"minute":  int64(now.Minute()),
+			"weekday": now.Weekday().String(),
+			"date":    now.Format(time.DateOnly),
+			"unix":    now.Unix(),
+		},
+	}
+}
+
+// Converts a claim to the values expressions work on
+func policyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case float64:
+		if value == float64(int64(value)) {
+			return int64(value)
+		}
+		return value
+	case int:
+		return int64(value)
+	case []string:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = item
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = policyValue(item)
+		}
+		return list
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			m[key] = policyValue(item)
+		}
+		return m
+	}
+	return value
+}
+
+// Loads policy-file and policy-timezone. Rules for routes outside the route table are
+// only warned about, they may belong to a route group mounted later.
+func (a *App) loadPolicyConfig() error {
+	location, err := time.LoadLocation(a.Config.Policy.Timezone)
+	if err != nil {
+		return fmt.Errorf("policy timezone: %w", err)
+	}
+	a.policyLocation = location
+	if a.Config.Policy.File == "" {
+		return nil
+	}
+	rules, err := loadPolicies(a.Config.Policy.File)
+	if err != nil {
+		return err
+	}
+	patterns := []string{POLICY_ALL_ROUTES}
+	for _, route := range a.Routes() {
+		patterns = append(patterns, route.Pattern())
+	}
+	for _, rule := range rules {
+		if !contains(patterns, rule.Route) {
+			a.Logger.Printf("Policy %s: no static route %s", rule.Name, rule.Route)
+		}
+	}
+	a.policies = rules
+	return nil
+}
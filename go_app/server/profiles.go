@@ -0,0 +1,72 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"go_app/configformat"
+	"go_app/configsource"
+)
+
+// Names accepted for env, e.g. dev, staging or prod
+var profilePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+func validProfile(profile string) error {
+	if profile != "" && !profilePattern.MatchString(profile) {
+		return fmt.Errorf("env %q is not a profile name: lowercase letters, digits, - and _", profile)
+	}
+	return nil
+}
+
+// The overlay of a metadata file for profile: metadata.staging.json for metadata.json
+func profilePath(path, profile string) string {
+	extension := filepath.Ext(path)
+	return strings.TrimSuffix(path, extension) + "." + profile + extension
+}
+
+// Merges the profile's overlay file into metadata, when env is set and the metadata
+// comes from a file. The overlay is optional, so a profile only needs one for the
+// values it changes; it is decoded like the base document.
+func (a *App) applyProfileOverlay(metadata map[string]interface{}, decode configformat.Decoder) error {
+	file, ok := a.MetadataSource.(*configsource.File)
+	if a.Config.Profile == "" || !ok {
+		return nil
+	}
+	path := profilePath(file.Path, a.Config.Profile)
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	overlay, err := decode(content)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	mergeMetadata(metadata, overlay)
+	return nil
+}
+
+// Deep-merges overlay into base: objects are merged key by key, anything else in the
+// overlay, arrays included, replaces the base value, and null removes it
+func mergeMetadata(base, overlay map[string]interface{}) {
+	for key, value := range overlay {
+		if value == nil {
+			delete(base, key)
+			continue
+		}
+		overlayObject, isObject := value.(map[string]interface{})
+		baseObject, baseIsObject := base[key].(map[string]interface{})
+		if isObject && baseIsObject {
+			mergeMetadata(baseObject, overlayObject)
+			continue
+		}
+		base[key] = value
+	}
+}
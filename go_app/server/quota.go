@@ -0,0 +1,208 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests refused because a monthly quota was used up, published on /debug/vars
+var quotaMetrics = expvar.NewMap("quota_exceeded")
+
+// Monthly request quotas. Authenticated requests are counted either way; limits apply
+// only when set.
+type QuotaConfig struct {
+	Monthly int    // requests per calendar month (UTC) and principal, 0 is unlimited
+	Tiers   string // per plan/tier overrides as "free:10000,pro:0"
+}
+
+// Counts requests per principal and month
+type UsageStore interface {
+	// Counts one request unless limit (when positive) is already reached, and returns
+	// the count afterwards
+	Add(ctx context.Context, principal, period string, limit int64) (used int64, allowed bool, err error)
+	Get(ctx context.Context, principal, period string) (int64, error)
+}
+
+type memoryUsageStore struct {
+	mutex  sync.Mutex
+	counts map[string]int64
+}
+
+func NewMemoryUsageStore() UsageStore {
+	return &memoryUsageStore{counts: make(map[string]int64)}
+}
+
+func (s *memoryUsageStore) Add(ctx context.Context, principal, period string, limit int64) (int64, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := principal + "|" + period
+	if limit > 0 && s.counts[key] >= limit {
+		return s.counts[key], false, nil
+	}
+	s.counts[key]++
+	return s.counts[key], true, nil
+}
+
+func (s *memoryUsageStore) Get(ctx context.Context, principal, period string) (int64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.counts[principal+"|"+period], nil
+}
+
+// Counts in a SQL database, one row per principal and month
+type sqlUsageStore struct {
+	db     SQLDB
+	driver string
+}
+
+const usageSchema = `CREATE TABLE IF NOT EXISTS request_usage (
+	principal TEXT NOT NULL,
+	period TEXT NOT NULL,
+	requests BIGINT NOT NULL,
+	PRIMARY KEY (principal, period)
+)`
+
+// Creates the request_usage table if needed
+func NewSQLUsageStore(db SQLDB, driver string) (UsageStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, usageSchema); err != nil {
+		return nil, err
+	}
+	return &sqlUsageStore{db: db, driver: driver}, nil
+}
+
+// The conditional upsert counts and checks in one statement, so concurrent requests
+// can't overrun the limit
+func (s *sqlUsageStore) Add(ctx context.Context, principal, period string, limit int64) (int64, bool, error) {
+	bound := limit
+	if bound <= 0 {
+		bound = 1<<63 - 1
+	}
+	result, err := s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO request_usage (principal, period, requests) VALUES (?, ?, 1)
+		ON CONFLICT (principal, period) DO UPDATE SET requests = request_usage.requests + 1 WHERE request_usage.requests < ?`),
+		principal, period, bound)
+	if err != nil {
+		return 0, false, err
+	}
+	counted, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, err
+	}
+	used, err := s.Get(ctx, principal, period)
+	return used, counted > 0, err
+}
+
+func (s *sqlUsageStore) Get(ctx context.Context, principal, period string) (int64, error) {
+	var used int64
+	err := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT requests FROM request_usage WHERE principal = ? AND period = ?`), principal, period).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return used, err
+}
+
+// The account a request is charged to. Tokens and Basic auth both name a user account;
+// API keys, HMAC clients and certificates are principals of their own.
+func quotaPrincipal(user *User) string {
+	switch user.AuthMethod {
+	case STRATEGY_JWT, STRATEGY_BASIC:
+		return "user:" + user.ID
+	}
+	return user.AuthMethod + ":" + user.ID
+}
+
+// The quota period containing now, e.g. "2026-10", and when the next one starts
+func quotaPeriod(now time.Time) (string, time.Time) {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return start.Format("2006-01"), start.AddDate(0, 1, 0)
+}
+
+// The monthly limit for user: quota-monthly unless quota-tiers has one for the
+// caller's plan/tier
+func (a *App) quotaLimit(user *User) int64 {
+	limit := a.Config.Quota.Monthly
+	if tier := userTier(user); tier != "" {
+		for _, pair := range configList(a.Config.Quota.Tiers) {
+			if name, value, ok := parseTierPair(pair); ok && name == tier {
+				limit = value
+			}
+		}
+	}
+	return int64(limit)
+}
+
+func parseTierPair(pair string) (string, int, bool) {
+	tier, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+	limit, err := strconv.Atoi(value)
+	return tier, limit, ok && tier != "" && err == nil
+}
+
+// Counts authenticated requests against their principal's monthly quota, answering
+// 429 until the next month once it is used up. A failing store lets requests through
+// uncounted rather than taking the service down.
+func (a *App) enforceQuota(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok || user.ID == "" {
+			next(w, r)
+			return
+		}
+		limit := a.quotaLimit(user)
+		period, reset := quotaPeriod(a.clock(r.Context()).Now())
+		used, allowed, err := a.stores(r.Context()).Usage.Add(r.Context(), quotaPrincipal(user), period, limit)
+		if err != nil {
+			a.Logger.Println("Usage accounting failed:", err)
+			next(w, r)
+			return
+		}
+		if limit > 0 {
+			w.Header().Set("X-Quota-Limit", strconv.FormatInt(limit, 10))
+			w.Header().Set("X-Quota-Remaining", strconv.FormatInt(max(limit-used, 0), 10))
+			w.Header().Set("X-Quota-Reset", strconv.FormatInt(reset.Unix(), 10))
+		}
+		if !allowed {
+			quotaMetrics.Add(quotaPrincipal(user), 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(reset.Sub(a.clock(r.Context()).Now()).Seconds())+1))
+			a.handleErrorResponse(w, r, http.StatusTooManyRequests, "Too Many Requests: Monthly quota exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+type usageResponse struct {
+	Principal string    `json:"principal"`
+	Period    string    `json:"period"`
+	Used      int64     `json:"used"`
+	Limit     *int64    `json:"limit"`     // null when unlimited
+	Remaining *int64    `json:"remaining"` // null when unlimited
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// The caller's consumption in the current month
+func (a *App) usage(ctx context.Context, _ struct{}) (usageResponse, error) {
+	user, ok := UserFromContext(ctx)
+	if !ok || user.ID == "" {
+		return usageResponse{}, &RejectError{Status: http.StatusUnauthorized, Message: "Unauthorized: Authentication required"}
+	}
+	period, reset := quotaPeriod(a.clock(ctx).Now())
+	used, err := a.stores(ctx).Usage.Get(ctx, quotaPrincipal(user), period)
+	if err != nil {
+		return usageResponse{}, err
+	}
+	response := usageResponse{Principal: quotaPrincipal(user), Period: period, Used: used, ResetsAt: reset}
+	if limit := a.quotaLimit(user); limit > 0 {
+		remaining := max(limit-used, 0)
+		response.Limit, response.Remaining = &limit, &remaining
+	}
+	return response, nil
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/cache"
+)
+
+// Rate limited requests per route, published on /debug/vars
+var rateLimitMetrics = expvar.NewMap("rate_limited")
+
+// Buckets kept; the least recently used are dropped, which refills them early
+const RATE_LIMIT_MAX_BUCKETS = 100000
+
+// Token bucket per client and route
+type bucket struct {
+	mutex    sync.Mutex
+	tokens   float64
+	capacity float64
+	last     time.Time
+}
+
+// Tokens in the bucket at now, refilled at capacity per minute
+func (b *bucket) level(now time.Time) float64 {
+	return math.Min(b.capacity, b.tokens+now.Sub(b.last).Minutes()*b.capacity)
+}
+
+// Limits requests per minute per client with token buckets that refill continuously
+type RateLimiter struct {
+	Clock Clock
+
+	// A bucket idle for a minute is full again, so it expires and carries no state
+	buckets *cache.Cache[string, *bucket]
+}
+
+func NewRateLimiter(clock Clock) *RateLimiter {
+	return &RateLimiter{Clock: clock, buckets: cache.New[string, *bucket](cache.Options[*bucket]{
+		Name:       "rate_limit_buckets",
+		TTL:        time.Minute,
+		MaxEntries: RATE_LIMIT_MAX_BUCKETS,
+		Now:        clock.Now,
+	})}
+}
+
+// Outcome of a rate limit check, reported to clients in X-RateLimit-* headers
+type RateLimitStatus struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next token, when not allowed
+}
+
+// Takes a token from key's bucket, reporting what is left and how long to wait when none is
+func (l *RateLimiter) Allow(key string, perMinute int) RateLimitStatus {
+	now := l.Clock.Now()
+
+	b, _ := l.buckets.GetOrLoad(context.Background(), key, func(context.Context) (*bucket, error) {
+		return &bucket{tokens: float64(perMinute), last: now}, nil
+	})
+	// Stored again to restart its TTL
+	defer l.buckets.Set(key, b)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.capacity = float64(perMinute)
+	b.tokens = b.level(now)
+	b.last = now
+
+	status := RateLimitStatus{Limit: perMinute}
+	if b.tokens < 1 {
+		status.RetryAfter = time.Duration((1 - b.tokens) / b.capacity * float64(time.Minute))
+	} else {
+		b.tokens--
+		status.Allowed = true
+	}
+	status.Remaining = int(b.tokens)
+	status.Reset = time.Duration((b.capacity - b.tokens) / b.capacity * float64(time.Minute))
+	return status
+}
+
+// Identifies the caller for rate limiting: the authenticated user if any, else the client IP
+func rateLimitClient(r *http.Request) string {
+	if user, ok := UserFromContext(r.Context()); ok && user.ID != "" {
+		return "user:" + user.ID
+	}
+	return "ip:" + clientIP(r)
+}
+
+// Reads per-tier limits: the rate-limit-tiers config, overridden by a "rateLimits"
+// object in the metadata document, e.g. {"rateLimits": {"free": 30, "pro": 600}}, with
+// the caller's tenant overlay applied
+func (a *App) tierLimits(ctx context.Context) map[string]int {
+	limits := map[string]int{}
+	for _, pair := range strings.Split(a.Config.RateLimitTiers, ",") {
+		tier, value, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if limit, err := strconv.Atoi(value); ok && tier != "" && err == nil {
+			limits[tier] = limit
+		}
+	}
+
+	if config, err := a.requestConfiguration(ctx); err == nil {
+		if tiers, ok := config.Metadata["rateLimits"].(map[string]interface{}); ok {
+			for tier, value := range tiers {
+				if limit, ok := value.(float64); ok {
+					limits[tier] = int(limit)
+				}
+			}
+		}
+	}
+	return limits
+}
+
+// The caller's plan from the "plan" or "tier" claim, empty when unauthenticated
+func rateLimitTier(r *http.Request) string {
+	user, ok := UserFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	return userTier(user)
+}
+
+func userTier(user *User) string {
+	for _, claim := range []string{"plan", "tier"} {
+		if tier, ok := user.Claims[claim].(string); ok && tier != "" {
+			return tier
+		}
+	}
+	return ""
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, status RateLimitStatus) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(status.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(status.Remaining))
+	w.Header().Set("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(status.Reset.Seconds()))))
+}
+
+// Allows perMinute requests per client on route, or the rateLimit of its route settings,
+// answering 429 beyond that. Callers
+// whose token names a tier with a configured limit get that limit instead; a tier
+// limit of 0 means unlimited.
+func (a *App) rateLimit(route string, perMinute int, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit := perMinute
+		if settings, ok := a.routeSettingsFor(route); ok && settings.RateLimit != nil {
+			limit = *settings.RateLimit
+		}
+		if limit <= 0 {
+			next(w, r)
+			return
+		}
+		if tier := rateLimitTier(r); tier != "" {
+			if tierLimit, ok := a.tierLimits(r.Context())[tier]; ok {
+				limit = tierLimit
+			}
+		}
+		if limit <= 0 {
+			next(w, r)
+			return
+		}
+
+		status := a.RateLimiter.Allow(route+"|"+rateLimitClient(r), limit)
+		setRateLimitHeaders(w, status)
+		if !status.Allowed {
+			rateLimitMetrics.Add(route, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(status.RetryAfter.Seconds()))))
+			a.handleErrorResponse(w, r, http.StatusTooManyRequests, "Too Many Requests: Rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+
+	"go_app/discovery"
+)
+
+// Service registration settings; registration is off when Backend is empty
+type DiscoveryConfig struct {
+	Backend        string
+	Addr           string
+	ServiceName    string
+	ServiceAddress string
+}
+
+// Registers this process with the configured registry and returns a function that
+// deregisters it again, to be called on shutdown.
+func (a *App) RegisterService(ctx context.Context, listenAddr net.Addr) (func(context.Context) error, error) {
+	if a.Discovery == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	tcpAddr, ok := listenAddr.(*net.TCPAddr)
+	if !ok {
+		return nil, errors.New("service registration needs a TCP listener")
+	}
+
+	address := a.Config.Discovery.ServiceAddress
+	if address == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		address = hostname
+	}
+
+	instance := discovery.Instance{
+		ID:      fmt.Sprintf("%s-%s-%d", a.Config.Discovery.ServiceName, address, tcpAddr.Port),
+		Name:    a.Config.Discovery.ServiceName,
+		Address: address,
+		Port:    tcpAddr.Port,
+		Meta:    map[string]string{},
+	}
+	addDeployment(instance.Meta, a.Deployment(ctx))
+	if config, err := a.loadConfiguration(ctx); err == nil {
+		if version, ok := config.Metadata["version"].(string); ok {
+			instance.Meta["version"] = version
+		}
+		instance.Meta["sha"] = config.SHA
+	}
+	// The registry probes the public listener, which serves TLS when a certificate is set
+	if a.Config.TLS.CertFile != "" {
+		instance.Scheme = "https"
+	}
+	instance.HealthCheckURL = instance.URL() + "/healthz"
+
+	if err := a.Discovery.Registry.Register(ctx, instance); err != nil {
+		return nil, err
+	}
+	a.Logger.Printf("Registered %s as %s with %s", instance.URL(), instance.ID, a.Config.Discovery.Backend)
+
+	return func(ctx context.Context) error {
+		return a.Discovery.Registry.Deregister(ctx, instance)
+	}, nil
+}
+
+// Liveness probe used by the registry health check
+func (a *App) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// Readiness probe: ready once the metadata loads, 503 while it is degraded
+func (a *App) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := a.loadConfiguration(r.Context()); err != nil {
+		w.Header().Set("Retry-After", strconv.Itoa(int(CONFIG_RETRY_AFTER.Seconds())))
+		a.writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "configState": CONFIG_STATE_DEGRADED, "error": err.Error()})
+		return
+	}
+	if a.Database != nil {
+		primaryErr, usable, replicas := a.Database.Health()
+		if primaryErr != nil {
+			a.writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "configState": CONFIG_STATE_OK, "database": "unavailable", "error": primaryErr.Error()})
+			return
+		}
+		// Reads fall back to the primary, so missing replicas don't make the service unready
+		if replicas > 0 {
+			a.writeJSON(w, r, http.StatusOK, map[string]string{"status": "ready", "configState": CONFIG_STATE_OK, "database": "ok", "replicas": fmt.Sprintf("%d/%d", usable, replicas)})
+			return
+		}
+	}
+	a.writeJSON(w, r, http.StatusOK, map[string]string{"status": "ready", "configState": CONFIG_STATE_OK})
+}
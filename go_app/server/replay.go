@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+)
+
+// Lets a token through a single-use route once. Uses are recorded in the used-token
+// blacklist as (jti, route) pairs until the token expires, so the same token still
+// works on other routes. Principals without a token, such as client certificates,
+// have nothing to replay and pass.
+func (a *App) singleUse(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok || user.AuthMethod != AUTH_METHOD_JWT {
+			next(w, r)
+			return
+		}
+		jti, _ := user.Claims["jti"].(string)
+		if jti == "" {
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Invalid token")
+			return
+		}
+
+		key := "jti:" + jti + " " + route
+		// Contains and Add are separate calls; without the lock two concurrent
+		// replays could both find the pair unused
+		a.replayMutex.Lock()
+		used := a.stores(r.Context()).Blacklist.Contains(key)
+		if !used {
+			a.stores(r.Context()).Blacklist.Add(key, tokenExpiry(user.Claims))
+		}
+		a.replayMutex.Unlock()
+		if used {
+			a.Logger.Printf("audit: event=token_replay route=%q jti=%s by=%s", route, jti, clientIP(r))
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Token has already been used")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Reads by the pool that served them, plus the pools' sql.DBStats, on /debug/vars
+var databaseMetrics = expvar.NewMap("database")
+
+// Seconds a Postgres standby is behind: zero while it has replayed all it received
+const postgresLagQuery = `SELECT CASE WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END`
+
+// What SQL stores run their statements on: a *sql.DB, or a *Database sending reads to
+// its replicas
+type SQLDB interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// A primary database with optional read replicas. Writes always go to the primary.
+// SELECT statements go to the replicas in turn, except when:
+//
+//   - no replica is usable: each is checked every database-health-interval and left out
+//     while unreachable or more than database-max-replica-lag behind;
+//   - the request already wrote through the Database, so it reads its own writes;
+//   - the context comes from ReadFromPrimary.
+type Database struct {
+	Primary *sql.DB
+
+	driver   string
+	maxLag   time.Duration
+	replicas []*replica
+	next     atomic.Uint64
+
+	mutex      sync.Mutex
+	primaryErr error // of the last check
+}
+
+type replica struct {
+	name string
+	db   *sql.DB
+
+	usable atomic.Bool
+	mutex  sync.Mutex
+	lag    time.Duration
+	err    error
+}
+
+// Opens the configured primary and replicas. Replicas start usable; one that fails to
+// open is an error, as it is likely a typo in the DSN.
+func openDatabases(config DatabaseConfig) (*Database, error) {
+	primary, err := openDatabase(config.Driver, config.URL)
+	if err != nil {
+		return nil, err
+	}
+	d := &Database{Primary: primary, driver: config.Driver, maxLag: config.MaxReplicaLag}
+	for i, url := range configList(config.ReplicaURLs) {
+		db, err := openDatabase(config.Driver, url)
+		if err != nil {
+			d.Close()
+			return nil, fmt.Errorf("replica %d: %w", i+1, err)
+		}
+		r := &replica{name: fmt.Sprintf("replica-%d", i+1), db: db}
+		r.usable.Store(true)
+		d.replicas = append(d.replicas, r)
+	}
+	d.publishStats()
+	return d, nil
+}
+
+func (d *Database) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	if marker, ok := ctx.Value(writeMarkerKey{}).(*atomic.Bool); ok {
+		marker.Store(true)
+	}
+	return d.Primary.ExecContext(ctx, query, args...)
+}
+
+func (d *Database) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return d.reader(ctx, query).QueryContext(ctx, query, args...)
+}
+
+func (d *Database) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return d.reader(ctx, query).QueryRowContext(ctx, query, args...)
+}
+
+// The pool query runs on
+func (d *Database) reader(ctx context.Context, query string) *sql.DB {
+	if len(d.replicas) == 0 || !readOnly(query) || readsPrimary(ctx) {
+		return d.Primary
+	}
+	start := d.next.Add(1)
+	for i := range d.replicas {
+		r := d.replicas[(start+uint64(i))%uint64(len(d.replicas))]
+		if r.usable.Load() {
+			databaseMetrics.Add("replica_reads", 1)
+			return r.db
+		}
+	}
+	databaseMetrics.Add("primary_fallbacks", 1)
+	return d.Primary
+}
+
+// Reports whether query only reads. Statements such as INSERT ... RETURNING are run
+// with QueryRowContext too, so the method alone doesn't tell.
+func readOnly(query string) bool {
+	query = strings.ToUpper(strings.TrimSpace(query))
+	return strings.HasPrefix(query, "SELECT") && !strings.Contains(query, " FOR UPDATE") && !strings.Contains(query, " FOR SHARE")
+}
+
+// Marks a request that wrote through a Database
+type writeMarkerKey struct{}
+
+// Marks contexts whose reads go to the primary
+type readPrimaryKey struct{}
+
+// Sends the reads made with ctx to the primary, for callers that can't accept data a
+// replica hasn't caught up on yet
+func ReadFromPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, readPrimaryKey{}, true)
+}
+
+func readsPrimary(ctx context.Context) bool {
+	if primary, _ := ctx.Value(readPrimaryKey{}).(bool); primary {
+		return true
+	}
+	marker, ok := ctx.Value(writeMarkerKey{}).(*atomic.Bool)
+	return ok && marker.Load()
+}
+
+// Lets requests read their own writes: once a request has written through the
+// Database, its later reads go to the primary
+func (a *App) readYourWrites(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.Database == nil || len(a.Database.replicas) == 0 {
+			next(w, r)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), writeMarkerKey{}, new(atomic.Bool))))
+	}
+}
+
+// Pings the primary and every replica, and measures the replicas' lag where the driver
+// has a way to. A replica is usable while it answers and is at most maxLag behind.
+func (d *Database) Check(ctx context.Context) {
+	err := d.Primary.PingContext(ctx)
+	d.mutex.Lock()
+	d.primaryErr = err
+	d.mutex.Unlock()
+
+	for _, r := range d.replicas {
+		lag, err := d.replicaLag(ctx, r.db)
+		if err == nil && d.maxLag > 0 && lag > d.maxLag {
+			err = fmt.Errorf("%s behind, more than %s", lag.Round(time.Millisecond), d.maxLag)
+		}
+		r.mutex.Lock()
+		r.lag, r.err = lag, err
+		r.mutex.Unlock()
+		if usable := err == nil; r.usable.Swap(usable) != usable {
+			if usable {
+				databaseMetrics.Add("replica_failbacks", 1)
+			} else {
+				databaseMetrics.Add("replica_failovers", 1)
+			}
+		}
+	}
+}
+
+func (d *Database) replicaLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	if err := db.PingContext(ctx); err != nil {
+		return 0, err
+	}
+	if d.driver != "postgres" && d.driver != "pgx" {
+		return 0, nil
+	}
+	var seconds float64
+	if err := db.QueryRowContext(ctx, postgresLagQuery).Scan(&seconds); err != nil {
+		return 0, fmt.Errorf("lag: %w", err)
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// Runs Check every interval until ctx is done
+func (d *Database) monitor(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		checkCtx, cancel := context.WithTimeout(ctx, min(interval, DATABASE_CONNECT_TIMEOUT))
+		d.Check(checkCtx)
+		cancel()
+	}
+}
+
+// The primary's error at the last check, and how many replicas serve reads
+func (d *Database) Health() (primaryErr error, usable, replicas int) {
+	d.mutex.Lock()
+	primaryErr = d.primaryErr
+	d.mutex.Unlock()
+	for _, r := range d.replicas {
+		if r.usable.Load() {
+			usable++
+		}
+	}
+	return primaryErr, usable, len(d.replicas)
+}
+
+// Closes the replicas and the primary
+func (d *Database) Close() error {
+	var errs []error
+	for _, r := range d.replicas {
+		errs = append(errs, r.db.Close())
+	}
+	errs = append(errs, d.Primary.Close())
+	return errors.Join(errs...)
+}
+
+// Publishes the pools' connection stats, and the replicas' state, in the database map
+func (d *Database) publishStats() {
+	databaseMetrics.Set("primary", expvar.Func(func() interface{} { return poolStats(d.Primary) }))
+	for _, r := range d.replicas {
+		databaseMetrics.Set(r.name, expvar.Func(func() interface{} {
+			stats := poolStats(r.db)
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			stats["usable"] = r.usable.Load()
+			stats["lag_ms"] = r.lag.Milliseconds()
+			if r.err != nil {
+				stats["error"] = r.err.Error()
+			}
+			return stats
+		}))
+	}
+}
+
+func poolStats(db *sql.DB) map[string]interface{} {
+	stats := db.Stats()
+	return map[string]interface{}{
+		"max_open":       stats.MaxOpenConnections,
+		"open":           stats.OpenConnections,
+		"in_use":         stats.InUse,
+		"idle":           stats.Idle,
+		"wait_count":     stats.WaitCount,
+		"wait_ms":        stats.WaitDuration.Milliseconds(),
+		"closed_idle":    stats.MaxIdleClosed,
+		"closed_expired": stats.MaxLifetimeClosed,
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"net/http"
+)
+
+// Responses that could not be sent as written, published on /debug/vars
+var responseMetrics = expvar.NewMap("response_writes")
+
+// Records what has gone out of a response, so a late error can tell whether its status
+// can still be sent. Installed around each route's handler and around the whole route,
+// since http.TimeoutHandler buffers what the handler writes and hides it from the outside.
+type trackedWriter struct {
+	http.ResponseWriter
+	status  int   // sent status, 0 until the header is written
+	written int64 // body bytes passed on
+	err     error // first failed Write, usually a client that went away
+}
+
+// Passes the first status on. Later calls, which net/http would only log as superfluous,
+// are counted and dropped.
+func (w *trackedWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		responseMetrics.Add("superfluous_write_header", 1)
+		return
+	}
+	// Informational statuses, e.g. 103 Early Hints, leave the final header to come
+	if status < http.StatusOK && status != http.StatusSwitchingProtocols {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *trackedWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	if err != nil && w.err == nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Lets http.ResponseController reach Flush and friends on the wrapped writer
+func (w *trackedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Tracks the response of next for responseStarted
+func trackResponses(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		next(&trackedWriter{ResponseWriter: w}, r)
+	}
+}
+
+// The innermost trackedWriter under w, nil if there is none, e.g. on the edge chain
+func trackedOf(w http.ResponseWriter) *trackedWriter {
+	for w != nil {
+		if tracked, ok := w.(*trackedWriter); ok {
+			return tracked
+		}
+		unwrapper, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return nil
+		}
+		w = unwrapper.Unwrap()
+	}
+	return nil
+}
+
+// Reports whether the header of the response through w has gone out, after which its
+// status can no longer change
+func responseStarted(w http.ResponseWriter) bool {
+	tracked := trackedOf(w)
+	return tracked != nil && tracked.status != 0
+}
+
+// Reports why a response to r need not be written, as the client is gone or the route's
+// deadline has passed and http.TimeoutHandler answered for it. nil while it is wanted.
+func responseAbandoned(r *http.Request) error {
+	err := r.Context().Err()
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return context.Cause(r.Context())
+	}
+	return nil
+}
+
+// Counts and logs a write to a client that went away. Nothing else can be sent on the
+// response, so the error only matters to the metrics and the debug log.
+func (a *App) writeFailed(r *http.Request, err error) {
+	responseMetrics.Add("write_errors", 1)
+	a.Log.Debug("Response write failed", "path", r.URL.Path, "error", err)
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Accepts limit bytes of body, then fails every write like a client that went away
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseRecorder.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection reset by peer")
+	}
+	w.limit -= len(p)
+	return w.ResponseRecorder.Write(p)
+}
+
+func responseMetric(name string) int64 {
+	if v, ok := responseMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestWriteJSON(t *testing.T) {
+	app := &App{Config: DefaultConfig(), Log: slog.New(slog.NewTextHandler(io.Discard, nil))}
+
+	tests := []struct {
+		name  string
+		value any
+		// Wraps the recorder and request the way the middleware would
+		setup func(recorder *httptest.ResponseRecorder, r *http.Request) (http.ResponseWriter, *http.Request)
+
+		wantStatus int
+		wantBody   string
+		wantMetric string // counter of responseMetrics that must go up, if any
+	}{
+		{
+			name:       "written",
+			value:      map[string]string{"status": "ok"},
+			wantStatus: http.StatusCreated,
+			wantBody:   "{\"status\":\"ok\"}\n",
+		},
+		{
+			name:  "writer fails after some bytes",
+			value: map[string]string{"status": "ok"},
+			setup: func(recorder *httptest.ResponseRecorder, r *http.Request) (http.ResponseWriter, *http.Request) {
+				return &trackedWriter{ResponseWriter: &failingWriter{ResponseRecorder: recorder, limit: 5}}, r
+			},
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"sta`,
+			wantMetric: "write_errors",
+		},
+		{
+			name:  "writer fails on the first byte",
+			value: map[string]string{"status": "ok"},
+			setup: func(recorder *httptest.ResponseRecorder, r *http.Request) (http.ResponseWriter, *http.Request) {
+				return &trackedWriter{ResponseWriter: &failingWriter{ResponseRecorder: recorder}}, r
+			},
+			wantStatus: http.StatusCreated,
+			wantMetric: "write_errors",
+		},
+		{
+			name:  "header already sent",
+			value: map[string]string{"error": "too late"},
+			setup: func(recorder *httptest.ResponseRecorder, r *http.Request) (http.ResponseWriter, *http.Request) {
+				w := &trackedWriter{ResponseWriter: recorder}
+				w.WriteHeader(http.StatusAccepted)
+				w.Write([]byte("partial"))
+				return w, r
+			},
+			wantStatus: http.StatusAccepted,
+			wantBody:   "partial",
+			wantMetric: "after_header",
+		},
+		{
+			name:  "request canceled",
+			value: map[string]string{"status": "ok"},
+			setup: func(recorder *httptest.ResponseRecorder, r *http.Request) (http.ResponseWriter, *http.Request) {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				return &trackedWriter{ResponseWriter: recorder}, r.WithContext(ctx)
+			},
+			wantStatus: 0,
+			wantMetric: "abandoned",
+		},
+		{
+			name:       "value cannot be encoded",
+			value:      map[string]any{"channel": make(chan int)},
+			wantStatus: http.StatusInternalServerError,
+			wantBody:   "{\"error\":\"Internal Server Error\",\"code\":\"internal_server_error\",\"retryable\":false}\n",
+			wantMetric: "encoding_errors",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := httptest.NewRecorder()
+			var w http.ResponseWriter = &trackedWriter{ResponseWriter: recorder}
+			r := httptest.NewRequest(http.MethodGet, "/status", nil)
+			if test.setup != nil {
+				w, r = test.setup(recorder, r)
+			}
+			before := responseMetric(test.wantMetric)
+
+			app.writeJSON(w, r, http.StatusCreated, test.value)
+
+			// The status that went out, 0 when none did
+			if status := trackedOf(w).status; status != test.wantStatus {
+				t.Errorf("status = %d, want %d", status, test.wantStatus)
+			}
+			if got := recorder.Body.String(); got != test.wantBody {
+				t.Errorf("body = %q, want %q", got, test.wantBody)
+			}
+			if test.wantMetric != "" && responseMetric(test.wantMetric) != before+1 {
+				t.Errorf("%s not counted", test.wantMetric)
+			}
+		})
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Claim naming the tenant of an account, set at login when the account has one
+const TENANT_CLAIM = "tenant"
+
+// Tokens of a principal issued at or before its cutoff are rejected. Revoking by user
+// or tenant sets a cutoff instead of listing every token that was handed out.
+type CutoffStore interface {
+	Get(ctx context.Context, principal string) (time.Time, bool, error)
+	Set(ctx context.Context, principal string, cutoff time.Time) error
+}
+
+// Cutoff keys of a user ID and a tenant
+func userPrincipal(id string) string       { return "user:" + id }
+func tenantPrincipal(tenant string) string { return "tenant:" + tenant }
+
+type memoryCutoffStore struct {
+	mutex   sync.Mutex
+	cutoffs map[string]time.Time
+}
+
+func NewMemoryCutoffStore() CutoffStore {
+	return &memoryCutoffStore{cutoffs: make(map[string]time.Time)}
+}
+
+func (s *memoryCutoffStore) Get(ctx context.Context, principal string) (time.Time, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	cutoff, ok := s.cutoffs[principal]
+	return cutoff, ok, nil
+}
+
+func (s *memoryCutoffStore) Set(ctx context.Context, principal string, cutoff time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.cutoffs[principal] = cutoff
+	return nil
+}
+
+// Cutoffs in a SQL database as Unix seconds, the resolution of the iat claim
+type sqlCutoffStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const cutoffsSchema = `CREATE TABLE IF NOT EXISTS token_cutoffs (
+	principal TEXT PRIMARY KEY,
+	not_before BIGINT NOT NULL
+)`
+
+// Creates the token_cutoffs table if needed
+func NewSQLCutoffStore(db *sql.DB, driver string) (CutoffStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, cutoffsSchema); err != nil {
+		return nil, err
+	}
+	return &sqlCutoffStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlCutoffStore) Get(ctx context.Context, principal string) (time.Time, bool, error) {
+	var notBefore int64
+	err := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT not_before FROM token_cutoffs WHERE principal = ?`), principal).Scan(&notBefore)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(notBefore, 0), true, nil
+}
+
+func (s *sqlCutoffStore) Set(ctx context.Context, principal string, cutoff time.Time) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO token_cutoffs (principal, not_before) VALUES (?, ?)
+		ON CONFLICT (principal) DO UPDATE SET not_before = excluded.not_before`), principal, cutoff.Unix())
+	return err
+}
+
+// Reports whether claims were issued at or before the cutoff of their user or tenant.
+// iat has second resolution, so tokens from the second of a revocation are rejected
+// too. Tokens without iat predate every cutoff.
+func (a *App) issuedBeforeCutoff(ctx context.Context, claims map[string]interface{}) (bool, error) {
+	issuedAt, _ := claims["iat"].(float64)
+	return a.cutoffPassed(ctx, cutoffPrincipals(claims), int64(issuedAt))
+}
+
+// The principals whose cutoffs apply to claims: its user and tenant
+func cutoffPrincipals(claims map[string]interface{}) []string {
+	var principals []string
+	if id, ok := claims["id"]; ok && id != nil {
+		principals = append(principals, userPrincipal(fmt.Sprint(id)))
+	}
+	if tenant, ok := claims[TENANT_CLAIM].(string); ok && tenant != "" {
+		principals = append(principals, tenantPrincipal(tenant))
+	}
+	return principals
+}
+
+// Reports whether a token issued at issuedAt predates the cutoff of any of principals
+func (a *App) cutoffPassed(ctx context.Context, principals []string, issuedAt int64) (bool, error) {
+	for _, principal := range principals {
+		cutoff, ok, err := a.stores(ctx).Cutoffs.Get(ctx, principal)
+		if err != nil {
+			return false, err
+		}
+		if ok && issuedAt <= cutoff.Unix() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type revokeUserRequest struct {
+	ID string `path:"id"`
+}
+
+type revokeTenantRequest struct {
+	Tenant string `path:"tenant"`
+}
+
+type revokeResponse struct {
+	Principal string    `json:"principal"`
+	NotBefore time.Time `json:"notBefore"` // tokens issued up to this second are rejected
+}
+
+// Rejects every token issued so far to a user, e.g. after a compromised device
+func (a *App) revokeUser(ctx context.Context, request revokeUserRequest) (revokeResponse, error) {
+	return a.revokePrincipal(ctx, userPrincipal(request.ID))
+}
+
+// Rejects every token issued so far to the accounts of a tenant
+func (a *App) revokeTenant(ctx context.Context, request revokeTenantRequest) (revokeResponse, error) {
+	return a.revokePrincipal(ctx, tenantPrincipal(request.Tenant))
+}
+
+func (a *App) revokePrincipal(ctx context.Context, principal string) (revokeResponse, error) {
+	now := a.clock(ctx).Now().UTC().Truncate(time.Second)
+	if err := a.stores(ctx).Cutoffs.Set(ctx, principal, now); err != nil {
+		return revokeResponse{}, err
+	}
+	a.Logger.Printf("audit: event=bulk_revocation principal=%q not_before=%d by=%s", principal, now.Unix(), clientIPFromContext(ctx))
+	return revokeResponse{Principal: principal, NotBefore: now}, nil
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// Serves through a ServeMux that is replaced as a whole when route groups are mounted
+// or unmounted. Requests in flight finish on the mux they started with.
+type Router struct {
+	mux atomic.Pointer[http.ServeMux]
+}
+
+func NewRouter() *Router {
+	router := &Router{}
+	router.mux.Store(http.NewServeMux())
+	return router
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router.mux.Load().ServeHTTP(w, r)
+}
+
+// Routes that are served only while mounted, e.g. a beta API behind a feature flag.
+// Their entries support everything the main table does.
+type RouteGroup struct {
+	Name   string
+	Routes []Route
+}
+
+// A registered group and whether it is being served
+type RouteGroupStatus struct {
+	Name    string   `json:"name"`
+	Mounted bool     `json:"mounted"`
+	Routes  []string `json:"routes"` // patterns, e.g. "GET /beta/items"
+}
+
+// A route wrapped in its middleware, ready for a mux
+type builtRoute struct {
+	listener string
+	pattern  string
+	auth     string // the table's auth mode, see weakensAuth
+	handler  http.HandlerFunc
+}
+
+type routeGroup struct {
+	name    string
+	routes  []builtRoute
+	mounted bool
+}
+
+// Returned for names that were never registered
+var errUnknownRouteGroup = errors.New("unknown route group")
+
+// Registers group, mounting it right away if route-groups lists its name. Groups are
+// registered once, typically right after New; mounting and unmounting is safe while
+// serving.
+func (a *App) RegisterRouteGroup(group RouteGroup) error {
+	if group.Name == "" {
+		return errors.New("route group needs a name")
+	}
+	built := make([]builtRoute, len(group.Routes))
+	for i, route := range group.Routes {
+		built[i] = a.build(route)
+	}
+
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	if _, exists := a.routeGroups[group.Name]; exists {
+		return fmt.Errorf("route group %q is already registered", group.Name)
+	}
+	a.routeGroups[group.Name] = &routeGroup{name: group.Name, routes: built}
+	if contains(configList(a.Config.RouteGroups), group.Name) {
+		return a.setMounted(group.Name, true)
+	}
+	return nil
+}
+
+// Starts serving the group's routes. Fails, leaving the routers as they were, if a
+// route conflicts with one already served.
+func (a *App) MountRouteGroup(name string) error {
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	return a.setMounted(name, true)
+}
+
+// Stops serving the group's routes; they answer 404 again
+func (a *App) UnmountRouteGroup(name string) error {
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	return a.setMounted(name, false)
+}
+
+// The registered groups, sorted by name
+func (a *App) RouteGroups() []RouteGroupStatus {
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	statuses := make([]RouteGroupStatus, 0, len(a.routeGroups))
+	for _, group := range a.routeGroups {
+		statuses = append(statuses, group.status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+func (group *routeGroup) status() RouteGroupStatus {
+	status := RouteGroupStatus{Name: group.name, Mounted: group.mounted, Routes: []string{}}
+	for _, route := range group.routes {
+		status.Routes = append(status.Routes, route.pattern)
+	}
+	return status
+}
+
+// Mounts exactly the groups listed in names, as route-groups does on SIGHUP
+func (a *App) applyRouteGroups(names []string) error {
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	var errs []error
+	for name := range a.routeGroups {
+		if err := a.setMounted(name, contains(names, name)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// The caller holds routeMutex
+func (a *App) setMounted(name string, mounted bool) error {
+	group, ok := a.routeGroups[name]
+	if !ok {
+		return fmt.Errorf("%w %q", errUnknownRouteGroup, name)
+	}
+	if group.mounted == mounted {
+		return nil
+	}
+	group.mounted = mounted
+	if err := a.swapRouters(); err != nil {
+		group.mounted = !mounted
+		return fmt.Errorf("route group %q: %w", name, err)
+	}
+	return nil
+}
+
+// Builds fresh muxes from the static routes and the mounted groups and swaps them in.
+// The caller holds routeMutex.
+func (a *App) swapRouters() (err error) {
+	muxes := map[*Router]*http.ServeMux{}
+	register := func(route builtRoute) {
+		router := a.routerFor(route.listener)
+		if muxes[router] == nil {
+			muxes[router] = http.NewServeMux()
+		}
+		muxes[router].HandleFunc(route.pattern, route.handler)
+	}
+	// ServeMux panics on conflicting patterns, which only mounted groups can bring in
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("%v", recovered)
+		}
+	}()
+	for _, route := range a.staticRoutes {
+		register(route)
+	}
+	for _, group := range a.routeGroups {
+		if group.mounted {
+			for _, route := range group.routes {
+				register(route)
+			}
+		}
+	}
+
+	for _, router := range []*Router{a.Router, a.AdminRouter, a.MetricsRouter} {
+		if router == nil {
+			continue
+		}
+		mux := muxes[router]
+		if mux == nil {
+			mux = http.NewServeMux()
+		}
+		router.mux.Store(mux)
+	}
+	return nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+type routeGroupRequest struct {
+	Name string `path:"name"`
+}
+
+func (a *App) listRouteGroups(ctx context.Context, _ struct{}) ([]RouteGroupStatus, error) {
+	return a.RouteGroups(), nil
+}
+
+// PUT /admin/route-groups/{name}
+func (a *App) mountRouteGroup(ctx context.Context, request routeGroupRequest) (RouteGroupStatus, error) {
+	return a.toggleRouteGroup(ctx, request.Name, true)
+}
+
+// DELETE /admin/route-groups/{name}
+func (a *App) unmountRouteGroup(ctx context.Context, request routeGroupRequest) (RouteGroupStatus, error) {
+	return a.toggleRouteGroup(ctx, request.Name, false)
+}
+
+func (a *App) toggleRouteGroup(ctx context.Context, name string, mounted bool) (RouteGroupStatus, error) {
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	err := a.setMounted(name, mounted)
+	if errors.Is(err, errUnknownRouteGroup) {
+		return RouteGroupStatus{}, &RejectError{Status: http.StatusNotFound, Message: "Not Found: Route group does not exist"}
+	}
+	if err != nil {
+		a.Logger.Println("Mounting route group failed:", err)
+		return RouteGroupStatus{}, &RejectError{Status: http.StatusConflict, Message: "Conflict: Route group conflicts with served routes"}
+	}
+	event := "route_group_unmounted"
+	if mounted {
+		event = "route_group_mounted"
+	}
+	a.Logger.Printf("audit: event=%s group=%q by=%s", event, name, clientIPFromContext(ctx))
+	return a.routeGroups[name].status(), nil
+}
@@ -0,0 +1,292 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"path"
+	"strings"
+	"time"
+)
+
+// Authentication a route requires
+const (
+	AUTH_DEFAULT     = ""       // auth-strategies unless the request path is in public-routes
+	AUTH_PUBLIC      = "public" // never authenticated; the handler checks credentials itself if needed
+	AUTH_JWT         = "jwt"
+	AUTH_MTLS        = "mtls"
+	AUTH_CERT_OR_JWT = "mtls-or-jwt"
+	AUTH_ADMIN       = "admin"
+)
+
+// Listener serving a route when admin-port or metrics-port split them off the main one
+const (
+	LISTENER_PUBLIC  = ""
+	LISTENER_ADMIN   = "admin"
+	LISTENER_METRICS = "metrics"
+)
+
+// Body sent when a route exceeds its timeout. http.TimeoutHandler sends a fixed body,
+// so it is not localized.
+const ROUTE_TIMEOUT_MSG = `{"error":"Service Unavailable: Request timed out","code":"request_timed_out","retryable":true}`
+
+// Declarative description of an endpoint; the table drives registration and can be
+// consumed by tooling such as code and documentation generators.
+type Route struct {
+	Method    string             `json:"method,omitempty"` // empty matches any method
+	Path      string             `json:"path"`
+	Summary   string             `json:"summary,omitempty"`
+	Auth      string             `json:"auth,omitempty"`      // AUTH_DEFAULT requires a token unless the path is public
+	Roles     []string           `json:"roles,omitempty"`     // any of these roles is sufficient
+	Scopes    []string           `json:"scopes,omitempty"`    // the token must have been granted all of these
+	Claims    []ClaimRequirement `json:"claims,omitempty"`    // the token must carry all of these
+	TwoFactor bool               `json:"twoFactor,omitempty"` // the token must carry the two-factor step-up claim
+	SingleUse bool               `json:"singleUse,omitempty"` // a token is accepted here once, by its jti
+	RateLimit int                `json:"rateLimit,omitempty"` // requests per minute per client, 0 is unlimited
+	Unmetered bool               `json:"unmetered,omitempty"` // not counted against monthly quotas
+	Timeout   time.Duration      `json:"timeout,omitempty"`
+	CacheTTL  time.Duration      `json:"cacheTTL,omitempty"` // GET responses are cached per path, query and principal
+	Listener  string             `json:"listener,omitempty"` // LISTENER_PUBLIC unless an admin or metrics route
+	Consumes  []string           `json:"consumes,omitempty"` // media types of accepted bodies, MEDIA_TYPE_JSON when empty
+	SLO       *SLO               `json:"slo,omitempty"`      // tracked and alerted on, see trackSLO
+	Handler   http.HandlerFunc   `json:"-"`
+	Canary    http.HandlerFunc   `json:"-"` // alternate implementation, see routeCanary
+	Shadow    http.HandlerFunc   `json:"-"` // gets a copy of requests, its response is only compared
+}
+
+// Pattern for http.ServeMux, e.g. "GET /status"
+func (route Route) Pattern() string {
+	if route.Method == "" {
+		return route.Path
+	}
+	return route.Method + " " + route.Path
+}
+
+// The service's route table
+func (a *App) Routes() []Route {
+	root := Route{Method: http.MethodGet, Path: "/{$}", Summary: "Hello World", Handler: a.rootHandler}
+	if a.Config.WebFS != nil {
+		root = Route{Method: http.MethodGet, Path: "/", Summary: "Single page application", Auth: AUTH_PUBLIC, Handler: a.spaHandler(a.Config.WebFS)}
+	}
+
+	routes := []Route{
+		root,
+		{Method: http.MethodGet, Path: "/healthz", Summary: "Liveness probe", Handler: a.healthzHandler},
+		{Method: http.MethodGet, Path: "/version", Summary: "Build and version details", Auth: AUTH_PUBLIC, Timeout: 10 * time.Second, Handler: a.versionHandler},
+		{Method: http.MethodGet, Path: "/openapi.json", Summary: "OpenAPI description of the routes", Auth: AUTH_PUBLIC, Timeout: 10 * time.Second, Handler: a.openAPIHandler},
+		{Method: http.MethodGet, Path: "/readyz", Summary: "Readiness probe", Auth: AUTH_PUBLIC, Timeout: 10 * time.Second, Handler: a.readyzHandler},
+		{Method: http.MethodPost, Path: "/login", Summary: "Exchange credentials for a token", Auth: AUTH_PUBLIC, RateLimit: 30, Timeout: 10 * time.Second, SLO: &SLO{Objective: 0.999, Latency: time.Second}, Handler: a.loginHandler},
+		{Method: http.MethodPost, Path: "/refresh", Summary: "Exchange a token for a new one", Auth: AUTH_PUBLIC, RateLimit: 30, Timeout: 10 * time.Second, SLO: &SLO{Objective: 0.999, Latency: 500 * time.Millisecond}, Handler: a.refreshHandler},
+		{Method: http.MethodPost, Path: "/logout", Summary: "Revoke the presented token", Auth: AUTH_PUBLIC, Timeout: 10 * time.Second, Handler: a.logoutHandler},
+		{Method: http.MethodGet, Path: "/protected", Summary: "Example protected resource", Auth: AUTH_CERT_OR_JWT, RateLimit: 120, Timeout: 10 * time.Second, Handler: a.protectedHandler},
+		{Method: http.MethodGet, Path: "/status", Summary: "Application metadata and version", Auth: AUTH_JWT, Scopes: []string{SCOPE_STATUS_READ}, Timeout: 10 * time.Second, CacheTTL: 10 * time.Second, SLO: &SLO{Objective: 0.99, Latency: 500 * time.Millisecond}, Handler: a.statusHandler},
+		{Method: http.MethodGet, Path: "/branding", Summary: "Branding of the caller's tenant", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: Handle(a, a.branding)},
+		{Method: http.MethodGet, Path: "/usage", Summary: "The caller's requests this month and their quota", Auth: AUTH_JWT, Unmetered: true, Timeout: 10 * time.Second, Handler: Handle(a, a.usage)},
+		{Method: http.MethodGet, Path: "/sessions", Summary: "List the caller's sessions", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: Handle(a, a.listSessions)},
+		{Method: http.MethodDelete, Path: "/sessions/{id}", Summary: "Revoke one of the caller's sessions", Auth: AUTH_JWT, SingleUse: true, Timeout: 10 * time.Second, Handler: Handle(a, a.deleteSession)},
+		{Method: http.MethodPost, Path: "/files", Summary: "Upload a file (multipart field \"file\")", Auth: AUTH_JWT, RateLimit: 30, Consumes: []string{MEDIA_TYPE_MULTIPART}, Handler: a.uploadFileHandler},
+		{Method: http.MethodGet, Path: "/files", Summary: "List the caller's files", Auth: AUTH_JWT, Handler: a.listFilesHandler},
+		{Method: http.MethodGet, Path: "/files/{id}", Summary: "Download one of the caller's files", Auth: AUTH_JWT, Handler: a.downloadFileHandler},
+		{Method: http.MethodDelete, Path: "/files/{id}", Summary: "Delete one of the caller's files", Auth: AUTH_JWT, SingleUse: true, Timeout: 10 * time.Second, Handler: a.deleteFileHandler},
+		{Method: http.MethodPost, Path: "/items", Summary: "Create an item owned by the caller", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: Handle(a, a.createItem)},
+		{Method: http.MethodGet, Path: "/items", Summary: "List the caller's items", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: Handle(a, a.listItems)},
+		{Method: http.MethodPost, Path: "/items:batchCreate", Summary: "Create up to 100 items, reporting each one's outcome", Auth: AUTH_JWT, Timeout: 30 * time.Second, Handler: HandleBatch(a, a.createItem)},
+		{Method: http.MethodPost, Path: "/items:batchDelete", Summary: "Delete up to 100 of the caller's items, reporting each one's outcome", Auth: AUTH_JWT, Timeout: 30 * time.Second, Handler: HandleBatch(a, a.deleteItem)},
+		{Method: http.MethodGet, Path: "/items/{id}", Summary: "One of the caller's items", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: a.RequireOwner("id", a.itemOwner, Handle(a, a.getItem))},
+		{Method: http.MethodPut, Path: "/items/{id}", Summary: "Rename or redescribe one of the caller's items", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: a.RequireOwner("id", a.itemOwner, Handle(a, a.updateItem))},
+		{Method: http.MethodDelete, Path: "/items/{id}", Summary: "Delete one of the caller's items", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: a.RequireOwner("id", a.itemOwner, Handle(a, a.deleteItem))},
+		{Method: http.MethodGet, Path: "/items/{id}/history", Summary: "The recorded changes of one of the caller's items, deleted or not", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: a.RequireOwner("id", a.itemOwner, Handle(a, a.itemHistory))},
+		{Method: http.MethodPost, Path: "/2fa/enroll", Summary: "Start TOTP enrollment", Auth: AUTH_JWT, SingleUse: true, Timeout: 10 * time.Second, Handler: a.enrollTwoFactorHandler},
+		{Method: http.MethodPost, Path: "/2fa/confirm", Summary: "Enable TOTP with a first code", Auth: AUTH_JWT, SingleUse: true, RateLimit: 30, Timeout: 10 * time.Second, Handler: a.confirmTwoFactorHandler},
+		{Method: http.MethodPost, Path: "/2fa/recovery-codes", Summary: "Replace the recovery codes", Auth: AUTH_JWT, SingleUse: true, TwoFactor: true, Timeout: 10 * time.Second, Handler: a.recoveryCodesHandler},
+		{Method: http.MethodPost, Path: "/2fa/disable", Summary: "Turn TOTP off", Auth: AUTH_JWT, SingleUse: true, TwoFactor: true, Timeout: 10 * time.Second, Handler: a.disableTwoFactorHandler},
+		{Method: http.MethodPost, Path: "/webhooks/{provider}", Summary: "Receive a signed webhook delivery", Auth: AUTH_PUBLIC, Timeout: 10 * time.Second, Consumes: []string{CONSUMES_ANY}, Handler: a.receiveWebhook},
+		{Method: http.MethodPost, Path: "/introspect", Summary: "RFC 7662 token introspection", Auth: AUTH_PUBLIC, Timeout: 10 * time.Second, Consumes: []string{MEDIA_TYPE_FORM}, Handler: a.introspectHandler},
+		{Method: http.MethodPost, Path: "/admin/unlock", Summary: "Lift a login lockout", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.unlock)},
+		{Method: http.MethodGet, Path: "/metrics", Summary: "Prometheus metrics", Listener: LISTENER_METRICS, Handler: a.metricsHandler},
+		{Method: http.MethodGet, Path: "/.well-known/jwks.json", Summary: "Public token verification keys", Handler: a.jwksHandler},
+		{Method: http.MethodPost, Path: "/admin/revocations/users/{id}", Summary: "Reject every token issued so far to a user", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.revokeUser)},
+		{Method: http.MethodPost, Path: "/admin/revocations/tenants/{tenant}", Summary: "Reject every token issued so far to a tenant's users", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.revokeTenant)},
+		{Method: http.MethodPost, Path: "/admin/keys/rotate", Summary: "Rotate the token signing key", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: a.rotateKeysHandler},
+		{Method: http.MethodGet, Path: "/admin/loglevel", Summary: "Current log level", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: a.getLogLevelHandler},
+		{Method: http.MethodPut, Path: "/admin/loglevel", Summary: "Change the log level, optionally for a limited time", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: a.setLogLevelHandler},
+		{Method: http.MethodGet, Path: "/admin/shutdown-status", Summary: "Which subsystems are running, draining or stopped", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.shutdownStatus)},
+		{Method: http.MethodGet, Path: "/admin/config", Summary: "Effective configuration", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: a.configHandler},
+		{Method: http.MethodGet, Path: "/admin/config/changes", Summary: "Recent metadata changes, newest first", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.listConfigChanges)},
+		{Method: http.MethodGet, Path: "/admin/route-groups", Summary: "Registered route groups and whether they are mounted", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.listRouteGroups)},
+		{Method: http.MethodPut, Path: "/admin/route-groups/{name}", Summary: "Mount a route group", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.mountRouteGroup)},
+		{Method: http.MethodDelete, Path: "/admin/route-groups/{name}", Summary: "Unmount a route group", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.unmountRouteGroup)},
+		{Method: http.MethodPost, Path: "/admin/webhooks/subscriptions", Summary: "Subscribe an endpoint to events", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.createSubscription)},
+		{Method: http.MethodGet, Path: "/admin/webhooks/subscriptions", Summary: "List webhook subscriptions", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.listSubscriptions)},
+		{Method: http.MethodDelete, Path: "/admin/webhooks/subscriptions/{id}", Summary: "Remove a webhook subscription", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.deleteSubscription)},
+		{Method: http.MethodGet, Path: "/admin/webhooks/subscriptions/{id}/deliveries", Summary: "Latest delivery attempts of a webhook subscription", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.listDeliveries)},
+		{Method: http.MethodGet, Path: "/admin/tenants", Summary: "Tenants with a config overlay", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.listTenantConfigs)},
+		{Method: http.MethodGet, Path: "/admin/tenants/{tenant}/config", Summary: "A tenant's config overlay and the settings it results in", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.getTenantConfig)},
+		{Method: http.MethodPut, Path: "/admin/tenants/{tenant}/config", Summary: "Set a tenant's config overlay", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.putTenantConfig)},
+		{Method: http.MethodDelete, Path: "/admin/tenants/{tenant}/config", Summary: "Remove a tenant's config overlay", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.deleteTenantConfig)},
+		{Method: http.MethodGet, Path: "/debug/vars", Summary: "expvar metrics", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: expvar.Handler().ServeHTTP},
+		{Method: http.MethodGet, Path: "/debug/goroutines", Summary: "Goroutines started by requests, per route", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: Handle(a, a.listGoroutines)},
+		{Path: "/debug/pprof/", Summary: "pprof index", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: pprof.Index},
+		{Path: "/debug/pprof/cmdline", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: pprof.Cmdline},
+		{Path: "/debug/pprof/profile", Summary: "CPU profile", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: pprof.Profile},
+		{Path: "/debug/pprof/symbol", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Consumes: []string{CONSUMES_ANY}, Handler: pprof.Symbol},
+		{Path: "/debug/pprof/trace", Summary: "Runtime execution trace", Auth: AUTH_ADMIN, Listener: LISTENER_ADMIN, Handler: pprof.Trace},
+	}
+	routes = append(routes, a.registrationRoutes()...)
+	if a.Config.Cookies.Name != "" {
+		routes = append(routes, Route{Method: http.MethodGet, Path: "/csrf", Summary: "CSRF token of the session cookie", Auth: AUTH_JWT, Handler: a.csrfHandler})
+	}
+	if a.Config.GraphQL {
+		routes = append(routes, Route{Method: http.MethodPost, Path: "/graphql", Summary: "GraphQL queries over users, status and sessions", Auth: AUTH_JWT, Timeout: 10 * time.Second, Handler: a.graphqlHandler()})
+	}
+	return routes
+}
+
+// Builds the static routes and serves them
+func (a *App) routes() {
+	for _, route := range a.Routes() {
+		a.staticRoutes = append(a.staticRoutes, a.build(route))
+	}
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	if err := a.swapRouters(); err != nil {
+		panic(err) // conflicting patterns in the route table
+	}
+}
+
+// Wraps a route in the middleware its table entry asks for
+func (a *App) build(route Route) builtRoute {
+	pattern := route.Pattern()
+
+	// Tracked on both sides of the route timeout, which buffers the handler's writes
+	handler := a.cacheResponses(pattern, route.CacheTTL, timed(TIMING_HANDLER, trackResponses(a.readYourWrites(route.Handler))))
+	// Canary responses bypass the cache so the two implementations never mix
+	if route.Canary != nil {
+		handler = a.routeCanary(pattern, handler, route.Canary)
+	}
+	if target, ok := a.shadowTarget(route); ok {
+		handler = a.shadow(pattern, target, handler)
+	}
+	// Outside the cache, so a cached response can't be replayed either
+	if route.SingleUse || contains(configList(a.Config.SingleUseRoutes), pattern) {
+		handler = a.singleUse(pattern, handler)
+	}
+	if !route.Unmetered {
+		handler = a.enforceQuota(handler)
+	}
+	handler = a.rateLimit(pattern, route.RateLimit, handler)
+	if len(route.Roles) > 0 {
+		handler = a.requireRoles(route.Roles, handler)
+	}
+	if len(route.Scopes) > 0 {
+		handler = a.requireScope(route.Scopes, handler)
+	}
+	if len(route.Claims) > 0 {
+		handler = a.requireClaims(route.Claims, handler)
+	}
+	if route.TwoFactor {
+		handler = a.requireTwoFactor(handler)
+	}
+	handler = a.enforcePolicy(pattern, handler)
+	// Checked once the caller is known, but before a rejected body costs quota or a token use
+	handler = a.requireContentType(pattern, route.Consumes, handler)
+	// Inside the timeout, so the count sees the deadline it sets
+	handler = countCanceled(pattern, timed(TIMING_AUTH, a.authenticateRoute(pattern, route.Auth, finishTiming(TIMING_AUTH, handler))))
+	if route.Timeout > 0 {
+		handler = http.TimeoutHandler(handler, route.Timeout, ROUTE_TIMEOUT_MSG).ServeHTTP
+	}
+	handler = a.enforceBudget(pattern, route.Timeout > 0, handler)
+	handler = a.recoverPanics(pattern, a.trackGoroutines(pattern, a.shedLoad(pattern, a.logSlowRequests(pattern, handler))))
+	handler = trackResponses(measureRequests(pattern, a.trackSLO(pattern, route.SLO, handler)))
+
+	return builtRoute{listener: route.Listener, pattern: pattern, auth: route.Auth, handler: handler}
+}
+
+// The router for listener, the main Router unless the listener has its own port
+func (a *App) routerFor(listener string) *Router {
+	switch {
+	case listener == LISTENER_ADMIN && a.AdminRouter != nil:
+		return a.AdminRouter
+	case listener == LISTENER_METRICS && a.MetricsRouter != nil:
+		return a.MetricsRouter
+	}
+	return a.Router
+}
+
+// Wraps next with the middleware for an auth mode
+func (a *App) authenticate(mode string, next http.HandlerFunc) http.HandlerFunc {
+	switch mode {
+	case AUTH_JWT:
+		return a.authenticateWith([]string{STRATEGY_JWT}, next)
+	case AUTH_MTLS:
+		return a.authenticateWith([]string{STRATEGY_MTLS}, next)
+	case AUTH_CERT_OR_JWT:
+		return a.authenticateWith([]string{STRATEGY_MTLS, STRATEGY_JWT}, next)
+	case AUTH_ADMIN:
+		return a.requireAdmin(next)
+	case AUTH_PUBLIC:
+		return next
+	case AUTH_DEFAULT:
+		return a.authenticateUnlessPublic(next)
+	default:
+		// Any other value names strategies to try in order, e.g. "apikey,jwt"
+		return a.authenticateWith(parseStrategies(mode), next)
+	}
+}
+
+// Lets requests for paths matching public-routes through and authenticates the rest
+// with the auth-strategies, so routes are protected unless explicitly made public
+func (a *App) authenticateUnlessPublic(next http.HandlerFunc) http.HandlerFunc {
+	patterns := parsePublicRoutes(a.Config.PublicRoutes)
+	withToken := a.authenticateWith(parseStrategies(a.Config.Auth.Strategies), next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if matchesAnyRoute(patterns, r.URL.Path) {
+			next(w, r)
+			return
+		}
+		withToken(w, r)
+	}
+}
+
+func parsePublicRoutes(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Matches urlPath against glob patterns. "*" matches within one path segment
+// (path.Match syntax); a trailing "/**" matches everything below a prefix.
+func matchesAnyRoute(patterns []string, urlPath string) bool {
+	for _, pattern := range patterns {
+		if prefix, ok := strings.CutSuffix(pattern, "/**"); ok {
+			if urlPath == prefix || strings.HasPrefix(urlPath, prefix+"/") {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, urlPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Only lets principals holding at least one of roles (from the "roles" claim) through
+func (a *App) requireRoles(roles []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Authentication required")
+			return
+		}
+		if !user.HasAnyRole(roles...) {
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Insufficient role")
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Backoff between background reloads of route settings while the metadata source fails
+const (
+	ROUTE_SETTINGS_RETRY_MIN = time.Second
+	ROUTE_SETTINGS_RETRY_MAX = time.Minute
+)
+
+// Operational settings of one route, declared in the "routes" object of the metadata
+// document by pattern so they can be tuned without a deploy, e.g.
+//
+//	{"routes": {"GET /status": {"corsOrigins": ["https://app.example.com"], "rateLimit": 60, "auth": "jwt"}}}
+//
+// They take precedence over the route table and the flags from the next request after
+// the metadata reloads. Whoever controls the metadata source can't lower a route's
+// protection though: an auth that would let through requests the table's refuses is
+// ignored, and so are all settings of admin routes.
+type RouteSettings struct {
+	CORSOrigins []string `json:"corsOrigins,omitempty"` // replaces cors-origins for the route; "*" allows any
+	RateLimit   *int     `json:"rateLimit,omitempty"`   // requests per minute per client; 0 turns the limit off
+	Auth        string   `json:"auth,omitempty"`        // an auth mode as in the route table, or strategies in order
+}
+
+// The settings declared for the route pattern. Until the metadata has loaded, and
+// while it is expired, the last loaded settings apply; a reload is started in the
+// background so the lookup never waits on the metadata source. One reload runs at a
+// time, and after a failure the next waits, from ROUTE_SETTINGS_RETRY_MIN doubling up
+// to ROUTE_SETTINGS_RETRY_MAX.
+func (a *App) routeSettingsFor(pattern string) (RouteSettings, bool) {
+	if _, ok := a.configCache.Get(CONFIG_CACHE_KEY); !ok && time.Now().UnixNano() >= a.routeSettingsRetry.Load() &&
+		a.routeSettingsReload.CompareAndSwap(false, true) {
+		go func() {
+			defer a.routeSettingsReload.Store(false)
+			if _, err := a.loadConfiguration(context.Background()); err != nil {
+				a.routeSettingsDelay = min(max(2*a.routeSettingsDelay, ROUTE_SETTINGS_RETRY_MIN), ROUTE_SETTINGS_RETRY_MAX)
+				a.routeSettingsRetry.Store(time.Now().Add(a.routeSettingsDelay).UnixNano())
+				a.Logger.Printf("Route settings reload failed, retrying in %s: %v", a.routeSettingsDelay, err)
+				return
+			}
+			a.routeSettingsDelay = 0
+		}()
+	}
+	table := a.routeSettings.Load()
+	if table == nil {
+		return RouteSettings{}, false
+	}
+	settings, ok := (*table)[pattern]
+	return settings, ok
+}
+
+// Parses the "routes" object of freshly loaded metadata and makes it the one in effect.
+// Invalid entries are logged and left out, so the route keeps its table settings. The
+// caller holds configMutex.
+func (a *App) applyRouteSettings(value interface{}) {
+	table := map[string]RouteSettings{}
+	entries, ok := value.(map[string]interface{})
+	if value != nil && !ok {
+		a.Logger.Println("Ignoring route settings: \"routes\" is not an object")
+	}
+	modes := a.routeAuthModes()
+	for pattern, entry := range entries {
+		settings, err := a.parseRouteSettings(entry)
+		if err != nil {
+			a.Logger.Printf("Ignoring route settings of %s: %v", pattern, err)
+			continue
+		}
+		mode, known := modes[pattern]
+		switch {
+		case known && mode == AUTH_ADMIN:
+			a.Logger.Printf("Ignoring route settings of %s: admin routes can't be overridden", pattern)
+			continue
+		case !known && settings.Auth != "":
+			// Its protection can't be compared, so it can't be changed
+			a.Logger.Printf("Ignoring route settings of %s: no such route to set the auth of", pattern)
+			continue
+		case !known:
+			a.Logger.Printf("Route settings of %s: no such route", pattern)
+		case settings.Auth != "" && a.weakensAuth(mode, settings.Auth):
+			a.Logger.Printf("Ignoring route settings of %s: auth %q is weaker than the route's %q", pattern, settings.Auth, mode)
+			continue
+		}
+		table[pattern] = settings
+	}
+	a.routeSettings.Store(&table)
+
+	patterns := make([]string, 0, len(table))
+	for pattern := range table {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	a.Log.Info("route settings applied", "routes", patterns)
+}
+
+func (a *App) parseRouteSettings(entry interface{}) (RouteSettings, error) {
+	var settings RouteSettings
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return settings, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return settings, err
+	}
+	if settings.RateLimit != nil && *settings.RateLimit < 0 {
+		return settings, fmt.Errorf("negative rateLimit %d", *settings.RateLimit)
+	}
+	switch settings.Auth {
+	case AUTH_DEFAULT, AUTH_PUBLIC, AUTH_JWT, AUTH_MTLS, AUTH_CERT_OR_JWT, AUTH_ADMIN:
+	default:
+		for _, name := range parseStrategies(settings.Auth) {
+			if _, ok := a.AuthStrategies[name]; !ok {
+				return settings, fmt.Errorf("unknown auth strategy %q", name)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// Auth modes of the routes in the table and the registered groups, by pattern
+func (a *App) routeAuthModes() map[string]string {
+	a.routeMutex.Lock()
+	defer a.routeMutex.Unlock()
+	modes := map[string]string{}
+	for _, route := range a.staticRoutes {
+		modes[route.pattern] = route.auth
+	}
+	for _, group := range a.routeGroups {
+		for _, route := range group.routes {
+			modes[route.pattern] = route.auth
+		}
+	}
+	return modes
+}
+
+// Whether override would let through requests that mode refuses. Admin routes keep
+// their mode; public and default ones can be tightened to anything but public, and
+// authenticated ones narrowed to some of the strategies they accept, or to admin.
+func (a *App) weakensAuth(mode, override string) bool {
+	switch {
+	case override == mode:
+		return false
+	case mode == AUTH_ADMIN, override == AUTH_PUBLIC:
+		return true
+	case override == AUTH_ADMIN, mode == AUTH_PUBLIC:
+		return false
+	}
+	accepted := a.modeStrategies(mode)
+	for _, strategy := range a.modeStrategies(override) {
+		if !contains(accepted, strategy) {
+			return true
+		}
+	}
+	return false
+}
+
+// The strategies an authenticated mode tries, see authenticate
+func (a *App) modeStrategies(mode string) []string {
+	switch mode {
+	case AUTH_JWT:
+		return []string{STRATEGY_JWT}
+	case AUTH_MTLS:
+		return []string{STRATEGY_MTLS}
+	case AUTH_CERT_OR_JWT:
+		return []string{STRATEGY_MTLS, STRATEGY_JWT}
+	case AUTH_DEFAULT:
+		return parseStrategies(a.Config.Auth.Strategies)
+	}
+	return parseStrategies(mode)
+}
+
+// Authenticates with the auth mode the route settings declare, or mode from the table.
+// A declared mode that is weaker than the table's is ignored, see weakensAuth.
+func (a *App) authenticateRoute(route, mode string, next http.HandlerFunc) http.HandlerFunc {
+	var mutex sync.Mutex
+	byMode := map[string]http.HandlerFunc{mode: a.authenticate(mode, next)}
+	return func(w http.ResponseWriter, r *http.Request) {
+		current := mode
+		if settings, ok := a.routeSettingsFor(route); ok && settings.Auth != "" && !a.weakensAuth(mode, settings.Auth) {
+			current = settings.Auth
+		}
+		mutex.Lock()
+		handler, ok := byMode[current]
+		if !ok {
+			handler = a.authenticate(current, next)
+			byMode[current] = handler
+		}
+		mutex.Unlock()
+		handler(w, r)
+	}
+}
+
+// The pattern of the main router's route for r, empty when none matches. A CORS
+// preflight is matched as the request it announces.
+func (a *App) routePattern(r *http.Request) string {
+	probe := *r
+	if method := r.Header.Get("Access-Control-Request-Method"); r.Method == http.MethodOptions && method != "" {
+		probe.Method = strings.ToUpper(method)
+	}
+	_, pattern := a.Router.mux.Load().Handler(&probe)
+	return pattern
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// When the process started, as near as the package can tell
+var processStart = time.Now()
+
+// Bounds the version source lookup for build_info, e.g. the git source on a slow disk
+const BUILD_INFO_TIMEOUT = time.Second
+
+// Kernel clock ticks per second, the unit of the CPU times in /proc/self/stat. Linux
+// reports them in USER_HZ, which is 100 on every architecture Go supports.
+const PROC_TICKS_PER_SECOND = 100
+
+// Runtime metrics read on every scrape, under the names client_golang gives them so
+// existing dashboards keep working
+var runtimeSamples = []struct {
+	name, help, key string
+}{
+	{"go_memstats_heap_alloc_bytes", "Bytes of allocated heap objects.", "/memory/classes/heap/objects:bytes"},
+	{"go_memstats_heap_objects", "Number of allocated heap objects.", "/gc/heap/objects:objects"},
+	{"go_memstats_next_gc_bytes", "Heap size the next garbage collection aims for.", "/gc/heap/goal:bytes"},
+	{"go_memstats_sys_bytes", "Bytes of memory obtained from the OS.", "/memory/classes/total:bytes"},
+	{"go_gomaxprocs", "Value of GOMAXPROCS.", "/sched/gomaxprocs:threads"},
+}
+
+// Writes the Go runtime and process metrics and build_info, whose labels let dashboards
+// slice everything else by deployed version. Process metrics come from /proc and are
+// left out where there is none.
+func (a *App) writeRuntimeMetrics(ctx context.Context, w io.Writer, openMetrics bool) {
+	ctx, cancel := context.WithTimeout(ctx, BUILD_INFO_TIMEOUT)
+	defer cancel()
+	info := a.BuildInfo(ctx)
+	writeInfoMetric(w, openMetrics, "build", "Build of the running service.",
+		metricLabel("service", info.Service)+","+metricLabel("version", info.Version)+","+metricLabel("sha", info.SHA)+","+
+			metricLabel("build", info.BuildNumber)+","+metricLabel("go_version", info.GoVersion)+","+metricLabel("profile", info.Profile))
+	writeInfoMetric(w, openMetrics, "go", "Version of the Go runtime.", metricLabel("version", runtime.Version()))
+
+	writeGauge(w, "go_goroutines", "Number of goroutines that currently exist.", float64(runtime.NumGoroutine()))
+	writeGauge(w, "go_threads", "Number of OS threads created.", float64(pprof.Lookup("threadcreate").Count()))
+	samples := make([]metrics.Sample, len(runtimeSamples))
+	for i, sample := range runtimeSamples {
+		samples[i].Name = sample.key
+	}
+	metrics.Read(samples)
+	for i, sample := range samples {
+		switch sample.Value.Kind() {
+		case metrics.KindUint64:
+			writeGauge(w, runtimeSamples[i].name, runtimeSamples[i].help, float64(sample.Value.Uint64()))
+		case metrics.KindFloat64:
+			writeGauge(w, runtimeSamples[i].name, runtimeSamples[i].help, sample.Value.Float64())
+		}
+	}
+
+	// GC pauses as a summary of the most recent ones, like client_golang
+	var gc debug.GCStats
+	gc.PauseQuantiles = make([]time.Duration, 5)
+	debug.ReadGCStats(&gc)
+	writeHeaderLine(w, "go_gc_duration_seconds", "Stop-the-world pause durations of the garbage collector.", "summary")
+	for i, quantile := range []string{"0", "0.25", "0.5", "0.75", "1"} {
+		fmt.Fprintf(w, "go_gc_duration_seconds{quantile=%q} %s\n", quantile, formatMetric(gc.PauseQuantiles[i].Seconds()))
+	}
+	fmt.Fprintf(w, "go_gc_duration_seconds_sum %s\n", formatMetric(gc.PauseTotal.Seconds()))
+	fmt.Fprintf(w, "go_gc_duration_seconds_count %d\n", gc.NumGC)
+
+	writeGauge(w, "process_start_time_seconds", "Start time of the process since the Unix epoch in seconds.", float64(processStart.UnixMilli())/1000)
+	if stat, err := readProcStat(); err == nil {
+		writeCounter(w, openMetrics, "process_cpu_seconds", "Total user and system CPU time spent in seconds.", stat.cpuSeconds)
+		writeGauge(w, "process_resident_memory_bytes", "Resident memory size in bytes.", stat.residentBytes)
+		writeGauge(w, "process_virtual_memory_bytes", "Virtual memory size in bytes.", stat.virtualBytes)
+	}
+	if fds, err := os.ReadDir("/proc/self/fd"); err == nil {
+		writeGauge(w, "process_open_fds", "Number of open file descriptors.", float64(len(fds)))
+	}
+	if limit, err := readMaxFDs(); err == nil {
+		writeGauge(w, "process_max_fds", "Maximum number of open file descriptors.", limit)
+	}
+}
+
+// Writes an info metric: a gauge of 1 named <name>_info in Prometheus, the info type in
+// OpenMetrics
+func writeInfoMetric(w io.Writer, openMetrics bool, name, help, labels string) {
+	if openMetrics {
+		writeHeaderLine(w, name, help, "info")
+	} else {
+		writeHeaderLine(w, name+"_info", help, "gauge")
+	}
+	fmt.Fprintf(w, "%s_info{%s} 1\n", name, labels)
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHeaderLine(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", name, formatMetric(value))
+}
+
+// The sample ends in _total; OpenMetrics names the family without it
+func writeCounter(w io.Writer, openMetrics bool, name, help string, value float64) {
+	family := name + "_total"
+	if openMetrics {
+		family = name
+	}
+	writeHeaderLine(w, family, help, "counter")
+	fmt.Fprintf(w, "%s_total %s\n", name, formatMetric(value))
+}
+
+func writeHeaderLine(w io.Writer, family, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, help, family, kind)
+}
+
+func formatMetric(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+type procStat struct {
+	cpuSeconds    float64
+	residentBytes float64
+	virtualBytes  float64
+}
+
+// Reads /proc/self/stat, see proc(5)
+func readProcStat() (procStat, error) {
+	data, err := os.ReadFile("/proc/self/stat")
+	if err != nil {
+		return procStat{}, err
+	}
+	// The command name in parentheses may contain spaces; the fields after it start
+	// with the state, field 3
+	end := bytes.LastIndexByte(data, ')')
+	if end < 0 {
+		return procStat{}, fmt.Errorf("unexpected /proc/self/stat")
+	}
+	fields := strings.Fields(string(data[end+1:]))
+	if len(fields) < 22 {
+		return procStat{}, fmt.Errorf("unexpected /proc/self/stat")
+	}
+	field := func(n int) float64 {
+		value, _ := strconv.ParseFloat(fields[n-3], 64)
+		return value
+	}
+	return procStat{
+		cpuSeconds:    (field(14) + field(15)) / PROC_TICKS_PER_SECOND,
+		virtualBytes:  field(23),
+		residentBytes: field(24) * float64(os.Getpagesize()),
+	}, nil
+}
+
+// The soft limit on open files from /proc/self/limits
+func readMaxFDs() (float64, error) {
+	file, err := os.Open("/proc/self/limits")
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rest, ok := strings.CutPrefix(scanner.Text(), "Max open files"); ok {
+			fields := strings.Fields(rest)
+			if len(fields) == 0 || fields[0] == "unlimited" {
+				break
+			}
+			return strconv.ParseFloat(fields[0], 64)
+		}
+	}
+	return 0, fmt.Errorf("no open file limit in /proc/self/limits")
+}
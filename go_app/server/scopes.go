@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Claim listing the scopes a token was granted, e.g. "status:read files:write"
+const SCOPE_CLAIM = "scope"
+
+// Scope of GET /status and the status query of /graphql
+const SCOPE_STATUS_READ = "status:read"
+
+// Splits a space separated scope string, dropping duplicates
+func parseScopes(value string) []string {
+	var scopes []string
+	for _, scope := range strings.Fields(value) {
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+func claimScopes(claims jwt.MapClaims) []string {
+	switch scopes := claims[SCOPE_CLAIM].(type) {
+	case string:
+		return parseScopes(scopes)
+	case []interface{}:
+		var parsed []string
+		for _, scope := range scopes {
+			if scope, ok := scope.(string); ok {
+				parsed = append(parsed, scope)
+			}
+		}
+		return parsed
+	}
+	return nil
+}
+
+// The scopes a new token gets: those requested, or all of held when the client asks
+// for none, narrowed to the ones token-scopes still grants. Unknown scopes are dropped
+// rather than refused, as OAuth 2.0 allows.
+func (a *App) grantScopes(requested string, held []string) []string {
+	allowed := parseScopes(a.Config.Tokens.Scopes)
+	candidates := held
+	if wanted := parseScopes(requested); len(wanted) > 0 {
+		candidates = wanted
+	}
+	granted := []string{}
+	for _, scope := range candidates {
+		if contains(allowed, scope) && contains(held, scope) {
+			granted = append(granted, scope)
+		}
+	}
+	return granted
+}
+
+// Answers 403 unless the token was granted every one of scopes. Principals without a
+// token, such as client certificates, have no scopes.
+func (a *App) requireScope(scopes []string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Authentication required")
+			return
+		}
+		if !user.HasScopes(scopes...) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+strings.Join(scopes, " ")+`"`)
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Insufficient scope")
+			return
+		}
+		next(w, r)
+	}
+}
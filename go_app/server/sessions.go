@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A login on one device. Tokens carry the session ID in their "sid" claim and can only
+// be used and refreshed while the session exists.
+type Session struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"-"`
+	UserAgent string    `json:"userAgent"`
+	IP        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+}
+
+// Persists sessions
+type SessionStore interface {
+	Create(ctx context.Context, session Session) error
+	Get(ctx context.Context, id string) (Session, bool, error)
+	// Records a refresh from ip with userAgent at now
+	Touch(ctx context.Context, id, ip, userAgent string, now time.Time) error
+	List(ctx context.Context, userID string) ([]Session, error)
+	Delete(ctx context.Context, id string) error
+	// Removes sessions last used before cutoff
+	Prune(ctx context.Context, cutoff time.Time) error
+}
+
+// Random 128-bit identifier, hex encoded
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+type memorySessionStore struct {
+	mutex    sync.Mutex
+	sessions map[string]Session
+}
+
+func NewMemorySessionStore() SessionStore {
+	return &memorySessionStore{sessions: make(map[string]Session)}
+}
+
+func (s *memorySessionStore) Create(ctx context.Context, session Session) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sessions[session.ID] = session
+	return nil
+}
+
+func (s *memorySessionStore) Get(ctx context.Context, id string) (Session, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	session, ok := s.sessions[id]
+	return session, ok, nil
+}
+
+func (s *memorySessionStore) Touch(ctx context.Context, id, ip, userAgent string, now time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if session, ok := s.sessions[id]; ok {
+		session.IP, session.UserAgent, session.LastUsed = ip, userAgent, now
+		s.sessions[id] = session
+	}
+	return nil
+}
+
+func (s *memorySessionStore) List(ctx context.Context, userID string) ([]Session, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var sessions []Session
+	for _, session := range s.sessions {
+		if session.UserID == userID {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].LastUsed.After(sessions[j].LastUsed) })
+	return sessions, nil
+}
+
+func (s *memorySessionStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.sessions, id)
+	return nil
+}
+
+func (s *memorySessionStore) Prune(ctx context.Context, cutoff time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, session := range s.sessions {
+		if session.LastUsed.Before(cutoff) {
+			delete(s.sessions, id)
+		}
+	}
+	return nil
+}
+
+// Sessions in a SQL database; timestamps are stored as Unix seconds for portability
+type sqlSessionStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const sessionsSchema = `CREATE TABLE IF NOT EXISTS sessions (
+	id TEXT PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	user_agent TEXT NOT NULL,
+	ip TEXT NOT NULL,
+	created_at BIGINT NOT NULL,
+	last_used_at BIGINT NOT NULL
+)`
+
+// Creates the sessions table if needed
+func NewSQLSessionStore(db *sql.DB, driver string) (SessionStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	for _, statement := range []string{
+		sessionsSchema,
+		`CREATE INDEX IF NOT EXISTS sessions_user_id ON sessions (user_id)`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlSessionStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlSessionStore) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, query), args...)
+	return err
+}
+
+func (s *sqlSessionStore) Create(ctx context.Context, session Session) error {
+	return s.exec(ctx, `INSERT INTO sessions (id, user_id, user_agent, ip, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		session.ID, session.UserID, session.UserAgent, session.IP, session.Created.Unix(), session.LastUsed.Unix())
+}
+
+func scanSession(row interface{ Scan(...interface{}) error }) (Session, error) {
+	var session Session
+	var created, lastUsed int64
+	err := row.Scan(&session.ID, &session.UserID, &session.UserAgent, &session.IP, &created, &lastUsed)
+	session.Created, session.LastUsed = time.Unix(created, 0), time.Unix(lastUsed, 0)
+	return session, err
+}
+
+func (s *sqlSessionStore) Get(ctx context.Context, id string) (Session, bool, error) {
+	row := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT id, user_id, user_agent, ip, created_at, last_used_at FROM sessions WHERE id = ?`), id)
+	session, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, false, nil
+	}
+	if err != nil {
+		return Session{}, false, err
+	}
+	return session, true, nil
+}
+
+func (s *sqlSessionStore) Touch(ctx context.Context, id, ip, userAgent string, now time.Time) error {
+	return s.exec(ctx, `UPDATE sessions SET ip = ?, user_agent = ?, last_used_at = ? WHERE id = ?`, ip, userAgent, now.Unix(), id)
+}
+
+func (s *sqlSessionStore) List(ctx context.Context, userID string) ([]Session, error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.driver, `SELECT id, user_id, user_agent, ip, created_at, last_used_at FROM sessions WHERE user_id = ? ORDER BY last_used_at DESC`), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqlSessionStore) Delete(ctx context.Context, id string) error {
+	return s.exec(ctx, `DELETE FROM sessions WHERE id = ?`, id)
+}
+
+func (s *sqlSessionStore) Prune(ctx context.Context, cutoff time.Time) error {
+	return s.exec(ctx, `DELETE FROM sessions WHERE last_used_at < ?`, cutoff.Unix())
+}
+
+// Starts a session for a login from r and returns its ID. With session-limit, the
+// user's least recently used sessions end to make room for it.
+func (a *App) startSession(r *http.Request, userID string) (string, error) {
+	if a.Config.SessionLimit > 0 {
+		sessions, err := a.stores(r.Context()).Sessions.List(r.Context(), userID)
+		if err != nil {
+			return "", err
+		}
+		// Listed most recently used first
+		for _, session := range sessions[min(len(sessions), a.Config.SessionLimit-1):] {
+			if err := a.stores(r.Context()).Sessions.Delete(r.Context(), session.ID); err != nil {
+				return "", err
+			}
+			a.Logger.Printf("audit: event=session_evicted session=%s user=%s ip=%s", session.ID, userID, clientIP(r))
+		}
+	}
+	id, err := newRandomID()
+	if err != nil {
+		return "", err
+	}
+	now := a.clock(r.Context()).Now()
+	return id, a.stores(r.Context()).Sessions.Create(r.Context(), Session{
+		ID:        id,
+		UserID:    userID,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+		Created:   now,
+		LastUsed:  now,
+	})
+}
+
+// Reports whether the session named by the token's sid claim is still active: neither
+// idle for longer than session-idle-timeout nor older than session-max-age. Tokens
+// without a sid, such as those minted before sessions existed, have nothing to check.
+func (a *App) sessionActive(ctx context.Context, claims map[string]interface{}) (bool, error) {
+	sid, ok := claims["sid"].(string)
+	if !ok {
+		return true, nil
+	}
+	session, exists, err := a.stores(ctx).Sessions.Get(ctx, sid)
+	if err != nil || !exists {
+		return false, err
+	}
+	now := a.clock(ctx).Now()
+	if a.Config.SessionMaxAge > 0 && now.Sub(session.Created) > a.Config.SessionMaxAge {
+		return false, nil
+	}
+	return now.Sub(session.LastUsed) <= a.Config.SessionIdleTimeout, nil
+}
+
+// Lists the caller's sessions, marking the one the request was made with
+func (a *App) listSessions(ctx context.Context, _ struct{}) (sessionList, error) {
+	user, _ := UserFromContext(ctx)
+	sessions, err := a.stores(ctx).Sessions.List(ctx, user.ID)
+	if err != nil {
+		return sessionList{}, fmt.Errorf("session listing: %w", err)
+	}
+
+	current, _ := user.Claims["sid"].(string)
+	list := sessionList{Sessions: []sessionView{}}
+	for _, session := range sessions {
+		list.Sessions = append(list.Sessions, sessionView{Session: session, Current: session.ID == current})
+	}
+	return list, nil
+}
+
+type sessionView struct {
+	Session
+	Current bool `json:"current"`
+}
+
+type sessionList struct {
+	Sessions []sessionView `json:"sessions"`
+}
+
+type sessionRequest struct {
+	ID string `path:"id"`
+}
+
+// Revokes one of the caller's sessions; its tokens stop working and cannot be refreshed
+func (a *App) deleteSession(ctx context.Context, request sessionRequest) (NoContent, error) {
+	user, _ := UserFromContext(ctx)
+	session, exists, err := a.stores(ctx).Sessions.Get(ctx, request.ID)
+	if err != nil {
+		return NoContent{}, fmt.Errorf("session lookup: %w", err)
+	}
+	// Other users' sessions are reported as missing so their IDs cannot be probed
+	if !exists || session.UserID != user.ID {
+		return NoContent{}, &RejectError{Status: http.StatusNotFound, Message: "Not Found: Session does not exist"}
+	}
+
+	if err := a.stores(ctx).Sessions.Delete(ctx, session.ID); err != nil {
+		return NoContent{}, fmt.Errorf("session deletion: %w", err)
+	}
+	a.Logger.Printf("audit: event=session_revoked session=%s user=%s ip=%s", session.ID, user.ID, clientIPFromContext(ctx))
+	return NoContent{}, nil
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Members reported per comparison; a shadow that differs everywhere is summed up by
+// the first ones
+const MAX_SHADOW_DIFFERENCES = 20
+
+// The JSON Pointers of the members that differ between the served and the shadow
+// response, sorted, leaving out those ignored matches. ok is false when the two can't
+// be compared as JSON: either isn't JSON, or was larger than MAX_SHADOW_BODY.
+func jsonDifferences(served, shadowed *digestWriter, ignored func(pointer string) bool) (differences []string, ok bool) {
+	servedDocument, ok := jsonDocument(served)
+	if !ok {
+		return nil, false
+	}
+	shadowDocument, ok := jsonDocument(shadowed)
+	if !ok {
+		return nil, false
+	}
+	collectDifferences(servedDocument, shadowDocument, "", ignored, &differences)
+	return differences, true
+}
+
+func jsonDocument(w *digestWriter) (interface{}, bool) {
+	mediaType, _, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.truncated || !(mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) {
+		return nil, false
+	}
+	var document interface{}
+	if err := json.Unmarshal(w.body.Bytes(), &document); err != nil {
+		return nil, false
+	}
+	return document, true
+}
+
+func collectDifferences(served, shadowed interface{}, path string, ignored func(string) bool, differences *[]string) {
+	if len(*differences) >= MAX_SHADOW_DIFFERENCES || ignored(path) {
+		return
+	}
+	switch served := served.(type) {
+	case map[string]interface{}:
+		shadowed, ok := shadowed.(map[string]interface{})
+		if !ok {
+			break
+		}
+		names := make([]string, 0, len(served)+len(shadowed))
+		for name := range served {
+			names = append(names, name)
+		}
+		for name := range shadowed {
+			if _, ok := served[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			servedMember, ok := served[name]
+			if !ok {
+				servedMember = missingMember{}
+			}
+			shadowMember, ok := shadowed[name]
+			if !ok {
+				shadowMember = missingMember{}
+			}
+			collectDifferences(servedMember, shadowMember, pointer(path, name), ignored, differences)
+		}
+		return
+	case []interface{}:
+		shadowed, ok := shadowed.([]interface{})
+		if !ok {
+			break
+		}
+		for i := 0; i < max(len(served), len(shadowed)); i++ {
+			var servedItem, shadowItem interface{} = missingMember{}, missingMember{}
+			if i < len(served) {
+				servedItem = served[i]
+			}
+			if i < len(shadowed) {
+				shadowItem = shadowed[i]
+			}
+			collectDifferences(servedItem, shadowItem, fmt.Sprintf("%s/%d", path, i), ignored, differences)
+		}
+		return
+	}
+	if !reflect.DeepEqual(served, shadowed) {
+		*differences = append(*differences, path)
+	}
+}
+
+// Stands for a member or item one of the responses lacks, which differs from null
+type missingMember struct{}
+
+// Matchers for the JSON Pointers of shadow-ignore
+func (a *App) shadowIgnored() func(pointer string) bool {
+	patterns := configList(a.Config.Traffic.ShadowIgnore)
+	return func(pointer string) bool {
+		for _, pattern := range patterns {
+			if pointerMatches(pattern, pointer) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Reports whether pointer matches pattern, a JSON Pointer whose "*" segments match any
+// one member or index
+func pointerMatches(pattern, pointer string) bool {
+	patternSegments, segments := strings.Split(pattern, "/"), strings.Split(pointer, "/")
+	if len(patternSegments) != len(segments) {
+		return false
+	}
+	for i, segment := range patternSegments {
+		if segment != "*" && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The pointer with array indices replaced by "*", so the differences metric has one
+// series per member rather than per item
+func fieldPattern(pointer string) string {
+	segments := strings.Split(pointer, "/")
+	for i, segment := range segments {
+		if segment != "" && strings.Trim(segment, "0123456789") == "" {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go_app/lifecycle"
+)
+
+// How long stopping may take, and each subsystem within it
+type ShutdownConfig struct {
+	// All of it; keep below the pod's terminationGracePeriodSeconds so the process
+	// exits on its own rather than being killed. 0 is no limit.
+	GracePeriod time.Duration
+	// Per subsystem, overriding their own, e.g. "message consumer=10s,public server=20s"
+	Timeouts string
+}
+
+func (c ShutdownConfig) validate() error {
+	if c.GracePeriod < 0 {
+		return fmt.Errorf("shutdown-grace-period must not be negative, got %s", c.GracePeriod)
+	}
+	_, err := parseShutdownTimeouts(c.Timeouts)
+	return err
+}
+
+// Parses "name=duration" pairs separated by commas, names as listed by
+// /admin/shutdown-status
+func parseShutdownTimeouts(value string) (map[string]time.Duration, error) {
+	timeouts := map[string]time.Duration{}
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, duration, ok := strings.Cut(entry, "=")
+		timeout, err := time.ParseDuration(strings.TrimSpace(duration))
+		if !ok || err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("shutdown-timeouts: want name=duration, got %q", entry)
+		}
+		timeouts[strings.TrimSpace(name)] = timeout
+	}
+	return timeouts, nil
+}
+
+// Progress of stopping the App, see GET /admin/shutdown-status
+type ShutdownStatus struct {
+	State      string            `json:"state"`              // running, draining or stopped
+	Started    string            `json:"started,omitempty"`  // when draining began
+	Deadline   string            `json:"deadline,omitempty"` // when shutdown-grace-period runs out
+	Subsystems []SubsystemStatus `json:"subsystems"`         // in start order; they stop in reverse
+}
+
+type SubsystemStatus struct {
+	Name    string `json:"name"`
+	State   string `json:"state"` // see the lifecycle.STATE_ constants
+	Timeout string `json:"timeout"`
+	Took    string `json:"took,omitempty"` // of the last start or stop step
+	Error   string `json:"error,omitempty"`
+}
+
+// The App's subsystems and how far each has got stopping. Subsystems that drained
+// are stopped; timed_out and skipped ones were abandoned to keep within the grace
+// period.
+func (a *App) ShutdownStatus() ShutdownStatus {
+	status := a.Lifecycle.Status()
+	report := ShutdownStatus{State: "running", Subsystems: make([]SubsystemStatus, len(status.Hooks))}
+	if status.Stopping {
+		report.State = "stopped"
+		report.Started = status.Stopped.UTC().Format(time.RFC3339)
+		if !status.Deadline.IsZero() {
+			report.Deadline = status.Deadline.UTC().Format(time.RFC3339)
+		}
+	}
+	for i, hook := range status.Hooks {
+		report.Subsystems[i] = SubsystemStatus{Name: hook.Name, State: hook.State, Timeout: hook.Timeout.String(), Error: hook.Error}
+		if hook.Took > 0 {
+			report.Subsystems[i].Took = hook.Took.Round(time.Millisecond).String()
+		}
+		if status.Stopping && (hook.State == lifecycle.STATE_RUNNING || hook.State == lifecycle.STATE_STOPPING) {
+			report.State = "draining"
+		}
+	}
+	return report
+}
+
+// GET /admin/shutdown-status
+func (a *App) shutdownStatus(ctx context.Context, _ struct{}) (ShutdownStatus, error) {
+	return a.ShutdownStatus(), nil
+}
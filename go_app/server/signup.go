@@ -0,0 +1,320 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+
+	"go_app/eventbus"
+	"go_app/i18n"
+	"go_app/notifier"
+)
+
+// Who may create an account on POST /register
+const (
+	REGISTRATION_CLOSED = "closed" // nobody; the route isn't served
+	REGISTRATION_OPEN   = "open"   // anyone
+	REGISTRATION_INVITE = "invite" // holders of an invite code
+)
+
+// Longest password bcrypt takes into account
+const MAX_PASSWORD_BYTES = 72
+
+// Email template of verification emails, see notifier.Templates
+const VERIFY_EMAIL_TEMPLATE = "verify_email"
+
+// How long a verification email may take to send
+const VERIFY_EMAIL_TIMEOUT = 30 * time.Second
+
+// Usernames: letters, digits, ".", "_" and "-", 3 to 64 of them
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]{3,64}$`)
+
+// Registrations, verifications and rejections, published on /debug/vars
+var registrationMetrics = expvar.NewMap("registration")
+
+// Self-service sign-up
+type RegistrationConfig struct {
+	Mode              string // see REGISTRATION_*
+	InviteCodes       string // comma separated; each may be used any number of times
+	MinPasswordLength int
+	PasswordClasses   int // of lowercase, uppercase, digits and symbols a password must mix
+
+	// New accounts can't log in until they open the link mailed to them. The email goes
+	// out through the notify SMTP relay; without one, subscribe to TopicUserRegistered.
+	VerifyEmail     bool
+	VerificationTTL time.Duration
+	VerifyURL       string // page the link opens with ?token=, e.g. https://api.example.com/register/verify
+}
+
+func (c RegistrationConfig) validate() error {
+	switch c.Mode {
+	case REGISTRATION_CLOSED, REGISTRATION_OPEN:
+	case REGISTRATION_INVITE:
+		if len(configList(c.InviteCodes)) == 0 {
+			return errors.New("registration invite needs registration-invite-codes")
+		}
+	default:
+		return fmt.Errorf("registration must be %s, %s or %s, got %q", REGISTRATION_CLOSED, REGISTRATION_OPEN, REGISTRATION_INVITE, c.Mode)
+	}
+	// The link isn't built from the request's Host, which the client chooses: whoever
+	// registers with someone else's address could have the token sent to their host
+	if c.VerifyEmail && c.VerifyURL == "" {
+		return errors.New("registration-verify-email needs registration-verify-url")
+	}
+	return nil
+}
+
+// An account created on POST /register. VerificationToken is the token mailed to the
+// account for delivery by other means; it isn't part of the event's JSON, so webhook
+// subscriptions don't receive it.
+type UserRegisteredEvent struct {
+	ID                int
+	Username          string
+	Email             string
+	IP                string
+	Locale            string // from the request's Accept-Language, for the email
+	VerificationURL   string `json:"-"`
+	VerificationToken string `json:"-"`
+	Time              time.Time
+}
+
+// The POST /register and GET /register/verify routes, served unless registration is closed
+func (a *App) registrationRoutes() []Route {
+	if a.Config.Registration.Mode == REGISTRATION_CLOSED || a.Config.Registration.Mode == "" {
+		return nil
+	}
+	return []Route{
+		{Method: http.MethodPost, Path: "/register", Summary: "Create an account", Auth: AUTH_PUBLIC, RateLimit: 10, Timeout: 10 * time.Second, Handler: a.registerHandler},
+		{Method: http.MethodGet, Path: "/register/verify", Summary: "Verify the email address of a new account", Auth: AUTH_PUBLIC, RateLimit: 30, Timeout: 10 * time.Second, Handler: a.verifyEmailHandler},
+	}
+}
+
+func (a *App) registerHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Username   string `json:"username"`
+		Password   string `json:"password"`
+		Email      string `json:"email"`
+		InviteCode string `json:"inviteCode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Username == "" || request.Password == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: username and password are required")
+		return
+	}
+	registry, ok := a.stores(r.Context()).Users.(AccountRegistry)
+	if !ok {
+		a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	config := a.Config.Registration
+	if config.Mode == REGISTRATION_INVITE && !validInviteCode(config.InviteCodes, request.InviteCode) {
+		registrationMetrics.Add("rejected_invite", 1)
+		a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Invalid invite code")
+		return
+	}
+	if !usernamePattern.MatchString(request.Username) {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: username must be 3 to 64 letters, digits, '.', '_' or '-'")
+		return
+	}
+	if err := checkPassword(config, request.Username, request.Password); err != nil {
+		registrationMetrics.Add("rejected_password", 1)
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	if request.Email == "" && config.VerifyEmail {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: email is required")
+		return
+	}
+	if request.Email != "" {
+		address, err := mail.ParseAddress(request.Email)
+		if err != nil || address.Name != "" {
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: email is not an email address")
+			return
+		}
+	}
+
+	var token string
+	var verification *EmailVerification
+	if config.VerifyEmail {
+		var err error
+		if token, err = newVerificationToken(); err != nil {
+			a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		verification = &EmailVerification{TokenHash: hashToken(token), Expires: a.clock(r.Context()).Now().Add(config.VerificationTTL)}
+	}
+	account, err := registry.CreateAccount(r.Context(), Account{Username: request.Username, Password: request.Password, Email: request.Email}, verification)
+	if errors.Is(err, ErrUsernameTaken) {
+		registrationMetrics.Add("rejected_taken", 1)
+		a.handleErrorResponse(w, r, http.StatusConflict, "Conflict: Username is already taken")
+		return
+	}
+	if err != nil {
+		a.Logger.Println("Account creation failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	registrationMetrics.Add("registered", 1)
+	a.Logger.Printf("audit: event=user_registered id=%d username=%q ip=%s", account.ID, account.Username, clientIP(r))
+	event := UserRegisteredEvent{
+		ID:       account.ID,
+		Username: account.Username,
+		Email:    account.Email,
+		IP:       clientIP(r),
+		Locale:   r.Header.Get("Accept-Language"),
+		Time:     a.clock(r.Context()).Now(),
+	}
+	if verification != nil {
+		event.VerificationToken = token
+		event.VerificationURL = verificationURL(config.VerifyURL, token)
+		a.sendVerificationEmail(r.Context(), event, verification.Expires)
+	}
+	eventbus.Publish(a.Events, TopicUserRegistered, event)
+
+	a.writeJSON(w, r, http.StatusCreated, map[string]interface{}{
+		"id":                   account.ID,
+		"username":             account.Username,
+		"verificationRequired": verification != nil,
+	})
+}
+
+func (a *App) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: token is required")
+		return
+	}
+	registry, ok := a.stores(r.Context()).Users.(AccountRegistry)
+	if !ok {
+		a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	account, err := registry.VerifyAccount(r.Context(), hashToken(token), a.clock(r.Context()).Now())
+	if errors.Is(err, ErrVerificationInvalid) {
+		registrationMetrics.Add("rejected_verification", 1)
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: Invalid or expired verification token")
+		return
+	}
+	if err != nil {
+		a.Logger.Println("Email verification failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	registrationMetrics.Add("verified", 1)
+	a.Logger.Printf("audit: event=email_verified id=%d username=%q ip=%s", account.ID, account.Username, clientIP(r))
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{"username": account.Username, "verified": true})
+}
+
+// Compares code with each invite code in time independent of their content
+func validInviteCode(codes, code string) bool {
+	valid := false
+	for _, candidate := range configList(codes) {
+		if secretsEqual(code, candidate) {
+			valid = true
+		}
+	}
+	return code != "" && valid
+}
+
+// Applies the password rules of config: the minimum length in characters, bcrypt's
+// limit in bytes, the character classes to mix, and not containing the username
+func checkPassword(config RegistrationConfig, username, password string) error {
+	if length := len([]rune(password)); length < config.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters", config.MinPasswordLength)
+	}
+	if len(password) > MAX_PASSWORD_BYTES {
+		return fmt.Errorf("password must be at most %d bytes", MAX_PASSWORD_BYTES)
+	}
+	if strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return errors.New("password must not contain the username")
+	}
+	var lower, upper, digit, symbol int
+	for _, c := range password {
+		switch {
+		case unicode.IsLower(c):
+			lower = 1
+		case unicode.IsUpper(c):
+			upper = 1
+		case unicode.IsDigit(c):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	if classes := lower + upper + digit + symbol; classes < config.PasswordClasses {
+		return fmt.Errorf("password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", config.PasswordClasses)
+	}
+	return nil
+}
+
+// 32 random bytes, URL-safe
+func newVerificationToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+// The link mailed to a new account, base with the token added to its query
+func verificationURL(base, token string) string {
+	separator := "?"
+	if strings.Contains(base, "?") {
+		separator = "&"
+	}
+	return base + separator + "token=" + url.QueryEscape(token)
+}
+
+// Mails the verification link in the background through the notify SMTP relay, in the
+// language of the request. Failures are logged and counted.
+func (a *App) sendVerificationEmail(ctx context.Context, event UserRegisteredEvent, expires time.Time) {
+	if a.mailer == nil || event.Email == "" {
+		return
+	}
+	email, err := a.mailer.Templates.Render(VERIFY_EMAIL_TEMPLATE, i18n.ParseAcceptLanguage(event.Locale), map[string]interface{}{
+		"Username": event.Username,
+		"URL":      event.VerificationURL,
+		"Expires":  expires,
+	})
+	if err != nil {
+		a.Logger.Println("Verification email failed:", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), VERIFY_EMAIL_TIMEOUT)
+	a.Go(ctx, func(ctx context.Context) {
+		defer cancel()
+		if err := a.mailer.SendEmail(ctx, []string{event.Email}, event.Time, email); err != nil {
+			registrationMetrics.Add("email_failures", 1)
+			a.Logger.Printf("Verification email to account %d failed: %v", event.ID, err)
+		}
+	})
+}
+
+// The SMTP relay of the notify settings for transactional emails, nil without one
+func newMailer(config NotifyConfig) (*notifier.SMTP, error) {
+	if config.SMTPAddr == "" {
+		return nil, nil
+	}
+	templates, err := notifier.LoadTemplates(config.EmailTemplates, i18n.DEFAULT_LOCALE)
+	if err != nil {
+		return nil, err
+	}
+	return &notifier.SMTP{
+		Addr:      config.SMTPAddr,
+		From:      config.SMTPFrom,
+		Username:  config.SMTPUsername,
+		Password:  config.SMTPPassword,
+		Templates: templates,
+	}, nil
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"go_app/eventbus"
+	"go_app/lifecycle"
+)
+
+// Per route SLO success ratios and burn rates over the alert windows, published on
+// /debug/vars and /metrics, e.g. slo{key="GET /status",field="burn_rate_1h"}
+var sloMetrics = expvar.NewMap("slo")
+
+// Requests are counted in buckets of a minute, kept for the longest alert window
+const (
+	SLO_BUCKET  = time.Minute
+	SLO_HISTORY = 6 * time.Hour
+)
+
+// A route's service level objective: at least Objective of its requests answered
+// without a 5xx and, when Latency is set, within Latency
+type SLO struct {
+	Objective float64       `json:"objective"`         // e.g. 0.999
+	Latency   time.Duration `json:"latency,omitempty"` // 0 counts only server errors as bad
+}
+
+// Burn rate: how many times faster than the objective allows the error budget is
+// being spent. 1 spends exactly the budget over the SLO period.
+func (s SLO) burnRate(ratio float64) float64 {
+	if s.Objective >= 1 {
+		if ratio < 1 {
+			return math.Inf(1)
+		}
+		return 0
+	}
+	return (1 - ratio) / (1 - s.Objective)
+}
+
+// A multi-window burn rate alert: it fires while both windows burn faster than
+// BurnRate, the long one proving the burn is significant and the short one that it is
+// still going on. The thresholds are the usual page and ticket levels for a 30 day
+// SLO period, spending 2% of the budget in an hour and 5% in six hours.
+type SLOAlert struct {
+	Name     string
+	Long     time.Duration
+	Short    time.Duration
+	BurnRate float64
+}
+
+// Alerts checked on every route with an SLO
+var SLO_ALERTS = []SLOAlert{
+	{Name: "fast", Long: time.Hour, Short: 5 * time.Minute, BurnRate: 14.4},
+	{Name: "slow", Long: 6 * time.Hour, Short: 30 * time.Minute, BurnRate: 6},
+}
+
+// Windows published as metrics, those of SLO_ALERTS
+var sloWindows = []time.Duration{5 * time.Minute, 30 * time.Minute, time.Hour, 6 * time.Hour}
+
+// Requests in one SLO_BUCKET
+type sloBucket struct {
+	start int64 // unix minute
+	good  int64
+	total int64
+}
+
+// Rolling request counts of a route with an SLO
+type sloTracker struct {
+	route string
+
+	mutex    sync.Mutex
+	slo      SLO
+	buckets  [SLO_HISTORY / SLO_BUCKET]sloBucket
+	alerting map[string]bool // by SLOAlert.Name
+}
+
+func (t *sloTracker) record(now time.Time, good bool) {
+	minute := now.Unix() / int64(SLO_BUCKET/time.Second)
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	bucket := &t.buckets[minute%int64(len(t.buckets))]
+	if bucket.start != minute {
+		*bucket = sloBucket{start: minute}
+	}
+	bucket.total++
+	if good {
+		bucket.good++
+	}
+}
+
+// Share of good requests over window, 1 when there were none
+func (t *sloTracker) successRatio(now time.Time, window time.Duration) float64 {
+	minute := now.Unix() / int64(SLO_BUCKET/time.Second)
+	oldest := minute - int64(window/SLO_BUCKET) + 1
+	var good, total int64
+	t.mutex.Lock()
+	for _, bucket := range t.buckets {
+		if bucket.start >= oldest && bucket.start <= minute {
+			good += bucket.good
+			total += bucket.total
+		}
+	}
+	t.mutex.Unlock()
+	if total == 0 {
+		return 1
+	}
+	return float64(good) / float64(total)
+}
+
+func (t *sloTracker) objective() SLO {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.slo
+}
+
+// Success ratio and burn rate per window, for sloMetrics
+func (t *sloTracker) snapshot(now time.Time) map[string]float64 {
+	slo := t.objective()
+	values := map[string]float64{"objective": slo.Objective}
+	for _, window := range sloWindows {
+		ratio := t.successRatio(now, window)
+		values["success_ratio_"+windowName(window)] = ratio
+		// JSON has no infinity; an objective of 1 burns "very fast" instead
+		values["burn_rate_"+windowName(window)] = min(slo.burnRate(ratio), math.MaxFloat64)
+	}
+	return values
+}
+
+// Moves the alert to firing or back, reporting whether it changed
+func (t *sloTracker) setAlerting(alert string, firing bool) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.alerting[alert] == firing {
+		return false
+	}
+	t.alerting[alert] = firing
+	return true
+}
+
+// e.g. "5m", "1h"
+func windowName(window time.Duration) string {
+	if window%time.Hour == 0 {
+		return fmt.Sprintf("%dh", window/time.Hour)
+	}
+	return fmt.Sprintf("%dm", window/time.Minute)
+}
+
+// The tracker of route, kept across rebuilds of the route table so its history
+// survives reloads of route groups
+func (a *App) sloTracker(route string, slo SLO) *sloTracker {
+	value, loaded := a.slos.LoadOrStore(route, &sloTracker{route: route, slo: slo, alerting: map[string]bool{}})
+	tracker := value.(*sloTracker)
+	if loaded {
+		tracker.mutex.Lock()
+		tracker.slo = slo
+		tracker.mutex.Unlock()
+	}
+	sloMetrics.Set(route, expvar.Func(func() any { return tracker.snapshot(a.Clock.Now()) }))
+	return tracker
+}
+
+// Counts the requests on route against its SLO. Rejections of the client's own making
+// (4xx) count as good: they spend no error budget.
+func (a *App) trackSLO(route string, slo *SLO, next http.HandlerFunc) http.HandlerFunc {
+	if slo == nil {
+		return next
+	}
+	tracker := a.sloTracker(route, *slo)
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusWriter{ResponseWriter: w}
+		next(recorder, r)
+		good := recorder.status < http.StatusInternalServerError
+		if slo.Latency > 0 && time.Since(start) > slo.Latency {
+			good = false
+		}
+		tracker.record(a.Clock.Now(), good)
+	}
+}
+
+// Checks every route's burn rates against SLO_ALERTS, publishing on TopicSLOBurn when
+// an alert starts or stops firing. Each replica checks its own requests.
+func (a *App) evaluateSLOs() {
+	now := a.Clock.Now()
+	a.slos.Range(func(_, value any) bool {
+		tracker := value.(*sloTracker)
+		slo := tracker.objective()
+		for _, alert := range SLO_ALERTS {
+			long := slo.burnRate(tracker.successRatio(now, alert.Long))
+			short := slo.burnRate(tracker.successRatio(now, alert.Short))
+			firing := long > alert.BurnRate && short > alert.BurnRate
+			if !tracker.setAlerting(alert.Name, firing) {
+				continue
+			}
+			if firing {
+				a.Log.Warn("SLO burn rate alert", "route", tracker.route, "alert", alert.Name, "burn_rate", long, "objective", slo.Objective)
+			} else {
+				a.Log.Info("SLO burn rate alert resolved", "route", tracker.route, "alert", alert.Name)
+			}
+			eventbus.Publish(a.Events, TopicSLOBurn, SLOBurnEvent{
+				Route:     tracker.route,
+				Alert:     alert.Name,
+				Window:    alert.Long,
+				BurnRate:  long,
+				Objective: slo.Objective,
+				Firing:    firing,
+				Time:      now,
+			})
+		}
+		return true
+	})
+}
+
+// Runs evaluateSLOs every slo-evaluation-interval. Not an App.Every job: the counts
+// are each replica's own, so every replica checks them.
+func (a *App) watchSLOs() lifecycle.Hook {
+	return lifecycle.Background("slo alerts", func(ctx context.Context) {
+		interval := a.Config.SLOEvaluationInterval
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				a.evaluateSLOs()
+			}
+		}
+	})
+}
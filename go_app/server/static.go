@@ -0,0 +1,93 @@
+package server
+
+import (
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Content hashes as build tools put them before the extension. Each must contain a
+// digit, and a Rollup hash both cases too, so that names like app-settings.js or
+// main.component.js don't pass for fingerprinted ones.
+var (
+	// webpack, Parcel and Angular: main.3f9a1c2e.js
+	hexHashPattern = regexp.MustCompile(`[.-][0-9a-f]*[0-9][0-9a-f]*$`)
+	// esbuild: main-5ZUNHBKR.js
+	base32HashPattern = regexp.MustCompile(`-[A-Z2-7]{8}$`)
+	// Rollup and Vite: index-BpQ2x7Yd.css
+	base64HashPattern = regexp.MustCompile(`[.-][0-9A-Za-z_-]{8}$`)
+)
+
+// Whether name is a fingerprinted asset, whose content never changes under that name.
+// A miss only costs a revalidation, while a false match keeps a changed file cached
+// for a year, so anything that doesn't look like a hash isn't one.
+func isHashedAsset(name string) bool {
+	ext := path.Ext(name)
+	if ext == "" {
+		return false
+	}
+	stem := strings.TrimSuffix(path.Base(name), ext)
+	if match := hexHashPattern.FindString(stem); len(match) > 8 {
+		return true
+	}
+	if match := base32HashPattern.FindString(stem); match != "" && strings.ContainsAny(match, "234567") {
+		return true
+	}
+	if match := base64HashPattern.FindString(stem); match != "" {
+		hash := match[1:]
+		return strings.ContainsAny(hash, "0123456789") &&
+			strings.ContainsAny(hash, "abcdefghijklmnopqrstuvwxyz") &&
+			strings.ContainsAny(hash, "ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	}
+	return false
+}
+
+// Serves a single page application from fsys, falling back to index.html
+// for client-side routes so deep links survive a page reload.
+func (a *App) spaHandler(fsys fs.FS) http.HandlerFunc {
+	fileServer := http.FileServer(http.FS(fsys))
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" {
+			name = "index.html"
+		}
+
+		info, err := fs.Stat(fsys, name)
+		if err != nil || info.IsDir() {
+			// Missing files with an extension are real 404s, not client-side routes
+			if path.Ext(name) != "" && name != "index.html" {
+				http.NotFound(w, r)
+				return
+			}
+			a.serveIndex(w, r, fsys)
+			return
+		}
+
+		if name == "index.html" {
+			a.serveIndex(w, r, fsys)
+			return
+		}
+
+		if isHashedAsset(name) {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "public, max-age=0, must-revalidate")
+		}
+		fileServer.ServeHTTP(w, r)
+	}
+}
+
+// index.html must never be cached so new deployments pick up new asset hashes
+func (a *App) serveIndex(w http.ResponseWriter, r *http.Request, fsys fs.FS) {
+	content, err := fs.ReadFile(fsys, "index.html")
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(content)
+}
@@ -0,0 +1,41 @@
+package server
+
+import "testing"
+
+func TestIsHashedAsset(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		// Fingerprinted by the common build tools
+		{"app.3f9a1c2e.js", true},
+		{"assets/main.3f9a1c2e4b5d6f70.css", true},
+		{"runtime-0123abcd.js", true},
+		{"main-5ZUNHBKR.js", true},
+		{"chunk-HV3RKK7S.js", true},
+		{"assets/index-BpQ2x7Yd.css", true},
+		{"assets/vendor-a_Z9-xQ1.js", true},
+		{"fonts/inter.9b1c4e7a.woff2", true},
+
+		// Ordinary names that only look long enough
+		{"app-settings.js", false},
+		{"main.component.js", false},
+		{"user-profile.css", false},
+		{"app-SETTINGS.js", false},
+		{"MyWidget-Settings.js", false},
+		{"assets/app-Settings.js", false},
+		{"jquery-3.7.1.min.js", false},
+		{"deadbeef.js", false},
+		{"app.deadbeef.js", false},
+		{"app.3f9a1c2.js", false},
+		{"app.3f9a1c2e.js.map", false},
+		{"favicon.ico", false},
+		{"app.3f9a1c2e", false},
+		{"index.html", false},
+	}
+	for _, test := range tests {
+		if got := isHashedAsset(test.name); got != test.want {
+			t.Errorf("isHashedAsset(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
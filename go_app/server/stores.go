@@ -0,0 +1,278 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"go_app/messaging"
+)
+
+// Persistence dependencies of the App
+type Stores struct {
+	Blacklist   TokenBlacklist
+	Revocations TokenBlacklist
+	Users       UserStore
+	Sessions    SessionStore
+	TwoFactor   TwoFactorStore
+	Files       FileStore
+	Cutoffs     CutoffStore
+	Usage       UsageStore
+	Messages    messaging.Log
+	Items       ItemStore
+	History     HistoryStore
+
+	Subscriptions WebhookSubscriptionStore
+	TenantConfigs TenantConfigStore
+}
+
+// Token blacklist to store used tokens. The same interface backs the revocation
+// store, which holds tokens that were logged out and may no longer be refreshed.
+type TokenBlacklist interface {
+	Contains(token string) bool
+	Add(token string, expiresAt time.Time) // expiresAt is the token's exp, zero if it has none
+}
+
+// Implemented by blacklists keyed by hashToken, so callers holding the hash skip hashing
+type hashedBlacklist interface {
+	ContainsHash(hash string) bool
+}
+
+// Unbounded blacklist that never forgets, see BoundedBlacklist for long-running processes
+type memoryBlacklist struct {
+	mutex sync.Mutex
+	set   map[string]struct{}
+}
+
+func NewMemoryBlacklist() TokenBlacklist {
+	return &memoryBlacklist{set: make(map[string]struct{})}
+}
+
+func (b *memoryBlacklist) Contains(token string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, exists := b.set[token]
+	return exists
+}
+
+func (b *memoryBlacklist) Add(token string, expiresAt time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.set[token] = struct{}{}
+}
+
+// A user that can log in
+type Account struct {
+	ID       int
+	Username string
+	Password string
+	Tenant   string   // organization the account belongs to, optional
+	Roles    []string // granted in the roles claim, optional
+	Email    string   // optional
+
+	// Registered with email verification and not verified yet, so it can't log in
+	Unverified bool
+}
+
+// Verifies login credentials
+type UserStore interface {
+	Authenticate(username, password string) (Account, bool)
+}
+
+// Returned by AccountRegistry.CreateAccount when the username is in use
+var ErrUsernameTaken = errors.New("username is already taken")
+
+// Returned by AccountRegistry.VerifyAccount for unknown, used and expired tokens
+var ErrVerificationInvalid = errors.New("invalid or expired verification token")
+
+// An email verification an account waits for: the hash of the token mailed to it (see
+// hashToken), and when the token stops working
+type EmailVerification struct {
+	TokenHash string
+	Expires   time.Time
+}
+
+// User stores that accept new accounts, needed by POST /register
+type AccountRegistry interface {
+	// Adds account with the next free ID, unverified until VerifyAccount when
+	// verification is given
+	CreateAccount(ctx context.Context, account Account, verification *EmailVerification) (Account, error)
+	// Marks the account waiting for tokenHash verified; the token works once
+	VerifyAccount(ctx context.Context, tokenHash string, now time.Time) (Account, error)
+}
+
+type memoryUserStore struct {
+	mutex         sync.RWMutex
+	accounts      map[string]Account
+	verifications map[string]memoryVerification // by token hash
+}
+
+type memoryVerification struct {
+	username string
+	expires  time.Time
+}
+
+func NewMemoryUserStore(accounts ...Account) UserStore {
+	store := &memoryUserStore{accounts: make(map[string]Account), verifications: make(map[string]memoryVerification)}
+	for _, account := range accounts {
+		store.accounts[account.Username] = account
+	}
+	return store
+}
+
+// Unknown usernames are compared against an empty password too, so the response time
+// does not tell whether the account exists
+func (s *memoryUserStore) Authenticate(username, password string) (Account, bool) {
+	s.mutex.RLock()
+	account, exists := s.accounts[username]
+	s.mutex.RUnlock()
+	if !secretsEqual(password, account.Password) || !exists {
+		return Account{}, false
+	}
+	return account, true
+}
+
+func (s *memoryUserStore) CreateAccount(ctx context.Context, account Account, verification *EmailVerification) (Account, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, exists := s.accounts[account.Username]; exists {
+		return Account{}, ErrUsernameTaken
+	}
+	account.ID = 1
+	for _, existing := range s.accounts {
+		account.ID = max(account.ID, existing.ID+1)
+	}
+	if verification != nil {
+		account.Unverified = true
+		s.verifications[verification.TokenHash] = memoryVerification{username: account.Username, expires: verification.Expires}
+	}
+	s.accounts[account.Username] = account
+	return account, nil
+}
+
+func (s *memoryUserStore) VerifyAccount(ctx context.Context, tokenHash string, now time.Time) (Account, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	verification, ok := s.verifications[tokenHash]
+	if !ok || !now.Before(verification.expires) {
+		return Account{}, ErrVerificationInvalid
+	}
+	delete(s.verifications, tokenHash)
+	account := s.accounts[verification.username]
+	account.Unverified = false
+	s.accounts[account.Username] = account
+	return account, nil
+}
+
+// Accounts in a SQL database with bcrypt password hashes
+type sqlUserStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const usersSchema = `CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY,
+	username TEXT NOT NULL UNIQUE,
+	password_hash TEXT NOT NULL,
+	tenant TEXT NOT NULL DEFAULT ''
+)`
+
+// Columns added after the users table was first released; verification_hash is set
+// while the account waits for its email verification
+var userColumns = []string{"email TEXT NOT NULL DEFAULT ''", "verification_hash TEXT", "verification_expires BIGINT"}
+
+// Attempts at inserting an account when concurrent registrations race for the same ID
+const ACCOUNT_INSERT_ATTEMPTS = 3
+
+// Compared against when the username is unknown, so both cases take as long
+var dummyPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+// Creates the users table if needed and inserts or updates seed, so the seeded
+// accounts always have the configured passwords
+func NewSQLUserStore(db *sql.DB, driver string, seed ...Account) (UserStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, usersSchema); err != nil {
+		return nil, err
+	}
+	if err := ensureColumns(ctx, db, "users", userColumns); err != nil {
+		return nil, err
+	}
+	for _, account := range seed {
+		hash, err := bcrypt.GenerateFromPassword([]byte(account.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.ExecContext(ctx, rebind(driver, `INSERT INTO users (id, username, password_hash, tenant) VALUES (?, ?, ?, ?)
+			ON CONFLICT (username) DO UPDATE SET password_hash = excluded.password_hash, tenant = excluded.tenant`),
+			account.ID, account.Username, string(hash), account.Tenant); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlUserStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlUserStore) Authenticate(username, password string) (Account, bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	var account Account
+	var hash string
+	err := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT id, username, password_hash, tenant, email, verification_hash IS NOT NULL FROM users WHERE username = ?`), username).
+		Scan(&account.ID, &account.Username, &hash, &account.Tenant, &account.Email, &account.Unverified)
+	if errors.Is(err, sql.ErrNoRows) {
+		hash = string(dummyPasswordHash)
+	} else if err != nil {
+		return Account{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil || err != nil {
+		return Account{}, false
+	}
+	return account, true
+}
+
+// Takes the next ID in the insert; a registration that lost the race for it hits the
+// primary key and tries again
+func (s *sqlUserStore) CreateAccount(ctx context.Context, account Account, verification *EmailVerification) (Account, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(account.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return Account{}, err
+	}
+	var tokenHash, expires interface{}
+	if verification != nil {
+		tokenHash, expires = verification.TokenHash, verification.Expires.Unix()
+		account.Unverified = true
+	}
+	query := rebind(s.driver, `INSERT INTO users (id, username, password_hash, tenant, email, verification_hash, verification_expires)
+		SELECT candidate.id, ?, ?, ?, ?, ?, ? FROM (SELECT COALESCE(MAX(id), 0) + 1 AS id FROM users) candidate
+		WHERE NOT EXISTS (SELECT 1 FROM users WHERE username = ?)
+		RETURNING id`)
+	for attempt := 0; attempt < ACCOUNT_INSERT_ATTEMPTS; attempt++ {
+		err = s.db.QueryRowContext(ctx, query, account.Username, string(hash), account.Tenant, account.Email, tokenHash, expires, account.Username).Scan(&account.ID)
+		if err == nil {
+			return account, nil
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			return Account{}, ErrUsernameTaken
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return Account{}, err
+}
+
+func (s *sqlUserStore) VerifyAccount(ctx context.Context, tokenHash string, now time.Time) (Account, error) {
+	var account Account
+	err := s.db.QueryRowContext(ctx, rebind(s.driver, `UPDATE users SET verification_hash = NULL, verification_expires = NULL
+		WHERE verification_hash = ? AND verification_expires > ?
+		RETURNING id, username, tenant, email`), tokenHash, now.Unix()).
+		Scan(&account.ID, &account.Username, &account.Tenant, &account.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Account{}, ErrVerificationInvalid
+	}
+	return account, err
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Media type of newline-delimited JSON, one value per line
+const CONTENT_TYPE_NDJSON = "application/x-ndjson"
+
+// Records written between flushes by default
+const STREAM_FLUSH_EVERY = 100
+
+// Longest a written record waits in the buffer by default
+const STREAM_FLUSH_INTERVAL = 200 * time.Millisecond
+
+// How a JSONStream flushes and frames its records
+type StreamOptions struct {
+	// Records between flushes: 0 for STREAM_FLUSH_EVERY, negative to flush only on the
+	// interval and at Close
+	FlushEvery int
+	// Flush when the oldest unflushed record is this old: 0 for STREAM_FLUSH_INTERVAL,
+	// negative to disable
+	FlushInterval time.Duration
+	// Wrap a JSON array in an object under this key, e.g. {"files": [...]}; unused for
+	// NDJSON
+	Envelope string
+	// Naming and time format of the records, usually App.Config.JSON
+	Encoding JSONConfig
+}
+
+// Writes a collection record by record, as NDJSON or as a JSON array, flushing as it
+// goes so nothing is buffered whole. Flushes are best effort: routes with a Timeout are
+// buffered by http.TimeoutHandler, so streaming routes leave it unset and watch the
+// request context instead.
+type JSONStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	ndjson     bool
+	options    StreamOptions
+
+	started  bool
+	closed   bool
+	records  int
+	pending  int
+	oldest   time.Time // when the first unflushed record was written
+	writeErr error
+}
+
+// Streams newline-delimited JSON
+func NewNDJSONStream(w http.ResponseWriter, options StreamOptions) *JSONStream {
+	return newJSONStream(w, true, options)
+}
+
+// Streams a JSON array, optionally inside options.Envelope
+func NewJSONArrayStream(w http.ResponseWriter, options StreamOptions) *JSONStream {
+	return newJSONStream(w, false, options)
+}
+
+// Streams NDJSON when the request accepts it and a JSON array otherwise, so list
+// endpoints keep their JSON format for existing clients
+func NewJSONStream(w http.ResponseWriter, r *http.Request, options StreamOptions) *JSONStream {
+	return newJSONStream(w, acceptsNDJSON(r), options)
+}
+
+func newJSONStream(w http.ResponseWriter, ndjson bool, options StreamOptions) *JSONStream {
+	if options.FlushEvery == 0 {
+		options.FlushEvery = STREAM_FLUSH_EVERY
+	}
+	if options.FlushInterval == 0 {
+		options.FlushInterval = STREAM_FLUSH_INTERVAL
+	}
+	return &JSONStream{
+		w:          w,
+		controller: http.NewResponseController(w),
+		ndjson:     ndjson,
+		options:    options,
+	}
+}
+
+func acceptsNDJSON(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(accepted); err == nil && mediaType == CONTENT_TYPE_NDJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// Sends the headers and the array opening, answering 200. Called by the first Write, or
+// by Close for an empty collection.
+func (s *JSONStream) start() error {
+	if s.started {
+		return s.writeErr
+	}
+	s.started = true
+	if s.ndjson {
+		s.w.Header().Set("Content-Type", CONTENT_TYPE_NDJSON)
+		s.w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	s.w.Header().Set("Content-Type", "application/json")
+	s.w.WriteHeader(http.StatusOK)
+	if s.options.Envelope != "" {
+		key, _ := json.Marshal(s.options.Encoding.key(s.options.Envelope))
+		return s.write("{" + string(key) + ":[")
+	}
+	return s.write("[")
+}
+
+func (s *JSONStream) write(text string) error {
+	if s.writeErr == nil {
+		_, s.writeErr = s.w.Write([]byte(text))
+	}
+	return s.writeErr
+}
+
+// Appends one record. After a write error, e.g. the client went away, every call
+// returns it, so loops can stop on the first error.
+func (s *JSONStream) Write(record any) error {
+	if s.closed {
+		return errors.New("write to a closed JSON stream")
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	data, err := s.options.Encoding.Marshal(record)
+	if err != nil {
+		return err
+	}
+	switch {
+	case s.ndjson:
+		err = s.write(string(data) + "\n")
+	case s.records > 0:
+		err = s.write("," + string(data))
+	default:
+		err = s.write(string(data))
+	}
+	if err != nil {
+		return err
+	}
+
+	s.records++
+	if s.pending == 0 {
+		s.oldest = time.Now()
+	}
+	s.pending++
+	if (s.options.FlushEvery > 0 && s.pending >= s.options.FlushEvery) ||
+		(s.options.FlushInterval > 0 && time.Since(s.oldest) >= s.options.FlushInterval) {
+		return s.Flush()
+	}
+	return nil
+}
+
+// Sends what is buffered to the client now
+func (s *JSONStream) Flush() error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	s.pending = 0
+	if err := s.controller.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		s.writeErr = err
+	}
+	return s.writeErr
+}
+
+// Ends the collection and flushes. A stream closed without records is still a valid,
+// empty answer.
+func (s *JSONStream) Close() error {
+	if s.closed {
+		return s.writeErr
+	}
+	if err := s.start(); err != nil {
+		return err
+	}
+	s.closed = true
+	if !s.ndjson {
+		closing := "]"
+		if s.options.Envelope != "" {
+			closing += "}"
+		}
+		if err := s.write(closing + "\n"); err != nil {
+			return err
+		}
+	}
+	return s.Flush()
+}
+
+// Ends the stream after a failure part way through, when the status can no longer
+// change. NDJSON gets a final {"error": message} line. A JSON array is left unclosed, so
+// clients fail to parse it instead of taking it as complete. Before the first record
+// nothing has been sent, and the caller should answer with handleErrorResponse instead.
+func (s *JSONStream) Abort(message string) {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.ndjson {
+		data, _ := json.Marshal(map[string]string{"error": message})
+		s.write(string(data) + "\n")
+	}
+	s.Flush()
+}
+
+// Whether anything has been sent yet
+func (s *JSONStream) Started() bool {
+	return s.started
+}
@@ -0,0 +1,494 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/eventbus"
+	"go_app/messaging"
+)
+
+// Outbound webhook attempts per outcome, published on /debug/vars
+var deliveryMetrics = expvar.NewMap("webhook_deliveries")
+
+// Message log topic holding one message per event and subscription
+const WEBHOOK_DELIVERY_TOPIC = "webhook-deliveries"
+
+// Subscription events matching every event type
+const ALL_EVENTS = "*"
+
+const (
+	WEBHOOK_DELIVERY_TIMEOUT     = 10 * time.Second
+	WEBHOOK_DELIVERY_CONCURRENCY = 8
+	WEBHOOK_DELIVERY_LOG_SIZE    = 100  // attempts kept per subscription
+	WEBHOOK_EVENT_QUEUE_SIZE     = 1024 // bus events waiting to be fanned out
+)
+
+// Outcome of a delivery attempt
+const (
+	DELIVERY_DELIVERED     = "delivered"
+	DELIVERY_RETRYING      = "retrying"
+	DELIVERY_DEAD_LETTERED = "dead_lettered"
+)
+
+// An endpoint receiving the events it subscribed to
+type WebhookSubscription struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Secret  string    `json:"secret,omitempty"` // returned only when the subscription is created
+	Events  []string  `json:"events"`           // event bus topic names, or "*" for all
+	Created time.Time `json:"created"`
+}
+
+func (s WebhookSubscription) matches(event string) bool {
+	return contains(s.Events, ALL_EVENTS) || contains(s.Events, event)
+}
+
+// One attempt at delivering an event to a subscription
+type WebhookAttempt struct {
+	DeliveryID string    `json:"deliveryId"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	Status     int       `json:"status,omitempty"` // HTTP status, absent when there was no response
+	Error      string    `json:"error,omitempty"`
+	Outcome    string    `json:"outcome"` // DELIVERY_*
+	DurationMS int64     `json:"durationMs"`
+	Time       time.Time `json:"time"`
+}
+
+// Persists subscriptions and their delivery logs
+type WebhookSubscriptionStore interface {
+	Create(ctx context.Context, subscription WebhookSubscription) error
+	Get(ctx context.Context, id string) (WebhookSubscription, bool, error)
+	List(ctx context.Context) ([]WebhookSubscription, error)
+	// Removes the subscription and its delivery log
+	Delete(ctx context.Context, id string) error
+	// Appends to the delivery log, keeping the newest WEBHOOK_DELIVERY_LOG_SIZE entries
+	RecordAttempt(ctx context.Context, subscriptionID string, attempt WebhookAttempt) error
+	// The delivery log, newest first
+	Attempts(ctx context.Context, subscriptionID string) ([]WebhookAttempt, error)
+}
+
+type memorySubscriptionStore struct {
+	mutex         sync.Mutex
+	subscriptions map[string]WebhookSubscription
+	attempts      map[string][]WebhookAttempt // oldest first
+}
+
+func NewMemorySubscriptionStore() WebhookSubscriptionStore {
+	return &memorySubscriptionStore{subscriptions: map[string]WebhookSubscription{}, attempts: map[string][]WebhookAttempt{}}
+}
+
+func (s *memorySubscriptionStore) Create(ctx context.Context, subscription WebhookSubscription) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.subscriptions[subscription.ID] = subscription
+	return nil
+}
+
+func (s *memorySubscriptionStore) Get(ctx context.Context, id string) (WebhookSubscription, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscription, ok := s.subscriptions[id]
+	return subscription, ok, nil
+}
+
+func (s *memorySubscriptionStore) List(ctx context.Context) ([]WebhookSubscription, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	subscriptions := make([]WebhookSubscription, 0, len(s.subscriptions))
+	for _, subscription := range s.subscriptions {
+		subscriptions = append(subscriptions, subscription)
+	}
+	sort.Slice(subscriptions, func(i, j int) bool { return subscriptions[i].Created.Before(subscriptions[j].Created) })
+	return subscriptions, nil
+}
+
+func (s *memorySubscriptionStore) Delete(ctx context.Context, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.subscriptions, id)
+	delete(s.attempts, id)
+	return nil
+}
+
+func (s *memorySubscriptionStore) RecordAttempt(ctx context.Context, subscriptionID string, attempt WebhookAttempt) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	attempts := append(s.attempts[subscriptionID], attempt)
+	if len(attempts) > WEBHOOK_DELIVERY_LOG_SIZE {
+		attempts = attempts[len(attempts)-WEBHOOK_DELIVERY_LOG_SIZE:]
+	}
+	s.attempts[subscriptionID] = attempts
+	return nil
+}
+
+func (s *memorySubscriptionStore) Attempts(ctx context.Context, subscriptionID string) ([]WebhookAttempt, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	attempts := s.attempts[subscriptionID]
+	newest := make([]WebhookAttempt, len(attempts))
+	for i, attempt := range attempts {
+		newest[len(attempts)-1-i] = attempt
+	}
+	return newest, nil
+}
+
+// Subscriptions in a SQL database. Secrets are stored as given, since every delivery
+// is signed with them.
+type sqlSubscriptionStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const subscriptionsSchema = `CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+	id TEXT PRIMARY KEY,
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL,
+	events TEXT NOT NULL,
+	created_at BIGINT NOT NULL
+)`
+
+const deliveryLogSchema = `CREATE TABLE IF NOT EXISTS webhook_delivery_log (
+	subscription_id TEXT NOT NULL,
+	delivery_id TEXT NOT NULL,
+	event TEXT NOT NULL,
+	attempt INTEGER NOT NULL,
+	status INTEGER NOT NULL,
+	error TEXT NOT NULL,
+	outcome TEXT NOT NULL,
+	duration_ms BIGINT NOT NULL,
+	attempted_at BIGINT NOT NULL
+)`
+
+// Creates the webhook_subscriptions and webhook_delivery_log tables if needed
+func NewSQLSubscriptionStore(db *sql.DB, driver string) (WebhookSubscriptionStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	for _, statement := range []string{
+		subscriptionsSchema,
+		deliveryLogSchema,
+		`CREATE INDEX IF NOT EXISTS webhook_delivery_log_subscription ON webhook_delivery_log (subscription_id, attempted_at)`,
+	} {
+		if _, err := db.ExecContext(ctx, statement); err != nil {
+			return nil, err
+		}
+	}
+	return &sqlSubscriptionStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlSubscriptionStore) exec(ctx context.Context, query string, args ...interface{}) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, query), args...)
+	return err
+}
+
+func (s *sqlSubscriptionStore) Create(ctx context.Context, subscription WebhookSubscription) error {
+	return s.exec(ctx, `INSERT INTO webhook_subscriptions (id, url, secret, events, created_at) VALUES (?, ?, ?, ?, ?)`,
+		subscription.ID, subscription.URL, subscription.Secret, strings.Join(subscription.Events, ","), subscription.Created.Unix())
+}
+
+func scanSubscription(row interface{ Scan(...interface{}) error }) (WebhookSubscription, error) {
+	var subscription WebhookSubscription
+	var events string
+	var created int64
+	err := row.Scan(&subscription.ID, &subscription.URL, &subscription.Secret, &events, &created)
+	subscription.Events, subscription.Created = configList(events), time.Unix(created, 0)
+	return subscription, err
+}
+
+func (s *sqlSubscriptionStore) Get(ctx context.Context, id string) (WebhookSubscription, bool, error) {
+	row := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT id, url, secret, events, created_at FROM webhook_subscriptions WHERE id = ?`), id)
+	subscription, err := scanSubscription(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return WebhookSubscription{}, false, nil
+	}
+	if err != nil {
+		return WebhookSubscription{}, false, err
+	}
+	return subscription, true, nil
+}
+
+func (s *sqlSubscriptionStore) List(ctx context.Context) ([]WebhookSubscription, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, url, secret, events, created_at FROM webhook_subscriptions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subscriptions := []WebhookSubscription{}
+	for rows.Next() {
+		subscription, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+func (s *sqlSubscriptionStore) Delete(ctx context.Context, id string) error {
+	if err := s.exec(ctx, `DELETE FROM webhook_delivery_log WHERE subscription_id = ?`, id); err != nil {
+		return err
+	}
+	return s.exec(ctx, `DELETE FROM webhook_subscriptions WHERE id = ?`, id)
+}
+
+func (s *sqlSubscriptionStore) RecordAttempt(ctx context.Context, subscriptionID string, attempt WebhookAttempt) error {
+	err := s.exec(ctx, `INSERT INTO webhook_delivery_log (subscription_id, delivery_id, event, attempt, status, error, outcome, duration_ms, attempted_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		subscriptionID, attempt.DeliveryID, attempt.Event, attempt.Attempt, attempt.Status, attempt.Error, attempt.Outcome, attempt.DurationMS, attempt.Time.UnixMilli())
+	if err != nil {
+		return err
+	}
+	// Drops what fell out of the newest WEBHOOK_DELIVERY_LOG_SIZE
+	return s.exec(ctx, `DELETE FROM webhook_delivery_log WHERE subscription_id = ? AND attempted_at < (
+		SELECT MIN(attempted_at) FROM (SELECT attempted_at FROM webhook_delivery_log WHERE subscription_id = ? ORDER BY attempted_at DESC LIMIT ?) AS newest)`,
+		subscriptionID, subscriptionID, WEBHOOK_DELIVERY_LOG_SIZE)
+}
+
+func (s *sqlSubscriptionStore) Attempts(ctx context.Context, subscriptionID string) ([]WebhookAttempt, error) {
+	rows, err := s.db.QueryContext(ctx, rebind(s.driver, `SELECT delivery_id, event, attempt, status, error, outcome, duration_ms, attempted_at
+		FROM webhook_delivery_log WHERE subscription_id = ? ORDER BY attempted_at DESC LIMIT ?`), subscriptionID, WEBHOOK_DELIVERY_LOG_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []WebhookAttempt{}
+	for rows.Next() {
+		var attempt WebhookAttempt
+		var attemptedAt int64
+		if err := rows.Scan(&attempt.DeliveryID, &attempt.Event, &attempt.Attempt, &attempt.Status, &attempt.Error, &attempt.Outcome, &attempt.DurationMS, &attemptedAt); err != nil {
+			return nil, err
+		}
+		attempt.Time = time.UnixMilli(attemptedAt)
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
+
+// A queued delivery of one event to one subscription
+type webhookDelivery struct {
+	SubscriptionID string          `json:"subscriptionId"`
+	ID             string          `json:"id"`
+	Event          string          `json:"event"`
+	Time           time.Time       `json:"time"`
+	Data           json.RawMessage `json:"data"`
+}
+
+// Queues a delivery of event for every subscription to its topic. Runs on the event
+// bus, so events the bus drops under load are not delivered either.
+func (a *App) fanOutWebhooks(event eventbus.Event) {
+	ctx, cancel := context.WithTimeout(context.Background(), WEBHOOK_DELIVERY_TIMEOUT)
+	defer cancel()
+	subscriptions, err := a.Stores.Subscriptions.List(ctx)
+	if err != nil {
+		a.Logger.Printf("Webhook fan-out of %s failed: %v", event.Topic, err)
+		return
+	}
+	var data json.RawMessage
+	for _, subscription := range subscriptions {
+		if !subscription.matches(event.Topic) {
+			continue
+		}
+		if data == nil {
+			if data, err = json.Marshal(event.Payload); err != nil {
+				a.Logger.Printf("Webhook fan-out of %s failed: %v", event.Topic, err)
+				return
+			}
+		}
+		id, err := newRandomID()
+		if err == nil {
+			delivery := webhookDelivery{SubscriptionID: subscription.ID, ID: id, Event: event.Topic, Time: event.Time, Data: data}
+			_, err = messaging.Publish(ctx, a.Stores.Messages, WEBHOOK_DELIVERY_TOPIC, delivery)
+		}
+		if err != nil {
+			a.Logger.Printf("Queueing %s for webhook subscription %s failed: %v", event.Topic, subscription.ID, err)
+		}
+	}
+}
+
+// Posts a queued delivery, signed with the subscription's secret, and records the
+// attempt. Errors have the consumer retry with exponential backoff until it
+// dead-letters the delivery after its MaxAttempts.
+func (a *App) deliverWebhook(ctx context.Context, message messaging.Message) error {
+	var delivery webhookDelivery
+	if err := message.Decode(&delivery); err != nil {
+		return fmt.Errorf("%w: %v", messaging.ErrPermanent, err)
+	}
+	subscription, ok, err := a.Stores.Subscriptions.Get(ctx, delivery.SubscriptionID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return nil // deleted since, nothing to deliver to
+	}
+
+	start := a.Clock.Now()
+	status, err := a.postWebhook(ctx, subscription, delivery)
+	attempt := WebhookAttempt{
+		DeliveryID: delivery.ID,
+		Event:      delivery.Event,
+		Attempt:    message.Attempt,
+		Status:     status,
+		Outcome:    DELIVERY_DELIVERED,
+		DurationMS: a.Clock.Now().Sub(start).Milliseconds(),
+		Time:       start,
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+		attempt.Outcome = DELIVERY_RETRYING
+		if message.Attempt >= a.Consumer.MaxAttempts {
+			attempt.Outcome = DELIVERY_DEAD_LETTERED
+		}
+	}
+	deliveryMetrics.Add(attempt.Outcome, 1)
+	if recordErr := a.Stores.Subscriptions.RecordAttempt(ctx, subscription.ID, attempt); recordErr != nil {
+		a.Logger.Printf("Recording webhook delivery %s failed: %v", delivery.ID, recordErr)
+	}
+	return err
+}
+
+// Sends a delivery and returns the response status. Anything but 2xx is an error.
+// The signature header has the format the stripe webhook receiver verifies:
+// t=TIMESTAMP,v1=hex(HMAC-SHA256(secret, "TIMESTAMP.body")).
+func (a *App) postWebhook(ctx context.Context, subscription WebhookSubscription, delivery webhookDelivery) (int, error) {
+	body, err := json.Marshal(map[string]interface{}{"id": delivery.ID, "event": delivery.Event, "time": delivery.Time, "data": delivery.Data})
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, WEBHOOK_DELIVERY_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(a.Clock.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Id", delivery.ID)
+	req.Header.Set("X-Webhook-Event", delivery.Event)
+	req.Header.Set("X-Webhook-Signature", "t="+timestamp+",v1="+webhookHMAC(subscription.Secret, []byte(timestamp+"."), body))
+
+	resp, err := a.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+type createSubscriptionRequest struct {
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"` // generated when empty
+	Events []string `json:"events"`
+}
+
+func (r createSubscriptionRequest) Validate() error {
+	target, err := url.Parse(r.URL)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") || target.Host == "" {
+		return errors.New("url must be an absolute http(s) URL")
+	}
+	if len(r.Events) == 0 {
+		return errors.New("events is required")
+	}
+	return nil
+}
+
+type subscriptionCreated struct {
+	WebhookSubscription
+}
+
+func (subscriptionCreated) StatusCode() int { return http.StatusCreated }
+
+// Subscribes an endpoint to events. The secret is in the response only this once.
+func (a *App) createSubscription(ctx context.Context, request createSubscriptionRequest) (subscriptionCreated, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return subscriptionCreated{}, err
+	}
+	secret := request.Secret
+	if secret == "" {
+		if secret, err = newRandomID(); err != nil {
+			return subscriptionCreated{}, err
+		}
+	}
+	subscription := WebhookSubscription{ID: id, URL: request.URL, Secret: secret, Events: request.Events, Created: a.clock(ctx).Now()}
+	if err := a.stores(ctx).Subscriptions.Create(ctx, subscription); err != nil {
+		return subscriptionCreated{}, err
+	}
+	a.Logger.Printf("audit: event=webhook_subscribed id=%s url=%q events=%q by=%s", id, request.URL, strings.Join(request.Events, ","), clientIPFromContext(ctx))
+	return subscriptionCreated{subscription}, nil
+}
+
+type subscriptionList struct {
+	Subscriptions []WebhookSubscription `json:"subscriptions"`
+}
+
+func (a *App) listSubscriptions(ctx context.Context, _ struct{}) (subscriptionList, error) {
+	subscriptions, err := a.stores(ctx).Subscriptions.List(ctx)
+	if err != nil {
+		return subscriptionList{}, err
+	}
+	for i := range subscriptions {
+		subscriptions[i].Secret = ""
+	}
+	return subscriptionList{Subscriptions: subscriptions}, nil
+}
+
+type subscriptionRequest struct {
+	ID string `path:"id"`
+}
+
+func (a *App) deleteSubscription(ctx context.Context, request subscriptionRequest) (NoContent, error) {
+	if _, err := a.findSubscription(ctx, request.ID); err != nil {
+		return NoContent{}, err
+	}
+	if err := a.stores(ctx).Subscriptions.Delete(ctx, request.ID); err != nil {
+		return NoContent{}, err
+	}
+	a.Logger.Printf("audit: event=webhook_unsubscribed id=%s by=%s", request.ID, clientIPFromContext(ctx))
+	return NoContent{}, nil
+}
+
+type deliveryLog struct {
+	Attempts []WebhookAttempt `json:"attempts"`
+}
+
+// The latest delivery attempts to a subscription, newest first
+func (a *App) listDeliveries(ctx context.Context, request subscriptionRequest) (deliveryLog, error) {
+	if _, err := a.findSubscription(ctx, request.ID); err != nil {
+		return deliveryLog{}, err
+	}
+	attempts, err := a.stores(ctx).Subscriptions.Attempts(ctx, request.ID)
+	if err != nil {
+		return deliveryLog{}, err
+	}
+	return deliveryLog{Attempts: attempts}, nil
+}
+
+func (a *App) findSubscription(ctx context.Context, id string) (WebhookSubscription, error) {
+	subscription, ok, err := a.stores(ctx).Subscriptions.Get(ctx, id)
+	if err != nil {
+		return WebhookSubscription{}, err
+	}
+	if !ok {
+		return WebhookSubscription{}, &RejectError{Status: http.StatusNotFound, Message: "Not Found: Webhook subscription does not exist"}
+	}
+	return subscription, nil
+}
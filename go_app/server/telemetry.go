@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/telemetry"
+)
+
+// Where the telemetry registry's metrics go, see metrics-backends
+const (
+	METRICS_BACKEND_PROMETHEUS = "prometheus" // served on /metrics next to the expvar metrics
+	METRICS_BACKEND_OTLP       = "otlp"       // pushed to an OpenTelemetry collector
+)
+
+// Metric export settings. Handlers record into telemetry.Default whatever is selected.
+type TelemetryConfig struct {
+	Backends     string // metrics backends separated by commas
+	OTLPEndpoint string // collector base URL, e.g. http://otel-collector:4318
+	OTLPHeaders  string // "name=value" pairs sent with every export
+	OTLPInterval time.Duration
+}
+
+// Latency of routed requests by route pattern and status. Each bucket keeps the trace
+// ID of a recent request as an exemplar.
+var requestDuration = telemetry.NewHistogram("http.server.request.duration",
+	"Duration of HTTP requests handled by a route", "s", telemetry.DEFAULT_BUCKETS)
+
+// Parses metrics-backends into the set of selected backends
+func parseMetricsBackends(value string) (map[string]bool, error) {
+	backends := map[string]bool{}
+	for _, name := range configList(value) {
+		if name != METRICS_BACKEND_PROMETHEUS && name != METRICS_BACKEND_OTLP {
+			return nil, fmt.Errorf("metrics-backends: unknown backend %q", name)
+		}
+		backends[name] = true
+	}
+	return backends, nil
+}
+
+// Builds the OTLP exporter of the default registry, or returns nil when the otlp
+// backend is not selected
+func newMetricsExporter(config TelemetryConfig, serviceName string, logger *log.Logger) (*telemetry.OTLPExporter, error) {
+	backends, err := parseMetricsBackends(config.Backends)
+	if err != nil || !backends[METRICS_BACKEND_OTLP] {
+		return nil, err
+	}
+	if config.OTLPEndpoint == "" {
+		return nil, fmt.Errorf("metrics-backends: otlp needs otlp-endpoint")
+	}
+	headers := map[string]string{}
+	for _, pair := range configList(config.OTLPHeaders) {
+		name, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("otlp-headers: malformed entry %q (expected name=value)", pair)
+		}
+		headers[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return &telemetry.OTLPExporter{
+		Endpoint: config.OTLPEndpoint,
+		Headers:  headers,
+		Resource: []telemetry.Attr{telemetry.String("service.name", serviceName)},
+		Registry: telemetry.Default,
+		Client:   &http.Client{},
+		Logger:   logger,
+	}, nil
+}
+
+// Continues the trace of an incoming traceparent header, or starts one, so the span is
+// in the request's context for exemplars and outgoing calls
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, ok := telemetry.ParseTraceparent(r.Header.Get("traceparent"))
+		span := telemetry.NewSpan(parent, ok)
+		next.ServeHTTP(w, r.WithContext(telemetry.ContextWithSpan(r.Context(), span)))
+	})
+}
+
+// Records the duration of requests on route in requestDuration
+func measureRequests(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusWriter{ResponseWriter: w}
+		next(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		requestDuration.Record(r.Context(), time.Since(start).Seconds(),
+			telemetry.String("http.route", route),
+			telemetry.String("http.response.status_code", strconv.Itoa(recorder.status)))
+	}
+}
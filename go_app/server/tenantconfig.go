@@ -0,0 +1,425 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go_app/configcrypt"
+)
+
+// Metadata members a tenant's overlay may replace
+var tenantOverlayKeys = []string{"rateLimits", "featureFlags", "branding"}
+
+// Longest a tenant's overlay may be cached for
+const MAX_TENANT_CONFIG_TTL = 24 * time.Hour
+
+// Most tenants whose overlays are cached at once
+const MAX_CACHED_TENANTS = 10000
+
+// Metadata overrides of one tenant, merged into the metadata for requests whose token
+// carries its tenant claim. Objects are merged key by key and null removes a value, as
+// with profile overlays.
+type TenantConfig struct {
+	Tenant  string                 `json:"tenant"`
+	Overlay map[string]interface{} `json:"overlay"`
+	TTL     time.Duration          `json:"-"` // how long replicas cache the overlay; 0 for tenant-config-ttl
+	Updated time.Time              `json:"updated"`
+}
+
+// Storage of the tenants' overlays
+type TenantConfigStore interface {
+	Get(ctx context.Context, tenant string) (TenantConfig, bool, error)
+	List(ctx context.Context) ([]TenantConfig, error) // sorted by tenant
+	Put(ctx context.Context, config TenantConfig) error
+	Delete(ctx context.Context, tenant string) error
+}
+
+type memoryTenantConfigStore struct {
+	mutex   sync.Mutex
+	configs map[string]TenantConfig
+}
+
+func NewMemoryTenantConfigStore() TenantConfigStore {
+	return &memoryTenantConfigStore{configs: make(map[string]TenantConfig)}
+}
+
+func (s *memoryTenantConfigStore) Get(ctx context.Context, tenant string) (TenantConfig, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	config, ok := s.configs[tenant]
+	return config, ok, nil
+}
+
+func (s *memoryTenantConfigStore) List(ctx context.Context) ([]TenantConfig, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	configs := make([]TenantConfig, 0, len(s.configs))
+	for _, config := range s.configs {
+		configs = append(configs, config)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Tenant < configs[j].Tenant })
+	return configs, nil
+}
+
+func (s *memoryTenantConfigStore) Put(ctx context.Context, config TenantConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.configs[config.Tenant] = config
+	return nil
+}
+
+func (s *memoryTenantConfigStore) Delete(ctx context.Context, tenant string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.configs, tenant)
+	return nil
+}
+
+// Overlays in a SQL database as JSON
+type sqlTenantConfigStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const tenantConfigsSchema = `CREATE TABLE IF NOT EXISTS tenant_configs (
+	tenant TEXT PRIMARY KEY,
+	overlay TEXT NOT NULL,
+	ttl_ms BIGINT NOT NULL,
+	updated_at BIGINT NOT NULL
+)`
+
+// Creates the tenant_configs table if needed
+func NewSQLTenantConfigStore(db *sql.DB, driver string) (TenantConfigStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, tenantConfigsSchema); err != nil {
+		return nil, err
+	}
+	return &sqlTenantConfigStore{db: db, driver: driver}, nil
+}
+
+func scanTenantConfig(row interface{ Scan(...interface{}) error }) (TenantConfig, error) {
+	var config TenantConfig
+	var overlay string
+	var ttl, updated int64
+	if err := row.Scan(&config.Tenant, &overlay, &ttl, &updated); err != nil {
+		return TenantConfig{}, err
+	}
+	if err := json.Unmarshal([]byte(overlay), &config.Overlay); err != nil {
+		return TenantConfig{}, fmt.Errorf("overlay of tenant %s: %w", config.Tenant, err)
+	}
+	config.TTL = time.Duration(ttl) * time.Millisecond
+	config.Updated = time.UnixMilli(updated)
+	return config, nil
+}
+
+func (s *sqlTenantConfigStore) Get(ctx context.Context, tenant string) (TenantConfig, bool, error) {
+	row := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT tenant, overlay, ttl_ms, updated_at FROM tenant_configs WHERE tenant = ?`), tenant)
+	config, err := scanTenantConfig(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TenantConfig{}, false, nil
+	}
+	if err != nil {
+		return TenantConfig{}, false, err
+	}
+	return config, true, nil
+}
+
+func (s *sqlTenantConfigStore) List(ctx context.Context) ([]TenantConfig, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT tenant, overlay, ttl_ms, updated_at FROM tenant_configs ORDER BY tenant`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	configs := []TenantConfig{}
+	for rows.Next() {
+		config, err := scanTenantConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, config)
+	}
+	return configs, rows.Err()
+}
+
+func (s *sqlTenantConfigStore) Put(ctx context.Context, config TenantConfig) error {
+	overlay, err := json.Marshal(config.Overlay)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO tenant_configs (tenant, overlay, ttl_ms, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (tenant) DO UPDATE SET overlay = excluded.overlay, ttl_ms = excluded.ttl_ms, updated_at = excluded.updated_at`),
+		config.Tenant, string(overlay), config.TTL.Milliseconds(), config.Updated.UnixMilli())
+	return err
+}
+
+func (s *sqlTenantConfigStore) Delete(ctx context.Context, tenant string) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `DELETE FROM tenant_configs WHERE tenant = ?`), tenant)
+	return err
+}
+
+// A tenant's cached overlay, decrypted, and the metadata it was last merged into
+type tenantOverlay struct {
+	overlay map[string]interface{} // nil when the tenant has none
+
+	mutex    sync.Mutex
+	base     int64 // LastUpdated of the metadata resolved was merged into
+	resolved ConfigCache
+}
+
+// The metadata as seen by tenant: the service's with the tenant's overlay merged in.
+// Overlays are cached for their own TTL, so a change made through the admin routes
+// reaches the other replicas within it; the result is merged again whenever the
+// metadata is reloaded.
+func (a *App) TenantConfiguration(ctx context.Context, tenant string) (ConfigCache, error) {
+	base, err := a.loadConfiguration(ctx)
+	if err != nil || tenant == "" {
+		return base, err
+	}
+	entry, err := a.tenantConfigs.GetOrLoadWithTTL(ctx, tenant, func(ctx context.Context) (*tenantOverlay, time.Duration, error) {
+		return a.loadTenantOverlay(ctx, tenant)
+	})
+	if err != nil {
+		// Serving the tenant the service's settings beats failing its requests
+		a.Logger.Printf("Tenant configuration of %s failed to load: %v", tenant, err)
+		return base, nil
+	}
+	if entry.overlay == nil {
+		return base, nil
+	}
+
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if entry.resolved.Metadata == nil || entry.base != base.LastUpdated {
+		metadata := cloneMetadata(base.Metadata).(map[string]interface{})
+		mergeMetadata(metadata, cloneMetadata(entry.overlay).(map[string]interface{}))
+		entry.resolved = ConfigCache{Metadata: metadata, SHA: base.SHA, LastUpdated: base.LastUpdated}
+		entry.base = base.LastUpdated
+	}
+	return entry.resolved, nil
+}
+
+func (a *App) loadTenantOverlay(ctx context.Context, tenant string) (*tenantOverlay, time.Duration, error) {
+	config, ok, err := a.stores(ctx).TenantConfigs.Get(ctx, tenant)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl := a.Config.TenantConfigTTL
+	if !ok {
+		return &tenantOverlay{}, ttl, nil
+	}
+	if config.TTL > 0 {
+		ttl = config.TTL
+	}
+	overlay := cloneMetadata(config.Overlay).(map[string]interface{})
+	if _, err := configcrypt.DecryptTree(a.MetadataCipher, overlay); err != nil {
+		return nil, 0, err
+	}
+	return &tenantOverlay{overlay: overlay}, ttl, nil
+}
+
+// The metadata as seen by the caller of ctx, the service's own for callers without a
+// tenant claim
+func (a *App) requestConfiguration(ctx context.Context) (ConfigCache, error) {
+	tenant := ""
+	if user, ok := UserFromContext(ctx); ok {
+		tenant, _ = user.Claims[TENANT_CLAIM].(string)
+	}
+	return a.TenantConfiguration(ctx, tenant)
+}
+
+// Reports whether the metadata's featureFlags, with the caller's tenant overlay,
+// turn the flag name on. Unknown flags are off.
+func (a *App) FeatureEnabled(ctx context.Context, name string) bool {
+	config, err := a.requestConfiguration(ctx)
+	if err != nil {
+		return false
+	}
+	flags, _ := config.Metadata["featureFlags"].(map[string]interface{})
+	enabled, _ := flags[name].(bool)
+	return enabled
+}
+
+// Copies a decoded JSON document so merging into the copy leaves it untouched
+func cloneMetadata(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		clone := make(map[string]interface{}, len(value))
+		for key, member := range value {
+			clone[key] = cloneMetadata(member)
+		}
+		return clone
+	case []interface{}:
+		clone := make([]interface{}, len(value))
+		for i, item := range value {
+			clone[i] = cloneMetadata(item)
+		}
+		return clone
+	}
+	return value
+}
+
+type brandingResponse struct {
+	Tenant   string                 `json:"tenant,omitempty"`
+	Branding map[string]interface{} `json:"branding"`
+}
+
+// The branding of the caller's tenant, for clients to theme themselves with
+func (a *App) branding(ctx context.Context, _ struct{}) (brandingResponse, error) {
+	config, err := a.requestConfiguration(ctx)
+	if err != nil {
+		return brandingResponse{}, &RejectError{Status: http.StatusServiceUnavailable, Message: "Service Unavailable"}
+	}
+	response := brandingResponse{Branding: map[string]interface{}{}}
+	if user, ok := UserFromContext(ctx); ok {
+		response.Tenant, _ = user.Claims[TENANT_CLAIM].(string)
+	}
+	if branding, ok := config.Metadata["branding"].(map[string]interface{}); ok {
+		response.Branding = branding
+	}
+	return response, nil
+}
+
+type tenantConfigResponse struct {
+	TenantConfig
+	TTL string `json:"ttl,omitempty"`
+}
+
+func newTenantConfigResponse(config TenantConfig) tenantConfigResponse {
+	response := tenantConfigResponse{TenantConfig: config}
+	if config.TTL > 0 {
+		response.TTL = config.TTL.String()
+	}
+	return response
+}
+
+type tenantConfigList struct {
+	Tenants []tenantConfigResponse `json:"tenants"`
+}
+
+// Every tenant with an overlay
+func (a *App) listTenantConfigs(ctx context.Context, _ struct{}) (tenantConfigList, error) {
+	configs, err := a.stores(ctx).TenantConfigs.List(ctx)
+	if err != nil {
+		return tenantConfigList{}, err
+	}
+	list := tenantConfigList{Tenants: make([]tenantConfigResponse, 0, len(configs))}
+	for _, config := range configs {
+		list.Tenants = append(list.Tenants, newTenantConfigResponse(config))
+	}
+	return list, nil
+}
+
+type tenantRequest struct {
+	Tenant string `path:"tenant"`
+}
+
+type tenantConfigDetail struct {
+	tenantConfigResponse
+	Effective map[string]interface{} `json:"effective"` // the overridable members as the tenant sees them
+}
+
+// A tenant's overlay and the settings it results in
+func (a *App) getTenantConfig(ctx context.Context, request tenantRequest) (tenantConfigDetail, error) {
+	config, err := a.findTenantConfig(ctx, request.Tenant)
+	if err != nil {
+		return tenantConfigDetail{}, err
+	}
+	detail := tenantConfigDetail{tenantConfigResponse: newTenantConfigResponse(config), Effective: map[string]interface{}{}}
+	base, err := a.loadConfiguration(ctx)
+	if err != nil {
+		return tenantConfigDetail{}, &RejectError{Status: http.StatusServiceUnavailable, Message: "Service Unavailable"}
+	}
+	// Merged here rather than taken from the cache, which may still hold the previous
+	// overlay on this replica
+	metadata := cloneMetadata(base.Metadata).(map[string]interface{})
+	overlay := cloneMetadata(config.Overlay).(map[string]interface{})
+	if _, err := configcrypt.DecryptTree(a.MetadataCipher, overlay); err != nil {
+		return tenantConfigDetail{}, err
+	}
+	mergeMetadata(metadata, overlay)
+	for _, key := range tenantOverlayKeys {
+		if value, ok := metadata[key]; ok {
+			detail.Effective[key] = value
+		}
+	}
+	return detail, nil
+}
+
+type putTenantConfigRequest struct {
+	Tenant  string                 `path:"tenant"`
+	Overlay map[string]interface{} `json:"overlay"`
+	TTL     string                 `json:"ttl"` // e.g. "5m"; empty for tenant-config-ttl
+}
+
+func (r putTenantConfigRequest) Validate() error {
+	if r.Overlay == nil {
+		return errors.New("overlay is required")
+	}
+	for key := range r.Overlay {
+		if !slices.Contains(tenantOverlayKeys, key) {
+			return fmt.Errorf("overlay may only set %s", strings.Join(tenantOverlayKeys, ", "))
+		}
+	}
+	if problems := ValidateMetadataMembers(r.Overlay); len(problems) > 0 {
+		return fmt.Errorf("overlay%s", problems[0].Error())
+	}
+	if r.TTL != "" {
+		if ttl, err := time.ParseDuration(r.TTL); err != nil || ttl <= 0 || ttl > MAX_TENANT_CONFIG_TTL {
+			return errors.New("ttl must be a positive duration up to 24h")
+		}
+	}
+	return nil
+}
+
+// Sets a tenant's overlay, replacing the one it had. This replica uses it right away,
+// the others once their cached copy expires.
+func (a *App) putTenantConfig(ctx context.Context, request putTenantConfigRequest) (tenantConfigResponse, error) {
+	overlay := cloneMetadata(request.Overlay)
+	if _, err := configcrypt.DecryptTree(a.MetadataCipher, overlay); err != nil {
+		return tenantConfigResponse{}, &RejectError{Status: http.StatusBadRequest, Message: "Bad Request: overlay has a value that can't be decrypted"}
+	}
+	config := TenantConfig{Tenant: request.Tenant, Overlay: request.Overlay, Updated: a.clock(ctx).Now().UTC()}
+	config.TTL, _ = time.ParseDuration(request.TTL)
+	if err := a.stores(ctx).TenantConfigs.Put(ctx, config); err != nil {
+		return tenantConfigResponse{}, err
+	}
+	a.tenantConfigs.Delete(request.Tenant)
+	a.Logger.Printf("audit: event=tenant_config_set tenant=%q keys=%q by=%s", request.Tenant, strings.Join(slices.Sorted(maps.Keys(request.Overlay)), ","), clientIPFromContext(ctx))
+	return newTenantConfigResponse(config), nil
+}
+
+// Removes a tenant's overlay; its requests get the service's settings again
+func (a *App) deleteTenantConfig(ctx context.Context, request tenantRequest) (NoContent, error) {
+	if _, err := a.findTenantConfig(ctx, request.Tenant); err != nil {
+		return NoContent{}, err
+	}
+	if err := a.stores(ctx).TenantConfigs.Delete(ctx, request.Tenant); err != nil {
+		return NoContent{}, err
+	}
+	a.tenantConfigs.Delete(request.Tenant)
+	a.Logger.Printf("audit: event=tenant_config_deleted tenant=%q by=%s", request.Tenant, clientIPFromContext(ctx))
+	return NoContent{}, nil
+}
+
+func (a *App) findTenantConfig(ctx context.Context, tenant string) (TenantConfig, error) {
+	config, ok, err := a.stores(ctx).TenantConfigs.Get(ctx, tenant)
+	if err != nil {
+		return TenantConfig{}, err
+	}
+	if !ok {
+		return TenantConfig{}, &RejectError{Status: http.StatusNotFound, Message: "Not Found: Tenant has no configuration"}
+	}
+	return config, nil
+}
@@ -0,0 +1,289 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests per route that came with a budget, and those turned away for it, published
+// on /debug/vars
+var budgetMetrics = expvar.NewMap("request_budget")
+
+// Header callers send with the milliseconds they will wait for the response. Outgoing
+// calls carry what is left of it.
+const BUDGET_HEADER = "X-Request-Budget-Ms"
+
+// Budgets above a day are taken as a day, which keeps the duration from overflowing
+const BUDGET_MAX_MS = 24 * 60 * 60 * 1000
+
+// Weight of the latest request in a route's moving average duration
+const BUDGET_LATENCY_WEIGHT = 0.2
+
+// Durations of one request for its Server-Timing header
+type serverTiming struct {
+	mutex  sync.Mutex
+	start  time.Time
+	names  []string // in the order they began
+	spans  map[string]timingSpan
+	totals map[string]time.Duration // summed entries such as downstream calls
+	counts map[string]int
+}
+
+type timingSpan struct {
+	start, end time.Time
+}
+
+type timingContextKey struct{}
+
+func timingFromContext(ctx context.Context) *serverTiming {
+	timing, _ := ctx.Value(timingContextKey{}).(*serverTiming)
+	return timing
+}
+
+func (t *serverTiming) begin(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.spans[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.spans[name] = timingSpan{start: time.Now()}
+}
+
+func (t *serverTiming) finish(name string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if span, ok := t.spans[name]; ok && span.end.IsZero() {
+		span.end = time.Now()
+		t.spans[name] = span
+	}
+}
+
+// Adds d to the summed entry name. Exported through RecordTiming for handlers.
+func (t *serverTiming) add(name string, d time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.totals[name]; !ok {
+		t.names = append(t.names, name)
+	}
+	t.totals[name] += d
+	t.counts[name]++
+}
+
+// The header value as of now. Spans still running, such as the handler writing its
+// response, count up to now; middleware is the time outside auth and the handler.
+func (t *serverTiming) header() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	now := time.Now()
+	total := now.Sub(t.start)
+	inside := time.Duration(0)
+	var entries []string
+	for _, name := range t.names {
+		if span, ok := t.spans[name]; ok {
+			end := span.end
+			if end.IsZero() {
+				end = now
+			}
+			if name == TIMING_AUTH || name == TIMING_HANDLER {
+				inside += end.Sub(span.start)
+			}
+			entries = append(entries, timingEntry(name, end.Sub(span.start), ""))
+			continue
+		}
+		entries = append(entries, timingEntry(name, t.totals[name], fmt.Sprintf("calls: %d", t.counts[name])))
+	}
+	entries = append(entries, timingEntry(TIMING_MIDDLEWARE, max(total-inside, 0), ""), timingEntry(TIMING_TOTAL, total, ""))
+	return strings.Join(entries, ", ")
+}
+
+func timingEntry(name string, d time.Duration, description string) string {
+	entry := name + ";dur=" + strconv.FormatFloat(float64(d.Microseconds())/1000, 'f', -1, 64)
+	if description != "" {
+		entry += `;desc="` + description + `"`
+	}
+	return entry
+}
+
+// Server-Timing entries the scaffold records
+const (
+	TIMING_AUTH       = "auth"
+	TIMING_HANDLER    = "handler"    // includes downstream calls made by the handler
+	TIMING_DOWNSTREAM = "downstream" // summed over the calls through App.HTTPClient
+	TIMING_MIDDLEWARE = "middleware"
+	TIMING_TOTAL      = "total"
+)
+
+// Adds d to the Server-Timing entry name of the request in ctx, e.g. a database query.
+// Entries recorded more than once are summed.
+func RecordTiming(ctx context.Context, name string, d time.Duration) {
+	if timing := timingFromContext(ctx); timing != nil {
+		timing.add(name, d)
+	}
+}
+
+// Adds the Server-Timing header to responses when server-timing is on
+func (a *App) timeRequests(next http.Handler) http.Handler {
+	if !a.Config.ServerTiming {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timing := &serverTiming{
+			start:  time.Now(),
+			spans:  make(map[string]timingSpan),
+			totals: make(map[string]time.Duration),
+			counts: make(map[string]int),
+		}
+		writer := &timingWriter{ResponseWriter: w, timing: timing}
+		next.ServeHTTP(writer, r.WithContext(context.WithValue(r.Context(), timingContextKey{}, timing)))
+	})
+}
+
+// Sets Server-Timing just before the header is sent
+type timingWriter struct {
+	http.ResponseWriter
+	timing *serverTiming
+	sent   bool
+}
+
+func (w *timingWriter) WriteHeader(status int) {
+	if !w.sent {
+		w.sent = true
+		w.Header().Set("Server-Timing", w.timing.header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *timingWriter) Write(p []byte) (int, error) {
+	if !w.sent {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *timingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Times next as the span name of the request's Server-Timing
+func timed(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timing := timingFromContext(r.Context())
+		if timing == nil {
+			next(w, r)
+			return
+		}
+		timing.begin(name)
+		defer timing.finish(name)
+		next(w, r)
+	}
+}
+
+// Ends the span name when the request reaches next, e.g. auth once it has succeeded
+func finishTiming(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if timing := timingFromContext(r.Context()); timing != nil {
+			timing.finish(name)
+		}
+		next(w, r)
+	}
+}
+
+// Moving average duration per route, to tell whether a budget suffices
+var routeLatencies sync.Map // route pattern -> *routeLatency
+
+type routeLatency struct {
+	mutex   sync.Mutex
+	average time.Duration
+}
+
+func (l *routeLatency) record(d time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.average == 0 {
+		l.average = d
+		return
+	}
+	l.average += time.Duration(BUDGET_LATENCY_WEIGHT * float64(d-l.average))
+}
+
+func (l *routeLatency) get() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.average
+}
+
+// Honors X-Request-Budget-Ms. A request whose budget is below the route's average
+// duration is answered 503 right away rather than after the caller has given up.
+// Otherwise the budget becomes the context deadline, and the response is cut off with
+// 503 when it runs out, like a route timeout. Routes without a Timeout stream, so for them
+// the budget is only the deadline and their writes aren't buffered.
+func (a *App) enforceBudget(route string, buffered bool, next http.HandlerFunc) http.HandlerFunc {
+	value, _ := routeLatencies.LoadOrStore(route, &routeLatency{})
+	latency := value.(*routeLatency)
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		header := r.Header.Get(BUDGET_HEADER)
+		if header == "" {
+			recorder := &statusWriter{ResponseWriter: w}
+			next(recorder, r)
+			if recorder.status < http.StatusInternalServerError {
+				latency.record(time.Since(start))
+			}
+			return
+		}
+		ms, err := strconv.ParseInt(header, 10, 64)
+		if err != nil || ms <= 0 {
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: Invalid X-Request-Budget-Ms")
+			return
+		}
+		budget := time.Duration(min(ms, BUDGET_MAX_MS)) * time.Millisecond
+		budgetMetrics.Add(route+".budgeted", 1)
+		if expected := latency.get(); budget < expected {
+			budgetMetrics.Add(route+".rejected", 1)
+			a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable: Request budget exhausted")
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.WithValue(r.Context(), budgetContextKey{}, true), budget)
+		defer cancel()
+		recorder := &statusWriter{ResponseWriter: w}
+		if buffered {
+			http.TimeoutHandler(next, budget, ROUTE_TIMEOUT_MSG).ServeHTTP(recorder, r.WithContext(ctx))
+		} else {
+			next(recorder, r.WithContext(ctx))
+		}
+		if recorder.status < http.StatusInternalServerError {
+			latency.record(time.Since(start))
+		}
+	}
+}
+
+// Marks contexts whose deadline is a caller's budget
+type budgetContextKey struct{}
+
+// Times calls through App.HTTPClient for Server-Timing and passes the remaining budget
+// of the request on, so downstream services stop when the caller would
+type budgetTransport struct {
+	base http.RoundTripper
+}
+
+func (t budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, ok := req.Context().Deadline()
+	if budgeted, _ := req.Context().Value(budgetContextKey{}).(bool); ok && budgeted && req.Header.Get(BUDGET_HEADER) == "" {
+		remaining := time.Until(deadline).Milliseconds()
+		if remaining <= 0 {
+			return nil, context.DeadlineExceeded
+		}
+		req = req.Clone(req.Context())
+		req.Header.Set(BUDGET_HEADER, strconv.FormatInt(remaining, 10))
+	}
+	start := time.Now()
+	resp, err := t.base.RoundTrip(req)
+	RecordTiming(req.Context(), TIMING_DOWNSTREAM, time.Since(start))
+	return resp, err
+}
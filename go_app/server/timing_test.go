@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Streaming routes have no Timeout, and a budget doesn't buffer them either, so a
+// flushed record reaches the client while the handler is still writing
+func TestBudgetDoesNotBufferStreams(t *testing.T) {
+	keys, err := NewRandomKeyProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	app := NewApp(DefaultConfig(), log.New(io.Discard, "", 0), NewMockClock(time.Now()), keys, Stores{
+		Blacklist:   NewMemoryBlacklist(),
+		Revocations: NewMemoryBlacklist(),
+		Users:       NewMemoryUserStore(),
+		TwoFactor:   NewMemoryTwoFactorStore(),
+	})
+	for _, route := range app.Routes() {
+		if route.Method == http.MethodGet && route.Path == "/files" && route.Timeout != 0 {
+			t.Errorf("GET /files has a Timeout of %s; http.TimeoutHandler would buffer its stream", route.Timeout)
+		}
+	}
+
+	release := make(chan struct{})
+	defer close(release)
+	handler := app.enforceBudget("GET /test-stream", false, func(w http.ResponseWriter, r *http.Request) {
+		stream := NewNDJSONStream(w, StreamOptions{})
+		stream.Write(map[string]int{"n": 1})
+		stream.Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		stream.Close()
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set(BUDGET_HEADER, "5000")
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	line := make(chan string, 1)
+	go func() {
+		text, _ := bufio.NewReader(resp.Body).ReadString('\n')
+		line <- text
+	}()
+	select {
+	case text := <-line:
+		if text != `{"n":1}`+"\n" {
+			t.Errorf("first line = %q, want the flushed record", text)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the flushed record didn't arrive before the handler returned")
+	}
+}
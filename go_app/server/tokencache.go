@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"go_app/cache"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// Verified tokens kept, each a few hundred bytes
+const TOKEN_CACHE_SIZE = 10000
+
+// Longest a verified token is kept; its exp ends it sooner
+const TOKEN_CACHE_TTL = 5 * time.Minute
+
+// A token whose signature, time claims and audience were checked, with what each
+// request authenticated by it needs precomputed
+type verifiedToken struct {
+	claims     jwt.MapClaims
+	user       User // copied for each request
+	keyID      string
+	hash       string   // see hashToken
+	principals []string // see cutoffPrincipals
+	issuedAt   int64
+}
+
+func newTokenCache(clock Clock) *cache.Cache[string, *verifiedToken] {
+	return cache.New[string, *verifiedToken](cache.Options[*verifiedToken]{
+		Name:       "tokens",
+		MaxEntries: TOKEN_CACHE_SIZE,
+		Now:        clock.Now,
+	})
+}
+
+// The claims of a valid, unexpired token. Clients send the same token with request
+// after request, and decoding it and checking its signature is most of the cost of
+// authenticating one, so verified tokens are cached by their text until they expire,
+// for at most TOKEN_CACHE_TTL, and while the key that signed them is still in the key
+// ring. The audience is not rechecked on a hit, but Reload empties the cache, so no
+// entry outlives the settings it was verified with. Whatever can end a token early — the revocation list (see revoked), its session
+// and cutoffs — is left to the caller to check on every request. Requests with
+// Overrides bypass the cache, whose entries were verified with the App's keys and clock.
+func (a *App) verifyToken(ctx context.Context, token string) (*verifiedToken, error) {
+	_, overridden := OverridesFromContext(ctx)
+	if verified, ok := a.tokenCache.Get(token); ok && !overridden {
+		if _, ok := a.keys(ctx).Lookup(verified.keyID); ok {
+			return verified, nil
+		}
+		a.tokenCache.Delete(token)
+	}
+	claims, key, err := a.parseTokenKey(ctx, token, false)
+	if err != nil {
+		return nil, err
+	}
+	issuedAt, _ := claims["iat"].(float64)
+	verified := &verifiedToken{
+		claims:     claims,
+		user:       *newUserFromClaims(claims),
+		keyID:      key.ID,
+		hash:       hashToken(token),
+		principals: cutoffPrincipals(claims),
+		issuedAt:   int64(issuedAt),
+	}
+	ttl := TOKEN_CACHE_TTL
+	if exp, ok := claims["exp"].(float64); ok {
+		ttl = min(ttl, time.Unix(int64(exp), 0).Sub(a.clock(ctx).Now()))
+	}
+	if ttl > 0 && !overridden {
+		a.tokenCache.SetWithTTL(token, verified, ttl)
+	}
+	return verified, nil
+}
+
+// Reports whether token is on the revocation list, using the hash computed when it was
+// verified where the list is keyed by hashes
+func (a *App) revoked(ctx context.Context, token string, verified *verifiedToken) bool {
+	if hashed, ok := a.stores(ctx).Revocations.(hashedBlacklist); ok {
+		return hashed.ContainsHash(verified.hash)
+	}
+	return a.stores(ctx).Revocations.Contains(token)
+}
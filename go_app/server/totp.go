@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238); these are the defaults every authenticator app supports
+const (
+	TOTP_PERIOD = 30 * time.Second
+	TOTP_DIGITS = 6
+	TOTP_SKEW   = 1 // accepted steps before and after the current one, for clock drift
+)
+
+// Number of single-use recovery codes issued on enrollment
+const RECOVERY_CODE_COUNT = 10
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Random 160-bit secret, base32 encoded as authenticator apps expect
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(secret), nil
+}
+
+// otpauth:// URI that authenticator apps import, usually rendered as a QR code
+func totpProvisioningURI(issuer, account, secret string) string {
+	query := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {fmt.Sprint(TOTP_DIGITS)},
+		"period":    {fmt.Sprint(int(TOTP_PERIOD.Seconds()))},
+	}
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+// HOTP value (RFC 4226) of secret for counter
+func hotp(secret []byte, counter uint64) string {
+	var message [8]byte
+	binary.BigEndian.PutUint64(message[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(message[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < TOTP_DIGITS; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTP_DIGITS, code%modulus)
+}
+
+func totpStep(now time.Time) int64 {
+	return now.Unix() / int64(TOTP_PERIOD.Seconds())
+}
+
+// Checks code against the steps around now, returning the matching step. Steps at or
+// before lastStep are refused so an observed code cannot be replayed.
+func verifyTOTP(secret, code string, now time.Time, lastStep int64) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != TOTP_DIGITS {
+		return 0, false
+	}
+	current := totpStep(now)
+	for step := current - TOTP_SKEW; step <= current+TOTP_SKEW; step++ {
+		if step <= lastStep || step < 0 {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, uint64(step))), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// Single-use recovery codes, returned in clear once and stored as SHA-256 hashes
+func generateRecoveryCodes() (codes []string, hashes []string, err error) {
+	for i := 0; i < RECOVERY_CODE_COUNT; i++ {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Secret of the RFC 4226 and RFC 6238 SHA-1 test vectors
+const rfcSecret = "12345678901234567890"
+
+var rfcSecretBase32 = base32NoPadding.EncodeToString([]byte(rfcSecret))
+
+func TestHOTP(t *testing.T) {
+	// RFC 4226 appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		if got := hotp([]byte(rfcSecret), uint64(counter)); got != code {
+			t.Errorf("hotp(%d) = %s, want %s", counter, got, code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	// RFC 6238 appendix B lists 8 digits; 6-digit codes are their last 6
+	tests := []struct {
+		name     string
+		unix     int64
+		code     string
+		lastStep int64
+		wantStep int64
+		wantOK   bool
+	}{
+		{name: "RFC 6238 at 59", unix: 59, code: "287082", wantStep: 1, wantOK: true},
+		{name: "RFC 6238 at 1111111109", unix: 1111111109, code: "081804", wantStep: 37037036, wantOK: true},
+		{name: "RFC 6238 at 1111111111", unix: 1111111111, code: "050471", wantStep: 37037037, wantOK: true},
+		{name: "RFC 6238 at 1234567890", unix: 1234567890, code: "005924", wantStep: 41152263, wantOK: true},
+		{name: "RFC 6238 at 2000000000", unix: 2000000000, code: "279037", wantStep: 66666666, wantOK: true},
+		{name: "RFC 6238 at 20000000000", unix: 20000000000, code: "353130", wantStep: 666666666, wantOK: true},
+		{name: "previous step within skew", unix: 1111111111 + 30, code: "050471", wantStep: 37037037, wantOK: true},
+		{name: "next step within skew", unix: 1111111111 - 30, code: "050471", wantStep: 37037037, wantOK: true},
+		{name: "two steps old", unix: 1111111111 + 60, code: "050471"},
+		{name: "two steps ahead", unix: 1111111111 - 60, code: "050471"},
+		{name: "replayed step", unix: 1111111111, code: "050471", lastStep: 37037037},
+		{name: "step after the last accepted", unix: 1111111111, code: "050471", lastStep: 37037036, wantStep: 37037037, wantOK: true},
+		{name: "wrong code", unix: 1111111111, code: "050472"},
+		{name: "8 digits", unix: 1111111111, code: "14050471"},
+		{name: "empty", unix: 1111111111, code: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := verifyTOTP(rfcSecretBase32, test.code, time.Unix(test.unix, 0), test.lastStep)
+			if ok != test.wantOK || step != test.wantStep {
+				t.Errorf("verifyTOTP() = %d, %v, want %d, %v", step, ok, test.wantStep, test.wantOK)
+			}
+		})
+	}
+
+	if _, ok := verifyTOTP(strings.ToLower(rfcSecretBase32), "287082", time.Unix(59, 0), 0); !ok {
+		t.Error("verifyTOTP() refused a lowercase secret")
+	}
+	if _, ok := verifyTOTP("not base32!", "287082", time.Unix(59, 0), 0); ok {
+		t.Error("verifyTOTP() accepted a code for a malformed secret")
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	keys, err := NewRandomKeyProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewMockClock(time.Unix(1111111111, 0))
+	store := NewMemoryTwoFactorStore()
+	app := NewApp(DefaultConfig(), log.New(io.Discard, "", 0), clock, keys, Stores{
+		Blacklist:   NewMemoryBlacklist(),
+		Revocations: NewMemoryBlacklist(),
+		Users:       NewMemoryUserStore(),
+		TwoFactor:   store,
+	})
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store.Save(ctx, TwoFactor{UserID: "1", Secret: rfcSecretBase32, Enabled: true, RecoveryCodes: hashes})
+
+	// In order: each step sees the enrollment the ones before it left behind
+	steps := []struct {
+		name string
+		code string
+		want bool
+	}{
+		{name: "current code", code: "050471", want: true},
+		{name: "same code replayed", code: "050471", want: false},
+		{name: "earlier code of the skew window", code: "081804", want: false},
+		{name: "recovery code", code: codes[0], want: true},
+		{name: "recovery code reused", code: codes[0], want: false},
+		{name: "recovery code in capitals without its dash", code: strings.ToUpper(strings.ReplaceAll(codes[1], "-", "")), want: true},
+		{name: "unknown recovery code", code: "aaaa-aaaa", want: false},
+		{name: "empty", code: " ", want: false},
+	}
+	for _, step := range steps {
+		ok, err := app.verifySecondFactor(ctx, "1", step.code)
+		if err != nil || ok != step.want {
+			t.Errorf("%s: verifySecondFactor() = %v, %v, want %v", step.name, ok, err, step.want)
+		}
+	}
+
+	enrollment, _, _ := store.Get(ctx, "1")
+	if enrollment.LastStep != 37037037 {
+		t.Errorf("LastStep = %d, want the accepted step 37037037", enrollment.LastStep)
+	}
+	if len(enrollment.RecoveryCodes) != RECOVERY_CODE_COUNT-2 {
+		t.Errorf("%d recovery codes left, want %d", len(enrollment.RecoveryCodes), RECOVERY_CODE_COUNT-2)
+	}
+
+	// The next step's code is accepted once the clock reaches it
+	clock.Advance(TOTP_PERIOD)
+	if ok, err := app.verifySecondFactor(ctx, "1", hotp([]byte(rfcSecret), 37037038)); err != nil || !ok {
+		t.Errorf("verifySecondFactor() of the next step's code = %v, %v, want true", ok, err)
+	}
+
+	// A pending enrollment takes TOTP codes, to confirm it, but no recovery codes
+	store.Save(ctx, TwoFactor{UserID: "2", Secret: rfcSecretBase32, RecoveryCodes: hashes})
+	if ok, _ := app.verifySecondFactor(ctx, "2", codes[2]); ok {
+		t.Error("verifySecondFactor() accepted a recovery code of a pending enrollment")
+	}
+	if ok, _ := app.verifySecondFactor(ctx, "2", hotp([]byte(rfcSecret), 37037038)); !ok {
+		t.Error("verifySecondFactor() refused a TOTP code of a pending enrollment")
+	}
+	if ok, _ := app.verifySecondFactor(ctx, "3", "050471"); ok {
+		t.Error("verifySecondFactor() accepted a code of a user without an enrollment")
+	}
+}
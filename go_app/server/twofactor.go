@@ -0,0 +1,314 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authentication methods recorded in the token's "amr" claim (RFC 8176)
+const (
+	AMR_PASSWORD = "pwd"
+	AMR_OTP      = "otp"
+)
+
+// A user's TOTP enrollment. It is pending until the first code is confirmed.
+type TwoFactor struct {
+	UserID        string
+	Secret        string
+	Enabled       bool
+	RecoveryCodes []string // SHA-256 hashes of the unused recovery codes
+	LastStep      int64    // last accepted TOTP step, refused afterwards to prevent replay
+}
+
+// Persists two-factor enrollments
+type TwoFactorStore interface {
+	Get(ctx context.Context, userID string) (TwoFactor, bool, error)
+	Save(ctx context.Context, enrollment TwoFactor) error
+	Delete(ctx context.Context, userID string) error
+}
+
+type memoryTwoFactorStore struct {
+	mutex       sync.Mutex
+	enrollments map[string]TwoFactor
+}
+
+func NewMemoryTwoFactorStore() TwoFactorStore {
+	return &memoryTwoFactorStore{enrollments: make(map[string]TwoFactor)}
+}
+
+func (s *memoryTwoFactorStore) Get(ctx context.Context, userID string) (TwoFactor, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	enrollment, ok := s.enrollments[userID]
+	enrollment.RecoveryCodes = append([]string(nil), enrollment.RecoveryCodes...)
+	return enrollment, ok, nil
+}
+
+func (s *memoryTwoFactorStore) Save(ctx context.Context, enrollment TwoFactor) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.enrollments[enrollment.UserID] = enrollment
+	return nil
+}
+
+func (s *memoryTwoFactorStore) Delete(ctx context.Context, userID string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.enrollments, userID)
+	return nil
+}
+
+// Enrollments in a SQL database; recovery code hashes are stored comma separated
+type sqlTwoFactorStore struct {
+	db     *sql.DB
+	driver string
+}
+
+const twoFactorSchema = `CREATE TABLE IF NOT EXISTS two_factor (
+	user_id TEXT PRIMARY KEY,
+	secret TEXT NOT NULL,
+	enabled INTEGER NOT NULL,
+	recovery_codes TEXT NOT NULL,
+	last_step BIGINT NOT NULL
+)`
+
+// Creates the two_factor table if needed
+func NewSQLTwoFactorStore(db *sql.DB, driver string) (TwoFactorStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DATABASE_CONNECT_TIMEOUT)
+	defer cancel()
+	if _, err := db.ExecContext(ctx, twoFactorSchema); err != nil {
+		return nil, err
+	}
+	return &sqlTwoFactorStore{db: db, driver: driver}, nil
+}
+
+func (s *sqlTwoFactorStore) Get(ctx context.Context, userID string) (TwoFactor, bool, error) {
+	row := s.db.QueryRowContext(ctx, rebind(s.driver, `SELECT user_id, secret, enabled, recovery_codes, last_step FROM two_factor WHERE user_id = ?`), userID)
+	var enrollment TwoFactor
+	var enabled int
+	var codes string
+	err := row.Scan(&enrollment.UserID, &enrollment.Secret, &enabled, &codes, &enrollment.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TwoFactor{}, false, nil
+	}
+	if err != nil {
+		return TwoFactor{}, false, err
+	}
+	enrollment.Enabled = enabled == 1
+	if codes != "" {
+		enrollment.RecoveryCodes = strings.Split(codes, ",")
+	}
+	return enrollment, true, nil
+}
+
+func (s *sqlTwoFactorStore) Save(ctx context.Context, enrollment TwoFactor) error {
+	enabled := 0
+	if enrollment.Enabled {
+		enabled = 1
+	}
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `INSERT INTO two_factor (user_id, secret, enabled, recovery_codes, last_step) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id) DO UPDATE SET secret = excluded.secret, enabled = excluded.enabled, recovery_codes = excluded.recovery_codes, last_step = excluded.last_step`),
+		enrollment.UserID, enrollment.Secret, enabled, strings.Join(enrollment.RecoveryCodes, ","), enrollment.LastStep)
+	return err
+}
+
+func (s *sqlTwoFactorStore) Delete(ctx context.Context, userID string) error {
+	_, err := s.db.ExecContext(ctx, rebind(s.driver, `DELETE FROM two_factor WHERE user_id = ?`), userID)
+	return err
+}
+
+// Returns the user's enrollment if two-factor authentication is enabled
+func (a *App) twoFactorEnabled(ctx context.Context, userID string) (TwoFactor, bool, error) {
+	enrollment, exists, err := a.stores(ctx).TwoFactor.Get(ctx, userID)
+	if err != nil || !exists || !enrollment.Enabled {
+		return TwoFactor{}, false, err
+	}
+	return enrollment, true, nil
+}
+
+// Accepts a current TOTP code or an unused recovery code, which is then consumed
+func (a *App) verifySecondFactor(ctx context.Context, userID, code string) (bool, error) {
+	a.twoFactorMutex.Lock()
+	defer a.twoFactorMutex.Unlock()
+
+	enrollment, exists, err := a.stores(ctx).TwoFactor.Get(ctx, userID)
+	if err != nil || !exists {
+		return false, err
+	}
+	code = strings.TrimSpace(code)
+	if step, ok := verifyTOTP(enrollment.Secret, code, a.clock(ctx).Now(), enrollment.LastStep); ok {
+		enrollment.LastStep = step
+		return true, a.stores(ctx).TwoFactor.Save(ctx, enrollment)
+	}
+	if !enrollment.Enabled {
+		return false, nil
+	}
+
+	hash := hashRecoveryCode(code)
+	for i, unused := range enrollment.RecoveryCodes {
+		if unused == hash {
+			enrollment.RecoveryCodes = append(enrollment.RecoveryCodes[:i], enrollment.RecoveryCodes[i+1:]...)
+			a.Logger.Printf("audit: event=recovery_code_used user=%s remaining=%d", userID, len(enrollment.RecoveryCodes))
+			return true, a.stores(ctx).TwoFactor.Save(ctx, enrollment)
+		}
+	}
+	return false, nil
+}
+
+// Reports whether the token was issued after a second factor was verified
+func steppedUp(claims map[string]interface{}) bool {
+	switch methods := claims["amr"].(type) {
+	case []string:
+		for _, method := range methods {
+			if method == AMR_OTP {
+				return true
+			}
+		}
+	case []interface{}:
+		for _, method := range methods {
+			if method == AMR_OTP {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Only lets principals whose token carries the two-factor step-up claim through
+func (a *App) requireTwoFactor(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := UserFromContext(r.Context())
+		if !ok {
+			a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Authentication required")
+			return
+		}
+		if !steppedUp(user.Claims) {
+			a.handleErrorResponse(w, r, http.StatusForbidden, "Forbidden: Two-factor authentication required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Starts enrollment with a fresh secret; the returned URI is usually shown as a QR code
+func (a *App) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	if _, enabled, err := a.twoFactorEnabled(r.Context(), user.ID); err != nil || enabled {
+		if err != nil {
+			a.Logger.Println("Two-factor lookup failed:", err)
+			a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		a.handleErrorResponse(w, r, http.StatusConflict, "Conflict: Two-factor authentication is already enabled")
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err == nil {
+		err = a.stores(r.Context()).TwoFactor.Save(r.Context(), TwoFactor{UserID: user.ID, Secret: secret})
+	}
+	if err != nil {
+		a.Logger.Println("Two-factor enrollment failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	a.writeJSON(w, r, http.StatusOK, map[string]string{
+		"secret": secret,
+		"uri":    totpProvisioningURI(a.Config.Discovery.ServiceName, user.Username, secret),
+	})
+}
+
+// Enables two-factor authentication once a code from the new secret checks out and
+// returns the recovery codes, which are not shown again
+func (a *App) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Code == "" {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: code is required")
+		return
+	}
+
+	enrollment, exists, err := a.stores(r.Context()).TwoFactor.Get(r.Context(), user.ID)
+	if err != nil {
+		a.Logger.Println("Two-factor lookup failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !exists {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: Two-factor enrollment not started")
+		return
+	}
+	if enrollment.Enabled {
+		a.handleErrorResponse(w, r, http.StatusConflict, "Conflict: Two-factor authentication is already enabled")
+		return
+	}
+	if ok, err := a.verifySecondFactor(r.Context(), user.ID, request.Code); !ok {
+		if err != nil {
+			a.Logger.Println("Two-factor verification failed:", err)
+		}
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: Invalid two-factor code")
+		return
+	}
+
+	codes, err := a.resetRecoveryCodes(r.Context(), user.ID, true)
+	if err != nil {
+		a.Logger.Println("Two-factor enrollment failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	a.Logger.Printf("audit: event=2fa_enabled user=%s ip=%s", user.ID, clientIP(r))
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+}
+
+// Replaces the caller's recovery codes, invalidating the old ones
+func (a *App) recoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	codes, err := a.resetRecoveryCodes(r.Context(), user.ID, false)
+	if err != nil {
+		a.Logger.Println("Recovery code generation failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	a.Logger.Printf("audit: event=recovery_codes_reset user=%s ip=%s", user.ID, clientIP(r))
+	a.writeJSON(w, r, http.StatusOK, map[string]interface{}{"recoveryCodes": codes})
+}
+
+func (a *App) resetRecoveryCodes(ctx context.Context, userID string, enable bool) ([]string, error) {
+	a.twoFactorMutex.Lock()
+	defer a.twoFactorMutex.Unlock()
+
+	enrollment, exists, err := a.stores(ctx).TwoFactor.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, errors.New("no two-factor enrollment")
+	}
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	enrollment.RecoveryCodes = hashes
+	enrollment.Enabled = enrollment.Enabled || enable
+	return codes, a.stores(ctx).TwoFactor.Save(ctx, enrollment)
+}
+
+// Turns two-factor authentication off for the caller
+func (a *App) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, _ := UserFromContext(r.Context())
+	if err := a.stores(r.Context()).TwoFactor.Delete(r.Context(), user.ID); err != nil {
+		a.Logger.Println("Two-factor removal failed:", err)
+		a.handleErrorResponse(w, r, http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	a.Logger.Printf("audit: event=2fa_disabled user=%s ip=%s", user.ID, clientIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// Largest JSON body Handle decodes
+const MAX_JSON_BODY = 1 << 20
+
+// Implemented by request types that check their own fields. A failure answers 400.
+type Validator interface {
+	Validate() error
+}
+
+// Implemented by response types that answer with a status other than 200
+type StatusCoder interface {
+	StatusCode() int
+}
+
+// Response of handlers that answer 204 without a body
+type NoContent struct{}
+
+func (NoContent) StatusCode() int { return http.StatusNoContent }
+
+// Adapts a typed function to an http.HandlerFunc, so the function deals only with
+// values and errors:
+//
+//   - Req is decoded from the JSON body when there is one. Fields tagged path:"name" or
+//     query:"name" are then filled from r.PathValue and the query string.
+//   - Req is validated if it implements Validator.
+//   - A *RejectError answers with its status and message, a context error with 503 and
+//     anything else with 500, logging the error.
+//   - Resp is encoded as JSON with 200, or its StatusCoder status.
+//
+// The context carries the authenticated user (UserFromContext) and the client IP
+// (clientIPFromContext).
+func Handle[Req, Resp any](a *App, fn func(ctx context.Context, request Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var request Req
+		if err := decodeRequest(w, r, &request); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				a.handleErrorResponse(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+				return
+			}
+			a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: "+err.Error())
+			return
+		}
+		if validator, ok := any(request).(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: "+err.Error())
+				return
+			}
+		}
+
+		ctx := context.WithValue(r.Context(), clientIPContextKey{}, clientIP(r))
+		response, err := fn(ctx, request)
+		if err != nil {
+			a.handleTypedError(w, r, err)
+			return
+		}
+
+		status := http.StatusOK
+		if coder, ok := any(response).(StatusCoder); ok {
+			status = coder.StatusCode()
+		}
+		if status == http.StatusNoContent {
+			w.WriteHeader(status)
+			return
+		}
+		a.writeJSON(w, r, status, response)
+	}
+}
+
+func (a *App) handleTypedError(w http.ResponseWriter, r *http.Request, err error) {
+	status, message := a.typedErrorStatus(r, err)
+	a.handleErrorResponse(w, r, status, message)
+}
+
+// The status and message err answers with, logging errors that answer 500
+func (a *App) typedErrorStatus(r *http.Request, err error) (int, string) {
+	var rejected *RejectError
+	switch {
+	case errors.As(err, &rejected):
+		return rejected.Status, rejected.Message
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable, "Service Unavailable"
+	default:
+		a.Log.Error("Handler failed", "method", r.Method, "path", r.URL.Path, "error", err)
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+}
+
+func decodeRequest(w http.ResponseWriter, r *http.Request, request any) error {
+	if r.Body != nil && r.Body != http.NoBody {
+		body := http.MaxBytesReader(w, r.Body, MAX_JSON_BODY)
+		if err := json.NewDecoder(body).Decode(request); err != nil && !errors.Is(err, io.EOF) {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				return err
+			}
+			return errors.New("invalid JSON body")
+		}
+	}
+
+	value := reflect.ValueOf(request).Elem()
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		var raw string
+		if name := field.Tag.Get("path"); name != "" {
+			raw = r.PathValue(name)
+		} else if name := field.Tag.Get("query"); name != "" && r.URL.Query().Has(name) {
+			raw = r.URL.Query().Get(name)
+		} else {
+			continue
+		}
+		if err := setField(value.Field(i), raw); err != nil {
+			return fmt.Errorf("%s: %w", field.Name, err)
+		}
+	}
+	return nil
+}
+
+// Parses raw into a string, integer or bool field
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		field.SetInt(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("not a boolean")
+		}
+		field.SetBool(b)
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// The client IP stored by filterClients or Handle, empty outside a request
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPContextKey{}).(string)
+	return ip
+}
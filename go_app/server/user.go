@@ -0,0 +1,84 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// How the principal of a request was authenticated
+const (
+	AUTH_METHOD_JWT  = "jwt"
+	AUTH_METHOD_MTLS = "mtls"
+)
+
+// The authenticated principal of a request
+type User struct {
+	ID         string
+	Username   string
+	AuthMethod string
+	Claims     jwt.MapClaims
+}
+
+// Unexported key type so no other package can read or overwrite the principal
+type userContextKey struct{}
+
+func newUserFromClaims(claims jwt.MapClaims) *User {
+	user := &User{AuthMethod: AUTH_METHOD_JWT, Claims: claims}
+	if id, ok := claims["id"]; ok && id != nil {
+		user.ID = fmt.Sprintf("%v", id)
+	}
+	if username, ok := claims["username"].(string); ok {
+		user.Username = username
+	}
+	return user
+}
+
+// Reports whether the "roles" claim contains any of roles
+func (u *User) HasAnyRole(roles ...string) bool {
+	granted, _ := u.Claims["roles"].([]interface{})
+	for _, role := range granted {
+		for _, wanted := range roles {
+			if role == wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The granted scopes: the "scope" claim, space separated as in OAuth 2.0, or a list
+func (u *User) Scopes() []string {
+	return claimScopes(u.Claims)
+}
+
+// Reports whether the token was granted every one of scopes
+func (u *User) HasScopes(scopes ...string) bool {
+	granted := u.Scopes()
+	for _, wanted := range scopes {
+		if !contains(granted, wanted) {
+			return false
+		}
+	}
+	return true
+}
+
+func withUser(ctx context.Context, user *User) context.Context {
+	return context.WithValue(ctx, userContextKey{}, user)
+}
+
+// Returns the principal stored by the authentication middleware, if any
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*User)
+	return user, ok && user != nil
+}
+
+// Removes identity headers a client could use to impersonate another user
+func stripIdentityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del("User")
+		next.ServeHTTP(w, r)
+	})
+}
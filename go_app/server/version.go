@@ -0,0 +1,162 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"go_app/subprocess"
+)
+
+// Where the commit SHA reported by /status comes from
+const (
+	VERSION_SOURCE_AUTO      = "auto" // the first of the others that has one, in this order
+	VERSION_SOURCE_LDFLAGS   = "ldflags"
+	VERSION_SOURCE_ENV       = "env"
+	VERSION_SOURCE_FILE      = "file"
+	VERSION_SOURCE_BUILDINFO = "buildinfo"
+	VERSION_SOURCE_GIT       = "git"
+)
+
+// Environment variable read by the env source, as set by most CI systems or a
+// Dockerfile's ARG/ENV
+const GIT_SHA_ENV = "GIT_SHA"
+
+// Set at link time with -ldflags "-X go_app/server.BuildSHA=$(git rev-parse HEAD)"
+var BuildSHA string
+
+// Returned when a source has no SHA in this build or environment
+var ErrNoVersion = errors.New("no commit SHA available")
+
+// Provides the commit SHA of the running build
+type VersionSource interface {
+	SHA(ctx context.Context) (string, error)
+	String() string
+}
+
+// Builds the source named by config.VersionSource. file is read by the file source.
+func NewVersionSource(name, file string) (VersionSource, error) {
+	switch name {
+	case VERSION_SOURCE_LDFLAGS:
+		return ldflagsVersion{}, nil
+	case VERSION_SOURCE_ENV:
+		return envVersion{}, nil
+	case VERSION_SOURCE_FILE:
+		return fileVersion{path: file}, nil
+	case VERSION_SOURCE_BUILDINFO:
+		return buildInfoVersion{}, nil
+	case VERSION_SOURCE_GIT:
+		return gitVersion{}, nil
+	case VERSION_SOURCE_AUTO, "":
+		return firstVersion{ldflagsVersion{}, envVersion{}, fileVersion{path: file}, buildInfoVersion{}, gitVersion{}}, nil
+	}
+	return nil, fmt.Errorf("unknown version source %q", name)
+}
+
+type ldflagsVersion struct{}
+
+func (ldflagsVersion) SHA(ctx context.Context) (string, error) {
+	if BuildSHA == "" {
+		return "", ErrNoVersion
+	}
+	return BuildSHA, nil
+}
+
+func (ldflagsVersion) String() string { return VERSION_SOURCE_LDFLAGS }
+
+type envVersion struct{}
+
+func (envVersion) SHA(ctx context.Context) (string, error) {
+	if sha := strings.TrimSpace(os.Getenv(GIT_SHA_ENV)); sha != "" {
+		return sha, nil
+	}
+	return "", ErrNoVersion
+}
+
+func (envVersion) String() string { return VERSION_SOURCE_ENV + " " + GIT_SHA_ENV }
+
+// A file holding the SHA, e.g. written by `git rev-parse HEAD > VERSION` before the
+// source tree is copied into an image without .git
+type fileVersion struct {
+	path string
+}
+
+func (f fileVersion) SHA(ctx context.Context) (string, error) {
+	content, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", ErrNoVersion
+	}
+	if err != nil {
+		return "", err
+	}
+	sha, _, _ := strings.Cut(strings.TrimSpace(string(content)), "\n")
+	if sha = strings.TrimSpace(sha); sha == "" {
+		return "", ErrNoVersion
+	}
+	return sha, nil
+}
+
+func (f fileVersion) String() string { return VERSION_SOURCE_FILE + " " + f.path }
+
+// The vcs.revision the go command stamps into binaries built inside a checkout
+type buildInfoVersion struct{}
+
+func (buildInfoVersion) SHA(ctx context.Context) (string, error) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", ErrNoVersion
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && setting.Value != "" {
+			return setting.Value, nil
+		}
+	}
+	return "", ErrNoVersion
+}
+
+func (buildInfoVersion) String() string { return VERSION_SOURCE_BUILDINFO }
+
+// Asks git about the working directory. Concurrent /status requests share one git
+// process, and the SHA is reused for as long as the metadata is cached.
+type gitVersion struct{}
+
+func (gitVersion) SHA(ctx context.Context) (string, error) {
+	output, err := subprocess.Default.Cached(ctx, subprocess.Command{
+		Name:      "git",
+		Args:      []string{"rev-parse", "HEAD"},
+		Timeout:   GIT_SHA_TIMEOUT,
+		MaxOutput: 256,
+	}, CACHE_DURATION_MS*time.Millisecond)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (gitVersion) String() string { return VERSION_SOURCE_GIT }
+
+// Tries each source in order and returns the first SHA found
+type firstVersion []VersionSource
+
+func (sources firstVersion) SHA(ctx context.Context) (string, error) {
+	var errs []error
+	for _, source := range sources {
+		sha, err := source.SHA(ctx)
+		if err == nil {
+			return sha, nil
+		}
+		if !errors.Is(err, ErrNoVersion) {
+			errs = append(errs, fmt.Errorf("%s: %w", source, err))
+		}
+	}
+	if len(errs) == 0 {
+		return "", ErrNoVersion
+	}
+	return "", errors.Join(errs...)
+}
+
+func (sources firstVersion) String() string { return VERSION_SOURCE_AUTO }
@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/messaging"
+)
+
+// Webhook deliveries per provider and outcome, published on /debug/vars
+var webhookMetrics = expvar.NewMap("webhooks")
+
+// How a provider signs its deliveries
+const (
+	// X-Hub-Signature-256: sha256=hex(HMAC-SHA256(secret, body)), with the delivery ID in
+	// X-GitHub-Delivery
+	WEBHOOK_SIGNATURE_GITHUB = "github"
+	// Stripe-Signature: t=TIMESTAMP,v1=hex(HMAC-SHA256(secret, "TIMESTAMP.body")), where
+	// several v1 entries may be sent while a secret is rolled
+	WEBHOOK_SIGNATURE_STRIPE = "stripe"
+)
+
+// Largest delivery accepted, it is read into memory to be verified
+const WEBHOOK_MAX_BODY = 5 << 20
+
+// How long delivery IDs are remembered to drop redeliveries and replays
+const WEBHOOK_DEDUP_WINDOW = 24 * time.Hour
+
+// Incoming webhooks. Secrets come from the config so they stay out of the code.
+type WebhookConfig struct {
+	Secrets   string        // provider:secret pairs, separated by commas
+	Tolerance time.Duration // how old a signed timestamp may be, for providers that send one
+}
+
+// A receiver for POST /webhooks/{provider}
+type Webhook struct {
+	Provider  string // path segment and the name its secret is configured under
+	Signature string // WEBHOOK_SIGNATURE_*
+	// Fields the JSON payload must have, by dotted path, with their JSON type: string,
+	// number, boolean, object or array, e.g. {"repository.full_name": "string"}
+	Fields map[string]string
+	// Handles verified deliveries from the message log, at least once and after the
+	// provider was answered. Returning messaging.ErrPermanent dead-letters a delivery.
+	Handle      func(ctx context.Context, delivery WebhookDelivery) error
+	Concurrency int // deliveries handled at once, 1 when less
+}
+
+// A verified delivery as queued for its handler
+type WebhookDelivery struct {
+	Provider   string          `json:"provider"`
+	ID         string          `json:"id"`
+	Event      string          `json:"event,omitempty"` // e.g. GitHub's X-GitHub-Event or Stripe's type
+	Payload    json.RawMessage `json:"payload"`
+	ReceivedAt time.Time       `json:"receivedAt"`
+}
+
+// The message log topic a provider's deliveries are queued on
+func WebhookTopic(provider string) string {
+	return "webhooks." + provider
+}
+
+var (
+	errWebhookSignature = errors.New("invalid signature")
+	errWebhookExpired   = errors.New("signature expired")
+)
+
+// Registers hook and its handler on the consumer. Register before the server starts;
+// deliveries for providers without a configured secret are refused.
+func (a *App) RegisterWebhook(hook Webhook) error {
+	switch {
+	case hook.Provider == "":
+		return errors.New("webhook needs a provider")
+	case hook.Signature != WEBHOOK_SIGNATURE_GITHUB && hook.Signature != WEBHOOK_SIGNATURE_STRIPE:
+		return fmt.Errorf("webhook %s: unknown signature scheme %q", hook.Provider, hook.Signature)
+	case hook.Handle == nil:
+		return fmt.Errorf("webhook %s needs a handler", hook.Provider)
+	}
+	if _, exists := a.webhooks[hook.Provider]; exists {
+		return fmt.Errorf("webhook %s is already registered", hook.Provider)
+	}
+	for path, kind := range hook.Fields {
+		if !contains([]string{"string", "number", "boolean", "object", "array"}, kind) {
+			return fmt.Errorf("webhook %s: field %s has unknown type %q", hook.Provider, path, kind)
+		}
+	}
+	a.webhooks[hook.Provider] = hook
+	a.Consumer.Handle(WebhookTopic(hook.Provider), hook.Concurrency, func(ctx context.Context, m messaging.Message) error {
+		var delivery WebhookDelivery
+		if err := m.Decode(&delivery); err != nil {
+			return fmt.Errorf("%w: %v", messaging.ErrPermanent, err)
+		}
+		return hook.Handle(ctx, delivery)
+	})
+	return nil
+}
+
+// Verifies a delivery, drops ones already received and queues the rest for the
+// provider's handler. Providers get 202 once the delivery is stored, so a slow handler
+// doesn't make them time out and retry.
+func (a *App) receiveWebhook(w http.ResponseWriter, r *http.Request) {
+	provider := r.PathValue("provider")
+	hook, ok := a.webhooks[provider]
+	secret := parseClientCredentials(a.Config.Webhooks.Secrets)[provider]
+	if !ok || secret == "" {
+		a.handleErrorResponse(w, r, http.StatusNotFound, "Not Found: Unknown webhook provider")
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, WEBHOOK_MAX_BODY+1))
+	if err != nil {
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request")
+		return
+	}
+	if len(body) > WEBHOOK_MAX_BODY {
+		a.handleErrorResponse(w, r, http.StatusRequestEntityTooLarge, "Request Entity Too Large")
+		return
+	}
+
+	delivery := WebhookDelivery{Provider: provider, Payload: body, ReceivedAt: a.clock(r.Context()).Now()}
+	switch hook.Signature {
+	case WEBHOOK_SIGNATURE_GITHUB:
+		delivery.ID, err = verifyGitHubSignature(r, body, secret)
+		delivery.Event = r.Header.Get("X-GitHub-Event")
+	case WEBHOOK_SIGNATURE_STRIPE:
+		delivery.ID, err = verifyStripeSignature(r, body, secret, a.clock(r.Context()).Now(), a.Config.Webhooks.Tolerance)
+	}
+	switch {
+	case errors.Is(err, errWebhookExpired):
+		webhookMetrics.Add(provider+".rejected", 1)
+		a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Request signature expired")
+		return
+	case err != nil:
+		webhookMetrics.Add(provider+".rejected", 1)
+		a.Logger.Printf("audit: event=webhook_rejected provider=%s reason=%q by=%s", provider, err, clientIP(r))
+		a.handleErrorResponse(w, r, http.StatusUnauthorized, "Unauthorized: Invalid request signature")
+		return
+	}
+
+	payload, err := checkWebhookPayload(body, hook.Fields)
+	if err != nil {
+		webhookMetrics.Add(provider+".invalid", 1)
+		a.handleErrorResponse(w, r, http.StatusBadRequest, "Bad Request: "+err.Error())
+		return
+	}
+	if delivery.Event == "" {
+		delivery.Event, _ = payload["type"].(string)
+	}
+
+	// Checked and recorded under the lock so concurrent redeliveries queue only once.
+	// Recorded after the append, so a delivery that couldn't be stored can be retried.
+	key := "webhook:" + provider + " " + delivery.ID
+	a.replayMutex.Lock()
+	defer a.replayMutex.Unlock()
+	if a.stores(r.Context()).Blacklist.Contains(key) {
+		webhookMetrics.Add(provider+".duplicate", 1)
+		a.writeJSON(w, r, http.StatusOK, map[string]string{"id": delivery.ID, "status": "duplicate"})
+		return
+	}
+	if _, err := messaging.Publish(r.Context(), a.stores(r.Context()).Messages, WebhookTopic(provider), delivery); err != nil {
+		a.Logger.Printf("Queueing %s webhook %s failed: %v", provider, delivery.ID, err)
+		a.handleErrorResponse(w, r, http.StatusServiceUnavailable, "Service Unavailable")
+		return
+	}
+	a.stores(r.Context()).Blacklist.Add(key, a.clock(r.Context()).Now().Add(WEBHOOK_DEDUP_WINDOW))
+	webhookMetrics.Add(provider+".queued", 1)
+	a.writeJSON(w, r, http.StatusAccepted, map[string]string{"id": delivery.ID, "status": "queued"})
+}
+
+// Checks X-Hub-Signature-256 and returns the delivery ID. GitHub sends no timestamp,
+// so only the delivery ID guards against replays.
+func verifyGitHubSignature(r *http.Request, body []byte, secret string) (string, error) {
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok || !hmac.Equal([]byte(webhookHMAC(secret, body)), []byte(strings.ToLower(signature))) {
+		return "", errWebhookSignature
+	}
+	id := r.Header.Get("X-GitHub-Delivery")
+	if id == "" {
+		return "", errors.New("missing X-GitHub-Delivery")
+	}
+	return id, nil
+}
+
+// Checks Stripe-Signature and the age of its timestamp. The event ID in the payload
+// identifies the delivery, or the signature for payloads without one.
+func verifyStripeSignature(r *http.Request, body []byte, secret string, now time.Time, tolerance time.Duration) (string, error) {
+	var timestamp string
+	var signatures []string
+	for _, part := range strings.Split(r.Header.Get("Stripe-Signature"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch name {
+		case "t":
+			timestamp = value
+		case "v1":
+			signatures = append(signatures, strings.ToLower(value))
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return "", errWebhookSignature
+	}
+	expected := webhookHMAC(secret, []byte(timestamp+"."), body)
+	matched := ""
+	for _, signature := range signatures {
+		if hmac.Equal([]byte(expected), []byte(signature)) {
+			matched = signature
+		}
+	}
+	if matched == "" {
+		return "", errWebhookSignature
+	}
+	// Checked after the signature, so an attacker can't probe the clock
+	if age := now.Sub(time.Unix(seconds, 0)); tolerance > 0 && (age > tolerance || age < -tolerance) {
+		return "", errWebhookExpired
+	}
+	var event struct {
+		ID string `json:"id"`
+	}
+	if json.Unmarshal(body, &event) == nil && event.ID != "" {
+		return event.ID, nil
+	}
+	return matched, nil
+}
+
+// hex(HMAC-SHA256(secret, parts...))
+func webhookHMAC(secret string, parts ...[]byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Decodes a payload and checks it has the required fields with their types
+func checkWebhookPayload(body []byte, fields map[string]string) (map[string]interface{}, error) {
+	var payload map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&payload); err != nil {
+		return nil, errors.New("Payload is not a JSON object")
+	}
+	for path, kind := range fields {
+		var value interface{} = payload
+		for _, key := range strings.Split(path, ".") {
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				value = nil
+				break
+			}
+			value = object[key]
+		}
+		if value == nil {
+			return nil, fmt.Errorf("Payload field %s is missing", path)
+		}
+		if jsonKind(value) != kind {
+			return nil, fmt.Errorf("Payload field %s must be a %s", path, kind)
+		}
+	}
+	return payload, nil
+}
+
+// The JSON type of a value decoded with UseNumber
+func jsonKind(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case json.Number:
+		return "number"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "null"
+}
@@ -0,0 +1,121 @@
+// Package session encrypts and authenticates cookie values with keys that can be
+// rotated. The server seals its session cookie with it (see session-cookie-keys);
+// services can seal cookies of their own the same way.
+package session
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go_app/configcrypt"
+)
+
+// Size of session keys: AES-256
+const KEY_SIZE = 32
+
+// Bytes naming the key a value was sealed with
+const keyIDSize = 4
+
+// Returned by Open for values that were tampered with, cut short, or sealed with a key
+// the codec no longer has
+var ErrInvalid = errors.New("session: invalid or unknown cookie value")
+
+// Seals cookie values with AES-256-GCM, which both encrypts them and authenticates
+// them: a value that was changed, or moved to a cookie of another name, doesn't open.
+// Keys rotate: the first key seals, every key opens, and each value names the key it
+// was sealed with.
+type Codec struct {
+	keys []codecKey
+}
+
+type codecKey struct {
+	id   [keyIDSize]byte
+	aead cipher.AEAD
+}
+
+// A codec sealing with the first of keys, each KEY_SIZE bytes
+func NewCodec(keys ...[]byte) (*Codec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("session: no key")
+	}
+	c := &Codec{}
+	for i, key := range keys {
+		if len(key) != KEY_SIZE {
+			return nil, fmt.Errorf("session: key %d must be %d bytes, got %d", i+1, KEY_SIZE, len(key))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		k := codecKey{aead: aead}
+		copy(k.id[:], sum[:])
+		c.keys = append(c.keys, k)
+	}
+	return c, nil
+}
+
+// Keys from a comma-separated list of base64 keys, newest first, in the format of
+// metadata keys (see scaffold encrypt -new-key). Entries starting with "@" name a file
+// holding the key.
+func ParseKeys(value string) ([][]byte, error) {
+	var keys [][]byte
+	for _, entry := range strings.Split(value, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		key, err := configcrypt.ParseKey(entry)
+		if err != nil {
+			return nil, fmt.Errorf("session key %d: %w", len(keys)+1, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Encrypts plaintext for the cookie name with the newest key
+func (c *Codec) Seal(name string, plaintext []byte) (string, error) {
+	key := c.keys[0]
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := append(key.id[:], nonce...)
+	sealed = key.aead.Seal(sealed, nonce, plaintext, []byte(name))
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts a value Seal made for the cookie name, with whichever key sealed it. stale
+// reports an older key, so the caller can seal the value anew.
+func (c *Codec) Open(name, value string) (plaintext []byte, stale bool, err error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < keyIDSize {
+		return nil, false, ErrInvalid
+	}
+	for i, key := range c.keys {
+		if string(key.id[:]) != string(sealed[:keyIDSize]) {
+			continue
+		}
+		rest := sealed[keyIDSize:]
+		if len(rest) < key.aead.NonceSize() {
+			return nil, false, ErrInvalid
+		}
+		nonce, ciphertext := rest[:key.aead.NonceSize()], rest[key.aead.NonceSize():]
+		plaintext, err := key.aead.Open(nil, nonce, ciphertext, []byte(name))
+		if err != nil {
+			return nil, false, ErrInvalid
+		}
+		return plaintext, i > 0, nil
+	}
+	return nil, false, ErrInvalid
+}
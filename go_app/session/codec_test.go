@@ -0,0 +1,121 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KEY_SIZE)
+}
+
+func newTestCodec(t *testing.T, keys ...[]byte) *Codec {
+	t.Helper()
+	codec, err := NewCodec(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return codec
+}
+
+// Flips one bit of the decoded value at i, counted from the start or, when negative,
+// from the end
+func flip(value string, i int) string {
+	raw, _ := base64.RawURLEncoding.DecodeString(value)
+	if i < 0 {
+		i += len(raw)
+	}
+	raw[i] ^= 0x01
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func TestCodec(t *testing.T) {
+	oldKey, newKey := testKey(1), testKey(2)
+	before := newTestCodec(t, oldKey)
+	rotated := newTestCodec(t, newKey, oldKey)
+	retired := newTestCodec(t, newKey)
+
+	sealedBefore, err := before.Seal("session", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := rotated.Seal("session", []byte("token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := rotated.Seal("session", []byte("token")); again == sealed {
+		t.Error("sealing twice gave the same value; the nonce must be random")
+	}
+	if strings.Contains(sealed, "token") {
+		t.Errorf("sealed value %q shows the plaintext", sealed)
+	}
+
+	tests := []struct {
+		name      string
+		codec     *Codec
+		cookie    string
+		value     string
+		wantStale bool
+		wantErr   bool
+	}{
+		{name: "round trip", codec: rotated, cookie: "session", value: sealed},
+		{name: "sealed with the previous key", codec: rotated, cookie: "session", value: sealedBefore, wantStale: true},
+		{name: "previous key removed", codec: retired, cookie: "session", value: sealedBefore, wantErr: true},
+		{name: "renamed cookie", codec: rotated, cookie: "other", value: sealed, wantErr: true},
+		{name: "tampered key ID", codec: rotated, cookie: "session", value: flip(sealed, 0), wantErr: true},
+		{name: "tampered nonce", codec: rotated, cookie: "session", value: flip(sealed, keyIDSize), wantErr: true},
+		{name: "tampered ciphertext", codec: rotated, cookie: "session", value: flip(sealed, -1), wantErr: true},
+		{name: "cut short", codec: rotated, cookie: "session", value: sealed[:len(sealed)-4], wantErr: true},
+		{name: "key ID only", codec: rotated, cookie: "session", value: sealed[:6], wantErr: true},
+		{name: "empty", codec: rotated, cookie: "session", value: "", wantErr: true},
+		{name: "not base64", codec: rotated, cookie: "session", value: "a plain token!", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plaintext, stale, err := test.codec.Open(test.cookie, test.value)
+			if test.wantErr {
+				if !errors.Is(err, ErrInvalid) || plaintext != nil {
+					t.Errorf("Open() = %q, %v, want ErrInvalid", plaintext, err)
+				}
+				return
+			}
+			if err != nil || string(plaintext) != "token" || stale != test.wantStale {
+				t.Errorf("Open() = %q, stale %v, %v, want \"token\", stale %v", plaintext, stale, err, test.wantStale)
+			}
+		})
+	}
+}
+
+func TestNewCodec(t *testing.T) {
+	if _, err := NewCodec(); err == nil {
+		t.Error("NewCodec() without keys succeeded")
+	}
+	if _, err := NewCodec(testKey(1), make([]byte, 16)); err == nil || !strings.Contains(err.Error(), "key 2") {
+		t.Errorf("NewCodec() with a short second key = %v, want an error naming key 2", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte(base64.StdEncoding.EncodeToString(testKey(3))+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ParseKeys(base64.StdEncoding.EncodeToString(testKey(1)) + ", ,@" + file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || !bytes.Equal(keys[0], testKey(1)) || !bytes.Equal(keys[1], testKey(3)) {
+		t.Errorf("ParseKeys() = %x, want the inline key, then the file's", keys)
+	}
+	if keys, err := ParseKeys(""); err != nil || len(keys) != 0 {
+		t.Errorf("ParseKeys(\"\") = %x, %v, want no keys", keys, err)
+	}
+	if _, err := ParseKeys("not base64!"); err == nil || !strings.Contains(err.Error(), "session key 1") {
+		t.Errorf("ParseKeys() of a malformed key = %v, want an error naming key 1", err)
+	}
+}
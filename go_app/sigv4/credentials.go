@@ -0,0 +1,300 @@
+package sigv4
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Temporary credentials are refreshed this long before they expire
+const CREDENTIALS_REFRESH_MARGIN = 5 * time.Minute
+
+// How long a failed lookup is remembered, so anonymous callers don't probe every time
+const CREDENTIALS_NEGATIVE_TTL = time.Minute
+
+// Looks up credentials in the same order as the AWS SDKs: environment variables, web
+// identity (EKS IRSA), the shared credentials file, the ECS container endpoint and the
+// EC2 instance metadata service. Results are cached until shortly before they expire.
+type CredentialChain struct {
+	HTTPClient *http.Client
+
+	mutex   sync.Mutex
+	cached  Credentials
+	err     error
+	checked time.Time
+}
+
+var defaultChain = &CredentialChain{HTTPClient: &http.Client{Timeout: 5 * time.Second}}
+
+// Credentials from the default chain, see CredentialChain
+func DefaultCredentials(ctx context.Context) (Credentials, error) {
+	return defaultChain.Retrieve(ctx)
+}
+
+func (c *CredentialChain) Retrieve(ctx context.Context) (Credentials, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	if c.err != nil && now.Sub(c.checked) < CREDENTIALS_NEGATIVE_TTL {
+		return Credentials{}, c.err
+	}
+	if c.err == nil && !c.checked.IsZero() && (c.cached.Expires.IsZero() || now.Before(c.cached.Expires.Add(-CREDENTIALS_REFRESH_MARGIN))) {
+		return c.cached, nil
+	}
+
+	c.cached, c.err = c.lookup(ctx)
+	c.checked = now
+	return c.cached, c.err
+}
+
+func (c *CredentialChain) lookup(ctx context.Context) (Credentials, error) {
+	if creds, err := CredentialsFromEnv(); err == nil {
+		return creds, nil
+	}
+	providers := []func(context.Context) (Credentials, error){
+		c.webIdentity,
+		sharedCredentials,
+		c.container,
+		c.instanceMetadata,
+	}
+	for _, provider := range providers {
+		creds, err := provider(ctx)
+		if err == nil {
+			return creds, nil
+		}
+		if !errors.Is(err, ErrNoCredentials) {
+			return Credentials{}, err
+		}
+	}
+	return Credentials{}, ErrNoCredentials
+}
+
+// Exchanges the token in AWS_WEB_IDENTITY_TOKEN_FILE for AWS_ROLE_ARN's credentials.
+// AssumeRoleWithWebIdentity is an unsigned STS call.
+func (c *CredentialChain) webIdentity(ctx context.Context) (Credentials, error) {
+	tokenFile, roleARN := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN")
+	if tokenFile == "" || roleARN == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+	if sessionName == "" {
+		sessionName = fmt.Sprintf("scaffold-%d", time.Now().Unix())
+	}
+
+	endpoint := "https://sts." + RegionFromEnv() + ".amazonaws.com/"
+	if custom := os.Getenv("AWS_ENDPOINT_URL_STS"); custom != "" {
+		endpoint = strings.TrimRight(custom, "/") + "/"
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {roleARN},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var result struct {
+		Credentials struct {
+			AccessKeyId     string
+			SecretAccessKey string
+			SessionToken    string
+			Expiration      time.Time
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err := c.fetch(req, func(body io.Reader) error { return xml.NewDecoder(body).Decode(&result) }); err != nil {
+		return Credentials{}, fmt.Errorf("web identity: %w", err)
+	}
+	return Credentials{
+		AccessKeyID:     result.Credentials.AccessKeyId,
+		SecretAccessKey: result.Credentials.SecretAccessKey,
+		SessionToken:    result.Credentials.SessionToken,
+		Expires:         result.Credentials.Expiration,
+	}, nil
+}
+
+// Reads AWS_PROFILE (or "default") from AWS_SHARED_CREDENTIALS_FILE or ~/.aws/credentials
+func sharedCredentials(context.Context) (Credentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return Credentials{}, ErrNoCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Credentials{}, ErrNoCredentials
+	}
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer file.Close()
+
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	var creds Credentials
+	inProfile := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inProfile || !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Credentials{}, err
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+type endpointCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (e endpointCredentials) credentials() Credentials {
+	return Credentials{AccessKeyID: e.AccessKeyId, SecretAccessKey: e.SecretAccessKey, SessionToken: e.Token, Expires: e.Expiration}
+}
+
+// ECS and EKS Pod Identity task role credentials
+func (c *CredentialChain) container(ctx context.Context) (Credentials, error) {
+	endpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if relative := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); relative != "" {
+		endpoint = "http://169.254.170.2" + relative
+	}
+	if endpoint == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); tokenFile != "" {
+		content, err := os.ReadFile(tokenFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+		token = strings.TrimSpace(string(content))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	var result endpointCredentials
+	if err := c.fetch(req, func(body io.Reader) error { return json.NewDecoder(body).Decode(&result) }); err != nil {
+		return Credentials{}, fmt.Errorf("container credentials: %w", err)
+	}
+	return result.credentials(), nil
+}
+
+// EC2 instance profile credentials via IMDSv2. Skipped when AWS_EC2_METADATA_DISABLED
+// is true; off EC2 the short timeout keeps the miss cheap.
+func (c *CredentialChain) instanceMetadata(ctx context.Context) (Credentials, error) {
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return Credentials{}, ErrNoCredentials
+	}
+	base := "http://169.254.169.254"
+	if custom := os.Getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT"); custom != "" {
+		base = strings.TrimRight(custom, "/")
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, base+"/latest/api/token", nil)
+	if err != nil {
+		return Credentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	var token string
+	if err := c.fetch(req, func(body io.Reader) error {
+		content, err := io.ReadAll(body)
+		token = string(content)
+		return err
+	}); err != nil {
+		// Not on EC2, or the metadata service is unreachable
+		return Credentials{}, ErrNoCredentials
+	}
+
+	get := func(path string, decode func(io.Reader) error) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		return c.fetch(req, decode)
+	}
+	var role string
+	if err := get("/latest/meta-data/iam/security-credentials/", func(body io.Reader) error {
+		content, err := io.ReadAll(body)
+		role = strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+		return err
+	}); err != nil || role == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	var result endpointCredentials
+	if err := get("/latest/meta-data/iam/security-credentials/"+role, func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&result)
+	}); err != nil {
+		return Credentials{}, fmt.Errorf("instance credentials: %w", err)
+	}
+	return result.credentials(), nil
+}
+
+func (c *CredentialChain) fetch(req *http.Request, decode func(io.Reader) error) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return decode(io.LimitReader(resp.Body, 1<<20))
+}
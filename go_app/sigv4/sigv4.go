@@ -0,0 +1,183 @@
+// Package sigv4 signs HTTP requests with AWS Signature Version 4, for S3 and
+// S3-compatible services, without pulling in the AWS SDK.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Payload hash for requests whose body is not signed
+const UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+
+// Hash of an empty body
+const EMPTY_PAYLOAD = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// AWS access credentials
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Expires         time.Time // zero for long-lived credentials
+}
+
+var ErrNoCredentials = errors.New("no AWS credentials found")
+
+// Reads credentials from the standard AWS environment variables
+func CredentialsFromEnv() (Credentials, error) {
+	creds := Credentials{
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+	return creds, nil
+}
+
+// Region from AWS_REGION or AWS_DEFAULT_REGION, defaulting to us-east-1
+func RegionFromEnv() string {
+	for _, key := range []string{"AWS_REGION", "AWS_DEFAULT_REGION"} {
+		if region := os.Getenv(key); region != "" {
+			return region
+		}
+	}
+	return "us-east-1"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// Adds the Authorization and x-amz-* headers to req. payloadHash is the hex SHA-256 of
+// the body, EMPTY_PAYLOAD, or UNSIGNED_PAYLOAD.
+func Sign(req *http.Request, creds Credentials, region, service, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(AMZ_DATE_FORMAT))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	scope, signedHeaders, signature := sign(req, creds, region, service, payloadHash, headers, now)
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+// Returns a copy of req's URL that grants its method on its path to anyone holding it
+// until expires has passed. Only the host header is signed, the payload never is.
+func Presign(req *http.Request, creds Credentials, region, service string, expires time.Duration, now time.Time) *url.URL {
+	now = now.UTC()
+	query := req.URL.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", creds.AccessKeyID+"/"+credentialScope(now, region, service))
+	query.Set("X-Amz-Date", now.Format(AMZ_DATE_FORMAT))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if creds.SessionToken != "" {
+		query.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	presigned := *req.URL
+	presigned.RawQuery = canonicalQuery(query)
+	unsigned := &http.Request{Method: req.Method, URL: &presigned}
+	_, _, signature := sign(unsigned, creds, region, service, UNSIGNED_PAYLOAD, map[string]string{"host": req.URL.Host}, now)
+	presigned.RawQuery += "&X-Amz-Signature=" + signature
+	return &presigned
+}
+
+const AMZ_DATE_FORMAT = "20060102T150405Z"
+
+func credentialScope(now time.Time, region, service string) string {
+	return now.Format("20060102") + "/" + region + "/" + service + "/aws4_request"
+}
+
+// Computes the signature over req with the given lower-cased headers
+func sign(req *http.Request, creds Credentials, region, service, payloadHash string, headers map[string]string, now time.Time) (scope, signedHeaders, signature string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders = strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope = credentialScope(now, region, service)
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		now.Format(AMZ_DATE_FORMAT),
+		scope,
+		sha256Hex(canonicalRequest),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format("20060102"))
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	return scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// Query string with sorted keys and AWS-style percent encoding
+func canonicalQuery(values url.Values) string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		sorted := append([]string(nil), values[key]...)
+		sort.Strings(sorted)
+		for _, value := range sorted {
+			parts = append(parts, Escape(key)+"="+Escape(value))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// Percent-encodes s as SigV4 expects: everything except A-Z a-z 0-9 - _ . ~
+func Escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
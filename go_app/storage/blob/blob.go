@@ -0,0 +1,112 @@
+// Package blob stores opaque objects under string keys, on local disk, in S3 (or an
+// S3-compatible store such as MinIO) or in Google Cloud Storage.
+package blob
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var ErrNotFound = errors.New("blob not found")
+
+// Returned by Presign for stores that cannot hand out direct URLs
+var ErrUnsupported = errors.New("blob store does not support presigned URLs")
+
+// Page size used by List when the caller passes no limit
+const DEFAULT_LIST_LIMIT = 1000
+
+// What is known about a stored object
+type Info struct {
+	Key         string
+	Size        int64
+	ContentType string
+	Modified    time.Time
+}
+
+// Object storage. Keys are slash-separated paths without a leading slash.
+type Store interface {
+	// Stores size bytes from body under key, replacing any existing object
+	Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error
+	// Opens the object; the caller closes it. Returns ErrNotFound for missing keys.
+	Get(ctx context.Context, key string) (io.ReadCloser, Info, error)
+	// Removes the object; missing keys are not an error
+	Delete(ctx context.Context, key string) error
+	// Lists up to limit objects below prefix in key order, continuing after cursor.
+	// Page.NextCursor is empty on the last page.
+	List(ctx context.Context, prefix, cursor string, limit int) (Page, error)
+	String() string
+}
+
+// One page of List results
+type Page struct {
+	Items      []Info
+	NextCursor string
+}
+
+// Implemented by stores that can sign URLs for direct client access
+type Presigner interface {
+	// Returns a URL that allows method on key without further credentials until expires
+	Presign(ctx context.Context, method, key string, expires time.Duration) (string, error)
+}
+
+// Presigns through the store, or returns ErrUnsupported
+func Presign(ctx context.Context, store Store, method, key string, expires time.Duration) (string, error) {
+	presigner, ok := store.(Presigner)
+	if !ok {
+		return "", ErrUnsupported
+	}
+	return presigner.Presign(ctx, method, key, expires)
+}
+
+// Creates a store from a directory path, file:///dir, s3://bucket/prefix or
+// gs://bucket/prefix
+func New(spec string) (Store, error) {
+	if !strings.Contains(spec, "://") {
+		return NewLocal(spec)
+	}
+	parsed, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	switch parsed.Scheme {
+	case "file":
+		return NewLocal(parsed.Path)
+	case "s3":
+		if parsed.Host == "" {
+			return nil, fmt.Errorf("%s: bucket is missing", spec)
+		}
+		return NewS3(parsed.Host, strings.Trim(parsed.Path, "/")), nil
+	case "gs":
+		if parsed.Host == "" {
+			return nil, fmt.Errorf("%s: bucket is missing", spec)
+		}
+		return NewGCS(parsed.Host, strings.Trim(parsed.Path, "/")), nil
+	default:
+		return nil, fmt.Errorf("unsupported blob store %q", spec)
+	}
+}
+
+func listLimit(limit int) int {
+	if limit <= 0 || limit > DEFAULT_LIST_LIMIT {
+		return DEFAULT_LIST_LIMIT
+	}
+	return limit
+}
+
+// Rejects keys that could escape a prefix or directory
+func validKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("invalid blob key %q", key)
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return fmt.Errorf("invalid blob key %q", key)
+		}
+	}
+	return nil
+}
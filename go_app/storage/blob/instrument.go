@@ -0,0 +1,116 @@
+package blob
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"io"
+	"runtime/trace"
+	"sync/atomic"
+	"time"
+)
+
+// Per-store operation counts, errors, latency and bytes, published on /debug/vars
+var storeMetrics = expvar.NewMap("blob")
+
+// Called around every operation of an instrumented store, e.g. to start an
+// OpenTelemetry span. The returned function receives the operation's error.
+var TraceHook func(ctx context.Context, store, operation, key string) (context.Context, func(error))
+
+type instrumented struct {
+	Store
+	name    string
+	metrics *expvar.Map
+}
+
+// Wraps store with metrics under name and runtime/trace tasks, which show up in
+// traces taken from /debug/pprof/trace. Presigning passes through when supported.
+func Instrument(store Store, name string) Store {
+	s := &instrumented{Store: store, name: name, metrics: new(expvar.Map)}
+	storeMetrics.Set(name, s.metrics)
+	return s
+}
+
+func (s *instrumented) start(ctx context.Context, operation, key string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, task := trace.NewTask(ctx, "blob."+operation)
+	trace.Log(ctx, "key", key)
+	var hook func(error)
+	if TraceHook != nil {
+		ctx, hook = TraceHook(ctx, s.name, operation, key)
+	}
+	return ctx, func(err error) {
+		s.metrics.Add(operation, 1)
+		s.metrics.Add(operation+"_ms", time.Since(start).Milliseconds())
+		if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrUnsupported) {
+			s.metrics.Add(operation+"_errors", 1)
+		}
+		if hook != nil {
+			hook(err)
+		}
+		task.End()
+	}
+}
+
+func (s *instrumented) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	ctx, done := s.start(ctx, "put", key)
+	counted := &countingReader{Reader: body}
+	err := s.Store.Put(ctx, key, counted, size, contentType)
+	s.metrics.Add("bytes_written", counted.n.Load())
+	done(err)
+	return err
+}
+
+// Latency covers opening the object; bytes are counted as the caller reads them
+func (s *instrumented) Get(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	ctx, done := s.start(ctx, "get", key)
+	body, info, err := s.Store.Get(ctx, key)
+	done(err)
+	if err != nil {
+		return nil, info, err
+	}
+	return &countingReadCloser{countingReader: countingReader{Reader: body}, closer: body, metrics: s.metrics}, info, nil
+}
+
+func (s *instrumented) Delete(ctx context.Context, key string) error {
+	ctx, done := s.start(ctx, "delete", key)
+	err := s.Store.Delete(ctx, key)
+	done(err)
+	return err
+}
+
+func (s *instrumented) List(ctx context.Context, prefix, cursor string, limit int) (Page, error) {
+	ctx, done := s.start(ctx, "list", prefix)
+	page, err := s.Store.List(ctx, prefix, cursor, limit)
+	done(err)
+	return page, err
+}
+
+func (s *instrumented) Presign(ctx context.Context, method, key string, expires time.Duration) (string, error) {
+	ctx, done := s.start(ctx, "presign", key)
+	url, err := Presign(ctx, s.Store, method, key, expires)
+	done(err)
+	return url, err
+}
+
+type countingReader struct {
+	io.Reader
+	n atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+type countingReadCloser struct {
+	countingReader
+	closer  io.Closer
+	metrics *expvar.Map
+}
+
+func (r *countingReadCloser) Close() error {
+	r.metrics.Add("bytes_read", r.n.Swap(0))
+	return r.closer.Close()
+}
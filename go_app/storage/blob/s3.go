@@ -0,0 +1,275 @@
+package blob
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go_app/sigv4"
+)
+
+// Objects in an S3 bucket below an optional key prefix, signed with credentials from
+// the default chain (sigv4.DefaultCredentials). AWS_ENDPOINT_URL_S3 (or
+// AWS_ENDPOINT_URL) points it at S3-compatible storage such as MinIO.
+type S3 struct {
+	Bucket      string
+	Prefix      string
+	Region      string
+	Endpoint    string
+	HTTPClient  *http.Client
+	Credentials func(ctx context.Context) (sigv4.Credentials, error)
+
+	scheme string
+}
+
+func NewS3(bucket, prefix string) *S3 {
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	return &S3{
+		Bucket:   bucket,
+		Prefix:   prefix,
+		Region:   sigv4.RegionFromEnv(),
+		Endpoint: strings.TrimRight(endpoint, "/"),
+		// No overall timeout, objects may be large; requests are bounded by their context
+		HTTPClient:  &http.Client{},
+		Credentials: sigv4.DefaultCredentials,
+		scheme:      "s3",
+	}
+}
+
+// Objects in a Google Cloud Storage bucket through its S3-compatible XML API. It signs
+// with an HMAC key for a service account, taken from GCS_HMAC_ACCESS_KEY_ID and
+// GCS_HMAC_SECRET.
+func NewGCS(bucket, prefix string) *S3 {
+	return &S3{
+		Bucket:      bucket,
+		Prefix:      prefix,
+		Region:      "auto",
+		Endpoint:    "https://storage.googleapis.com",
+		HTTPClient:  &http.Client{},
+		Credentials: gcsCredentials,
+		scheme:      "gs",
+	}
+}
+
+func gcsCredentials(context.Context) (sigv4.Credentials, error) {
+	creds := sigv4.Credentials{
+		AccessKeyID:     os.Getenv("GCS_HMAC_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("GCS_HMAC_SECRET"),
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return sigv4.Credentials{}, fmt.Errorf("%w in GCS_HMAC_ACCESS_KEY_ID/GCS_HMAC_SECRET", sigv4.ErrNoCredentials)
+	}
+	return creds, nil
+}
+
+// Virtual-hosted style on AWS, path style on a custom endpoint
+func (s *S3) bucketURL() string {
+	if s.Endpoint != "" {
+		return s.Endpoint + "/" + s.Bucket
+	}
+	return "https://" + s.Bucket + ".s3." + s.Region + ".amazonaws.com"
+}
+
+func (s *S3) objectURL(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return s.bucketURL() + (&url.URL{Path: "/" + s.fullKey(key)}).EscapedPath(), nil
+}
+
+func (s *S3) fullKey(key string) string {
+	if s.Prefix == "" {
+		return key
+	}
+	return s.Prefix + "/" + key
+}
+
+func (s *S3) do(ctx context.Context, method, key string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(ctx, method, objectURL, body, size, header)
+}
+
+func (s *S3) send(ctx context.Context, method, target string, body io.Reader, size int64, header http.Header) (*http.Response, error) {
+	creds, err := s.credentials(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	payloadHash := sigv4.EMPTY_PAYLOAD
+	if body != nil {
+		// The body is streamed, so it is not part of the signature
+		req.ContentLength = size
+		payloadHash = sigv4.UNSIGNED_PAYLOAD
+	}
+	sigv4.Sign(req, creds, s.Region, "s3", payloadHash, time.Now())
+	return s.HTTPClient.Do(req)
+}
+
+func (s *S3) credentials(ctx context.Context) (sigv4.Credentials, error) {
+	if s.Credentials == nil {
+		return sigv4.DefaultCredentials(ctx)
+	}
+	return s.Credentials(ctx)
+}
+
+func s3Error(resp *http.Response) error {
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("s3: %s: %s", resp.Status, strings.TrimSpace(string(message)))
+}
+
+func (s *S3) Put(ctx context.Context, key string, body io.Reader, size int64, contentType string) error {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, body, size, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, Info, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, 0, nil)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, Info{}, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		return nil, Info{}, s3Error(resp)
+	}
+
+	info := Info{Key: key, Size: resp.ContentLength, ContentType: resp.Header.Get("Content-Type")}
+	if size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64); err == nil {
+		info.Size = size
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.Modified = modified
+	}
+	return resp.Body, info, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+// ListObjectsV2; the cursor is S3's continuation token
+func (s *S3) List(ctx context.Context, prefix, cursor string, limit int) (Page, error) {
+	query := map[string]string{
+		"list-type": "2",
+		"prefix":    s.fullKey(prefix),
+		"max-keys":  strconv.Itoa(listLimit(limit)),
+	}
+	if cursor != "" {
+		query["continuation-token"] = cursor
+	}
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var pairs []string
+	for _, name := range names {
+		pairs = append(pairs, name+"="+sigv4.Escape(query[name]))
+	}
+
+	resp, err := s.send(ctx, http.MethodGet, s.bucketURL()+"/?"+strings.Join(pairs, "&"), nil, 0, nil)
+	if err != nil {
+		return Page{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Page{}, s3Error(resp)
+	}
+
+	var result struct {
+		Contents []struct {
+			Key          string
+			Size         int64
+			LastModified time.Time
+		}
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Page{}, fmt.Errorf("s3: list: %w", err)
+	}
+	var page Page
+	for _, object := range result.Contents {
+		key := object.Key
+		if s.Prefix != "" {
+			key = strings.TrimPrefix(key, s.Prefix+"/")
+		}
+		page.Items = append(page.Items, Info{Key: key, Size: object.Size, Modified: object.LastModified})
+	}
+	if result.IsTruncated {
+		page.NextCursor = result.NextContinuationToken
+	}
+	return page, nil
+}
+
+// Signs a URL a client can use directly, e.g. to download a large object without
+// passing it through the service. S3 caps expires at seven days.
+func (s *S3) Presign(ctx context.Context, method, key string, expires time.Duration) (string, error) {
+	objectURL, err := s.objectURL(key)
+	if err != nil {
+		return "", err
+	}
+	creds, err := s.credentials(ctx)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, objectURL, nil)
+	if err != nil {
+		return "", err
+	}
+	return sigv4.Presign(req, creds, s.Region, "s3", expires, time.Now()).String(), nil
+}
+
+func (s *S3) String() string {
+	scheme := s.scheme
+	if scheme == "" {
+		scheme = "s3"
+	}
+	if s.Prefix == "" {
+		return scheme + "://" + s.Bucket
+	}
+	return scheme + "://" + s.Bucket + "/" + s.Prefix
+}
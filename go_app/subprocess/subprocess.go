@@ -0,0 +1,223 @@
+// Package subprocess runs external commands with a timeout and a cap on their output.
+// Concurrent identical invocations share one process, and successful results can be
+// cached, so a burst of requests never turns into a burst of forks.
+package subprocess
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limits applied when a Command leaves them zero
+const (
+	DEFAULT_TIMEOUT    = 10 * time.Second
+	DEFAULT_MAX_OUTPUT = 1 << 20 // bytes of stdout
+	MAX_STDERR         = 4096    // bytes of stderr kept for error messages
+)
+
+// Process starts, coalesced calls, cache hits, failures and runs killed because every
+// caller gave up, published on /debug/vars
+var metrics = expvar.NewMap("subprocess")
+
+var ErrOutputTooLarge = errors.New("command output exceeds the limit")
+
+// An external command
+type Command struct {
+	Name      string
+	Args      []string
+	Dir       string        // working directory, the process's own when empty
+	Timeout   time.Duration // DEFAULT_TIMEOUT when zero
+	MaxOutput int64         // DEFAULT_MAX_OUTPUT when zero
+}
+
+func (c Command) String() string {
+	return strings.Join(append([]string{c.Name}, c.Args...), " ")
+}
+
+// Identifies identical invocations: the same command line in the same directory
+func (c Command) key() string {
+	dir := c.Dir
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+	return dir + "\x00" + strings.Join(append([]string{c.Name}, c.Args...), "\x00")
+}
+
+type call struct {
+	done    chan struct{}
+	output  []byte
+	err     error
+	waiters int                // callers still waiting, guarded by Runner.mutex
+	cancel  context.CancelFunc // kills the process once no one waits for it
+}
+
+type result struct {
+	output  []byte
+	expires time.Time
+}
+
+// Coalesces and caches command runs. The zero value is not usable, see NewRunner.
+type Runner struct {
+	mutex sync.Mutex
+	calls map[string]*call
+	cache map[string]result
+}
+
+func NewRunner() *Runner {
+	return &Runner{calls: make(map[string]*call), cache: make(map[string]result)}
+}
+
+// Shared by the service's exec calls
+var Default = NewRunner()
+
+// Runs cmd and returns its stdout. A caller arriving while the same command runs waits
+// for that run instead of starting another. A caller giving up stops waiting right
+// away; the process is killed once every caller waiting on it has given up. Failed runs
+// return whatever stdout was read along with an error wrapping *exec.ExitError.
+func (r *Runner) Run(ctx context.Context, cmd Command) ([]byte, error) {
+	key := cmd.key()
+	r.mutex.Lock()
+	c, running := r.calls[key]
+	if !running {
+		processCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call{done: make(chan struct{}), cancel: cancel}
+		r.calls[key] = c
+		go r.start(processCtx, key, cmd, c)
+	} else {
+		metrics.Add("coalesced", 1)
+	}
+	c.waiters++
+	r.mutex.Unlock()
+
+	select {
+	case <-c.done:
+		return c.output, c.err
+	case <-ctx.Done():
+		r.abandon(key, c)
+		return nil, ctx.Err()
+	}
+}
+
+// Drops a waiter, killing the process when it was the last. Later callers start a
+// fresh run rather than joining the one being killed.
+func (r *Runner) abandon(key string, c *call) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	c.waiters--
+	if c.waiters > 0 {
+		return
+	}
+	if r.calls[key] == c {
+		delete(r.calls, key)
+	}
+	c.cancel()
+}
+
+// Like Run, but reuses a successful result for ttl. Failures are not cached.
+func (r *Runner) Cached(ctx context.Context, cmd Command, ttl time.Duration) ([]byte, error) {
+	key := cmd.key()
+	r.mutex.Lock()
+	cached, ok := r.cache[key]
+	r.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		metrics.Add("cache_hits", 1)
+		return cached.output, nil
+	}
+
+	output, err := r.Run(ctx, cmd)
+	if err == nil {
+		r.mutex.Lock()
+		r.cache[key] = result{output: output, expires: time.Now().Add(ttl)}
+		r.mutex.Unlock()
+	}
+	return output, err
+}
+
+func (r *Runner) start(ctx context.Context, key string, cmd Command, c *call) {
+	c.output, c.err = run(ctx, cmd)
+	r.mutex.Lock()
+	if r.calls[key] == c {
+		delete(r.calls, key)
+	}
+	r.mutex.Unlock()
+	c.cancel()
+	close(c.done)
+}
+
+func run(ctx context.Context, cmd Command) ([]byte, error) {
+	timeout, maxOutput := cmd.Timeout, cmd.MaxOutput
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+	if maxOutput <= 0 {
+		maxOutput = DEFAULT_MAX_OUTPUT
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	stdout := &limitedBuffer{limit: maxOutput, exceed: cancel}
+	stderr := &limitedBuffer{limit: MAX_STDERR}
+	process := exec.CommandContext(ctx, cmd.Name, cmd.Args...)
+	process.Dir = cmd.Dir
+	process.Stdout = stdout
+	process.Stderr = stderr
+	// Don't wait forever for pipes held open by a grandchild after the kill
+	process.WaitDelay = time.Second
+
+	metrics.Add("started", 1)
+	err := process.Run()
+	switch {
+	case stdout.exceeded:
+		metrics.Add("failures", 1)
+		return stdout.buffer.Bytes(), fmt.Errorf("%s: %w (%d bytes)", cmd, ErrOutputTooLarge, maxOutput)
+	case ctx.Err() == context.DeadlineExceeded:
+		metrics.Add("timeouts", 1)
+		return stdout.buffer.Bytes(), fmt.Errorf("%s: timed out after %s", cmd, timeout)
+	case ctx.Err() == context.Canceled:
+		metrics.Add("canceled", 1)
+		return stdout.buffer.Bytes(), fmt.Errorf("%s: %w", cmd, ctx.Err())
+	case err != nil:
+		metrics.Add("failures", 1)
+		if message := strings.TrimSpace(stderr.buffer.String()); message != "" {
+			return stdout.buffer.Bytes(), fmt.Errorf("%s: %w: %s", cmd, err, message)
+		}
+		return stdout.buffer.Bytes(), fmt.Errorf("%s: %w", cmd, err)
+	}
+	return stdout.buffer.Bytes(), nil
+}
+
+// Keeps the first limit bytes and drops the rest. With exceed set, going over the
+// limit calls it instead, which kills the process. The buffer is a field rather than
+// embedded so io.Copy cannot bypass Write through bytes.Buffer's ReadFrom.
+type limitedBuffer struct {
+	buffer   bytes.Buffer
+	limit    int64
+	exceed   func()
+	exceeded bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - int64(b.buffer.Len())
+	if int64(len(p)) <= room {
+		return b.buffer.Write(p)
+	}
+	if room > 0 {
+		b.buffer.Write(p[:room])
+	}
+	if b.exceed == nil {
+		return len(p), nil
+	}
+	if !b.exceeded {
+		b.exceeded = true
+		b.exceed()
+	}
+	return 0, ErrOutputTooLarge
+}
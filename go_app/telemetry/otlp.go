@@ -0,0 +1,162 @@
+package telemetry
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults for OTLPExporter
+const (
+	DEFAULT_OTLP_INTERVAL = 30 * time.Second
+	OTLP_METRICS_PATH     = "/v1/metrics"
+	OTLP_TIMEOUT          = 10 * time.Second
+)
+
+// Cumulative temporality: each export carries totals since the registry started
+const otlpCumulative = 2
+
+// Pushes a registry to an OpenTelemetry collector over OTLP/HTTP with the JSON encoding,
+// which needs no generated protobuf code
+type OTLPExporter struct {
+	Endpoint string            // collector base URL, e.g. http://otel-collector:4318
+	Headers  map[string]string // e.g. an API key for a hosted backend
+	Resource []Attr            // describes the process, e.g. service.name
+	Registry *Registry
+	Client   *http.Client
+	Logger   *log.Logger
+}
+
+// Sends the current snapshot once
+func (e *OTLPExporter) Export(ctx context.Context) error {
+	body, err := json.Marshal(otlpRequest(e.Registry.Snapshot(), e.Resource))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, OTLP_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(e.Endpoint, "/")+OTLP_METRICS_PATH, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range e.Headers {
+		req.Header.Set(name, value)
+	}
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP export to %s: %s: %s", e.Endpoint, resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// Exports every interval until ctx is done, then once more so the last measurements
+// aren't lost. Failures are logged and retried at the next tick.
+func (e *OTLPExporter) Run(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = DEFAULT_OTLP_INTERVAL
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if err := e.Export(context.WithoutCancel(ctx)); err != nil {
+				e.Logger.Println("Final metrics export failed:", err)
+			}
+			return
+		case <-ticker.C:
+			if err := e.Export(ctx); err != nil {
+				e.Logger.Println("Metrics export failed:", err)
+			}
+		}
+	}
+}
+
+// The JSON mapping of ExportMetricsServiceRequest. 64-bit integers are strings, and
+// trace and span IDs hex rather than base64, as the OTLP JSON encoding requires.
+func otlpRequest(snapshot Snapshot, resource []Attr) map[string]any {
+	start, now := nanos(snapshot.Start), nanos(snapshot.Time)
+	metrics := []map[string]any{}
+	for _, counter := range snapshot.Counters {
+		points := []map[string]any{}
+		for _, point := range counter.Points {
+			points = append(points, map[string]any{
+				"attributes":        otlpAttributes(point.Attrs),
+				"startTimeUnixNano": start,
+				"timeUnixNano":      now,
+				"asDouble":          point.Value,
+			})
+		}
+		metrics = append(metrics, map[string]any{
+			"name": counter.Name, "description": counter.Description, "unit": counter.Unit,
+			"sum": map[string]any{"aggregationTemporality": otlpCumulative, "isMonotonic": true, "dataPoints": points},
+		})
+	}
+	for _, histogram := range snapshot.Histograms {
+		points := []map[string]any{}
+		for _, point := range histogram.Points {
+			counts := make([]string, len(point.Counts))
+			for i, count := range point.Counts {
+				counts[i] = strconv.FormatUint(count, 10)
+			}
+			exemplars := []map[string]any{}
+			for _, exemplar := range point.Exemplars {
+				if exemplar != nil {
+					exemplars = append(exemplars, map[string]any{
+						"timeUnixNano": nanos(exemplar.Time),
+						"asDouble":     exemplar.Value,
+						"traceId":      exemplar.TraceID,
+						"spanId":       exemplar.SpanID,
+					})
+				}
+			}
+			points = append(points, map[string]any{
+				"attributes":        otlpAttributes(point.Attrs),
+				"startTimeUnixNano": start,
+				"timeUnixNano":      now,
+				"count":             strconv.FormatUint(point.Count, 10),
+				"sum":               point.Sum,
+				"bucketCounts":      counts,
+				"explicitBounds":    histogram.Bounds,
+				"exemplars":         exemplars,
+			})
+		}
+		metrics = append(metrics, map[string]any{
+			"name": histogram.Name, "description": histogram.Description, "unit": histogram.Unit,
+			"histogram": map[string]any{"aggregationTemporality": otlpCumulative, "dataPoints": points},
+		})
+	}
+	return map[string]any{"resourceMetrics": []map[string]any{{
+		"resource":     map[string]any{"attributes": otlpAttributes(resource)},
+		"scopeMetrics": []map[string]any{{"scope": map[string]any{"name": "go_app/telemetry"}, "metrics": metrics}},
+	}}}
+}
+
+func otlpAttributes(attrs []Attr) []map[string]any {
+	converted := make([]map[string]any, len(attrs))
+	for i, attr := range attrs {
+		converted[i] = map[string]any{"key": attr.Key, "value": map[string]any{"stringValue": attr.Value}}
+	}
+	return converted
+}
+
+func nanos(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
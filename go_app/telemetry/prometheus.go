@@ -0,0 +1,87 @@
+package telemetry
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Content types of the two text formats WritePrometheus produces
+const (
+	PROMETHEUS_CONTENT_TYPE  = "text/plain; version=0.0.4; charset=utf-8"
+	OPENMETRICS_CONTENT_TYPE = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+)
+
+// Writes the snapshot in the Prometheus text format, or in OpenMetrics, which is the
+// only one of the two that carries exemplars. The caller ends OpenMetrics output with
+// "# EOF" once everything else it serves is written.
+func WritePrometheus(w io.Writer, snapshot Snapshot, openMetrics bool) {
+	for _, counter := range snapshot.Counters {
+		// Samples end in _total; OpenMetrics names the family without it
+		sample := strings.TrimSuffix(sanitize(counter.Name), "_total") + "_total"
+		family := sample
+		if openMetrics {
+			family = strings.TrimSuffix(sample, "_total")
+		}
+		writeHeader(w, family, counter.Description, "counter")
+		for _, point := range counter.Points {
+			fmt.Fprintf(w, "%s%s %s\n", sample, labels(point.Attrs), formatFloat(point.Value))
+		}
+	}
+	for _, histogram := range snapshot.Histograms {
+		name := sanitize(histogram.Name)
+		writeHeader(w, name, histogram.Description, "histogram")
+		for _, point := range histogram.Points {
+			var cumulative uint64
+			for i, count := range point.Counts {
+				cumulative += count
+				le := "+Inf"
+				if i < len(histogram.Bounds) {
+					le = formatFloat(histogram.Bounds[i])
+				}
+				line := fmt.Sprintf("%s_bucket%s %d", name, labels(point.Attrs, Attr{Key: "le", Value: le}), cumulative)
+				if exemplar := point.Exemplars[i]; openMetrics && exemplar != nil {
+					line += fmt.Sprintf(" # {trace_id=%q,span_id=%q} %s %s", exemplar.TraceID, exemplar.SpanID,
+						formatFloat(exemplar.Value), strconv.FormatFloat(float64(exemplar.Time.UnixMilli())/1000, 'f', 3, 64))
+				}
+				fmt.Fprintln(w, line)
+			}
+			fmt.Fprintf(w, "%s_sum%s %s\n", name, labels(point.Attrs), formatFloat(point.Sum))
+			fmt.Fprintf(w, "%s_count%s %d\n", name, labels(point.Attrs), point.Count)
+		}
+	}
+}
+
+func writeHeader(w io.Writer, family, description, kind string) {
+	if description != "" {
+		fmt.Fprintf(w, "# HELP %s %s\n", family, strings.NewReplacer("\\", `\\`, "\n", `\n`).Replace(description))
+	}
+	fmt.Fprintf(w, "# TYPE %s %s\n", family, kind)
+}
+
+func labels(attrs []Attr, extra ...Attr) string {
+	all := append(append([]Attr(nil), attrs...), extra...)
+	if len(all) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(all))
+	for i, attr := range all {
+		pairs[i] = sanitize(attr.Key) + "=" + strconv.Quote(attr.Value)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Replaces characters Prometheus does not allow in names, e.g. the dots of OTel names
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
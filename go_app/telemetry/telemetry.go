@@ -0,0 +1,268 @@
+// Package telemetry is the instrumentation API handlers use to record custom metrics.
+// Counters and histograms live in a Registry that every configured backend reads:
+// Prometheus scrapes it, the OTLP exporter pushes it. Histograms keep the trace ID of
+// a recent observation in each bucket as an exemplar, linking a slow bucket to a trace.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds, in seconds, for latency histograms
+var DEFAULT_BUCKETS = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// A label on a measurement, e.g. String("route", "GET /status")
+type Attr struct {
+	Key   string
+	Value string
+}
+
+func String(key, value string) Attr {
+	return Attr{Key: key, Value: value}
+}
+
+// Sorted by key, so the same labels in any order make one series
+func normalize(attrs []Attr) ([]Attr, string) {
+	sorted := append([]Attr(nil), attrs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	var key strings.Builder
+	for _, attr := range sorted {
+		fmt.Fprintf(&key, "%q=%q,", attr.Key, attr.Value)
+	}
+	return sorted, key.String()
+}
+
+// Holds the metrics of a process. Instruments are created once, typically in package
+// variables, and are safe for concurrent use.
+type Registry struct {
+	mutex      sync.Mutex
+	start      time.Time
+	counters   map[string]*Counter
+	histograms map[string]*Histogram
+}
+
+func NewRegistry() *Registry {
+	return &Registry{start: time.Now(), counters: map[string]*Counter{}, histograms: map[string]*Histogram{}}
+}
+
+// The registry the service's backends export
+var Default = NewRegistry()
+
+// Returns the counter named name, creating it on first use. unit follows UCUM, e.g.
+// "By" for bytes or "1" for plain counts.
+func (r *Registry) Counter(name, description, unit string) *Counter {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if counter, ok := r.counters[name]; ok {
+		return counter
+	}
+	counter := &Counter{Name: name, Description: description, Unit: unit, series: map[string]*counterSeries{}}
+	r.counters[name] = counter
+	return counter
+}
+
+// Returns the histogram named name, creating it with bounds on first use
+func (r *Registry) Histogram(name, description, unit string, bounds []float64) *Histogram {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if histogram, ok := r.histograms[name]; ok {
+		return histogram
+	}
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	histogram := &Histogram{Name: name, Description: description, Unit: unit, Bounds: bounds, series: map[string]*histogramSeries{}}
+	r.histograms[name] = histogram
+	return histogram
+}
+
+// Counter and Histogram on the Default registry
+func NewCounter(name, description, unit string) *Counter {
+	return Default.Counter(name, description, unit)
+}
+
+func NewHistogram(name, description, unit string, bounds []float64) *Histogram {
+	return Default.Histogram(name, description, unit, bounds)
+}
+
+// A monotonic sum, e.g. jobs processed
+type Counter struct {
+	Name        string
+	Description string
+	Unit        string
+
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	attrs []Attr
+	value float64
+}
+
+// Adds value, which must not be negative, to the series for attrs
+func (c *Counter) Add(ctx context.Context, value float64, attrs ...Attr) {
+	if value < 0 || math.IsNaN(value) {
+		return
+	}
+	sorted, key := normalize(attrs)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	series, ok := c.series[key]
+	if !ok {
+		series = &counterSeries{attrs: sorted}
+		c.series[key] = series
+	}
+	series.value += value
+}
+
+// A distribution of observations, e.g. request durations
+type Histogram struct {
+	Name        string
+	Description string
+	Unit        string
+	Bounds      []float64 // upper bounds; the last bucket is unbounded
+
+	mutex  sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	attrs     []Attr
+	counts    []uint64 // per bucket, len(Bounds)+1
+	count     uint64
+	sum       float64
+	exemplars []*Exemplar // latest traced observation per bucket, nil when none
+}
+
+// An observation linked to the trace it was made in
+type Exemplar struct {
+	Value   float64
+	Time    time.Time
+	TraceID string
+	SpanID  string
+}
+
+// Records value in the series for attrs. When ctx carries a span, the observation
+// becomes its bucket's exemplar.
+func (h *Histogram) Record(ctx context.Context, value float64, attrs ...Attr) {
+	if math.IsNaN(value) {
+		return
+	}
+	sorted, key := normalize(attrs)
+	bucket := sort.SearchFloat64s(h.Bounds, value) // first bound >= value
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	series, ok := h.series[key]
+	if !ok {
+		series = &histogramSeries{
+			attrs:     sorted,
+			counts:    make([]uint64, len(h.Bounds)+1),
+			exemplars: make([]*Exemplar, len(h.Bounds)+1),
+		}
+		h.series[key] = series
+	}
+	series.counts[bucket]++
+	series.count++
+	series.sum += value
+	if span, ok := SpanFromContext(ctx); ok {
+		series.exemplars[bucket] = &Exemplar{Value: value, Time: time.Now(), TraceID: span.TraceID, SpanID: span.SpanID}
+	}
+}
+
+// Point-in-time copies of the registry's series, sorted by name, for exporters
+type CounterData struct {
+	Name, Description, Unit string
+	Points                  []CounterPoint
+}
+
+type CounterPoint struct {
+	Attrs []Attr
+	Value float64
+}
+
+type HistogramData struct {
+	Name, Description, Unit string
+	Bounds                  []float64
+	Points                  []HistogramPoint
+}
+
+type HistogramPoint struct {
+	Attrs     []Attr
+	Counts    []uint64
+	Count     uint64
+	Sum       float64
+	Exemplars []*Exemplar
+}
+
+type Snapshot struct {
+	Start      time.Time // when the registry was created; sums are cumulative since
+	Time       time.Time
+	Counters   []CounterData
+	Histograms []HistogramData
+}
+
+func (r *Registry) Snapshot() Snapshot {
+	r.mutex.Lock()
+	counters := make([]*Counter, 0, len(r.counters))
+	for _, counter := range r.counters {
+		counters = append(counters, counter)
+	}
+	histograms := make([]*Histogram, 0, len(r.histograms))
+	for _, histogram := range r.histograms {
+		histograms = append(histograms, histogram)
+	}
+	r.mutex.Unlock()
+
+	snapshot := Snapshot{Start: r.start, Time: time.Now()}
+	for _, counter := range counters {
+		data := CounterData{Name: counter.Name, Description: counter.Description, Unit: counter.Unit}
+		counter.mutex.Lock()
+		for _, series := range counter.series {
+			data.Points = append(data.Points, CounterPoint{Attrs: series.attrs, Value: series.value})
+		}
+		counter.mutex.Unlock()
+		sortPoints(data.Points, func(p CounterPoint) []Attr { return p.Attrs })
+		snapshot.Counters = append(snapshot.Counters, data)
+	}
+	for _, histogram := range histograms {
+		data := HistogramData{Name: histogram.Name, Description: histogram.Description, Unit: histogram.Unit, Bounds: histogram.Bounds}
+		histogram.mutex.Lock()
+		for _, series := range histogram.series {
+			point := HistogramPoint{
+				Attrs:     series.attrs,
+				Counts:    append([]uint64(nil), series.counts...),
+				Count:     series.count,
+				Sum:       series.sum,
+				Exemplars: make([]*Exemplar, len(series.exemplars)),
+			}
+			for i, exemplar := range series.exemplars {
+				if exemplar != nil {
+					copied := *exemplar
+					point.Exemplars[i] = &copied
+				}
+			}
+			data.Points = append(data.Points, point)
+		}
+		histogram.mutex.Unlock()
+		sortPoints(data.Points, func(p HistogramPoint) []Attr { return p.Attrs })
+		snapshot.Histograms = append(snapshot.Histograms, data)
+	}
+	sort.Slice(snapshot.Counters, func(i, j int) bool { return snapshot.Counters[i].Name < snapshot.Counters[j].Name })
+	sort.Slice(snapshot.Histograms, func(i, j int) bool { return snapshot.Histograms[i].Name < snapshot.Histograms[j].Name })
+	return snapshot
+}
+
+func sortPoints[P any](points []P, attrs func(P) []Attr) {
+	sort.Slice(points, func(i, j int) bool {
+		_, a := normalize(attrs(points[i]))
+		_, b := normalize(attrs(points[j]))
+		return a < b
+	})
+}
@@ -0,0 +1,78 @@
+package telemetry
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+)
+
+// Identifies the trace a request belongs to, as carried by the W3C traceparent header
+type SpanContext struct {
+	TraceID string // 32 lowercase hex digits
+	SpanID  string // 16 lowercase hex digits
+	Sampled bool
+}
+
+type spanContextKey struct{}
+
+func ContextWithSpan(ctx context.Context, span SpanContext) context.Context {
+	return context.WithValue(ctx, spanContextKey{}, span)
+}
+
+func SpanFromContext(ctx context.Context) (SpanContext, bool) {
+	span, ok := ctx.Value(spanContextKey{}).(SpanContext)
+	return span, ok
+}
+
+// Reads a version 00 traceparent, e.g.
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+func ParseTraceparent(header string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	traceID, spanID, flags := parts[1], parts[2], parts[3]
+	if !isHex(traceID, 32) || !isHex(spanID, 16) || !isHex(flags, 2) ||
+		traceID == strings.Repeat("0", 32) || spanID == strings.Repeat("0", 16) {
+		return SpanContext{}, false
+	}
+	flagBits, _ := hex.DecodeString(flags)
+	return SpanContext{TraceID: traceID, SpanID: spanID, Sampled: flagBits[0]&1 == 1}, true
+}
+
+func isHex(value string, length int) bool {
+	if len(value) != length {
+		return false
+	}
+	for _, c := range value {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// A new span in parent's trace, or the root of a new trace when there is no parent
+func NewSpan(parent SpanContext, hasParent bool) SpanContext {
+	span := SpanContext{TraceID: parent.TraceID, SpanID: randomHex(8), Sampled: parent.Sampled}
+	if !hasParent {
+		span.TraceID, span.Sampled = randomHex(16), true
+	}
+	return span
+}
+
+// The traceparent header value for calls made within span
+func (span SpanContext) Traceparent() string {
+	flags := "00"
+	if span.Sampled {
+		flags = "01"
+	}
+	return "00-" + span.TraceID + "-" + span.SpanID + "-" + flags
+}
+
+func randomHex(bytes int) string {
+	buf := make([]byte, bytes)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,187 @@
+// Package testsupport spins up the full service in-process for end-to-end tests.
+package testsupport
+
+import (
+	"crypto/rand"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	"go_app/server"
+)
+
+// Contents of the metadata.json written for every TestApp
+const DEFAULT_METADATA = `{
+  "description": "test application",
+  "version": "0.0.0"
+}`
+
+// Password of the exampleuser account in a TestApp
+const TEST_PASSWORD = "test-password"
+
+// Value of the X-Admin-Token header accepted by a TestApp
+const TEST_ADMIN_TOKEN = "test-admin-token"
+
+// A running App behind an httptest.Server, with a controllable clock
+type TestApp struct {
+	App    *server.App
+	Server *httptest.Server
+	Clock  *server.MockClock
+
+	// Path of the temporary metadata.json, rewrite it to test config changes
+	MetadataPath string
+}
+
+// Starts the full middleware stack against a temp metadata.json and in-memory stores,
+// the ones server.New picks without a database.
+// Everything is torn down when the test finishes.
+func NewTestApp(t testing.TB) *TestApp {
+	t.Helper()
+
+	metadataPath := filepath.Join(t.TempDir(), "metadata.json")
+	if err := os.WriteFile(metadataPath, []byte(DEFAULT_METADATA), 0o644); err != nil {
+		t.Fatalf("write metadata: %v", err)
+	}
+
+	config := server.DefaultConfig()
+	config.MetadataPath = metadataPath
+	config.AdminToken = TEST_ADMIN_TOKEN
+	config.ExampleUserPassword = TEST_PASSWORD
+
+	keys, err := server.NewRandomKeyProvider()
+	if err != nil {
+		t.Fatalf("create key provider: %v", err)
+	}
+	clock := server.NewMockClock(time.Now().Truncate(time.Second))
+
+	// Built the way the service builds itself, so a TestApp gets every store and
+	// default a real one does, only with the clock, keys and logs under the test's control
+	app, err := server.New(config, server.Dependencies{
+		Logger:    log.New(testWriter{t}, "", 0),
+		Overrides: server.Overrides{Clock: clock, Keys: keys},
+	})
+	if err != nil {
+		t.Fatalf("create app: %v", err)
+	}
+	ts := httptest.NewServer(app.Handler())
+	t.Cleanup(ts.Close)
+
+	return &TestApp{
+		App:          app,
+		Server:       ts,
+		Clock:        clock,
+		MetadataPath: metadataPath,
+	}
+}
+
+// Base URL of the test server
+func (ta *TestApp) URL() string {
+	return ta.Server.URL
+}
+
+// Sends a request to the test server, adding a bearer token when token is non-empty.
+// A body is sent as JSON.
+func (ta *TestApp) Do(t testing.TB, method, path, token string, body io.Reader) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(method, ta.Server.URL+path, body)
+	if err != nil {
+		t.Fatalf("build request: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := ta.Server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// Serves req in-process with overrides swapped in for this request only, e.g. a
+// recording store or a clock fixed at the time a request was recorded, leaving the
+// App shared by other requests untouched
+func (ta *TestApp) ServeWith(t testing.TB, overrides server.Overrides, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	recorder := httptest.NewRecorder()
+	ta.App.Handler().ServeHTTP(recorder, req.WithContext(server.WithOverrides(req.Context(), overrides)))
+	return recorder
+}
+
+// Returns a token for exampleuser signed with the App's current key. Each has its own
+// jti, so it passes single-use routes once.
+func (ta *TestApp) ValidToken(t testing.TB) string {
+	t.Helper()
+	now := ta.Clock.Now()
+	return ta.MintToken(t, jwt.MapClaims{
+		"id":       1,
+		"username": "exampleuser",
+		"scope":    ta.App.Config.Tokens.Scopes,
+		"jti":      rand.Text(),
+		"iat":      now.Unix(),
+		"exp":      now.Add(server.TOKEN_EXPIRATION_TIME).Unix(),
+	})
+}
+
+// Returns a correctly signed token for exampleuser whose exp is in the past
+func (ta *TestApp) ExpiredToken(t testing.TB) string {
+	t.Helper()
+	now := ta.Clock.Now()
+	return ta.MintToken(t, jwt.MapClaims{
+		"id":       1,
+		"username": "exampleuser",
+		"iat":      now.Add(-2 * server.TOKEN_EXPIRATION_TIME).Unix(),
+		"exp":      now.Add(-server.TOKEN_EXPIRATION_TIME).Unix(),
+	})
+}
+
+// Returns a valid token whose payload was altered after signing
+func (ta *TestApp) TamperedToken(t testing.TB) string {
+	t.Helper()
+	parts := strings.Split(ta.ValidToken(t), ".")
+	forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"id":       2,
+		"username": "admin",
+	}).SigningString()
+	if err != nil {
+		t.Fatalf("build forged payload: %v", err)
+	}
+	parts[1] = strings.Split(forged, ".")[1]
+	return strings.Join(parts, ".")
+}
+
+// Signs arbitrary claims with the App's current key
+func (ta *TestApp) MintToken(t testing.TB, claims jwt.MapClaims) string {
+	t.Helper()
+	key := ta.App.Keys.Current()
+	unsigned := jwt.NewWithClaims(key.Method, claims)
+	unsigned.Header["kid"] = key.ID
+	token, err := unsigned.SignedString(key.Private)
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+// Routes App logs into the test output
+type testWriter struct {
+	t testing.TB
+}
+
+func (w testWriter) Write(p []byte) (int, error) {
+	w.t.Helper()
+	w.t.Log(strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
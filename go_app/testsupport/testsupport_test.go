@@ -0,0 +1,70 @@
+package testsupport_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"go_app/server"
+	"go_app/testsupport"
+)
+
+func decode(t *testing.T, resp *http.Response, v any) {
+	t.Helper()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("decode %s: %v", resp.Request.URL.Path, err)
+	}
+}
+
+func TestLoginLifecycle(t *testing.T) {
+	ta := testsupport.NewTestApp(t)
+
+	login := ta.Do(t, http.MethodPost, "/login", "", strings.NewReader(`{"username":"exampleuser","password":"`+testsupport.TEST_PASSWORD+`"}`))
+	if login.StatusCode != http.StatusOK {
+		t.Fatalf("POST /login = %d, want 200", login.StatusCode)
+	}
+	var credentials struct{ Token string }
+	decode(t, login, &credentials)
+
+	status := ta.Do(t, http.MethodGet, "/status", credentials.Token, nil)
+	if status.StatusCode != http.StatusOK {
+		t.Fatalf("GET /status = %d, want 200", status.StatusCode)
+	}
+	var body map[string][]map[string]string
+	decode(t, status, &body)
+	if got := body["my-application"][0]["description"]; got != "test application" {
+		t.Errorf("description = %q, want the one of the TestApp's metadata.json", got)
+	}
+
+	// Served from the usage store server.New sets up
+	usage := ta.Do(t, http.MethodGet, "/usage", credentials.Token, nil)
+	if usage.StatusCode != http.StatusOK {
+		t.Fatalf("GET /usage = %d, want 200", usage.StatusCode)
+	}
+
+	if resp := ta.Do(t, http.MethodPost, "/logout", credentials.Token, nil); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("POST /logout = %d, want 204", resp.StatusCode)
+	}
+	if resp := ta.Do(t, http.MethodGet, "/status", credentials.Token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status after logout = %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestTokensFollowTheClock(t *testing.T) {
+	ta := testsupport.NewTestApp(t)
+
+	token := ta.ValidToken(t)
+	if resp := ta.Do(t, http.MethodGet, "/status", token, nil); resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /status = %d, want 200", resp.StatusCode)
+	}
+	if resp := ta.Do(t, http.MethodGet, "/status", ta.ExpiredToken(t), nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status with an expired token = %d, want 401", resp.StatusCode)
+	}
+
+	ta.Clock.Advance(server.TOKEN_EXPIRATION_TIME + time.Second)
+	if resp := ta.Do(t, http.MethodGet, "/status", token, nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("GET /status once the token expired = %d, want 401", resp.StatusCode)
+	}
+}
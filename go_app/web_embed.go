@@ -0,0 +1,20 @@
+//go:build embedweb
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+)
+
+//go:embed all:web/dist
+var embeddedWeb embed.FS
+
+func init() {
+	dist, err := fs.Sub(embeddedWeb, "web/dist")
+	if err != nil {
+		log.Fatal(err)
+	}
+	webFS = dist
+}
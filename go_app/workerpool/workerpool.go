@@ -0,0 +1,171 @@
+// Package workerpool runs expensive tasks on a fixed number of goroutines. Tasks wait
+// in a bounded queue; when it is full, submissions fail fast instead of piling up, so
+// a burst of CPU-heavy or blocking work cannot exhaust goroutines or memory.
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+// Per-pool counters and gauges, published on /debug/vars
+var poolMetrics = expvar.NewMap("worker_pools")
+
+var (
+	ErrQueueFull = errors.New("worker pool queue is full")
+	ErrClosed    = errors.New("worker pool is closed")
+)
+
+type task struct {
+	ctx  context.Context
+	fn   func(context.Context) error
+	done chan error // nil for fire-and-forget tasks
+}
+
+// A fixed set of workers draining a bounded task queue
+type Pool struct {
+	Name   string
+	Logger *log.Logger
+
+	tasks   chan task
+	mutex   sync.RWMutex // guards closing tasks against concurrent sends
+	closed  bool
+	workers sync.WaitGroup
+	busy    atomic.Int64
+	metrics *expvar.Map
+}
+
+// Starts size workers (GOMAXPROCS when size < 1) with room for queueSize waiting tasks
+func New(name string, size, queueSize int, logger *log.Logger) *Pool {
+	if size < 1 {
+		size = runtime.GOMAXPROCS(0)
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	p := &Pool{
+		Name:    name,
+		Logger:  logger,
+		tasks:   make(chan task, queueSize),
+		metrics: new(expvar.Map),
+	}
+	p.metrics.Set("workers", expvar.Func(func() interface{} { return size }))
+	p.metrics.Set("busy", expvar.Func(func() interface{} { return p.busy.Load() }))
+	p.metrics.Set("queued", expvar.Func(func() interface{} { return len(p.tasks) }))
+	poolMetrics.Set(name, p.metrics)
+
+	for i := 0; i < size; i++ {
+		p.workers.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+func (p *Pool) work() {
+	defer p.workers.Done()
+	for t := range p.tasks {
+		// Callers that gave up while the task was queued don't need it run
+		if err := t.ctx.Err(); err != nil {
+			p.metrics.Add("canceled", 1)
+			p.finish(t, err)
+			continue
+		}
+		p.busy.Add(1)
+		err := p.run(t)
+		p.busy.Add(-1)
+		p.metrics.Add("completed", 1)
+		p.finish(t, err)
+	}
+}
+
+func (p *Pool) run(t task) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			p.metrics.Add("panics", 1)
+			p.Logger.Printf("Worker pool %s task panicked: %v\n%s", p.Name, recovered, debug.Stack())
+			err = fmt.Errorf("task panicked: %v", recovered)
+		}
+	}()
+	return t.fn(t.ctx)
+}
+
+func (p *Pool) finish(t task, err error) {
+	if t.done != nil {
+		t.done <- err
+		return
+	}
+	if err != nil && !errors.Is(err, context.Canceled) {
+		p.Logger.Printf("Worker pool %s task failed: %v", p.Name, err)
+	}
+}
+
+func (p *Pool) enqueue(t task) error {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.closed {
+		return ErrClosed
+	}
+	select {
+	case p.tasks <- t:
+		p.metrics.Add("submitted", 1)
+		return nil
+	default:
+		p.metrics.Add("rejected", 1)
+		return ErrQueueFull
+	}
+}
+
+// Runs fn on a worker and waits for its result. Returns ErrQueueFull right away when
+// the queue has no room, and ctx.Err() when ctx ends first; fn receives ctx as well.
+func (p *Pool) Do(ctx context.Context, fn func(context.Context) error) error {
+	t := task{ctx: ctx, fn: fn, done: make(chan error, 1)}
+	if err := p.enqueue(t); err != nil {
+		return err
+	}
+	select {
+	case err := <-t.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Queues fn without waiting for it; errors and panics are logged. Use a context that
+// outlives the request, such as context.WithoutCancel(r.Context()).
+func (p *Pool) Submit(ctx context.Context, fn func(context.Context) error) error {
+	return p.enqueue(task{ctx: ctx, fn: fn})
+}
+
+// Stops accepting tasks and waits for the queued ones to finish
+func (p *Pool) Close() {
+	p.mutex.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.tasks)
+	}
+	p.mutex.Unlock()
+	p.workers.Wait()
+}
+
+// Runs fn on the pool and returns its value, see Pool.Do. The value is discarded when
+// there is an error, since fn may still be running after ctx ended.
+func Run[T any](ctx context.Context, p *Pool, fn func(context.Context) (T, error)) (T, error) {
+	var result T
+	err := p.Do(ctx, func(ctx context.Context) error {
+		var err error
+		result, err = fn(ctx)
+		return err
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}